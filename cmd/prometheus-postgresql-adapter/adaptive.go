@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+const (
+	// adaptiveBatchWindow is the number of batches written at a size before the size is adjusted.
+	adaptiveBatchWindow = 20
+	// adaptiveBatchSteps is the number of additive increases from the minimum to the maximum size.
+	adaptiveBatchSteps = 20
+	// adaptiveBatchHeadroom is the fraction of the latency target under which the batch size grows. Between
+	// it and the target, the size holds, so that it settles instead of oscillating around the target.
+	adaptiveBatchHeadroom = 0.8
+)
+
+// batchController adjusts the batch size with AIMD, between a minimum and a maximum. Once a window of
+// batches was written at a size, the size grows by a step if their p95 write duration is under the headroom
+// of the latency target, and halves if it is over the target.
+type batchController struct {
+	lower, upper, step int
+	target             time.Duration
+
+	mutex sync.Mutex
+	size  int
+	// durations are those of the batches written since the last adjustment
+	durations []time.Duration
+}
+
+// newBatchController returns a controller starting at the maximum size, where writes are not split.
+func newBatchController(lower, upper int, target time.Duration) *batchController {
+	return &batchController{
+		lower:  lower,
+		upper:  upper,
+		step:   max(1, (upper-lower)/adaptiveBatchSteps),
+		target: target,
+		size:   upper,
+	}
+}
+
+func (c *batchController) current() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+// observe records the duration of a batch write and adjusts the size at the end of a window. It returns the
+// p95 of the window and whether the size changed.
+func (c *batchController) observe(d time.Duration) (time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.durations = append(c.durations, d)
+	if len(c.durations) < adaptiveBatchWindow {
+		return 0, false
+	}
+	sort.Slice(c.durations, func(i, j int) bool { return c.durations[i] < c.durations[j] })
+	p95 := c.durations[(len(c.durations)*95-1)/100]
+	c.durations = c.durations[:0]
+	previous := c.size
+	switch {
+	case p95 > c.target:
+		c.size = max(c.lower, c.size/2)
+	case p95 < time.Duration(adaptiveBatchHeadroom*float64(c.target)):
+		c.size = min(c.upper, c.size+c.step)
+	}
+	return p95, c.size != previous
+}
+
+// adaptiveWriter writes the samples of a write in batches of the size of its controller, which it feeds the
+// durations of the batches.
+type adaptiveWriter struct {
+	next       writers.Writer
+	controller *batchController
+	size       prometheus.Gauge
+}
+
+func newAdaptiveWriter(next writers.Writer, controller *batchController, size prometheus.Gauge) *adaptiveWriter {
+	size.Set(float64(controller.current()))
+	return &adaptiveWriter{next: next, controller: controller, size: size}
+}
+
+// WriteContext writes the samples batch by batch, stopping at the first failing batch. Batches with samples
+// rejected as invalid data don't stop the write, their rejections are summed up in a PartialWriteError.
+func (a *adaptiveWriter) WriteContext(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	var stats writers.WriteStats
+	var partial *pgprometheus.PartialWriteError
+	total := len(samples)
+	for len(samples) > 0 {
+		n := min(a.controller.current(), len(samples))
+		begin := time.Now()
+		batchStats, err := a.next.WriteContext(ctx, samples[:n])
+		a.observe(n, time.Since(begin))
+		stats.Add(batchStats)
+		var batchPartial *pgprometheus.PartialWriteError
+		switch {
+		case errors.As(err, &batchPartial):
+			if partial == nil {
+				partial = &pgprometheus.PartialWriteError{Err: batchPartial.Err}
+			}
+			partial.Rejected += batchPartial.Rejected
+		case err != nil:
+			return stats, err
+		}
+		samples = samples[n:]
+	}
+	if partial != nil {
+		partial.Written = total - partial.Rejected
+		return stats, partial
+	}
+	return stats, nil
+}
+
+func (a *adaptiveWriter) observe(n int, d time.Duration) {
+	p95, changed := a.controller.observe(d)
+	if !changed {
+		return
+	}
+	size := a.controller.current()
+	a.size.Set(float64(size))
+	log.Debug("msg", "Adjusted the write batch size", "size", size, "p95", p95, "target", a.controller.target, "last_batch", n)
+}
+
+func (a *adaptiveWriter) Name() string {
+	return a.next.Name()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// runController feeds the controller windows of batch durations given by latency, returning the size after
+// each window.
+func runController(t *testing.T, c *batchController, windows int, latency func(size int) time.Duration) []int {
+	t.Helper()
+	sizes := make([]int, windows)
+	for i := range sizes {
+		for j := 0; j < adaptiveBatchWindow; j++ {
+			c.observe(latency(c.current()))
+		}
+		sizes[i] = c.current()
+		if sizes[i] < c.lower || sizes[i] > c.upper {
+			t.Fatalf("Window %d: size %d out of the bounds [%d, %d]", i, sizes[i], c.lower, c.upper)
+		}
+	}
+	return sizes
+}
+
+// linearLatency is the write latency of a batch growing linearly with its size.
+func linearLatency(fixed time.Duration, perSample time.Duration) func(size int) time.Duration {
+	return func(size int) time.Duration {
+		return fixed + time.Duration(size)*perSample
+	}
+}
+
+func TestBatchControllerConverges(t *testing.T) {
+	target := time.Second
+	c := newBatchController(100, 100000, target)
+	latency := linearLatency(10*time.Millisecond, 20*time.Microsecond)
+	sizes := runController(t, c, 100, latency)
+
+	checkSettled(t, sizes, latency, target)
+
+	// a slower database, eg. during a backup, shrinks the batches, which grow again afterwards
+	slow := linearLatency(10*time.Millisecond, 80*time.Microsecond)
+	checkSettled(t, runController(t, c, 50, slow), slow, target)
+	checkSettled(t, runController(t, c, 50, latency), latency, target)
+}
+
+// checkSettled checks that the size stays the same over the last 20 windows, taking between the headroom
+// and the target.
+func checkSettled(t *testing.T, sizes []int, latency func(size int) time.Duration, target time.Duration) {
+	t.Helper()
+	settled := sizes[len(sizes)-20]
+	for i, size := range sizes[len(sizes)-20:] {
+		if size != settled {
+			t.Fatalf("Expected the size to settle at %d, got %d in window %d", settled, size, len(sizes)-20+i)
+		}
+	}
+	if d := latency(settled); d > target || d < time.Duration(adaptiveBatchHeadroom*float64(target)) {
+		t.Errorf("Expected the settled size %d to take between 80%% and 100%% of the target, got %v", settled, d)
+	}
+}
+
+func TestBatchControllerBounds(t *testing.T) {
+	c := newBatchController(500, 10000, time.Second)
+	sizes := runController(t, c, 20, func(int) time.Duration { return time.Minute })
+	if sizes[len(sizes)-1] != 500 {
+		t.Errorf("Expected the size to drop to the minimum, got %d", sizes[len(sizes)-1])
+	}
+	sizes = runController(t, c, 40, func(int) time.Duration { return time.Millisecond })
+	if sizes[len(sizes)-1] != 10000 {
+		t.Errorf("Expected the size to grow to the maximum, got %d", sizes[len(sizes)-1])
+	}
+
+	// a single slow batch in a window doesn't move the p95
+	for i := 0; i < adaptiveBatchWindow; i++ {
+		d := time.Millisecond
+		if i == 0 {
+			d = time.Minute
+		}
+		c.observe(d)
+	}
+	if c.current() != 10000 {
+		t.Errorf("Expected a single outlier to be ignored, got size %d", c.current())
+	}
+}
+
+func TestAdaptiveWriter(t *testing.T) {
+	next := &fakeWriter{}
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_adaptive_batch_size"})
+	writer := newAdaptiveWriter(next, newBatchController(2, 4, time.Second), gauge)
+	if testutil.ToFloat64(gauge) != 4 {
+		t.Errorf("Expected the gauge to start at the maximum size, got %v", testutil.ToFloat64(gauge))
+	}
+	samples := make(model.Samples, 10)
+	for i := range samples {
+		samples[i] = &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: model.Time(i)}
+	}
+	stats, err := writer.WriteContext(context.Background(), samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.calls != 3 || len(next.samples) != 10 || stats.Written != 10 {
+		t.Errorf("Expected 10 samples written in 3 batches, got %d samples in %d batches, %d written", len(next.samples), next.calls, stats.Written)
+	}
+
+	// the batches go on after samples were rejected, and the rejections add up
+	partial := &partialWriter{}
+	writer = newAdaptiveWriter(partial, newBatchController(2, 4, time.Second), gauge)
+	_, err = writer.WriteContext(context.Background(), samples)
+	var partialErr *pgprometheus.PartialWriteError
+	if !errors.As(err, &partialErr) || partialErr.Rejected != 3 || partialErr.Written != 7 {
+		t.Errorf("Expected 3 of 10 samples to be rejected, got %v", err)
+	}
+
+	next = &fakeWriter{err: errors.New("connection refused")}
+	writer = newAdaptiveWriter(next, newBatchController(2, 4, time.Second), gauge)
+	if _, err := writer.WriteContext(context.Background(), samples); err == nil || next.calls != 1 {
+		t.Errorf("Expected the write to stop at the first failing batch, got %v after %d batches", err, next.calls)
+	}
+}
+
+// partialWriter rejects one sample of each batch.
+type partialWriter struct{}
+
+func (p *partialWriter) WriteContext(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	return writers.WriteStats{Written: len(samples) - 1}, &pgprometheus.PartialWriteError{Written: len(samples) - 1, Rejected: 1, Err: errors.New("invalid")}
+}
+
+func (p *partialWriter) Name() string {
+	return "partial"
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/cardinality"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+const (
+	deleteSeriesPath = "/api/v1/admin/tsdb/delete_series"
+	checkIndexesPath = "/admin/check-indexes"
+	labelCachePath   = "/admin/cache/labels"
+	labelsReloadPath = "/admin/labels/reload"
+	// suppressedMetricsPath lists the metrics over -write-max-series-per-metric
+	suppressedMetricsPath = "/admin/cardinality/suppressed"
+)
+
+// labelCacheHottest is the default number of hottest series listed by the label cache endpoint.
+const labelCacheHottest = 10
+
+type seriesDeleter interface {
+	DeleteSeries(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, opts pgprometheus.DeleteOptions, progress func(deleted int64)) error
+}
+
+type indexChecker interface {
+	CheckIndexes(ctx context.Context) ([]pgprometheus.IndexStatus, error)
+}
+
+type labelCacher interface {
+	LabelCacheStats(top int) (pgprometheus.LabelCacheStats, bool)
+	FlushLabelCache() (int, bool)
+}
+
+type labelReloader interface {
+	ReloadLabels(ctx context.Context) (int, bool, error)
+}
+
+type suppressionLister interface {
+	Suppressed() []cardinality.Suppression
+	Unsuppress(metric string) bool
+}
+
+// Delete job states
+const (
+	jobRunning  = "running"
+	jobFinished = "finished"
+	jobFailed   = "failed"
+)
+
+// deleteJob is the progress report of a background series deletion.
+type deleteJob struct {
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Deleted  int64      `json:"deletedSamples"`
+	Error    string     `json:"error,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// deleteJobRetention is how long the progress report of a finished deletion is kept.
+const deleteJobRetention = time.Hour
+
+// deleteJobs runs series deletions in the background and keeps track of their progress.
+type deleteJobs struct {
+	deleter   seriesDeleter
+	retention time.Duration
+	// ctx is canceled by stop, aborting the running deletions.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+
+	mutex sync.Mutex
+	// opts are the options of new deletions, replaced by configuration reloads
+	opts   pgprometheus.DeleteOptions
+	nextID int
+	jobs   map[string]*deleteJob
+}
+
+func newDeleteJobs(deleter seriesDeleter, opts pgprometheus.DeleteOptions) *deleteJobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &deleteJobs{deleter: deleter, opts: opts, retention: deleteJobRetention, ctx: ctx, cancel: cancel, jobs: map[string]*deleteJob{}}
+}
+
+// start launches a deletion and returns its job ID.
+func (d *deleteJobs) start(selectors [][]*labels.Matcher, start, end time.Time, removeOrphans bool) string {
+	d.mutex.Lock()
+	d.evictLocked(time.Now())
+	d.nextID++
+	job := &deleteJob{ID: strconv.Itoa(d.nextID), State: jobRunning, Started: time.Now()}
+	d.jobs[job.ID] = job
+	opts := d.opts
+	d.mutex.Unlock()
+
+	opts.RemoveOrphans = removeOrphans
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		err := d.deleter.DeleteSeries(d.ctx, selectors, start, end, opts, func(deleted int64) {
+			d.mutex.Lock()
+			job.Deleted = deleted
+			d.mutex.Unlock()
+		})
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		now := time.Now()
+		job.Finished = &now
+		if err != nil {
+			log.Error("msg", "Series deletion failed", "job", job.ID, "err", err)
+			job.State = jobFailed
+			job.Error = err.Error()
+			return
+		}
+		log.Info("msg", "Series deletion finished", "job", job.ID, "deleted", job.Deleted)
+		job.State = jobFinished
+	}()
+	return job.ID
+}
+
+// setOptions sets the options of the deletions started from now on.
+func (d *deleteJobs) setOptions(opts pgprometheus.DeleteOptions) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.opts = opts
+}
+
+// evictLocked forgets the jobs that finished more than the retention ago. d.mutex must be held.
+func (d *deleteJobs) evictLocked(now time.Time) {
+	for id, job := range d.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > d.retention {
+			delete(d.jobs, id)
+		}
+	}
+}
+
+// stop cancels the running deletions and waits for them to return, or for ctx to be done.
+func (d *deleteJobs) stop(ctx context.Context) error {
+	d.cancel()
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *deleteJobs) get(id string) (deleteJob, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.evictLocked(time.Now())
+	job, ok := d.jobs[id]
+	if !ok {
+		return deleteJob{}, false
+	}
+	return *job, true
+}
+
+// handler serves POST /api/v1/admin/tsdb/delete_series and GET /api/v1/admin/tsdb/delete_series/<id>
+func (d *deleteJobs) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == deleteSeriesPath {
+			if r.Method != http.MethodPost {
+				util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+				return
+			}
+			d.startHandler(w, r)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, deleteSeriesPath+"/")
+		if r.Method != http.MethodGet {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		job, ok := d.get(id)
+		if !ok {
+			util.WriteAPIError(w, http.StatusNotFound, errorBadData, util.ErrCodeBadRequest, "unknown delete job", nil)
+			return
+		}
+		writeAPIData(w, job)
+	})
+}
+
+func (d *deleteJobs) startHandler(w http.ResponseWriter, r *http.Request) {
+	selectors, start, end, err := parseSeriesParams(r)
+	if err != nil {
+		util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+		return
+	}
+	if len(selectors) == 0 {
+		util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "no match[] parameter provided", nil)
+		return
+	}
+	removeOrphans := false
+	if v := r.Form.Get("remove_orphans"); v != "" {
+		removeOrphans, err = strconv.ParseBool(v)
+		if err != nil {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "invalid remove_orphans parameter", nil)
+			return
+		}
+	}
+	id := d.start(selectors, start, end, removeOrphans)
+	log.Info("msg", "Started series deletion", "job", id, "match", r.Form["match[]"])
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeAPIData(w, map[string]string{"id": id})
+}
+
+// checkIndexesHandler serves POST /admin/check-indexes, reporting the state of the expected indexes. Missing
+// indexes are created in the background with -pg-create-missing-indexes.
+func checkIndexesHandler(checker indexChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		statuses, err := checker.CheckIndexes(r.Context())
+		if err != nil {
+			util.WriteAPIError(w, http.StatusInternalServerError, errorExecution, util.ErrCodeInternal, "error checking indexes", err)
+			return
+		}
+		writeAPIData(w, statuses)
+	})
+}
+
+// labelCacheHandler serves GET /admin/cache/labels, reporting the size, hits and misses of the label cache with
+// its hottest series, limited by the limit parameter, and DELETE /admin/cache/labels, flushing it.
+func labelCacheHandler(cache labelCacher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			top := labelCacheHottest
+			if v := r.URL.Query().Get("limit"); v != "" {
+				var err error
+				if top, err = strconv.Atoi(v); err != nil || top < 0 {
+					util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "invalid limit parameter", nil)
+					return
+				}
+			}
+			stats, enabled := cache.LabelCacheStats(top)
+			if !enabled {
+				util.WriteAPIError(w, http.StatusNotFound, errorBadData, util.ErrCodeBadRequest, "the label cache is disabled", nil)
+				return
+			}
+			writeAPIData(w, stats)
+		case http.MethodDelete:
+			flushed, enabled := cache.FlushLabelCache()
+			if !enabled {
+				util.WriteAPIError(w, http.StatusNotFound, errorBadData, util.ErrCodeBadRequest, "the label cache is disabled", nil)
+				return
+			}
+			log.Info("msg", "Flushed the label cache", "series", flushed)
+			writeAPIData(w, map[string]int{"flushed": flushed})
+		default:
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+		}
+	})
+}
+
+// labelsReloadHandler serves POST /admin/labels/reload, loading the label sets of -pg-labels-readonly again,
+// so that the samples of newly provisioned series are written without waiting for the refresh interval.
+func labelsReloadHandler(reloader labelReloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		series, enabled, err := reloader.ReloadLabels(r.Context())
+		if !enabled {
+			util.WriteAPIError(w, http.StatusNotFound, errorBadData, util.ErrCodeBadRequest, "the labels aren't read-only", nil)
+			return
+		}
+		if err != nil {
+			util.WriteAPIError(w, http.StatusInternalServerError, errorExecution, util.ErrCodeInternal, "error reloading the labels, the previous ones are kept", err)
+			return
+		}
+		log.Info("msg", "Reloaded the label sets", "series", series)
+		writeAPIData(w, map[string]int{"series": series})
+	})
+}
+
+// suppressedMetricsHandler serves GET /admin/cardinality/suppressed, listing the metrics over the series
+// limit, and DELETE /admin/cardinality/suppressed?metric=<name>, unsuppressing a metric so that its series
+// are counted from scratch.
+func suppressedMetricsHandler(guard suppressionLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeAPIData(w, guard.Suppressed())
+		case http.MethodDelete:
+			metric := r.URL.Query().Get("metric")
+			if metric == "" {
+				util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "no metric parameter provided", nil)
+				return
+			}
+			if !guard.Unsuppress(metric) {
+				util.WriteAPIError(w, http.StatusNotFound, errorBadData, util.ErrCodeBadRequest, "the metric is not suppressed", nil)
+				return
+			}
+			writeAPIData(w, map[string]string{"unsuppressed": metric})
+		default:
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+		}
+	})
+}
+
+// adminAuth only lets requests through that carry the admin API token as bearer token.
+func adminAuth(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			util.WriteAPIError(w, http.StatusUnauthorized, errorBadData, util.ErrCodeUnauthorized, "unauthorized", nil)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
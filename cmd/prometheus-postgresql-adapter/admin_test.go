@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/cardinality"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+)
+
+type fakeSeriesDeleter struct {
+	selectors [][]*labels.Matcher
+	opts      pgprometheus.DeleteOptions
+	err       error
+}
+
+func (f *fakeSeriesDeleter) DeleteSeries(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, opts pgprometheus.DeleteOptions, progress func(deleted int64)) error {
+	f.selectors, f.opts = selectors, opts
+	progress(10)
+	progress(15)
+	return f.err
+}
+
+func waitForJob(t *testing.T, jobs *deleteJobs, id string) deleteJob {
+	for i := 0; i < 100; i++ {
+		job, ok := jobs.get(id)
+		if !ok {
+			t.Fatalf("Job %s not found", id)
+		}
+		if job.State != jobRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return deleteJob{}
+}
+
+func TestDeleteSeriesAPI(t *testing.T) {
+	deleter := &fakeSeriesDeleter{}
+	jobs := newDeleteJobs(deleter, pgprometheus.DeleteOptions{BatchSize: 100})
+	handler := adminAuth("secret", jobs.handler())
+
+	req := httptest.NewRequest("POST", deleteSeriesPath+`?match[]=up{job="node"}&remove_orphans=true`, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected HTTP 202, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", contentType)
+	}
+	var started struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &started); err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitForJob(t, jobs, started.Data.ID)
+	if job.State != jobFinished || job.Deleted != 15 {
+		t.Errorf("Unexpected job %+v", job)
+	}
+	if !deleter.opts.RemoveOrphans || deleter.opts.BatchSize != 100 || len(deleter.selectors) != 1 {
+		t.Errorf("Unexpected delete call %+v %v", deleter.opts, deleter.selectors)
+	}
+
+	req = httptest.NewRequest("GET", deleteSeriesPath+"/"+started.Data.ID, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"state":"finished"`) {
+		t.Errorf("Unexpected job status %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDeleteSeriesAPIFailedJob(t *testing.T) {
+	jobs := newDeleteJobs(&fakeSeriesDeleter{err: errors.New("boom")}, pgprometheus.DeleteOptions{BatchSize: 100})
+	id := jobs.start(nil, time.Time{}, time.Time{}, false)
+	job := waitForJob(t, jobs, id)
+	if job.State != jobFailed || job.Error != "boom" || job.Finished == nil {
+		t.Errorf("Unexpected job %+v", job)
+	}
+}
+
+func TestDeleteSeriesAPIEvictsFinishedJobs(t *testing.T) {
+	jobs := newDeleteJobs(&fakeSeriesDeleter{}, pgprometheus.DeleteOptions{BatchSize: 100})
+	id := jobs.start(nil, time.Time{}, time.Time{}, false)
+	waitForJob(t, jobs, id)
+	jobs.mutex.Lock()
+	jobs.retention = time.Millisecond
+	jobs.mutex.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := jobs.get(id); ok {
+		t.Errorf("Expected job %s to be evicted after the retention", id)
+	}
+}
+
+type blockingSeriesDeleter struct{}
+
+func (blockingSeriesDeleter) DeleteSeries(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, opts pgprometheus.DeleteOptions, progress func(deleted int64)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestDeleteSeriesAPIStop(t *testing.T) {
+	jobs := newDeleteJobs(blockingSeriesDeleter{}, pgprometheus.DeleteOptions{BatchSize: 100})
+	id := jobs.start(nil, time.Time{}, time.Time{}, false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := jobs.stop(ctx); err != nil {
+		t.Fatalf("Running deletion wasn't canceled: %v", err)
+	}
+	job, ok := jobs.get(id)
+	if !ok || job.State != jobFailed || job.Error != context.Canceled.Error() {
+		t.Errorf("Unexpected job %+v", job)
+	}
+}
+
+func TestDeleteSeriesAPIErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "no token", method: "POST", path: deleteSeriesPath + "?match[]=up", status: 401},
+		{name: "wrong token", method: "POST", path: deleteSeriesPath + "?match[]=up", token: "guess", status: 401},
+		{name: "no match", method: "POST", path: deleteSeriesPath, token: "secret", status: 400},
+		{name: "bad orphans flag", method: "POST", path: deleteSeriesPath + "?match[]=up&remove_orphans=maybe", token: "secret", status: 400},
+		{name: "get without id", method: "GET", path: deleteSeriesPath, token: "secret", status: 405},
+		{name: "unknown job", method: "GET", path: deleteSeriesPath + "/42", token: "secret", status: 404},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			jobs := newDeleteJobs(&fakeSeriesDeleter{}, pgprometheus.DeleteOptions{BatchSize: 100})
+			req := httptest.NewRequest(c.method, c.path, nil)
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			recorder := httptest.NewRecorder()
+			adminAuth("secret", jobs.handler()).ServeHTTP(recorder, req)
+			if recorder.Code != c.status {
+				t.Errorf("Expected status %d, got %d: %s", c.status, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+type fakeLabelCacher struct {
+	disabled bool
+	top      int
+	flushed  bool
+}
+
+func (f *fakeLabelCacher) LabelCacheStats(top int) (pgprometheus.LabelCacheStats, bool) {
+	f.top = top
+	return pgprometheus.LabelCacheStats{Size: 1, Capacity: 10, Hits: 3, Hottest: []pgprometheus.LabelCacheEntry{{Series: `up{job="node"}`, Hits: 3}}}, !f.disabled
+}
+
+func (f *fakeLabelCacher) FlushLabelCache() (int, bool) {
+	f.flushed = true
+	return 1, !f.disabled
+}
+
+func TestLabelCacheAPI(t *testing.T) {
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		disabled bool
+		status   int
+		body     string
+		top      int
+		flushed  bool
+	}{
+		{name: "stats", method: "GET", path: labelCachePath, status: 200, body: `"hottest":[{"series":"up{job=\"node\"}","hits":3}]`, top: labelCacheHottest},
+		{name: "stats limit", method: "GET", path: labelCachePath + "?limit=3", status: 200, top: 3},
+		{name: "bad limit", method: "GET", path: labelCachePath + "?limit=-1", status: 400},
+		{name: "flush", method: "DELETE", path: labelCachePath, status: 200, body: `"flushed":1`, flushed: true},
+		{name: "disabled", method: "GET", path: labelCachePath, disabled: true, status: 404, top: labelCacheHottest},
+		{name: "flush disabled", method: "DELETE", path: labelCachePath, disabled: true, status: 404, flushed: true},
+		{name: "post", method: "POST", path: labelCachePath, status: 405},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			cache := &fakeLabelCacher{disabled: c.disabled}
+			recorder := httptest.NewRecorder()
+			labelCacheHandler(cache).ServeHTTP(recorder, httptest.NewRequest(c.method, c.path, nil))
+			if recorder.Code != c.status || !strings.Contains(recorder.Body.String(), c.body) {
+				t.Errorf("Expected status %d with %s, got %d: %s", c.status, c.body, recorder.Code, recorder.Body.String())
+			}
+			if cache.top != c.top || cache.flushed != c.flushed {
+				t.Errorf("Expected limit %d and flush %v, got %d and %v", c.top, c.flushed, cache.top, cache.flushed)
+			}
+		})
+	}
+}
+
+type fakeLabelReloader struct {
+	disabled bool
+	err      error
+}
+
+func (f fakeLabelReloader) ReloadLabels(ctx context.Context) (int, bool, error) {
+	return 2000, !f.disabled, f.err
+}
+
+func TestLabelsReloadAPI(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		method   string
+		reloader fakeLabelReloader
+		status   int
+		body     string
+	}{
+		{name: "reload", method: "POST", status: 200, body: `"series":2000`},
+		{name: "disabled", method: "POST", reloader: fakeLabelReloader{disabled: true}, status: 404},
+		{name: "error", method: "POST", reloader: fakeLabelReloader{err: errors.New("too many label sets")}, status: 500, body: "error reloading the labels"},
+		{name: "get", method: "GET", status: 405},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			labelsReloadHandler(c.reloader).ServeHTTP(recorder, httptest.NewRequest(c.method, labelsReloadPath, nil))
+			if recorder.Code != c.status || !strings.Contains(recorder.Body.String(), c.body) {
+				t.Errorf("Expected status %d with %s, got %d: %s", c.status, c.body, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestSuppressedMetricsAPI(t *testing.T) {
+	guard := cardinality.NewGuard(1, time.Hour)
+	guard.Admit(model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "events", "ts": "1"}},
+		{Metric: model.Metric{model.MetricNameLabel: "events", "ts": "2"}},
+	})
+	handler := suppressedMetricsHandler(guard)
+	for _, c := range []struct {
+		name   string
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{name: "list", method: "GET", path: suppressedMetricsPath, status: 200, body: `"metric":"events","since":`},
+		{name: "no metric", method: "DELETE", path: suppressedMetricsPath, status: 400},
+		{name: "not suppressed", method: "DELETE", path: suppressedMetricsPath + "?metric=up", status: 404},
+		{name: "unsuppress", method: "DELETE", path: suppressedMetricsPath + "?metric=events", status: 200, body: `"unsuppressed":"events"`},
+		{name: "list empty", method: "GET", path: suppressedMetricsPath, status: 200, body: `"data":[]`},
+		{name: "post", method: "POST", path: suppressedMetricsPath, status: 405},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(c.method, c.path, nil))
+		if recorder.Code != c.status || !strings.Contains(recorder.Body.String(), c.body) {
+			t.Errorf("%s: expected status %d with %s, got %d: %s", c.name, c.status, c.body, recorder.Code, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+// Prometheus HTTP API error types
+const (
+	errorBadData   = "bad_data"
+	errorExecution = "execution"
+	errorCanceled  = "canceled"
+)
+
+type labelQuerier interface {
+	LabelNames(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]string, error)
+	LabelValues(ctx context.Context, name string, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]string, error)
+}
+
+type seriesQuerier interface {
+	Series(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]model.Metric, error)
+}
+
+type apiResponse struct {
+	Status string      `json:"status"`
+	Data   interface{} `json:"data"`
+}
+
+func writeAPIData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: data}); err != nil {
+		log.Error("msg", "Error encoding API response", "err", err)
+	}
+}
+
+// writeQueryError replies to a failed storage query, telling apart queries aborted by the client.
+func writeQueryError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		util.WriteAPIError(w, http.StatusServiceUnavailable, errorCanceled, util.ErrCodeQuery, "query was canceled", err)
+		return
+	}
+	log.Warn("msg", "Error running query", "path", r.URL.Path, "err", err)
+	util.WriteAPIError(w, http.StatusInternalServerError, errorExecution, util.ErrCodeQuery, "error running query", err)
+}
+
+// parseTime parses a time given as RFC3339 or as a Unix timestamp in (fractional) seconds. An empty
+// string yields the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		seconds, fraction := math.Modf(t)
+		return time.Unix(int64(seconds), int64(math.Round(fraction*float64(time.Second)))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseSeriesParams reads the match[], start and end parameters shared by the series-based API endpoints.
+func parseSeriesParams(r *http.Request) ([][]*labels.Matcher, time.Time, time.Time, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("error parsing form values: %v", err)
+	}
+	var selectors [][]*labels.Matcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, time.Time{}, time.Time{}, err
+		}
+		selectors = append(selectors, matchers)
+	}
+	selectors = normalizeMatchers(namePolicy, selectors)
+	start, err := parseTime(r.Form.Get("start"))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	end, err := parseTime(r.Form.Get("end"))
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return nil, time.Time{}, time.Time{}, fmt.Errorf("end timestamp must not be before start time")
+	}
+	return selectors, start, end, nil
+}
+
+// labelsAPI serves GET /api/v1/labels
+func labelsAPI(querier labelQuerier, limit int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selectors, start, end, err := parseSeriesParams(r)
+		if err != nil {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+			return
+		}
+		names, err := querier.LabelNames(r.Context(), selectors, start, end, limit)
+		if err != nil {
+			writeQueryError(w, r, err)
+			return
+		}
+		writeAPIData(w, names)
+	})
+}
+
+// labelValuesAPI serves GET /api/v1/label/<name>/values
+func labelValuesAPI(querier labelQuerier, limit int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+		name, found := strings.CutSuffix(name, "/values")
+		if !found || name == "" || strings.Contains(name, "/") {
+			util.WriteAPIError(w, http.StatusNotFound, errorBadData, util.ErrCodeBadRequest, "unknown path", nil)
+			return
+		}
+		if namePolicy == util.NamePolicyNormalize {
+			name = util.NormalizeLabelName(name)
+		}
+		if !model.LabelName(name).IsValid() {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, fmt.Sprintf("invalid label name: %q", name), nil)
+			return
+		}
+		selectors, start, end, err := parseSeriesParams(r)
+		if err != nil {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+			return
+		}
+		values, err := querier.LabelValues(r.Context(), name, selectors, start, end, limit)
+		if err != nil {
+			writeQueryError(w, r, err)
+			return
+		}
+		writeAPIData(w, values)
+	})
+}
+
+// seriesAPI serves GET and POST /api/v1/series
+func seriesAPI(querier seriesQuerier, limit int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		selectors, start, end, err := parseSeriesParams(r)
+		if err != nil {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+			return
+		}
+		if len(selectors) == 0 {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "no match[] parameter provided", nil)
+			return
+		}
+		series, err := querier.Series(r.Context(), selectors, start, end, limit)
+		if errors.Is(err, pgprometheus.ErrTooManySeries) {
+			msg := fmt.Sprintf("query matches more than %d series, use a more specific selector", limit)
+			util.WriteAPIError(w, http.StatusUnprocessableEntity, errorExecution, util.ErrCodeLimitExceeded, msg, nil)
+			return
+		}
+		if err != nil {
+			writeQueryError(w, r, err)
+			return
+		}
+		writeAPIData(w, series)
+	})
+}
+
+type rangeQuerier interface {
+	QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration, limit int, maxSamples int) (model.Matrix, error)
+}
+
+// readLimits bound range queries. Zero values mean no limit.
+type readLimits struct {
+	maxSeries   int
+	maxSamples  int
+	maxDuration time.Duration
+	// slowQuery is the duration from which queries are logged as slow.
+	slowQuery time.Duration
+}
+
+// Statuses of read queries
+const (
+	readSuccess       = "success"
+	readBadData       = "bad_data"
+	readLimitExceeded = "limit_exceeded"
+	readCanceled      = "canceled"
+	readError         = "error"
+)
+
+// maxQueryPoints caps the number of steps of a range query, as Prometheus does.
+const maxQueryPoints = 11000
+
+type queryData struct {
+	ResultType string       `json:"resultType"`
+	Result     model.Matrix `json:"result"`
+}
+
+// parseDuration parses a duration given in (fractional) seconds or in Prometheus duration syntax.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		if duration := time.Duration(d * float64(time.Second)); duration > 0 && d < math.MaxInt64/float64(time.Second) {
+			return duration, nil
+		}
+		return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+	}
+	if d, err := model.ParseDuration(s); err == nil && d > 0 {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// parseRangeParams reads the query, start, end and step parameters of a range query.
+func parseRangeParams(r *http.Request) (string, time.Time, time.Time, time.Duration, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", time.Time{}, time.Time{}, 0, fmt.Errorf("error parsing form values: %v", err)
+	}
+	query := r.Form.Get("query")
+	if query == "" {
+		return "", time.Time{}, time.Time{}, 0, fmt.Errorf("no query parameter provided")
+	}
+	start, err := parseTime(r.Form.Get("start"))
+	if err != nil {
+		return "", time.Time{}, time.Time{}, 0, err
+	}
+	end, err := parseTime(r.Form.Get("end"))
+	if err != nil {
+		return "", time.Time{}, time.Time{}, 0, err
+	}
+	if start.IsZero() || end.IsZero() {
+		return "", time.Time{}, time.Time{}, 0, fmt.Errorf("start and end parameters are required")
+	}
+	if end.Before(start) {
+		return "", time.Time{}, time.Time{}, 0, fmt.Errorf("end timestamp must not be before start time")
+	}
+	step, err := parseDuration(r.Form.Get("step"))
+	if err != nil {
+		return "", time.Time{}, time.Time{}, 0, err
+	}
+	if end.Sub(start)/step > maxQueryPoints {
+		return "", time.Time{}, time.Time{}, 0, fmt.Errorf("exceeded maximum resolution of %d points per timeseries, try decreasing the query resolution", maxQueryPoints)
+	}
+	return query, start, end, step, nil
+}
+
+// queryRangeAPI serves GET and POST /api/v1/query_range for the PromQL subset the storage can translate.
+func queryRangeAPI(m *metrics, querier rangeQuerier, limits readLimits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		query, start, end, step, err := parseRangeParams(r)
+		if err != nil {
+			m.readQueries.WithLabelValues(readBadData).Inc()
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+			return
+		}
+		ctx := r.Context()
+		if limits.maxDuration > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, limits.maxDuration)
+			defer cancel()
+		}
+		begin := time.Now()
+		matrix, err := querier.QueryRange(ctx, query, start, end, step, limits.maxSeries, limits.maxSamples)
+		duration := time.Since(begin)
+		samples := 0
+		for _, series := range matrix {
+			samples += len(series.Values)
+		}
+		status := readSuccess
+		defer func() {
+			m.readQueries.WithLabelValues(status).Inc()
+			m.readQueryDuration.Observe(duration.Seconds())
+			if status == readSuccess {
+				m.readSamplesReturned.Observe(float64(samples))
+			}
+			if limits.slowQuery > 0 && duration >= limits.slowQuery {
+				log.Warn("msg", "Slow query", "query", query, "start", start, "end", end, "step", step, "rows", samples, "duration", duration, "status", status)
+			}
+		}()
+
+		var parseErrs parser.ParseErrors
+		switch {
+		case errors.As(err, &parseErrs) || errors.Is(err, pgprometheus.ErrUnsupportedExpression):
+			status = readBadData
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+		case errors.Is(err, pgprometheus.ErrTooManySeries):
+			status = readLimitExceeded
+			msg := fmt.Sprintf("query matches more than %d series, use a more specific selector", limits.maxSeries)
+			util.WriteAPIError(w, http.StatusUnprocessableEntity, errorExecution, util.ErrCodeLimitExceeded, msg, nil)
+		case errors.Is(err, pgprometheus.ErrTooManySamples):
+			status = readLimitExceeded
+			msg := fmt.Sprintf("query returns more than %d samples, use a shorter range, a larger step or a more specific selector", limits.maxSamples)
+			util.WriteAPIError(w, http.StatusUnprocessableEntity, errorExecution, util.ErrCodeLimitExceeded, msg, nil)
+		case err != nil && r.Context().Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+			status = readLimitExceeded
+			msg := fmt.Sprintf("query took longer than %v and was aborted, use a shorter range or a more specific selector", limits.maxDuration)
+			util.WriteAPIError(w, http.StatusUnprocessableEntity, errorExecution, util.ErrCodeLimitExceeded, msg, err)
+		case err != nil:
+			status = readError
+			if errors.Is(r.Context().Err(), context.Canceled) {
+				status = readCanceled
+			}
+			writeQueryError(w, r, err)
+		default:
+			writeAPIData(w, queryData{ResultType: "matrix", Result: matrix})
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+)
+
+type fakeLabelQuerier struct {
+	name      string
+	selectors [][]*labels.Matcher
+	start     time.Time
+	end       time.Time
+	limit     int
+	err       error
+}
+
+func (f *fakeLabelQuerier) LabelNames(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]string, error) {
+	f.selectors, f.start, f.end, f.limit = selectors, start, end, limit
+	return []string{"__name__", "job"}, f.err
+}
+
+func (f *fakeLabelQuerier) LabelValues(ctx context.Context, name string, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]string, error) {
+	f.name, f.selectors, f.start, f.end, f.limit = name, selectors, start, end, limit
+	return []string{"node"}, f.err
+}
+
+func TestLabelsAPI(t *testing.T) {
+	querier := &fakeLabelQuerier{}
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", `/api/v1/labels?match[]=up{job="node"}&match[]=down&start=10&end=2020-01-01T00:00:00Z`, nil)
+	labelsAPI(querier, 5).ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Fatalf("Expected HTTP 200 Status Code, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if expected := `{"status":"success","data":["__name__","job"]}` + "\n"; recorder.Body.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, recorder.Body.String())
+	}
+	if len(querier.selectors) != 2 || len(querier.selectors[0]) != 2 {
+		t.Errorf("Unexpected selectors %v", querier.selectors)
+	}
+	if !querier.start.Equal(time.Unix(10, 0)) || !querier.end.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected time range %v - %v", querier.start, querier.end)
+	}
+	if querier.limit != 5 {
+		t.Errorf("Expected limit 5, got %d", querier.limit)
+	}
+}
+
+func TestLabelValuesAPI(t *testing.T) {
+	testCases := []struct {
+		path   string
+		status int
+		name   string
+	}{
+		{path: "/api/v1/label/job/values", status: 200, name: "job"},
+		{path: "/api/v1/label/__name__/values", status: 200, name: "__name__"},
+		{path: "/api/v1/label/job", status: 404},
+		{path: "/api/v1/label/job/values?match[]=up{", status: 400},
+		{path: "/api/v1/label/job/values?start=yesterday", status: 400},
+		{path: "/api/v1/label/job/values?start=20&end=10", status: 400},
+	}
+	for _, c := range testCases {
+		t.Run(c.path, func(t *testing.T) {
+			querier := &fakeLabelQuerier{}
+			recorder := httptest.NewRecorder()
+			labelValuesAPI(querier, 5).ServeHTTP(recorder, httptest.NewRequest("GET", c.path, nil))
+			if recorder.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, recorder.Code, recorder.Body.String())
+			}
+			var resp map[string]interface{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if c.status != 200 {
+				if resp["status"] != "error" || resp["errorType"] != "bad_data" {
+					t.Errorf("Unexpected error body %v", resp)
+				}
+				return
+			}
+			if querier.name != c.name {
+				t.Errorf("Expected label %q, got %q", c.name, querier.name)
+			}
+		})
+	}
+}
+
+func TestLabelsAPIQueryError(t *testing.T) {
+	querier := &fakeLabelQuerier{err: fmt.Errorf("relation \"metrics_labels\" does not exist")}
+	recorder := httptest.NewRecorder()
+	labelsAPI(querier, 5).ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v1/labels", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected HTTP 500 Status Code, got %d", recorder.Code)
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["errorType"] != "execution" || resp["code"] != "query_error" {
+		t.Errorf("Unexpected error body %v", resp)
+	}
+}
+
+type fakeSeriesQuerier struct {
+	series []model.Metric
+	err    error
+	limit  int
+}
+
+func (f *fakeSeriesQuerier) Series(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]model.Metric, error) {
+	f.limit = limit
+	return f.series, f.err
+}
+
+func TestSeriesAPI(t *testing.T) {
+	testCases := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		querier  *fakeSeriesQuerier
+		status   int
+		expected string
+	}{
+		{
+			name:     "get",
+			method:   "GET",
+			target:   `/api/v1/series?match[]=up`,
+			querier:  &fakeSeriesQuerier{series: []model.Metric{{"__name__": "up", "job": "node"}}},
+			status:   200,
+			expected: `{"status":"success","data":[{"__name__":"up","job":"node"}]}`,
+		},
+		{
+			name:     "post form",
+			method:   "POST",
+			target:   "/api/v1/series",
+			body:     "match[]=up",
+			querier:  &fakeSeriesQuerier{series: []model.Metric{}},
+			status:   200,
+			expected: `{"status":"success","data":[]}`,
+		},
+		{
+			name:    "missing match",
+			method:  "GET",
+			target:  "/api/v1/series",
+			querier: &fakeSeriesQuerier{},
+			status:  400,
+		},
+		{
+			name:     "too many series",
+			method:   "GET",
+			target:   `/api/v1/series?match[]={job=~".+"}`,
+			querier:  &fakeSeriesQuerier{err: pgprometheus.ErrTooManySeries},
+			status:   422,
+			expected: `{"status":"error","errorType":"execution","error":"query matches more than 3 series, use a more specific selector","code":"limit_exceeded"}`,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+			if c.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			recorder := httptest.NewRecorder()
+			seriesAPI(c.querier, 3).ServeHTTP(recorder, req)
+			if recorder.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, recorder.Code, recorder.Body.String())
+			}
+			if c.expected != "" && strings.TrimSpace(recorder.Body.String()) != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, recorder.Body.String())
+			}
+		})
+	}
+}
+
+type fakeRangeQuerier struct {
+	query string
+	step  time.Duration
+	err   error
+	// hang blocks the query until the context is done.
+	hang bool
+}
+
+func (f *fakeRangeQuerier) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration, limit int, maxSamples int) (model.Matrix, error) {
+	f.query, f.step = query, step
+	if f.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return model.Matrix{{Metric: model.Metric{"job": "node"}, Values: []model.SamplePair{{Timestamp: 60000, Value: 1.5}}}}, nil
+}
+
+func TestQueryRangeAPI(t *testing.T) {
+	testCases := []struct {
+		name     string
+		target   string
+		querier  *fakeRangeQuerier
+		status   int
+		expected string
+	}{
+		{
+			name:     "matrix",
+			target:   "/api/v1/query_range?query=sum+by+(job)+(up)&start=0&end=120&step=1m",
+			querier:  &fakeRangeQuerier{},
+			status:   200,
+			expected: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"node"},"values":[[60,"1.5"]]}]}}`,
+		},
+		{
+			name:    "missing step",
+			target:  "/api/v1/query_range?query=up&start=0&end=120",
+			querier: &fakeRangeQuerier{},
+			status:  400,
+		},
+		{
+			name:    "too many points",
+			target:  "/api/v1/query_range?query=up&start=0&end=86400&step=1",
+			querier: &fakeRangeQuerier{},
+			status:  400,
+		},
+		{
+			name:     "unsupported",
+			target:   "/api/v1/query_range?query=avg(up)&start=0&end=120&step=60",
+			querier:  &fakeRangeQuerier{err: fmt.Errorf("%w \"avg(up)\"", pgprometheus.ErrUnsupportedExpression)},
+			status:   400,
+			expected: `{"status":"error","errorType":"bad_data","error":"unsupported expression \"avg(up)\"","code":"bad_request"}`,
+		},
+		{
+			name:    "too many series",
+			target:  "/api/v1/query_range?query=up&start=0&end=120&step=60",
+			querier: &fakeRangeQuerier{err: pgprometheus.ErrTooManySeries},
+			status:  422,
+		},
+		{
+			name:     "too many samples",
+			target:   "/api/v1/query_range?query=up&start=0&end=120&step=60",
+			querier:  &fakeRangeQuerier{err: pgprometheus.ErrTooManySamples},
+			status:   422,
+			expected: `{"status":"error","errorType":"execution","error":"query returns more than 1000 samples, use a shorter range, a larger step or a more specific selector","code":"limit_exceeded"}`,
+		},
+		{
+			name:    "too slow",
+			target:  "/api/v1/query_range?query=up&start=0&end=120&step=60",
+			querier: &fakeRangeQuerier{hang: true},
+			status:  422,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			limits := readLimits{maxSeries: 3, maxSamples: 1000, maxDuration: 10 * time.Millisecond, slowQuery: time.Millisecond}
+			queryRangeAPI(testMetrics, c.querier, limits).ServeHTTP(recorder, httptest.NewRequest("GET", c.target, nil))
+			if recorder.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, recorder.Code, recorder.Body.String())
+			}
+			if c.expected != "" && strings.TrimSpace(recorder.Body.String()) != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// Headers of the write responses telling what became of the samples of the request, so that senders notice
+// samples being dropped without scraping the adapter.
+const (
+	headerSamplesReceived = "X-Adapter-Samples-Received"
+	headerSamplesWritten  = "X-Adapter-Samples-Written"
+	headerSamplesDropped  = "X-Adapter-Samples-Dropped"
+	// headerDropReasons lists the dropped samples by reason, as comma-separated reason=count pairs sorted by
+	// reason.
+	headerDropReasons = "X-Adapter-Samples-Dropped-Reasons"
+
+	// the written counts of the remote write 2.0 specification; histograms and exemplars are never written
+	headerRemoteWriteSamples    = "X-Prometheus-Remote-Write-Samples-Written"
+	headerRemoteWriteHistograms = "X-Prometheus-Remote-Write-Histograms-Written"
+	headerRemoteWriteExemplars  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// setSampleAudit sets the headers accounting for the samples received by a write request. It must be called
+// before the status is written.
+func setSampleAudit(h http.Header, received int, stats writers.WriteStats) {
+	written := strconv.Itoa(stats.Written)
+	h.Set(headerSamplesReceived, strconv.Itoa(received))
+	h.Set(headerSamplesWritten, written)
+	h.Set(headerSamplesDropped, strconv.Itoa(stats.DroppedTotal()))
+	if reasons := dropReasons(stats.Dropped); reasons != "" {
+		h.Set(headerDropReasons, reasons)
+	}
+	h.Set(headerRemoteWriteSamples, written)
+	h.Set(headerRemoteWriteHistograms, "0")
+	h.Set(headerRemoteWriteExemplars, "0")
+}
+
+// dropReasons formats the dropped samples by reason for headerDropReasons.
+func dropReasons(dropped map[string]int) string {
+	reasons := make([]string, 0, len(dropped))
+	for reason := range dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for i, reason := range reasons {
+		reasons[i] = fmt.Sprintf("%s=%d", reason, dropped[reason])
+	}
+	return strings.Join(reasons, ",")
+}
+
+// parseSampleAudit reads the stats of a write from the headers of its response, set by setSampleAudit. It
+// returns false if the headers are missing or malformed.
+func parseSampleAudit(h http.Header) (writers.WriteStats, bool) {
+	var stats writers.WriteStats
+	written, err := strconv.Atoi(h.Get(headerSamplesWritten))
+	if err != nil {
+		return stats, false
+	}
+	stats.Written = written
+	if reasons := h.Get(headerDropReasons); reasons != "" {
+		for _, pair := range strings.Split(reasons, ",") {
+			reason, count, ok := strings.Cut(pair, "=")
+			n, err := strconv.Atoi(count)
+			if !ok || err != nil {
+				return stats, false
+			}
+			stats.Drop(reason, n)
+		}
+	}
+	return stats, true
+}
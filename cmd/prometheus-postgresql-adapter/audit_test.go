@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+func TestWriteSampleAudit(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 1}, {Value: 1, Timestamp: 2}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "down"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 1, Timestamp: 2}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &fakeWriter{dropped: map[string]int{"out_of_order": 1}}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, true).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", recorder.Code)
+	}
+	for header, expected := range map[string]string{
+		headerSamplesReceived:       "5",
+		headerSamplesWritten:        "3",
+		headerSamplesDropped:        "2",
+		headerDropReasons:           "duplicate=1,out_of_order=1",
+		headerRemoteWriteSamples:    "3",
+		headerRemoteWriteHistograms: "0",
+		headerRemoteWriteExemplars:  "0",
+	} {
+		if got := recorder.Header().Get(header); got != expected {
+			t.Errorf("Expected %s %q, got %q", header, expected, got)
+		}
+	}
+}
+
+func TestParseSampleAudit(t *testing.T) {
+	stats := writers.WriteStats{Written: 7}
+	stats.Drop("quota", 2)
+	stats.Drop("invalid_utf8", 1)
+	h := http.Header{}
+	setSampleAudit(h, 10, stats)
+	parsed, ok := parseSampleAudit(h)
+	if !ok || !reflect.DeepEqual(parsed, stats) {
+		t.Errorf("Expected %+v, got %+v, %v", stats, parsed, ok)
+	}
+	if _, ok := parseSampleAudit(http.Header{}); ok {
+		t.Error("Expected missing headers not to be parsed")
+	}
+	h.Set(headerDropReasons, "quota")
+	if _, ok := parseSampleAudit(h); ok {
+		t.Error("Expected malformed reasons not to be parsed")
+	}
+}
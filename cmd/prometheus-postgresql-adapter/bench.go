@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// benchConfig configures the bench subcommand.
+type benchConfig struct {
+	url            string
+	series         int
+	labels         int
+	scrapeInterval time.Duration
+	churnRate      float64
+	duration       time.Duration
+	targetRate     float64
+	batchSize      int
+	concurrency    int
+	seed           int64
+	logLevel       string
+	pg             pgprometheus.Config
+}
+
+func parseBenchFlags(args []string) (*benchConfig, error) {
+	cfg := &benchConfig{}
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&cfg.url, "url", "", "Remote write URL of a running adapter (eg. http://localhost:9201/write). If empty, samples are written to the database configured by the -pg-* flags directly.")
+	fs.IntVar(&cfg.series, "series", 10000, "Number of active series.")
+	fs.IntVar(&cfg.labels, "labels", 5, "Number of labels per series, besides the metric name and the series ID.")
+	fs.DurationVar(&cfg.scrapeInterval, "scrape-interval", 15*time.Second, "Interval between the timestamps of consecutive samples of a series.")
+	fs.Float64Var(&cfg.churnRate, "churn-rate", 0, "Fraction of the series replaced by new series after each scrape.")
+	fs.DurationVar(&cfg.duration, "duration", time.Minute, "How long to send samples for.")
+	fs.Float64Var(&cfg.targetRate, "target-rate", 0, "Samples per second to send (0 means as fast as possible).")
+	fs.IntVar(&cfg.batchSize, "batch-size", 2000, "Number of samples per write.")
+	fs.IntVar(&cfg.concurrency, "concurrency", 4, "Number of concurrent writes.")
+	fs.Int64Var(&cfg.seed, "seed", 1, "Seed the series and values are generated from. Runs with the same seed send the same series.")
+	fs.StringVar(&cfg.logLevel, "log-level", "info", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
+	pgprometheus.RegisterFlags(fs, "pg", &cfg.pg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.series <= 0:
+		return nil, fmt.Errorf("-series must be positive")
+	case cfg.labels < 0:
+		return nil, fmt.Errorf("-labels must not be negative")
+	case cfg.scrapeInterval <= 0:
+		return nil, fmt.Errorf("-scrape-interval must be positive")
+	case cfg.churnRate < 0 || cfg.churnRate > 1:
+		return nil, fmt.Errorf("-churn-rate must be between 0 and 1")
+	case cfg.duration <= 0:
+		return nil, fmt.Errorf("-duration must be positive")
+	case cfg.targetRate < 0:
+		return nil, fmt.Errorf("-target-rate must not be negative")
+	case cfg.batchSize <= 0:
+		return nil, fmt.Errorf("-batch-size must be positive")
+	case cfg.concurrency <= 0:
+		return nil, fmt.Errorf("-concurrency must be positive")
+	}
+	return cfg, nil
+}
+
+// runBench runs the bench subcommand, which sends synthetic samples to an adapter or to the database and
+// reports the sustained throughput. It returns the exit code.
+func runBench(args []string) int {
+	cfg, err := parseBenchFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log.Init(cfg.logLevel)
+
+	var writer writers.Writer
+	if cfg.url != "" {
+		writer = &remoteWriter{url: cfg.url, client: &http.Client{Timeout: 30 * time.Second}}
+	} else {
+		client, err := pgprometheus.NewClient(&cfg.pg)
+		if err != nil {
+			log.Error("msg", "Error creating the database client", "err", err)
+			return 1
+		}
+		defer client.Close()
+		if err := client.EnsureSchema(); err != nil {
+			log.Error("msg", "Error setting up the schema", "err", err)
+			return 1
+		}
+		writer = client
+	}
+	log.Info("msg", "Sending samples", "storage", writer.Name(), "series", cfg.series, "duration", cfg.duration, "target_rate", cfg.targetRate)
+	result := runBenchLoad(context.Background(), cfg, writer)
+	result.print(os.Stdout)
+	return 0
+}
+
+// remoteWriter sends samples to an adapter as remote write requests.
+type remoteWriter struct {
+	url    string
+	client *http.Client
+}
+
+// WriteContext sends the samples in a remote write request. The stats are those of the audit headers of the
+// response, all samples counting as written if the receiver doesn't set them.
+func (r *remoteWriter) WriteContext(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	data, err := proto.Marshal(samplesToProto(samples))
+	if err != nil {
+		return writers.WriteStats{}, err
+	}
+	compressed := snappy.Encode(nil, data)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(compressed))
+	if err != nil {
+		return writers.WriteStats{}, err
+	}
+	setBodyDigest(req.Header, compressed)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return writers.WriteStats{}, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return writers.WriteStats{}, fmt.Errorf("remote write failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	if stats, ok := parseSampleAudit(resp.Header); ok {
+		return stats, nil
+	}
+	return writers.WriteStats{Written: len(samples)}, nil
+}
+
+func (r *remoteWriter) Name() string {
+	return "remote write"
+}
+
+// seriesGenerator generates the samples of synthetic scrapes. The series, values and churn only depend on
+// the seed; the timestamps advance by the scrape interval from the start time.
+type seriesGenerator struct {
+	rnd      *rand.Rand
+	labels   int
+	churn    float64
+	interval time.Duration
+	series   []model.Metric
+	// nextID is the ID of the next new series
+	nextID int
+	// churned carries over fractions of series to replace between scrapes
+	churned float64
+	time    model.Time
+}
+
+func newSeriesGenerator(seed int64, series, labels int, churn float64, interval time.Duration, start model.Time) *seriesGenerator {
+	g := &seriesGenerator{rnd: rand.New(rand.NewSource(seed)), labels: labels, churn: churn, interval: interval, time: start}
+	g.series = make([]model.Metric, series)
+	for i := range g.series {
+		g.series[i] = g.newSeries()
+	}
+	return g
+}
+
+func (g *seriesGenerator) newSeries() model.Metric {
+	id := g.nextID
+	g.nextID++
+	metric := make(model.Metric, g.labels+2)
+	metric[model.MetricNameLabel] = model.LabelValue(fmt.Sprintf("bench_metric_%d", id%10))
+	metric["series_id"] = model.LabelValue(strconv.Itoa(id))
+	for i := 0; i < g.labels; i++ {
+		metric[model.LabelName(fmt.Sprintf("label_%d", i))] = model.LabelValue(fmt.Sprintf("value_%d", g.rnd.Intn(100)))
+	}
+	return metric
+}
+
+// scrape returns a sample of each series, then replaces the churned series.
+func (g *seriesGenerator) scrape() model.Samples {
+	samples := make(model.Samples, len(g.series))
+	for i, metric := range g.series {
+		samples[i] = &model.Sample{Metric: metric, Value: model.SampleValue(g.rnd.Float64() * 100), Timestamp: g.time}
+	}
+	g.time = g.time.Add(g.interval)
+	g.churned += g.churn * float64(len(g.series))
+	for ; g.churned >= 1; g.churned-- {
+		g.series[g.rnd.Intn(len(g.series))] = g.newSeries()
+	}
+	return samples
+}
+
+// benchResult sums up a bench run.
+type benchResult struct {
+	mutex     sync.Mutex
+	elapsed   time.Duration
+	samples   int
+	errors    int
+	latencies []time.Duration
+}
+
+func (r *benchResult) record(samples int, latency time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.latencies = append(r.latencies, latency)
+	if err != nil {
+		r.errors++
+		log.Debug("msg", "Write failed", "err", err)
+		return
+	}
+	r.samples += samples
+}
+
+// percentile returns the write latency below which the fraction p of the writes are.
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, r.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func (r *benchResult) print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "duration:        %v\n", r.elapsed.Round(time.Millisecond))
+	_, _ = fmt.Fprintf(w, "samples written: %d\n", r.samples)
+	_, _ = fmt.Fprintf(w, "writes:          %d\n", len(r.latencies))
+	_, _ = fmt.Fprintf(w, "write errors:    %d\n", r.errors)
+	_, _ = fmt.Fprintf(w, "throughput:      %.1f samples/s\n", float64(r.samples)/r.elapsed.Seconds())
+	_, _ = fmt.Fprintf(w, "latency p50:     %v\n", r.percentile(0.5).Round(time.Microsecond))
+	_, _ = fmt.Fprintf(w, "latency p99:     %v\n", r.percentile(0.99).Round(time.Microsecond))
+}
+
+// runBenchLoad sends scrapes of the generated series in batches to the writer for the configured duration,
+// pacing them to the target rate.
+func runBenchLoad(ctx context.Context, cfg *benchConfig, writer writers.Writer) *benchResult {
+	result := &benchResult{}
+	batches := make(chan model.Samples, cfg.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				begin := time.Now()
+				_, err := writer.WriteContext(ctx, batch)
+				result.record(len(batch), time.Since(begin), err)
+			}
+		}()
+	}
+
+	start := time.Now()
+	deadline := start.Add(cfg.duration)
+	generator := newSeriesGenerator(cfg.seed, cfg.series, cfg.labels, cfg.churnRate, cfg.scrapeInterval, model.TimeFromUnixNano(start.UnixNano()))
+	sent := 0
+send:
+	for {
+		samples := generator.scrape()
+		for len(samples) > 0 {
+			if cfg.targetRate > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(sent) / cfg.targetRate * float64(time.Second)))))
+			}
+			if !time.Now().Before(deadline) {
+				break send
+			}
+			n := min(cfg.batchSize, len(samples))
+			batches <- samples[:n]
+			samples = samples[n:]
+			sent += n
+		}
+	}
+	close(batches)
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	return result
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestSeriesGeneratorDeterministic(t *testing.T) {
+	a := newSeriesGenerator(7, 100, 3, 0.1, 15*time.Second, 1000)
+	b := newSeriesGenerator(7, 100, 3, 0.1, 15*time.Second, 1000)
+	for i := 0; i < 5; i++ {
+		sa, sb := a.scrape(), b.scrape()
+		for j := range sa {
+			if !sa[j].Equal(sb[j]) {
+				t.Fatalf("Scrape %d differs at sample %d: %v != %v", i, j, sa[j], sb[j])
+			}
+		}
+		if sa[0].Timestamp != model.Time(1000+i*15000) {
+			t.Errorf("Expected scrape %d at %d, got %d", i, 1000+i*15000, sa[0].Timestamp)
+		}
+	}
+	if c := newSeriesGenerator(8, 100, 3, 0, 15*time.Second, 1000).scrape(); c[0].Metric.Equal(a.series[0]) && c[1].Metric.Equal(a.series[1]) {
+		t.Error("Expected another seed to generate other series")
+	}
+}
+
+func TestSeriesGeneratorChurn(t *testing.T) {
+	g := newSeriesGenerator(1, 100, 2, 0.05, time.Second, 0)
+	seen := map[model.Fingerprint]bool{}
+	for i := 0; i < 10; i++ {
+		samples := g.scrape()
+		if len(samples) != 100 {
+			t.Fatalf("Expected 100 samples per scrape, got %d", len(samples))
+		}
+		for _, s := range samples {
+			seen[s.Metric.Fingerprint()] = true
+		}
+	}
+	// 5 new series after each of the first 9 scrapes, some replacing series that were never scraped
+	if len(seen) <= 100 || len(seen) > 145 {
+		t.Errorf("Expected between 101 and 145 series with churn, got %d", len(seen))
+	}
+	if g.nextID != 150 {
+		t.Errorf("Expected 50 series to be created by churn, got %d", g.nextID-100)
+	}
+}
+
+func TestSamplesToProtoRoundTrip(t *testing.T) {
+	g := newSeriesGenerator(1, 10, 2, 0, time.Second, 0)
+	samples := append(g.scrape(), g.scrape()...)
+	req := samplesToProto(samples)
+	if len(req.Timeseries) != 20 {
+		t.Errorf("Expected a series per run of samples of a metric, got %d", len(req.Timeseries))
+	}
+	for _, ts := range req.Timeseries {
+		for i := 1; i < len(ts.Labels); i++ {
+			if ts.Labels[i-1].Name >= ts.Labels[i].Name {
+				t.Fatalf("Expected labels to be sorted by name, got %v", ts.Labels)
+			}
+		}
+	}
+	decoded := protoToSamples(req)
+	if len(decoded) != len(samples) {
+		t.Fatalf("Expected %d samples, got %d", len(samples), len(decoded))
+	}
+	for i := range samples {
+		if !samples[i].Equal(decoded[i]) {
+			t.Errorf("Sample %d: expected %v, got %v", i, samples[i], decoded[i])
+		}
+	}
+}
+
+func TestRunBenchLoad(t *testing.T) {
+	writer := &fakeWriter{}
+	server := httptest.NewServer(write(testMetrics, writer, false))
+	defer server.Close()
+	cfg, err := parseBenchFlags([]string{"-url", server.URL, "-series", "50", "-duration", "300ms", "-target-rate", "1000", "-batch-size", "20", "-concurrency", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := runBenchLoad(context.Background(), cfg, &remoteWriter{url: cfg.url, client: server.Client()})
+	if result.errors != 0 {
+		t.Errorf("Expected no errors, got %d", result.errors)
+	}
+	// paced to 1000 samples/s, give or take a batch
+	if result.samples < 260 || result.samples > 340 {
+		t.Errorf("Expected about 300 samples to be sent in 300ms, got %d", result.samples)
+	}
+	if len(writer.samples) != result.samples {
+		t.Errorf("Expected the adapter to receive the %d samples sent, got %d", result.samples, len(writer.samples))
+	}
+	var report bytes.Buffer
+	result.print(&report)
+	if !strings.Contains(report.String(), "write errors:    0\n") || !strings.Contains(report.String(), "latency p99:") {
+		t.Errorf("Unexpected report %q", report.String())
+	}
+}
+
+func TestParseBenchFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{{"-series", "0"}, {"-churn-rate", "2"}, {"-batch-size", "-1"}, {"-unknown"}} {
+		if _, err := parseBenchFlags(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+)
+
+// Sources of effective configuration values
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+const redacted = "<redacted>"
+
+// configEntry is the effective value of a configuration flag.
+type configEntry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// sourceValue stands in for a flag value when finding out which flags are given on the command line.
+type sourceValue struct {
+	isBool bool
+}
+
+func (v sourceValue) String() string   { return "" }
+func (v sourceValue) Set(string) error { return nil }
+func (v sourceValue) IsBoolFlag() bool { return v.isBool }
+
+// recordFlagSources tells apart the flags given in args from the ones envy set from the environment. It
+// must run after envy and flag parsing, envSet being the flags set before parsing the command line.
+func recordFlagSources(fs *flag.FlagSet, args []string, envSet map[string]bool) map[string]string {
+	// parse the arguments once more on a shadow flag set, as envy and the command line both mark flags as set
+	shadow := flag.NewFlagSet("sources", flag.ContinueOnError)
+	shadow.SetOutput(io.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		shadow.Var(sourceValue{isBool: ok && boolFlag.IsBoolFlag()}, f.Name, "")
+	})
+	_ = shadow.Parse(args)
+	sources := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = sourceDefault
+		if envSet[f.Name] {
+			sources[f.Name] = sourceEnv
+		}
+	})
+	shadow.Visit(func(f *flag.Flag) {
+		sources[f.Name] = sourceFlag
+	})
+	return sources
+}
+
+// publicStringFlags are the string flags whose values are shown by the config API. String values of other
+// flags may hold credentials, endpoints or paths of secrets and are redacted. Flags of other types only hold
+// numbers, durations and booleans and are always shown.
+var publicStringFlags = map[string]bool{
+	"log-level":                             true,
+	"metrics-namespace":                     true,
+	"web-listen-address":                    true,
+	"web-telemetry-path":                    true,
+	"web-telemetry-listen-address":          true,
+	"write-downsample-method":               true,
+	"write-source-label":                    true,
+	"write-source-from":                     true,
+	"write-source-header":                   true,
+	"write-source-collision":                true,
+	"write-invalid-utf8-policy":             true,
+	"quarantine-table":                      true,
+	"quota-state-table":                     true,
+	"tracing-service-name":                  true,
+	"leader-election-rest-id":               true,
+	"leader-election-kubernetes-lease-name": true,
+	"leader-election-kubernetes-namespace":  true,
+	"leader-election-kubernetes-identity":   true,
+	"pg-database":                           true,
+	"pg-table":                              true,
+	"pg-ssl-mode":                           true,
+	"pg-target-session-attrs":               true,
+	"pg-label-storage":                      true,
+	"pg-promoted-labels":                    true,
+	"pg-staging-mode":                       true,
+	"pg-staging-instance-id":                true,
+	"pg-late-data-policy":                   true,
+	"pg-disk-usage-function":                true,
+	"pg-synchronous-commit":                 true,
+}
+
+// isPublicFlag tells whether the value of a flag can be shown by the config API.
+func isPublicFlag(f *flag.Flag) bool {
+	if publicStringFlags[f.Name] {
+		return true
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	_, isString := getter.Get().(string)
+	return !isString
+}
+
+// configAPI serves GET /admin/config with the effective value and source of every configuration flag, sorted
+// by name. It is an admin endpoint, served behind adminAuth with -enable-admin-api only.
+func configAPI(fs *flag.FlagSet, sources map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries []configEntry
+		fs.VisitAll(func(f *flag.Flag) {
+			entry := configEntry{Name: f.Name, Value: f.Value.String(), Source: sources[f.Name]}
+			if entry.Source == "" {
+				entry.Source = sourceDefault
+			}
+			if !isPublicFlag(f) && entry.Value != "" {
+				entry.Value = redacted
+			}
+			entries = append(entries, entry)
+		})
+		writeAPIData(w, entries)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configSections are the sections of the configuration file, each holding the flags with its prefix. The
+// other flags are set at the top level.
+var configSections = []struct {
+	key    string
+	prefix string
+}{
+	{key: "web", prefix: "web-"},
+	{key: "postgres", prefix: "pg-"},
+	{key: "election", prefix: "leader-election-"},
+	{key: "write", prefix: "write-"},
+}
+
+// configFileFlag is the flag naming the configuration file, which can't be set in it.
+const configFileFlag = "config-file"
+
+// configKey returns the section and the key of a flag in the configuration file, the section being empty
+// for top level keys. Keys are the flag names without the prefix of their section, in snake case.
+func configKey(flagName string) (string, string) {
+	for _, section := range configSections {
+		if strings.HasPrefix(flagName, section.prefix) {
+			return section.key, strings.ReplaceAll(strings.TrimPrefix(flagName, section.prefix), "-", "_")
+		}
+	}
+	return "", strings.ReplaceAll(flagName, "-", "_")
+}
+
+// configFlag returns the flag of a key of the configuration file, or nil if there is none.
+func configFlag(fs *flag.FlagSet, section, key string) *flag.Flag {
+	name := strings.ReplaceAll(key, "_", "-")
+	for _, s := range configSections {
+		if s.key == section {
+			name = s.prefix + name
+		}
+	}
+	f := fs.Lookup(name)
+	if f == nil || f.Name == configFileFlag {
+		return nil
+	}
+	if flagSection, _ := configKey(f.Name); flagSection != section {
+		// eg. a top level pg_host
+		return nil
+	}
+	return f
+}
+
+// loadConfigFile sets the flags from the configuration file at path, except those given on the command line
+// or in the environment, recording the file as their source. Unknown keys are errors; errors name the YAML
+// path of the offending key.
+func loadConfigFile(fs *flag.FlagSet, path string, sources map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	var document yaml.Node
+	if err := decoder.Decode(&document); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a mapping of settings", root.Line)
+	}
+	set := func(section string, keyNode, valueNode *yaml.Node) error {
+		path := keyNode.Value
+		if section != "" {
+			path = section + "." + path
+		}
+		f := configFlag(fs, section, keyNode.Value)
+		if f == nil {
+			return fmt.Errorf("%s (line %d): unknown field", path, keyNode.Line)
+		}
+		if valueNode.Kind != yaml.ScalarNode || valueNode.Tag == "!!null" {
+			return fmt.Errorf("%s (line %d): expected a value", path, valueNode.Line)
+		}
+		if source := sources[f.Name]; source == sourceFlag || source == sourceEnv {
+			return nil
+		}
+		if err := fs.Set(f.Name, valueNode.Value); err != nil {
+			return fmt.Errorf("%s (line %d): invalid value %q: %w", path, valueNode.Line, valueNode.Value, err)
+		}
+		sources[f.Name] = sourceFile
+		return nil
+	}
+	for i := 0; i < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+		if !isConfigSection(keyNode.Value) {
+			if err := set("", keyNode, valueNode); err != nil {
+				return err
+			}
+			continue
+		}
+		if valueNode.Tag == "!!null" {
+			// a section with every setting commented out
+			continue
+		}
+		if valueNode.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s (line %d): expected a mapping of settings", keyNode.Value, valueNode.Line)
+		}
+		for j := 0; j < len(valueNode.Content); j += 2 {
+			if err := set(keyNode.Value, valueNode.Content[j], valueNode.Content[j+1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isConfigSection(key string) bool {
+	for _, section := range configSections {
+		if section.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// printDefaultConfig writes a configuration file with every setting commented out at its default value,
+// under the usage of its flag.
+func printDefaultConfig(w io.Writer, fs *flag.FlagSet) {
+	entries := map[string][]*flag.Flag{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFileFlag {
+			return
+		}
+		section, _ := configKey(f.Name)
+		entries[section] = append(entries[section], f)
+	})
+	fmt.Fprintf(w, "# Configuration of the %s, given with -%s. Flags and TS_PROM_ environment variables\n", applicationName, configFileFlag)
+	fmt.Fprintln(w, "# take precedence over it. Uncomment the settings to change.")
+	writeEntries := func(indent string, flags []*flag.Flag) {
+		for _, f := range flags {
+			_, key := configKey(f.Name)
+			usage := strings.ReplaceAll(f.Usage, "\n", "\n"+indent+"# ")
+			fmt.Fprintf(w, "\n%s# %s\n%s#%s: %s\n", indent, usage, indent, key, configValue(f.DefValue))
+		}
+	}
+	writeEntries("", entries[""])
+	for _, section := range configSections {
+		fmt.Fprintf(w, "\n%s:\n", section.key)
+		writeEntries("  ", entries[section.key])
+	}
+}
+
+// configValue returns value as a YAML scalar, quoted only when needed for it to be read back as is.
+func configValue(value string) string {
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &node); err == nil && len(node.Content) == 1 &&
+		node.Content[0].Kind == yaml.ScalarNode && node.Content[0].Tag != "!!null" && node.Content[0].Value == value {
+		return value
+	}
+	quoted, _ := yaml.Marshal(value)
+	return strings.TrimSpace(string(quoted))
+}
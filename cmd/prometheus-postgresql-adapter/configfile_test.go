@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	defineFlags(fs, &config{})
+	if err := fs.Set("pg-host", "db1"); err != nil {
+		t.Fatal(err)
+	}
+	envSet := map[string]bool{"pg-host": true}
+	args := []string{"-log-level", "warn"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	sources := recordFlagSources(fs, args, envSet)
+
+	path := writeConfigFile(t, `
+log_level: error
+startup_self_test: true
+web:
+  listen_address: ":9999"
+postgres:
+  host: db2
+  max_open_conns: 20
+election:
+write:
+  downsample_interval: 1m
+`)
+	if err := loadConfigFile(fs, path, sources); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string][2]string{
+		"log-level":                 {"warn", sourceFlag},
+		"pg-host":                   {"db1", sourceEnv},
+		"startup-self-test":         {"true", sourceFile},
+		"web-listen-address":        {":9999", sourceFile},
+		"pg-max-open-conns":         {"20", sourceFile},
+		"write-downsample-interval": {"1m0s", sourceFile},
+		"pg-port":                   {"5432", sourceDefault},
+	} {
+		if value := fs.Lookup(name).Value.String(); value != expected[0] || sources[name] != expected[1] {
+			t.Errorf("Expected %s to be %q from %s, got %q from %s", name, expected[0], expected[1], value, sources[name])
+		}
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for content, expected := range map[string]string{
+		"postgres:\n  hots: db1\n":                          "postgres.hots (line 2): unknown field",
+		"pg_host: db1\n":                                    "pg_host (line 1): unknown field",
+		"database:\n  host: db1\n":                          "database (line 1): unknown field",
+		"config_file: other.yaml\n":                         "config_file (line 1): unknown field",
+		"web:\n  listen_address:\n":                         "web.listen_address (line 2): expected a value",
+		"write: 1m\n":                                       "write (line 1): expected a mapping of settings",
+		"postgres:\n  port: 5432\n  max_open_conns: many\n": `postgres.max_open_conns (line 3): invalid value "many"`,
+		"- log_level\n":                                     "line 1: expected a mapping of settings",
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		defineFlags(fs, &config{})
+		err := loadConfigFile(fs, writeConfigFile(t, content), map[string]string{})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error containing %q for %q, got %v", expected, content, err)
+		}
+	}
+}
+
+func TestPrintDefaultConfig(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	defineFlags(fs, &config{})
+	var buf bytes.Buffer
+	printDefaultConfig(&buf, fs)
+
+	// the template as is, then with every setting uncommented, loads and keeps the defaults
+	uncommented := regexp.MustCompile(`(?m)^(\s*)#([a-z0-9_]+: )`).ReplaceAllString(buf.String(), "$1$2")
+	for _, content := range []string{buf.String(), uncommented} {
+		sources := map[string]string{}
+		if err := loadConfigFile(fs, writeConfigFile(t, content), sources); err != nil {
+			t.Fatal(err)
+		}
+		fs.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() != f.DefValue {
+				t.Errorf("Expected %s to keep its default %q, got %q", f.Name, f.DefValue, f.Value.String())
+			}
+		})
+	}
+	if !strings.Contains(uncommented, "\npostgres:\n") || !strings.Contains(uncommented, "\n  host: localhost\n") {
+		t.Errorf("Expected the postgres section with its host, got %s", uncommented)
+	}
+}
@@ -0,0 +1,239 @@
+//go:build conformance
+
+// The conformance suite checks the write endpoint against the receiver side of the remote write
+// specification, with the adapter writing to a database given as connection string in TS_PROM_TEST_PG_DSN.
+// It is run by `make conformance`, which starts a throwaway database in docker.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/quota"
+)
+
+// conformanceConfig returns the client configuration of the database of TS_PROM_TEST_PG_DSN.
+func conformanceConfig(t *testing.T) *pgprometheus.Config {
+	t.Helper()
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	parsed, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Password != "" {
+		// the client takes the password from the environment like libpq
+		t.Setenv("PGPASSWORD", parsed.Password)
+	}
+	cfg := pgprometheus.DefaultConfig()
+	cfg.Host = parsed.Host
+	cfg.Port = int(parsed.Port)
+	cfg.User = parsed.User
+	cfg.Database = parsed.Database
+	cfg.SSLMode = "disable"
+	cfg.Table = "conformance_metrics"
+	cfg.CheckIndexes = false
+	return cfg
+}
+
+// startConformanceAdapter serves the write endpoint of an adapter writing to the conformance database.
+func startConformanceAdapter(t *testing.T) (*httptest.Server, *pgprometheus.Client) {
+	t.Helper()
+	client, err := pgprometheus.NewClient(conformanceConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(write(testMetrics, client, false))
+	t.Cleanup(server.Close)
+	return server, client
+}
+
+// remoteWrite sends a body to the write endpoint with the headers of a Prometheus remote write 1.0 sender,
+// overridden by header.
+func remoteWrite(t *testing.T, url string, body []byte, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "Prometheus/2.53.0")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp
+}
+
+// encodeSeries encodes a write request of a single series with the given samples.
+func encodeSeries(t *testing.T, seriesLabels []prompb.Label, samples ...prompb.Sample) []byte {
+	t.Helper()
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{Labels: seriesLabels, Samples: samples}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+// countConformanceSamples counts the samples written of the series named name with the given run label.
+func countConformanceSamples(t *testing.T, client *pgprometheus.Client, name string, run string) int64 {
+	t.Helper()
+	selector := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name),
+		labels.MustNewMatcher(labels.MatchEqual, "run", run),
+	}
+	count, err := client.CountSamples(context.Background(), [][]*labels.Matcher{selector}, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// conformanceRun tells the series of a test run apart from those of previous runs against the same database.
+func conformanceRun() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func TestConformanceWrite(t *testing.T) {
+	server, client := startConformanceAdapter(t)
+	run := conformanceRun()
+	now := time.Now().UnixMilli()
+	body := encodeSeries(t, []prompb.Label{{Name: "__name__", Value: "conformance_up"}, {Name: "job", Value: "conformance"}, {Name: "run", Value: run}},
+		prompb.Sample{Value: 1, Timestamp: now - 1000}, prompb.Sample{Value: 2, Timestamp: now})
+	resp := remoteWrite(t, server.URL, body, nil)
+	if resp.StatusCode/100 != 2 {
+		t.Fatalf("Expected a 2xx status, got %d", resp.StatusCode)
+	}
+	if written := resp.Header.Get(headerRemoteWriteSamples); written != "2" {
+		t.Errorf("Expected %s to be 2, got %q", headerRemoteWriteSamples, written)
+	}
+	for _, header := range []string{headerRemoteWriteHistograms, headerRemoteWriteExemplars} {
+		if written := resp.Header.Get(header); written != "0" {
+			t.Errorf("Expected %s to be 0, got %q", header, written)
+		}
+	}
+	if n := countConformanceSamples(t, client, "conformance_up", run); n != 2 {
+		t.Errorf("Expected 2 samples to be stored, got %d", n)
+	}
+
+	// a request without samples, eg. of metadata only, is accepted
+	if resp := remoteWrite(t, server.URL, snappy.Encode(nil, nil), nil); resp.StatusCode/100 != 2 {
+		t.Errorf("Expected an empty request to be accepted, got %d", resp.StatusCode)
+	}
+}
+
+func TestConformanceOutOfOrder(t *testing.T) {
+	server, client := startConformanceAdapter(t)
+	run := conformanceRun()
+	series := []prompb.Label{{Name: "__name__", Value: "conformance_out_of_order"}, {Name: "run", Value: run}}
+	now := time.Now().UnixMilli()
+	// samples older than those already written, and unordered within a request, are all written
+	for _, body := range [][]byte{
+		encodeSeries(t, series, prompb.Sample{Value: 3, Timestamp: now}),
+		encodeSeries(t, series, prompb.Sample{Value: 2, Timestamp: now - 2000}, prompb.Sample{Value: 1, Timestamp: now - 3000}),
+	} {
+		if resp := remoteWrite(t, server.URL, body, nil); resp.StatusCode/100 != 2 {
+			t.Fatalf("Expected out of order samples to be accepted, got %d", resp.StatusCode)
+		}
+	}
+	if n := countConformanceSamples(t, client, "conformance_out_of_order", run); n != 3 {
+		t.Errorf("Expected 3 samples to be stored, got %d", n)
+	}
+}
+
+func TestConformanceInvalid(t *testing.T) {
+	server, client := startConformanceAdapter(t)
+	run := conformanceRun()
+	valid := encodeSeries(t, []prompb.Label{{Name: "__name__", Value: "conformance_invalid"}, {Name: "run", Value: run}}, prompb.Sample{Value: 1, Timestamp: time.Now().UnixMilli()})
+	for _, c := range []struct {
+		name   string
+		body   []byte
+		header http.Header
+		status int
+	}{
+		{name: "not snappy", body: []byte("not snappy"), status: http.StatusBadRequest},
+		{name: "not protobuf", body: snappy.Encode(nil, []byte{0xff, 0xff, 0xff}), status: http.StatusBadRequest},
+		{name: "empty label name", body: encodeSeries(t, []prompb.Label{{Name: "__name__", Value: "conformance_invalid"}, {Name: "", Value: "a"}, {Name: "run", Value: run}}, prompb.Sample{Value: 1, Timestamp: time.Now().UnixMilli()}), status: http.StatusBadRequest},
+		{name: "duplicate label name", body: encodeSeries(t, []prompb.Label{{Name: "__name__", Value: "conformance_invalid"}, {Name: "run", Value: run}, {Name: "run", Value: run}}, prompb.Sample{Value: 1, Timestamp: time.Now().UnixMilli()}), status: http.StatusBadRequest},
+		{name: "gzip", body: valid, header: http.Header{"Content-Encoding": {"gzip"}}, status: http.StatusUnsupportedMediaType},
+		{name: "remote write 2.0", body: valid, header: http.Header{"Content-Type": {"application/x-protobuf;proto=io.prometheus.write.v2.Request"}}, status: http.StatusUnsupportedMediaType},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if resp := remoteWrite(t, server.URL, c.body, c.header); resp.StatusCode != c.status {
+				t.Errorf("Expected status %d, got %d", c.status, resp.StatusCode)
+			}
+		})
+	}
+	if n := countConformanceSamples(t, client, "conformance_invalid", run); n != 0 {
+		t.Errorf("Expected no sample of the invalid requests to be stored, got %d", n)
+	}
+}
+
+func TestConformanceRetries(t *testing.T) {
+	// over a quota, the sender retries with backoff
+	server, _ := startConformanceAdapter(t)
+	quotaCfg, err := quota.Parse([]byte("tenants:\n  conformance:\n    new_series_per_day: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas = quota.NewEngine(quotaCfg)
+	defer func() {
+		quotas = nil
+	}()
+	run := conformanceRun()
+	sample := []prompb.Sample{{Value: 1, Timestamp: time.Now().UnixMilli()}}
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "conformance_retry"}, {Name: "job", Value: "a"}, {Name: "run", Value: run}}, Samples: sample},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "conformance_retry"}, {Name: "job", Value: "b"}, {Name: "run", Value: run}}, Samples: sample},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := snappy.Encode(nil, data)
+	if resp := remoteWrite(t, server.URL, body, http.Header{quota.DefaultTenantHeader: {"conformance"}}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d over the quota, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	quotas = nil
+
+	// with the database gone, the sender retries until it is back
+	cfg := conformanceConfig(t)
+	cfg.Port = 1
+	client, err := pgprometheus.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	unreachable := httptest.NewServer(write(testMetrics, client, false))
+	defer unreachable.Close()
+	if resp := remoteWrite(t, unreachable.URL, body, nil); resp.StatusCode/100 != 5 {
+		t.Errorf("Expected a 5xx status with the database unreachable, got %d", resp.StatusCode)
+	}
+}
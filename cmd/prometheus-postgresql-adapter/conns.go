@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connTracker exports the number of connections of the servers by state, and counts the connections closed
+// while a request was in progress or before any was read, as opposed to idle connections closed. Those are
+// closed because of errors, request bodies too large to read, or senders asking for it, which Prometheus
+// doesn't.
+type connTracker struct {
+	mutex       sync.Mutex
+	states      map[net.Conn]http.ConnState
+	connections *prometheus.GaugeVec
+	errorCloses prometheus.Counter
+}
+
+func newConnTracker(namespace string) *connTracker {
+	t := &connTracker{
+		states: map[net.Conn]http.ConnState{},
+		connections: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "http_connections",
+				Help:      "Number of HTTP connections, by state: new, active or idle.",
+			},
+			[]string{"state"},
+		),
+		errorCloses: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "http_connections_closed_on_error_total",
+				Help:      "Total number of HTTP connections closed while new or active instead of idle, because of errors or request bodies left unread.",
+			},
+		),
+	}
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle} {
+		t.connections.WithLabelValues(state.String())
+	}
+	return t
+}
+
+// track is the http.Server ConnState hook.
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	previous, known := t.states[conn]
+	if known {
+		t.connections.WithLabelValues(previous.String()).Dec()
+	}
+	switch state {
+	case http.StateNew, http.StateActive, http.StateIdle:
+		t.states[conn] = state
+		t.connections.WithLabelValues(state.String()).Inc()
+	default:
+		// closed or hijacked, the server is done with the connection
+		delete(t.states, conn)
+		if state == http.StateClosed && known && previous != http.StateIdle {
+			t.errorCloses.Inc()
+		}
+	}
+}
+
+func (t *connTracker) collectors() []prometheus.Collector {
+	return []prometheus.Collector{t.connections, t.errorCloses}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// post sends a body to url, telling whether the connection was reused.
+func post(t *testing.T, client *http.Client, url string, body []byte) (int, bool) {
+	t.Helper()
+	var reused bool
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode, reused
+}
+
+// TestWriteKeepAlive checks that a write failing to decode doesn't cost the sender its connection.
+func TestWriteKeepAlive(t *testing.T) {
+	m := newMetrics("")
+	server := httptest.NewUnstartedServer(write(m, &fakeWriter{}, false))
+	server.Config.ConnState = m.connections.track
+	server.Start()
+	defer server.Close()
+	client := server.Client()
+
+	if status, _ := post(t, client, server.URL, []byte("not snappy")); status != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", status)
+	}
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, reused := post(t, client, server.URL, snappy.Encode(nil, data))
+	if status != http.StatusOK || !reused {
+		t.Errorf("Expected the valid write to reuse the connection, got status %d, reused %v", status, reused)
+	}
+	if closed := testutil.ToFloat64(m.connections.errorCloses); closed != 0 {
+		t.Errorf("Expected no connection closed on error, got %v", closed)
+	}
+}
+
+func TestConnTracker(t *testing.T) {
+	tracker := newConnTracker("")
+	a, b := &fakeConn{}, &fakeConn{}
+	tracker.track(a, http.StateNew)
+	tracker.track(a, http.StateActive)
+	tracker.track(b, http.StateNew)
+	tracker.track(a, http.StateIdle)
+	for state, expected := range map[string]float64{"new": 1, "active": 0, "idle": 1} {
+		if got := testutil.ToFloat64(tracker.connections.WithLabelValues(state)); got != expected {
+			t.Errorf("Expected %v %s connections, got %v", expected, state, got)
+		}
+	}
+	tracker.track(a, http.StateClosed)
+	tracker.track(b, http.StateClosed)
+	if closed := testutil.ToFloat64(tracker.errorCloses); closed != 1 {
+		t.Errorf("Expected the new connection closed to count as an error, got %v", closed)
+	}
+	if len(tracker.states) != 0 || testutil.ToFloat64(tracker.connections.WithLabelValues("idle")) != 0 {
+		t.Error("Expected closed connections to be forgotten")
+	}
+}
+
+type fakeConn struct {
+	net.Conn
+}
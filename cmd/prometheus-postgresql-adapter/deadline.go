@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// remoteWriteTimeoutHeader is where senders may tell the timeout of their write requests, as a duration
+// (eg. "30s") or a number of seconds.
+const remoteWriteTimeoutHeader = "X-Prometheus-Remote-Write-Timeout"
+
+// Sources of the deadline of a write
+const (
+	deadlineHeader      = "header"
+	deadlineSendTimeout = "send_timeout"
+)
+
+// maxDeadlineMargin bounds the margin taken off the timeout of the sender, so that the write is abandoned
+// before the sender gives up, and the response makes it back in time.
+const maxDeadlineMargin = 500 * time.Millisecond
+
+// sendTimeout is -adapter-send-timeout, the deadline of writes of which the sender doesn't tell its timeout,
+// none if 0.
+var sendTimeout time.Duration
+
+// writeDeadline returns the deadline of a write request that arrived at the given time and where it comes
+// from: the timeout of the sender in the header, minus a margin of a tenth of it up to maxDeadlineMargin,
+// or sendTimeout. It returns false if there is no deadline.
+func writeDeadline(h http.Header, arrived time.Time) (time.Time, string, bool) {
+	if v := h.Get(remoteWriteTimeoutHeader); v != "" {
+		timeout, err := parseWriteTimeout(v)
+		if err == nil {
+			return arrived.Add(timeout - min(timeout/10, maxDeadlineMargin)), deadlineHeader, true
+		}
+		log.Debug("msg", "Ignoring invalid write timeout header", "header", remoteWriteTimeoutHeader, "value", v, "err", err)
+	}
+	if sendTimeout > 0 {
+		return arrived.Add(sendTimeout), deadlineSendTimeout, true
+	}
+	return time.Time{}, "", false
+}
+
+// parseWriteTimeout parses a positive duration or number of seconds.
+func parseWriteTimeout(v string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, parseErr := strconv.ParseFloat(v, 64)
+		if parseErr != nil {
+			return 0, err
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, strconv.ErrRange
+	}
+	return timeout, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+func TestWriteDeadline(t *testing.T) {
+	arrived := time.Unix(1700000000, 0)
+	defer func(previous time.Duration) {
+		sendTimeout = previous
+	}(sendTimeout)
+	sendTimeout = 30 * time.Second
+
+	tests := []struct {
+		header   string
+		expected time.Duration
+		source   string
+	}{
+		{"", 30 * time.Second, deadlineSendTimeout},
+		{"10s", 9500 * time.Millisecond, deadlineHeader},
+		{"2", 1800 * time.Millisecond, deadlineHeader},
+		{"1.5", 1350 * time.Millisecond, deadlineHeader},
+		{"0", 30 * time.Second, deadlineSendTimeout},
+		{"-5s", 30 * time.Second, deadlineSendTimeout},
+		{"soon", 30 * time.Second, deadlineSendTimeout},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		if test.header != "" {
+			h.Set(remoteWriteTimeoutHeader, test.header)
+		}
+		deadline, source, ok := writeDeadline(h, arrived)
+		if !ok || deadline.Sub(arrived) != test.expected || source != test.source {
+			t.Errorf("%q: expected a deadline after %v from %s, got %v from %s", test.header, test.expected, test.source, deadline.Sub(arrived), source)
+		}
+	}
+
+	sendTimeout = 0
+	if _, _, ok := writeDeadline(http.Header{}, arrived); ok {
+		t.Error("Expected no deadline without header and send timeout")
+	}
+}
+
+// slowWriter writes for delay unless its context is done first.
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (s slowWriter) WriteContext(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	select {
+	case <-time.After(s.delay):
+		return writers.WriteStats{Written: len(samples)}, nil
+	case <-ctx.Done():
+		return writers.WriteStats{}, ctx.Err()
+	}
+}
+
+func (s slowWriter) Name() string {
+	return "slow"
+}
+
+func TestWriteAbandonedAtDeadline(t *testing.T) {
+	body := encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}})
+	abandoned := testutil.ToFloat64(testMetrics.writesAbandoned.WithLabelValues(deadlineHeader))
+	request := httptest.NewRequest("POST", "/write", bytes.NewReader(body))
+	request.Header.Set(remoteWriteTimeoutHeader, "50ms")
+	recorder := httptest.NewRecorder()
+	started := time.Now()
+	write(testMetrics, slowWriter{delay: 10 * time.Second}, false).ServeHTTP(recorder, request)
+
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Expected the write to be abandoned at its deadline, took %v", elapsed)
+	}
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for an abandoned write, got %d", recorder.Code)
+	}
+	if n := testutil.ToFloat64(testMetrics.writesAbandoned.WithLabelValues(deadlineHeader)) - abandoned; n != 1 {
+		t.Errorf("Expected 1 abandoned write to be counted, got %v", n)
+	}
+
+	// writes finishing in time aren't abandoned
+	request = httptest.NewRequest("POST", "/write", bytes.NewReader(body))
+	request.Header.Set(remoteWriteTimeoutHeader, "5s")
+	recorder = httptest.NewRecorder()
+	write(testMetrics, slowWriter{delay: time.Millisecond}, false).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a write finishing in time, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+// maxPooledDecodeBuffer caps the size of decode buffers kept for reuse, so a single huge request doesn't
+// pin its buffer forever.
+const maxPooledDecodeBuffer = 8 << 20
+
+// maxWriteBytes bounds the size of decompressed write request bodies. Larger requests are rejected with 413
+// before they are decompressed.
+const maxWriteBytes = 4 << 20
+
+// Content encodings of write request bodies
+const (
+	encodingSnappy = "snappy"
+	encodingGzip   = "gzip"
+)
+
+// errDecodedTooLarge is returned when a gzip compressed body decompresses to more than the limit.
+var errDecodedTooLarge = errors.New("decompressed body too large")
+
+// decodeBuffer holds the decompressed body of a write request.
+type decodeBuffer struct {
+	b []byte
+}
+
+var decodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &decodeBuffer{}
+	},
+}
+
+// decodeBuffersInUse and decodeBufferBytesInUse are the number and the capacity of the decode buffers acquired
+// and not released yet.
+var decodeBuffersInUse, decodeBufferBytesInUse atomic.Int64
+
+func acquireDecodeBuffer() *decodeBuffer {
+	buf := decodeBufferPool.Get().(*decodeBuffer)
+	decodeBuffersInUse.Add(1)
+	decodeBufferBytesInUse.Add(int64(cap(buf.b)))
+	return buf
+}
+
+// releaseDecodeBuffer returns the buffer to the pool. The decoded bytes must not be used afterwards.
+func releaseDecodeBuffer(buf *decodeBuffer) {
+	decodeBuffersInUse.Add(-1)
+	decodeBufferBytesInUse.Add(-int64(cap(buf.b)))
+	if buf.reusable() {
+		decodeBufferPool.Put(buf)
+	}
+}
+
+func (buf *decodeBuffer) reusable() bool {
+	return cap(buf.b) <= maxPooledDecodeBuffer
+}
+
+// decode decompresses the snappy block into the buffer, growing it if needed.
+func (buf *decodeBuffer) decode(compressed []byte) ([]byte, error) {
+	decoded, err := snappy.Decode(buf.b[:cap(buf.b)], compressed)
+	if err != nil {
+		return nil, err
+	}
+	decodeBufferBytesInUse.Add(int64(cap(decoded) - cap(buf.b)))
+	buf.b = decoded
+	return decoded, nil
+}
+
+// decodeGzip decompresses the gzip stream into the buffer, growing it if needed. As gzip doesn't announce the
+// decompressed length upfront, it stops with errDecodedTooLarge as soon as it goes beyond limit bytes.
+func (buf *decodeBuffer) decodeGzip(compressed []byte, limit int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	decoded := bytes.NewBuffer(buf.b[:0])
+	n, err := decoded.ReadFrom(io.LimitReader(zr, int64(limit)+1))
+	decodeBufferBytesInUse.Add(int64(decoded.Cap() - cap(buf.b)))
+	buf.b = decoded.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(limit) {
+		return nil, errDecodedTooLarge
+	}
+	return buf.b, nil
+}
+
+// isSnappy reports whether b is a valid snappy block of at most maxWriteBytes, to tell senders that compressed
+// the body twice.
+func isSnappy(b []byte) bool {
+	if n, err := snappy.DecodedLen(b); err != nil || n > maxWriteBytes {
+		return false
+	}
+	_, err := snappy.Decode(nil, b)
+	return err == nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestDecodeBufferReuse(t *testing.T) {
+	buf := &decodeBuffer{}
+	first, err := buf.decode(snappy.Encode(nil, bytes.Repeat([]byte("a"), 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := buf.decode(snappy.Encode(nil, bytes.Repeat([]byte("b"), 500)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 500 || second[0] != 'b' {
+		t.Errorf("Unexpected decoded content")
+	}
+	if &first[0] != &second[0] {
+		t.Errorf("Expected the smaller request to reuse the buffer")
+	}
+	if _, err := buf.decode([]byte("not snappy")); err == nil {
+		t.Errorf("Expected decode error")
+	}
+}
+
+func TestDecodeBufferCap(t *testing.T) {
+	buf := &decodeBuffer{}
+	if _, err := buf.decode(snappy.Encode(nil, make([]byte, maxPooledDecodeBuffer+1))); err != nil {
+		t.Fatal(err)
+	}
+	if buf.reusable() {
+		t.Errorf("Expected oversized buffer not to be pooled")
+	}
+	buf = &decodeBuffer{}
+	if _, err := buf.decode(snappy.Encode(nil, make([]byte, 1024))); err != nil {
+		t.Fatal(err)
+	}
+	if !buf.reusable() {
+		t.Errorf("Expected small buffer to be pooled")
+	}
+}
+
+func TestDecodeBufferInUse(t *testing.T) {
+	buffers, bytes := decodeBuffersInUse.Load(), decodeBufferBytesInUse.Load()
+	buf := acquireDecodeBuffer()
+	if _, err := buf.decode(snappy.Encode(nil, make([]byte, 1024))); err != nil {
+		t.Fatal(err)
+	}
+	if n := decodeBuffersInUse.Load() - buffers; n != 1 {
+		t.Errorf("Expected 1 buffer in use, got %d", n)
+	}
+	if n := decodeBufferBytesInUse.Load() - bytes; n != int64(cap(buf.b)) {
+		t.Errorf("Expected the %d bytes of the buffer in use, got %d", cap(buf.b), n)
+	}
+	releaseDecodeBuffer(buf)
+	if decodeBuffersInUse.Load() != buffers || decodeBufferBytesInUse.Load() != bytes {
+		t.Error("Expected the released buffer not to be in use anymore")
+	}
+}
+
+func TestDecodeGzip(t *testing.T) {
+	buf := &decodeBuffer{}
+	decoded, err := buf.decodeGzip(gzipBody(t, bytes.Repeat([]byte("a"), 1000)), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1000 || decoded[0] != 'a' {
+		t.Errorf("Unexpected decoded content")
+	}
+	if _, err := buf.decodeGzip(gzipBody(t, make([]byte, 1001)), 1000); !errors.Is(err, errDecodedTooLarge) {
+		t.Errorf("Expected a body beyond the limit to be too large, got %v", err)
+	}
+	if _, err := buf.decodeGzip([]byte("not gzip"), 1000); err == nil {
+		t.Errorf("Expected decode error")
+	}
+	truncated := gzipBody(t, bytes.Repeat([]byte("a"), 1000))
+	if _, err := buf.decodeGzip(truncated[:len(truncated)-4], 1000); err == nil {
+		t.Errorf("Expected a truncated stream to fail")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+)
+
+type sampleKey struct {
+	fingerprint model.Fingerprint
+	timestamp   model.Time
+}
+
+// dedupeSamples collapses samples of the same series and timestamp, keeping the value of the last one at
+// the position of the first one. It returns the remaining samples and the number of collapsed samples.
+func dedupeSamples(samples model.Samples) (model.Samples, int) {
+	seen := make(map[sampleKey]int)
+	deduped := samples[:0:0]
+	for _, s := range samples {
+		key := sampleKey{fingerprint: s.Metric.Fingerprint(), timestamp: s.Timestamp}
+		if i, ok := seen[key]; ok {
+			deduped[i].Value = s.Value
+			continue
+		}
+		seen[key] = len(deduped)
+		deduped = append(deduped, s)
+	}
+	return deduped, len(samples) - len(deduped)
+}
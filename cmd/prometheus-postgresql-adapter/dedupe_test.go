@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestDedupeSamples(t *testing.T) {
+	up := model.Metric{model.MetricNameLabel: "up", "job": "a"}
+	upCopy := model.Metric{"job": "a", model.MetricNameLabel: "up"}
+	down := model.Metric{model.MetricNameLabel: "up", "job": "b"}
+	samples := model.Samples{
+		{Metric: up, Timestamp: 1, Value: 1},
+		{Metric: down, Timestamp: 1, Value: 2},
+		{Metric: up, Timestamp: 2, Value: 3},
+		{Metric: upCopy, Timestamp: 1, Value: 4},
+		{Metric: down, Timestamp: 1, Value: 5},
+	}
+	deduped, collapsed := dedupeSamples(samples)
+	if collapsed != 2 {
+		t.Errorf("Expected 2 collapsed samples, got %d", collapsed)
+	}
+	expected := model.Samples{
+		{Metric: up, Timestamp: 1, Value: 4},
+		{Metric: down, Timestamp: 1, Value: 5},
+		{Metric: up, Timestamp: 2, Value: 3},
+	}
+	if !deduped.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, deduped)
+	}
+
+	deduped, collapsed = dedupeSamples(nil)
+	if collapsed != 0 || len(deduped) != 0 {
+		t.Errorf("Expected empty result, got %v", deduped)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// contentSha256Header carries the hex encoded SHA-256 of a write request body, as sent by the bench and
+// verify subcommands.
+const contentSha256Header = "X-Content-Sha256"
+
+// Reasons counted by the digest failures counter.
+const (
+	digestMismatch = "mismatch"
+	digestMissing  = "missing"
+)
+
+// requireDigest is -write-require-digest: write requests without a digest of their body are rejected.
+var requireDigest = false
+
+// errDigestMissing is returned by checkBodyDigest for a request without digest when one is required.
+var errDigestMissing = errors.New("request has no " + contentSha256Header + " or Digest header with a SHA-256 of its body")
+
+// checkBodyDigest checks the body of a write request, as received, against the SHA-256 of the
+// X-Content-Sha256 header and of the SHA-256 entry of the Digest header (RFC 3230), those that are set. Without
+// either, it returns errDigestMissing if required, and nil otherwise.
+func checkBodyDigest(h http.Header, body []byte, required bool) error {
+	sum := sha256.Sum256(body)
+	checked := false
+	if value := h.Get(contentSha256Header); value != "" {
+		expected, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(expected) != sha256.Size {
+			return fmt.Errorf("%s is not a hex encoded SHA-256", contentSha256Header)
+		}
+		if !bytes.Equal(expected, sum[:]) {
+			return fmt.Errorf("body doesn't match %s", contentSha256Header)
+		}
+		checked = true
+	}
+	for _, instance := range strings.Split(strings.Join(h.Values("Digest"), ","), ",") {
+		algorithm, value, _ := strings.Cut(strings.TrimSpace(instance), "=")
+		if !strings.EqualFold(algorithm, "SHA-256") {
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(expected) != sha256.Size {
+			return errors.New("SHA-256 Digest is not a base64 encoded SHA-256")
+		}
+		if !bytes.Equal(expected, sum[:]) {
+			return errors.New("body doesn't match the SHA-256 Digest")
+		}
+		checked = true
+	}
+	if !checked && required {
+		return errDigestMissing
+	}
+	return nil
+}
+
+// setBodyDigest sets the X-Content-Sha256 header of a write request with body.
+func setBodyDigest(h http.Header, body []byte) {
+	sum := sha256.Sum256(body)
+	h.Set(contentSha256Header, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestCheckBodyDigest(t *testing.T) {
+	body := []byte("snappy compressed write request")
+	sum := sha256.Sum256(body)
+	hexSum, base64Sum := hex.EncodeToString(sum[:]), base64.StdEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("corrupted"))
+	for _, c := range []struct {
+		name     string
+		header   http.Header
+		required bool
+		ok       bool
+	}{
+		{name: "none", header: http.Header{}, ok: true},
+		{name: "none required", header: http.Header{}, required: true},
+		{name: "sha256", header: http.Header{contentSha256Header: {hexSum}}, required: true, ok: true},
+		{name: "sha256 upper case", header: http.Header{contentSha256Header: {" " + strings.ToUpper(hexSum)}}, ok: true},
+		{name: "sha256 mismatch", header: http.Header{contentSha256Header: {hex.EncodeToString(other[:])}}},
+		{name: "sha256 invalid", header: http.Header{contentSha256Header: {"abc"}}},
+		{name: "digest", header: http.Header{"Digest": {"SHA-256=" + base64Sum}}, required: true, ok: true},
+		{name: "digest list", header: http.Header{"Digest": {"md5=HUXZLQLMuI/KZ5KDcJPcOA==, sha-256=" + base64Sum}}, required: true, ok: true},
+		{name: "digest mismatch", header: http.Header{"Digest": {"SHA-256=" + base64.StdEncoding.EncodeToString(other[:])}}},
+		{name: "digest invalid", header: http.Header{"Digest": {"SHA-256=" + hexSum}}},
+		{name: "digest other algorithm", header: http.Header{"Digest": {"md5=HUXZLQLMuI/KZ5KDcJPcOA=="}}, ok: true},
+		{name: "digest other algorithm required", header: http.Header{"Digest": {"md5=HUXZLQLMuI/KZ5KDcJPcOA=="}}, required: true},
+		{name: "both", header: http.Header{contentSha256Header: {hexSum}, "Digest": {"SHA-256=" + base64Sum}}, ok: true},
+		{name: "both one mismatch", header: http.Header{contentSha256Header: {hexSum}, "Digest": {"SHA-256=" + base64.StdEncoding.EncodeToString(other[:])}}},
+	} {
+		if err := checkBodyDigest(c.header, body, c.required); (err == nil) != c.ok {
+			t.Errorf("%s: expected ok %v, got %v", c.name, c.ok, err)
+		}
+	}
+}
+
+func TestWriteDigest(t *testing.T) {
+	defer func() {
+		requireDigest = false
+	}()
+	body := encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}})
+	corrupted := append([]byte(nil), body...)
+	corrupted[len(corrupted)-1] ^= 1
+
+	post := func(body []byte, digestOf []byte) (*httptest.ResponseRecorder, *fakeWriter) {
+		writer := &fakeWriter{}
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/write", bytes.NewReader(body))
+		if digestOf != nil {
+			setBodyDigest(req.Header, digestOf)
+		}
+		write(testMetrics, writer, false).ServeHTTP(recorder, req)
+		return recorder, writer
+	}
+
+	mismatches := testutil.ToFloat64(testMetrics.writeDigestFailures.WithLabelValues(digestMismatch))
+	recorder, writer := post(corrupted, body)
+	if recorder.Code != http.StatusBadRequest || writer.calls != 0 {
+		t.Errorf("Expected a corrupted body to be rejected with 400, got %d and %d writes", recorder.Code, writer.calls)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != "digest_mismatch" {
+		t.Errorf("Expected code digest_mismatch, got %q", resp.Code)
+	}
+	if n := testutil.ToFloat64(testMetrics.writeDigestFailures.WithLabelValues(digestMismatch)) - mismatches; n != 1 {
+		t.Errorf("Expected 1 mismatch to be counted, got %v", n)
+	}
+	if recorder, writer := post(body, body); recorder.Code != http.StatusOK || writer.calls != 1 {
+		t.Errorf("Expected a matching body to be written, got %d and %d writes", recorder.Code, writer.calls)
+	}
+	if recorder, writer := post(body, nil); recorder.Code != http.StatusOK || writer.calls != 1 {
+		t.Errorf("Expected a body without digest to be written, got %d and %d writes", recorder.Code, writer.calls)
+	}
+
+	requireDigest = true
+	missing := testutil.ToFloat64(testMetrics.writeDigestFailures.WithLabelValues(digestMissing))
+	if recorder, writer := post(body, nil); recorder.Code != http.StatusBadRequest || writer.calls != 0 {
+		t.Errorf("Expected a body without digest to be rejected with 400, got %d and %d writes", recorder.Code, writer.calls)
+	}
+	if n := testutil.ToFloat64(testMetrics.writeDigestFailures.WithLabelValues(digestMissing)) - missing; n != 1 {
+		t.Errorf("Expected 1 missing digest to be counted, got %v", n)
+	}
+}
+
+func TestRemoteWriterDigest(t *testing.T) {
+	defer func() {
+		requireDigest = false
+	}()
+	requireDigest = true
+	writer := &fakeWriter{}
+	server := httptest.NewServer(write(testMetrics, writer, false))
+	defer server.Close()
+	remote := &remoteWriter{url: server.URL, client: server.Client()}
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1, Timestamp: 1000}}
+	if _, err := remote.WriteContext(context.Background(), samples); err != nil {
+		t.Fatalf("Expected the bench and verify writes to pass the digest check, got %v", err)
+	}
+	if len(writer.samples) != 1 {
+		t.Errorf("Expected the sample to be written, got %v", writer.samples)
+	}
+}
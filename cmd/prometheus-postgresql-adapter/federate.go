@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+const (
+	// maxFederationCacheEntries is the number of distinct match[] sets cached, the cache is cleared when it
+	// is full.
+	maxFederationCacheEntries = 100
+	federationHelp            = "Latest value stored in the database."
+)
+
+type latestQuerier interface {
+	LatestSamples(ctx context.Context, selectors [][]*labels.Matcher, since time.Time, limit int) (model.Vector, error)
+}
+
+// federationCache keeps the rendered responses of /federate for ttl, by match[] set, as federation scrapes
+// repeat the same queries periodically.
+type federationCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]federationEntry
+}
+
+type federationEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+func newFederationCache(ttl time.Duration) *federationCache {
+	return &federationCache{ttl: ttl, now: time.Now, entries: map[string]federationEntry{}}
+}
+
+func (c *federationCache) get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !c.now().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (c *federationCache) put(key string, body []byte) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	if len(c.entries) >= maxFederationCacheEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxFederationCacheEntries {
+			c.entries = map[string]federationEntry{}
+		}
+	}
+	c.entries[key] = federationEntry{body: body, expires: now.Add(c.ttl)}
+}
+
+// federateHandler serves GET /federate with the latest sample within lookback of each series matching the
+// match[] selectors, in the text exposition format, for a Prometheus to scrape. Queries matching more than
+// maxSeries series fail. Staleness markers, and series with names that aren't valid in the text format, are
+// left out.
+func federateHandler(querier latestQuerier, lookback time.Duration, maxSeries int, cache *federationCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, fmt.Sprintf("error parsing form values: %v", err), nil)
+			return
+		}
+		matches := append([]string(nil), r.Form["match[]"]...)
+		if len(matches) == 0 {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "no match[] parameter provided", nil)
+			return
+		}
+		sort.Strings(matches)
+		key := strings.Join(matches, "\n")
+		if body, ok := cache.get(key); ok {
+			writeFederation(w, body)
+			return
+		}
+		var selectors [][]*labels.Matcher
+		for _, s := range matches {
+			matchers, err := parser.ParseMetricSelector(s)
+			if err != nil {
+				util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+				return
+			}
+			selectors = append(selectors, matchers)
+		}
+		selectors = normalizeMatchers(namePolicy, selectors)
+		samples, err := querier.LatestSamples(r.Context(), selectors, cache.now().Add(-lookback), maxSeries)
+		if errors.Is(err, pgprometheus.ErrTooManySeries) {
+			msg := fmt.Sprintf("query matches more than %d series, use a more specific selector", maxSeries)
+			util.WriteAPIError(w, http.StatusUnprocessableEntity, errorExecution, util.ErrCodeLimitExceeded, msg, nil)
+			return
+		}
+		if err != nil {
+			writeQueryError(w, r, err)
+			return
+		}
+		var body bytes.Buffer
+		if err := renderFederation(&body, samples); err != nil {
+			util.WriteAPIError(w, http.StatusInternalServerError, errorExecution, util.ErrCodeQuery, "error rendering the samples", err)
+			return
+		}
+		cache.put(key, body.Bytes())
+		writeFederation(w, body.Bytes())
+	})
+}
+
+func writeFederation(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+	_, _ = w.Write(body)
+}
+
+// renderFederation writes the samples in the text exposition format, as untyped metrics grouped by metric
+// name, in the order of their metric names and label sets.
+func renderFederation(w io.Writer, samples model.Vector) error {
+	sorted := make(model.Vector, 0, len(samples))
+	for _, s := range samples {
+		if value.IsStaleNaN(float64(s.Value)) || !validExpositionNames(s.Metric) {
+			continue
+		}
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Metric, sorted[j].Metric
+		if a[model.MetricNameLabel] != b[model.MetricNameLabel] {
+			return a[model.MetricNameLabel] < b[model.MetricNameLabel]
+		}
+		return a.String() < b.String()
+	})
+	var family *dto.MetricFamily
+	for _, s := range sorted {
+		name := string(s.Metric[model.MetricNameLabel])
+		if family == nil || family.GetName() != name {
+			if family != nil {
+				if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+					return err
+				}
+			}
+			help := federationHelp
+			family = &dto.MetricFamily{Name: &name, Help: &help, Type: dto.MetricType_UNTYPED.Enum()}
+		}
+		family.Metric = append(family.Metric, federatedMetric(s))
+	}
+	if family != nil {
+		_, err := expfmt.MetricFamilyToText(w, family)
+		return err
+	}
+	return nil
+}
+
+func federatedMetric(s *model.Sample) *dto.Metric {
+	names := make([]string, 0, len(s.Metric))
+	for name := range s.Metric {
+		if name != model.MetricNameLabel {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	pairs := make([]*dto.LabelPair, len(names))
+	for i, name := range names {
+		name, value := name, string(s.Metric[model.LabelName(name)])
+		pairs[i] = &dto.LabelPair{Name: &name, Value: &value}
+	}
+	v, timestamp := float64(s.Value), int64(s.Timestamp)
+	return &dto.Metric{Label: pairs, Untyped: &dto.Untyped{Value: &v}, TimestampMs: &timestamp}
+}
+
+// validExpositionNames tells whether the metric name and the label names of a series are valid in the text
+// exposition format understood by every Prometheus version.
+func validExpositionNames(metric model.Metric) bool {
+	for name, value := range metric {
+		if name == model.MetricNameLabel {
+			if !util.IsValidMetricName(string(value)) {
+				return false
+			}
+			continue
+		}
+		if !util.IsValidLabelName(string(name)) {
+			return false
+		}
+	}
+	_, ok := metric[model.MetricNameLabel]
+	return ok
+}
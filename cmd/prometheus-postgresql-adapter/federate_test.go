@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+)
+
+type fakeLatestQuerier struct {
+	samples   model.Vector
+	err       error
+	calls     int
+	selectors [][]*labels.Matcher
+	since     time.Time
+}
+
+func (f *fakeLatestQuerier) LatestSamples(_ context.Context, selectors [][]*labels.Matcher, since time.Time, _ int) (model.Vector, error) {
+	f.calls++
+	f.selectors, f.since = selectors, since
+	return f.samples, f.err
+}
+
+func federate(t *testing.T, handler http.Handler, matches ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	query := url.Values{"match[]": matches}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/federate?"+query.Encode(), nil))
+	return recorder
+}
+
+func TestFederate(t *testing.T) {
+	at := model.TimeFromUnix(1700000000)
+	querier := &fakeLatestQuerier{samples: model.Vector{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node", "instance": `host "a"`}, Value: 1, Timestamp: at},
+		{Metric: model.Metric{model.MetricNameLabel: "node_load1", "job": "node"}, Value: 0.5, Timestamp: at.Add(-time.Second)},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "api"}, Value: 0, Timestamp: at},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "gone"}, Value: model.SampleValue(math.Float64frombits(value.StaleNaN)), Timestamp: at},
+		{Metric: model.Metric{model.MetricNameLabel: "http.requests", "job": "api"}, Value: 3, Timestamp: at},
+		{Metric: model.Metric{model.MetricNameLabel: "temperature", "sensor": "a"}, Value: model.SampleValue(math.Inf(-1)), Timestamp: at},
+	}}
+	cache := newFederationCache(0)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time {
+		return now
+	}
+	recorder := federate(t, federateHandler(querier, 5*time.Minute, 100, cache), `{job=~"node|api"}`, "temperature")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the text exposition format, got %q", contentType)
+	}
+	if len(querier.selectors) != 2 || !querier.since.Equal(now.Add(-5*time.Minute)) {
+		t.Errorf("Expected the selectors to be queried over the lookback, got %v since %v", querier.selectors, querier.since)
+	}
+	expected := `# HELP node_load1 Latest value stored in the database.
+# TYPE node_load1 untyped
+node_load1{job="node"} 0.5 1699999999000
+# HELP temperature Latest value stored in the database.
+# TYPE temperature untyped
+temperature{sensor="a"} -Inf 1700000000000
+# HELP up Latest value stored in the database.
+# TYPE up untyped
+up{instance="host \"a\"",job="node"} 1 1700000000000
+up{job="api"} 0 1700000000000
+`
+	body := recorder.Body.String()
+	if body != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, body)
+	}
+
+	// what promtool check metrics does
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Expected the output to parse, got %v", err)
+	}
+	if len(families) != 3 || len(families["up"].Metric) != 2 {
+		t.Errorf("Expected 3 metric families, got %v", families)
+	}
+	problems, err := promlint.New(strings.NewReader(body)).Lint()
+	if err != nil || len(problems) > 0 {
+		t.Errorf("Expected the output to pass the lint, got %v, %v", problems, err)
+	}
+}
+
+func TestFederateCache(t *testing.T) {
+	querier := &fakeLatestQuerier{samples: model.Vector{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1, Timestamp: 1000}}}
+	cache := newFederationCache(10 * time.Second)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time {
+		return now
+	}
+	handler := federateHandler(querier, time.Minute, 100, cache)
+	first := federate(t, handler, "up", `{job="a"}`).Body.String()
+	// the order of the match[] parameters doesn't matter
+	if second := federate(t, handler, `{job="a"}`, "up").Body.String(); second != first || querier.calls != 1 {
+		t.Errorf("Expected the cached response, got %d queries", querier.calls)
+	}
+	federate(t, handler, "up")
+	if querier.calls != 2 {
+		t.Errorf("Expected other match[] parameters to be queried, got %d queries", querier.calls)
+	}
+	now = now.Add(10 * time.Second)
+	federate(t, handler, "up", `{job="a"}`)
+	if querier.calls != 3 {
+		t.Errorf("Expected an expired response to be queried again, got %d queries", querier.calls)
+	}
+
+	// errors aren't cached
+	querier.err = pgprometheus.ErrTooManySeries
+	now = now.Add(time.Minute)
+	if recorder := federate(t, handler, "up"); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for too many series, got %d", recorder.Code)
+	}
+	querier.err = nil
+	if recorder := federate(t, handler, "up"); recorder.Code != http.StatusOK || querier.calls != 5 {
+		t.Errorf("Expected the query to be run again after an error, got %d and %d queries", recorder.Code, querier.calls)
+	}
+}
+
+func TestFederateBadRequests(t *testing.T) {
+	handler := federateHandler(&fakeLatestQuerier{}, time.Minute, 100, newFederationCache(0))
+	if recorder := federate(t, handler); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without match[], got %d", recorder.Code)
+	}
+	if recorder := federate(t, handler, "up{"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid selector, got %d", recorder.Code)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/federate?match[]=up", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"runtime/debug"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// applyGCSettings sets the garbage collection target percentage and the soft memory limit of the runtime,
+// where positive. They take precedence over the GOGC and GOMEMLIMIT environment variables.
+func applyGCSettings(gcPercent int, memoryLimit int64) {
+	if gcPercent > 0 {
+		previous := debug.SetGCPercent(gcPercent)
+		log.Info("msg", "Set the garbage collection target percentage", "percent", gcPercent, "previous", previous)
+	}
+	if memoryLimit > 0 {
+		previous := debug.SetMemoryLimit(memoryLimit)
+		log.Info("msg", "Set the soft memory limit", "bytes", memoryLimit, "previous", previous)
+	}
+}
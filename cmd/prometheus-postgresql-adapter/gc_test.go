@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/debug"
+	runtimemetrics "runtime/metrics"
+	"testing"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+func TestApplyGCSettings(t *testing.T) {
+	previousPercent := debug.SetGCPercent(100)
+	previousLimit := debug.SetMemoryLimit(math.MaxInt64)
+	defer func() {
+		debug.SetGCPercent(previousPercent)
+		debug.SetMemoryLimit(previousLimit)
+	}()
+
+	applyGCSettings(0, 0)
+	if percent, limit := debug.SetGCPercent(100), debug.SetMemoryLimit(-1); percent != 100 || limit != math.MaxInt64 {
+		t.Errorf("Expected unset settings to keep the runtime ones, got %d%% and %d bytes", percent, limit)
+	}
+	applyGCSettings(400, 1<<30)
+	if percent, limit := debug.SetGCPercent(100), debug.SetMemoryLimit(-1); percent != 400 || limit != 1<<30 {
+		t.Errorf("Expected 400%% and 1GiB, got %d%% and %d bytes", percent, limit)
+	}
+}
+
+// TestGCSettingsLoad sends the load of the bench subcommand to an in-process adapter writing to a dry run,
+// once with the default garbage collection settings and once tuned, and logs throughput, write latency and
+// garbage collection of both. The sender runs in the same process, so it is subject to the same settings.
+// It takes a while and is skipped unless TS_PROM_LOAD_TEST is set:
+//
+//	TS_PROM_LOAD_TEST=1 go test -run TestGCSettingsLoad -v ./cmd/prometheus-postgresql-adapter
+//
+// On a single core, 100k series with 5 labels in batches of 2000 and 8 concurrent writes, 20s each:
+//
+//	default (100%, no limit):  163k samples/s, p50 94ms, p99 189ms, 161 GC cycles, GC 22.5% CPU, heap 97 MiB
+//	tuned (400%, 1GiB limit):  202k samples/s, p50 66ms, p99 177ms, 45 GC cycles, GC 7.7% CPU, heap 290 MiB
+//
+// Tuning trades about three times the heap for a quarter more throughput, so the defaults keep the runtime
+// settings. The figures vary with the machine; rerun it to choose settings for the deployment at hand.
+func TestGCSettingsLoad(t *testing.T) {
+	if os.Getenv("TS_PROM_LOAD_TEST") == "" {
+		t.Skip("TS_PROM_LOAD_TEST not set")
+	}
+	server := httptest.NewServer(write(testMetrics, writers.NewDryRun(0, 0), false))
+	defer server.Close()
+	previousPercent := debug.SetGCPercent(100)
+	previousLimit := debug.SetMemoryLimit(math.MaxInt64)
+	defer func() {
+		debug.SetGCPercent(previousPercent)
+		debug.SetMemoryLimit(previousLimit)
+	}()
+
+	for _, c := range []struct {
+		name        string
+		gcPercent   int
+		memoryLimit int64
+	}{
+		{name: "default", gcPercent: 100, memoryLimit: math.MaxInt64},
+		{name: "tuned", gcPercent: 400, memoryLimit: 1 << 30},
+	} {
+		debug.SetGCPercent(c.gcPercent)
+		debug.SetMemoryLimit(c.memoryLimit)
+		cfg, err := parseBenchFlags([]string{"-url", server.URL, "-series", "100000", "-duration", "20s", "-batch-size", "2000", "-concurrency", "8"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runtime.GC()
+		before := readGCStats()
+		result := runBenchLoad(context.Background(), cfg, &remoteWriter{url: cfg.url, client: server.Client()})
+		after := readGCStats()
+		if result.errors != 0 {
+			t.Errorf("%s: expected no errors, got %d", c.name, result.errors)
+		}
+		t.Logf("%s: %.0f samples/s, p50 %v, p99 %v, %d GC cycles, GC %.1f%% CPU, heap %d MiB", c.name,
+			float64(result.samples)/result.elapsed.Seconds(), result.percentile(0.5).Round(time.Millisecond), result.percentile(0.99).Round(time.Millisecond),
+			after[0].Value.Uint64()-before[0].Value.Uint64(),
+			100*(after[1].Value.Float64()-before[1].Value.Float64())/(after[2].Value.Float64()-before[2].Value.Float64()),
+			after[3].Value.Uint64()>>20)
+	}
+}
+
+// readGCStats reads the number of GC cycles, the CPU time spent collecting and in total, and the heap size.
+func readGCStats() []runtimemetrics.Sample {
+	samples := []runtimemetrics.Sample{
+		{Name: "/gc/cycles/total:gc-cycles"},
+		{Name: "/cpu/classes/gc/total:cpu-seconds"},
+		{Name: "/cpu/classes/total:cpu-seconds"},
+		{Name: "/memory/classes/heap/objects:bytes"},
+	}
+	runtimemetrics.Read(samples)
+	return samples
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+// healthResponse is the body of /healthz. Error and Code are those of an ErrorResponse, set when the writes
+// are stale.
+type healthResponse struct {
+	Status string `json:"status"`
+	// LastSuccessfulWrite is the time of the last successful write, by remote storage
+	LastSuccessfulWrite map[string]time.Time `json:"lastSuccessfulWrite"`
+	Error               string               `json:"error,omitempty"`
+	Code                string               `json:"code,omitempty"`
+}
+
+// lastWrites keeps the time of the last successful write to each remote storage.
+type lastWrites struct {
+	mutex sync.Mutex
+	times map[string]time.Time
+}
+
+var successfulWrites = &lastWrites{times: map[string]time.Time{}}
+
+func (l *lastWrites) record(remote string, t time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.times[remote] = t
+}
+
+// snapshot returns a copy of the times by remote, and the latest of them.
+func (l *lastWrites) snapshot() (map[string]time.Time, time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	times := make(map[string]time.Time, len(l.times))
+	var latest time.Time
+	for remote, t := range l.times {
+		times[remote] = t
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return times, latest
+}
+
+// recordSuccessfulWrite records a write of samples to the remote storage that succeeded, at least partly.
+func (m *metrics) recordSuccessfulWrite(remote string) {
+	now := time.Now()
+	successfulWrites.record(remote, now)
+	m.lastSuccessfulWrite.WithLabelValues(remote).Set(float64(now.UnixNano()) / 1e9)
+}
+
+// writeStaleness tells whether an instance stopped writing although it should: it is the leader and
+// Prometheus has been sending requests, yet nothing was written for longer than max. Followers, which don't
+// write, and instances Prometheus stopped sending to, are never stale, so that they aren't restarted in a loop.
+type writeStaleness struct {
+	max time.Duration
+
+	mutex sync.Mutex
+	// leaderSince is when a check first saw the instance as the leader, zero while it isn't. A new leader
+	// gets max to write before it is stale, however old the last write of the instance.
+	leaderSince time.Time
+}
+
+// check returns how long the writes have been stale, 0 if they aren't.
+func (s *writeStaleness) check(now time.Time, isLeader bool, lastRequest time.Time, lastWrite time.Time) time.Duration {
+	if s.max <= 0 {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !isLeader {
+		s.leaderSince = time.Time{}
+		return 0
+	}
+	if s.leaderSince.IsZero() {
+		s.leaderSince = now
+	}
+	if now.Sub(lastRequest) > s.max {
+		return 0
+	}
+	since := lastWrite
+	if s.leaderSince.After(since) {
+		since = s.leaderSince
+	}
+	if stale := now.Sub(since); stale > s.max {
+		return stale
+	}
+	return 0
+}
+
+// healthzStaleness is the staleness of -healthz-max-write-staleness.
+var healthzStaleness = &writeStaleness{}
+
+// isWritingLeader tells whether this instance is the one writing, which it is without leader election.
+func isWritingLeader(leader util.LeaderElector) bool {
+	if leader == nil {
+		return true
+	}
+	isLeader, err := leader.IsLeader()
+	return err == nil && isLeader
+}
+
+// writeHealth answers a successful health check with the last successful writes, or 500 if they are stale.
+func writeHealth(w http.ResponseWriter, staleness *writeStaleness, leader util.LeaderElector) {
+	times, latest := successfulWrites.snapshot()
+	resp := healthResponse{Status: "ok", LastSuccessfulWrite: times}
+	status := http.StatusOK
+	if staleness.max > 0 {
+		now := time.Now()
+		if stale := staleness.check(now, isWritingLeader(leader), time.Unix(0, lastRequest.lastSeen()), latest); stale > 0 {
+			log.Warn("msg", "No successful write while receiving requests as the leader, failing the health check", "stale", stale, "max", staleness.max)
+			resp.Status = "error"
+			resp.Code = util.ErrCodeWriteStale
+			resp.Error = fmt.Sprintf("no successful write for %v while receiving requests as the leader", stale.Round(time.Second))
+			status = http.StatusInternalServerError
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+func TestWriteStaleness(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := &writeStaleness{max: 5 * time.Minute}
+	at := func(d time.Duration) time.Time {
+		return start.Add(d)
+	}
+
+	// a new leader gets max to write, however old the last write
+	if stale := s.check(at(0), true, at(0), time.Time{}); stale != 0 {
+		t.Errorf("Expected a new leader not to be stale, got %v", stale)
+	}
+	if stale := s.check(at(4*time.Minute), true, at(4*time.Minute), time.Time{}); stale != 0 {
+		t.Errorf("Expected no staleness within max of becoming the leader, got %v", stale)
+	}
+	if stale := s.check(at(6*time.Minute), true, at(6*time.Minute), time.Time{}); stale != 6*time.Minute {
+		t.Errorf("Expected a leader receiving requests without writing to be stale for 6m, got %v", stale)
+	}
+	if stale := s.check(at(6*time.Minute), true, at(6*time.Minute), at(2*time.Minute)); stale != 0 {
+		t.Errorf("Expected a leader that wrote within max not to be stale, got %v", stale)
+	}
+	if stale := s.check(at(20*time.Minute), true, at(10*time.Minute), at(2*time.Minute)); stale != 0 {
+		t.Errorf("Expected a leader without recent requests not to be stale, got %v", stale)
+	}
+
+	// followers never write, and become leader with a fresh start
+	if stale := s.check(at(20*time.Minute), false, at(20*time.Minute), at(2*time.Minute)); stale != 0 {
+		t.Errorf("Expected a follower not to be stale, got %v", stale)
+	}
+	if stale := s.check(at(21*time.Minute), true, at(21*time.Minute), at(2*time.Minute)); stale != 0 {
+		t.Errorf("Expected a follower becoming the leader not to be stale, got %v", stale)
+	}
+	if stale := s.check(at(27*time.Minute), true, at(27*time.Minute), at(2*time.Minute)); stale != 6*time.Minute {
+		t.Errorf("Expected the staleness to count from becoming the leader, got %v", stale)
+	}
+
+	disabled := &writeStaleness{}
+	if stale := disabled.check(at(time.Hour), true, at(time.Hour), time.Time{}); stale != 0 {
+		t.Errorf("Expected no staleness when disabled, got %v", stale)
+	}
+}
+
+func TestHealthLastSuccessfulWrite(t *testing.T) {
+	testMetrics.recordSuccessfulWrite("healthz-test")
+	if ts := testutil.ToFloat64(testMetrics.lastSuccessfulWrite.WithLabelValues("healthz-test")); time.Since(time.Unix(int64(ts), 0)) > time.Minute {
+		t.Errorf("Expected the gauge to be the time of the write, got %v", ts)
+	}
+	recorder := httptest.NewRecorder()
+	health(fakeHealthChecker{}).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", recorder.Code)
+	}
+	var resp healthResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Health body is not JSON: %v (%q)", err, recorder.Body.String())
+	}
+	if last, ok := resp.LastSuccessfulWrite["healthz-test"]; resp.Status != "ok" || !ok || time.Since(last) > time.Minute {
+		t.Errorf("Expected the last successful write of the remote, got %+v", resp)
+	}
+}
+
+func TestHealthWriteStale(t *testing.T) {
+	savedRequest, savedWrites := lastRequest, successfulWrites
+	lastRequest = newLiveness(time.Now())
+	successfulWrites = &lastWrites{times: map[string]time.Time{}}
+	defer func() {
+		lastRequest, successfulWrites = savedRequest, savedWrites
+	}()
+	staleness := &writeStaleness{max: time.Minute, leaderSince: time.Now().Add(-time.Hour)}
+	successfulWrites.record("healthz-stale-test", time.Now().Add(-time.Hour))
+
+	election := util.NewFakeElection("fake")
+	recorder := httptest.NewRecorder()
+	writeHealth(recorder, staleness, election)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected a follower to be healthy, got %d", recorder.Code)
+	}
+
+	// only instances writing without leader election or as the leader fail the check
+	for name, leader := range map[string]util.LeaderElector{"no election": nil, "leader": election} {
+		election.SetLeader(true)
+		staleness.leaderSince = time.Now().Add(-time.Hour)
+		recorder = httptest.NewRecorder()
+		writeHealth(recorder, staleness, leader)
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected status 500, got %d", name, recorder.Code)
+		}
+		if resp := decodeErrorResponse(t, recorder); resp.Code != "write_stale" {
+			t.Errorf("%s: expected code write_stale, got %q", name, resp.Code)
+		}
+	}
+}
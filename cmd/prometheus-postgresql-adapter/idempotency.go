@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Results of the lookups of write requests in the write result cache
+const (
+	idempotencyHit       = "hit"
+	idempotencyWaitedHit = "waited_hit"
+	idempotencyMiss      = "miss"
+)
+
+// writeResults is the cache of -write-idempotency-ttl, nil if disabled.
+var writeResults *writeResultCache
+
+// writeResultCache remembers the write requests committed within ttl, by hash, for an identical request, such
+// as a retry of a request that timed out at the sender while it was written, to succeed without being
+// written again. Requests in flight are remembered too: identical requests wait for them. It is per instance,
+// retries sent to other instances are written again.
+type writeResultCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mutex   sync.Mutex
+	entries map[uint64]*writeResult
+	// committed are the keys of the committed requests, oldest first
+	committed *list.List
+}
+
+type writeResult struct {
+	// done is closed once the request in flight is over
+	done    chan struct{}
+	element *list.Element
+	expires time.Time
+}
+
+func newWriteResultCache(ttl time.Duration, maxEntries int) *writeResultCache {
+	return &writeResultCache{ttl: ttl, maxEntries: maxEntries, now: time.Now, entries: map[uint64]*writeResult{}, committed: list.New()}
+}
+
+// key hashes the compressed body of a write request together with what else decides the written samples:
+// the source label and the tenant of the quotas.
+func (c *writeResultCache) key(r *http.Request, body []byte) uint64 {
+	d := xxhash.New()
+	_, _ = d.Write(body)
+	if sources != nil {
+		_, _ = d.WriteString("\x00" + sources.source(r))
+	}
+	if quotas != nil {
+		_, _ = d.WriteString("\x00" + r.Header.Get(quotas.TenantHeader()))
+	}
+	return d.Sum64()
+}
+
+// begin returns idempotencyHit if an identical request committed within the ttl, and idempotencyWaitedHit if
+// it committed while the request waited for it. Otherwise, the request is in flight until end is called,
+// and it returns idempotencyMiss. The error is that of ctx if it is done while waiting.
+func (c *writeResultCache) begin(ctx context.Context, key uint64) (string, error) {
+	waited := false
+	for {
+		c.mutex.Lock()
+		result, ok := c.entries[key]
+		switch {
+		case !ok:
+			c.entries[key] = &writeResult{done: make(chan struct{})}
+			c.mutex.Unlock()
+			return idempotencyMiss, nil
+		case result.element == nil:
+			c.mutex.Unlock()
+			select {
+			case <-result.done:
+				waited = true
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		case c.now().Before(result.expires):
+			c.mutex.Unlock()
+			if waited {
+				return idempotencyWaitedHit, nil
+			}
+			return idempotencyHit, nil
+		default:
+			c.committed.Remove(result.element)
+			delete(c.entries, key)
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// end ends the request in flight begun with key. Committed requests are remembered for the ttl, forgetting
+// the oldest ones beyond maxEntries, the others are forgotten right away.
+func (c *writeResultCache) end(key uint64, committed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := c.entries[key]
+	close(result.done)
+	if !committed {
+		delete(c.entries, key)
+		return
+	}
+	result.expires = c.now().Add(c.ttl)
+	result.element = c.committed.PushBack(key)
+	for c.committed.Len() > c.maxEntries {
+		delete(c.entries, c.committed.Remove(c.committed.Front()).(uint64))
+	}
+}
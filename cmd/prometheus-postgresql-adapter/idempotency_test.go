@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestWriteResultCache(t *testing.T) {
+	cache := newWriteResultCache(time.Minute, 2)
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time {
+		return now
+	}
+	ctx := context.Background()
+	begin := func(key uint64) string {
+		t.Helper()
+		result, err := cache.begin(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if result := begin(1); result != idempotencyMiss {
+		t.Fatalf("Expected a miss, got %s", result)
+	}
+	cache.end(1, true)
+	if result := begin(1); result != idempotencyHit {
+		t.Errorf("Expected a committed request to be a hit, got %s", result)
+	}
+
+	// failed requests aren't remembered
+	begin(2)
+	cache.end(2, false)
+	if result := begin(2); result != idempotencyMiss {
+		t.Errorf("Expected a failed request to be a miss, got %s", result)
+	}
+	cache.end(2, true)
+
+	// the oldest requests are forgotten beyond the maximum
+	begin(3)
+	cache.end(3, true)
+	if result := begin(1); result != idempotencyMiss || len(cache.entries) != 3 {
+		t.Errorf("Expected the oldest request to be forgotten, got %s and %d entries", result, len(cache.entries))
+	}
+	cache.end(1, false)
+
+	now = now.Add(time.Minute)
+	if result := begin(3); result != idempotencyMiss {
+		t.Errorf("Expected an expired request to be a miss, got %s", result)
+	}
+	cache.end(3, false)
+}
+
+func TestWriteResultCacheInFlight(t *testing.T) {
+	cache := newWriteResultCache(time.Minute, 10)
+	if _, err := cache.begin(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan string)
+	go func() {
+		result, _ := cache.begin(context.Background(), 1)
+		results <- result
+	}()
+	select {
+	case result := <-results:
+		t.Fatalf("Expected an identical request to wait for the one in flight, got %s", result)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cache.end(1, true)
+	if result := <-results; result != idempotencyWaitedHit {
+		t.Errorf("Expected a hit once the request in flight committed, got %s", result)
+	}
+
+	if _, err := cache.begin(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cache.begin(ctx, 2); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected waiting to stop with the context, got %v", err)
+	}
+}
+
+func TestWriteIdempotency(t *testing.T) {
+	writeResults = newWriteResultCache(time.Minute, 10)
+	defer func() {
+		writeResults = nil
+	}()
+	body := encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}})
+	writer := &fakeWriter{err: errors.New("connection refused")}
+	post := func() int {
+		recorder := httptest.NewRecorder()
+		write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(body)))
+		return recorder.Code
+	}
+	hits := testutil.ToFloat64(testMetrics.writeIdempotency.WithLabelValues(idempotencyHit))
+
+	if code := post(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the failed write to fail, got %d", code)
+	}
+	writer.err = nil
+	if code := post(); code != http.StatusOK || writer.calls != 2 {
+		t.Fatalf("Expected the retry of a failed write to be written, got %d and %d writes", code, writer.calls)
+	}
+	if code := post(); code != http.StatusOK || writer.calls != 2 {
+		t.Errorf("Expected the retry of a committed write not to be written again, got %d and %d writes", code, writer.calls)
+	}
+	if n := testutil.ToFloat64(testMetrics.writeIdempotency.WithLabelValues(idempotencyHit)) - hits; n != 1 {
+		t.Errorf("Expected 1 hit to be counted, got %v", n)
+	}
+}
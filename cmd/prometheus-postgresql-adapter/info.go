@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+type describer interface {
+	Describe(ctx context.Context) (*pgprometheus.Description, error)
+}
+
+// logDescription logs a summary of the database at startup, as a single entry.
+func logDescription(d describer) {
+	description, err := d.Describe(context.Background())
+	if err != nil {
+		log.Warn("msg", "Error describing the database", "err", err)
+		return
+	}
+	log.Info(descriptionKeyvals(description)...)
+}
+
+// descriptionKeyvals flattens a description into log key/value pairs, one per relation.
+func descriptionKeyvals(d *pgprometheus.Description) []interface{} {
+	timescale := d.TimescaleDB
+	if timescale == "" {
+		timescale = "absent"
+	}
+	keyvals := []interface{}{"msg", "Connected to the database", "server_version", d.ServerVersion, "timescaledb", timescale,
+		"user", d.User, "database", d.Database, "schema", d.Schema, "search_path", d.SearchPath, "schema_layout", d.SchemaLayout}
+	for _, r := range d.Relations {
+		value := "missing"
+		switch {
+		case r.Exists && r.EstimatedRows != nil:
+			value = fmt.Sprintf("%s, ~%d rows", r.Kind, *r.EstimatedRows)
+		case r.Exists:
+			value = r.Kind
+		}
+		keyvals = append(keyvals, r.Name, value)
+	}
+	var missing []string
+	for _, idx := range d.Indexes {
+		if idx.Status != pgprometheus.IndexOK {
+			missing = append(missing, fmt.Sprintf("%s (%s)", idx.Index, idx.Status))
+		}
+	}
+	indexes := "ok"
+	if len(missing) > 0 {
+		indexes = strings.Join(missing, "; ")
+	}
+	return append(keyvals, "indexes", indexes)
+}
+
+// infoHandler serves GET /admin/info with the same summary of the database as logged at startup.
+func infoHandler(d describer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		description, err := d.Describe(r.Context())
+		if err != nil {
+			util.WriteAPIError(w, http.StatusInternalServerError, errorExecution, util.ErrCodeStorageUnavailable, "error describing the database", err)
+			return
+		}
+		writeAPIData(w, description)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+type fakeDescriber struct {
+	description *pgprometheus.Description
+	err         error
+}
+
+func (f fakeDescriber) Describe(ctx context.Context) (*pgprometheus.Description, error) {
+	return f.description, f.err
+}
+
+func testDescription() *pgprometheus.Description {
+	rows := int64(42)
+	return &pgprometheus.Description{
+		ServerVersion: "16.4",
+		User:          "prometheus",
+		Database:      "metrics",
+		Schema:        "public",
+		SearchPath:    `"$user", public`,
+		SchemaLayout:  pgprometheus.SchemaLayoutPgPrometheusNormalized,
+		Relations: []pgprometheus.RelationInfo{
+			{Name: "metrics", Exists: true, Kind: "view"},
+			{Name: "metrics_labels", Exists: true, Kind: "table", EstimatedRows: &rows},
+			{Name: "metrics_values"},
+		},
+		Indexes: []pgprometheus.IndexStatus{
+			{Index: "gin index on metrics_labels (labels)", Status: pgprometheus.IndexOK},
+			{Index: "btree index on metrics_values (time)", Status: pgprometheus.IndexMissing},
+		},
+	}
+}
+
+func TestDescriptionKeyvals(t *testing.T) {
+	keyvals := descriptionKeyvals(testDescription())
+	values := map[interface{}]interface{}{}
+	for i := 0; i < len(keyvals); i += 2 {
+		values[keyvals[i]] = keyvals[i+1]
+	}
+	expected := map[string]string{
+		"timescaledb":    "absent",
+		"search_path":    `"$user", public`,
+		"schema_layout":  "pg_prometheus_normalized",
+		"metrics":        "view",
+		"metrics_labels": "table, ~42 rows",
+		"metrics_values": "missing",
+		"indexes":        "btree index on metrics_values (time) (missing)",
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("Expected %s=%q, got %q", key, value, values[key])
+		}
+	}
+}
+
+func TestInfoHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	infoHandler(fakeDescriber{description: testDescription()}).ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/info", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", recorder.Code)
+	}
+	var resp struct {
+		Data pgprometheus.Description `json:"data"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.ServerVersion != "16.4" || resp.Data.SchemaLayout != pgprometheus.SchemaLayoutPgPrometheusNormalized || len(resp.Data.Relations) != 3 || *resp.Data.Relations[1].EstimatedRows != 42 {
+		t.Errorf("Unexpected description %+v", resp.Data)
+	}
+
+	recorder = httptest.NewRecorder()
+	infoHandler(fakeDescriber{err: errors.New("connection refused")}).ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/info", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", recorder.Code)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeStorageUnavailable {
+		t.Errorf("Expected code %q, got %q", util.ErrCodeStorageUnavailable, resp.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	infoHandler(fakeDescriber{description: testDescription()}).ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/info", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+)
+
+// initDBInstance is the instance label of the self-test sample written when verifying the adapter role.
+const initDBInstance = "init-db"
+
+// initDBConfig configures the init-db subcommand. pg connects as the owner of the schema, and holds the
+// configuration of the adapter, which decides the tables to create.
+type initDBConfig struct {
+	roles                pgprometheus.RolesConfig
+	passwordFile         string
+	readOnlyPasswordFile string
+	dryRun               bool
+	verify               bool
+	timeout              time.Duration
+	logLevel             string
+	pg                   pgprometheus.Config
+}
+
+func parseInitDBFlags(args []string) (*initDBConfig, error) {
+	cfg := &initDBConfig{}
+	fs := flag.NewFlagSet("init-db", flag.ContinueOnError)
+	fs.StringVar(&cfg.roles.Role, "role", "prometheus_adapter", "Login role of the adapter to create.")
+	fs.StringVar(&cfg.passwordFile, "role-password-file", "", "File holding the password of -role, as the adapter reads it with -pg-password-file. The password is left unchanged if empty.")
+	fs.StringVar(&cfg.roles.ReadOnlyRole, "read-only-role", "", "Login role of query clients such as Grafana to create, with select privileges only. None if empty.")
+	fs.StringVar(&cfg.readOnlyPasswordFile, "read-only-role-password-file", "", "File holding the password of -read-only-role. The password is left unchanged if empty.")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "Print the statements without running them.")
+	fs.BoolVar(&cfg.verify, "verify", true, "Connect as -role afterwards and run the self-test, and as -read-only-role if it has a password file, checking read access.")
+	fs.DurationVar(&cfg.timeout, "timeout", time.Minute, "Timeout of the verification.")
+	fs.StringVar(&cfg.logLevel, "log-level", "info", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
+	pgprometheus.RegisterFlags(fs, "pg", &cfg.pg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if cfg.pg.Schema == "" {
+		cfg.pg.Schema = "public"
+	}
+	cfg.roles.Database = cfg.pg.Database
+	cfg.roles.Schema = cfg.pg.Schema
+	cfg.roles.CreateObjects = cfg.pg.StagingMode == "unlogged"
+	switch {
+	case cfg.pg.LabelStorage != "jsonb":
+		// the tables and the view of the normalized layout are set up again on every startup, which takes owning them
+		return nil, fmt.Errorf("init-db supports the jsonb label storage only, the adapter must own the tables of the %s layout", cfg.pg.LabelStorage)
+	case cfg.roles.Role == cfg.pg.User:
+		return nil, fmt.Errorf("-role must differ from -pg-user, which owns the schema")
+	}
+	if err := cfg.roles.Validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	if cfg.roles.Password, err = readRolePassword(cfg.passwordFile); err != nil {
+		return nil, err
+	}
+	if cfg.roles.ReadOnlyPassword, err = readRolePassword(cfg.readOnlyPasswordFile); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readRolePassword reads the password from path as is, like the adapter does, empty if path is.
+func readRolePassword(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading password file: %w", err)
+	}
+	return string(content), nil
+}
+
+// runInitDB runs the init-db subcommand, which creates the schema and the least-privilege roles of a deployment
+// as the owner of the schema, runs the schema setup of the adapter, grants the roles their privileges and
+// verifies them. All of it is idempotent. It returns the exit code.
+func runInitDB(args []string) int {
+	cfg, err := parseInitDBFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log.Init(cfg.logLevel)
+	if cfg.dryRun {
+		printInitDB(os.Stdout, cfg)
+		return 0
+	}
+	client, err := pgprometheus.NewClient(&cfg.pg)
+	if err != nil {
+		log.Error("msg", "Error creating the database client", "err", err)
+		return 1
+	}
+	defer client.Close()
+	if err := initDB(context.Background(), os.Stdout, cfg, client.DB, client.EnsureSchema); err != nil {
+		log.Error("msg", "Error setting up the database", "err", err)
+		return 1
+	}
+	if cfg.verify {
+		if err := verifyRoles(cfg); err != nil {
+			log.Error("msg", "Error verifying the roles", "err", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// printInitDB prints what init-db runs.
+func printInitDB(w io.Writer, cfg *initDBConfig) {
+	for _, s := range pgprometheus.RolesSetup(&cfg.roles) {
+		_, _ = fmt.Fprintf(w, "%s;\n", s.Display)
+	}
+	_, _ = fmt.Fprintf(w, "-- the schema setup of the adapter on startup, for the tables of %s\n", cfg.pg.Table)
+	for _, s := range pgprometheus.RolesGrants(&cfg.roles) {
+		_, _ = fmt.Fprintf(w, "%s;\n", s.Display)
+	}
+}
+
+// initDB creates the schema and the roles, then sets up the tables with ensureSchema, the schema setup of the
+// adapter, and grants the roles their privileges on them, printing each statement to w before running it.
+func initDB(ctx context.Context, w io.Writer, cfg *initDBConfig, db *sql.DB, ensureSchema func() error) error {
+	run := func(statements []pgprometheus.RolesStatement) error {
+		for _, s := range statements {
+			_, _ = fmt.Fprintf(w, "%s;\n", s.Display)
+			if _, err := db.ExecContext(ctx, s.SQL); err != nil {
+				return fmt.Errorf("error running %q: %w", s.Display, err)
+			}
+		}
+		return nil
+	}
+	if err := run(pgprometheus.RolesSetup(&cfg.roles)); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "-- the schema setup of the adapter on startup, for the tables of %s\n", cfg.pg.Table)
+	if err := ensureSchema(); err != nil {
+		return fmt.Errorf("error setting up the tables: %w", err)
+	}
+	return run(pgprometheus.RolesGrants(&cfg.roles))
+}
+
+// verifyRoles connects as the adapter role, runs the schema setup of the adapter and the self-test of the
+// -self-test flag, writing, reading and deleting a sample, then as the read-only role if it has a password
+// file, checking read access only.
+func verifyRoles(cfg *initDBConfig) error {
+	type check struct {
+		role, passwordFile string
+		write              bool
+	}
+	checks := []check{{cfg.roles.Role, cfg.passwordFile, true}}
+	if cfg.roles.ReadOnlyRole != "" && cfg.readOnlyPasswordFile != "" {
+		checks = append(checks, check{cfg.roles.ReadOnlyRole, cfg.readOnlyPasswordFile, false})
+	}
+	for _, c := range checks {
+		pg := cfg.pg
+		pg.User = c.role
+		pg.PasswordFile = c.passwordFile
+		pg.PasswordCommand = ""
+		// the search_path of the role is what the adapter will use
+		pg.Schema = ""
+		if err := verifyRole(&pg, cfg.timeout, c.write); err != nil {
+			return fmt.Errorf("role %s: %w", c.role, err)
+		}
+		log.Info("msg", "Verified the role", "role", c.role, "write", c.write)
+	}
+	return nil
+}
+
+func verifyRole(pg *pgprometheus.Config, timeout time.Duration, write bool) error {
+	client, err := pgprometheus.NewClient(pg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.HealthCheck(); err != nil {
+		return err
+	}
+	if write {
+		if err := client.EnsureSchema(); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return client.SelfTest(ctx, initDBInstance, write)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInitDBDryRun(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseInitDBFlags([]string{"-pg-user", "owner", "-pg-database", "prom", "-role-password-file", passwordFile, "-read-only-role", "grafana", "-dry-run"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.roles.Password != "s3cret" || cfg.roles.Schema != "public" || cfg.roles.CreateObjects {
+		t.Errorf("Unexpected roles configuration %+v", cfg.roles)
+	}
+	var out bytes.Buffer
+	printInitDB(&out, cfg)
+	printed := out.String()
+	if strings.Contains(printed, "s3cret") {
+		t.Errorf("Expected the password to be redacted, got\n%s", printed)
+	}
+	setup := strings.Index(printed, `create role "prometheus_adapter"`)
+	tables := strings.Index(printed, "-- the schema setup of the adapter")
+	grants := strings.Index(printed, `grant select, insert, delete on all tables in schema "public" to "prometheus_adapter"`)
+	if setup < 0 || tables < setup || grants < tables {
+		t.Errorf("Expected the roles, the schema setup and the grants in this order, got\n%s", printed)
+	}
+	if !strings.Contains(printed, `grant select on all tables in schema "public" to "grafana"`) {
+		t.Errorf("Expected the read-only role to be granted select, got\n%s", printed)
+	}
+}
+
+func TestParseInitDBFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"-pg-user", "adapter", "-role", "adapter"},
+		{"-pg-label-storage", "normalized"},
+		{"-role", "pg_adapter"},
+		{"-read-only-role", "prometheus_adapter"},
+		{"-role-password-file", filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := parseInitDBFlags(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+	cfg, err := parseInitDBFlags([]string{"-pg-staging-mode", "unlogged", "-pg-schema", "prom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.roles.CreateObjects || cfg.roles.Schema != "prom" {
+		t.Errorf("Expected CREATE on the prom schema for the unlogged staging tables, got %+v", cfg.roles)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// liveness tracks when Prometheus was last seen sending samples, so that the leader resigns once it is gone.
+// Requests still being handled count as seen now: a write taking longer than the Prometheus timeout must not
+// look like a dead Prometheus.
+type liveness struct {
+	last     atomic.Int64
+	inFlight atomic.Int64
+}
+
+func newLiveness(now time.Time) *liveness {
+	l := &liveness{}
+	l.last.Store(now.UnixNano())
+	return l
+}
+
+// begin records the arrival of a write request, to be followed by end once it is handled.
+func (l *liveness) begin() {
+	l.inFlight.Add(1)
+	l.last.Store(time.Now().UnixNano())
+}
+
+func (l *liveness) end() {
+	// the time is stored first, so that lastSeen never sees no request in flight and an outdated time
+	l.last.Store(time.Now().UnixNano())
+	l.inFlight.Add(-1)
+}
+
+// lastSeen returns when Prometheus was last seen in Unix nanoseconds, now while requests are in flight.
+func (l *liveness) lastSeen() int64 {
+	if l.inFlight.Load() > 0 {
+		return time.Now().UnixNano()
+	}
+	return l.last.Load()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// blockingWriter blocks writes until released.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingWriter) WriteContext(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return writers.WriteStats{Written: len(samples)}, nil
+}
+
+func (b *blockingWriter) Name() string {
+	return "blocking"
+}
+
+func TestSendSamplesLeadership(t *testing.T) {
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1, Timestamp: 1}}
+	for _, c := range []struct {
+		name    string
+		leader  util.LeaderElector
+		written bool
+		err     bool
+	}{
+		{name: "no election", leader: nil, written: true},
+		{name: "leader", leader: func() util.LeaderElector {
+			e := util.NewFakeElection("fake")
+			e.SetLeader(true)
+			return util.NewElector(e)
+		}(), written: true},
+		{name: "follower", leader: util.NewElector(util.NewFakeElection("fake")), written: false},
+		{name: "leader check failing", leader: func() util.LeaderElector {
+			e := util.NewFakeElection("fake")
+			e.SetError(errors.New("lock lost"))
+			return util.NewElector(e)
+		}(), written: false, err: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			writer := &fakeWriter{}
+			stats, err := sendSamples(context.Background(), testMetrics, writer, c.leader, "", samples)
+			if (err != nil) != c.err {
+				t.Errorf("Expected error %v, got %v", c.err, err)
+			}
+			if c.name == "follower" && stats.Dropped["not_leader"] != 1 {
+				t.Errorf("Expected the sample to be dropped as not_leader, got %+v", stats)
+			}
+			if written := writer.calls > 0; written != c.written {
+				t.Errorf("Expected written %v, got %v", c.written, written)
+			}
+		})
+	}
+	if currentLeadership() != nil {
+		t.Error("Expected no leadership without leader election")
+	}
+}
+
+// TestLivenessSlowWrite checks the leader doesn't resign while a write takes longer than the Prometheus
+// timeout, does once Prometheus is gone and resumes the election when it comes back.
+func TestLivenessSlowWrite(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	saved := lastRequest
+	lastRequest = newLiveness(time.Now())
+	defer func() {
+		lastRequest = saved
+	}()
+	election := util.NewFakeElection("fake")
+	election.SetLeader(true)
+	elector := util.NewScheduledElector(election, time.Hour)
+
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := snappy.Encode(nil, data)
+	writer := &blockingWriter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		write(testMetrics, writer, false).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/write", bytes.NewReader(body)))
+	}()
+	<-writer.started
+
+	// the liveness checks run concurrently with the write
+	time.Sleep(2 * timeout)
+	var checks sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		checks.Add(1)
+		go func() {
+			defer checks.Done()
+			elector.PrometheusLivenessCheck(lastRequest.lastSeen(), timeout)
+		}()
+	}
+	checks.Wait()
+	if resigns := election.Resigns(); resigns != 0 {
+		t.Fatalf("Expected no resignation during a slow write, got %d", resigns)
+	}
+
+	close(writer.release)
+	<-done
+	time.Sleep(2 * timeout)
+	elector.PrometheusLivenessCheck(lastRequest.lastSeen(), timeout)
+	if election.Resigns() != 1 || !elector.IsPausedScheduledElection() {
+		t.Fatalf("Expected to resign once Prometheus is gone, got %d resignations", election.Resigns())
+	}
+
+	lastRequest.begin()
+	lastRequest.end()
+	elector.PrometheusLivenessCheck(lastRequest.lastSeen(), timeout)
+	if elector.IsPausedScheduledElection() {
+		t.Error("Expected the election to resume once Prometheus is back")
+	}
+}
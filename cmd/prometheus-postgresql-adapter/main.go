@@ -18,17 +18,34 @@ package main
 // documentation/examples/remote_storage/remote_storage_adapter/main.go
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"html/template"
 	"io"
+	"mime"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"os"
-	"sync/atomic"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/cardinality"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/deadletter"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/gaps"
 	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
 	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/quarantine"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/quota"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/tracing"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/transform"
 	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
@@ -36,9 +53,10 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	ioprometheusclient "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"database/sql"
 	"fmt"
@@ -47,134 +65,797 @@ import (
 type config struct {
 	remoteTimeout      time.Duration
 	listenAddr         string
+	telemetryAddr      string
+	healthzStaleness   time.Duration
 	telemetryPath      string
-	pgPrometheusConfig pgprometheus.Config
+	pgPrometheusConfig *pgprometheus.Config
+	storage            string
+	sinks              *writers.Sinks
 	logLevel           string
+	legacyErrorBodies  bool
+	queryMaxLabels     int
+	queryMaxSeries     int
 	haGroupLockID      int
 	restElection       bool
+	restElectionID     string
+	restElectionTTL    time.Duration
+	k8sElection        bool
+	k8sElectionConfig  util.KubernetesElectionConfig
 	prometheusTimeout  time.Duration
 	electionInterval   time.Duration
+	electionVerify     bool
+	handoffGrace       time.Duration
+	followerReject     bool
+	enableAdminAPI     bool
+	adminTokenFile     string
+	deleteBatchSize    int
+	deleteBatchPause   time.Duration
+	tailMaxStreams     int
+	tailMaxSamples     int
+	tailMaxDuration    time.Duration
+	transformRules     string
+	dedupeInRequest    bool
+	adaptiveBatching   bool
+	adaptiveBatchMin   int
+	adaptiveBatchMax   int
+	adaptiveBatchP95   time.Duration
+	downsample         writers.DownsampleConfig
+	disableStatusPage  bool
+	quarantineDir      string
+	quarantineTable    string
+	quarantineMaxBytes int64
+	quarantineMaxRows  int
+	quarantineMaxAge   time.Duration
+	quarantineRecent   int
+	writeConcurrency   int
+	writeQueue         int
+	writeQueueTimeout  time.Duration
+	selfTest           bool
+	selfTestTimeout    time.Duration
+	dryRun             bool
+	dbTimeReference    bool
+	storageReport      time.Duration
+	storageTimeout     time.Duration
+	gcPercent          int
+	memoryLimit        int64
+	readMaxSamples     int
+	readMaxDuration    time.Duration
+	readSlowQuery      time.Duration
+	federateLookback   time.Duration
+	federateMaxSeries  int
+	federateCacheTTL   time.Duration
+	statusTSDBTTL      time.Duration
+	statusTSDBRefresh  time.Duration
+	statusTSDBTimeout  time.Duration
+	quotaConfigFile    string
+	gapDetectionFile   string
+	quotaStateTable    string
+	quotaPersist       time.Duration
+	maxSeriesPerMetric int
+	maxSeriesWindow    time.Duration
+	maxSeriesTable     string
+	maxSeriesPersist   time.Duration
+	idempotencyTTL     time.Duration
+	idempotencyMax     int
+	deadLetterDir      string
+	deadLetterMaxBytes int64
+	// flagSources records where each flag got its value from: flag, env or default.
+	flagSources        map[string]string
+	configFile         string
+	tracingEndpoint    string
+	tracingService     string
+	tracingSampleRatio float64
+	shutdownTimeout    time.Duration
+	metricsNamespace   string
+	sourceLabel        string
+	sourceFrom         string
+	sourceHeader       string
+	sourceStatic       string
+	sourceCollision    string
+	namePolicy         string
+	requireDigest      bool
 }
 
 const (
-	tickInterval      = time.Second
-	promLivenessCheck = time.Second
+	tickInterval          = time.Second
+	promLivenessCheck     = time.Second
+	throughputLogInterval = 10 * time.Second
+	applicationName       = "prometheus-postgresql-adapter"
 )
 
+// version is set at build time
+var version = "unknown"
+
 var (
-	receivedSamples = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "received_samples_total",
-			Help: "Total number of received samples.",
-		},
-	)
-	sentSamples = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "sent_samples_total",
-			Help: "Total number of processed samples sent to remote storage.",
-		},
-		[]string{"remote"},
-	)
-	failedSamples = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "failed_samples_total",
-			Help: "Total number of processed samples which failed on send to remote storage.",
-		},
-		[]string{"remote"},
-	)
-	sentBatchDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "sent_batch_duration_seconds",
-			Help:    "Duration of sample batch send calls to the remote storage.",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"remote"},
-	)
-	httpRequestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_ms",
-			Help:    "Duration of HTTP request in milliseconds",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"path"},
-	)
-	writeThroughput     = util.NewThroughputCalc(tickInterval)
-	elector             *util.Elector
-	lastRequestUnixNano = time.Now().UnixNano()
+	startTime       = time.Now()
+	recentWrites    = &writeStatus{}
+	highestReceived = newHighestTimestamp()
+	highestWritten  = newHighestTimestamp()
+	writeThroughput = util.NewThroughputCalc(tickInterval)
+	elector         util.LeaderElector
+	// advisoryLock is the lock of the advisory lock election, if used, handed off on shutdown.
+	advisoryLock *util.PgAdvisoryLock
+	transformer  *transform.Engine
+	quotas       *quota.Engine
+	seriesGuard  *cardinality.Guard
+	sources      *sourceLabeler
+	// deletions are the series deletions of the admin API, canceled on shutdown.
+	deletions   *deleteJobs
+	lastRequest = newLiveness(time.Now())
+	// followersReject makes followers reject writes with 503 instead of accepting and dropping them.
+	followersReject bool
+	// deadLetters keeps the writes rejected as invalid by the storage, nil unless -dead-letter-dir is set.
+	deadLetters *deadletter.Dir
 )
 
-func init() {
-	prometheus.MustRegister(receivedSamples)
-	prometheus.MustRegister(sentSamples)
-	prometheus.MustRegister(failedSamples)
-	prometheus.MustRegister(sentBatchDuration)
-	prometheus.MustRegister(httpRequestDuration)
-	writeThroughput.Start()
-}
+// errNotLeader is returned by sendSamples on followers with -leader-election-follower-reject.
+var errNotLeader = errors.New("this instance is not the leader")
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init-db" {
+		os.Exit(runInitDB(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "print-default-config" {
+		fs := flag.NewFlagSet("print-default-config", flag.ExitOnError)
+		defineFlags(fs, &config{})
+		printDefaultConfig(os.Stdout, fs)
+		os.Exit(0)
+	}
 	cfg := parseFlags()
 	log.Init(cfg.logLevel)
-	log.Info("config", fmt.Sprintf("%+v", cfg))
+	log.Info("config", fmt.Sprintf("%+v", cfg), "postgres", fmt.Sprintf("%+v", *cfg.pgPrometheusConfig))
+	initialSettings, err := newSettings(cfg)
+	if err != nil {
+		log.Error("msg", "Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	currentSettings.Store(initialSettings)
+	applyGCSettings(cfg.gcPercent, cfg.memoryLimit)
+	util.LegacyErrorBodies = cfg.legacyErrorBodies
+	followersReject = cfg.followerReject
+	sendTimeout = cfg.remoteTimeout
+	healthzStaleness.max = cfg.healthzStaleness
+	if err := util.ValidateNamePolicy(cfg.namePolicy); err != nil {
+		log.Error("msg", "Invalid -write-name-policy", "err", err)
+		os.Exit(1)
+	}
+	namePolicy = cfg.namePolicy
+	requireDigest = cfg.requireDigest
 
-	http.Handle(cfg.telemetryPath, promhttp.Handler())
+	m := newMetrics(cfg.metricsNamespace)
+	m.register(prometheus.DefaultRegisterer)
+	m.configLastReloadSuccess.SetToCurrentTime()
+	writeThroughput.Start()
 
-	pgClient := buildClients(cfg)
-	elector = initElector(cfg, pgClient.DB)
+	mux := http.NewServeMux()
+	servers := []*http.Server{{Addr: cfg.listenAddr, Handler: mux, ConnState: m.connections.track}}
+	telemetryMux := mux
+	if cfg.telemetryAddr != "" {
+		if err := checkListenAddresses(cfg.listenAddr, cfg.telemetryAddr); err != nil {
+			log.Error("msg", "Invalid telemetry listen address", "err", err)
+			os.Exit(1)
+		}
+		telemetryMux = http.NewServeMux()
+		servers = append(servers, &http.Server{Addr: cfg.telemetryAddr, Handler: telemetryMux, ConnState: m.connections.track})
+	}
+	telemetryMux.Handle(cfg.telemetryPath, promhttp.Handler())
+	handleProfiling(mux)
 
-	http.Handle("/write", timeHandler("write", write(pgClient)))
-	http.Handle("/healthz", health(pgClient))
+	if cfg.transformRules != "" {
+		transformer = initTransformer(cfg.transformRules)
+	}
+	if cfg.idempotencyTTL > 0 {
+		if cfg.idempotencyMax <= 0 {
+			log.Error("msg", "-write-idempotency-max-entries must be positive")
+			os.Exit(1)
+		}
+		writeResults = newWriteResultCache(cfg.idempotencyTTL, cfg.idempotencyMax)
+	}
+	if cfg.deadLetterDir != "" {
+		var err error
+		if deadLetters, err = deadletter.NewDir(cfg.deadLetterDir, cfg.deadLetterMaxBytes, version); err != nil {
+			log.Error("msg", "Error setting up the dead letter directory", "err", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.sourceLabel != "" {
+		var err error
+		if sources, err = newSourceLabeler(cfg); err != nil {
+			log.Error("msg", "Invalid source label configuration", "err", err)
+			os.Exit(1)
+		}
+	}
 
-	log.Info("msg", "Starting up...")
-	log.Info("msg", "Listening", "addr", cfg.listenAddr)
+	writer := initStorage(cfg)
+	checker, ok := writer.(healthChecker)
+	if !ok {
+		checker = alwaysHealthy{}
+	}
+	maxOpenConns := cfg.pgPrometheusConfig.MaxOpenConns
+	var db *sql.DB
+	if pgClient := postgresStorage(writer); pgClient == nil {
+		log.Warn("msg", "Samples aren't written to PostgreSQL, leader election, the quarantine, the query and admin APIs and the self-test are disabled", "storage", writer.Name())
+	} else {
+		db = pgClient.DB
+		initClient(cfg, mux, m, pgClient)
+		maxOpenConns = pgClient.DB.Stats().MaxOpenConnections
+		if cfg.dbTimeReference {
+			highestReceived.now, highestWritten.now, cfg.downsample.Now = pgClient.DBNow, pgClient.DBNow, pgClient.DBNow
+		}
+	}
+	if cfg.quotaConfigFile != "" {
+		quotas = initQuotas(cfg, db)
+	}
+	if cfg.maxSeriesPerMetric > 0 {
+		seriesGuard = initSeriesGuard(cfg, db)
+	}
+	var gapDetector *gaps.Detector
+	if cfg.gapDetectionFile != "" {
+		gapDetector = initGapDetection(cfg)
+	}
+
+	if cfg.adaptiveBatching {
+		writer = initAdaptiveBatching(cfg, m, writer)
+	}
+
+	var downsampler *writers.Downsampler
+	if cfg.downsample.Interval > 0 {
+		downsampler = initDownsampler(cfg, writer)
+		writer = downsampler
+	}
 
-	err := http.ListenAndServe(cfg.listenAddr, nil)
+	shutdownTracing := initTracing(cfg)
 
+	mux.Handle("/write", timeHandler(m, "write", tracing.Handler("/write", limitWrites(cfg, m, maxOpenConns, write(m, writer, cfg.dedupeInRequest)))))
+	mux.Handle("/healthz", health(checker))
+	if telemetryMux != mux {
+		telemetryMux.Handle("/healthz", health(checker))
+	}
+	if cfg.enableAdminAPI {
+		mux.Handle("/admin/config", timeHandler(m, "config", settingsAdminAuth(configAPI(flag.CommandLine, cfg.flagSources))))
+		if cfg.tailMaxStreams <= 0 || cfg.tailMaxSamples <= 0 || cfg.tailMaxDuration <= 0 {
+			log.Error("msg", "-admin-tail-max-streams, -admin-tail-max-samples and -admin-tail-max-duration must be positive")
+			os.Exit(1)
+		}
+		taps = newTapRegistry(cfg.tailMaxStreams)
+		mux.Handle(tailPath, timeHandler(m, "tail", settingsAdminAuth(tailHandler(m, taps, cfg.tailMaxSamples, cfg.tailMaxDuration))))
+		if seriesGuard != nil {
+			mux.Handle(suppressedMetricsPath, timeHandler(m, "suppressed_metrics", settingsAdminAuth(suppressedMetricsHandler(seriesGuard))))
+		}
+	}
+
+	if gapDetector != nil {
+		if taps == nil {
+			taps = newTapRegistry(0)
+		}
+		taps.attach(gapDetector)
+	}
+
+	var root http.Handler
+	if !cfg.disableStatusPage {
+		root = statusPage(checker, cfg.pgPrometheusConfig.Table)
+	}
+	mux.Handle("/", m.unknownPaths.handler(root))
+
+	go logThroughput()
+
+	log.Info("msg", "Starting up...")
+	listeners, err := listen(servers)
 	if err != nil {
 		log.Error("msg", "Listen failure", "err", err)
 		os.Exit(1)
 	}
-}
 
-func parseFlags() *config {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-stop
+		log.Info("msg", "Shutting down", "signal", sig)
+		if advisoryLock != nil && cfg.handoffGrace > 0 {
+			// before the servers shut down, so that writes go on until the handoff is done
+			if _, err := advisoryLock.Handoff(cfg.handoffGrace); err != nil {
+				log.Warn("msg", "Error handing off the advisory lock", "err", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+		defer cancel()
+		if err := shutdown(ctx, servers); err != nil {
+			log.Warn("msg", "Error waiting for in-flight requests", "err", err)
+		}
+		if deletions != nil {
+			if err := deletions.stop(ctx); err != nil {
+				log.Warn("msg", "Error waiting for the series deletions to stop", "err", err)
+			}
+		}
+		if downsampler != nil {
+			// the intervals that aren't over yet are written as they are
+			if err := downsampler.Close(ctx); err != nil {
+				log.Warn("msg", "Error writing the buffered downsampled samples", "err", err)
+			}
+		}
+		// flush the spans of the last requests
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warn("msg", "Error shutting down the span exporter", "err", err)
+		}
+	}()
 
-	cfg := &config{}
+	reloads := newReloader(flag.CommandLine, cfg, m)
+	reloads.transformer, reloads.quotas, reloads.deletions, reloads.gaps = transformer, quotas, deletions, gapDetector
+	go reloads.handleReloads()
 
-	pgprometheus.ParseFlags(&cfg.pgPrometheusConfig)
+	if err := serve(servers, listeners); err != nil {
+		log.Error("msg", "Listen failure", "err", err)
+		os.Exit(1)
+	}
+	<-stopped
+}
 
-	flag.DurationVar(&cfg.remoteTimeout, "adapter-send-timeout", 30*time.Second, "The timeout to use when sending samples to the remote storage.")
-	flag.StringVar(&cfg.listenAddr, "web-listen-address", ":9201", "Address to listen on for web endpoints.")
-	flag.StringVar(&cfg.telemetryPath, "web-telemetry-path", "/metrics", "Address to listen on for web endpoints.")
-	flag.StringVar(&cfg.logLevel, "log-level", "debug", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
-	flag.IntVar(&cfg.haGroupLockID, "leader-election-pg-advisory-lock-id", 0, "Unique advisory lock id per adapter high-availability group. Set it if you want to use leader election implementation based on PostgreSQL advisory lock.")
-	flag.DurationVar(&cfg.prometheusTimeout, "leader-election-pg-advisory-lock-prometheus-timeout", -1, "Adapter will resign if there are no requests from Prometheus within a given timeout (0 means no timeout). "+
-		"Note: make sure that only one Prometheus instance talks to the adapter. Timeout value should be co-related with Prometheus scrape interval but add enough `slack` to prevent random flips.")
-	flag.BoolVar(&cfg.restElection, "leader-election-rest", false, "Enable REST interface for the leader election")
-	flag.DurationVar(&cfg.electionInterval, "scheduled-election-interval", 5*time.Second, "Interval at which scheduled election runs. This is used to select a leader and confirm that we still holding the advisory lock.")
+func parseFlags() *config {
+	cfg := &config{}
+	defineFlags(flag.CommandLine, cfg)
 
 	envy.Parse("TS_PROM")
+	envSet := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		envSet[f.Name] = true
+	})
 	flag.Parse()
+	cfg.flagSources = recordFlagSources(flag.CommandLine, os.Args[1:], envSet)
+	if cfg.configFile != "" {
+		// the logger isn't set up yet, the log level may come from the file
+		if err := loadConfigFile(flag.CommandLine, cfg.configFile, cfg.flagSources); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading -%s %s: %v\n", configFileFlag, cfg.configFile, err)
+			os.Exit(2)
+		}
+	}
 
 	return cfg
 }
 
-type writer interface {
-	Write(samples model.Samples) error
-	Name() string
+// defineFlags defines the configuration flags on fs, with cfg receiving their values.
+func defineFlags(fs *flag.FlagSet, cfg *config) {
+	cfg.sinks = writers.RegisterFlags(fs)
+	pgSink, _ := cfg.sinks.Get(writers.DefaultStorage)
+	cfg.pgPrometheusConfig = &pgSink.(*pgprometheus.Sink).Config
+	fs.StringVar(&cfg.storage, "storage", writers.DefaultStorage, fmt.Sprintf("Storage the samples are written to [ \"%s\" ], each configured by the flags with its prefix. Leader election, the quarantine, the query and admin APIs and the self-test need the PostgreSQL storage, directly or as primary of the tee storage.", strings.Join(writers.Names(), `", "`)))
+	fs.StringVar(&cfg.configFile, configFileFlag, "", "YAML file with the configuration, in sections web, postgres, election and write holding the flags with those prefixes, and the other flags at the top level. Keys are flag names in snake case, eg. postgres.max_open_conns. Flags and environment variables take precedence. See the print-default-config subcommand. Reloaded on SIGHUP, which applies changes of the log level, the query and read limits, the admin delete batch settings and the admin API token file, and of the files of the transformation rules, the quotas and the admin API token. Other changes need a restart.")
+
+	fs.DurationVar(&cfg.remoteTimeout, "adapter-send-timeout", 30*time.Second, "The timeout to use when sending samples to the remote storage, counted from the arrival of the write request, unless the sender tells its timeout in the "+remoteWriteTimeoutHeader+" header (0 means no timeout).")
+	fs.StringVar(&cfg.listenAddr, "web-listen-address", ":9201", "Address to listen on for web endpoints.")
+	fs.StringVar(&cfg.metricsNamespace, "metrics-namespace", "", "Namespace prefixed to the names of the adapter's own metrics, eg. \"tsadapter\" for tsadapter_received_samples_total.")
+	fs.StringVar(&cfg.telemetryPath, "web-telemetry-path", "/metrics", "Address to listen on for web endpoints.")
+	fs.StringVar(&cfg.telemetryAddr, "web-telemetry-listen-address", "", "Address to serve -web-telemetry-path and /healthz on, instead of -web-listen-address. The metrics are no longer served on -web-listen-address then.")
+	fs.DurationVar(&cfg.healthzStaleness, "healthz-max-write-staleness", 0, "Fail /healthz with 500 when nothing was written for this long while this instance is the leader and receives requests, so that a wedged instance is restarted. Followers and instances without requests never fail it (0 disables the check).")
+	fs.BoolVar(&cfg.legacyErrorBodies, "web-legacy-error-bodies", false, "Reply with plain-text error bodies instead of JSON. Deprecated, will be removed in the next release.")
+	fs.IntVar(&cfg.queryMaxLabels, "query-max-labels", 10000, "Maximum number of label names or values returned by the labels API.")
+	fs.IntVar(&cfg.queryMaxSeries, "query-max-series", 10000, "Maximum number of series returned by the series and query_range APIs. Queries matching more series fail.")
+	fs.IntVar(&cfg.readMaxSamples, "read-max-samples", 50000000, "Maximum number of samples returned by the query_range API. Queries returning more are aborted (0 means no limit).")
+	fs.DurationVar(&cfg.readMaxDuration, "read-max-duration", 2*time.Minute, "Maximum duration of query_range queries. Slower queries are aborted (0 means no limit).")
+	fs.DurationVar(&cfg.readSlowQuery, "read-slow-query-threshold", 10*time.Second, "Duration from which query_range queries are logged as slow (0 disables the log).")
+	fs.DurationVar(&cfg.federateLookback, "federate-lookback", 5*time.Minute, "How far back /federate looks for the latest sample of each series.")
+	fs.IntVar(&cfg.federateMaxSeries, "federate-max-series", 10000, "Maximum number of series returned by /federate. Scrapes matching more series fail.")
+	fs.DurationVar(&cfg.statusTSDBTTL, "status-tsdb-cache-ttl", 15*time.Minute, "Age beyond which the cardinality stats of /api/v1/status/tsdb are computed again on request. Until they are, the previous stats are served marked as stale.")
+	fs.DurationVar(&cfg.statusTSDBRefresh, "status-tsdb-refresh-interval", 0, "Interval at which the cardinality stats of /api/v1/status/tsdb are computed in the background. The aggregations scan the whole labels table (0 computes them on request only).")
+	fs.DurationVar(&cfg.statusTSDBTimeout, "status-tsdb-timeout", 5*time.Minute, "Statement timeout of the queries computing the cardinality stats of /api/v1/status/tsdb.")
+	fs.DurationVar(&cfg.federateCacheTTL, "federate-cache-ttl", 10*time.Second, "How long the responses of /federate are cached by match[] parameters (0 disables the cache).")
+	fs.BoolVar(&cfg.enableAdminAPI, "enable-admin-api", false, "Enable the admin API endpoints, which allow deleting data and show the configuration.")
+	fs.StringVar(&cfg.adminTokenFile, "admin-api-token-file", "", "File containing the bearer token required by the admin API endpoints. Reloaded on SIGHUP.")
+	fs.StringVar(&cfg.gapDetectionFile, "gap-detection-config", "", "YAML file with rules of series selectors and their expected interval. Series not seen for the tolerance times their interval are logged and counted in series_missing. Reloaded on SIGHUP, which forgets the series tracked.")
+	fs.IntVar(&cfg.deleteBatchSize, "admin-delete-batch-size", 10000, "Maximum number of samples removed per statement by the delete_series admin endpoint.")
+	fs.DurationVar(&cfg.deleteBatchPause, "admin-delete-batch-pause", 100*time.Millisecond, "Time to wait between delete batches of the delete_series admin endpoint.")
+	fs.IntVar(&cfg.tailMaxStreams, "admin-tail-max-streams", 4, "Maximum number of concurrent streams of the "+tailPath+" admin endpoint, which streams the samples being written.")
+	fs.IntVar(&cfg.tailMaxSamples, "admin-tail-max-samples", 10000, "Maximum number of samples of a stream of the "+tailPath+" admin endpoint.")
+	fs.DurationVar(&cfg.tailMaxDuration, "admin-tail-max-duration", 5*time.Minute, "Maximum duration of a stream of the "+tailPath+" admin endpoint.")
+	fs.StringVar(&cfg.transformRules, "transform-rules-file", "", "YAML file with rules transforming samples before they are written. Reloaded on SIGHUP.")
+	fs.BoolVar(&cfg.dedupeInRequest, "write-dedupe-in-request", false, "Collapse samples with the same series and timestamp within a write request, keeping the last value.")
+	fs.IntVar(&cfg.gcPercent, "gogc-percent", 0, "Garbage collection target percentage, like GOGC. Higher values trade memory for less CPU spent collecting the transient buffers of writes (0 keeps GOGC, or 100).")
+	fs.Int64Var(&cfg.memoryLimit, "memory-limit-bytes", 0, "Soft memory limit of the Go runtime in bytes, like GOMEMLIMIT. The garbage collector runs more often as the heap approaches it, which keeps a high -gogc-percent safe (0 keeps GOMEMLIMIT, or no limit).")
+	fs.DurationVar(&cfg.storageReport, "storage-report-interval", 0, "Interval at which the size of the tables is measured, for the storage_bytes_total, bytes_per_sample_stored, compression_ratio and write_amplification_ratio metrics. The catalog queries aren't free on huge hypertables (0 disables the report).")
+	fs.DurationVar(&cfg.storageTimeout, "storage-report-timeout", 30*time.Second, "Statement timeout of the queries of -storage-report-interval.")
+	fs.BoolVar(&cfg.dbTimeReference, "db-time-reference", false, "Judge sample ages by the database clock instead of the local one: the clamping of future timestamps in the highest timestamp metrics and the grace window of -write-downsample-interval. The database time is estimated from the clock skew measured by the health checks.")
+	fs.BoolVar(&cfg.adaptiveBatching, "write-adaptive-batching", false, "Write the samples of requests in batches of a size adjusted to the write latency: it grows while the p95 of the batch write durations is well under -write-adaptive-batch-latency-target and halves when it is over.")
+	fs.IntVar(&cfg.adaptiveBatchMin, "write-adaptive-batch-min", 1000, "Minimum number of samples per batch with -write-adaptive-batching.")
+	fs.IntVar(&cfg.adaptiveBatchMax, "write-adaptive-batch-max", 50000, "Maximum number of samples per batch with -write-adaptive-batching, which is the initial size.")
+	fs.DurationVar(&cfg.adaptiveBatchP95, "write-adaptive-batch-latency-target", 2*time.Second, "Target for the p95 of the batch write durations with -write-adaptive-batching.")
+	fs.DurationVar(&cfg.downsample.Interval, "write-downsample-interval", 0, "Write one aggregated sample per series and interval, aligned on the wall clock, eg. 1m. Samples are buffered until the interval and -write-downsample-grace are over. Disabled if 0.")
+	fs.StringVar(&cfg.downsample.Method, "write-downsample-method", writers.DownsampleLast, "How the samples of an interval are aggregated with -write-downsample-interval [ \"last\", \"avg\", \"min\", \"max\" ].")
+	fs.DurationVar(&cfg.downsample.Grace, "write-downsample-grace", 30*time.Second, "How long after the end of an interval its samples are still accepted with -write-downsample-interval. Later samples are dropped.")
+	fs.IntVar(&cfg.downsample.MaxSeries, "write-downsample-max-series", 100000, "Maximum number of series buffered with -write-downsample-interval. Samples of more series are dropped (0 means no limit).")
+	fs.Int64Var(&cfg.downsample.MaxBytes, "write-downsample-max-bytes", 256<<20, "Estimated maximum memory taken by the samples buffered with -write-downsample-interval. Samples of new series or intervals beyond it are dropped (0 means no limit).")
+	fs.BoolVar(&cfg.disableStatusPage, "web-disable-status-page", false, "Don't serve the HTML status page at /.")
+	fs.StringVar(&cfg.quarantineDir, "quarantine-dir", "", "Directory to keep samples rejected by the write path in, as hourly JSONL files. Mutually exclusive with -quarantine-table.")
+	fs.StringVar(&cfg.quarantineTable, "quarantine-table", "", "Table to keep samples rejected by the write path in. Mutually exclusive with -quarantine-dir.")
+	fs.Int64Var(&cfg.quarantineMaxBytes, "quarantine-max-bytes", 100<<20, "Maximum total size of the quarantine files.")
+	fs.IntVar(&cfg.quarantineMaxRows, "quarantine-max-rows", 100000, "Maximum number of rows in the quarantine table.")
+	fs.DurationVar(&cfg.quarantineMaxAge, "quarantine-max-age", 7*24*time.Hour, "How long quarantined samples are kept.")
+	fs.IntVar(&cfg.quarantineRecent, "quarantine-recent", 1000, "Number of recently quarantined samples kept in memory for /admin/quarantine/recent.")
+	fs.BoolVar(&cfg.pgPrometheusConfig.PartialAccept, "write-partial-accept", false, "When the database rejects a write for invalid data, write the batch without the offending samples, which are rejected and reported in the response body.")
+	fs.IntVar(&cfg.pgPrometheusConfig.PartialAcceptMaxDepth, "write-partial-accept-max-depth", pgprometheus.DefaultConfig().PartialAcceptMaxDepth, "How many times a batch is split to isolate invalid samples with -write-partial-accept before the remaining failing part is rejected as a whole.")
+	fs.StringVar(&cfg.sourceLabel, "write-source-label", "", "Label identifying the sender of each write request added to its samples, eg. \"ingest_source\". It is part of the series identity and labels the sent and failed samples counters. Disabled if empty.")
+	fs.StringVar(&cfg.sourceFrom, "write-source-from", sourceFromHeader, "Where the value of -write-source-label comes from [ \"header\", \"client-ip\", \"static\" ]. Requests without header value get no label.")
+	fs.StringVar(&cfg.sourceHeader, "write-source-header", defaultSourceHeader, "Request header holding the value of -write-source-label with -write-source-from=header.")
+	fs.StringVar(&cfg.sourceStatic, "write-source-static", "", "Value of -write-source-label with -write-source-from=static.")
+	fs.StringVar(&cfg.namePolicy, "write-name-policy", util.NamePolicyAllow, "What to do with label names and metric names that don't follow the Prometheus naming rules [ \"reject\", \"normalize\", \"allow\" ]. \"reject\" rejects the write with 400, \"normalize\" replaces invalid characters with _ and applies the same mapping to the matchers of the series APIs, \"allow\" stores them as they are.")
+	fs.BoolVar(&cfg.requireDigest, "write-require-digest", false, "Reject write requests without an X-Content-Sha256 or SHA-256 Digest header. Set headers are always checked against the body as received, and mismatches rejected with 400.")
+	fs.StringVar(&cfg.sourceCollision, "write-source-collision", sourceCollisionKeep, "What to do with samples that already have -write-source-label [ \"keep\", \"overwrite\" ]. \"keep\" keeps their own value.")
+	fs.StringVar(&cfg.pgPrometheusConfig.InvalidUTF8Policy, "write-invalid-utf8-policy", pgprometheus.DefaultConfig().InvalidUTF8Policy, "What to do with label names and values that aren't valid UTF-8 [ \"replace\", \"base64\", \"drop\" ]. \"replace\" replaces invalid bytes with U+FFFD, \"base64\" encodes invalid values and lists their labels in the "+pgprometheus.Base64LabelsLabel+" label, \"drop\" drops the samples. Invalid label names are always replaced.")
+	fs.IntVar(&cfg.writeConcurrency, "write-max-concurrency", 0, "Maximum number of write requests handled concurrently (0 means -pg-max-open-conns, negative disables the limit).")
+	fs.IntVar(&cfg.writeQueue, "write-max-queue", 100, "Maximum number of write requests waiting for a free slot.")
+	fs.DurationVar(&cfg.writeQueueTimeout, "write-queue-timeout", 10*time.Second, "How long write requests wait for a free slot before they are rejected with 503.")
+	fs.BoolVar(&cfg.selfTest, "startup-self-test", false, "Write, read back and delete a synthetic adapter_self_test sample before listening, and exit if that fails. Replicas that aren't the leader only check read access.")
+	fs.DurationVar(&cfg.selfTestTimeout, "startup-self-test-timeout", 30*time.Second, "Time the startup self-test may take before the adapter gives up and exits.")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "Accept and decode writes without touching the database, for load tests and for validating remote write configurations. Same as -storage=dry-run.")
+	fs.StringVar(&cfg.quotaConfigFile, "quota-config-file", "", "YAML file with per-tenant limits of samples per second and new series per day. Writes over quota are rejected with 429 or partially dropped. Reloaded on SIGHUP.")
+	fs.StringVar(&cfg.quotaStateTable, "quota-state-table", "adapter_quota_series", "Table the series counted against the quotas are kept in, so that daily series budgets survive restarts.")
+	fs.DurationVar(&cfg.quotaPersist, "quota-persist-interval", time.Minute, "Interval at which new series are saved to -quota-state-table.")
+	fs.DurationVar(&cfg.idempotencyTTL, "write-idempotency-ttl", 0, "How long committed write requests are remembered, by a hash of their body, so that identical requests, such as retries of requests that timed out at the sender, succeed without being written again. Identical requests arriving while one is written wait for it. Per instance: retries sent to another instance are written again (0 disables).")
+	fs.StringVar(&cfg.deadLetterDir, "dead-letter-dir", "", "Directory to keep the write requests the storage rejected as invalid in, as hourly files of snappy compressed write requests. The sender doesn't retry them; replay them with the replay subcommand once the cause is fixed.")
+	fs.Int64Var(&cfg.deadLetterMaxBytes, "dead-letter-max-bytes", 100<<20, "Maximum total size of the files of -dead-letter-dir, beyond which the oldest files are removed (0 means no limit).")
+	fs.IntVar(&cfg.idempotencyMax, "write-idempotency-max-entries", 10000, "Maximum number of write requests remembered with -write-idempotency-ttl, the oldest ones being forgotten first.")
+	fs.IntVar(&cfg.maxSeriesPerMetric, "write-max-series-per-metric", 0, "Maximum number of series of a metric name seen within -write-max-series-window. Samples of new series of a metric over it are dropped while its known series are written, and the metric is listed in /admin/cardinality/suppressed. The series are kept in memory, up to this many per metric name (0 disables the limit).")
+	fs.DurationVar(&cfg.maxSeriesWindow, "write-max-series-window", 24*time.Hour, "Series count against -write-max-series-per-metric until they have no sample for this long.")
+	fs.StringVar(&cfg.maxSeriesTable, "write-max-series-state-table", "", "Table the series of the metrics over -write-max-series-per-metric are kept in, so that they stay suppressed across restarts. Needs the PostgreSQL storage. Empty keeps them in memory only.")
+	fs.DurationVar(&cfg.maxSeriesPersist, "write-max-series-persist-interval", time.Minute, "Interval at which series expire from -write-max-series-window and the suppressed metrics are saved to -write-max-series-state-table.")
+	fs.StringVar(&cfg.tracingEndpoint, "tracing-otlp-endpoint", "", "OTLP/HTTP endpoint to export OpenTelemetry spans of write requests to, eg. http://localhost:4318/v1/traces. Tracing is disabled if empty.")
+	fs.StringVar(&cfg.tracingService, "tracing-service-name", "prometheus-postgresql-adapter", "Service name of the exported spans.")
+	fs.Float64Var(&cfg.tracingSampleRatio, "tracing-sample-ratio", 1, "Share of write requests traced, between 0 and 1, unless the sender decided already in the traceparent header.")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time given to in-flight requests to finish on SIGINT or SIGTERM before the adapter exits.")
+	fs.StringVar(&cfg.logLevel, "log-level", "debug", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
+	fs.IntVar(&cfg.haGroupLockID, "leader-election-pg-advisory-lock-id", 0, "Unique advisory lock id per adapter high-availability group. Set it if you want to use leader election implementation based on PostgreSQL advisory lock.")
+	fs.DurationVar(&cfg.prometheusTimeout, "leader-election-pg-advisory-lock-prometheus-timeout", -1, "Adapter will resign if there are no requests from Prometheus within a given timeout (0 means no timeout). "+
+		"Note: make sure that only one Prometheus instance talks to the adapter. Timeout value should be co-related with Prometheus scrape interval but add enough `slack` to prevent random flips.")
+	fs.BoolVar(&cfg.restElection, "leader-election-rest", false, "Enable REST interface for the leader election")
+	fs.StringVar(&cfg.restElectionID, "leader-election-rest-id", "", "Elector ID used for the REST leader election. Contested leases go to the lowest ID. Defaults to the hostname.")
+	fs.DurationVar(&cfg.restElectionTTL, "leader-election-rest-ttl", 0, "Lease TTL for the REST leader election. Leadership has to be refreshed within this interval or it expires (0 means no expiry).")
+	fs.BoolVar(&cfg.k8sElection, "leader-election-kubernetes", false, "Enable the leader election over a Kubernetes Lease.")
+	fs.StringVar(&cfg.k8sElectionConfig.LeaseName, "leader-election-kubernetes-lease-name", "prometheus-postgresql-adapter", "Name of the Lease used for the Kubernetes leader election.")
+	fs.StringVar(&cfg.k8sElectionConfig.Namespace, "leader-election-kubernetes-namespace", "", "Namespace of the Lease used for the Kubernetes leader election. Defaults to the namespace of the pod.")
+	fs.StringVar(&cfg.k8sElectionConfig.Identity, "leader-election-kubernetes-identity", "", "Identity used for the Kubernetes leader election. Defaults to the hostname, which is the pod name.")
+	fs.StringVar(&cfg.k8sElectionConfig.Kubeconfig, "leader-election-kubernetes-kubeconfig", "", "Kubeconfig file used for the Kubernetes leader election outside of a cluster. Defaults to the in-cluster configuration, then to KUBECONFIG or ~/.kube/config.")
+	fs.DurationVar(&cfg.k8sElectionConfig.LeaseDuration, "leader-election-kubernetes-lease-duration", 15*time.Second, "Duration other instances wait before taking over a Lease that isn't renewed.")
+	fs.DurationVar(&cfg.k8sElectionConfig.RenewDeadline, "leader-election-kubernetes-renew-deadline", 10*time.Second, "Duration the leader retries renewing the Lease before giving up leadership.")
+	fs.DurationVar(&cfg.k8sElectionConfig.RetryPeriod, "leader-election-kubernetes-retry-period", 2*time.Second, "Interval between attempts to acquire or renew the Lease.")
+	fs.BoolVar(&cfg.electionVerify, "leader-election-verify", false, "Record the leader in the adapter_leader_registry table when the advisory lock is acquired and warn if another application or instance seems to use the same lock ID.")
+	fs.BoolVar(&cfg.followerReject, "leader-election-follower-reject", false, "Reject writes with 503 and code not_leader on instances that aren't the leader, instead of accepting and dropping their samples. For senders that retry against another instance, eg. behind a load balancer.")
+	fs.DurationVar(&cfg.handoffGrace, "handoff-grace-period", 0, "On SIGINT or SIGTERM, the leader of the advisory lock election releases the lock and keeps writing until another instance holds it, for at most this long, before it shuts down. Standbys take over within -scheduled-election-interval instead of once the session of the stopped leader drops (0 disables the handoff).")
+	fs.DurationVar(&cfg.electionInterval, "scheduled-election-interval", 5*time.Second, "Interval at which scheduled election runs. This is used to select a leader and confirm that we still holding the advisory lock.")
+}
+
+// readLimits returns the limits of range queries.
+func (cfg *config) readLimits() readLimits {
+	return readLimits{maxSeries: cfg.queryMaxSeries, maxSamples: cfg.readMaxSamples, maxDuration: cfg.readMaxDuration, slowQuery: cfg.readSlowQuery}
+}
+
+// initStorage builds the writer of -storage, -dry-run standing for -storage=dry-run.
+func initStorage(cfg *config) writers.Writer {
+	storage := cfg.storage
+	if cfg.dryRun {
+		storage = "dry-run"
+	}
+	writer, err := cfg.sinks.New(storage)
+	if err != nil {
+		log.Error("msg", "Error setting up the storage", "err", err)
+		os.Exit(1)
+	}
+	return writer
 }
 
-func buildClients(cfg *config) *pgprometheus.Client {
-	pgClient := pgprometheus.NewClient(&cfg.pgPrometheusConfig)
+// postgresStorage returns the database client writer writes to, directly or as primary of a tee, nil if
+// there is none.
+func postgresStorage(writer writers.Writer) *pgprometheus.Client {
+	if tee, ok := writer.(*writers.Tee); ok {
+		writer = tee.Primary()
+	}
+	pgClient, _ := writer.(*pgprometheus.Client)
 	return pgClient
 }
 
-func initElector(cfg *config, db *sql.DB) *util.Elector {
-	if cfg.restElection && cfg.haGroupLockID != 0 {
-		log.Error("msg", "Use either REST or PgAdvisoryLock for the leader election")
+// alwaysHealthy is the health checker of storages that can't be checked.
+type alwaysHealthy struct{}
+
+func (alwaysHealthy) HealthCheck() error {
+	return nil
+}
+
+// initClient sets up the metrics of the database client, the election, the quarantine, the query and
+// admin APIs and the storage report, warms up the connections and runs the startup self-test.
+func initClient(cfg *config, mux *http.ServeMux, m *metrics, pgClient *pgprometheus.Client) {
+	logDescription(pgClient)
+	m.registerer.MustRegister(pgClient.ConnectionStats())
+	if stats := pgClient.DatabaseStats(); stats != nil {
+		m.registerer.MustRegister(stats)
+	}
+	initQuarantine(cfg, mux, pgClient)
+	elector = initElector(cfg, mux, m, pgClient.DB)
+
+	mux.Handle("/api/v1/labels", timeHandler(m, "labels", withSettings(func(s *settings) http.Handler {
+		return labelsAPI(pgClient, s.queryMaxLabels)
+	})))
+	mux.Handle("/api/v1/label/", timeHandler(m, "label_values", withSettings(func(s *settings) http.Handler {
+		return labelValuesAPI(pgClient, s.queryMaxLabels)
+	})))
+	mux.Handle("/api/v1/series", timeHandler(m, "series", withSettings(func(s *settings) http.Handler {
+		return seriesAPI(pgClient, s.readLimits.maxSeries)
+	})))
+	mux.Handle("/api/v1/query_range", timeHandler(m, "query_range", withSettings(func(s *settings) http.Handler {
+		return queryRangeAPI(m, pgClient, s.readLimits)
+	})))
+	if cfg.statusTSDBTimeout <= 0 {
+		log.Error("msg", "-status-tsdb-timeout must be positive")
 		os.Exit(1)
 	}
+	statusCache := newTSDBStatusCache(cfg.statusTSDBTTL, cfg.statusTSDBRefresh, cfg.statusTSDBTimeout, pgClient.TSDBStatus)
+	if cfg.statusTSDBRefresh > 0 {
+		go statusCache.run()
+	}
+	mux.Handle(tsdbStatusPath, timeHandler(m, "status_tsdb", tsdbStatusAPI(statusCache)))
+	mux.Handle("/federate", timeHandler(m, "federate", federateHandler(pgClient, cfg.federateLookback, cfg.federateMaxSeries, newFederationCache(cfg.federateCacheTTL))))
+	mux.Handle("/admin/info", timeHandler(m, "info", infoHandler(pgClient)))
+	if cfg.enableAdminAPI {
+		initAdminAPI(cfg, mux, m, pgClient, pgClient, pgClient, pgClient)
+	}
+
+	if cfg.storageReport > 0 {
+		if cfg.storageTimeout <= 0 {
+			log.Error("msg", "-storage-report-timeout must be positive")
+			os.Exit(1)
+		}
+		reporter := &storageReporter{interval: cfg.storageReport, timeout: cfg.storageTimeout, measure: pgClient.StorageReport, m: m}
+		go reporter.run()
+		log.Info("msg", "Reporting the size of the tables", "interval", cfg.storageReport)
+	}
+
+	if cfg.pgPrometheusConfig.WarmConnections > 0 {
+		warmConnections(pgClient, cfg.pgPrometheusConfig.WarmConnections)
+	}
+	if cfg.selfTest {
+		runSelfTest(cfg.selfTestTimeout, pgClient)
+	}
+}
+
+// warmConnections opens the connections of -pg-warm-connections before the listeners start, so that the
+// adapter only becomes ready once they are established. Connections failing to open are only warned about,
+// as writes open them on demand.
+func warmConnections(pgClient *pgprometheus.Client, n int) {
+	begin := time.Now()
+	warmed, err := pgClient.WarmConnections(context.Background())
+	if err != nil {
+		log.Warn("msg", "Error warming up database connections, the first writes may be slow", "warmed", warmed, "requested", n, "duration", time.Since(begin), "err", err)
+		return
+	}
+	log.Info("msg", "Warmed up database connections", "connections", warmed, "duration", time.Since(begin))
+}
+
+// initTracing sets up exporting spans to the OTLP endpoint, if any, and returns the function flushing them on
+// shutdown. Without endpoint, the tracer stays a no-op.
+func initTracing(cfg *config) func(ctx context.Context) error {
+	if cfg.tracingEndpoint == "" {
+		return func(ctx context.Context) error { return nil }
+	}
+	if cfg.tracingSampleRatio < 0 || cfg.tracingSampleRatio > 1 {
+		log.Error("msg", "-tracing-sample-ratio must be between 0 and 1")
+		os.Exit(1)
+	}
+	shutdown, err := tracing.Init(cfg.tracingEndpoint, cfg.tracingService, cfg.tracingSampleRatio)
+	if err != nil {
+		log.Error("msg", "Error setting up tracing", "err", err)
+		os.Exit(1)
+	}
+	log.Info("msg", "Exporting spans of write requests", "endpoint", cfg.tracingEndpoint, "sample_ratio", cfg.tracingSampleRatio)
+	return shutdown
+}
+
+// initDownsampler sets up the downsampler aggregating the samples before they are written to writer, and
+// starts writing the aggregated samples.
+func initAdaptiveBatching(cfg *config, m *metrics, writer writers.Writer) writers.Writer {
+	if cfg.adaptiveBatchMin <= 0 || cfg.adaptiveBatchMax < cfg.adaptiveBatchMin || cfg.adaptiveBatchP95 <= 0 {
+		log.Error("msg", "Invalid adaptive batching configuration, the batch sizes must be positive, the minimum not above the maximum, and the latency target positive")
+		os.Exit(1)
+	}
+	log.Info("msg", "Adapting the write batch size to the write latency", "min", cfg.adaptiveBatchMin, "max", cfg.adaptiveBatchMax, "latency_target", cfg.adaptiveBatchP95)
+	return newAdaptiveWriter(writer, newBatchController(cfg.adaptiveBatchMin, cfg.adaptiveBatchMax, cfg.adaptiveBatchP95), m.adaptiveBatchSize)
+}
+
+func initDownsampler(cfg *config, writer writers.Writer) *writers.Downsampler {
+	downsampler, err := writers.NewDownsampler(writer, cfg.downsample)
+	if err != nil {
+		log.Error("msg", "Invalid downsample configuration", "err", err)
+		os.Exit(1)
+	}
+	downsampler.Start()
+	log.Info("msg", "Downsampling samples before writing them", "interval", cfg.downsample.Interval, "method", cfg.downsample.Method, "grace", cfg.downsample.Grace)
+	return downsampler
+}
+
+// runSelfTest runs the startup self-test, exiting if it fails or doesn't finish within the timeout.
+func runSelfTest(timeout time.Duration, pgClient *pgprometheus.Client) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Error("msg", "Error getting the hostname for the self-test", "err", err)
+		os.Exit(1)
+	}
+	write := true
+	if elector != nil {
+		write, err = elector.IsLeader()
+		if err != nil {
+			log.Error("msg", "IsLeader check failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- pgClient.SelfTest(ctx, hostname, write)
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Write doesn't take a context, so a hung database might not release it
+		err = &pgprometheus.SelfTestError{Phase: "timeout", Err: ctx.Err()}
+	}
+	if err != nil {
+		phase := "unknown"
+		var selfTestErr *pgprometheus.SelfTestError
+		if errors.As(err, &selfTestErr) {
+			phase = selfTestErr.Phase
+		}
+		log.Error("msg", "Startup self-test failed", "phase", phase, "timeout", timeout, "err", err)
+		os.Exit(1)
+	}
+}
+
+// limitWrites bounds the number of concurrent write requests, by default to the size of the connection pool.
+func limitWrites(cfg *config, m *metrics, maxOpenConns int, handler http.Handler) http.Handler {
+	concurrency := cfg.writeConcurrency
+	if concurrency == 0 {
+		concurrency = maxOpenConns
+	}
+	if concurrency <= 0 {
+		return handler
+	}
+	limiter := util.NewConcurrencyLimiter("write", concurrency, cfg.writeQueue, cfg.writeQueueTimeout)
+	m.registerer.MustRegister(limiter.Collectors()...)
+	return limiter.Handler(handler)
+}
+
+func initQuarantine(cfg *config, mux *http.ServeMux, pgClient *pgprometheus.Client) {
+	var q *quarantine.Quarantine
+	var err error
+	switch {
+	case cfg.quarantineDir != "" && cfg.quarantineTable != "":
+		log.Error("msg", "Use either -quarantine-dir or -quarantine-table")
+		os.Exit(1)
+	case cfg.quarantineDir != "":
+		q, err = quarantine.NewDir(cfg.quarantineDir, cfg.quarantineMaxBytes, cfg.quarantineMaxAge, cfg.quarantineRecent)
+	case cfg.quarantineTable != "":
+		q, err = quarantine.NewTable(pgClient.DB, cfg.quarantineTable, cfg.quarantineMaxRows, cfg.quarantineMaxAge, cfg.quarantineRecent)
+	default:
+		return
+	}
+	if err != nil {
+		log.Error("msg", "Error setting up the quarantine", "err", err)
+		os.Exit(1)
+	}
+	pgClient.OnReject(q.Add)
+	mux.Handle("/admin/quarantine/recent", q.RecentHandler())
+}
+
+// initSeriesGuard sets up the limit of series per metric name, keeping the suppressed metrics in
+// -write-max-series-state-table if set and a database is given.
+func initSeriesGuard(cfg *config, db *sql.DB) *cardinality.Guard {
+	if cfg.maxSeriesWindow <= 0 || cfg.maxSeriesPersist <= 0 {
+		log.Error("msg", "-write-max-series-window and -write-max-series-persist-interval must be positive")
+		os.Exit(1)
+	}
+	guard := cardinality.NewGuard(cfg.maxSeriesPerMetric, cfg.maxSeriesWindow)
+	if cfg.maxSeriesTable != "" {
+		if db == nil {
+			log.Warn("msg", "Without PostgreSQL storage, the metrics over the series limit are kept in memory only", "table", cfg.maxSeriesTable)
+		} else {
+			var err error
+			if guard, err = cardinality.NewPersistentGuard(cfg.maxSeriesPerMetric, cfg.maxSeriesWindow, db, cfg.maxSeriesTable); err != nil {
+				log.Error("msg", "Error setting up the series limit", "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+	go guard.Run(cfg.maxSeriesPersist)
+	log.Info("msg", "Limiting the series per metric name", "max_series", cfg.maxSeriesPerMetric, "window", cfg.maxSeriesWindow)
+	return guard
+}
+
+// initQuotas loads the quota configuration. Without database, the series counted against the quotas are
+// only kept in memory.
+func initQuotas(cfg *config, db *sql.DB) *quota.Engine {
+	quotaCfg, err := quota.Load(cfg.quotaConfigFile)
+	if err != nil {
+		log.Error("msg", "Error loading quota configuration", "err", err)
+		os.Exit(1)
+	}
+	if db == nil {
+		return quota.NewEngine(quotaCfg)
+	}
+	engine, err := quota.NewPersistentEngine(quotaCfg, db, cfg.quotaStateTable)
+	if err != nil {
+		log.Error("msg", "Error setting up the quotas", "err", err)
+		os.Exit(1)
+	}
+	go engine.Run(cfg.quotaPersist)
+	return engine
+}
+
+func initGapDetection(cfg *config) *gaps.Detector {
+	gapCfg, err := gaps.Load(cfg.gapDetectionFile)
+	if err != nil {
+		log.Error("msg", "Error loading gap detection configuration", "err", err)
+		os.Exit(1)
+	}
+	detector := gaps.NewDetector(gapCfg)
+	go detector.Run()
+	return detector
+}
+
+func initTransformer(path string) *transform.Engine {
+	engine, err := transform.NewEngine(path)
+	if err != nil {
+		log.Error("msg", "Error loading transformation rules", "err", err)
+		os.Exit(1)
+	}
+	return engine
+}
+
+func initAdminAPI(cfg *config, mux *http.ServeMux, m *metrics, deleter seriesDeleter, checker indexChecker, cache labelCacher, reloader labelReloader) {
+	deletions = newDeleteJobs(deleter, currentSettings.Load().deleteOptions)
+	handler := timeHandler(m, "delete_series", settingsAdminAuth(deletions.handler()))
+	mux.Handle(deleteSeriesPath, handler)
+	mux.Handle(deleteSeriesPath+"/", handler)
+	mux.Handle(checkIndexesPath, timeHandler(m, "check_indexes", settingsAdminAuth(checkIndexesHandler(checker))))
+	mux.Handle(labelCachePath, timeHandler(m, "label_cache", settingsAdminAuth(labelCacheHandler(cache))))
+	mux.Handle(labelsReloadPath, timeHandler(m, "labels_reload", settingsAdminAuth(labelsReloadHandler(reloader))))
+	log.Warn("msg", "Admin API enabled")
+}
+
+func initElector(cfg *config, mux *http.ServeMux, m *metrics, db *sql.DB) util.LeaderElector {
+	backends := 0
+	for _, enabled := range []bool{cfg.restElection, cfg.haGroupLockID != 0, cfg.k8sElection} {
+		if enabled {
+			backends++
+		}
+	}
+	if backends > 1 {
+		log.Error("msg", "Use only one of REST, PgAdvisoryLock or Kubernetes for the leader election")
+		os.Exit(1)
+	}
+	if cfg.k8sElection {
+		k8sElection, err := util.NewKubernetesElection(cfg.k8sElectionConfig)
+		if err != nil {
+			log.Error("msg", "Error creating the Kubernetes leader election", "err", err)
+			os.Exit(1)
+		}
+		log.Info("msg", "Initialized leader election based on a Kubernetes Lease", "lease", cfg.k8sElectionConfig.LeaseName, "id", k8sElection.ID())
+		return util.NewElector(k8sElection)
+	}
 	if cfg.restElection {
-		return util.NewElector(util.NewRestElection())
+		restElection := util.NewRestElection(cfg.restElectionID, cfg.restElectionTTL)
+		m.registerer.MustRegister(util.RestLeaseTransitions)
+		mux.Handle("/admin/election/leader", restElection.LeaderHandler())
+		mux.Handle("/leader/status", restElection.StatusHandler())
+		mux.Handle("/leader/resign", restElection.ResignHandler())
+		log.Info("msg", "Initialized REST leader election", "id", restElection.ID(), "ttl", cfg.restElectionTTL)
+		return util.NewElector(restElection)
 	}
 	if cfg.haGroupLockID == 0 {
 		log.Warn("msg", "No adapter leader election. Group lock id is not set. Possible duplicate write load if running adapter in high-availability mode")
@@ -184,11 +865,22 @@ func initElector(cfg *config, db *sql.DB) *util.Elector {
 		log.Error("msg", "Prometheus timeout configuration must be set when using PG advisory lock")
 		os.Exit(1)
 	}
-	lock, err := util.NewPgAdvisoryLock(cfg.haGroupLockID, db)
+	m.registerer.MustRegister(util.LockReconnects, util.ElectionHandoffs, util.ElectionStepDuration, util.ElectionSinceConfirmed, util.ElectionResignations, util.ElectionRegainedAfter)
+	var lock *util.PgAdvisoryLock
+	var err error
+	if cfg.electionVerify {
+		m.registerer.MustRegister(util.LockIDCollisions, util.ElectionTakeovers)
+		hostname, _ := os.Hostname()
+		identity := util.LeaderIdentity{Application: applicationName, Hostname: hostname, PID: os.Getpid(), Version: version}
+		lock, err = util.NewVerifiedPgAdvisoryLock(cfg.haGroupLockID, db, identity, 2*cfg.electionInterval)
+	} else {
+		lock, err = util.NewPgAdvisoryLock(cfg.haGroupLockID, db)
+	}
 	if err != nil {
 		log.Error("msg", "Error creating advisory lock", "haGroupLockId", cfg.haGroupLockID, "err", err)
 		os.Exit(1)
 	}
+	advisoryLock = lock
 	scheduledElector := util.NewScheduledElector(lock, cfg.electionInterval)
 	log.Info("msg", "Initialized leader election based on PostgreSQL advisory lock")
 	if cfg.prometheusTimeout != 0 {
@@ -197,79 +889,464 @@ func initElector(cfg *config, db *sql.DB) *util.Elector {
 			for {
 				select {
 				case <-ticker.C:
-					lastReq := atomic.LoadInt64(&lastRequestUnixNano)
-					scheduledElector.PrometheusLivenessCheck(lastReq, cfg.prometheusTimeout)
+					scheduledElector.PrometheusLivenessCheck(lastRequest.lastSeen(), cfg.prometheusTimeout)
 				}
 			}
 		}()
 	}
-	return &scheduledElector.Elector
+	return scheduledElector
 }
 
-func write(writer writer) http.Handler {
+func write(m *metrics, writer writers.Writer, dedupe bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		compressed, err := io.ReadAll(r.Body)
+		arrived := time.Now()
+		// Prometheus counts as alive from the arrival of the request until it is answered
+		lastRequest.begin()
+		defer lastRequest.end()
+		encoding, err := checkWriteEncoding(r.Header)
+		if err != nil {
+			// a 415 lets remote write 2.0 senders fall back to 1.0
+			util.WriteError(w, http.StatusUnsupportedMediaType, util.ErrCodeUnsupportedMedia, err.Error(), nil)
+			return
+		}
+		// neither snappy nor gzip grow any body of maxWriteBytes beyond the MaxEncodedLen of snappy
+		compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(snappy.MaxEncodedLen(maxWriteBytes))))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Warn("msg", "Write request too large", "limit", tooLarge.Limit)
+			util.WriteError(w, http.StatusRequestEntityTooLarge, util.ErrCodeTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), nil)
+			return
+		}
 		if err != nil {
 			log.Error("msg", "Read error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// what is left of the body can't be read either, the connection can't be reused
+			w.Header().Set("Connection", "close")
+			util.WriteError(w, http.StatusInternalServerError, util.ErrCodeReadError, "error reading request body", err)
 			return
 		}
 
-		reqBuf, err := snappy.Decode(nil, compressed)
+		if err := checkBodyDigest(r.Header, compressed, requireDigest); err != nil {
+			reason := digestMismatch
+			if errors.Is(err, errDigestMissing) {
+				reason = digestMissing
+			}
+			m.writeDigestFailures.WithLabelValues(reason).Inc()
+			log.Warn("msg", "Write request digest check failed", "err", err)
+			util.WriteError(w, http.StatusBadRequest, util.ErrCodeDigestMismatch, err.Error(), nil)
+			return
+		}
+		m.writeRequestCompressedBytes.WithLabelValues(encoding).Observe(float64(len(compressed)))
+		// the length is read from the header of the block, which decoding would allocate whatever it says
+		if decodedLen, err := snappy.DecodedLen(compressed); encoding == encodingSnappy && err == nil && decodedLen > maxWriteBytes {
+			log.Warn("msg", "Write request too large", "decompressed_bytes", decodedLen, "limit", maxWriteBytes)
+			util.WriteError(w, http.StatusRequestEntityTooLarge, util.ErrCodeTooLarge, fmt.Sprintf("decompressed request body is larger than %d bytes", maxWriteBytes), nil)
+			return
+		}
+
+		ctx := r.Context()
+		committed := false
+		if writeResults != nil {
+			key := writeResults.key(r, compressed)
+			result, err := writeResults.begin(ctx, key)
+			if err != nil {
+				util.WriteError(w, http.StatusServiceUnavailable, util.ErrCodeStorageUnavailable, "gave up waiting for an identical write request in flight", err)
+				return
+			}
+			m.writeIdempotency.WithLabelValues(result).Inc()
+			if result != idempotencyMiss {
+				log.Debug("msg", "Identical write request already committed, not writing it again", "result", result)
+				return
+			}
+			defer func() {
+				writeResults.end(key, committed)
+			}()
+		}
+		begin := time.Now()
+		_, span := tracing.Tracer().Start(ctx, encoding+"_decode", trace.WithAttributes(attribute.Int("compressed_bytes", len(compressed))))
+		buf := acquireDecodeBuffer()
+		var reqBuf []byte
+		if encoding == encodingGzip {
+			reqBuf, err = buf.decodeGzip(compressed, maxWriteBytes)
+		} else {
+			reqBuf, err = buf.decode(compressed)
+		}
+		tracing.RecordError(span, err)
+		span.End()
+		if errors.Is(err, errDecodedTooLarge) {
+			releaseDecodeBuffer(buf)
+			log.Warn("msg", "Write request too large", "limit", maxWriteBytes)
+			util.WriteError(w, http.StatusRequestEntityTooLarge, util.ErrCodeTooLarge, fmt.Sprintf("decompressed request body is larger than %d bytes", maxWriteBytes), nil)
+			return
+		}
 		if err != nil {
-			log.Error("msg", "Decode error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			releaseDecodeBuffer(buf)
+			log.Error("msg", "Decode error", "encoding", encoding, "err", err.Error())
+			util.WriteError(w, http.StatusBadRequest, util.ErrCodeDecode, fmt.Sprintf("request body is not valid %s", encoding), err)
 			return
 		}
+		m.writeDecodeDuration.WithLabelValues(encoding).Observe(time.Since(begin).Seconds())
+		m.writeRequestDecompressedBytes.Observe(float64(len(reqBuf)))
 
+		begin = time.Now()
+		_, span = tracing.Tracer().Start(ctx, "proto_unmarshal", trace.WithAttributes(attribute.Int("decompressed_bytes", len(reqBuf))))
 		var req prompb.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		err = proto.Unmarshal(reqBuf, &req)
+		tracing.RecordError(span, err)
+		span.End()
+		if err != nil && encoding == encodingGzip && isSnappy(reqBuf) {
+			releaseDecodeBuffer(buf)
+			log.Error("msg", "Unmarshal error", "err", "snappy compressed body inside gzip")
+			util.WriteError(w, http.StatusBadRequest, util.ErrCodeDecode, "request body is snappy compressed inside gzip, compress it with either snappy or gzip", err)
+			return
+		}
+		// unmarshalling copies all strings, so the buffer can be reused right away
+		releaseDecodeBuffer(buf)
+		if err != nil {
 			log.Error("msg", "Unmarshal error", "err", err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			util.WriteError(w, http.StatusBadRequest, util.ErrCodeDecode, "request body is not a valid remote write request", err)
+			return
+		}
+		m.writeDecodeDuration.WithLabelValues("protobuf").Observe(time.Since(begin).Seconds())
+		if err := validateLabelSets(&req); err != nil {
+			log.Debug("msg", "Invalid write request", "err", err)
+			util.WriteError(w, http.StatusBadRequest, util.ErrCodeBadRequest, err.Error(), nil)
+			return
+		}
+		if err := applyNamePolicy(m, namePolicy, &req); err != nil {
+			log.Debug("msg", "Write request with invalid names", "err", err)
+			util.WriteError(w, http.StatusBadRequest, util.ErrCodeBadRequest, err.Error(), nil)
 			return
 		}
 
+		begin = time.Now()
 		samples := protoToSamples(&req)
-		receivedSamples.Add(float64(len(samples)))
+		if len(samples) == 0 {
+			// some senders send requests without samples, there is nothing to write
+			m.emptyWriteRequests.Inc()
+			return
+		}
+		m.receivedSamples.Add(float64(len(samples)))
+		highestReceived.update(samples)
+		received := len(samples)
+		var stats writers.WriteStats
+		var source string
+		if sources != nil {
+			source = sources.source(r)
+			sources.inject(samples, source)
+		}
+		if transformer != nil {
+			transformer.Apply(samples)
+		}
+		if dedupe {
+			var collapsed int
+			samples, collapsed = dedupeSamples(samples)
+			stats.Drop("duplicate", collapsed)
+			if collapsed > 0 {
+				m.dedupedSamples.Add(float64(collapsed))
+				log.Debug("msg", "Collapsed duplicate samples", "collapsed", collapsed, "remaining", len(samples))
+			}
+		}
+		m.writeDecodeDuration.WithLabelValues("convert").Observe(time.Since(begin).Seconds())
 
-		err = sendSamples(writer, samples)
-		if err != nil {
-			log.Warn("msg", "Error sending samples to remote storage", "err", err, "storage", writer.Name(), "num_samples", len(samples))
+		if quotas != nil {
+			admitted, err := quotas.Admit(r.Header.Get(quotas.TenantHeader()), samples)
+			var exceeded *quota.ExceededError
+			if errors.As(err, &exceeded) {
+				stats.Drop("quota", len(samples))
+				setSampleAudit(w.Header(), received, stats)
+				log.Debug("msg", "Write over quota", "tenant", exceeded.Tenant, "quota", exceeded.Reason)
+				util.WriteError(w, http.StatusTooManyRequests, util.ErrCodeQuotaExceeded, exceeded.Error(), exceeded)
+				return
+			}
+			stats.Drop("quota", len(samples)-len(admitted))
+			samples = admitted
+		}
+		if seriesGuard != nil {
+			admitted := seriesGuard.Admit(samples)
+			stats.Drop("series_limit", len(samples)-len(admitted))
+			samples = admitted
 		}
 
-		counter, err := sentSamples.GetMetricWithLabelValues(writer.Name())
+		if taps != nil {
+			taps.observe(samples)
+		}
+		// only the trace is passed on, the write isn't aborted when the sender goes away, but once it would have
+		// given up
+		writeCtx := context.WithoutCancel(ctx)
+		deadline, deadlineSource, hasDeadline := writeDeadline(r.Header, arrived)
+		if hasDeadline {
+			var cancel context.CancelFunc
+			writeCtx, cancel = context.WithDeadline(writeCtx, deadline)
+			defer cancel()
+		}
+		if source != "" {
+			writeCtx = pgprometheus.WithSource(writeCtx, source)
+		}
+		written, err := sendSamples(writeCtx, m, writer, currentLeadership(), sources.counterValue(source), samples)
+		committed = err == nil
+		stats.Add(written)
+		setSampleAudit(w.Header(), received, stats)
+		if errors.Is(err, pgprometheus.ErrStorageFull) {
+			recentWrites.setError(err)
+			util.WriteError(w, http.StatusInsufficientStorage, util.ErrCodeStorageFull, "the database is over its size limit, writes are rejected", nil)
+			return
+		}
+		if errors.Is(err, pgprometheus.ErrCircuitOpen) {
+			recentWrites.setError(err)
+			util.WriteError(w, http.StatusServiceUnavailable, util.ErrCodeCircuitOpen, "the database is unreachable, writes fail fast", err)
+			return
+		}
+		if errors.Is(err, pgprometheus.ErrNotVisible) {
+			recentWrites.setError(err)
+			util.WriteError(w, http.StatusInternalServerError, util.ErrCodeNotVisible, "the samples committed but aren't visible, retry the write", nil)
+			return
+		}
+		if errors.Is(err, errNotLeader) {
+			util.WriteError(w, http.StatusServiceUnavailable, util.ErrCodeNotLeader, "this instance is not the leader, send the write to the leader", nil)
+			return
+		}
+		var partial *pgprometheus.PartialWriteError
+		if errors.As(err, &partial) {
+			recentWrites.setError(err)
+			writePartialResponse(w, partial)
+			return
+		}
+		if err != nil && hasDeadline && errors.Is(writeCtx.Err(), context.DeadlineExceeded) {
+			m.writesAbandoned.WithLabelValues(deadlineSource).Inc()
+			log.Warn("msg", "Write abandoned at its deadline", "deadline", deadlineSource, "after", time.Since(arrived), "num_samples", len(samples))
+			util.WriteError(w, http.StatusServiceUnavailable, util.ErrCodeStorageUnavailable, "the write didn't finish before its deadline, retry the write", err)
+			return
+		}
 		if err != nil {
-			log.Warn("msg", "Couldn't get a counter", "labelValue", writer.Name(), "err", err)
+			class, sqlState := pgprometheus.ClassifyError(err)
+			logArgs := []interface{}{"msg", "Error sending samples to remote storage", "err", err, "class", class, "sqlstate", sqlState, "storage", writer.Name(), "num_samples", len(samples)}
+			var writeErr *pgprometheus.WriteError
+			if errors.As(err, &writeErr) {
+				logArgs = append(logArgs, "phase", writeErr.Phase, "rows", writeErr.Rows)
+			}
+			log.Warn(logArgs...)
+			recentWrites.setError(err)
+			if rejectedForGood(err, class) {
+				// a 4xx, as the retries of the sender would fail the same way
+				if deadLetters != nil {
+					if err := deadLetters.Add(samplesToProto(samples)); err != nil {
+						log.Error("msg", "Error keeping the rejected write request", "err", err, "num_samples", len(samples))
+					}
+				}
+				util.WriteError(w, http.StatusBadRequest, util.ErrCodeInvalidData, "the storage rejected the samples as invalid", err)
+				return
+			}
+			util.WriteError(w, http.StatusServiceUnavailable, util.ErrCodeStorageUnavailable, "error writing to the storage, retry the write", err)
+		}
+	})
+}
+
+// rejectedForGood tells whether a write failed for the samples themselves, so that retries would fail the same
+// way. Writes failing to acquire a connection or to commit are retried whatever the class of their error, as
+// the samples didn't get to the database or may have been written.
+func rejectedForGood(err error, class string) bool {
+	var writeErr *pgprometheus.WriteError
+	if errors.As(err, &writeErr) && (writeErr.Phase == pgprometheus.ErrConnAcquire || writeErr.Phase == pgprometheus.ErrCommit) {
+		return false
+	}
+	return !pgprometheus.RetryableErrorClass(class)
+}
+
+// partialWriteResponse is the body of write requests of which only part of the samples were written.
+type partialWriteResponse struct {
+	Status   string `json:"status"`
+	Code     string `json:"code"`
+	Written  int    `json:"written"`
+	Rejected int    `json:"rejected"`
+}
+
+// writePartialResponse reports the samples rejected by a partial write. The request succeeds, so that the
+// rejected samples aren't sent again.
+func writePartialResponse(w http.ResponseWriter, partial *pgprometheus.PartialWriteError) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(partialWriteResponse{Status: "partial", Code: util.ErrCodeInvalidData, Written: partial.Written, Rejected: partial.Rejected})
+}
+
+// writeStatus keeps the recent state of the write path for the status page.
+type writeStatus struct {
+	mutex         sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (s *writeStatus) setError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Prometheus PostgreSQL adapter</title></head>
+<body>
+<h1>Prometheus PostgreSQL adapter</h1>
+<table>
+<tr><th align="left">Version</th><td>{{.Version}}</td></tr>
+<tr><th align="left">Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th align="left">Leader</th><td>{{.Leader}}</td></tr>
+<tr><th align="left">Table</th><td>{{.Table}}</td></tr>
+<tr><th align="left">Database</th><td>{{.Database}}</td></tr>
+<tr><th align="left">Write throughput</th><td>{{printf "%.1f" .Throughput}} samples/s</td></tr>
+<tr><th align="left">Last write error</th><td>{{if .LastError}}{{.LastError}} ({{.LastErrorTime.Format "2006-01-02T15:04:05Z07:00"}}){{else}}none{{end}}</td></tr>
+</table>
+<p><a href="/">Refresh</a> &middot; <a href="/metrics">Metrics</a></p>
+</body>
+</html>
+`))
+
+type statusData struct {
+	Version       string
+	Uptime        time.Duration
+	Leader        string
+	Table         string
+	Database      string
+	Throughput    float64
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// statusPage serves a human-readable overview of the adapter at /
+func statusPage(checker healthChecker, table string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		data := statusData{
+			Version:    version,
+			Uptime:     time.Since(startTime).Truncate(time.Second),
+			Leader:     "no leader election",
+			Table:      table,
+			Database:   "ok",
+			Throughput: writeThroughput.Rate(),
 		}
-		writeThroughput.SetCurrent(getCounterValue(counter))
+		if elector != nil {
+			leader, err := elector.IsLeader()
+			switch {
+			case err != nil:
+				data.Leader = fmt.Sprintf("unknown: %v", err)
+			case leader:
+				data.Leader = fmt.Sprintf("leader (%s)", elector.ID())
+			default:
+				data.Leader = fmt.Sprintf("follower (%s)", elector.ID())
+			}
+		}
+		if err := checker.HealthCheck(); err != nil {
+			data.Database = fmt.Sprintf("unavailable: %v", err)
+		}
+		recentWrites.mutex.Lock()
+		data.LastError = recentWrites.lastError
+		data.LastErrorTime = recentWrites.lastErrorTime
+		recentWrites.mutex.Unlock()
 
-		select {
-		case d := <-writeThroughput.Values:
-			log.Info("msg", "Samples write throughput", "samples/sec", d)
-		default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, data); err != nil {
+			log.Error("msg", "Error rendering status page", "err", err)
 		}
 	})
 }
 
-func getCounterValue(counter prometheus.Counter) float64 {
-	dtoMetric := &ioprometheusclient.Metric{}
-	if err := counter.Write(dtoMetric); err != nil {
-		log.Warn("msg", "Error reading counter value", "err", err, "sentSamples", sentSamples)
+// logThroughput periodically logs the write throughput, also when no requests arrive.
+func logThroughput() {
+	ticker := time.NewTicker(throughputLogInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		keyvals := []interface{}{"msg", "Samples write throughput", "samples/sec_1m", writeThroughput.Rate(), "samples/sec_5m", writeThroughput.Rate5m()}
+		if elector != nil {
+			if leader, err := elector.IsLeader(); err == nil && !leader {
+				keyvals = append(keyvals, "leader", false)
+			}
+		}
+		log.Info(keyvals...)
 	}
-	return dtoMetric.GetCounter().GetValue()
 }
 
-func health(writer *pgprometheus.Client) http.Handler {
+type healthChecker interface {
+	HealthCheck() error
+}
+
+// hostReporter is implemented by health checkers that know which database host they are connected to.
+type hostReporter interface {
+	CurrentHost() string
+}
+
+func health(checker healthChecker) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := writer.HealthCheck()
+		err := checker.HealthCheck()
+		if errors.Is(err, pgprometheus.ErrCircuitOpen) {
+			util.WriteError(w, http.StatusServiceUnavailable, util.ErrCodeCircuitOpen, "the circuit breaker in front of the database is open", err)
+			return
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			util.WriteError(w, http.StatusInternalServerError, util.ErrCodeStorageUnavailable, "storage health check failed", err)
 			return
 		}
-		w.Header().Set("Content-Length", "0")
+		if reporter, ok := checker.(hostReporter); ok {
+			w.Header().Set("X-Database-Host", reporter.CurrentHost())
+		}
+		writeHealth(w, healthzStaleness, currentLeadership())
 	})
 }
 
+// checkWriteEncoding checks that the headers of a write request, if set, announce a snappy or gzip compressed
+// remote write 1.0 request, and returns the encoding, snappy if unset.
+func checkWriteEncoding(h http.Header) (string, error) {
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	switch {
+	case encoding == "":
+		encoding = encodingSnappy
+	case strings.Contains(encoding, ","):
+		return "", fmt.Errorf("mixed Content-Encoding %q, the body must be compressed with either snappy or gzip only", h.Get("Content-Encoding"))
+	case encoding != encodingSnappy && encoding != encodingGzip:
+		return "", fmt.Errorf("unsupported Content-Encoding %q, only snappy and gzip are supported", h.Get("Content-Encoding"))
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		return encoding, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported Content-Type %q, only application/x-protobuf is supported", contentType)
+	}
+	if proto, ok := params["proto"]; ok && proto != "prometheus.WriteRequest" {
+		return "", fmt.Errorf("unsupported protobuf message %q, only prometheus.WriteRequest (remote write 1.0) is supported", proto)
+	}
+	return encoding, nil
+}
+
+// validateLabelSets checks that the label names of each series are set and unique, as the remote write
+// specification requires.
+func validateLabelSets(req *prompb.WriteRequest) error {
+	for _, ts := range req.Timeseries {
+		seen := make(map[string]bool, len(ts.Labels))
+		for _, l := range ts.Labels {
+			if l.Name == "" {
+				return fmt.Errorf("series %s has a label with an empty name", formatLabels(ts.Labels))
+			}
+			if seen[l.Name] {
+				return fmt.Errorf("series %s has the label %q more than once", formatLabels(ts.Labels), l.Name)
+			}
+			seen[l.Name] = true
+		}
+	}
+	return nil
+}
+
+// formatLabels formats the labels of a series in the order they were sent, for error messages.
+func formatLabels(labels []prompb.Label) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l.Name, l.Value)
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
 func protoToSamples(req *prompb.WriteRequest) model.Samples {
 	var samples model.Samples
 	for _, ts := range req.Timeseries {
@@ -289,41 +1366,102 @@ func protoToSamples(req *prompb.WriteRequest) model.Samples {
 	return samples
 }
 
-func sendSamples(w writer, samples model.Samples) error {
-	atomic.StoreInt64(&lastRequestUnixNano, time.Now().UnixNano())
-	begin := time.Now()
-	shouldWrite := true
-	var err error
-	if elector != nil {
-		shouldWrite, err = elector.IsLeader()
+// samplesToProto is the inverse of protoToSamples: consecutive samples of the same metric make up a series.
+func samplesToProto(samples model.Samples) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	var previous model.Metric
+	for _, s := range samples {
+		if len(req.Timeseries) == 0 || !s.Metric.Equal(previous) {
+			labels := make([]prompb.Label, 0, len(s.Metric))
+			for name, value := range s.Metric {
+				labels = append(labels, prompb.Label{Name: string(name), Value: string(value)})
+			}
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].Name < labels[j].Name
+			})
+			req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: labels})
+			previous = s.Metric
+		}
+		ts := &req.Timeseries[len(req.Timeseries)-1]
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: float64(s.Value), Timestamp: int64(s.Timestamp)})
+	}
+	return req
+}
+
+// currentLeadership returns the leader election, nil if there is none.
+func currentLeadership() util.LeaderElector {
+	return elector
+}
+
+// sendSamples writes the samples if this instance is the leader, or if there is no leader election (nil
+// leader). Followers skip the write without error, counting the samples as dropped for not_leader, or fail
+// with errNotLeader if followersReject is set.
+func sendSamples(ctx context.Context, m *metrics, w writers.Writer, leader util.LeaderElector, source string, samples model.Samples) (writers.WriteStats, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "write_samples", trace.WithAttributes(attribute.String("storage", w.Name()), attribute.Int("samples.count", len(samples))))
+	defer span.End()
+	if leader != nil {
+		isLeader, err := leader.IsLeader()
 		if err != nil {
 			log.Error("msg", "IsLeader check failed", "err", err)
-			return err
+			return writers.WriteStats{}, err
+		}
+		if !isLeader {
+			span.SetAttributes(attribute.Bool("leader", false))
+			log.Debug("msg", fmt.Sprintf("Election id %v: Instance is not a leader. Can't write data", leader.ID()))
+			if followersReject {
+				return writers.WriteStats{}, errNotLeader
+			}
+			var stats writers.WriteStats
+			stats.Drop("not_leader", len(samples))
+			return stats, nil
 		}
 	}
-	if shouldWrite {
-		err = w.Write(samples)
-	} else {
-		log.Debug("msg", fmt.Sprintf("Election id %v: Instance is not a leader. Can't write data", elector.ID()))
-		return nil
-	}
+	begin := time.Now()
+	stats, err := w.WriteContext(ctx, samples)
 	duration := time.Since(begin).Seconds()
+	span.SetAttributes(attribute.Float64("batch.duration_seconds", duration))
+	tracing.RecordError(span, err)
+	var partial *pgprometheus.PartialWriteError
+	if errors.As(err, &partial) {
+		span.SetAttributes(attribute.Int("samples.rejected", partial.Rejected))
+		m.failedSamples.WithLabelValues(w.Name(), source).Add(float64(partial.Rejected))
+		m.sentSamples.WithLabelValues(w.Name(), source).Add(float64(partial.Written))
+		if partial.Written > 0 {
+			m.recordSuccessfulWrite(w.Name())
+		}
+		writeThroughput.Add(partial.Written)
+		m.sentBatchDuration.WithLabelValues(w.Name()).Observe(duration)
+		return stats, err
+	}
 	if err != nil {
-		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
-		return err
+		m.failedSamples.WithLabelValues(w.Name(), source).Add(float64(len(samples)))
+		m.writeErrors.WithLabelValues(pgprometheus.ClassifyError(err)).Inc()
+		return stats, err
 	}
-	sentSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
-	sentBatchDuration.WithLabelValues(w.Name()).Observe(duration)
-	return nil
+	m.sentSamples.WithLabelValues(w.Name(), source).Add(float64(len(samples)))
+	m.recordSuccessfulWrite(w.Name())
+	writeThroughput.Add(len(samples))
+	highestWritten.update(samples)
+	m.sentBatchDuration.WithLabelValues(w.Name()).Observe(duration)
+	return stats, nil
+}
+
+// handleProfiling registers the pprof handlers, which net/http/pprof only registers on the default mux.
+func handleProfiling(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 }
 
 // timeHandler uses Prometheus histogram to track request time
-func timeHandler(path string, handler http.Handler) http.Handler {
+func timeHandler(m *metrics, path string, handler http.Handler) http.Handler {
 	f := func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		handler.ServeHTTP(w, r)
 		elapsedMs := time.Since(start).Nanoseconds() / int64(time.Millisecond)
-		httpRequestDuration.WithLabelValues(path).Observe(float64(elapsedMs))
+		m.httpRequestDuration.WithLabelValues(path).Observe(float64(elapsedMs))
 	}
 	return http.HandlerFunc(f)
 }
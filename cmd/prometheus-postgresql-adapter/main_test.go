@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/cardinality"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/quota"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// testMetrics are the metrics of the handlers under test. They aren't registered.
+var testMetrics = newMetrics("")
+
+func init() {
+	log.Init("debug")
+}
+
+type fakeWriter struct {
+	samples model.Samples
+	calls   int
+	err     error
+	// dropped are the samples of each write reported as dropped by reason
+	dropped map[string]int
+}
+
+func (f *fakeWriter) WriteContext(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	f.calls++
+	f.samples = append(f.samples, samples...)
+	if f.err != nil {
+		return writers.WriteStats{}, f.err
+	}
+	stats := writers.WriteStats{Written: len(samples)}
+	for reason, n := range f.dropped {
+		stats.Drop(reason, n)
+		stats.Written -= n
+	}
+	return stats, nil
+}
+
+func (f *fakeWriter) Name() string {
+	return "fake"
+}
+
+type fakeHealthChecker struct {
+	err error
+}
+
+func (f fakeHealthChecker) HealthCheck() error {
+	return f.err
+}
+
+func decodeErrorResponse(t *testing.T, recorder *httptest.ResponseRecorder) util.ErrorResponse {
+	t.Helper()
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+	var resp util.ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error body is not JSON: %v (%q)", err, recorder.Body.String())
+	}
+	return resp
+}
+
+// retryAfter returns the Retry-After header of the response in seconds, failing the test if it isn't an
+// integer number of seconds.
+func retryAfter(t *testing.T, recorder *httptest.ResponseRecorder) int {
+	t.Helper()
+	seconds, err := strconv.Atoi(recorder.Header().Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		t.Errorf("Expected Retry-After in seconds, got %q", recorder.Header().Get("Retry-After"))
+	}
+	return seconds
+}
+
+// encodeLabelSets encodes a write request with a sample for each of the label sets.
+func encodeLabelSets(t *testing.T, labelSets ...[]prompb.Label) []byte {
+	t.Helper()
+	req := &prompb.WriteRequest{}
+	for _, labels := range labelSets {
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: labels, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}})
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+func TestWriteErrorCodes(t *testing.T) {
+	valid := encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}})
+	testCases := []struct {
+		name   string
+		body   []byte
+		header http.Header
+		status int
+		code   string
+	}{
+		{name: "invalid snappy", body: []byte("not snappy"), status: http.StatusBadRequest, code: "decode_error"},
+		{name: "invalid protobuf", body: snappy.Encode(nil, []byte{0xff, 0xff, 0xff}), status: http.StatusBadRequest, code: "decode_error"},
+		{name: "empty label name", body: encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "", Value: "a"}}), status: http.StatusBadRequest, code: "bad_request"},
+		{name: "duplicate label name", body: encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}, {Name: "job", Value: "b"}}), status: http.StatusBadRequest, code: "bad_request"},
+		{name: "brotli", body: valid, header: http.Header{"Content-Encoding": {"br"}}, status: http.StatusUnsupportedMediaType, code: "unsupported_media_type"},
+		{name: "snappy in gzip", body: valid, header: http.Header{"Content-Encoding": {"snappy, gzip"}}, status: http.StatusUnsupportedMediaType, code: "unsupported_media_type"},
+		{name: "json", body: valid, header: http.Header{"Content-Type": {"application/json"}}, status: http.StatusUnsupportedMediaType, code: "unsupported_media_type"},
+		{name: "remote write 2.0", body: valid, header: http.Header{"Content-Type": {"application/x-protobuf;proto=io.prometheus.write.v2.Request"}}, status: http.StatusUnsupportedMediaType, code: "unsupported_media_type"},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			writer := &fakeWriter{}
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/write", bytes.NewReader(c.body))
+			for name, values := range c.header {
+				req.Header[name] = values
+			}
+			write(testMetrics, writer, false).ServeHTTP(recorder, req)
+			if writer.calls != 0 {
+				t.Errorf("Expected the writer not to be called, got %d calls", writer.calls)
+			}
+			if recorder.Code != c.status {
+				t.Errorf("Expected status %d, got %d", c.status, recorder.Code)
+			}
+			if resp := decodeErrorResponse(t, recorder); resp.Code != c.code {
+				t.Errorf("Expected code %q, got %q", c.code, resp.Code)
+			}
+		})
+	}
+}
+
+func TestWriteAcceptedEncodings(t *testing.T) {
+	body := encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}})
+	for _, header := range []http.Header{
+		{},
+		{"Content-Encoding": {"snappy"}, "Content-Type": {"application/x-protobuf"}},
+		{"Content-Type": {"application/x-protobuf;proto=prometheus.WriteRequest"}},
+		{"Content-Encoding": {"SNAPPY"}},
+	} {
+		writer := &fakeWriter{}
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/write", bytes.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		write(testMetrics, writer, false).ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK || writer.calls != 1 {
+			t.Errorf("Expected a write with headers %v to be accepted, got status %d and %d writes", header, recorder.Code, writer.calls)
+		}
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+	}}
+	for name, req := range map[string]*prompb.WriteRequest{"no series": {}, "no samples": req} {
+		t.Run(name, func(t *testing.T) {
+			data, err := proto.Marshal(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			empty := testutil.ToFloat64(testMetrics.emptyWriteRequests)
+			writer := &fakeWriter{err: errors.New("must not be called")}
+			recorder := httptest.NewRecorder()
+			write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("Expected status 200, got %d", recorder.Code)
+			}
+			if writer.calls != 0 {
+				t.Errorf("Expected the writer not to be called, got %d calls", writer.calls)
+			}
+			if n := testutil.ToFloat64(testMetrics.emptyWriteRequests) - empty; n != 1 {
+				t.Errorf("Expected 1 empty request to be counted, got %v", n)
+			}
+		})
+	}
+}
+
+func TestWriteOverQuota(t *testing.T) {
+	quotaCfg, err := quota.Parse([]byte("tenants:\n  team-a:\n    new_series_per_day: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas = quota.NewEngine(quotaCfg)
+	defer func() {
+		quotas = nil
+	}()
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &fakeWriter{}
+	recorder := httptest.NewRecorder()
+	httpReq := httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data)))
+	httpReq.Header.Set(quota.DefaultTenantHeader, "team-a")
+	write(testMetrics, writer, false).ServeHTTP(recorder, httpReq)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, recorder.Code)
+	}
+	resp := decodeErrorResponse(t, recorder)
+	if resp.Code != util.ErrCodeQuotaExceeded || !strings.Contains(resp.Error, "team-a") {
+		t.Errorf("Expected quota error naming the tenant, got %+v", resp)
+	}
+	if len(writer.samples) != 0 {
+		t.Errorf("Expected no samples to be written, got %d", len(writer.samples))
+	}
+	if reasons := recorder.Header().Get(headerDropReasons); reasons != "quota=2" {
+		t.Errorf("Expected the samples to be dropped over quota, got %q", reasons)
+	}
+	// the new series budget is reset on the next day
+	if seconds := retryAfter(t, recorder); seconds > 24*3600 {
+		t.Errorf("Expected to retry by the next day, got %ds", seconds)
+	}
+}
+
+func TestWriteSeriesLimit(t *testing.T) {
+	seriesGuard = cardinality.NewGuard(1, time.Hour)
+	defer func() {
+		seriesGuard = nil
+	}()
+	body := encodeLabelSets(t,
+		[]prompb.Label{{Name: "__name__", Value: "events"}, {Name: "ts", Value: "1"}},
+		[]prompb.Label{{Name: "__name__", Value: "events"}, {Name: "ts", Value: "2"}},
+		[]prompb.Label{{Name: "__name__", Value: "up"}},
+	)
+	writer := &fakeWriter{}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the write to succeed, got %d", recorder.Code)
+	}
+	if len(writer.samples) != 2 {
+		t.Errorf("Expected the new series over the limit to be dropped, got %v", writer.samples)
+	}
+	if reasons := recorder.Header().Get(headerDropReasons); reasons != "series_limit=1" {
+		t.Errorf("Expected the series over the limit to be reported, got %q", reasons)
+	}
+}
+
+func TestWritePartial(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 1, Timestamp: 2}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &fakeWriter{err: &pgprometheus.PartialWriteError{Written: 1, Rejected: 1, Err: errors.New("invalid byte sequence")}}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", recorder.Code)
+	}
+	var resp partialWriteResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Body is not JSON: %v (%q)", err, recorder.Body.String())
+	}
+	if resp.Status != "partial" || resp.Code != util.ErrCodeInvalidData || resp.Written != 1 || resp.Rejected != 1 {
+		t.Errorf("Unexpected partial write response %+v", resp)
+	}
+	if strings.Contains(recorder.Body.String(), "invalid byte sequence") {
+		t.Error("Expected the database error not to be exposed")
+	}
+}
+
+func TestWriteStorageFull(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &fakeWriter{err: pgprometheus.ErrStorageFull}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+	if recorder.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected status %d, got %d", http.StatusInsufficientStorage, recorder.Code)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeStorageFull {
+		t.Errorf("Expected code %q, got %q", util.ErrCodeStorageFull, resp.Code)
+	}
+}
+
+func TestWriteCircuitOpen(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client tells the remaining cool-down
+	open := util.WithRetryAfter(pgprometheus.ErrCircuitOpen, 12500*time.Millisecond)
+	writer := &fakeWriter{err: open}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeCircuitOpen {
+		t.Errorf("Expected code %q, got %q", util.ErrCodeCircuitOpen, resp.Code)
+	}
+	if seconds := retryAfter(t, recorder); seconds != 13 {
+		t.Errorf("Expected to retry after the cool-down of 13s, got %ds", seconds)
+	}
+
+	recorder = httptest.NewRecorder()
+	health(fakeHealthChecker{err: open}).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected health status %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if seconds := retryAfter(t, recorder); seconds != 13 {
+		t.Errorf("Expected the health check to retry after the cool-down of 13s, got %ds", seconds)
+	}
+}
+
+func TestWriteNotVisible(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &fakeWriter{err: pgprometheus.ErrNotVisible}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, recorder.Code)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeNotVisible {
+		t.Errorf("Expected code %q, got %q", util.ErrCodeNotVisible, resp.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	health(fakeHealthChecker{err: pgprometheus.ErrNotVisible}).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected health status %d, got %d", http.StatusInternalServerError, recorder.Code)
+	}
+}
+
+func TestWriteStorageError(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{name: "connection lost", err: &pgconn.PgError{Code: "08006", Message: "relation \"metrics_values\" is gone"}, status: http.StatusServiceUnavailable, code: util.ErrCodeStorageUnavailable},
+		{name: "unknown", err: errors.New("relation \"metrics_values\" is gone"), status: http.StatusServiceUnavailable, code: util.ErrCodeStorageUnavailable},
+		{name: "invalid data", err: &pgconn.PgError{Code: "22003", Message: "relation \"metrics_values\" is gone"}, status: http.StatusBadRequest, code: util.ErrCodeInvalidData},
+		{name: "invalid data inserting values", err: &pgprometheus.WriteError{Phase: pgprometheus.ErrValueInsert, Err: &pgconn.PgError{Code: "22003", Message: "relation \"metrics_values\" is gone"}}, status: http.StatusBadRequest, code: util.ErrCodeInvalidData},
+		{name: "constraint violated on commit", err: &pgprometheus.WriteError{Phase: pgprometheus.ErrCommit, Err: &pgconn.PgError{Code: "23503", Message: "relation \"metrics_values\" is gone"}}, status: http.StatusServiceUnavailable, code: util.ErrCodeStorageUnavailable},
+		{name: "connection refused", err: &pgprometheus.WriteError{Phase: pgprometheus.ErrConnAcquire, Err: errors.New("dial tcp: relation \"metrics_values\" is gone")}, status: http.StatusServiceUnavailable, code: util.ErrCodeStorageUnavailable},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			write(testMetrics, &fakeWriter{err: c.err}, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+			if recorder.Code != c.status {
+				t.Errorf("Expected status %d, got %d", c.status, recorder.Code)
+			}
+			if resp := decodeErrorResponse(t, recorder); resp.Code != c.code {
+				t.Errorf("Expected code %q, got %q", c.code, resp.Code)
+			}
+			if strings.Contains(recorder.Body.String(), "metrics_values") {
+				t.Error("Expected the database error not to be exposed")
+			}
+			if c.status == http.StatusServiceUnavailable {
+				retryAfter(t, recorder)
+			} else if header := recorder.Header().Get("Retry-After"); header != "" {
+				t.Errorf("Expected no Retry-After for status %d, got %q", c.status, header)
+			}
+		})
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	writer := &fakeWriter{}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(make([]byte, snappy.MaxEncodedLen(maxWriteBytes)+1))))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, recorder.Code)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeTooLarge {
+		t.Errorf("Expected code %q, got %q", util.ErrCodeTooLarge, resp.Code)
+	}
+	if writer.calls != 0 {
+		t.Errorf("Expected the writer not to be called, got %d calls", writer.calls)
+	}
+
+	// a small body declaring a huge decompressed length is rejected before it is decompressed
+	compressed := snappy.Encode(nil, make([]byte, maxWriteBytes+1))
+	recorder = httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(compressed)))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for %d compressed bytes, got %d", http.StatusRequestEntityTooLarge, len(compressed), recorder.Code)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeTooLarge {
+		t.Errorf("Expected code %q, got %q", util.ErrCodeTooLarge, resp.Code)
+	}
+}
+
+func gzipBody(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestWriteGzip(t *testing.T) {
+	snappyBody := encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}})
+	data, err := snappy.Decode(nil, snappyBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name   string
+		body   []byte
+		status int
+		code   string
+	}{
+		{name: "valid", body: gzipBody(t, data), status: http.StatusOK},
+		{name: "invalid gzip", body: snappyBody, status: http.StatusBadRequest, code: util.ErrCodeDecode},
+		{name: "snappy inside gzip", body: gzipBody(t, snappyBody), status: http.StatusBadRequest, code: util.ErrCodeDecode},
+		{name: "too large", body: gzipBody(t, make([]byte, maxWriteBytes+1)), status: http.StatusRequestEntityTooLarge, code: util.ErrCodeTooLarge},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			writer := &fakeWriter{}
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/write", bytes.NewReader(c.body))
+			req.Header.Set("Content-Encoding", "gzip")
+			write(testMetrics, writer, false).ServeHTTP(recorder, req)
+			if recorder.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, recorder.Code, recorder.Body)
+			}
+			if c.status == http.StatusOK {
+				if len(writer.samples) != 1 {
+					t.Errorf("Expected 1 sample to be written, got %d", len(writer.samples))
+				}
+				return
+			}
+			if resp := decodeErrorResponse(t, recorder); resp.Code != c.code {
+				t.Errorf("Expected code %q, got %q", c.code, resp.Code)
+			}
+			if writer.calls != 0 {
+				t.Errorf("Expected the writer not to be called, got %d calls", writer.calls)
+			}
+		})
+	}
+}
+
+func TestWriteFollowerReject(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector = util.NewElector(util.NewFakeElection("fake"))
+	defer func() {
+		elector = nil
+	}()
+	for reject, status := range map[bool]int{false: http.StatusOK, true: http.StatusServiceUnavailable} {
+		followersReject = reject
+		writer := &fakeWriter{}
+		recorder := httptest.NewRecorder()
+		write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+		if recorder.Code != status {
+			t.Errorf("Reject %v: expected status %d, got %d", reject, status, recorder.Code)
+		}
+		if reject {
+			if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeNotLeader {
+				t.Errorf("Expected code %q, got %q", util.ErrCodeNotLeader, resp.Code)
+			}
+			if seconds := retryAfter(t, recorder); seconds != int(util.DefaultRetryAfter.Seconds()) {
+				t.Errorf("Expected to retry after %v, got %ds", util.DefaultRetryAfter, seconds)
+			}
+		}
+		if writer.calls != 0 {
+			t.Errorf("Reject %v: expected the follower not to write, got %d calls", reject, writer.calls)
+		}
+	}
+	followersReject = false
+}
+
+func TestHealthErrorHidesCause(t *testing.T) {
+	cause := fmt.Errorf("pq: password authentication failed for user \"secret\"")
+	recorder := httptest.NewRecorder()
+	health(fakeHealthChecker{err: cause}).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", recorder.Code)
+	}
+	resp := decodeErrorResponse(t, recorder)
+	if resp.Code != "storage_unavailable" {
+		t.Errorf("Expected code storage_unavailable, got %q", resp.Code)
+	}
+	if bytes.Contains(recorder.Body.Bytes(), []byte("secret")) {
+		t.Errorf("Response leaks the underlying error: %q", recorder.Body.String())
+	}
+}
+
+func TestLegacyErrorBodies(t *testing.T) {
+	util.LegacyErrorBodies = true
+	defer func() { util.LegacyErrorBodies = false }()
+
+	cause := fmt.Errorf("connection refused")
+	recorder := httptest.NewRecorder()
+	health(fakeHealthChecker{err: cause}).ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "connection refused\n" {
+		t.Errorf("Expected plain error body, got %q", body)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	recentWrites.setError(errors.New("copy failed: <boom>"))
+	recorder := httptest.NewRecorder()
+	statusPage(fakeHealthChecker{err: errors.New("connection refused")}, "metrics").ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", recorder.Code)
+	}
+	body := recorder.Body.String()
+	for _, expected := range []string{"<td>metrics</td>", "unavailable: connection refused", "copy failed: &lt;boom&gt;", "no leader election"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected status page to contain %q:\n%s", expected, body)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	statusPage(fakeHealthChecker{}, "metrics").ServeHTTP(recorder, httptest.NewRequest("GET", "/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown paths, got %d", recorder.Code)
+	}
+}
+
+func TestInitStorage(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg := &config{}
+	defineFlags(fs, cfg)
+	if err := fs.Parse([]string{"-pg-host=db", "-storage=tee", "-tee-storages=dry-run,dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.pgPrometheusConfig.Host != "db" {
+		t.Errorf("Expected the -pg flags to configure the postgresql storage, got host %q", cfg.pgPrometheusConfig.Host)
+	}
+	writer := initStorage(cfg)
+	if _, ok := writer.(*writers.Tee); !ok || postgresStorage(writer) != nil {
+		t.Errorf("Expected a tee without PostgreSQL, got %s", writer.Name())
+	}
+	cfg.dryRun = true
+	if writer := initStorage(cfg); writer.Name() != "dry-run" {
+		t.Errorf("Expected -dry-run to select the dry-run storage, got %s", writer.Name())
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/cardinality"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/deadletter"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/gaps"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/quarantine"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/quota"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/transform"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// metrics are the adapter's own metrics, named in the namespace of -metrics-namespace.
+type metrics struct {
+	namespace string
+
+	receivedSamples               prometheus.Counter
+	sentSamples                   *prometheus.CounterVec
+	failedSamples                 *prometheus.CounterVec
+	writeErrors                   *prometheus.CounterVec
+	sentBatchDuration             *prometheus.HistogramVec
+	httpRequestDuration           *prometheus.HistogramVec
+	dedupedSamples                prometheus.Counter
+	writeRequestCompressedBytes   *prometheus.HistogramVec
+	writeRequestDecompressedBytes prometheus.Histogram
+	readQueries                   *prometheus.CounterVec
+	readQueryDuration             prometheus.Histogram
+	readSamplesReturned           prometheus.Histogram
+	emptyWriteRequests            prometheus.Counter
+	writeDecodeDuration           *prometheus.HistogramVec
+	configReloads                 *prometheus.CounterVec
+	configLastReloadSuccess       prometheus.Gauge
+	adaptiveBatchSize             prometheus.Gauge
+	lastSuccessfulWrite           *prometheus.GaugeVec
+	invalidNames                  *prometheus.CounterVec
+	writeDigestFailures           *prometheus.CounterVec
+	writeIdempotency              *prometheus.CounterVec
+	writesAbandoned               *prometheus.CounterVec
+	tailStreams                   prometheus.Gauge
+	tailDroppedSamples            prometheus.Counter
+	storageBytes                  *prometheus.GaugeVec
+	bytesPerSampleStored          prometheus.Gauge
+	compressionRatio              prometheus.Gauge
+	writeAmplification            prometheus.Gauge
+	unknownPaths                  *unknownPathCounter
+	connections                   *connTracker
+	gauges                        []prometheus.Collector
+
+	// registerer registers the collectors of the other packages, prefixed with the namespace by register.
+	registerer prometheus.Registerer
+}
+
+func newMetrics(namespace string) *metrics {
+	return &metrics{
+		namespace: namespace,
+		receivedSamples: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "received_samples_total",
+				Help:      "Total number of received samples.",
+			},
+		),
+		sentSamples: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "sent_samples_total",
+				Help:      "Total number of processed samples sent to remote storage, by remote and -write-source-label value.",
+			},
+			[]string{"remote", "source"},
+		),
+		failedSamples: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "failed_samples_total",
+				Help:      "Total number of processed samples which failed on send to remote storage, by remote and -write-source-label value.",
+			},
+			[]string{"remote", "source"},
+		),
+		writeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "write_errors_total",
+				Help:      "Total number of failed writes to the remote storage, by error class and SQLSTATE.",
+			},
+			[]string{"class", "sqlstate"},
+		),
+		sentBatchDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "sent_batch_duration_seconds",
+				Help:      "Duration of sample batch send calls to the remote storage.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"remote"},
+		),
+		httpRequestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "http_request_duration_ms",
+				Help:      "Duration of HTTP request in milliseconds",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"path"},
+		),
+		dedupedSamples: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "deduplicated_samples_total",
+				Help:      "Total number of samples dropped because the same series and timestamp occurred again in the same request.",
+			},
+		),
+		writeRequestCompressedBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "write_request_compressed_bytes",
+				Help:      "Size of the compressed write request bodies, by content encoding.",
+				Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+			},
+			[]string{"encoding"},
+		),
+		writeRequestDecompressedBytes: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "write_request_decompressed_bytes",
+				Help:      "Size of the decompressed write request bodies.",
+				Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+			},
+		),
+		readQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "read_queries_total",
+				Help:      "Total number of range queries, by status.",
+			},
+			[]string{"status"},
+		),
+		readQueryDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "read_query_duration_seconds",
+				Help:      "Duration of range queries in the database.",
+				Buckets:   prometheus.ExponentialBuckets(0.005, 4, 8),
+			},
+		),
+		readSamplesReturned: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "read_samples_returned",
+				Help:      "Number of samples returned by successful range queries.",
+				Buckets:   prometheus.ExponentialBuckets(10, 10, 7),
+			},
+		),
+		emptyWriteRequests: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "empty_write_requests_total",
+				Help:      "Total number of write requests without samples, which are accepted without writing.",
+			},
+		),
+		writeDecodeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "write_decode_duration_seconds",
+				Help:      "Duration of the stages of decoding a write request: decompression, named after the content encoding (snappy or gzip), protobuf and convert.",
+				Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+			},
+			[]string{"stage"},
+		),
+		configReloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "config_reloads_total",
+				Help:      "Total number of configuration reloads on SIGHUP, by status.",
+			},
+			[]string{"status"},
+		),
+		configLastReloadSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "config_last_reload_success_timestamp_seconds",
+				Help:      "Timestamp of the last successful configuration reload, or of the start if there was none.",
+			},
+		),
+		adaptiveBatchSize: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "write_adaptive_batch_size",
+				Help:      "Number of samples per batch written to the remote storage with -write-adaptive-batching, 0 without.",
+			},
+		),
+		lastSuccessfulWrite: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "last_successful_write_timestamp_seconds",
+				Help:      "Timestamp of the last successful write to the remote storage, by remote.",
+			},
+			[]string{"remote"},
+		),
+		invalidNames: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "write_invalid_names_total",
+				Help:      "Total number of label names and metric names received that don't follow the Prometheus naming rules, by -write-name-policy and kind (label or metric).",
+			},
+			[]string{"policy", "kind"},
+		),
+		writeDigestFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "write_digest_failures_total",
+				Help:      "Total number of write requests rejected by the body digest check, by reason (mismatch or missing).",
+			},
+			[]string{"reason"},
+		),
+		writeIdempotency: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "write_idempotency_lookups_total",
+				Help:      "Total number of write requests looked up in the cache of -write-idempotency-ttl, by result: hit for identical requests committed before, waited_hit for those committed while waiting for them, and miss.",
+			},
+			[]string{"result"},
+		),
+		writesAbandoned: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "write_deadline_abandoned_total",
+				Help:      "Total number of writes abandoned at their deadline, by source of the deadline: header for the timeout told by the sender, send_timeout for -adapter-send-timeout.",
+			},
+			[]string{"deadline"},
+		),
+		tailStreams: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "admin_tail_streams",
+				Help:      "Number of open streams of the tail admin endpoint.",
+			},
+		),
+		tailDroppedSamples: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "admin_tail_dropped_samples_total",
+				Help:      "Total number of samples dropped by streams of the tail admin endpoint that fell behind.",
+			},
+		),
+		storageBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "storage_bytes_total",
+				Help:      "Size on disk of the tables written to, by object: values for the values table, labels for the label tables, indexes for the indexes of both. Measured every -storage-report-interval.",
+			},
+			[]string{"object"},
+		),
+		bytesPerSampleStored: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "bytes_per_sample_stored",
+				Help:      "Size on disk of the tables written to, indexes included, over the estimated number of samples in the values table.",
+			},
+		),
+		compressionRatio: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "compression_ratio",
+				Help:      "Size of the compressed chunks of the values hypertable before compression over their size after, 0 if no chunk is compressed.",
+			},
+		),
+		writeAmplification: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "write_amplification_ratio",
+				Help:      "Bytes per sample stored over the bytes per sample received on the wire since startup, compressed as sent.",
+			},
+		),
+		unknownPaths: newUnknownPathCounter(namespace, maxUnknownPaths),
+		connections:  newConnTracker(namespace),
+		gauges: []prometheus.Collector{
+			highestReceived.gauge(namespace, "highest_received_timestamp_seconds", "Highest sample timestamp received, clamped to the current time."),
+			highestWritten.gauge(namespace, "highest_written_timestamp_seconds", "Highest sample timestamp written to the remote storage, clamped to the current time."),
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "write_throughput_samples_per_second",
+					Help:      "Samples written to the remote storage per second, averaged over the last minute.",
+				},
+				writeThroughput.Rate,
+			),
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "write_decode_buffers_in_use",
+					Help:      "Number of pooled buffers holding decompressed write requests in use.",
+				},
+				func() float64 {
+					return float64(decodeBuffersInUse.Load())
+				},
+			),
+			prometheus.NewGaugeFunc(
+				prometheus.GaugeOpts{
+					Namespace: namespace,
+					Name:      "write_decode_buffer_in_use_bytes",
+					Help:      "Capacity in bytes of the pooled buffers holding decompressed write requests in use.",
+				},
+				func() float64 {
+					return float64(decodeBufferBytesInUse.Load())
+				},
+			),
+		},
+		registerer: prometheus.DefaultRegisterer,
+	}
+}
+
+// register registers the metrics with r, along with the metrics of the packages used in any case. The
+// metrics of the other packages are prefixed with the namespace of the adapter's metrics; collectors
+// registered later must go through m.registerer to get the prefix too.
+func (m *metrics) register(r prometheus.Registerer) {
+	r.MustRegister(
+		m.receivedSamples,
+		m.sentSamples,
+		m.failedSamples,
+		m.writeErrors,
+		m.sentBatchDuration,
+		m.httpRequestDuration,
+		m.dedupedSamples,
+		m.writeRequestCompressedBytes,
+		m.writeRequestDecompressedBytes,
+		m.writeDecodeDuration,
+		m.emptyWriteRequests,
+		m.unknownPaths.requests,
+		m.readQueries,
+		m.readQueryDuration,
+		m.readSamplesReturned,
+		m.configReloads,
+		m.configLastReloadSuccess,
+		m.adaptiveBatchSize,
+		m.lastSuccessfulWrite,
+		m.invalidNames,
+		m.writeDigestFailures,
+		m.writeIdempotency,
+		m.writesAbandoned,
+		m.tailStreams,
+		m.tailDroppedSamples,
+		m.storageBytes,
+		m.bytesPerSampleStored,
+		m.compressionRatio,
+		m.writeAmplification,
+	)
+	r.MustRegister(m.gauges...)
+	r.MustRegister(m.connections.collectors()...)
+
+	m.registerer = r
+	if m.namespace != "" {
+		m.registerer = prometheus.WrapRegistererWithPrefix(m.namespace+"_", r)
+	}
+	m.registerer.MustRegister(
+		pgprometheus.FailoverEvents,
+		pgprometheus.PasswordCommandFailures,
+		pgprometheus.OutOfOrderSamples,
+		pgprometheus.CompressedChunkSamples,
+		pgprometheus.UnknownSeriesSamples,
+		pgprometheus.InvalidSamples,
+		pgprometheus.InvalidUTF8Samples,
+		pgprometheus.ImpreciseSamples,
+		pgprometheus.StorageFull,
+		pgprometheus.ClockSkew,
+		pgprometheus.CircuitState,
+		pgprometheus.CommitDuration,
+		pgprometheus.WritePhaseDuration,
+		pgprometheus.VisibilityCheckDuration,
+		pgprometheus.VisibilityCheckFailures,
+		pgprometheus.SchemaLayout,
+		transform.RuleSamples,
+		quarantine.Errors,
+		deadletter.Requests,
+		deadletter.Errors,
+		gaps.Missing,
+		gaps.Untracked,
+		quota.Samples,
+		quota.NewSeries,
+		util.RetryAfterSeconds,
+		cardinality.SuppressedSamples,
+		cardinality.SuppressedMetrics,
+		writers.DownsampleInputSamples,
+		writers.DownsampleOutputSamples,
+		writers.DownsampleDroppedSamples,
+		writers.DownsampleBufferedSeries,
+		writers.TeeMirrorErrors,
+	)
+}
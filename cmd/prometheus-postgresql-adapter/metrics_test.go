@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+func gatheredNames(t *testing.T, registry *prometheus.Registry) map[string]bool {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	return names
+}
+
+func TestMetricsNamespace(t *testing.T) {
+	testCases := []struct {
+		namespace string
+		prefix    string
+	}{
+		{namespace: "", prefix: ""},
+		{namespace: "tsadapter", prefix: "tsadapter_"},
+	}
+	for _, c := range testCases {
+		t.Run(c.prefix, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			m := newMetrics(c.namespace)
+			m.register(registry)
+			// registered later, like the metrics of the election backends
+			m.registerer.MustRegister(util.LockReconnects)
+
+			names := gatheredNames(t, registry)
+			for _, name := range []string{"received_samples_total", "highest_received_timestamp_seconds", "write_throughput_samples_per_second", "database_failovers_total", "election_lock_reconnects_total"} {
+				if !names[c.prefix+name] {
+					t.Errorf("Expected %s%s to be registered, got %v", c.prefix, name, names)
+				}
+				if c.prefix != "" && names[name] {
+					t.Errorf("Expected %s not to be registered without prefix", name)
+				}
+			}
+		})
+	}
+}
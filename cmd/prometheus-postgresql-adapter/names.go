@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+// namePolicy is the -write-name-policy for label names and metric names that don't follow the Prometheus
+// naming rules.
+var namePolicy = util.NamePolicyAllow
+
+// Kinds of invalid names counted by the invalid names counter.
+const (
+	invalidNameLabel  = "label"
+	invalidNameMetric = "metric"
+)
+
+// applyNamePolicy applies the policy to the label names and metric names of the request, counting the
+// invalid names. With the reject policy, it returns an error naming the first invalid name; with the normalize
+// policy, it replaces the invalid names in place.
+func applyNamePolicy(m *metrics, policy string, req *prompb.WriteRequest) error {
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		invalid := false
+		for j := range ts.Labels {
+			l := &ts.Labels[j]
+			kind, name := invalidNameLabel, l.Name
+			valid := util.IsValidLabelName(l.Name)
+			if valid && l.Name == labels.MetricName {
+				kind, name = invalidNameMetric, l.Value
+				valid = util.IsValidMetricName(l.Value)
+			}
+			if valid {
+				continue
+			}
+			m.invalidNames.WithLabelValues(policy, kind).Inc()
+			switch policy {
+			case util.NamePolicyReject:
+				return fmt.Errorf("invalid %s name %q in series %s", kind, name, formatLabels(ts.Labels))
+			case util.NamePolicyNormalize:
+				if kind == invalidNameMetric {
+					l.Value = util.NormalizeMetricName(l.Value)
+				} else {
+					invalid = true
+				}
+			}
+		}
+		if invalid {
+			normalizeLabelNames(ts.Labels)
+		}
+	}
+	return nil
+}
+
+// normalizeLabelNames replaces the invalid label names of a series with util.NormalizeLabelNames.
+func normalizeLabelNames(seriesLabels []prompb.Label) {
+	names := make([]string, len(seriesLabels))
+	for i, l := range seriesLabels {
+		names[i] = l.Name
+	}
+	for i, name := range util.NormalizeLabelNames(names) {
+		seriesLabels[i].Name = name
+	}
+}
+
+// normalizeMatchers maps the label names of the matchers, and the metric names they match exactly, the way
+// the normalize policy maps the names of written series. Names that collided in a series can only be matched
+// by their util.CollisionLabelName.
+func normalizeMatchers(policy string, selectors [][]*labels.Matcher) [][]*labels.Matcher {
+	if policy != util.NamePolicyNormalize {
+		return selectors
+	}
+	normalized := make([][]*labels.Matcher, len(selectors))
+	for i, matchers := range selectors {
+		normalized[i] = make([]*labels.Matcher, len(matchers))
+		for j, matcher := range matchers {
+			name, value := util.NormalizeLabelName(matcher.Name), matcher.Value
+			if name == labels.MetricName && value != "" && (matcher.Type == labels.MatchEqual || matcher.Type == labels.MatchNotEqual) {
+				value = util.NormalizeMetricName(value)
+			}
+			if name == matcher.Name && value == matcher.Value {
+				normalized[i][j] = matcher
+				continue
+			}
+			normalized[i][j] = labels.MustNewMatcher(matcher.Type, name, value)
+		}
+	}
+	return normalized
+}
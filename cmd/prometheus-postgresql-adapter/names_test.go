@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+func TestApplyNamePolicy(t *testing.T) {
+	series := func() *prompb.WriteRequest {
+		return &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+			{Labels: []prompb.Label{{Name: "__name__", Value: "http.requests"}, {Name: "http.method", Value: "GET"}, {Name: "http_method", Value: "get"}, {Name: "job", Value: "a"}}},
+			{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "k8s-pod", Value: "p"}}},
+			{Labels: []prompb.Label{{Name: "__name__", Value: "node:cpu:rate5m"}, {Name: "job", Value: "b"}}},
+		}}
+	}
+	for _, c := range []struct {
+		policy   string
+		err      string
+		expected [][]prompb.Label
+	}{
+		{policy: util.NamePolicyAllow, expected: [][]prompb.Label{
+			{{Name: "__name__", Value: "http.requests"}, {Name: "http.method", Value: "GET"}, {Name: "http_method", Value: "get"}, {Name: "job", Value: "a"}},
+			{{Name: "__name__", Value: "up"}, {Name: "k8s-pod", Value: "p"}},
+			{{Name: "__name__", Value: "node:cpu:rate5m"}, {Name: "job", Value: "b"}},
+		}},
+		{policy: util.NamePolicyNormalize, expected: [][]prompb.Label{
+			{{Name: "__name__", Value: "http_requests"}, {Name: util.CollisionLabelName("http.method"), Value: "GET"}, {Name: "http_method", Value: "get"}, {Name: "job", Value: "a"}},
+			{{Name: "__name__", Value: "up"}, {Name: "k8s_pod", Value: "p"}},
+			{{Name: "__name__", Value: "node:cpu:rate5m"}, {Name: "job", Value: "b"}},
+		}},
+		{policy: util.NamePolicyReject, err: `invalid metric name "http.requests"`},
+	} {
+		t.Run(c.policy, func(t *testing.T) {
+			labelsBefore := testutil.ToFloat64(testMetrics.invalidNames.WithLabelValues(c.policy, invalidNameLabel))
+			metricsBefore := testutil.ToFloat64(testMetrics.invalidNames.WithLabelValues(c.policy, invalidNameMetric))
+			req := series()
+			err := applyNamePolicy(testMetrics, c.policy, req)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Errorf("Expected an error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, ts := range req.Timeseries {
+				if !reflect.DeepEqual(ts.Labels, c.expected[i]) {
+					t.Errorf("Series %d: expected %v, got %v", i, c.expected[i], ts.Labels)
+				}
+			}
+			if n := testutil.ToFloat64(testMetrics.invalidNames.WithLabelValues(c.policy, invalidNameLabel)) - labelsBefore; n != 2 {
+				t.Errorf("Expected 2 invalid label names to be counted, got %v", n)
+			}
+			if n := testutil.ToFloat64(testMetrics.invalidNames.WithLabelValues(c.policy, invalidNameMetric)) - metricsBefore; n != 1 {
+				t.Errorf("Expected 1 invalid metric name to be counted, got %v", n)
+			}
+		})
+	}
+}
+
+func TestWriteNamePolicy(t *testing.T) {
+	defer func() {
+		namePolicy = util.NamePolicyAllow
+	}()
+	body := encodeLabelSets(t, []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "service.name", Value: "api"}})
+
+	namePolicy = util.NamePolicyReject
+	writer := &fakeWriter{}
+	recorder := httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(body)))
+	if recorder.Code != http.StatusBadRequest || writer.calls != 0 {
+		t.Errorf("Expected the write to be rejected with 400, got %d and %d writes", recorder.Code, writer.calls)
+	}
+	if resp := decodeErrorResponse(t, recorder); !strings.Contains(resp.Error, `"service.name"`) {
+		t.Errorf("Expected the error to name the invalid label, got %q", resp.Error)
+	}
+
+	namePolicy = util.NamePolicyNormalize
+	writer = &fakeWriter{}
+	recorder = httptest.NewRecorder()
+	write(testMetrics, writer, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK || len(writer.samples) != 1 {
+		t.Fatalf("Expected the write to succeed, got %d and %d samples", recorder.Code, len(writer.samples))
+	}
+	if value, ok := writer.samples[0].Metric["service_name"]; !ok || value != "api" {
+		t.Errorf("Expected the label name to be normalized, got %v", writer.samples[0].Metric)
+	}
+}
+
+func TestNormalizeMatchers(t *testing.T) {
+	selectors := [][]*labels.Matcher{{
+		labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "http.requests"),
+		labels.MustNewMatcher(labels.MatchRegexp, "service.name", "api|web"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "job", "a.b"),
+	}}
+	if got := normalizeMatchers(util.NamePolicyAllow, selectors); !reflect.DeepEqual(got, selectors) {
+		t.Errorf("Expected the matchers to be kept with the allow policy, got %v", got)
+	}
+	got := normalizeMatchers(util.NamePolicyNormalize, selectors)
+	expected := []string{`__name__="http_requests"`, `service_name=~"api|web"`, `job!="a.b"`}
+	for i, matcher := range got[0] {
+		if matcher.String() != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], matcher)
+		}
+	}
+	if selectors[0][0].Value != "http.requests" {
+		t.Error("Expected the matchers given not to be modified")
+	}
+}
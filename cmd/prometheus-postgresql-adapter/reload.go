@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/gaps"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/quota"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/transform"
+)
+
+// reloadableFlags are the flags applied by a configuration reload on SIGHUP. Changes of the other flags,
+// eg. the connection settings, are ignored until a restart. Besides, a reload re-reads
+// -transform-rules-file, -quota-config-file, -gap-detection-config and -admin-api-token-file.
+var reloadableFlags = map[string]bool{
+	"log-level":                 true,
+	"query-max-labels":          true,
+	"query-max-series":          true,
+	"read-max-samples":          true,
+	"read-max-duration":         true,
+	"read-slow-query-threshold": true,
+	"admin-delete-batch-size":   true,
+	"admin-delete-batch-pause":  true,
+	"admin-api-token-file":      true,
+}
+
+// settings are the part of the configuration handlers read on each request. A reload replaces the whole
+// snapshot, which is never modified.
+type settings struct {
+	logLevel       string
+	queryMaxLabels int
+	readLimits     readLimits
+	deleteOptions  pgprometheus.DeleteOptions
+	// adminToken is the bearer token of the admin API, read from -admin-api-token-file
+	adminToken string
+}
+
+var currentSettings atomic.Pointer[settings]
+
+// newSettings validates the reloadable settings of cfg.
+func newSettings(cfg *config) (*settings, error) {
+	if err := log.ValidateLevel(cfg.logLevel); err != nil {
+		return nil, fmt.Errorf("invalid -log-level: %w", err)
+	}
+	s := &settings{
+		logLevel:       cfg.logLevel,
+		queryMaxLabels: cfg.queryMaxLabels,
+		readLimits:     cfg.readLimits(),
+		deleteOptions:  pgprometheus.DeleteOptions{BatchSize: cfg.deleteBatchSize, BatchPause: cfg.deleteBatchPause},
+	}
+	if !cfg.enableAdminAPI {
+		return s, nil
+	}
+	if cfg.deleteBatchSize <= 0 {
+		return nil, fmt.Errorf("-admin-delete-batch-size must be positive")
+	}
+	if cfg.adminTokenFile == "" {
+		return nil, fmt.Errorf("the admin API requires -admin-api-token-file")
+	}
+	token, err := os.ReadFile(cfg.adminTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading admin API token: %w", err)
+	}
+	s.adminToken = strings.TrimSpace(string(token))
+	if s.adminToken == "" {
+		return nil, fmt.Errorf("the admin API token in %s is empty", cfg.adminTokenFile)
+	}
+	return s, nil
+}
+
+// withSettings builds the handler from the current settings on each request, so that reloads apply to the
+// following requests.
+func withSettings(build func(s *settings) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		build(currentSettings.Load()).ServeHTTP(w, r)
+	})
+}
+
+// settingsAdminAuth is adminAuth with the token of the current settings.
+func settingsAdminAuth(handler http.Handler) http.Handler {
+	return withSettings(func(s *settings) http.Handler {
+		return adminAuth(s.adminToken, handler)
+	})
+}
+
+// reloader reloads the configuration file, applying the reloadable settings. The values given as flags or
+// environment variables are kept, as they take precedence over the file.
+type reloader struct {
+	m          *metrics
+	configFile string
+	// values are the effective values of the flags, except for changes waiting for a restart
+	values  map[string]string
+	sources map[string]string
+
+	transformer *transform.Engine
+	quotas      *quota.Engine
+	quotaFile   string
+	gaps        *gaps.Detector
+	gapsFile    string
+	deletions   *deleteJobs
+}
+
+func newReloader(fs *flag.FlagSet, cfg *config, m *metrics) *reloader {
+	r := &reloader{m: m, configFile: cfg.configFile, values: map[string]string{}, sources: map[string]string{}, quotaFile: cfg.quotaConfigFile, gapsFile: cfg.gapDetectionFile}
+	fs.VisitAll(func(f *flag.Flag) {
+		r.values[f.Name] = f.Value.String()
+	})
+	for name, source := range cfg.flagSources {
+		r.sources[name] = source
+	}
+	return r
+}
+
+// reload loads the configuration once more and applies the reloadable settings, if they are all valid. It
+// returns the flags applied and the changed flags ignored until a restart.
+func (r *reloader) reload() (changed []string, ignored []string, err error) {
+	cfg := &config{}
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineFlags(fs, cfg)
+	sources := map[string]string{}
+	for name, source := range r.sources {
+		if source != sourceFlag && source != sourceEnv {
+			continue
+		}
+		if err := fs.Set(name, r.values[name]); err != nil {
+			return nil, nil, err
+		}
+		sources[name] = source
+	}
+	if r.configFile != "" {
+		if err := loadConfigFile(fs, r.configFile, sources); err != nil {
+			return nil, nil, fmt.Errorf("error loading -%s %s: %w", configFileFlag, r.configFile, err)
+		}
+	}
+	// the admin API is only set up on start
+	cfg.enableAdminAPI = r.values["enable-admin-api"] == "true"
+	s, err := newSettings(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rules *transform.Rules
+	if r.transformer != nil {
+		if rules, err = transform.Load(r.transformer.Path()); err != nil {
+			return nil, nil, fmt.Errorf("error loading transformation rules: %w", err)
+		}
+	}
+	var quotaCfg *quota.Config
+	if r.quotas != nil {
+		if quotaCfg, err = quota.Load(r.quotaFile); err != nil {
+			return nil, nil, fmt.Errorf("error loading quota configuration: %w", err)
+		}
+	}
+	var gapsCfg *gaps.Config
+	if r.gaps != nil {
+		if gapsCfg, err = gaps.Load(r.gapsFile); err != nil {
+			return nil, nil, fmt.Errorf("error loading gap detection configuration: %w", err)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value == r.values[f.Name] {
+			return
+		}
+		if !reloadableFlags[f.Name] {
+			ignored = append(ignored, f.Name)
+			return
+		}
+		changed = append(changed, f.Name)
+		r.values[f.Name] = value
+	})
+	currentSettings.Store(s)
+	_ = log.SetLevel(s.logLevel)
+	if rules != nil {
+		r.transformer.SetRules(rules)
+	}
+	if quotaCfg != nil {
+		r.quotas.SetConfig(quotaCfg)
+	}
+	if gapsCfg != nil {
+		r.gaps.SetConfig(gapsCfg)
+	}
+	if r.deletions != nil {
+		r.deletions.setOptions(s.deleteOptions)
+	}
+	sort.Strings(changed)
+	sort.Strings(ignored)
+	return changed, ignored, nil
+}
+
+// handleReloads reloads the configuration on every SIGHUP.
+func (r *reloader) handleReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		r.reloadAndReport()
+	}
+}
+
+// reloadAndReport reloads the configuration, logging and counting the outcome. A configuration that fails to
+// load or to validate leaves the current one active.
+func (r *reloader) reloadAndReport() {
+	changed, ignored, err := r.reload()
+	if err != nil {
+		r.m.configReloads.WithLabelValues("failure").Inc()
+		log.Error("msg", "Error reloading the configuration, keeping the current one", "err", err)
+		return
+	}
+	r.m.configReloads.WithLabelValues("success").Inc()
+	r.m.configLastReloadSuccess.SetToCurrentTime()
+	log.Info("msg", "Reloaded the configuration", "changed", strings.Join(changed, ","))
+	if len(ignored) > 0 {
+		log.Warn("msg", "Changed settings take effect on the next restart only", "ignored", strings.Join(ignored, ","))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// loadTestConfig parses args and the configuration file they name like parseFlags, and makes the settings
+// current.
+func loadTestConfig(t *testing.T, args []string) (*flag.FlagSet, *config) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg := &config{}
+	defineFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	cfg.flagSources = recordFlagSources(fs, args, nil)
+	if cfg.configFile != "" {
+		if err := loadConfigFile(fs, cfg.configFile, cfg.flagSources); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := newSettings(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := currentSettings.Swap(s)
+	t.Cleanup(func() {
+		currentSettings.Store(previous)
+		log.Init("debug")
+	})
+	return fs, cfg
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenPath, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfigFile(t, "query_max_series: 100\nenable_admin_api: true\nadmin_api_token_file: "+tokenPath+"\n")
+	fs, cfg := loadTestConfig(t, []string{"-config-file", path, "-query-max-labels", "7"})
+	m := newMetrics("")
+	r := newReloader(fs, cfg, m)
+	handler := settingsAdminAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	authorized := func(token string) bool {
+		req := httptest.NewRequest("GET", "/admin/config", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code == http.StatusOK
+	}
+	if !authorized("first") {
+		t.Fatal("Expected the initial token to be accepted")
+	}
+
+	// flags take precedence over the file, the listen address needs a restart
+	if err := os.WriteFile(tokenPath, []byte("second\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	content := "query_max_series: 50\nquery_max_labels: 9\nlog_level: warn\nenable_admin_api: true\nadmin_api_token_file: " + tokenPath + "\nweb:\n  listen_address: \":9300\"\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	changed, ignored, err := r.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"log-level", "query-max-series"}) || !reflect.DeepEqual(ignored, []string{"web-listen-address"}) {
+		t.Errorf("Unexpected changed %v and ignored %v settings", changed, ignored)
+	}
+	s := currentSettings.Load()
+	if s.readLimits.maxSeries != 50 || s.queryMaxLabels != 7 || s.logLevel != "warn" {
+		t.Errorf("Unexpected settings %+v", s)
+	}
+	if authorized("first") || !authorized("second") {
+		t.Error("Expected the reloaded token to replace the initial one")
+	}
+
+	// an invalid file keeps the current settings
+	if err := os.WriteFile(path, []byte("query_max_series: 10\nlog_level: verbose\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.reload(); err == nil {
+		t.Fatal("Expected an invalid log level to fail the reload")
+	}
+	if currentSettings.Load() != s {
+		t.Error("Expected a failed reload to keep the current settings")
+	}
+	if err := os.WriteFile(path, []byte("enable_admin_api: true\nadmin_api_token_file: "+filepath.Join(dir, "missing")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.reload(); err == nil {
+		t.Fatal("Expected a missing admin token to fail the reload")
+	}
+	if currentSettings.Load() != s || !authorized("second") {
+		t.Error("Expected a failed reload to keep the current token")
+	}
+}
+
+func TestWithSettings(t *testing.T) {
+	loadTestConfig(t, []string{"-query-max-labels", "1"})
+	var limits []int
+	handler := withSettings(func(s *settings) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limits = append(limits, s.queryMaxLabels)
+		})
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/labels", nil))
+	currentSettings.Store(&settings{queryMaxLabels: 2})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/labels", nil))
+	if !reflect.DeepEqual(limits, []int{1, 2}) {
+		t.Errorf("Expected each request to see the current settings, got %v", limits)
+	}
+}
+
+func TestReloadMetrics(t *testing.T) {
+	path := writeConfigFile(t, "log_level: info\n")
+	fs, cfg := loadTestConfig(t, []string{"-config-file", path})
+	m := newMetrics("")
+	r := newReloader(fs, cfg, m)
+
+	r.reloadAndReport()
+	if n := testutil.ToFloat64(m.configReloads.WithLabelValues("success")); n != 1 {
+		t.Errorf("Expected 1 successful reload, got %v", n)
+	}
+	succeeded := testutil.ToFloat64(m.configLastReloadSuccess)
+	if succeeded == 0 {
+		t.Error("Expected the time of the successful reload to be recorded")
+	}
+
+	if err := os.WriteFile(path, []byte("log_level: loud\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r.reloadAndReport()
+	if n := testutil.ToFloat64(m.configReloads.WithLabelValues("failure")); n != 1 {
+		t.Errorf("Expected 1 failed reload, got %v", n)
+	}
+	if testutil.ToFloat64(m.configLastReloadSuccess) != succeeded {
+		t.Error("Expected a failed reload not to update the time of the last successful one")
+	}
+}
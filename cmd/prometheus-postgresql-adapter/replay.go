@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/deadletter"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// replayedSuffix is appended to the name of the files replayed without -delete.
+const replayedSuffix = ".replayed"
+
+// replayConfig configures the replay subcommand.
+type replayConfig struct {
+	url      string
+	rate     float64
+	delete   bool
+	timeout  time.Duration
+	logLevel string
+	pg       pgprometheus.Config
+	files    []string
+}
+
+func parseReplayFlags(args []string) (*replayConfig, error) {
+	cfg := &replayConfig{}
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: prometheus-postgresql-adapter replay [flags] file...")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&cfg.url, "url", "", "Remote write URL of a running adapter (eg. http://localhost:9201/write). If empty, samples are written to the database configured by the -pg-* flags directly.")
+	fs.Float64Var(&cfg.rate, "rate", 0, "Samples per second to send (0 means as fast as possible).")
+	fs.BoolVar(&cfg.delete, "delete", false, "Delete the files replayed successfully instead of renaming them with the "+replayedSuffix+" suffix.")
+	fs.DurationVar(&cfg.timeout, "timeout", 30*time.Second, "Timeout of each write request.")
+	fs.StringVar(&cfg.logLevel, "log-level", "info", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
+	pgprometheus.RegisterFlags(fs, "pg", &cfg.pg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.files = fs.Args()
+	switch {
+	case len(cfg.files) == 0:
+		return nil, fmt.Errorf("no file to replay given")
+	case cfg.rate < 0:
+		return nil, fmt.Errorf("-rate must not be negative")
+	case cfg.timeout <= 0:
+		return nil, fmt.Errorf("-timeout must be positive")
+	}
+	return cfg, nil
+}
+
+// runReplay runs the replay subcommand, which sends the write requests of dead letter files to an adapter or
+// to the database. It returns the exit code.
+func runReplay(args []string) int {
+	cfg, err := parseReplayFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log.Init(cfg.logLevel)
+
+	var writer writers.Writer
+	if cfg.url != "" {
+		writer = &remoteWriter{url: cfg.url, client: &http.Client{Timeout: cfg.timeout}}
+	} else {
+		client, err := pgprometheus.NewClient(&cfg.pg)
+		if err != nil {
+			log.Error("msg", "Error creating the database client", "err", err)
+			return 1
+		}
+		defer client.Close()
+		if err := client.EnsureSchema(); err != nil {
+			log.Error("msg", "Error setting up the schema", "err", err)
+			return 1
+		}
+		writer = client
+	}
+	for _, file := range cfg.files {
+		if err := replayFile(context.Background(), cfg, writer, file, os.Stdout); err != nil {
+			log.Error("msg", "Error replaying, the file is kept", "file", file, "err", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// replayResult sums up the replay of a file.
+type replayResult struct {
+	requests int
+	samples  int
+	written  int
+	corrupt  int
+}
+
+// replayFile sends the write requests of a dead letter file in order, paced to cfg.rate, and prints a
+// summary to out. The file is renamed, or deleted with -delete, once all requests were sent; it stays in
+// place if a write fails, so that it can be replayed again.
+func replayFile(ctx context.Context, cfg *replayConfig, writer writers.Writer, file string, out io.Writer) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	var result replayResult
+	start := time.Now()
+	header, corrupt, err := deadletter.Read(f, func(req *prompb.WriteRequest) error {
+		series := pgprometheus.SeriesFromRequest(req)
+		samples := 0
+		for _, s := range series {
+			samples += len(s.Samples)
+		}
+		if cfg.rate > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(result.samples) / cfg.rate * float64(time.Second)))))
+		}
+		writeCtx, cancel := context.WithTimeout(ctx, cfg.timeout)
+		stats, err := pgprometheus.WriteSeries(writeCtx, writer, series)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("error sending request %d: %w", result.requests+1, err)
+		}
+		result.requests++
+		result.samples += samples
+		result.written += stats.Written
+		log.Debug("msg", "Replayed a write request", "file", file, "request", result.requests, "samples", samples)
+		return nil
+	})
+	_ = f.Close()
+	result.corrupt = corrupt
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: %d requests with %d samples replayed, %d samples written, %d corrupt entries skipped (written by %s at %s)\n",
+		file, result.requests, result.samples, result.written, result.corrupt, header.Version, header.Created.Format(time.RFC3339))
+	if cfg.delete {
+		return os.Remove(file)
+	}
+	return os.Rename(file, file+replayedSuffix)
+}
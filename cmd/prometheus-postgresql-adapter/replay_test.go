@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/deadletter"
+)
+
+func writeDeadLetterFile(t *testing.T, data []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "deadletter-20261016-12"+deadletter.FileSuffix)
+	if err := os.WriteFile(file, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func deadLetterFile(t *testing.T, requests ...*prompb.WriteRequest) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := deadletter.Write(&buf, deadletter.Header{Version: "0.4.1", Created: time.Now()}, requests...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReplayFile(t *testing.T) {
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node"}, Value: 1, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "other"}, Value: 0, Timestamp: 1000},
+	}
+	// a truncated entry after the two requests
+	data := append(deadLetterFile(t, samplesToProto(samples[:1]), samplesToProto(samples[1:])), 0, 0, 0)
+
+	file := writeDeadLetterFile(t, data)
+	writer := &fakeWriter{}
+	var out bytes.Buffer
+	if err := replayFile(context.Background(), &replayConfig{timeout: time.Second}, writer, file, &out); err != nil {
+		t.Fatal(err)
+	}
+	if writer.calls != 2 || !writer.samples.Equal(samples) {
+		t.Errorf("Expected %v to be written in 2 requests, got %v in %d", samples, writer.samples, writer.calls)
+	}
+	if summary := out.String(); !strings.Contains(summary, "2 requests with 2 samples replayed") || !strings.Contains(summary, "1 corrupt entries") {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+	if _, err := os.Stat(file + replayedSuffix); err != nil {
+		t.Errorf("Expected the file to be renamed: %v", err)
+	}
+
+	file = writeDeadLetterFile(t, data)
+	if err := replayFile(context.Background(), &replayConfig{timeout: time.Second, delete: true}, &fakeWriter{}, file, &out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be deleted, got %v", err)
+	}
+
+	// a failed write keeps the file
+	file = writeDeadLetterFile(t, data)
+	writer = &fakeWriter{err: errors.New("connection refused")}
+	if err := replayFile(context.Background(), &replayConfig{timeout: time.Second}, writer, file, &out); err == nil {
+		t.Error("Expected the replay to fail")
+	}
+	if writer.calls != 1 {
+		t.Errorf("Expected the replay to stop at the failed write, got %d calls", writer.calls)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected the file to be kept: %v", err)
+	}
+}
+
+func TestParseReplayFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{{}, {"-rate", "-1", "a.dl"}, {"-timeout", "0", "a.dl"}, {"-unknown", "a.dl"}} {
+		if _, err := parseReplayFlags(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
+
+// TestWriteDeadLetter checks that the writes rejected as invalid are kept in the dead letter directory, and
+// those failing with a retryable error aren't.
+func TestWriteDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	var err error
+	if deadLetters, err = deadletter.NewDir(dir, 0, version); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		deadLetters = nil
+	}()
+	req := samplesToProto(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1, Timestamp: 1000}})
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, writeErr := range []error{&pgconn.PgError{Code: "08006"}, &pgconn.PgError{Code: "22003"}} {
+		recorder := httptest.NewRecorder()
+		write(testMetrics, &fakeWriter{err: writeErr}, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+		if recorder.Code == http.StatusOK {
+			t.Fatalf("Expected the write to fail with %v", writeErr)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+deadletter.FileSuffix))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 dead letter file, got %v and %v", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var kept []*prompb.WriteRequest
+	if _, _, err := deadletter.Read(f, func(r *prompb.WriteRequest) error {
+		kept = append(kept, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || !protoToSamples(kept[0]).Equal(protoToSamples(req)) {
+		t.Errorf("Expected only the invalid write to be kept, got %v", kept)
+	}
+}
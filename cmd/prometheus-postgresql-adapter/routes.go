@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+const (
+	// maxUnknownPaths is the number of distinct unknown paths counted by path, later ones are counted as
+	// unknownPathOther.
+	maxUnknownPaths   = 100
+	maxUnknownPathLen = 64
+	unknownPathOther  = "other"
+)
+
+// boundedValues passes the first limit distinct values through and maps later ones to other, to keep the
+// cardinality of a label bounded.
+type boundedValues struct {
+	limit int
+	other string
+
+	mutex sync.Mutex
+	seen  map[string]bool
+}
+
+func newBoundedValues(limit int, other string) *boundedValues {
+	return &boundedValues{limit: limit, other: other, seen: map[string]bool{}}
+}
+
+func (b *boundedValues) value(v string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.seen[v] {
+		if len(b.seen) >= b.limit {
+			return b.other
+		}
+		b.seen[v] = true
+	}
+	return v
+}
+
+// unknownPathCounter counts the requests to paths without handler, such as scans. The first paths seen get
+// their own label value, to keep the cardinality bounded.
+type unknownPathCounter struct {
+	requests *prometheus.CounterVec
+	paths    *boundedValues
+}
+
+func newUnknownPathCounter(namespace string, limit int) *unknownPathCounter {
+	return &unknownPathCounter{
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "unknown_path_requests_total",
+				Help:      "Total number of requests to paths without handler, by path. Paths seen after the first ones are counted as \"other\".",
+			},
+			[]string{"path"},
+		),
+		paths: newBoundedValues(limit, unknownPathOther),
+	}
+}
+
+// label returns the label value the path is counted under.
+func (u *unknownPathCounter) label(path string) string {
+	if len(path) > maxUnknownPathLen {
+		path = path[:maxUnknownPathLen]
+	}
+	return u.paths.value(path)
+}
+
+// handler is the catch-all handler of the mux: it serves root on "/", if set, and replies 404 to any other
+// path.
+func (u *unknownPathCounter) handler(root http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && root != nil {
+			root.ServeHTTP(w, r)
+			return
+		}
+		u.requests.WithLabelValues(u.label(r.URL.Path)).Inc()
+		util.WriteError(w, http.StatusNotFound, util.ErrCodeNotFound, "not found", nil)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+func TestUnknownPaths(t *testing.T) {
+	counter := newUnknownPathCounter("", 2)
+	root := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("status"))
+	})
+	handler := counter.handler(root)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "status" {
+		t.Errorf("Expected the root handler to serve /, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	long := "/" + strings.Repeat("x", 100)
+	for _, path := range []string{"/wp-login.php", "/.env", "/wp-login.php", long, long + "y", "/"} {
+		recorder := httptest.NewRecorder()
+		if path == "/" {
+			counter.handler(nil).ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		} else {
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		}
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", path, recorder.Code)
+		}
+		if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeNotFound {
+			t.Errorf("Expected code %q, got %q", util.ErrCodeNotFound, resp.Code)
+		}
+	}
+	expected := map[string]float64{"/wp-login.php": 2, "/.env": 1, unknownPathOther: 3}
+	if n := testutil.CollectAndCount(counter.requests); n != len(expected) {
+		t.Errorf("Expected %d paths to be counted, got %d", len(expected), n)
+	}
+	for path, count := range expected {
+		if actual := testutil.ToFloat64(counter.requests.WithLabelValues(path)); actual != count {
+			t.Errorf("Expected %v requests to %s, got %v", count, path, actual)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// checkListenAddresses fails if the telemetry listen address would collide with the main one, which is the
+// case for the same port on the same host or on all interfaces.
+func checkListenAddresses(listenAddr, telemetryAddr string) error {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", listenAddr, err)
+	}
+	telemetryHost, telemetryPort, err := net.SplitHostPort(telemetryAddr)
+	if err != nil {
+		return fmt.Errorf("invalid telemetry listen address %q: %w", telemetryAddr, err)
+	}
+	if port != telemetryPort || port == "0" {
+		return nil
+	}
+	if host == telemetryHost || allInterfaces(host) || allInterfaces(telemetryHost) {
+		return fmt.Errorf("the telemetry listen address %q collides with the listen address %q", telemetryAddr, listenAddr)
+	}
+	return nil
+}
+
+func allInterfaces(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// listen binds the addresses of the servers, so that startup fails before any of them serves if one can't.
+func listen(servers []*http.Server) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(servers))
+	for _, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		log.Info("msg", "Listening", "addr", listener.Addr().String())
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// serve runs the servers on their listeners until they are shut down, returning the first error of a server
+// failing otherwise.
+func serve(servers []*http.Server, listeners []net.Listener) error {
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(servers[i], listeners[i])
+	}
+	for range servers {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdown gracefully shuts the servers down in parallel, waiting for in-flight requests until ctx is done.
+func shutdown(ctx context.Context, servers []*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	var err error
+	for range servers {
+		err = errors.Join(err, <-errs)
+	}
+	return err
+}
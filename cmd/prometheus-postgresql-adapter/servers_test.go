@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckListenAddresses(t *testing.T) {
+	for _, c := range []struct {
+		listen, telemetry string
+		collide           bool
+	}{
+		{listen: ":9201", telemetry: ":9202", collide: false},
+		{listen: ":9201", telemetry: ":9201", collide: true},
+		{listen: ":9201", telemetry: "127.0.0.1:9201", collide: true},
+		{listen: "0.0.0.0:9201", telemetry: "10.0.0.1:9201", collide: true},
+		{listen: "[::]:9201", telemetry: "localhost:9201", collide: true},
+		{listen: "10.0.0.1:9201", telemetry: "127.0.0.1:9201", collide: false},
+		{listen: "127.0.0.1:0", telemetry: "127.0.0.1:0", collide: false},
+	} {
+		err := checkListenAddresses(c.listen, c.telemetry)
+		if (err != nil) != c.collide {
+			t.Errorf("%s and %s: expected collision %v, got %v", c.listen, c.telemetry, c.collide, err)
+		}
+	}
+	if err := checkListenAddresses(":9201", "9202"); err == nil {
+		t.Error("Expected an error for an address without port")
+	}
+}
+
+func TestServeTelemetrySeparately(t *testing.T) {
+	mux, telemetryMux := http.NewServeMux(), http.NewServeMux()
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {})
+	telemetryMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {})
+	servers := []*http.Server{{Addr: "127.0.0.1:0", Handler: mux}, {Addr: "127.0.0.1:0", Handler: telemetryMux}}
+	listeners, err := listen(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- serve(servers, listeners)
+	}()
+
+	for i, c := range []struct {
+		path   string
+		status [2]int
+	}{
+		{path: "/write", status: [2]int{http.StatusOK, http.StatusNotFound}},
+		{path: "/metrics", status: [2]int{http.StatusNotFound, http.StatusOK}},
+	} {
+		for j, listener := range listeners {
+			resp, err := http.Get("http://" + listener.Addr().String() + c.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != c.status[j] {
+				t.Errorf("Case %d: expected status %d for %s on server %d, got %d", i, c.status[j], c.path, j, resp.StatusCode)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := shutdown(ctx, servers); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected the servers to stop without error, got %v", err)
+	}
+}
+
+func TestListenFailsOnTakenAddress(t *testing.T) {
+	taken, err := listen([]*http.Server{{Addr: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken[0].Close()
+	first := &http.Server{Addr: "127.0.0.1:0"}
+	if _, err := listen([]*http.Server{first, {Addr: taken[0].Addr().String()}}); err == nil {
+		t.Fatal("Expected listening on a taken address to fail")
+	}
+}
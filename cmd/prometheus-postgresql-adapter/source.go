@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/common/model"
+)
+
+// Where the value of the source label comes from.
+const (
+	sourceFromHeader   = "header"
+	sourceFromClientIP = "client-ip"
+	sourceFromStatic   = "static"
+)
+
+// What happens to samples that already have the source label.
+const (
+	sourceCollisionKeep      = "keep"
+	sourceCollisionOverwrite = "overwrite"
+)
+
+const (
+	defaultSourceHeader = "X-Prometheus-Remote-Write-Source"
+	// maxSourceValues is the number of distinct sources counted by source in the sent and failed samples
+	// counters, later ones are counted as sourceOther.
+	maxSourceValues = 100
+	sourceOther     = "other"
+)
+
+// sourceLabeler adds a label identifying the sender of a write request to its samples, so that the label is
+// part of the identity of the series.
+type sourceLabeler struct {
+	label     model.LabelName
+	from      string
+	header    string
+	static    string
+	overwrite bool
+	counted   *boundedValues
+}
+
+func newSourceLabeler(cfg *config) (*sourceLabeler, error) {
+	s := &sourceLabeler{
+		label:   model.LabelName(cfg.sourceLabel),
+		from:    cfg.sourceFrom,
+		header:  http.CanonicalHeaderKey(cfg.sourceHeader),
+		static:  cfg.sourceStatic,
+		counted: newBoundedValues(maxSourceValues, sourceOther),
+	}
+	if !s.label.IsValid() || s.label == model.MetricNameLabel {
+		return nil, fmt.Errorf("invalid source label name %q", cfg.sourceLabel)
+	}
+	switch cfg.sourceFrom {
+	case sourceFromHeader:
+		if s.header == "" {
+			return nil, fmt.Errorf("the source header must be set")
+		}
+	case sourceFromClientIP:
+	case sourceFromStatic:
+		if s.static == "" {
+			return nil, fmt.Errorf("the static source must be set")
+		}
+	default:
+		return nil, fmt.Errorf("unknown source %q, expected %q, %q or %q", cfg.sourceFrom, sourceFromHeader, sourceFromClientIP, sourceFromStatic)
+	}
+	switch cfg.sourceCollision {
+	case sourceCollisionKeep:
+	case sourceCollisionOverwrite:
+		s.overwrite = true
+	default:
+		return nil, fmt.Errorf("unknown source collision policy %q, expected %q or %q", cfg.sourceCollision, sourceCollisionKeep, sourceCollisionOverwrite)
+	}
+	return s, nil
+}
+
+// source returns the source of the request, empty if the request doesn't tell.
+func (s *sourceLabeler) source(r *http.Request) string {
+	switch s.from {
+	case sourceFromHeader:
+		return r.Header.Get(s.header)
+	case sourceFromClientIP:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	default:
+		return s.static
+	}
+}
+
+// inject sets the source label of the samples, keeping or overwriting a label of the same name of a sample
+// according to the collision policy. Without source, the samples are left alone.
+func (s *sourceLabeler) inject(samples model.Samples, source string) {
+	if source == "" {
+		return
+	}
+	value := model.LabelValue(source)
+	for _, sample := range samples {
+		if _, ok := sample.Metric[s.label]; ok && !s.overwrite {
+			continue
+		}
+		sample.Metric[s.label] = value
+	}
+}
+
+// counterValue returns the value of the source label of the sent and failed samples counters.
+func (s *sourceLabeler) counterValue(source string) string {
+	if s == nil {
+		return ""
+	}
+	return s.counted.value(source)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func sourceConfig(from string, collision string) *config {
+	return &config{sourceLabel: "ingest_source", sourceFrom: from, sourceHeader: defaultSourceHeader, sourceStatic: "static-a", sourceCollision: collision}
+}
+
+func TestNewSourceLabelerErrors(t *testing.T) {
+	for name, cfg := range map[string]*config{
+		"invalid label":     {sourceLabel: "ingest-source", sourceFrom: sourceFromClientIP, sourceCollision: sourceCollisionKeep},
+		"metric name label": {sourceLabel: "__name__", sourceFrom: sourceFromClientIP, sourceCollision: sourceCollisionKeep},
+		"unknown source":    {sourceLabel: "ingest_source", sourceFrom: "cookie", sourceCollision: sourceCollisionKeep},
+		"missing header":    {sourceLabel: "ingest_source", sourceFrom: sourceFromHeader, sourceCollision: sourceCollisionKeep},
+		"missing static":    {sourceLabel: "ingest_source", sourceFrom: sourceFromStatic, sourceCollision: sourceCollisionKeep},
+		"unknown collision": {sourceLabel: "ingest_source", sourceFrom: sourceFromClientIP, sourceCollision: "merge"},
+	} {
+		if _, err := newSourceLabeler(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSourceLabelerSource(t *testing.T) {
+	r := httptest.NewRequest("POST", "/write", nil)
+	r.RemoteAddr = "10.1.2.3:41234"
+	r.Header.Set(defaultSourceHeader, "prom-a")
+	for from, expected := range map[string]string{sourceFromHeader: "prom-a", sourceFromClientIP: "10.1.2.3", sourceFromStatic: "static-a"} {
+		s, err := newSourceLabeler(sourceConfig(from, sourceCollisionKeep))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source := s.source(r); source != expected {
+			t.Errorf("%s: expected source %q, got %q", from, expected, source)
+		}
+	}
+}
+
+func TestSourceLabelerInject(t *testing.T) {
+	for collision, expected := range map[string]model.LabelValue{sourceCollisionKeep: "own", sourceCollisionOverwrite: "prom-a"} {
+		s, err := newSourceLabeler(sourceConfig(sourceFromHeader, collision))
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := model.Samples{
+			{Metric: model.Metric{model.MetricNameLabel: "up"}},
+			{Metric: model.Metric{model.MetricNameLabel: "up", "ingest_source": "own"}},
+		}
+		s.inject(samples, "prom-a")
+		if value := samples[0].Metric["ingest_source"]; value != "prom-a" {
+			t.Errorf("%s: expected the source to be added, got %q", collision, value)
+		}
+		if value := samples[1].Metric["ingest_source"]; value != expected {
+			t.Errorf("%s: expected the colliding label to be %q, got %q", collision, expected, value)
+		}
+		unlabelled := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}}}
+		s.inject(unlabelled, "")
+		if _, ok := unlabelled[0].Metric["ingest_source"]; ok {
+			t.Errorf("%s: expected no label without source", collision)
+		}
+	}
+}
+
+func TestWriteSourceLabel(t *testing.T) {
+	var err error
+	if sources, err = newSourceLabeler(sourceConfig(sourceFromHeader, sourceCollisionKeep)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sources = nil
+	}()
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 1, Timestamp: 2}}},
+	}}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := testutil.ToFloat64(testMetrics.sentSamples.WithLabelValues("fake", "prom-a"))
+	writer := &fakeWriter{}
+	httpReq := httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data)))
+	httpReq.Header.Set(defaultSourceHeader, "prom-a")
+	write(testMetrics, writer, false).ServeHTTP(httptest.NewRecorder(), httpReq)
+	for _, s := range writer.samples {
+		if s.Metric["ingest_source"] != "prom-a" {
+			t.Errorf("Expected the sample to carry its source, got %v", s.Metric)
+		}
+	}
+	if n := testutil.ToFloat64(testMetrics.sentSamples.WithLabelValues("fake", "prom-a")) - sent; n != 2 {
+		t.Errorf("Expected 2 samples to be counted for the source, got %v", n)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+)
+
+// Objects of the storage report
+const (
+	storageObjectValues  = "values"
+	storageObjectLabels  = "labels"
+	storageObjectIndexes = "indexes"
+)
+
+// storageReportJitter is the fraction of the interval by which each report is delayed at most, so that
+// adapters started together don't query the catalog at the same time.
+const storageReportJitter = 0.1
+
+// storageReporter measures the size of the tables every interval and relates it to the bytes received on
+// the wire, for capacity planning.
+type storageReporter struct {
+	interval time.Duration
+	timeout  time.Duration
+	measure  func(ctx context.Context, timeout time.Duration) (pgprometheus.StorageReport, error)
+	m        *metrics
+}
+
+// run reports every interval, give or take the jitter, forever.
+func (r *storageReporter) run() {
+	for {
+		time.Sleep(r.interval + time.Duration(rand.Float64()*storageReportJitter*float64(r.interval)))
+		r.update()
+	}
+}
+
+func (r *storageReporter) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	report, err := r.measure(ctx, r.timeout)
+	if err != nil {
+		log.Warn("msg", "Error measuring the size of the tables, keeping the previous report", "err", err)
+		return
+	}
+	r.m.storageBytes.WithLabelValues(storageObjectValues).Set(float64(report.ValuesBytes))
+	r.m.storageBytes.WithLabelValues(storageObjectLabels).Set(float64(report.LabelsBytes))
+	r.m.storageBytes.WithLabelValues(storageObjectIndexes).Set(float64(report.IndexBytes))
+	if report.Samples > 0 {
+		stored := float64(report.TotalBytes()) / float64(report.Samples)
+		r.m.bytesPerSampleStored.Set(stored)
+		wireBytes, received := collectedSum(r.m.writeRequestCompressedBytes), collectedSum(r.m.receivedSamples)
+		if wireBytes > 0 && received > 0 {
+			r.m.writeAmplification.Set(stored / (wireBytes / received))
+		}
+	}
+	r.m.compressionRatio.Set(report.CompressionRatio)
+	log.Debug("msg", "Measured the size of the tables", "bytes", report.TotalBytes(), "samples", report.Samples, "compression_ratio", report.CompressionRatio)
+}
+
+// collectedSum returns the sum of the values of a collector of counters, or of the observations of a
+// collector of histograms.
+func collectedSum(c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	sum := 0.0
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			continue
+		}
+		sum += m.GetCounter().GetValue() + m.GetHistogram().GetSampleSum()
+	}
+	return sum
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+)
+
+func TestStorageReporter(t *testing.T) {
+	m := newMetrics("")
+	m.writeRequestCompressedBytes.WithLabelValues(encodingSnappy).Observe(600)
+	m.writeRequestCompressedBytes.WithLabelValues(encodingGzip).Observe(400)
+	m.receivedSamples.Add(500)
+	report := pgprometheus.StorageReport{ValuesBytes: 8000, LabelsBytes: 1000, IndexBytes: 1000, Samples: 1000, CompressionRatio: 12.5}
+	var err error
+	r := &storageReporter{interval: time.Minute, timeout: time.Second, m: m, measure: func(ctx context.Context, timeout time.Duration) (pgprometheus.StorageReport, error) {
+		return report, err
+	}}
+	r.update()
+
+	for object, expected := range map[string]float64{storageObjectValues: 8000, storageObjectLabels: 1000, storageObjectIndexes: 1000} {
+		if v := testutil.ToFloat64(m.storageBytes.WithLabelValues(object)); v != expected {
+			t.Errorf("Expected %v bytes of %s, got %v", expected, object, v)
+		}
+	}
+	// 10 bytes stored per sample, 2 bytes received per sample
+	if v := testutil.ToFloat64(m.bytesPerSampleStored); v != 10 {
+		t.Errorf("Expected 10 bytes per sample stored, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.writeAmplification); v != 5 {
+		t.Errorf("Expected a write amplification of 5, got %v", v)
+	}
+	if v := testutil.ToFloat64(m.compressionRatio); v != 12.5 {
+		t.Errorf("Expected a compression ratio of 12.5, got %v", v)
+	}
+
+	// a failed measurement keeps the previous report
+	err = errors.New("canceling statement due to statement timeout")
+	report = pgprometheus.StorageReport{}
+	r.update()
+	if v := testutil.ToFloat64(m.storageBytes.WithLabelValues(storageObjectValues)); v != 8000 {
+		t.Errorf("Expected the previous report to be kept, got %v", v)
+	}
+}
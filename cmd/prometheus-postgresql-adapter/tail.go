@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+const (
+	tailPath = "/admin/tail"
+	// tailDefaultLimit is the number of samples streamed by the tail endpoint without limit parameter.
+	tailDefaultLimit = 100
+	// tailBuffer is the number of samples a tap holds for its stream, beyond which it drops them.
+	tailBuffer = 1000
+)
+
+// Reasons of the end of a tail stream
+const (
+	tailEndLimit    = "limit"
+	tailEndDuration = "duration"
+	tailEndClient   = "client"
+)
+
+var errTooManyTaps = errors.New("too many taps")
+
+// taps are the taps of the write pipeline, nil unless the admin API or gap detection is enabled.
+var taps *tapRegistry
+
+// sampleTap receives the samples of the write pipeline matching any of its selectors.
+type sampleTap struct {
+	selectors [][]*labels.Matcher
+	samples   chan *model.Sample
+	dropped   atomic.Int64
+}
+
+func newSampleTap(selectors [][]*labels.Matcher, buffer int) *sampleTap {
+	return &sampleTap{selectors: selectors, samples: make(chan *model.Sample, buffer)}
+}
+
+// observe passes copies of the matching samples to the tap, dropping them if its buffer is full, so that a
+// slow reader never holds up writes.
+func (t *sampleTap) observe(samples model.Samples) {
+	for _, s := range samples {
+		if !t.matches(s.Metric) {
+			continue
+		}
+		if len(t.samples) == cap(t.samples) {
+			t.dropped.Add(1)
+			continue
+		}
+		select {
+		case t.samples <- &model.Sample{Metric: s.Metric.Clone(), Value: s.Value, Timestamp: s.Timestamp}:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
+
+func (t *sampleTap) matches(metric model.Metric) bool {
+	for _, selector := range t.selectors {
+		matches := true
+		for _, m := range selector {
+			if !m.Matches(string(metric[model.LabelName(m.Name)])) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleObserver is attached to the write pipeline for good, eg. the gap detector.
+type sampleObserver interface {
+	Observe(samples model.Samples)
+}
+
+// tapRegistry holds at most max taps of the write pipeline, and the observers attached on start. Observing
+// is lock-free: the taps are swapped as a whole when one is added or removed.
+type tapRegistry struct {
+	max       int
+	observers []sampleObserver
+	mutex     sync.Mutex
+	taps      atomic.Pointer[[]*sampleTap]
+}
+
+func newTapRegistry(max int) *tapRegistry {
+	return &tapRegistry{max: max}
+}
+
+// attach adds an observer of all samples. It must be called before the writes are served.
+func (r *tapRegistry) attach(o sampleObserver) {
+	r.observers = append(r.observers, o)
+}
+
+// add attaches a tap, failing with errTooManyTaps if there are max taps already.
+func (r *tapRegistry) add(t *sampleTap) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var current []*sampleTap
+	if p := r.taps.Load(); p != nil {
+		current = *p
+	}
+	if len(current) >= r.max {
+		return errTooManyTaps
+	}
+	updated := append(current[:len(current):len(current)], t)
+	r.taps.Store(&updated)
+	return nil
+}
+
+// remove detaches a tap.
+func (r *tapRegistry) remove(t *sampleTap) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p := r.taps.Load()
+	if p == nil {
+		return
+	}
+	updated := make([]*sampleTap, 0, len(*p))
+	for _, other := range *p {
+		if other != t {
+			updated = append(updated, other)
+		}
+	}
+	r.taps.Store(&updated)
+}
+
+// observe passes the samples to the observers and the taps.
+func (r *tapRegistry) observe(samples model.Samples) {
+	for _, o := range r.observers {
+		o.Observe(samples)
+	}
+	if p := r.taps.Load(); p != nil {
+		for _, t := range *p {
+			t.observe(samples)
+		}
+	}
+}
+
+// tailSample is a streamed sample. The value is a string like in the query API, as JSON has no NaN.
+type tailSample struct {
+	Metric    string            `json:"metric"`
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// tailTrailer is the last line of a tail stream.
+type tailTrailer struct {
+	Samples int    `json:"samples"`
+	Dropped int64  `json:"dropped"`
+	End     string `json:"end"`
+}
+
+// tailHandler serves GET /admin/tail?match[]=<selector>&limit=<n>&duration=<duration>, streaming the samples
+// sent to the storage from then on that match any of the selectors as NDJSON. The stream ends after limit
+// samples, tailDefaultLimit by default and at most maxLimit, or after duration, maxDuration by default and at
+// most. Its last line counts the samples dropped because the stream fell behind.
+func tailHandler(m *metrics, registry *tapRegistry, maxLimit int, maxDuration time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		query := r.URL.Query()
+		var selectors [][]*labels.Matcher
+		for _, s := range query["match[]"] {
+			matchers, err := parser.ParseMetricSelector(s)
+			if err != nil {
+				util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, err.Error(), nil)
+				return
+			}
+			selectors = append(selectors, matchers)
+		}
+		if len(selectors) == 0 {
+			util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "no match[] parameter provided", nil)
+			return
+		}
+		limit := min(tailDefaultLimit, maxLimit)
+		if v := query.Get("limit"); v != "" {
+			var err error
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxLimit {
+				util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "invalid limit parameter, expected a number between 1 and "+strconv.Itoa(maxLimit), nil)
+				return
+			}
+		}
+		duration := maxDuration
+		if v := query.Get("duration"); v != "" {
+			d, err := model.ParseDuration(v)
+			if err != nil || d <= 0 || time.Duration(d) > maxDuration {
+				util.WriteAPIError(w, http.StatusBadRequest, errorBadData, util.ErrCodeBadRequest, "invalid duration parameter, expected a duration up to "+model.Duration(maxDuration).String(), nil)
+				return
+			}
+			duration = time.Duration(d)
+		}
+
+		tap := newSampleTap(selectors, min(limit, tailBuffer))
+		if err := registry.add(tap); err != nil {
+			util.WriteAPIError(w, http.StatusTooManyRequests, errorBadData, util.ErrCodeLimitExceeded, "too many tail streams, retry later", nil)
+			return
+		}
+		m.tailStreams.Inc()
+		log.Info("msg", "Tail stream started", "match", query["match[]"], "limit", limit, "duration", duration)
+		trailer := streamTail(w, r, tap, limit, duration)
+		registry.remove(tap)
+		m.tailStreams.Dec()
+		m.tailDroppedSamples.Add(float64(trailer.Dropped))
+		log.Info("msg", "Tail stream ended", "samples", trailer.Samples, "dropped", trailer.Dropped, "end", trailer.End)
+	})
+}
+
+// streamTail streams the samples of the tap until limit samples were streamed, the duration elapsed or the
+// client went away, ending with the trailer it returns.
+func streamTail(w http.ResponseWriter, r *http.Request, tap *sampleTap, limit int, duration time.Duration) tailTrailer {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+	encoder := json.NewEncoder(w)
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	trailer := tailTrailer{}
+	for trailer.End == "" {
+		select {
+		case s := <-tap.samples:
+			labels := make(map[string]string, len(s.Metric))
+			for name, value := range s.Metric {
+				if name != model.MetricNameLabel {
+					labels[string(name)] = string(value)
+				}
+			}
+			_ = encoder.Encode(tailSample{
+				Metric:    string(s.Metric[model.MetricNameLabel]),
+				Labels:    labels,
+				Value:     strconv.FormatFloat(float64(s.Value), 'f', -1, 64),
+				Timestamp: int64(s.Timestamp),
+			})
+			trailer.Samples++
+			if trailer.Samples >= limit {
+				trailer.End = tailEndLimit
+			} else if len(tap.samples) > 0 {
+				// flush once the burst is written
+				continue
+			}
+			flush()
+		case <-timer.C:
+			trailer.End = tailEndDuration
+		case <-r.Context().Done():
+			trailer.End = tailEndClient
+		}
+	}
+	trailer.Dropped = tap.dropped.Load()
+	if trailer.End != tailEndClient {
+		_ = encoder.Encode(trailer)
+		flush()
+	}
+	return trailer
+}
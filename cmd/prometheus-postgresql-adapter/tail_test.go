@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestSampleTapDropsWhenFull(t *testing.T) {
+	tap := newSampleTap([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, "up")}}, 2)
+	metric := model.Metric{model.MetricNameLabel: "up"}
+	samples := model.Samples{
+		{Metric: metric, Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "down"}, Value: 2},
+		{Metric: metric, Value: 3},
+		{Metric: metric, Value: 4},
+	}
+	tap.observe(samples)
+	if len(tap.samples) != 2 || tap.dropped.Load() != 1 {
+		t.Errorf("Expected 2 buffered and 1 dropped sample, got %d and %d", len(tap.samples), tap.dropped.Load())
+	}
+	s := <-tap.samples
+	metric["job"] = "changed"
+	if _, ok := s.Metric["job"]; ok || s.Value != 1 {
+		t.Errorf("Expected a copy of the first sample, got %v", s)
+	}
+}
+
+func TestTapRegistry(t *testing.T) {
+	registry := newTapRegistry(1)
+	registry.observe(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}}})
+	first := newSampleTap([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, "up")}}, 10)
+	if err := registry.add(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.add(newSampleTap(nil, 10)); err != errTooManyTaps {
+		t.Errorf("Expected the second tap to be rejected, got %v", err)
+	}
+	registry.observe(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}}})
+	registry.remove(first)
+	registry.observe(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}}})
+	if len(first.samples) != 1 {
+		t.Errorf("Expected the tap to see the samples while attached only, got %d", len(first.samples))
+	}
+}
+
+// countingObserver counts the samples it observes.
+type countingObserver struct {
+	samples int
+}
+
+func (o *countingObserver) Observe(samples model.Samples) {
+	o.samples += len(samples)
+}
+
+func TestTapRegistryObservers(t *testing.T) {
+	registry := newTapRegistry(0)
+	observer := &countingObserver{}
+	registry.attach(observer)
+	registry.observe(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}}})
+	if observer.samples != 1 {
+		t.Errorf("Expected the observer to see the samples, got %d", observer.samples)
+	}
+	if err := registry.add(newSampleTap(nil, 10)); err != errTooManyTaps {
+		t.Errorf("Expected observers to leave no room for taps, got %v", err)
+	}
+}
+
+func TestTailEndpoint(t *testing.T) {
+	taps = newTapRegistry(1)
+	defer func() {
+		taps = nil
+	}()
+	server := httptest.NewServer(tailHandler(testMetrics, taps, 1000, time.Minute))
+	defer server.Close()
+
+	for _, query := range []string{"", "match[]=up{", "match[]=up&limit=0", "match[]=up&limit=1001", "match[]=up&duration=2m"} {
+		resp, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected, got %d", query, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "?" + url.Values{"match[]": {`up{job="a"}`}, "limit": {"2"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected a stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	busy, err := http.Get(server.URL + "?match[]=up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = busy.Body.Close()
+	if busy.StatusCode != http.StatusTooManyRequests || busy.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected a stream beyond the maximum to be rejected with 429 and Retry-After, got %d", busy.StatusCode)
+	}
+
+	body := encodeLabelSets(t,
+		[]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+		[]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+		[]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "x"}, {Name: "job", Value: "a"}},
+		[]prompb.Label{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "y"}, {Name: "job", Value: "a"}},
+	)
+	recorder := httptest.NewRecorder()
+	write(testMetrics, &fakeWriter{}, false).ServeHTTP(recorder, httptest.NewRequest("POST", "/write", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the write to succeed, got %d", recorder.Code)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 {
+		t.Fatalf("Expected 2 samples and the trailer, got %q", lines)
+	}
+	var sample tailSample
+	if err := json.Unmarshal([]byte(lines[0]), &sample); err != nil {
+		t.Fatal(err)
+	}
+	if sample.Metric != "up" || sample.Labels["job"] != "a" || sample.Value != "1" || sample.Timestamp != 1 {
+		t.Errorf("Unexpected sample %+v", sample)
+	}
+	var trailer tailTrailer
+	if err := json.Unmarshal([]byte(lines[2]), &trailer); err != nil {
+		t.Fatal(err)
+	}
+	if trailer.Samples != 2 || trailer.End != tailEndLimit {
+		t.Errorf("Unexpected trailer %+v", trailer)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// highestTimestamp tracks the highest sample timestamp seen so far, in milliseconds.
+type highestTimestamp struct {
+	value atomic.Int64
+	now   func() time.Time
+}
+
+func newHighestTimestamp() *highestTimestamp {
+	return &highestTimestamp{now: time.Now}
+}
+
+// update raises the timestamp to the newest sample. Far-future samples are clamped to the current time,
+// and older samples never move it backwards.
+func (h *highestTimestamp) update(samples model.Samples) {
+	if len(samples) == 0 {
+		return
+	}
+	highest := samples[0].Timestamp
+	for _, s := range samples[1:] {
+		if s.Timestamp > highest {
+			highest = s.Timestamp
+		}
+	}
+	if now := model.TimeFromUnixNano(h.now().UnixNano()); highest > now {
+		highest = now
+	}
+	for {
+		current := h.value.Load()
+		if int64(highest) <= current || h.value.CompareAndSwap(current, int64(highest)) {
+			return
+		}
+	}
+}
+
+// gauge exposes the timestamp in seconds.
+func (h *highestTimestamp) gauge(namespace string, name string, help string) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		},
+		func() float64 {
+			return float64(h.value.Load()) / 1000
+		},
+	)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestHighestTimestamp(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := &highestTimestamp{now: func() time.Time { return now }}
+	samplesAt := func(timestamps ...int64) model.Samples {
+		samples := model.Samples{}
+		for _, ts := range timestamps {
+			samples = append(samples, &model.Sample{Timestamp: model.Time(ts)})
+		}
+		return samples
+	}
+
+	h.update(samplesAt(500000, 900000, 700000))
+	if v := h.value.Load(); v != 900000 {
+		t.Errorf("Expected highest timestamp 900000, got %d", v)
+	}
+	h.update(samplesAt(800000))
+	if v := h.value.Load(); v != 900000 {
+		t.Errorf("Expected out-of-order samples not to move the timestamp back, got %d", v)
+	}
+	h.update(samplesAt(5000000))
+	if v := h.value.Load(); v != 1000000 {
+		t.Errorf("Expected far-future samples to be clamped to now, got %d", v)
+	}
+	h.update(nil)
+	if v := h.value.Load(); v != 1000000 {
+		t.Errorf("Expected empty requests to be ignored, got %d", v)
+	}
+}
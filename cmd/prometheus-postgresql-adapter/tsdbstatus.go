@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+const tsdbStatusPath = "/api/v1/status/tsdb"
+
+// tsdbStatusResponse is the data of the /api/v1/status/tsdb response: the status, when it was computed and
+// whether that is longer ago than the TTL.
+type tsdbStatusResponse struct {
+	pgprometheus.TSDBStatus
+	ComputedAt time.Time `json:"computedAt"`
+	Stale      bool      `json:"stale"`
+}
+
+// tsdbStatusCache keeps the last TSDB status, as computing it scans the labels table. It is computed in the
+// background, on request when it is older than ttl and every interval if positive, one computation at a
+// time, so requests never wait for it.
+type tsdbStatusCache struct {
+	ttl      time.Duration
+	interval time.Duration
+	timeout  time.Duration
+	compute  func(ctx context.Context, timeout time.Duration) (pgprometheus.TSDBStatus, error)
+	now      func() time.Time
+
+	mutex      sync.Mutex
+	status     *pgprometheus.TSDBStatus
+	computedAt time.Time
+	computing  bool
+}
+
+func newTSDBStatusCache(ttl, interval, timeout time.Duration, compute func(ctx context.Context, timeout time.Duration) (pgprometheus.TSDBStatus, error)) *tsdbStatusCache {
+	return &tsdbStatusCache{ttl: ttl, interval: interval, timeout: timeout, compute: compute, now: time.Now}
+}
+
+// run computes the status every interval, forever.
+func (c *tsdbStatusCache) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.refresh()
+		<-ticker.C
+	}
+}
+
+// get returns the last status, nil if none was computed yet, starting a computation if it is older than the
+// TTL.
+func (c *tsdbStatusCache) get() *tsdbStatusResponse {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stale := c.status == nil || c.now().Sub(c.computedAt) >= c.ttl
+	if stale && !c.computing {
+		c.computing = true
+		go c.update()
+	}
+	if c.status == nil {
+		return nil
+	}
+	return &tsdbStatusResponse{TSDBStatus: *c.status, ComputedAt: c.computedAt, Stale: stale}
+}
+
+// refresh computes the status unless a computation is running already.
+func (c *tsdbStatusCache) refresh() {
+	c.mutex.Lock()
+	if c.computing {
+		c.mutex.Unlock()
+		return
+	}
+	c.computing = true
+	c.mutex.Unlock()
+	c.update()
+}
+
+func (c *tsdbStatusCache) update() {
+	begin := c.now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	status, err := c.compute(ctx, c.timeout)
+	cancel()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.computing = false
+	if err != nil {
+		log.Warn("msg", "Error computing the TSDB status, keeping the previous one", "err", err)
+		return
+	}
+	c.status = &status
+	c.computedAt = c.now()
+	log.Debug("msg", "Computed the TSDB status", "series", status.HeadStats.NumSeries, "duration", c.computedAt.Sub(begin))
+}
+
+// tsdbStatusAPI serves GET /api/v1/status/tsdb from the cache. Until the status was computed once, it
+// replies with 503.
+func tsdbStatusAPI(cache *tsdbStatusCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.WriteAPIError(w, http.StatusMethodNotAllowed, errorBadData, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		status := cache.get()
+		if status == nil {
+			util.WriteAPIError(w, http.StatusServiceUnavailable, errorExecution, util.ErrCodeNotReady, "the TSDB status is being computed", nil)
+			return
+		}
+		writeAPIData(w, status)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+// fakeStatus computes a status with the number of computations as number of series, blocking until release
+// is closed.
+type fakeStatus struct {
+	mutex   sync.Mutex
+	calls   int
+	err     error
+	release chan struct{}
+}
+
+func (f *fakeStatus) compute(ctx context.Context, timeout time.Duration) (pgprometheus.TSDBStatus, error) {
+	<-f.release
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls++
+	return pgprometheus.TSDBStatus{HeadStats: pgprometheus.TSDBHeadStats{NumSeries: uint64(f.calls)}}, f.err
+}
+
+// waitComputed waits for the computation of the status in the background to finish.
+func waitComputed(cache *tsdbStatusCache) {
+	for {
+		cache.mutex.Lock()
+		computing := cache.computing
+		cache.mutex.Unlock()
+		if !computing {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func getTSDBStatus(t *testing.T, handler http.Handler) (int, tsdbStatusResponse) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", tsdbStatusPath, nil))
+	var resp struct {
+		Data tsdbStatusResponse `json:"data"`
+	}
+	if recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder.Code, resp.Data
+}
+
+func TestTSDBStatusAPI(t *testing.T) {
+	fake := &fakeStatus{release: make(chan struct{})}
+	var nowMutex sync.Mutex
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	setNow := func(t time.Time) {
+		nowMutex.Lock()
+		defer nowMutex.Unlock()
+		now = t
+	}
+	cache := newTSDBStatusCache(time.Minute, 0, time.Second, fake.compute)
+	cache.now = func() time.Time {
+		nowMutex.Lock()
+		defer nowMutex.Unlock()
+		return now
+	}
+	handler := tsdbStatusAPI(cache)
+
+	// the first request starts the computation without waiting for it
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", tsdbStatusPath, nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d before the first computation, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if resp := decodeErrorResponse(t, recorder); resp.Code != util.ErrCodeNotReady {
+		t.Errorf("Expected code %q, got %q", util.ErrCodeNotReady, resp.Code)
+	}
+	retryAfter(t, recorder)
+	// requests during the computation don't start another one
+	getTSDBStatus(t, handler)
+	close(fake.release)
+	waitComputed(cache)
+
+	code, status := getTSDBStatus(t, handler)
+	if code != http.StatusOK || status.HeadStats.NumSeries != 1 || !status.ComputedAt.Equal(now) || status.Stale {
+		t.Errorf("Expected the fresh status computed at %v, got %d and %+v", now, code, status)
+	}
+
+	// past the TTL, the stale status is served while it is computed again
+	setNow(now.Add(time.Minute))
+	code, status = getTSDBStatus(t, handler)
+	if code != http.StatusOK || status.HeadStats.NumSeries != 1 || !status.Stale {
+		t.Errorf("Expected the previous status marked as stale, got %d and %+v", code, status)
+	}
+	waitComputed(cache)
+	if _, status = getTSDBStatus(t, handler); status.HeadStats.NumSeries != 2 || !status.ComputedAt.Equal(now) {
+		t.Errorf("Expected the status to be computed again, got %+v", status)
+	}
+
+	// a failed computation keeps the previous status
+	fake.mutex.Lock()
+	fake.err = errors.New("canceling statement due to statement timeout")
+	fake.mutex.Unlock()
+	setNow(now.Add(time.Minute))
+	getTSDBStatus(t, handler)
+	waitComputed(cache)
+	if _, status = getTSDBStatus(t, handler); status.HeadStats.NumSeries != 2 || !status.Stale {
+		t.Errorf("Expected the previous status to be kept, got %+v", status)
+	}
+	waitComputed(cache)
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if fake.calls != 4 {
+		t.Errorf("Expected 4 computations, got %d", fake.calls)
+	}
+}
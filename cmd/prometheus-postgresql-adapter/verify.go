@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// verifyRunLabel identifies the samples of a verify run, so that runs don't see each other's samples.
+const verifyRunLabel = "verify_run"
+
+// verifyConfig configures the verify subcommand.
+type verifyConfig struct {
+	url          string
+	metric       string
+	labels       model.Metric
+	runID        string
+	series       int
+	samples      int
+	timeout      time.Duration
+	pollInterval time.Duration
+	cleanup      bool
+	logLevel     string
+	pg           pgprometheus.Config
+}
+
+func parseVerifyFlags(args []string) (*verifyConfig, error) {
+	cfg := &verifyConfig{}
+	var labelsFlag string
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.StringVar(&cfg.url, "url", "", "Remote write URL of the adapter to verify (eg. http://localhost:9201/write).")
+	fs.StringVar(&cfg.metric, "metric", "adapter_verify", "Name of the synthetic metric.")
+	fs.StringVar(&labelsFlag, "labels", "", "Comma-separated name=value labels of the synthetic series, eg. \"env=staging,team=infra\".")
+	fs.StringVar(&cfg.runID, "run-id", "", "Value of the "+verifyRunLabel+" label of the synthetic series. Defaults to a value unique to the run.")
+	fs.IntVar(&cfg.series, "series", 1, "Number of synthetic series.")
+	fs.IntVar(&cfg.samples, "samples", 10, "Number of synthetic samples, spread over the series.")
+	fs.DurationVar(&cfg.timeout, "timeout", time.Minute, "Time the samples may take to show up in the database, including the write request.")
+	fs.DurationVar(&cfg.pollInterval, "poll-interval", time.Second, "Interval at which the database is polled for the samples.")
+	fs.BoolVar(&cfg.cleanup, "cleanup", true, "Delete the synthetic samples and their series afterwards.")
+	fs.StringVar(&cfg.logLevel, "log-level", "info", "The log level to use [ \"error\", \"warn\", \"info\", \"debug\" ].")
+	pgprometheus.RegisterFlags(fs, "pg", &cfg.pg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	labels, err := parseLabels(labelsFlag)
+	if err != nil {
+		return nil, err
+	}
+	cfg.labels = labels
+	if cfg.runID == "" {
+		cfg.runID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	switch {
+	case cfg.url == "":
+		return nil, fmt.Errorf("-url must be set")
+	case !model.IsValidMetricName(model.LabelValue(cfg.metric)):
+		return nil, fmt.Errorf("invalid metric name %q", cfg.metric)
+	case cfg.series <= 0:
+		return nil, fmt.Errorf("-series must be positive")
+	case cfg.samples < cfg.series:
+		return nil, fmt.Errorf("-samples must be at least -series")
+	case cfg.timeout <= 0 || cfg.pollInterval <= 0:
+		return nil, fmt.Errorf("-timeout and -poll-interval must be positive")
+	}
+	return cfg, nil
+}
+
+// parseLabels parses comma-separated name=value pairs.
+func parseLabels(s string) (model.Metric, error) {
+	metric := model.Metric{}
+	if s == "" {
+		return metric, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		label := model.LabelName(strings.TrimSpace(name))
+		if !ok || !label.IsValid() || label == model.MetricNameLabel || label == verifyRunLabel || label == "series" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		metric[label] = model.LabelValue(value)
+	}
+	return metric, nil
+}
+
+// verifyStore reads the synthetic samples back from the database.
+type verifyStore interface {
+	CountSamples(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time) (int64, error)
+	DeleteSeries(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, opts pgprometheus.DeleteOptions, progress func(deleted int64)) error
+}
+
+// runVerify runs the verify subcommand, which sends synthetic samples to an adapter as remote write requests
+// and waits for them to show up in the database. It returns the exit code.
+func runVerify(args []string) int {
+	cfg, err := parseVerifyFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	log.Init(cfg.logLevel)
+	client, err := pgprometheus.NewClient(&cfg.pg)
+	if err != nil {
+		log.Error("msg", "Error creating the database client", "err", err)
+		return 1
+	}
+	defer client.Close()
+	writer := &remoteWriter{url: cfg.url, client: &http.Client{Timeout: cfg.timeout}}
+	result := runVerifyCheck(context.Background(), cfg, writer, client)
+	result.print(os.Stdout)
+	if !result.ok() {
+		return 1
+	}
+	return 0
+}
+
+// verifyResult sums up a verify run.
+type verifyResult struct {
+	runID        string
+	sent         int
+	found        int64
+	writeLatency time.Duration
+	visibleAfter time.Duration
+	writeErr     error
+	readErr      error
+	cleanupErr   error
+	cleanedUp    bool
+}
+
+func (r *verifyResult) ok() bool {
+	return r.writeErr == nil && r.readErr == nil && r.found == int64(r.sent)
+}
+
+func (r *verifyResult) print(w io.Writer) {
+	status := "OK"
+	if !r.ok() {
+		status = "FAILED"
+	}
+	_, _ = fmt.Fprintf(w, "result:          %s\n", status)
+	_, _ = fmt.Fprintf(w, "run id:          %s\n", r.runID)
+	_, _ = fmt.Fprintf(w, "samples sent:    %d\n", r.sent)
+	_, _ = fmt.Fprintf(w, "samples found:   %d\n", r.found)
+	_, _ = fmt.Fprintf(w, "write latency:   %v\n", r.writeLatency.Round(time.Millisecond))
+	if r.writeErr != nil {
+		_, _ = fmt.Fprintf(w, "write error:     %v\n", r.writeErr)
+	}
+	if r.readErr != nil {
+		_, _ = fmt.Fprintf(w, "read error:      %v\n", r.readErr)
+	}
+	if r.ok() {
+		_, _ = fmt.Fprintf(w, "visible after:   %v\n", r.visibleAfter.Round(time.Millisecond))
+	}
+	switch {
+	case r.cleanupErr != nil:
+		_, _ = fmt.Fprintf(w, "cleanup error:   %v\n", r.cleanupErr)
+	case r.cleanedUp:
+		_, _ = fmt.Fprintf(w, "cleanup:         done\n")
+	}
+}
+
+// verifySamples returns the synthetic samples of the run, spread over the series, each at its own millisecond
+// before now.
+func verifySamples(cfg *verifyConfig, now time.Time) model.Samples {
+	series := make([]model.Metric, cfg.series)
+	for i := range series {
+		metric := cfg.labels.Clone()
+		metric[model.MetricNameLabel] = model.LabelValue(cfg.metric)
+		metric[verifyRunLabel] = model.LabelValue(cfg.runID)
+		metric["series"] = model.LabelValue(strconv.Itoa(i))
+		series[i] = metric
+	}
+	start := model.TimeFromUnixNano(now.UnixNano()).Add(-time.Duration(cfg.samples) * time.Millisecond)
+	samples := make(model.Samples, cfg.samples)
+	for i := range samples {
+		samples[i] = &model.Sample{
+			Metric:    series[i%cfg.series],
+			Value:     model.SampleValue(i),
+			Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+		}
+	}
+	return samples
+}
+
+// runVerifyCheck writes the synthetic samples through writer and polls store until all of them are visible or
+// the timeout expired, then deletes them if configured to.
+func runVerifyCheck(ctx context.Context, cfg *verifyConfig, writer writers.Writer, store verifyStore) *verifyResult {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+	result := &verifyResult{runID: cfg.runID}
+	samples := verifySamples(cfg, time.Now())
+	result.sent = len(samples)
+	start, end := samples[0].Timestamp.Time(), samples[len(samples)-1].Timestamp.Time()
+	selectors := [][]*labels.Matcher{{
+		labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, cfg.metric),
+		labels.MustNewMatcher(labels.MatchEqual, verifyRunLabel, cfg.runID),
+	}}
+
+	begin := time.Now()
+	_, result.writeErr = writer.WriteContext(ctx, samples)
+	result.writeLatency = time.Since(begin)
+	if result.writeErr == nil {
+		result.found, result.readErr = waitForSamples(ctx, store, selectors, start, end, result.sent, cfg.pollInterval)
+		result.visibleAfter = time.Since(begin)
+	}
+
+	if cfg.cleanup {
+		// the samples may have arrived even if the write timed out, so clean up in any case
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+		defer cancel()
+		result.cleanupErr = store.DeleteSeries(cleanupCtx, selectors, time.Time{}, time.Time{}, pgprometheus.DeleteOptions{BatchSize: 1000, RemoveOrphans: true}, nil)
+		result.cleanedUp = result.cleanupErr == nil
+	}
+	return result
+}
+
+// waitForSamples polls store until it has the expected number of samples of the selected series between start
+// and end, or ctx is done.
+func waitForSamples(ctx context.Context, store verifyStore, selectors [][]*labels.Matcher, start, end time.Time, expected int, interval time.Duration) (int64, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		found, err := store.CountSamples(ctx, selectors, start, end)
+		if err == nil && found >= int64(expected) {
+			return found, nil
+		}
+		log.Debug("msg", "Waiting for the samples", "found", found, "expected", expected, "err", err)
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("only %d of %d samples showed up in time", found, expected)
+			}
+			return found, err
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	pgprometheus "github.com/timescale/prometheus-postgresql-adapter/pkg/postgresql"
+)
+
+// fakeVerifyStore counts the samples received by a fakeWriter, of which it shows only the first visible.
+type fakeVerifyStore struct {
+	writer  *fakeWriter
+	visible int
+	deleted bool
+}
+
+func (f *fakeVerifyStore) CountSamples(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time) (int64, error) {
+	var count int64
+	for _, s := range f.writer.samples {
+		matches := !s.Timestamp.Time().Before(start) && !s.Timestamp.Time().After(end)
+		for _, m := range selectors[0] {
+			matches = matches && m.Matches(string(s.Metric[model.LabelName(m.Name)]))
+		}
+		if matches && count < int64(f.visible) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakeVerifyStore) DeleteSeries(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, opts pgprometheus.DeleteOptions, progress func(deleted int64)) error {
+	f.deleted = true
+	return nil
+}
+
+func TestRunVerifyCheck(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		visible  int
+		writeErr error
+		ok       bool
+		report   string
+	}{
+		{name: "all samples visible", visible: 1000, ok: true, report: "result:          OK\n"},
+		{name: "samples missing", visible: 7, report: "only 7 of 10 samples showed up"},
+		{name: "write failing", visible: 1000, writeErr: pgprometheus.ErrCircuitOpen, report: "write error:     remote write failed with status 503"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			writer := &fakeWriter{err: c.writeErr}
+			server := httptest.NewServer(write(testMetrics, writer, false))
+			defer server.Close()
+			cfg, err := parseVerifyFlags([]string{"-url", server.URL, "-series", "3", "-samples", "10", "-labels", "env=ci", "-timeout", "200ms", "-poll-interval", "10ms"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := &fakeVerifyStore{writer: writer, visible: c.visible}
+			result := runVerifyCheck(context.Background(), cfg, &remoteWriter{url: cfg.url, client: server.Client()}, store)
+			if result.ok() != c.ok {
+				t.Errorf("Expected ok %v, got %+v", c.ok, result)
+			}
+			if !store.deleted || !result.cleanedUp {
+				t.Error("Expected the synthetic series to be deleted")
+			}
+			var report bytes.Buffer
+			result.print(&report)
+			if !strings.Contains(report.String(), c.report) {
+				t.Errorf("Expected the report to contain %q, got %q", c.report, report.String())
+			}
+			for _, s := range writer.samples {
+				if s.Metric["env"] != "ci" || s.Metric[verifyRunLabel] != model.LabelValue(cfg.runID) {
+					t.Errorf("Unexpected labels of synthetic sample %v", s.Metric)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifySamples(t *testing.T) {
+	cfg := &verifyConfig{metric: "adapter_verify", labels: model.Metric{}, runID: "run", series: 3, samples: 7}
+	samples := verifySamples(cfg, time.Unix(100, 0))
+	if len(samples) != 7 {
+		t.Fatalf("Expected 7 samples, got %d", len(samples))
+	}
+	seen := map[model.Fingerprint]bool{}
+	for i, s := range samples {
+		seen[s.Metric.Fingerprint()] = true
+		if i > 0 && s.Timestamp <= samples[i-1].Timestamp {
+			t.Errorf("Expected increasing timestamps, got %v after %v", s.Timestamp, samples[i-1].Timestamp)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected the samples to be spread over 3 series, got %d", len(seen))
+	}
+	if last := samples[len(samples)-1].Timestamp; last.Time().After(time.Unix(100, 0)) {
+		t.Errorf("Expected the samples to be in the past, got %v", last)
+	}
+}
+
+func TestParseVerifyFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-url", "http://localhost:9201/write", "-series", "0"},
+		{"-url", "http://localhost:9201/write", "-series", "5", "-samples", "4"},
+		{"-url", "http://localhost:9201/write", "-metric", "not a metric"},
+		{"-url", "http://localhost:9201/write", "-labels", "env"},
+		{"-url", "http://localhost:9201/write", "-labels", "verify_run=x"},
+		{"-url", "http://localhost:9201/write", "-timeout", "0"},
+	} {
+		if _, err := parseVerifyFlags(args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package cardinality limits the number of series of each metric name, so that a label taking unbounded
+// values, such as a timestamp, can't flood the database with series.
+package cardinality
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const (
+	// maxMetricLabels is the number of metric names counted under their own name by SuppressedSamples, the
+	// others are counted as otherMetric.
+	maxMetricLabels = 100
+	otherMetric     = "_other"
+	// lastSeenResolution is the granularity at which the last sample of a persisted series is saved, the
+	// window being measured in hours.
+	lastSeenResolution = time.Hour
+)
+
+var (
+	// SuppressedSamples counts the samples of new series rejected because their metric is over the series
+	// limit, by metric name.
+	SuppressedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cardinality_suppressed_samples_total",
+			Help: "Total number of samples of new series rejected because their metric is over the series limit, by metric name (\"" + otherMetric + "\" beyond 100 metrics).",
+		},
+		[]string{"metric"},
+	)
+	// SuppressedMetrics is the number of metrics over the series limit.
+	SuppressedMetrics = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cardinality_suppressed_metrics",
+			Help: "Number of metrics over the series limit, of which new series are rejected.",
+		},
+	)
+)
+
+// Suppression describes a metric over the series limit.
+type Suppression struct {
+	Metric string    `json:"metric"`
+	Since  time.Time `json:"since"`
+	Series int       `json:"series"`
+	// Rejected is the number of samples rejected since the metric was suppressed.
+	Rejected int64 `json:"rejectedSamples"`
+}
+
+type seriesState struct {
+	lastSeen time.Time
+	// dirty marks series of suppressed metrics that changed since they were last persisted.
+	dirty bool
+}
+
+type metricState struct {
+	series map[model.Fingerprint]*seriesState
+	// suppressed is when the metric reached the limit, zero while it is below.
+	suppressed time.Time
+	rejected   int64
+}
+
+// Guard counts the distinct series of each metric name seen within a sliding window. Once a metric has
+// maxSeries series, samples of its new series are rejected while its known series keep being written,
+// until enough of them are not seen for the window or the metric is unsuppressed. It is safe for concurrent
+// use.
+type Guard struct {
+	maxSeries int
+	window    time.Duration
+	store     *store
+	now       func() time.Time
+
+	mutex    sync.Mutex
+	metrics  map[string]*metricState
+	labelled map[string]bool
+}
+
+// NewGuard creates a guard allowing maxSeries series per metric name within window. The series are kept in
+// memory only; use NewPersistentGuard to keep suppressed metrics across restarts.
+func NewGuard(maxSeries int, window time.Duration) *Guard {
+	return &Guard{
+		maxSeries: maxSeries,
+		window:    window,
+		now:       time.Now,
+		metrics:   map[string]*metricState{},
+		labelled:  map[string]bool{},
+	}
+}
+
+// Admit returns the samples that aren't new series of a metric over the series limit.
+func (g *Guard) Admit(samples model.Samples) model.Samples {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := g.now()
+	admitted := samples[:0:0]
+	for _, sample := range samples {
+		name := string(sample.Metric[model.MetricNameLabel])
+		m := g.metrics[name]
+		if m == nil {
+			m = &metricState{series: map[model.Fingerprint]*seriesState{}}
+			g.metrics[name] = m
+		}
+		fp := sample.Metric.Fingerprint()
+		series := m.series[fp]
+		switch {
+		case series != nil:
+			if now.Sub(series.lastSeen) >= lastSeenResolution {
+				series.lastSeen = now
+				series.dirty = true
+			}
+		case len(m.series) >= g.maxSeries:
+			if m.suppressed.IsZero() {
+				g.suppress(name, m, now)
+			}
+			m.rejected++
+			SuppressedSamples.WithLabelValues(g.metricLabel(name)).Inc()
+			continue
+		default:
+			m.series[fp] = &seriesState{lastSeen: now, dirty: true}
+		}
+		admitted = append(admitted, sample)
+	}
+	return admitted
+}
+
+// suppress starts rejecting new series of a metric. The caller must hold the mutex.
+func (g *Guard) suppress(name string, m *metricState, now time.Time) {
+	m.suppressed = now
+	m.rejected = 0
+	for _, series := range m.series {
+		series.dirty = true
+	}
+	SuppressedMetrics.Inc()
+	log.Warn("msg", "Metric reached the series limit, samples of its new series are rejected", "metric", name, "max_series", g.maxSeries, "window", g.window)
+}
+
+// metricLabel returns the value of the metric label of SuppressedSamples for name. The caller must hold
+// the mutex.
+func (g *Guard) metricLabel(name string) string {
+	if !g.labelled[name] {
+		if len(g.labelled) >= maxMetricLabels {
+			return otherMetric
+		}
+		g.labelled[name] = true
+	}
+	return name
+}
+
+// Suppressed lists the metrics over the series limit, by name.
+func (g *Guard) Suppressed() []Suppression {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	suppressed := []Suppression{}
+	for name, m := range g.metrics {
+		if !m.suppressed.IsZero() {
+			suppressed = append(suppressed, Suppression{Metric: name, Since: m.suppressed, Series: len(m.series), Rejected: m.rejected})
+		}
+	}
+	sort.Slice(suppressed, func(i, j int) bool {
+		return suppressed[i].Metric < suppressed[j].Metric
+	})
+	return suppressed
+}
+
+// Unsuppress forgets the series of a suppressed metric, so that new series are admitted again until it
+// reaches the limit anew. It returns false if the metric isn't suppressed.
+func (g *Guard) Unsuppress(name string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	m := g.metrics[name]
+	if m == nil || m.suppressed.IsZero() {
+		return false
+	}
+	delete(g.metrics, name)
+	SuppressedMetrics.Dec()
+	log.Info("msg", "Metric unsuppressed, its series are counted from scratch", "metric", name)
+	return true
+}
+
+// expire forgets the series not seen within the window, and unsuppresses the metrics that are below the
+// limit again. The caller must hold the mutex.
+func (g *Guard) expire(now time.Time) {
+	horizon := now.Add(-g.window)
+	for name, m := range g.metrics {
+		for fp, series := range m.series {
+			if series.lastSeen.Before(horizon) {
+				delete(m.series, fp)
+			}
+		}
+		if !m.suppressed.IsZero() && len(m.series) < g.maxSeries {
+			m.suppressed = time.Time{}
+			SuppressedMetrics.Dec()
+			log.Info("msg", "Metric is below the series limit again", "metric", name, "series", len(m.series))
+		}
+		if len(m.series) == 0 {
+			delete(g.metrics, name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+func init() {
+	log.Init("debug")
+}
+
+func samplesOf(name string, from, to int) model.Samples {
+	var samples model.Samples
+	for i := from; i < to; i++ {
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(name), "ts": model.LabelValue(fmt.Sprint(i))}
+		samples = append(samples, &model.Sample{Metric: metric, Timestamp: model.Time(i)})
+	}
+	return samples
+}
+
+func newTestGuard(maxSeries int, window time.Duration) (*Guard, *time.Time) {
+	g := NewGuard(maxSeries, window)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	g.now = func() time.Time {
+		return now
+	}
+	return g, &now
+}
+
+func TestGuard(t *testing.T) {
+	g, now := newTestGuard(3, time.Hour)
+	suppressedMetrics := testutil.ToFloat64(SuppressedMetrics)
+	rejected := testutil.ToFloat64(SuppressedSamples.WithLabelValues("events"))
+	if admitted := g.Admit(append(samplesOf("events", 0, 2), samplesOf("up", 0, 1)...)); len(admitted) != 3 {
+		t.Fatalf("Expected the samples below the limit to be admitted, got %d", len(admitted))
+	}
+	admitted := g.Admit(samplesOf("events", 0, 5))
+	if len(admitted) != 3 || admitted[2].Metric["ts"] != "2" {
+		t.Errorf("Expected the known series and one new series to be admitted, got %v", admitted)
+	}
+	if n := testutil.ToFloat64(SuppressedSamples.WithLabelValues("events")) - rejected; n != 2 {
+		t.Errorf("Expected 2 suppressed samples to be counted, got %v", n)
+	}
+	if n := testutil.ToFloat64(SuppressedMetrics) - suppressedMetrics; n != 1 {
+		t.Errorf("Expected 1 suppressed metric, got %v", n)
+	}
+	suppressed := g.Suppressed()
+	if len(suppressed) != 1 || suppressed[0].Metric != "events" || suppressed[0].Series != 3 || suppressed[0].Rejected != 2 || !suppressed[0].Since.Equal(*now) {
+		t.Errorf("Unexpected suppressed metrics %+v", suppressed)
+	}
+	// known series keep flowing, other metrics aren't affected
+	if admitted := g.Admit(append(samplesOf("events", 1, 2), samplesOf("up", 1, 3)...)); len(admitted) != 3 {
+		t.Errorf("Expected known series and other metrics to be admitted, got %d", len(admitted))
+	}
+
+	// series not seen within the window are forgotten
+	*now = now.Add(30 * time.Minute)
+	g.Admit(samplesOf("events", 1, 3))
+	*now = now.Add(45 * time.Minute)
+	if err := g.Persist(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Suppressed()) != 0 {
+		t.Errorf("Expected the metric to be below the limit once series expired, got %+v", g.Suppressed())
+	}
+	if admitted := g.Admit(samplesOf("events", 10, 11)); len(admitted) != 1 {
+		t.Errorf("Expected a new series to be admitted again, got %d", len(admitted))
+	}
+	if n := testutil.ToFloat64(SuppressedMetrics) - suppressedMetrics; n != 0 {
+		t.Errorf("Expected no suppressed metric, got %v", n)
+	}
+}
+
+func TestUnsuppress(t *testing.T) {
+	g, _ := newTestGuard(2, time.Hour)
+	g.Admit(samplesOf("events", 0, 3))
+	if g.Unsuppress("up") {
+		t.Error("Expected a metric that isn't suppressed not to be unsuppressed")
+	}
+	if !g.Unsuppress("events") || len(g.Suppressed()) != 0 {
+		t.Fatalf("Expected the metric to be unsuppressed, got %+v", g.Suppressed())
+	}
+	if admitted := g.Admit(samplesOf("events", 5, 8)); len(admitted) != 2 {
+		t.Errorf("Expected the series to be counted from scratch, got %d admitted", len(admitted))
+	}
+}
+
+func TestSuppressedSamplesLabels(t *testing.T) {
+	g, _ := newTestGuard(1, time.Hour)
+	other := testutil.ToFloat64(SuppressedSamples.WithLabelValues(otherMetric))
+	for i := 0; i < maxMetricLabels+5; i++ {
+		g.Admit(samplesOf(fmt.Sprintf("metric_%d", i), 0, 2))
+	}
+	if len(g.labelled) != maxMetricLabels {
+		t.Errorf("Expected %d labelled metrics, got %d", maxMetricLabels, len(g.labelled))
+	}
+	if n := testutil.ToFloat64(SuppressedSamples.WithLabelValues(otherMetric)) - other; n != 5 {
+		t.Errorf("Expected the metrics beyond the label limit to be counted as %s, got %v", otherMetric, n)
+	}
+}
@@ -0,0 +1,154 @@
+package cardinality
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlCreateSuppressedTable = "create table if not exists %s (metric text not null, fingerprint bigint not null, suppressed_since timestamp with time zone not null, last_seen timestamp with time zone not null, primary key (metric, fingerprint))"
+	sqlLoadSuppressed        = "select metric, fingerprint, suppressed_since, last_seen from %s where last_seen >= $1"
+	sqlUpsertSuppressed      = "insert into %s (metric, fingerprint, suppressed_since, last_seen) select * from unnest($1::text[], $2::bigint[], $3::timestamptz[], $4::timestamptz[]) on conflict (metric, fingerprint) do update set suppressed_since = excluded.suppressed_since, last_seen = greatest(%s.last_seen, excluded.last_seen)"
+	sqlDeleteUnsuppressed    = "delete from %s where last_seen < $1 or metric <> all($2::text[])"
+)
+
+// store keeps the series of the suppressed metrics in a table, so that they stay suppressed, and their
+// known series admitted, across restarts. The series of the other metrics aren't kept: after a restart,
+// they are counted from scratch.
+type store struct {
+	db    *sql.DB
+	table string
+}
+
+// NewPersistentGuard creates a guard that keeps the series of the suppressed metrics in the given table,
+// which is created if needed. The suppressed metrics are loaded right away; call Persist periodically to
+// save changes.
+func NewPersistentGuard(maxSeries int, window time.Duration, db *sql.DB, table string) (*Guard, error) {
+	g := NewGuard(maxSeries, window)
+	g.store = &store{db: db, table: table}
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(sqlCreateSuppressedTable, table)); err != nil {
+		return nil, fmt.Errorf("error creating the suppressed metrics table: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(sqlLoadSuppressed, table), g.now().Add(-window))
+	if err != nil {
+		return nil, fmt.Errorf("error loading the suppressed metrics: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var name string
+		var fingerprint int64
+		var suppressed time.Time
+		series := &seriesState{}
+		if err := rows.Scan(&name, &fingerprint, &suppressed, &series.lastSeen); err != nil {
+			return nil, fmt.Errorf("error loading the suppressed metrics: %w", err)
+		}
+		m, ok := g.metrics[name]
+		if !ok {
+			m = &metricState{series: map[model.Fingerprint]*seriesState{}, suppressed: suppressed}
+			g.metrics[name] = m
+			SuppressedMetrics.Inc()
+		}
+		m.series[model.Fingerprint(fingerprint)] = series
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading the suppressed metrics: %w", err)
+	}
+	log.Info("msg", "Loaded the metrics over the series limit", "table", table, "metrics", len(g.metrics))
+	return g, nil
+}
+
+// Persist forgets the series not seen within the window, and saves the series of the suppressed metrics
+// that changed since the last call, deleting those of the metrics that aren't suppressed anymore. It only
+// expires series for guards without table.
+func (g *Guard) Persist(ctx context.Context) error {
+	var names []string
+	// not nil, as a null array would match no metric
+	suppressed := []string{}
+	var fingerprints []int64
+	var since, lastSeen []time.Time
+	g.mutex.Lock()
+	now := g.now()
+	g.expire(now)
+	if g.store != nil {
+		for name, m := range g.metrics {
+			if m.suppressed.IsZero() {
+				continue
+			}
+			suppressed = append(suppressed, name)
+			for fp, series := range m.series {
+				if !series.dirty {
+					continue
+				}
+				names = append(names, name)
+				fingerprints = append(fingerprints, int64(fp))
+				since = append(since, m.suppressed)
+				lastSeen = append(lastSeen, series.lastSeen)
+				series.dirty = false
+			}
+		}
+	}
+	g.mutex.Unlock()
+	if g.store == nil {
+		return nil
+	}
+
+	tx, err := g.store.db.BeginTx(ctx, nil)
+	if err != nil {
+		g.markDirty(names, fingerprints)
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlDeleteUnsuppressed, g.store.table), now.Add(-g.window), suppressed); err != nil {
+		g.markDirty(names, fingerprints)
+		return err
+	}
+	if len(names) > 0 {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlUpsertSuppressed, g.store.table, g.store.table), names, fingerprints, since, lastSeen); err != nil {
+			g.markDirty(names, fingerprints)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		g.markDirty(names, fingerprints)
+		return err
+	}
+	return nil
+}
+
+// markDirty makes the next Persist save the series again after a failure.
+func (g *Guard) markDirty(names []string, fingerprints []int64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, name := range names {
+		if m, ok := g.metrics[name]; ok {
+			if series, ok := m.series[model.Fingerprint(fingerprints[i])]; ok {
+				series.dirty = true
+			}
+		}
+	}
+}
+
+// Run persists the series every interval. It never returns.
+func (g *Guard) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := g.Persist(ctx); err != nil {
+			log.Warn("msg", "Error persisting the metrics over the series limit, retrying later", "err", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,244 @@
+// Package deadletter keeps the write requests the storage rejected for good in files, so that they can be
+// replayed by hand after an incident.
+//
+// A file starts with Magic, followed by the header: its length as a 4-byte big-endian integer and the
+// Header as JSON. Each entry is then the length of its payload and the CRC-32 (Castagnoli) of the payload,
+// both as 4-byte big-endian integers, and the payload, a snappy compressed WriteRequest protobuf.
+package deadletter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Magic starts every dead letter file.
+const Magic = "PGADL\x01"
+
+const (
+	fileLayout = "20060102-15"
+	// FileSuffix is the extension of dead letter files.
+	FileSuffix = ".dl"
+	// maxEntryBytes bounds the length of an entry a reader accepts, beyond which the file is deemed corrupt.
+	maxEntryBytes = 256 << 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrNotDeadLetter is returned by Read for files not starting with Magic.
+var ErrNotDeadLetter = errors.New("not a dead letter file")
+
+var (
+	// Requests counts the write requests kept in dead letter files.
+	Requests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dead_letter_requests_total",
+			Help: "Total number of write requests rejected by the storage for good that were kept in -dead-letter-dir.",
+		},
+	)
+	// Errors counts the write requests that could not be kept.
+	Errors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dead_letter_errors_total",
+			Help: "Total number of write requests rejected by the storage for good that could not be kept in -dead-letter-dir.",
+		},
+	)
+)
+
+// Header describes a dead letter file.
+type Header struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// Dir appends write requests to hourly files in a directory. The oldest files are removed while all files
+// together exceed maxBytes.
+type Dir struct {
+	dir      string
+	maxBytes int64
+	version  string
+
+	mutex sync.Mutex
+}
+
+// NewDir keeps write requests in dir, creating it if needed. version is recorded in the header of the files.
+func NewDir(dir string, maxBytes int64, version string) (*Dir, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating dead letter directory: %w", err)
+	}
+	return &Dir{dir: dir, maxBytes: maxBytes, version: version}, nil
+}
+
+// Add appends a write request to the file of the current hour, counting it in Requests, or in Errors if it
+// fails.
+func (d *Dir) Add(req *prompb.WriteRequest) error {
+	err := d.add(req, time.Now())
+	if err != nil {
+		Errors.Inc()
+		return err
+	}
+	Requests.Inc()
+	return nil
+}
+
+func (d *Dir) add(req *prompb.WriteRequest, now time.Time) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	entry := encodeEntry(snappy.Encode(nil, data))
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	name := filepath.Join(d.dir, "deadletter-"+now.UTC().Format(fileLayout)+FileSuffix)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		err = writeHeader(f, Header{Version: d.version, Created: now.UTC()})
+	}
+	if err == nil {
+		_, err = f.Write(entry)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return d.prune()
+}
+
+// prune removes the oldest files while all files together exceed maxBytes, keeping the current one.
+func (d *Dir) prune() error {
+	if d.maxBytes <= 0 {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(d.dir, "deadletter-*"+FileSuffix))
+	if err != nil {
+		return err
+	}
+	// the names sort chronologically
+	sort.Strings(files)
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+	for i := 0; i < len(files)-1 && total > d.maxBytes; i++ {
+		if err := os.Remove(files[i]); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, h Header) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, len(Magic)+4+len(data))
+	buf = append(buf, Magic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	_, err = w.Write(append(buf, data...))
+	return err
+}
+
+func encodeEntry(payload []byte) []byte {
+	buf := make([]byte, 0, 8+len(payload))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(payload, castagnoli))
+	return append(buf, payload...)
+}
+
+// Write writes a dead letter file with the header and the requests to w.
+func Write(w io.Writer, h Header, requests ...*prompb.WriteRequest) error {
+	if err := writeHeader(w, h); err != nil {
+		return err
+	}
+	for _, req := range requests {
+		data, err := proto.Marshal(req)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(encodeEntry(snappy.Encode(nil, data))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read reads a dead letter file, passing each request to f, and returns the header and the number of corrupt
+// entries skipped. Entries failing their checksum or not decoding are skipped; a truncated entry or an
+// implausible length ends the file, counting as one corrupt entry. Reading stops at the first error of f.
+func Read(r io.Reader, f func(req *prompb.WriteRequest) error) (Header, int, error) {
+	var h Header
+	br := bufio.NewReader(r)
+	prefix := make([]byte, len(Magic)+4)
+	if _, err := io.ReadFull(br, prefix); err != nil || string(prefix[:len(Magic)]) != Magic {
+		return h, 0, ErrNotDeadLetter
+	}
+	data := make([]byte, binary.BigEndian.Uint32(prefix[len(Magic):]))
+	if _, err := io.ReadFull(br, data); err != nil {
+		return h, 0, fmt.Errorf("error reading the header: %w", err)
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, 0, fmt.Errorf("error decoding the header: %w", err)
+	}
+	corrupt := 0
+	entryHeader := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(br, entryHeader); err == io.EOF {
+			return h, corrupt, nil
+		} else if err != nil {
+			return h, corrupt + 1, nil
+		}
+		length := binary.BigEndian.Uint32(entryHeader)
+		if length > maxEntryBytes {
+			return h, corrupt + 1, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return h, corrupt + 1, nil
+		}
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(entryHeader[4:]) {
+			corrupt++
+			continue
+		}
+		decoded, err := snappy.Decode(nil, payload)
+		if err != nil {
+			corrupt++
+			continue
+		}
+		var req prompb.WriteRequest
+		if err := proto.Unmarshal(decoded, &req); err != nil {
+			corrupt++
+			continue
+		}
+		if err := f(&req); err != nil {
+			return h, corrupt, err
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package deadletter
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func testRequest(value float64) *prompb.WriteRequest {
+	return &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+		Samples: []prompb.Sample{{Value: value, Timestamp: 1000}},
+	}}}
+}
+
+func readAll(t *testing.T, data []byte) (Header, []*prompb.WriteRequest, int) {
+	t.Helper()
+	var requests []*prompb.WriteRequest
+	h, corrupt, err := Read(bytes.NewReader(data), func(req *prompb.WriteRequest) error {
+		requests = append(requests, req)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, requests, corrupt
+}
+
+func TestRoundTrip(t *testing.T) {
+	header := Header{Version: "0.4.1", Created: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+	requests := []*prompb.WriteRequest{testRequest(1), testRequest(2)}
+	var buf bytes.Buffer
+	if err := Write(&buf, header, requests...); err != nil {
+		t.Fatal(err)
+	}
+	h, read, corrupt := readAll(t, buf.Bytes())
+	if h != header {
+		t.Errorf("Expected header %+v, got %+v", header, h)
+	}
+	if corrupt != 0 || !reflect.DeepEqual(read, requests) {
+		t.Errorf("Expected %v without corrupt entries, got %v and %d corrupt", requests, read, corrupt)
+	}
+}
+
+func TestReadCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, Header{}, testRequest(1), testRequest(2)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	var header bytes.Buffer
+	if err := Write(&header, Header{}); err != nil {
+		t.Fatal(err)
+	}
+	// the first byte of the payload of the first entry
+	first := header.Len() + 8
+
+	for _, c := range []struct {
+		name     string
+		data     func() []byte
+		requests int
+		corrupt  int
+	}{
+		{"checksum", func() []byte {
+			corrupted := bytes.Clone(data)
+			corrupted[first] ^= 0xff
+			return corrupted
+		}, 1, 1},
+		{"truncated", func() []byte { return data[:len(data)-3] }, 1, 1},
+		{"truncated length", func() []byte { return append(bytes.Clone(data), 0, 0) }, 2, 1},
+		{"implausible length", func() []byte { return append(bytes.Clone(data), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0) }, 2, 1},
+	} {
+		_, read, corrupt := readAll(t, c.data())
+		if len(read) != c.requests || corrupt != c.corrupt {
+			t.Errorf("%s: expected %d requests and %d corrupt entries, got %d and %d", c.name, c.requests, c.corrupt, len(read), corrupt)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	if _, _, err := Read(strings.NewReader("{\"time\": 1}\n"), nil); err != ErrNotDeadLetter {
+		t.Errorf("Expected %v, got %v", ErrNotDeadLetter, err)
+	}
+
+	// reading stops at the first error of f
+	var buf bytes.Buffer
+	if err := Write(&buf, Header{}, testRequest(1), testRequest(2)); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	failed := errors.New("connection refused")
+	_, _, err := Read(&buf, func(req *prompb.WriteRequest) error {
+		calls++
+		return failed
+	})
+	if err != failed || calls != 1 {
+		t.Errorf("Expected reading to stop at the first error, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "deadletter")
+	d, err := NewDir(dir, 0, "0.4.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if err := d.add(testRequest(float64(i)), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "deadletter-20261016-12"+FileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, read, corrupt := readAll(t, data)
+	if h.Version != "0.4.1" || !h.Created.Equal(now) {
+		t.Errorf("Expected the header of the first request, got %+v", h)
+	}
+	if len(read) != 2 || corrupt != 0 {
+		t.Errorf("Expected 2 requests appended to the file, got %d and %d corrupt", len(read), corrupt)
+	}
+}
+
+func TestDirPrune(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDir(dir, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := d.add(testRequest(1), now.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+FileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the current file is kept even if it exceeds the maximum alone
+	if want := []string{filepath.Join(dir, "deadletter-20261016-14"+FileSuffix)}; !reflect.DeepEqual(files, want) {
+		t.Errorf("Expected %v, got %v", want, files)
+	}
+}
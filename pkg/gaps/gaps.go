@@ -0,0 +1,299 @@
+// Package gaps watches the series matching rules for their samples to stop arriving, eg. because their
+// exporter died, without an absent() alerting rule per metric.
+package gaps
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// Defaults of the rules
+const (
+	DefaultTolerance   = 3
+	DefaultMaxSeries   = 10000
+	DefaultForgetAfter = 24 * time.Hour
+)
+
+var (
+	// Missing is the number of series of each rule that stopped arriving.
+	Missing = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "series_missing",
+			Help: "Number of series tracked by each gap detection rule that haven't been seen for the tolerance times their expected interval.",
+		},
+		[]string{"rule"},
+	)
+	// Untracked counts the new series of each rule that weren't tracked, as the rule tracks its maximum.
+	Untracked = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "series_missing_untracked_total",
+			Help: "Total number of series matching a gap detection rule that weren't tracked, as the rule tracked its maximum number of series already.",
+		},
+		[]string{"rule"},
+	)
+)
+
+// Rule watches the series matching any of its selectors.
+type Rule struct {
+	Name  string   `yaml:"name"`
+	Match []string `yaml:"match"`
+	// Interval is the expected interval between the samples of a series, eg. its scrape interval.
+	Interval model.Duration `yaml:"interval"`
+	// Tolerance is the number of intervals without samples after which a series is missing.
+	Tolerance float64 `yaml:"tolerance"`
+	// MaxSeries bounds the series tracked, new series beyond it are counted in Untracked.
+	MaxSeries int `yaml:"max_series"`
+	// ForgetAfter is how long a missing series is tracked, after which it stops counting as missing.
+	ForgetAfter model.Duration `yaml:"forget_after"`
+
+	selectors [][]*labels.Matcher
+}
+
+// Config is the gap detection configuration file.
+type Config struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Parse reads a gap detection configuration.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for i, rule := range cfg.Rules {
+		if rule == nil || rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (r *Rule) validate() error {
+	if len(r.Match) == 0 {
+		return errors.New("no match selectors")
+	}
+	for _, s := range r.Match {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return fmt.Errorf("invalid selector %q: %w", s, err)
+		}
+		r.selectors = append(r.selectors, matchers)
+	}
+	if r.Interval <= 0 {
+		return errors.New("the interval must be positive")
+	}
+	switch {
+	case r.Tolerance == 0:
+		r.Tolerance = DefaultTolerance
+	case r.Tolerance < 1:
+		return errors.New("the tolerance must be at least 1")
+	}
+	switch {
+	case r.MaxSeries == 0:
+		r.MaxSeries = DefaultMaxSeries
+	case r.MaxSeries < 0:
+		return errors.New("the maximum number of series must not be negative")
+	}
+	switch {
+	case r.ForgetAfter == 0:
+		r.ForgetAfter = model.Duration(DefaultForgetAfter)
+	case r.ForgetAfter < 0:
+		return errors.New("forget_after must not be negative")
+	}
+	return nil
+}
+
+// Load reads the gap detection configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// threshold is the time without samples after which a series of the rule is missing.
+func (r *Rule) threshold() time.Duration {
+	return time.Duration(r.Tolerance * float64(r.Interval))
+}
+
+func (r *Rule) matches(metric model.Metric) bool {
+	for _, selector := range r.selectors {
+		matches := true
+		for _, m := range selector {
+			if !m.Matches(string(metric[model.LabelName(m.Name)])) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// series is a tracked series.
+type series struct {
+	metric   string
+	lastSeen time.Time
+	missing  bool
+}
+
+// ruleState tracks the series of a rule.
+type ruleState struct {
+	rule *Rule
+
+	mutex  sync.Mutex
+	series map[model.Fingerprint]*series
+}
+
+// Detector tracks when the series matching its rules were last seen. Observing only locks the states of the
+// rules matching samples, and the rules are swapped as a whole on reload.
+type Detector struct {
+	now   func() time.Time
+	rules atomic.Pointer[[]*ruleState]
+}
+
+// NewDetector returns a detector for the rules of cfg.
+func NewDetector(cfg *Config) *Detector {
+	d := &Detector{now: time.Now}
+	d.SetConfig(cfg)
+	return d
+}
+
+// SetConfig replaces the rules, forgetting all tracked series.
+func (d *Detector) SetConfig(cfg *Config) {
+	states := make([]*ruleState, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		states = append(states, &ruleState{rule: rule, series: map[model.Fingerprint]*series{}})
+	}
+	d.rules.Store(&states)
+	Missing.Reset()
+	Untracked.Reset()
+	for _, rule := range cfg.Rules {
+		Missing.WithLabelValues(rule.Name)
+		Untracked.WithLabelValues(rule.Name)
+	}
+}
+
+// Observe records the samples of the series matching the rules as seen now. Series are tracked by arrival
+// rather than by timestamp, so that a sender catching up doesn't make them look missing.
+func (d *Detector) Observe(samples model.Samples) {
+	now := d.now()
+	for _, state := range *d.rules.Load() {
+		state.observe(samples, now)
+	}
+}
+
+func (s *ruleState) observe(samples model.Samples, now time.Time) {
+	locked := false
+	for _, sample := range samples {
+		if !s.rule.matches(sample.Metric) {
+			continue
+		}
+		if !locked {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			locked = true
+		}
+		fp := sample.Metric.Fingerprint()
+		if tracked, ok := s.series[fp]; ok {
+			if tracked.missing {
+				tracked.missing = false
+				log.Info("msg", "Missing series arriving again", "rule", s.rule.Name, "series", tracked.metric, "missing_for", now.Sub(tracked.lastSeen))
+			}
+			tracked.lastSeen = now
+			continue
+		}
+		if len(s.series) >= s.rule.MaxSeries {
+			Untracked.WithLabelValues(s.rule.Name).Inc()
+			continue
+		}
+		s.series[fp] = &series{metric: sample.Metric.String(), lastSeen: now}
+	}
+}
+
+// Check updates Missing, logging the series that went missing since the last check and forgetting those
+// missing for longer than ForgetAfter.
+func (d *Detector) Check() {
+	now := d.now()
+	for _, state := range *d.rules.Load() {
+		Missing.WithLabelValues(state.rule.Name).Set(float64(state.check(now)))
+	}
+}
+
+func (s *ruleState) check(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	missing := 0
+	threshold := s.rule.threshold()
+	for fp, tracked := range s.series {
+		since := now.Sub(tracked.lastSeen)
+		if since < threshold {
+			continue
+		}
+		if since >= threshold+time.Duration(s.rule.ForgetAfter) {
+			log.Info("msg", "Forgetting missing series", "rule", s.rule.Name, "series", tracked.metric, "last_seen", tracked.lastSeen)
+			delete(s.series, fp)
+			continue
+		}
+		if !tracked.missing {
+			tracked.missing = true
+			log.Warn("msg", "Series stopped arriving", "rule", s.rule.Name, "series", tracked.metric, "last_seen", tracked.lastSeen, "expected_interval", s.rule.Interval)
+		}
+		missing++
+	}
+	return missing
+}
+
+// CheckInterval returns the interval at which Check should run: a tenth of the shortest interval of the
+// rules, at least a second.
+func (d *Detector) CheckInterval() time.Duration {
+	interval := time.Minute
+	for _, state := range *d.rules.Load() {
+		if i := time.Duration(state.rule.Interval) / 10; i < interval {
+			interval = i
+		}
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// Run checks every CheckInterval, forever. The interval follows the rules as reloaded.
+func (d *Detector) Run() {
+	for {
+		time.Sleep(d.CheckInterval())
+		d.Check()
+	}
+}
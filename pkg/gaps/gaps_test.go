@@ -0,0 +1,136 @@
+package gaps
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+func init() {
+	log.Init("debug")
+}
+
+func samplesOf(name string, series int) model.Samples {
+	var samples model.Samples
+	for i := 0; i < series; i++ {
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(name), "instance": model.LabelValue(fmt.Sprint(i))}
+		samples = append(samples, &model.Sample{Metric: metric})
+	}
+	return samples
+}
+
+func newTestDetector(t *testing.T, config string) (*Detector, *time.Time) {
+	t.Helper()
+	cfg, err := Parse([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDetector(cfg)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time {
+		return now
+	}
+	return d, &now
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]string{
+		"unknown field":       "rules:\n- name: a\n  match: [up]\n  interval: 15s\n  every: 1m\n",
+		"no name":             "rules:\n- match: [up]\n  interval: 15s\n",
+		"duplicate name":      "rules:\n- name: a\n  match: [up]\n  interval: 15s\n- name: a\n  match: [up]\n  interval: 15s\n",
+		"no selector":         "rules:\n- name: a\n  interval: 15s\n",
+		"invalid selector":    "rules:\n- name: a\n  match: ['up{']\n  interval: 15s\n",
+		"no interval":         "rules:\n- name: a\n  match: [up]\n",
+		"low tolerance":       "rules:\n- name: a\n  match: [up]\n  interval: 15s\n  tolerance: 0.5\n",
+		"negative maximum":    "rules:\n- name: a\n  match: [up]\n  interval: 15s\n  max_series: -1\n",
+		"negative forgetting": "rules:\n- name: a\n  match: [up]\n  interval: 15s\n  forget_after: -1h\n",
+	}
+	for name, config := range testCases {
+		if _, err := Parse([]byte(config)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	cfg, err := Parse([]byte("rules:\n- name: a\n  match: [up]\n  interval: 15s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := cfg.Rules[0]; r.Tolerance != DefaultTolerance || r.MaxSeries != DefaultMaxSeries || time.Duration(r.ForgetAfter) != DefaultForgetAfter {
+		t.Errorf("Unexpected defaults %+v", r)
+	}
+}
+
+func TestMissingSeries(t *testing.T) {
+	d, now := newTestDetector(t, "rules:\n- name: node\n  match: ['up{job=\"node\"}', node_load1]\n  interval: 10s\n  forget_after: 1h\n")
+	samples := samplesOf("node_load1", 2)
+	samples = append(samples, &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node"}})
+	samples = append(samples, &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "job": "other"}})
+	d.Observe(samples)
+	if n := len((*d.rules.Load())[0].series); n != 3 {
+		t.Fatalf("Expected the 3 matching series to be tracked, got %d", n)
+	}
+
+	*now = now.Add(20 * time.Second)
+	d.Observe(samples[:1])
+	d.Check()
+	if v := testutil.ToFloat64(Missing.WithLabelValues("node")); v != 0 {
+		t.Errorf("Expected no series missing within the tolerance, got %v", v)
+	}
+	*now = now.Add(15 * time.Second)
+	d.Check()
+	if v := testutil.ToFloat64(Missing.WithLabelValues("node")); v != 2 {
+		t.Errorf("Expected 2 series missing, got %v", v)
+	}
+	d.Observe(samples[1:2])
+	d.Check()
+	if v := testutil.ToFloat64(Missing.WithLabelValues("node")); v != 1 {
+		t.Errorf("Expected the series seen again not to be missing, got %v", v)
+	}
+
+	*now = now.Add(2 * time.Hour)
+	d.Check()
+	if n, v := len((*d.rules.Load())[0].series), testutil.ToFloat64(Missing.WithLabelValues("node")); n != 0 || v != 0 {
+		t.Errorf("Expected the series missing for longer than forget_after to be forgotten, got %d tracked and %v missing", n, v)
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	d, _ := newTestDetector(t, "rules:\n- name: up\n  match: [up]\n  interval: 10s\n  max_series: 2\n")
+	d.Observe(samplesOf("up", 3))
+	d.Observe(samplesOf("up", 3))
+	if n := len((*d.rules.Load())[0].series); n != 2 {
+		t.Errorf("Expected 2 tracked series, got %d", n)
+	}
+	if v := testutil.ToFloat64(Untracked.WithLabelValues("up")); v != 2 {
+		t.Errorf("Expected the third series to be counted as untracked twice, got %v", v)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	d, now := newTestDetector(t, "rules:\n- name: up\n  match: [up]\n  interval: 10s\n")
+	d.Observe(samplesOf("up", 1))
+	*now = now.Add(time.Minute)
+	d.Check()
+	if v := testutil.ToFloat64(Missing.WithLabelValues("up")); v != 1 {
+		t.Fatalf("Expected 1 series missing, got %v", v)
+	}
+	cfg, err := Parse([]byte("rules:\n- name: load\n  match: [node_load1]\n  interval: 1s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.SetConfig(cfg)
+	if n := testutil.CollectAndCount(Missing); n != 1 {
+		t.Errorf("Expected the gauges of the previous rules to be removed, got %d", n)
+	}
+	d.Check()
+	if v := testutil.ToFloat64(Missing.WithLabelValues("load")); v != 0 {
+		t.Errorf("Expected the tracked series to be forgotten, got %v missing", v)
+	}
+	if interval := d.CheckInterval(); interval != time.Second {
+		t.Errorf("Expected a check interval of 1s, got %v", interval)
+	}
+}
@@ -1,40 +1,67 @@
 package log
 
 import (
+	"sync/atomic"
+
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/promlog"
 )
 
 var (
-	// Application wide logger
-	logger log.Logger
+	// Application wide logger, replaced by SetLevel
+	logger atomic.Value
 )
 
+type holder struct {
+	log.Logger
+}
+
 func Init(logLevel string) {
 	allowedLevel := promlog.AllowedLevel{}
 	_ = allowedLevel.Set(logLevel)
+	setLogger(&allowedLevel)
+}
+
+// ValidateLevel checks that logLevel is a known log level.
+func ValidateLevel(logLevel string) error {
+	return (&promlog.AllowedLevel{}).Set(logLevel)
+}
 
+// SetLevel replaces the logger with one logging from logLevel on. Unlike Init, it fails on unknown levels.
+func SetLevel(logLevel string) error {
+	allowedLevel := promlog.AllowedLevel{}
+	if err := allowedLevel.Set(logLevel); err != nil {
+		return err
+	}
+	setLogger(&allowedLevel)
+	return nil
+}
+
+func setLogger(allowedLevel *promlog.AllowedLevel) {
 	config := promlog.Config{
-		Level:  &allowedLevel,
+		Level:  allowedLevel,
 		Format: &promlog.AllowedFormat{},
 	}
+	logger.Store(holder{promlog.New(&config)})
+}
 
-	logger = promlog.New(&config)
+func current() log.Logger {
+	return logger.Load().(holder).Logger
 }
 
 func Debug(keyvals ...interface{}) {
-	_ = level.Debug(logger).Log(keyvals...)
+	_ = level.Debug(current()).Log(keyvals...)
 }
 
 func Info(keyvals ...interface{}) {
-	_ = level.Info(logger).Log(keyvals...)
+	_ = level.Info(current()).Log(keyvals...)
 }
 
 func Warn(keyvals ...interface{}) {
-	_ = level.Warn(logger).Log(keyvals...)
+	_ = level.Warn(current()).Log(keyvals...)
 }
 
 func Error(keyvals ...interface{}) {
-	_ = level.Error(logger).Log(keyvals...)
+	_ = level.Error(current()).Log(keyvals...)
 }
@@ -0,0 +1,156 @@
+package pgprometheus
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// States of the circuit breaker, as values of the CircuitState gauge.
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// ErrCircuitOpen is the error of writes while the circuit breaker is open after consecutive connection
+// failures.
+var ErrCircuitOpen = errors.New("the database is unreachable, writes fail fast until the circuit breaker closes")
+
+// circuitOpenError is ErrCircuitOpen along with the remaining cool-down of the circuit breaker.
+type circuitOpenError struct {
+	cooldown time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return ErrCircuitOpen.Error()
+}
+
+func (e *circuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// RetryAfter returns the remaining cool-down, after which a write probes the database.
+func (e *circuitOpenError) RetryAfter() time.Duration {
+	return e.cooldown
+}
+
+// CircuitState is the state of the circuit breaker in front of database writes.
+var CircuitState = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "storage_circuit_state",
+		Help: "State of the circuit breaker in front of database writes: 0 closed, 1 open (writes fail fast), 2 half-open (a probe write is in flight).",
+	},
+)
+
+var circuitStateNames = map[int]string{circuitClosed: "closed", circuitOpen: "open", circuitHalfOpen: "half-open"}
+
+// circuitBreaker opens after threshold consecutive writes failed to reach the database, failing writes right
+// away for the cool-down. The first write after the cool-down probes the database, closing the breaker if it
+// gets through and opening it again otherwise.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mutex    sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	CircuitState.Set(circuitClosed)
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow tells whether a write may go ahead. Each allowed write must be followed by a call to done.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.transition(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		// only the probe goes through
+		return false
+	default:
+		return true
+	}
+}
+
+// done records the outcome of an allowed write. Only errors reaching the database count as failures.
+func (b *circuitBreaker) done(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !isConnectionError(err) {
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.transition(circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.transition(circuitOpen)
+	}
+}
+
+// open tells whether writes currently fail fast.
+func (b *circuitBreaker) open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state != circuitClosed
+}
+
+// openError returns the error of writes failing fast, with the remaining cool-down. While half-open, the
+// cool-down is over.
+func (b *circuitBreaker) openError() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	remaining := b.cooldown - b.now().Sub(b.openedAt)
+	if b.state != circuitOpen || remaining < 0 {
+		remaining = 0
+	}
+	return &circuitOpenError{cooldown: remaining}
+}
+
+func (b *circuitBreaker) transition(state int) {
+	from := circuitStateNames[b.state]
+	b.state = state
+	CircuitState.Set(float64(state))
+	switch state {
+	case circuitOpen:
+		log.Warn("msg", "Circuit breaker opened, writes fail fast", "from", from, "consecutive_failures", b.failures, "cooldown", b.cooldown)
+	case circuitHalfOpen:
+		log.Info("msg", "Circuit breaker half-open, probing the database with the next write")
+	default:
+		log.Info("msg", "Circuit breaker closed, writes resume", "from", from)
+	}
+}
+
+// isConnectionError tells whether a write failed for not getting through to the database, as opposed to the
+// database refusing it. Statements canceled by the statement timeout don't count, the database is up then.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// 57P01 admin_shutdown, 57P02 crash_shutdown, 57P03 cannot_connect_now
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P")
+	}
+	class, _ := ClassifyError(err)
+	return class == ErrorClassNetwork || class == ErrorClassTimeout
+}
@@ -0,0 +1,123 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker(3, 30*time.Second)
+	b.now = func() time.Time { return now }
+	down := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("Expected write %d to be allowed", i)
+		}
+		b.done(down)
+	}
+	// a write refused by the database resets the count
+	b.allow()
+	b.done(&pgconn.PgError{Code: "22P02"})
+	for i := 0; i < 3; i++ {
+		b.allow()
+		b.done(down)
+	}
+	if b.allow() {
+		t.Fatal("Expected the breaker to open after 3 consecutive connection failures")
+	}
+	if state := testutil.ToFloat64(CircuitState); state != circuitOpen {
+		t.Errorf("Expected the open state, got %v", state)
+	}
+	now = now.Add(10 * time.Second)
+	var retry interface{ RetryAfter() time.Duration }
+	if err := b.openError(); !errors.Is(err, ErrCircuitOpen) || !errors.As(err, &retry) || retry.RetryAfter() != 20*time.Second {
+		t.Errorf("Expected the remaining cool-down of 20s, got %v", err)
+	}
+
+	now = now.Add(20 * time.Second)
+	if !b.allow() {
+		t.Fatal("Expected a probe write after the cool-down")
+	}
+	if b.allow() {
+		t.Error("Expected a single probe write while half-open")
+	}
+	if state := testutil.ToFloat64(CircuitState); state != circuitHalfOpen {
+		t.Errorf("Expected the half-open state, got %v", state)
+	}
+	b.done(context.DeadlineExceeded)
+	if b.allow() {
+		t.Fatal("Expected the breaker to open again after a failed probe")
+	}
+
+	now = now.Add(30 * time.Second)
+	b.allow()
+	b.done(nil)
+	if !b.allow() || b.open() {
+		t.Error("Expected the breaker to close after a successful probe")
+	}
+	if state := testutil.ToFloat64(CircuitState); state != circuitClosed {
+		t.Errorf("Expected the closed state, got %v", state)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	for _, c := range []struct {
+		err        error
+		connection bool
+	}{
+		{err: nil, connection: false},
+		{err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, connection: true},
+		{err: fmt.Errorf("copy: %w", context.DeadlineExceeded), connection: true},
+		{err: &pgconn.PgError{Code: "08006"}, connection: true},
+		{err: &pgconn.PgError{Code: "57P03"}, connection: true},
+		// statement timeout
+		{err: &pgconn.PgError{Code: "57014"}, connection: false},
+		{err: &pgconn.PgError{Code: "23505"}, connection: false},
+		{err: context.Canceled, connection: false},
+		{err: ErrStorageFull, connection: false},
+	} {
+		if connection := isConnectionError(c.err); connection != c.connection {
+			t.Errorf("%v: expected connection error %v, got %v", c.err, c.connection, connection)
+		}
+	}
+}
+
+func TestWriteCircuitOpen(t *testing.T) {
+	db, err := sql.Open("pgx", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	client := &Client{DB: db, cfg: cfg, labels: &jsonbLabelStore{table: "metrics"}, staging: stagingTable(cfg), breaker: newCircuitBreaker(2, time.Minute)}
+	samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1, Timestamp: 1}}
+	for i := 0; i < 2; i++ {
+		if err := client.Write(samples); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Expected write %d to fail on the connection, got %v", i, err)
+		}
+	}
+	begin := time.Now()
+	if err := client.Write(samples); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected the write to fail fast, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected the write to fail right away, took %v", elapsed)
+	}
+	if err := client.HealthCheck(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected the health check to report the open breaker, got %v", err)
+	}
+	if class, _ := ClassifyError(ErrCircuitOpen); class != ErrorClassCircuitOpen {
+		t.Errorf("Expected class %q, got %q", ErrorClassCircuitOpen, class)
+	}
+}
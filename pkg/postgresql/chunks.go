@@ -0,0 +1,194 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const (
+	// chunkMemoryShare is the share of shared_buffers a chunk of the values table should fit in, with its
+	// indexes, following the TimescaleDB best practice of 25% of the memory.
+	chunkMemoryShare = 0.25
+	// minChunkInterval and maxChunkInterval bound the recommended chunk interval: smaller chunks make for too
+	// many chunks, larger ones keep old data from being compressed and dropped in time.
+	minChunkInterval = time.Hour
+	maxChunkInterval = 28 * 24 * time.Hour
+	// chunkIntervalTolerance is the relative difference between the recommended and the current chunk
+	// interval below which the recommendation isn't applied, so that it doesn't change with every measurement.
+	chunkIntervalTolerance = 0.2
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlChunkInterval    = "select extract(epoch from time_interval)::bigint from timescaledb_information.dimensions where hypertable_schema = current_schema() and hypertable_name = $1 and column_name = 'time'"
+	sqlChunkRowWidth    = "select coalesce(hypertable_size(format('%I.%I', current_schema(), $1::text)::regclass), 0), approximate_row_count(format('%I.%I', current_schema(), $1::text)::regclass)"
+	sqlSharedBuffers    = "select pg_size_bytes(current_setting('shared_buffers'))"
+	sqlSetChunkInterval = "select set_chunk_time_interval(format('%I.%I', current_schema(), $1::text)::regclass, make_interval(secs => $2))"
+)
+
+// ChunkIntervalRecommendation is the chunk interval of the values hypertable recommended from the measured
+// ingest rate and row width, so that a chunk fits in a quarter of shared_buffers.
+type ChunkIntervalRecommendation struct {
+	CurrentSeconds     int64   `json:"currentSeconds"`
+	RecommendedSeconds int64   `json:"recommendedSeconds"`
+	SamplesPerSecond   float64 `json:"samplesPerSecond"`
+	// RowBytes is the average size of a row of the values hypertable, including its indexes. Compressed
+	// chunks make it smaller than the size of the rows of uncompressed chunks.
+	RowBytes           float64   `json:"rowBytes"`
+	SharedBuffersBytes int64     `json:"sharedBuffersBytes"`
+	MeasuredAt         time.Time `json:"measuredAt"`
+	// Applied tells whether the recommendation was set as the interval of future chunks.
+	Applied bool `json:"applied"`
+}
+
+// chunkMeasurement is what the chunk interval is recommended from.
+type chunkMeasurement struct {
+	// current is the chunk interval of the values table, 0 if it isn't a hypertable
+	current       time.Duration
+	tableBytes    int64
+	rows          int64
+	sharedBuffers int64
+}
+
+// recommendChunkInterval returns the chunk interval at which the rows written at samplesPerSecond, of
+// rowBytes each, fill chunkMemoryShare of sharedBuffers, in whole hours between minChunkInterval and
+// maxChunkInterval.
+func recommendChunkInterval(samplesPerSecond float64, rowBytes float64, sharedBuffers int64) time.Duration {
+	seconds := chunkMemoryShare * float64(sharedBuffers) / (samplesPerSecond * rowBytes)
+	if seconds >= maxChunkInterval.Seconds() {
+		return maxChunkInterval
+	}
+	interval := (time.Duration(seconds) * time.Second).Truncate(time.Hour)
+	if interval < minChunkInterval {
+		return minChunkInterval
+	}
+	return interval
+}
+
+// chunkAdvisor measures the ingest rate every interval and recommends a chunk interval for the values
+// hypertable, logging it. With apply, it sets the recommendation as the interval of future chunks, which
+// leaves the existing chunks alone.
+type chunkAdvisor struct {
+	interval time.Duration
+	apply    bool
+	// committed returns the number of samples committed so far
+	committed func() int64
+	measure   func(ctx context.Context) (chunkMeasurement, error)
+	set       func(ctx context.Context, interval time.Duration) error
+
+	lastCommitted int64
+	lastTime      time.Time
+	latest        atomic.Pointer[ChunkIntervalRecommendation]
+}
+
+// run measures the ingest rate every interval until stop is closed.
+func (a *chunkAdvisor) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	a.lastCommitted, a.lastTime = a.committed(), time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), a.interval)
+			if err := a.advise(ctx, now); err != nil {
+				log.Warn("msg", "Error recommending a chunk interval", "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// advise recommends a chunk interval from the samples committed since the previous call. Without samples,
+// or if the values table isn't a hypertable, there is no recommendation.
+func (a *chunkAdvisor) advise(ctx context.Context, now time.Time) error {
+	committed := a.committed()
+	elapsed := now.Sub(a.lastTime).Seconds()
+	samples := committed - a.lastCommitted
+	a.lastCommitted, a.lastTime = committed, now
+	if samples <= 0 || elapsed <= 0 {
+		return nil
+	}
+	m, err := a.measure(ctx)
+	if err != nil {
+		return err
+	}
+	if m.current <= 0 {
+		log.Debug("msg", "The values table isn't a hypertable, no chunk interval is recommended")
+		return nil
+	}
+	if m.rows <= 0 || m.tableBytes <= 0 || m.sharedBuffers <= 0 {
+		return nil
+	}
+	r := &ChunkIntervalRecommendation{
+		CurrentSeconds:     int64(m.current.Seconds()),
+		SamplesPerSecond:   float64(samples) / elapsed,
+		RowBytes:           float64(m.tableBytes) / float64(m.rows),
+		SharedBuffersBytes: m.sharedBuffers,
+		MeasuredAt:         now,
+	}
+	recommended := recommendChunkInterval(r.SamplesPerSecond, r.RowBytes, m.sharedBuffers)
+	r.RecommendedSeconds = int64(recommended.Seconds())
+	off := math.Abs(recommended.Seconds()-m.current.Seconds())/m.current.Seconds() > chunkIntervalTolerance
+	if a.apply && off {
+		if err := a.set(ctx, recommended); err != nil {
+			a.latest.Store(r)
+			return fmt.Errorf("error setting the chunk interval: %w", err)
+		}
+		r.Applied = true
+		log.Info("msg", "Set the recommended chunk interval for future chunks", "previous", m.current, "interval", recommended)
+	} else if off {
+		log.Info("msg", "The chunk interval of the values table differs from the recommended one", "current", m.current, "recommended", recommended,
+			"samples_per_second", r.SamplesPerSecond, "row_bytes", r.RowBytes, "shared_buffers_bytes", m.sharedBuffers)
+	}
+	a.latest.Store(r)
+	return nil
+}
+
+// measureChunks looks up the chunk interval, size and row count of the values hypertable and the size of
+// shared_buffers. Without TimescaleDB, or if the values table isn't a hypertable, the measurement is empty.
+func (c *Client) measureChunks(ctx context.Context) (chunkMeasurement, error) {
+	var m chunkMeasurement
+	var timescale bool
+	if err := c.DB.QueryRowContext(ctx, sqlStatsTimescale).Scan(&timescale); err != nil || !timescale {
+		return m, err
+	}
+	table := c.cfg.Table + "_values"
+	var seconds int64
+	err := c.DB.QueryRowContext(ctx, sqlChunkInterval, table).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("error looking up the chunk interval: %w", err)
+	}
+	m.current = time.Duration(seconds) * time.Second
+	if err := c.DB.QueryRowContext(ctx, sqlChunkRowWidth, table).Scan(&m.tableBytes, &m.rows); err != nil {
+		return m, fmt.Errorf("error measuring the values table: %w", err)
+	}
+	if err := c.DB.QueryRowContext(ctx, sqlSharedBuffers).Scan(&m.sharedBuffers); err != nil {
+		return m, fmt.Errorf("error looking up shared_buffers: %w", err)
+	}
+	return m, nil
+}
+
+// setChunkInterval sets the interval of the future chunks of the values hypertable.
+func (c *Client) setChunkInterval(ctx context.Context, interval time.Duration) error {
+	_, err := c.DB.ExecContext(ctx, sqlSetChunkInterval, c.cfg.Table+"_values", interval.Seconds())
+	return err
+}
+
+// chunkIntervalArg returns the chunk_time_interval argument of create_hypertable, empty for the default.
+func chunkIntervalArg(interval time.Duration) string {
+	if interval <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(", chunk_time_interval => interval '%d seconds'", int64(interval.Seconds()))
+}
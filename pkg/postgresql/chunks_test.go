@@ -0,0 +1,147 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecommendChunkInterval(t *testing.T) {
+	const sharedBuffers = 8 << 30
+	for _, c := range []struct {
+		samplesPerSecond float64
+		rowBytes         float64
+		expected         time.Duration
+	}{
+		// 2 GiB at 1 MB/s fill up in 36 minutes
+		{samplesPerSecond: 10000, rowBytes: 100, expected: minChunkInterval},
+		// 2 GiB at 50 kB/s fill up in 11.9 hours
+		{samplesPerSecond: 1000, rowBytes: 50, expected: 11 * time.Hour},
+		// 2 GiB at 1 kB/s fill up in 24.9 days
+		{samplesPerSecond: 10, rowBytes: 100, expected: 596 * time.Hour},
+		{samplesPerSecond: 1, rowBytes: 100, expected: maxChunkInterval},
+	} {
+		if got := recommendChunkInterval(c.samplesPerSecond, c.rowBytes, sharedBuffers); got != c.expected {
+			t.Errorf("%v samples/s of %v bytes: expected %v, got %v", c.samplesPerSecond, c.rowBytes, c.expected, got)
+		}
+	}
+}
+
+// fakeChunks is the values hypertable of a chunk advisor.
+type fakeChunks struct {
+	committed   int64
+	measurement chunkMeasurement
+	measured    int
+	set         []time.Duration
+	setErr      error
+}
+
+func (f *fakeChunks) advisor(apply bool, now time.Time) *chunkAdvisor {
+	return &chunkAdvisor{
+		apply: apply,
+		committed: func() int64 {
+			return f.committed
+		},
+		measure: func(context.Context) (chunkMeasurement, error) {
+			f.measured++
+			return f.measurement, nil
+		},
+		set: func(_ context.Context, interval time.Duration) error {
+			if f.setErr != nil {
+				return f.setErr
+			}
+			f.set = append(f.set, interval)
+			return nil
+		},
+		lastTime: now,
+	}
+}
+
+func TestChunkAdvisor(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	// 50 bytes per row, 2 GiB per chunk at 1000 samples per second take 11 hours
+	f := &fakeChunks{measurement: chunkMeasurement{current: 7 * 24 * time.Hour, tableBytes: 5e9, rows: 1e8, sharedBuffers: 8 << 30}}
+	a := f.advisor(false, now)
+
+	// without writes, there is nothing to measure
+	now = now.Add(time.Hour)
+	if err := a.advise(ctx, now); err != nil || f.measured != 0 || a.latest.Load() != nil {
+		t.Fatalf("Expected no recommendation without writes, got %v", err)
+	}
+
+	f.committed += 3600 * 1000
+	now = now.Add(time.Hour)
+	if err := a.advise(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	r := a.latest.Load()
+	if r == nil || r.RecommendedSeconds != 11*3600 || r.CurrentSeconds != 7*24*3600 || r.SamplesPerSecond != 1000 || r.RowBytes != 50 || r.Applied {
+		t.Fatalf("Unexpected recommendation %+v", r)
+	}
+	if len(f.set) != 0 {
+		t.Error("Expected the recommendation not to be applied")
+	}
+
+	a.apply = true
+	f.committed += 3600 * 1000
+	now = now.Add(time.Hour)
+	if err := a.advise(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.set) != 1 || f.set[0] != 11*time.Hour || !a.latest.Load().Applied {
+		t.Errorf("Expected the recommendation to be applied, got %v", f.set)
+	}
+
+	// close enough to the current interval, it isn't set again
+	f.measurement.current = 12 * time.Hour
+	f.committed += 3600 * 1000
+	now = now.Add(time.Hour)
+	if err := a.advise(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.set) != 1 || a.latest.Load().Applied {
+		t.Errorf("Expected a recommendation within the tolerance not to be applied, got %v", f.set)
+	}
+
+	f.measurement.current = 7 * 24 * time.Hour
+	f.setErr = errors.New("permission denied")
+	f.committed += 3600 * 1000
+	now = now.Add(time.Hour)
+	if err := a.advise(ctx, now); err == nil || a.latest.Load().Applied {
+		t.Error("Expected the failure to set the chunk interval to be reported")
+	}
+
+	// the values table is no hypertable
+	f.measurement = chunkMeasurement{}
+	f.committed += 3600 * 1000
+	previous := a.latest.Load()
+	if err := a.advise(ctx, now.Add(time.Hour)); err != nil || a.latest.Load() != previous {
+		t.Errorf("Expected no recommendation without hypertable, got %v", err)
+	}
+}
+
+func TestNormalizedChunkInterval(t *testing.T) {
+	for interval, expected := range map[time.Duration]string{
+		0:              "perform create_hypertable('metrics_values', 'time', if_not_exists => true)",
+		12 * time.Hour: "perform create_hypertable('metrics_values', 'time', chunk_time_interval => interval '43200 seconds', if_not_exists => true)",
+	} {
+		recording := &recordingDB{}
+		db := sql.OpenDB(recording)
+		store := &normalizedLabelStore{table: "metrics", chunkInterval: interval}
+		if _, err := store.ensureSchema(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		_ = db.Close()
+		found := false
+		for _, statement := range recording.recorded() {
+			found = found || strings.Contains(statement, expected)
+		}
+		if !found {
+			t.Errorf("Expected %s, got %v", expected, recording.recorded())
+		}
+	}
+}
@@ -1,283 +1,1136 @@
+// Package pgprometheus writes Prometheus samples to PostgreSQL and TimescaleDB.
+//
+// It can be embedded in other programs: build a Config, starting from DefaultConfig, create a Client with
+// NewClient, call EnsureSchema once, then Write batches of samples from any number of goroutines.
+// HealthCheck tells whether the database is reachable. Close releases the connections when done.
 package pgprometheus
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
+	"database/sql/driver"
 	"flag"
 	"fmt"
 	"github.com/jackc/pgx/v5"
 	"os"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/tracing"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
 
 	pgx_stdlib "github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Config for the database
+// Config for the database. Use DefaultConfig to get a configuration with the same defaults as the flags
+// registered by ParseFlags.
 type Config struct {
-	host                   string
-	port                   int
-	user                   string
-	passwordFile           string
-	database               string
-	schema                 string
-	sslMode                string
-	table                  string
-	maxOpenConns           int
-	maxIdleConns           int
-	pgPrometheusLogSamples bool
-	dbConnectRetries       int
+	// Host may be a comma-separated list of hosts, see TargetSessionAttrs.
+	Host     string
+	Port     int
+	User     string
+	Database string
+	// Schema is set as the search_path of the connections, the search_path of the user applies if empty.
+	Schema  string
+	SSLMode string
+	// SSLRootCert verifies the server certificate with the require, verify-ca and verify-full ssl modes.
+	// SSLCert and SSLKey are the client certificate and its key.
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	// PasswordFile is read before each new connection. Mutually exclusive with PasswordCommand.
+	PasswordFile string
+	// PasswordCommand is a shell command printing the password. It runs again after failed authentication.
+	PasswordCommand        string
+	PasswordCommandTimeout time.Duration
+	// Table is the prefix of the tables the samples are written to.
+	Table        string
+	MaxOpenConns int
+	MaxIdleConns int
+	// LowPriorityMaxOpenConns and LowPriorityMaxIdleConns size the separate pool of WriteLowPriority, which
+	// has at least one connection.
+	LowPriorityMaxOpenConns int
+	LowPriorityMaxIdleConns int
+	ConnMaxLifetime         time.Duration
+	ConnMaxIdleTime         time.Duration
+	ConnKeepalive           time.Duration
+	// WarmConnections is the number of connections WarmConnections opens, within WarmConnectionsTimeout.
+	WarmConnections        int
+	WarmConnectionsTimeout time.Duration
+	// LogSamples logs the raw samples to LogSamplesFile, or to stdout if that is empty.
+	LogSamples         bool
+	LogSamplesFile     string
+	LogSamplesMaxSize  int
+	LogSamplesKeep     int
+	ConnectRetries     int
+	TargetSessionAttrs string
+	// LabelStorage is the label storage layout, "jsonb" or "normalized".
+	LabelStorage string
+	// MetricNameInLabels includes __name__ in the labels jsonb of the jsonb layout, or in the labels of the
+	// view of the normalized layout. The metric_name column is populated either way.
+	MetricNameInLabels bool
+	// PromotedLabels is a comma-separated list of labels copied into columns of the labels table named after
+	// them, indexed and exposed by the view of the normalized layout. The labels stay in the jsonb too.
+	PromotedLabels      string
+	PartitionByMetric   bool
+	RejectOutOfOrder    bool
+	OutOfOrderTolerance time.Duration
+	WatermarkCacheSize  int
+	// LabelCacheSize is the number of series whose label sets are cached as stored, 0 disables the cache.
+	LabelCacheSize int
+	// LabelsReadOnly loads the labels table of the jsonb layout by EnsureSchema, failing if it holds more than
+	// LabelsReadOnlyMaxSeries label sets, and writes the samples of the loaded series to the values table
+	// directly, dropping the others, without inserting labels. The label sets are loaded again every
+	// LabelsReadOnlyRefreshInterval, if positive, and by ReloadLabels.
+	LabelsReadOnly                bool
+	LabelsReadOnlyMaxSeries       int
+	LabelsReadOnlyRefreshInterval time.Duration
+	StatsMetrics                  bool
+	StatsInterval                 time.Duration
+	StatsTimeout                  time.Duration
+	// StagingMode is "temp" for a temporary staging table per write, or "unlogged" for a persistent unlogged
+	// staging table per adapter, which works through transaction pooling.
+	StagingMode string
+	// StagingInstanceID suffixes the unlogged staging table. Defaults to the hostname.
+	StagingInstanceID string
+	// LateDataPolicy is what happens to samples before the newest compressed chunk: "write" them anyway,
+	// "drop" them or route them to the "overflow" table.
+	LateDataPolicy          string
+	LateDataRefreshInterval time.Duration
+	// SortBatch orders the samples of a write by series and time before they are copied.
+	SortBatch bool
+	// GroupCopyByMetric copies the samples of each metric of a write with a COPY of its own, for writes of at
+	// most GroupCopyMaxGroups metrics.
+	GroupCopyByMetric  bool
+	GroupCopyMaxGroups int
+	// CheckIndexes warns about missing indexes on startup, CreateMissingIndexes creates them in the background.
+	CheckIndexes         bool
+	CreateMissingIndexes bool
+	// PartialAccept retries writes failing on invalid data without the offending samples, which are rejected,
+	// bisecting the batch at most PartialAcceptMaxDepth times.
+	PartialAccept         bool
+	PartialAcceptMaxDepth int
+	// InvalidUTF8Policy is what happens to samples with label names or values that aren't valid UTF-8:
+	// invalid bytes are "replace"d with U+FFFD, values are "base64" encoded, or the samples are "drop"ped.
+	InvalidUTF8Policy string
+	// MaxDatabaseBytes and MaxDiskUsagePercent reject writes while the database size, or the usage of its
+	// volume reported by DiskUsageFunction, is over the limit. Writes resume once usage dropped below
+	// DiskGuardResumeRatio of the limit. 0 disables a limit.
+	MaxDatabaseBytes     int64
+	MaxDiskUsagePercent  float64
+	DiskUsageFunction    string
+	DiskGuardResumeRatio float64
+	DiskGuardInterval    time.Duration
+	// CircuitBreakerFailures is the number of consecutive writes failing to reach the database after which
+	// writes fail fast with ErrCircuitOpen for CircuitBreakerCooldown. 0 disables the circuit breaker.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+	// SynchronousCommit is the synchronous_commit of the write transactions, the server setting if empty.
+	SynchronousCommit string
+	// CommitVisibilityCheck makes writes check that their latest sample is visible to another connection
+	// after the commit, failing with ErrNotVisible otherwise.
+	CommitVisibilityCheck bool
+	// ClockSkewWarnThreshold is the difference between the database clock and the local clock from which a
+	// warning is logged, 0 disables it. The skew is measured by the health checks and every
+	// ClockSkewCheckInterval, if positive.
+	ClockSkewWarnThreshold time.Duration
+	ClockSkewCheckInterval time.Duration
+	// ChunkInterval is the chunk interval of the values hypertable when EnsureSchema creates it, the
+	// TimescaleDB default if 0.
+	ChunkInterval time.Duration
+	// ChunkAdvisorInterval is how often a chunk interval is recommended for the values hypertable from the
+	// ingest rate, 0 disables the recommendations. ApplyChunkRecommendation sets recommendations as the
+	// interval of future chunks.
+	ChunkAdvisorInterval     time.Duration
+	ApplyChunkRecommendation bool
+	// Provenance adds the first_seen, last_seen and written_by columns to the labels table, which writes
+	// update from the source of their context, see WithSource. A label set is updated at most once per
+	// ProvenanceInterval, unless written by a new source.
+	Provenance         bool
+	ProvenanceInterval time.Duration
 }
 
-// ParseFlags parses the configuration flags specific to PostgreSQL and TimescaleDB
+// DefaultConfig returns the default configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		Host:                          "localhost",
+		Port:                          5432,
+		User:                          "postgres",
+		Database:                      "postgres",
+		SSLMode:                       "disable",
+		PasswordCommandTimeout:        10 * time.Second,
+		Table:                         "metrics",
+		MaxOpenConns:                  50,
+		MaxIdleConns:                  10,
+		LowPriorityMaxOpenConns:       5,
+		LowPriorityMaxIdleConns:       1,
+		ConnMaxLifetime:               30 * time.Minute,
+		ConnMaxIdleTime:               5 * time.Minute,
+		WarmConnectionsTimeout:        30 * time.Second,
+		LabelStorage:                  labelStorageJsonb,
+		WatermarkCacheSize:            100000,
+		LabelsReadOnlyMaxSeries:       100000,
+		LabelsReadOnlyRefreshInterval: 5 * time.Minute,
+		StatsInterval:                 30 * time.Second,
+		StatsTimeout:                  5 * time.Second,
+		StagingMode:                   stagingModeTemp,
+		LateDataPolicy:                lateDataWrite,
+		LateDataRefreshInterval:       time.Minute,
+		GroupCopyMaxGroups:            20,
+		CheckIndexes:                  true,
+		LogSamplesMaxSize:             100,
+		LogSamplesKeep:                5,
+		PartialAcceptMaxDepth:         10,
+		InvalidUTF8Policy:             invalidUTF8Replace,
+		DiskGuardResumeRatio:          0.9,
+		DiskGuardInterval:             30 * time.Second,
+		CircuitBreakerFailures:        5,
+		CircuitBreakerCooldown:        30 * time.Second,
+		ClockSkewWarnThreshold:        5 * time.Second,
+		ClockSkewCheckInterval:        time.Minute,
+		ProvenanceInterval:            time.Hour,
+	}
+}
+
+// ParseFlags registers the configuration flags specific to PostgreSQL and TimescaleDB on the global flag set.
+// Applications embedding the client don't need to call it.
 func ParseFlags(cfg *Config) *Config {
-	flag.StringVar(&cfg.host, "pg-host", "localhost", "The PostgreSQL host")
-	flag.IntVar(&cfg.port, "pg-port", 5432, "The PostgreSQL port")
-	flag.StringVar(&cfg.user, "pg-user", "postgres", "The PostgreSQL user")
-	flag.StringVar(&cfg.passwordFile, "pg-password-file", "", "File to read the PostgreSQL password from")
-	flag.StringVar(&cfg.database, "pg-database", "postgres", "The PostgreSQL database")
-	flag.StringVar(&cfg.sslMode, "pg-ssl-mode", "disable", "The PostgreSQL connection ssl mode")
-	flag.StringVar(&cfg.table, "pg-table", "metrics", "Override prefix for internal tables. It is also a view name used for querying")
-	flag.IntVar(&cfg.maxOpenConns, "pg-max-open-conns", 50, "The max number of open connections to the database")
-	flag.IntVar(&cfg.maxIdleConns, "pg-max-idle-conns", 10, "The max number of idle connections to the database")
-	flag.BoolVar(&cfg.pgPrometheusLogSamples, "pg-prometheus-log-samples", false, "Log raw samples to stdout")
-	flag.IntVar(&cfg.dbConnectRetries, "pg-db-connect-retries", 0, "How many times to retry connecting to the database")
+	return RegisterFlags(flag.CommandLine, "pg", cfg)
+}
+
+// RegisterFlags registers the configuration flags on fs, named with the given prefix (eg. "pg" for -pg-host),
+// so that several configurations can be set on the same flag set.
+func RegisterFlags(fs *flag.FlagSet, prefix string, cfg *Config) *Config {
+	d := DefaultConfig()
+	name := func(n string) string {
+		return prefix + "-" + n
+	}
+	fs.StringVar(&cfg.Host, name("host"), d.Host, fmt.Sprintf("The PostgreSQL host. A comma-separated list of hosts enables failover to whichever host matches -%s", name("target-session-attrs")))
+	fs.IntVar(&cfg.Port, name("port"), d.Port, "The PostgreSQL port")
+	fs.StringVar(&cfg.User, name("user"), d.User, "The PostgreSQL user")
+	fs.StringVar(&cfg.PasswordFile, name("password-file"), d.PasswordFile, "File to read the PostgreSQL password from")
+	fs.StringVar(&cfg.PasswordCommand, name("password-command"), d.PasswordCommand, fmt.Sprintf("Shell command printing the PostgreSQL password to stdout. It runs again after failed authentication, to pick up rotated credentials. Mutually exclusive with -%s", name("password-file")))
+	fs.DurationVar(&cfg.PasswordCommandTimeout, name("password-command-timeout"), d.PasswordCommandTimeout, fmt.Sprintf("Timeout for running -%s", name("password-command")))
+	fs.StringVar(&cfg.Database, name("database"), d.Database, "The PostgreSQL database")
+	fs.StringVar(&cfg.Schema, name("schema"), d.Schema, "The PostgreSQL schema of the tables, set as search_path of the connections. Defaults to the search_path of the user")
+	fs.StringVar(&cfg.SSLMode, name("ssl-mode"), d.SSLMode, "The PostgreSQL connection ssl mode [ \"disable\", \"allow\", \"prefer\", \"require\", \"verify-ca\", \"verify-full\" ]")
+	fs.StringVar(&cfg.SSLRootCert, name("ssl-root-cert"), d.SSLRootCert, fmt.Sprintf("PEM file of the root certificates the server certificate is verified against. With -%s=require, the server certificate is verified like with verify-ca", name("ssl-mode")))
+	fs.StringVar(&cfg.SSLCert, name("ssl-cert"), d.SSLCert, "PEM file of the client certificate")
+	fs.StringVar(&cfg.SSLKey, name("ssl-key"), d.SSLKey, fmt.Sprintf("PEM file of the key of -%s", name("ssl-cert")))
+	fs.StringVar(&cfg.Table, name("table"), d.Table, "Override prefix for internal tables. It is also a view name used for querying")
+	fs.IntVar(&cfg.MaxOpenConns, name("max-open-conns"), d.MaxOpenConns, "The max number of open connections to the database")
+	fs.IntVar(&cfg.MaxIdleConns, name("max-idle-conns"), d.MaxIdleConns, "The max number of idle connections to the database")
+	fs.IntVar(&cfg.LowPriorityMaxOpenConns, name("low-priority-max-open-conns"), d.LowPriorityMaxOpenConns, fmt.Sprintf("The max number of open connections of the pool of low priority writes, eg. backfills, besides -%s. Low priority writes never take the connections of live writes. At least 1", name("max-open-conns")))
+	fs.IntVar(&cfg.LowPriorityMaxIdleConns, name("low-priority-max-idle-conns"), d.LowPriorityMaxIdleConns, "The max number of idle connections of the pool of low priority writes")
+	fs.DurationVar(&cfg.ConnMaxLifetime, name("conn-max-lifetime"), d.ConnMaxLifetime, "Maximum time a database connection is reused (0 means forever)")
+	fs.DurationVar(&cfg.ConnMaxIdleTime, name("conn-max-idle-time"), d.ConnMaxIdleTime, "Maximum time a database connection may be idle before it is closed (0 means forever)")
+	fs.DurationVar(&cfg.ConnKeepalive, name("conn-keepalive"), d.ConnKeepalive, "Interval at which idle database connections are pinged, discarding broken ones (0 disables it)")
+	fs.IntVar(&cfg.WarmConnections, name("warm-connections"), d.WarmConnections, fmt.Sprintf("Number of database connections opened and pinged on startup, before writes are accepted, so that the first writes don't wait for connections to be established. At most -%s (0 disables it)", name("max-idle-conns")))
+	fs.DurationVar(&cfg.WarmConnectionsTimeout, name("warm-connections-timeout"), d.WarmConnectionsTimeout, fmt.Sprintf("Time -%s may take, after which startup goes on with the connections warmed so far", name("warm-connections")))
+	fs.BoolVar(&cfg.LogSamples, name("prometheus-log-samples"), d.LogSamples, fmt.Sprintf("Log raw samples to stdout, or to -%s", name("prometheus-log-samples-file")))
+	fs.StringVar(&cfg.LogSamplesFile, name("prometheus-log-samples-file"), d.LogSamplesFile, "File to log raw samples to, one line per sample, \"-\" meaning stdout. Setting it enables logging samples")
+	fs.IntVar(&cfg.LogSamplesMaxSize, name("prometheus-log-samples-max-size-mb"), d.LogSamplesMaxSize, fmt.Sprintf("Size in megabytes from which -%s is rotated (0 means never)", name("prometheus-log-samples-file")))
+	fs.IntVar(&cfg.LogSamplesKeep, name("prometheus-log-samples-keep"), d.LogSamplesKeep, fmt.Sprintf("Number of rotated -%s files kept", name("prometheus-log-samples-file")))
+	fs.IntVar(&cfg.ConnectRetries, name("db-connect-retries"), d.ConnectRetries, "How many times to retry connecting to the database")
+	fs.StringVar(&cfg.TargetSessionAttrs, name("target-session-attrs"), d.TargetSessionAttrs, "Which hosts are acceptable for new connections [ \"any\", \"read-write\", \"read-only\", \"primary\", \"standby\", \"prefer-standby\" ]. Defaults to \"read-write\" when multiple hosts are given, \"any\" otherwise")
+	fs.StringVar(&cfg.LabelStorage, name("label-storage"), d.LabelStorage, "Label storage layout [ \"jsonb\", \"normalized\" ]. The normalized layout keeps labels in separate key/value tables, which are created on startup")
+	fs.BoolVar(&cfg.MetricNameInLabels, name("metric-name-in-labels"), d.MetricNameInLabels, "Include the metric name as \"__name__\" in the labels jsonb, besides the metric_name column. Existing label sets in the other layout are detected on startup and matched by writes until they are migrated")
+	fs.StringVar(&cfg.PromotedLabels, name("promoted-labels"), d.PromotedLabels, "Comma-separated labels copied into indexed text columns of the labels table named after them, eg. cluster,namespace,job, so they can be filtered on without jsonb operators. Newly promoted labels are backfilled in the background; labels removed from the list keep their columns, which aren't populated anymore")
+	fs.BoolVar(&cfg.PartitionByMetric, name("partition-by-metric"), d.PartitionByMetric, "List partition the values table by metric name, creating partitions for new metrics on demand. Requires the normalized label storage; the values table is no hypertable then")
+	fs.BoolVar(&cfg.RejectOutOfOrder, name("reject-out-of-order"), d.RejectOutOfOrder, fmt.Sprintf("Drop samples older than the latest committed sample of their series minus -%s", name("out-of-order-tolerance")))
+	fs.DurationVar(&cfg.OutOfOrderTolerance, name("out-of-order-tolerance"), d.OutOfOrderTolerance, fmt.Sprintf("How much older than the latest committed sample of a series samples may be with -%s", name("reject-out-of-order")))
+	fs.IntVar(&cfg.LabelCacheSize, name("label-cache-size"), d.LabelCacheSize, "Number of series whose label sets are cached as stored. Writes of only cached series skip inserting labels. Flush the cache with DELETE /admin/cache/labels after removing label sets by hand, eg. truncating the labels table (0 disables the cache)")
+	fs.BoolVar(&cfg.LabelsReadOnly, name("labels-readonly"), d.LabelsReadOnly, fmt.Sprintf("Load the labels table on startup and write samples straight to the values table, for deployments with a fixed, pre-provisioned set of series. Samples of series not in the labels table are dropped and quarantined instead of creating them. Reload the labels with -%s or POST /admin/labels/reload. Requires -%s=jsonb", name("labels-readonly-refresh-interval"), name("label-storage")))
+	fs.IntVar(&cfg.LabelsReadOnlyMaxSeries, name("labels-readonly-max-series"), d.LabelsReadOnlyMaxSeries, fmt.Sprintf("Maximum number of label sets loaded with -%s. Startup fails if the labels table holds more", name("labels-readonly")))
+	fs.DurationVar(&cfg.LabelsReadOnlyRefreshInterval, name("labels-readonly-refresh-interval"), d.LabelsReadOnlyRefreshInterval, fmt.Sprintf("Interval at which the labels table is loaded again with -%s (0 means on startup and on request only)", name("labels-readonly")))
+	fs.IntVar(&cfg.WatermarkCacheSize, name("out-of-order-cache-size"), d.WatermarkCacheSize, fmt.Sprintf("Number of series for which the latest committed timestamp is cached with -%s", name("reject-out-of-order")))
+	fs.BoolVar(&cfg.StatsMetrics, name("stats-metrics"), d.StatsMetrics, "Expose database statistics (pg_stat_database, chunk counts, table sizes, replication lag) as adapter_pg_* metrics. They are collected on a dedicated connection")
+	fs.DurationVar(&cfg.StatsInterval, name("stats-interval"), d.StatsInterval, "Interval at which the database statistics are collected")
+	fs.DurationVar(&cfg.StatsTimeout, name("stats-timeout"), d.StatsTimeout, "Statement timeout for collecting the database statistics")
+	fs.StringVar(&cfg.StagingMode, name("staging-mode"), d.StagingMode, "Where samples are staged before they are inserted [ \"temp\", \"unlogged\" ]. The unlogged mode uses a persistent staging table per adapter and writes in a single transaction, so it works through transaction pooling (eg. PgBouncer)")
+	fs.StringVar(&cfg.StagingInstanceID, name("staging-instance-id"), d.StagingInstanceID, fmt.Sprintf("Suffix of the unlogged staging table, unique per adapter instance. Defaults to the hostname. Only used with -%s=unlogged", name("staging-mode")))
+	fs.StringVar(&cfg.LateDataPolicy, name("late-data-policy"), d.LateDataPolicy, fmt.Sprintf("What to do with samples older than the newest compressed chunk of the values table [ \"write\", \"drop\", \"overflow\" ]. \"overflow\" writes them to the <%s>_values_overflow table", name("table")))
+	fs.DurationVar(&cfg.LateDataRefreshInterval, name("late-data-refresh-interval"), d.LateDataRefreshInterval, fmt.Sprintf("Interval at which the compression horizon is looked up with -%s", name("late-data-policy")))
+	fs.BoolVar(&cfg.SortBatch, name("sort-batch"), d.SortBatch, "Order the samples of each write by series and time before copying them, for better index locality of the inserts")
+	fs.BoolVar(&cfg.GroupCopyByMetric, name("group-copy-by-metric"), d.GroupCopyByMetric, fmt.Sprintf("Copy the samples of each metric of a write with a COPY of its own, for better chunk locality and compression with -%s or a space dimension on the values table. Writes of more than -%s metrics are copied at once", name("partition-by-metric"), name("group-copy-max-groups")))
+	fs.IntVar(&cfg.GroupCopyMaxGroups, name("group-copy-max-groups"), d.GroupCopyMaxGroups, fmt.Sprintf("Maximum number of metrics of a write for -%s to copy them separately", name("group-copy-by-metric")))
+	fs.BoolVar(&cfg.CheckIndexes, name("check-indexes"), d.CheckIndexes, "Warn on startup about missing or invalid indexes on the labels and values tables")
+	fs.BoolVar(&cfg.CreateMissingIndexes, name("create-missing-indexes"), d.CreateMissingIndexes, fmt.Sprintf("Create the indexes reported missing or invalid by -%s in the background, concurrently where possible", name("check-indexes")))
+	fs.Int64Var(&cfg.MaxDatabaseBytes, name("max-database-bytes"), d.MaxDatabaseBytes, "Database size in bytes from which writes are rejected with 507 Insufficient Storage (0 means no limit)")
+	fs.Float64Var(&cfg.MaxDiskUsagePercent, name("max-disk-usage-percent"), d.MaxDiskUsagePercent, fmt.Sprintf("Usage in percent of the database volume from which writes are rejected with 507 Insufficient Storage (0 means no limit). Requires -%s", name("disk-usage-function")))
+	fs.StringVar(&cfg.DiskUsageFunction, name("disk-usage-function"), d.DiskUsageFunction, "Name of a database function returning the used_bytes and total_bytes of the volume of the database, eg. built on pg_ls_dir or an extension")
+	fs.Float64Var(&cfg.DiskGuardResumeRatio, name("disk-guard-resume-ratio"), d.DiskGuardResumeRatio, fmt.Sprintf("Fraction of -%s or -%s below which writes resume", name("max-database-bytes"), name("max-disk-usage-percent")))
+	fs.DurationVar(&cfg.DiskGuardInterval, name("disk-guard-interval"), d.DiskGuardInterval, "Interval at which the database size and disk usage are checked")
+	fs.IntVar(&cfg.CircuitBreakerFailures, name("circuit-breaker-failures"), d.CircuitBreakerFailures, fmt.Sprintf("Number of consecutive writes failing to reach the database after which writes fail fast with 503 for -%s (0 disables the circuit breaker)", name("circuit-breaker-cooldown")))
+	fs.DurationVar(&cfg.CircuitBreakerCooldown, name("circuit-breaker-cooldown"), d.CircuitBreakerCooldown, "How long writes fail fast once the circuit breaker opened, before a single write probes the database")
+	fs.StringVar(&cfg.SynchronousCommit, name("synchronous-commit"), d.SynchronousCommit, "synchronous_commit of the write transactions [ \"on\", \"off\", \"local\", \"remote_write\", \"remote_apply\" ]. \"off\" trades the durability of the latest writes on a database crash for throughput. Defaults to the server setting")
+	fs.BoolVar(&cfg.CommitVisibilityCheck, name("commit-visibility-check"), d.CommitVisibilityCheck, "After each write commits, check on another connection that its latest sample is visible before acknowledging the write. Writes committing only part of their samples aren't checked")
+	fs.DurationVar(&cfg.ClockSkewWarnThreshold, name("clock-skew-warn-threshold"), d.ClockSkewWarnThreshold, "Difference between the database clock and the local clock from which a warning is logged (0 disables the warning)")
+	fs.DurationVar(&cfg.ClockSkewCheckInterval, name("clock-skew-check-interval"), d.ClockSkewCheckInterval, "Interval at which the clock skew to the database is measured, besides the health checks (0 measures it on health checks only)")
+	fs.DurationVar(&cfg.ChunkInterval, name("chunk-interval"), d.ChunkInterval, fmt.Sprintf("chunk_time_interval of the values hypertable when it is created with -%s=normalized. Existing hypertables keep theirs (0 means the TimescaleDB default)", name("label-storage")))
+	fs.DurationVar(&cfg.ChunkAdvisorInterval, name("chunk-advisor-interval"), d.ChunkAdvisorInterval, "Interval at which the ingest rate and row width are measured to recommend a chunk interval for the values hypertable, so that a chunk and its indexes fit in 25% of shared_buffers. Recommendations are logged and shown by /admin/info (0 disables them)")
+	fs.BoolVar(&cfg.ApplyChunkRecommendation, name("apply-chunk-recommendation"), d.ApplyChunkRecommendation, fmt.Sprintf("Set the chunk interval recommended with -%s for future chunks, with set_chunk_time_interval. Existing chunks are left alone", name("chunk-advisor-interval")))
+	fs.BoolVar(&cfg.Provenance, name("provenance"), d.Provenance, "Record when each series was first and last written and by which sources in the first_seen, last_seen and written_by (jsonb array) columns of the labels table, which are added on startup. The source is the sender of the write as identified for -write-source-label. Samples downsampled before they are written have no source")
+	fs.DurationVar(&cfg.ProvenanceInterval, name("provenance-interval"), d.ProvenanceInterval, fmt.Sprintf("Minimum interval between updates of the last_seen of a series with -%s, so that writes don't update every label set they touch. A new source of a series is recorded right away (0 updates it on every write)", name("provenance")))
 	return cfg
 }
 
+// FailoverEvents counts how often new connections landed on a different database host than before.
+var FailoverEvents = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "database_failovers_total",
+		Help: "Total number of detected changes of the database host new connections are established to.",
+	},
+)
+
 // Client sends Prometheus samples to PostgreSQL
 type Client struct {
-	DB  *sql.DB
-	cfg *Config
+	DB          *sql.DB
+	cfg         *Config
+	labels      labelStore
+	currentHost atomic.Value
+	brokenConns atomic.Int64
+	watermarks  *watermarkCache
+	labelCache  *labelCache
+	knownSeries *knownSeries
+	horizon     *compressionHorizon
+	onReject    func(reason string, samples model.Samples)
+	stats       *databaseStats
+	staging     string
+	// stagingOwner identifies the claim of this client on the unlogged staging table, if any
+	stagingOwner string
+	stop         chan struct{}
+	sampleLog    *sampleLog
+	diskGuard    *diskGuard
+	breaker      *circuitBreaker
+	clock        *clockSkew
+	precision    precisionCheck
+	// schemaLayout is the layout of the tables detected by EnsureSchema
+	schemaLayout string
+	// lowPriority is the pool of WriteLowPriority
+	lowPriority *sql.DB
+	// committed counts the samples committed by writes
+	committed    atomic.Int64
+	chunkAdvisor *chunkAdvisor
+
+	creatingIndexes atomic.Bool
 }
 
 // noinspection SqlNoDataSourceInspection
 const (
-	sqlCreateTmpTable   = "create temporary table %s_tmp (time timestamp with time zone, value double precision, metric_name text, labels jsonb) on commit preserve rows;"
-	sqlTempTableCleanup = "drop table %s_tmp;"
-	sqlInsertLabels     = "insert into %s_labels (metric_name, labels) select distinct sample.metric_name, sample.labels from %s_tmp sample on conflict do nothing;"
-	sqlInsertValues     = "insert into %s_values (time, value, labels_id) select sample.time, sample.value, lbl.id from %s_tmp sample left join %s_labels lbl on lbl.metric_name = sample.metric_name and lbl.labels = sample.labels;"
-	sqlHealthCheck      = "SELECT 1"
+	sqlStagingColumns   = "time timestamp with time zone, value double precision, metric_name text, labels jsonb"
+	sqlTempTableCleanup = "drop table if exists %s;"
+	sqlInsertLabels     = "insert into %s_labels (metric_name, labels%s) select distinct sample.metric_name, sample.labels%s from %s sample on conflict do nothing;"
+	sqlInsertValues     = "insert into %s_values (time, value, labels_id) select sample.time, sample.value, lbl.id from %s sample left join %s_labels lbl on lbl.metric_name = sample.metric_name and lbl.labels = sample.labels;"
+	// the any layout statements also match the label set of a series in the other metric name layout,
+	// preferring the configured one
+	sqlInsertLabelsAnyLayout    = "insert into %s_labels (metric_name, labels%s) select distinct sample.metric_name, sample.labels%s from %s sample where not exists (select 1 from %s_labels lbl where lbl.metric_name = sample.metric_name and lbl.labels = %s) on conflict do nothing;"
+	sqlInsertValuesAnyLayout    = "insert into %s_values (time, value, labels_id) select sample.time, sample.value, lbl.id from %s sample left join lateral (select l.id from %s_labels l where l.metric_name = sample.metric_name and (l.labels = sample.labels or l.labels = %s) order by l.labels = sample.labels desc limit 1) lbl on true;"
+	sqlLabelsWithName           = "(sample.labels || jsonb_build_object('__name__', sample.metric_name))"
+	sqlLabelsWithoutName        = "(sample.labels - '__name__')"
+	sqlLabelLayouts             = "select exists (select 1 from %s_labels where labels ? '__name__'), exists (select 1 from %s_labels where not labels ? '__name__')"
+	sqlMigrateLabelsWithName    = "update %s_labels l set labels = l.labels || jsonb_build_object('__name__', l.metric_name) where not l.labels ? '__name__' and not exists (select 1 from %s_labels o where o.metric_name = l.metric_name and o.labels = l.labels || jsonb_build_object('__name__', l.metric_name))"
+	sqlMigrateLabelsWithoutName = "update %s_labels l set labels = l.labels - '__name__' where l.labels ? '__name__' and not exists (select 1 from %s_labels o where o.metric_name = l.metric_name and o.labels = l.labels - '__name__')"
+	sqlHealthCheck              = "SELECT now()"
+	sqlTimeColumnType           = "select data_type from information_schema.columns where table_schema = current_schema() and table_name = $1 and column_name = 'time'"
 )
 
-func readPassword(cfg *Config) string {
-	content, err := os.ReadFile(cfg.passwordFile)
+func readPassword(cfg *Config) (string, error) {
+	content, err := os.ReadFile(cfg.PasswordFile)
 	if err != nil {
-		log.Error("msg", "Password file for establishing postgresql connection not found", "err", err)
-		os.Exit(1)
+		return "", fmt.Errorf("error reading password file: %w", err)
 	}
-	return string(content)
+	return string(content), nil
 }
 
-// NewClient creates a new PostgreSQL client
-func NewClient(cfg *Config) *Client {
+// NewClient creates a new PostgreSQL client. Connections are established lazily, use HealthCheck to verify
+// the database is reachable. The client is safe for concurrent use; call Close to release its connections
+// and stop its background tasks.
+func NewClient(cfg *Config) (*Client, error) {
+	if cfg.RejectOutOfOrder && cfg.WatermarkCacheSize <= 0 {
+		return nil, fmt.Errorf("the out of order cache size must be positive")
+	}
+	if cfg.PasswordFile != "" && cfg.PasswordCommand != "" {
+		return nil, fmt.Errorf("a password file and a password command are mutually exclusive")
+	}
+	if cfg.LowPriorityMaxOpenConns < 1 {
+		// low priority writes would wait forever
+		return nil, fmt.Errorf("the low priority pool needs at least one connection")
+	}
+	if cfg.LabelsReadOnly {
+		switch {
+		case cfg.LabelStorage != labelStorageJsonb:
+			return nil, fmt.Errorf("read-only labels require the %q label storage", labelStorageJsonb)
+		case cfg.LabelsReadOnlyMaxSeries < 1:
+			return nil, fmt.Errorf("the maximum number of read-only label sets must be positive")
+		case cfg.LabelsReadOnlyRefreshInterval < 0:
+			return nil, fmt.Errorf("the read-only labels refresh interval must not be negative")
+		}
+	}
+	switch {
+	case cfg.WarmConnections < 0:
+		return nil, fmt.Errorf("the number of connections to warm must not be negative")
+	case cfg.WarmConnections > cfg.MaxIdleConns:
+		// the pool would close the connections beyond the maximum as soon as they are released
+		return nil, fmt.Errorf("cannot warm %d connections with at most %d idle connections", cfg.WarmConnections, cfg.MaxIdleConns)
+	case cfg.WarmConnections > 0 && cfg.WarmConnectionsTimeout <= 0:
+		return nil, fmt.Errorf("the timeout of warming connections must be positive")
+	}
+	if cfg.Provenance {
+		switch {
+		case cfg.LabelsReadOnly:
+			// the samples of read-only labels aren't staged
+			return nil, fmt.Errorf("provenance can't be recorded with read-only labels")
+		case cfg.ProvenanceInterval < 0:
+			return nil, fmt.Errorf("the provenance interval must not be negative")
+		}
+	}
+	if cfg.GroupCopyByMetric && cfg.GroupCopyMaxGroups < 1 {
+		return nil, fmt.Errorf("grouping the COPY by metric needs a maximum number of groups of at least 1")
+	}
 	baseConnStr := fmt.Sprintf("host=%v port=%v user=%v dbname=%v sslmode=%v connect_timeout=10",
-		cfg.host, cfg.port, cfg.user, cfg.database, cfg.sslMode)
+		cfg.Host, cfg.Port, cfg.User, cfg.Database, cfg.SSLMode)
+	targetSessionAttrs := cfg.TargetSessionAttrs
+	if targetSessionAttrs == "" && strings.Contains(cfg.Host, ",") {
+		// make sure writes always land on the current primary
+		targetSessionAttrs = "read-write"
+	}
+	if targetSessionAttrs != "" {
+		baseConnStr += fmt.Sprintf(" target_session_attrs=%v", targetSessionAttrs)
+	}
+	tlsParams, err := tlsConnParams(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsParams != "" {
+		baseConnStr += " " + tlsParams
+	}
 
 	config, err := pgx.ParseConfig(baseConnStr)
 	if err != nil {
-		log.Error("err", err)
-		os.Exit(1)
+		return nil, err
+	}
+	// samples are passed as UTC instants; a session time zone must not shift them if a column ever loses
+	// its time zone
+	config.RuntimeParams["timezone"] = "UTC"
+	if cfg.Schema != "" {
+		config.RuntimeParams["search_path"] = pgx.Identifier{cfg.Schema}.Sanitize()
+	}
+	promoted, err := parsePromotedLabels(cfg.PromotedLabels)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := newLabelStore(cfg.LabelStorage, cfg.Table, cfg.PartitionByMetric, cfg.MetricNameInLabels, promoted)
+	if err != nil {
+		return nil, err
+	}
+	if normalized, ok := labels.(*normalizedLabelStore); ok {
+		normalized.chunkInterval = cfg.ChunkInterval
+	}
+	switch cfg.StagingMode {
+	case stagingModeTemp:
+	case stagingModeUnlogged:
+		if cfg.StagingInstanceID == "" {
+			if cfg.StagingInstanceID, err = defaultInstanceID(); err != nil {
+				return nil, err
+			}
+		}
+		if invalidInstanceIDChars.MatchString(cfg.StagingInstanceID) {
+			return nil, fmt.Errorf("invalid staging instance ID %q, only lower case letters, digits and underscores are allowed", cfg.StagingInstanceID)
+		}
+		// unnamed statements only, prepared statements don't survive transaction pooling
+		config.DefaultQueryExecMode = pgx.QueryExecModeExec
+	default:
+		return nil, fmt.Errorf("unknown staging mode %q, expected %q or %q", cfg.StagingMode, stagingModeTemp, stagingModeUnlogged)
+	}
+	switch cfg.LateDataPolicy {
+	case lateDataWrite:
+	case lateDataDrop, lateDataOverflow:
+		if cfg.PartitionByMetric {
+			return nil, fmt.Errorf("the late data policy requires the values table to be a hypertable, it can't be used with partitioning by metric")
+		}
+		if cfg.LateDataRefreshInterval <= 0 {
+			return nil, fmt.Errorf("the late data refresh interval must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("unknown late data policy %q, expected %q, %q or %q", cfg.LateDataPolicy, lateDataWrite, lateDataDrop, lateDataOverflow)
+	}
+	switch cfg.InvalidUTF8Policy {
+	case invalidUTF8Replace, invalidUTF8Base64, invalidUTF8Drop:
+	default:
+		return nil, fmt.Errorf("unknown invalid UTF-8 policy %q, expected %q, %q or %q", cfg.InvalidUTF8Policy, invalidUTF8Replace, invalidUTF8Base64, invalidUTF8Drop)
+	}
+	if cfg.MaxDatabaseBytes > 0 || cfg.MaxDiskUsagePercent > 0 {
+		switch {
+		case cfg.MaxDiskUsagePercent > 0 && cfg.DiskUsageFunction == "":
+			return nil, fmt.Errorf("the disk usage limit requires a disk usage function")
+		case cfg.DiskUsageFunction != "" && !validFunctionName.MatchString(cfg.DiskUsageFunction):
+			return nil, fmt.Errorf("invalid disk usage function name %q", cfg.DiskUsageFunction)
+		case cfg.DiskGuardResumeRatio <= 0 || cfg.DiskGuardResumeRatio > 1:
+			return nil, fmt.Errorf("the disk guard resume ratio must be between 0 and 1")
+		case cfg.DiskGuardInterval <= 0:
+			return nil, fmt.Errorf("the disk guard interval must be positive")
+		}
+	}
+	if cfg.CircuitBreakerFailures > 0 && cfg.CircuitBreakerCooldown <= 0 {
+		return nil, fmt.Errorf("the circuit breaker cool-down must be positive")
+	}
+	if cfg.ChunkInterval < 0 {
+		return nil, fmt.Errorf("the chunk interval must not be negative")
+	}
+	if cfg.ApplyChunkRecommendation && cfg.ChunkAdvisorInterval <= 0 {
+		return nil, fmt.Errorf("applying chunk recommendations requires a positive chunk advisor interval")
+	}
+	if cfg.SynchronousCommit != "" && !synchronousCommitModes[cfg.SynchronousCommit] {
+		return nil, fmt.Errorf("unknown synchronous commit mode %q, expected on, off, local, remote_write or remote_apply", cfg.SynchronousCommit)
+	}
+	var passwordCommand *passwordCommand
+	if cfg.PasswordCommand != "" {
+		passwordCommand = newPasswordCommand(cfg.PasswordCommand, cfg.PasswordCommandTimeout)
 	}
 	beforeConnectHook := func(ctx context.Context, connConfig *pgx.ConnConfig) error {
-		if connConfig != nil {
-			log.Debug("msg", "Re-reading password before establishing new connection...")
-			password := readPassword(cfg)
+		if connConfig == nil {
+			return nil
+		}
+		if passwordCommand != nil {
+			password, err := passwordCommand.get(ctx)
+			if err != nil {
+				return err
+			}
 			connConfig.Password = password
+			return nil
+		}
+		if cfg.PasswordFile == "" {
+			return nil
+		}
+		log.Debug("msg", "Re-reading password before establishing new connection...")
+		password, err := readPassword(cfg)
+		if err != nil {
+			return err
 		}
+		connConfig.Password = password
 		return nil
 	}
-	connector := pgx_stdlib.GetConnector(*config, pgx_stdlib.OptionBeforeConnect(beforeConnectHook))
+	client := &Client{
+		cfg:     cfg,
+		labels:  labels,
+		staging: stagingTable(cfg),
+		stop:    make(chan struct{}),
+		clock:   &clockSkew{threshold: cfg.ClockSkewWarnThreshold},
+	}
+	afterConnectHook := func(ctx context.Context, conn *pgx.Conn) error {
+		client.recordHost(conn.PgConn().Conn().RemoteAddr().String())
+		return nil
+	}
+	var connector driver.Connector = pgx_stdlib.GetConnector(*config, pgx_stdlib.OptionBeforeConnect(beforeConnectHook), pgx_stdlib.OptionAfterConnect(afterConnectHook))
+	connector = &tlsConnector{Connector: connector}
+	if passwordCommand != nil {
+		connector = &reauthConnector{Connector: connector, password: passwordCommand}
+	}
 
 	db := sql.OpenDB(connector)
 
 	log.Info("msg", baseConnStr)
 
-	db.SetMaxOpenConns(cfg.maxOpenConns)
-	db.SetMaxIdleConns(cfg.maxIdleConns)
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
 
-	client := &Client{
-		DB:  db,
-		cfg: cfg,
-	}
+	// the connections of the low priority pool are only established once low priority writes come in
+	lowPriority := sql.OpenDB(connector)
+	lowPriority.SetMaxOpenConns(cfg.LowPriorityMaxOpenConns)
+	lowPriority.SetMaxIdleConns(cfg.LowPriorityMaxIdleConns)
+	lowPriority.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	lowPriority.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
 
-	return client
-}
-
-func metricMetaJson(m model.Metric) (string, string) {
-	metricName, hasName := m[model.MetricNameLabel]
-	numLabels := len(m) - 1
-	if !hasName {
-		numLabels = len(m)
+	client.DB = db
+	client.lowPriority = lowPriority
+	if cfg.RejectOutOfOrder {
+		client.watermarks = newWatermarkCache(cfg.WatermarkCacheSize, cfg.OutOfOrderTolerance, client.latestSampleTime)
 	}
-	labelStrings := make([]string, 0, numLabels)
-	for label, value := range m {
-		if label != model.MetricNameLabel {
-			escapedLabel, err := json.Marshal(string(label))
-			if err != nil {
-				log.Warn("msg", fmt.Sprintf("Could not format label '%s', skipping", string(label)), "err", err)
-				continue
-			}
-			escapedValue, err := json.Marshal(string(value))
-			if err != nil {
-				log.Warn("msg", fmt.Sprintf("Could not format value '%s', skipping", string(value)), "err", err)
-				continue
-			}
-			labelStrings = append(labelStrings, fmt.Sprintf("%s: %s", escapedLabel, escapedValue))
+	if cfg.LabelCacheSize > 0 {
+		client.labelCache = newLabelCache(cfg.LabelCacheSize)
+	}
+	if cfg.LabelsReadOnly {
+		client.knownSeries = newKnownSeries(cfg.LabelsReadOnlyRefreshInterval, client.loadKnownSeries)
+		if cfg.LabelsReadOnlyRefreshInterval > 0 {
+			go client.knownSeries.run(client.stop)
 		}
 	}
-
-	switch numLabels {
-	case 0:
-		if hasName {
-			return string(metricName), "{}"
+	if cfg.LateDataPolicy != lateDataWrite {
+		client.horizon = newCompressionHorizon(cfg.LateDataRefreshInterval, client.lookupCompressionHorizon)
+		go client.horizon.run(client.stop)
+	}
+	if cfg.MaxDatabaseBytes > 0 || cfg.MaxDiskUsagePercent > 0 {
+		client.diskGuard = newDiskGuard(cfg, client.lookupDiskUsage)
+		go client.diskGuard.run(client.stop)
+	}
+	if cfg.CircuitBreakerFailures > 0 {
+		client.breaker = newCircuitBreaker(cfg.CircuitBreakerFailures, cfg.CircuitBreakerCooldown)
+	}
+	if cfg.ConnKeepalive > 0 {
+		go client.keepalive(cfg.ConnKeepalive)
+	}
+	if cfg.ClockSkewCheckInterval > 0 {
+		go client.checkClock(cfg.ClockSkewCheckInterval)
+	}
+	if cfg.ChunkAdvisorInterval > 0 {
+		client.chunkAdvisor = &chunkAdvisor{
+			interval:  cfg.ChunkAdvisorInterval,
+			apply:     cfg.ApplyChunkRecommendation,
+			committed: client.committed.Load,
+			measure:   client.measureChunks,
+			set:       client.setChunkInterval,
 		}
-		return "", "{}"
-	default:
-		sort.Strings(labelStrings)
-		return string(metricName), fmt.Sprintf("{%s}", strings.Join(labelStrings, ","))
+		go client.chunkAdvisor.run(client.stop)
 	}
+	if cfg.StatsMetrics {
+		client.stats = newDatabaseStats(client, cfg.StatsInterval, cfg.StatsTimeout)
+		go client.stats.run()
+	}
+	if cfg.LogSamples || cfg.LogSamplesFile != "" {
+		path := cfg.LogSamplesFile
+		if path == "" {
+			path = sampleLogStdout
+		}
+		if client.sampleLog, err = newSampleLog(path, int64(cfg.LogSamplesMaxSize)<<20, cfg.LogSamplesKeep); err != nil {
+			log.Error("msg", "Error opening the sample log, samples aren't logged", "path", path, "err", err)
+		} else {
+			go client.sampleLog.run(sampleLogFlushInterval, client.stop)
+		}
+	}
+	return client, nil
 }
 
-func copyFromTmpTableInTransaction(ctx context.Context, conn *sql.Conn, query string, queryDescription string) error {
-	tx, err := conn.BeginTx(ctx, nil)
+// MetricMetaJson returns the metric name and the canonical jsonb text for the remaining labels of a metric.
+// Labels are ordered by their raw name before they are encoded, so any given label set always renders to
+// the exact same bytes. Lookups by label set must use this function to get the same canonical form. Bytes
+// that aren't valid UTF-8 are replaced with U+FFFD, a run of them by a single one.
+func MetricMetaJson(m model.Metric) (string, string) {
+	return metricMetaJson(m, false)
+}
 
-	if err != nil {
-		log.Error("msg", "Error on transaction setup", "err", err, "desc", queryDescription)
-		return err
+// metricMetaJson is MetricMetaJson, keeping __name__ in the labels with withName.
+func metricMetaJson(m model.Metric, withName bool) (string, string) {
+	labels := make([]prompb.Label, 0, len(m))
+	for name, value := range m {
+		labels = append(labels, prompb.Label{Name: string(name), Value: string(value)})
 	}
+	slices.SortFunc(labels, compareLabels)
+	return labelsMetaJson(labels, withName)
+}
 
-	defer func(tx *sql.Tx) {
-		_ = tx.Rollback()
-	}(tx)
-
-	stmtLabels, err := tx.Prepare(query)
+// EnsureSchema first probes the layout of the existing tables, failing if the adapter can't write to them
+// with its configuration. It then creates the tables required by the configured label storage layout, if
+// any, the unlogged staging table and the overflow table. It fails if the time column of the values table has no time zone.
+// It adds the columns of promoted labels and starts backfilling new ones in the background, and the
+// provenance columns with Provenance.
+// It warns about label sets stored in another metric name layout than the configured one, which writes match
+// from then on. With CheckIndexes, it then checks the indexes of the tables.
+func (c *Client) EnsureSchema() error {
+	ctx := context.Background()
+	probe, err := probeSchema(ctx, c.DB, c.cfg.Table)
 	if err != nil {
-		log.Error("msg", "Error on preparing statement", "err", err, "desc", queryDescription)
 		return err
 	}
-	_, err = stmtLabels.Exec()
-	if err != nil {
-		log.Error("msg", "Error executing statement", "err", err, "desc", queryDescription)
+	if err := c.checkSchemaLayout(probe); err != nil {
 		return err
 	}
-
-	err = stmtLabels.Close()
+	backfill, err := c.labels.ensureSchema(ctx, c.DB)
 	if err != nil {
-		log.Error("msg", "Error on closing statement", "err", err, "desc", queryDescription)
 		return err
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		log.Error("msg", "Error on Commit", "err", err, "desc", queryDescription)
+	// the layout may have been created just now
+	if probe, err = probeSchema(ctx, c.DB, c.cfg.Table); err != nil {
+		return err
+	}
+	c.schemaLayout, _ = probe.layout()
+	SchemaLayout.Reset()
+	SchemaLayout.WithLabelValues(c.schemaLayout).Set(1)
+	log.Info("msg", "Detected the layout of the tables", "table", c.cfg.Table, "layout", c.schemaLayout)
+	if len(backfill) > 0 {
+		go c.backfillPromoted(backfill)
+	}
+	if c.cfg.Provenance {
+		if err := c.ensureProvenance(ctx); err != nil {
+			return err
+		}
+	}
+	if err := c.ensureStaging(ctx); err != nil {
+		return err
+	}
+	if err := c.ensureOverflow(ctx); err != nil {
+		return err
+	}
+	if err := c.checkTimeColumn(ctx); err != nil {
 		return err
 	}
+	if err := c.labels.checkLayout(ctx, c.DB); err != nil {
+		return err
+	}
+	if err := c.ensureKnownSeries(ctx); err != nil {
+		return err
+	}
+	if c.cfg.CheckIndexes {
+		if _, err := c.CheckIndexes(ctx); err != nil {
+			log.Warn("msg", "Error checking indexes", "err", err)
+		}
+	}
 	return nil
 }
 
-func (c *Client) insertLabels(ctx context.Context, conn *sql.Conn) error {
-	query := fmt.Sprintf(sqlInsertLabels, c.cfg.table, c.cfg.table)
-	return copyFromTmpTableInTransaction(ctx, conn, query, "labels")
+// checkTimeColumn makes sure the time column of the values table is a timestamptz, as the timestamps written
+// to a timestamp without time zone would depend on the session time zone.
+func (c *Client) checkTimeColumn(ctx context.Context) error {
+	var dataType string
+	err := c.DB.QueryRowContext(ctx, sqlTimeColumnType, c.cfg.Table+"_values").Scan(&dataType)
+	if err == sql.ErrNoRows {
+		// the jsonb layout doesn't create the tables, writes will tell
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking the time column: %w", err)
+	}
+	if dataType != "timestamp with time zone" {
+		return fmt.Errorf("the time column of %s_values is a %s, it must be a timestamp with time zone (alter table %s_values alter column time type timestamptz using time at time zone 'UTC')",
+			c.cfg.Table, dataType, c.cfg.Table)
+	}
+	return nil
 }
 
-func (c *Client) insertValues(ctx context.Context, conn *sql.Conn) error {
-	query := fmt.Sprintf(sqlInsertValues, c.cfg.table, c.cfg.table, c.cfg.table)
-	return copyFromTmpTableInTransaction(ctx, conn, query, "values")
+// cleanupTimeout bounds the statements returning a connection to the pool clean after a write, which run
+// even if the write was cancelled.
+const cleanupTimeout = 5 * time.Second
+
+// cleanupContext returns a context for cleaning up after a write, which isn't cancelled with ctx.
+func cleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
 }
 
+// cleanup drops the temp table of a write and returns conn to the pool, or discards it if the temp table
+// can't be dropped, as the next write on the session would fail creating it.
 func (c *Client) cleanup(ctx context.Context, conn *sql.Conn) {
 	// not 100% sure if this is necessary, but AFAICT there's no reason why returning
 	// a connection to the pool would clean session-local data like temporary tables
-	_, err := conn.ExecContext(ctx, fmt.Sprintf(sqlTempTableCleanup, c.cfg.table))
+	ctx, cancel := cleanupContext(ctx)
+	defer cancel()
+	_, err := conn.ExecContext(ctx, fmt.Sprintf(sqlTempTableCleanup, c.staging))
 	if err != nil {
-		log.Error("msg", "Failed to clean up temp table", "err", err)
+		log.Error("msg", "Failed to clean up temp table, discarding connection", "err", err)
+		c.discard(conn)
+		return
 	}
 	_ = conn.Close()
 }
 
-// Write implements the Writer interface and writes metric samples to the database
+// discard closes conn instead of returning it to the pool.
+func (c *Client) discard(conn *sql.Conn) {
+	c.brokenConns.Add(1)
+	_ = conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+	_ = conn.Close()
+}
+
+// Write writes metric samples to the database. It returns once the samples are committed, and may be called
+// concurrently. Writing no samples doesn't touch the database.
 func (c *Client) Write(samples model.Samples) error {
+	_, err := c.WriteContext(context.Background(), samples)
+	return err
+}
+
+// WriteContext implements the Writer interface and writes metric samples to the database like Write, tracing
+// each database phase as a child span of the span in ctx. The stats count the samples dropped before the
+// write by reason, invalid_utf8, unknown_series, out_of_order or compressed_chunk, and those committed. With PartialAccept, a
+// write failing on invalid data commits the valid samples and returns a *PartialWriteError, the rejected
+// samples being counted as invalid_data. While the database is over its size limit, writes fail with
+// ErrStorageFull, and while the circuit breaker is open with ErrCircuitOpen. With CommitVisibilityCheck,
+// writes of which the samples aren't visible after the commit fail with ErrNotVisible. Other failures of the
+// database phases are returned as a *WriteError naming the phase. Samples with integer values of magnitude
+// 2^53 or more are written, but counted in ImpreciseSamples.
+func (c *Client) WriteContext(ctx context.Context, samples model.Samples) (stats writers.WriteStats, err error) {
+	if len(samples) == 0 {
+		return stats, nil
+	}
+	if c.diskGuard != nil && c.diskGuard.full.Load() {
+		return stats, ErrStorageFull
+	}
+	if c.breaker != nil {
+		if !c.breaker.allow() {
+			return stats, c.breaker.openError()
+		}
+		defer func() {
+			c.breaker.done(err)
+		}()
+	}
+	defer func() {
+		c.committed.Add(int64(stats.Written))
+	}()
 	begin := time.Now()
-	ctx := context.Background()
-	conn, err := c.DB.Conn(ctx)
-	if err != nil {
-		log.Error("msg", "Failed to acquire database connection", "err", err)
-		return err
+	var invalid model.Samples
+	samples, invalid = normalizeUTF8(samples, c.cfg.InvalidUTF8Policy)
+	c.reject(&stats, "invalid_utf8", invalid)
+	if c.knownSeries != nil {
+		var unknown model.Samples
+		samples, unknown = c.knownSeries.split(samples)
+		UnknownSeriesSamples.Add(float64(len(unknown)))
+		c.reject(&stats, "unknown_series", unknown)
+	}
+	c.precision.check(samples, begin)
+	if c.watermarks != nil {
+		var outOfOrder model.Samples
+		samples, outOfOrder = c.watermarks.filter(ctx, samples)
+		c.reject(&stats, "out_of_order", outOfOrder)
+	}
+	var late model.Samples
+	if c.horizon != nil {
+		samples, late = c.horizon.split(samples)
+		if c.cfg.LateDataPolicy == lateDataDrop && len(late) > 0 {
+			CompressedChunkSamples.Add(float64(len(late)))
+			c.reject(&stats, "compressed_chunk", late)
+			late = nil
+		}
+	}
+	if c.sampleLog != nil {
+		var sampleLines bytes.Buffer
+		for _, sample := range samples {
+			metricName, metricJson := MetricMetaJson(sample.Metric)
+			appendSampleLine(&sampleLines, sample.Timestamp.Time().UTC(), int64(sample.Timestamp), sample.Value, metricName, metricJson)
+		}
+		defer func() {
+			c.sampleLog.write(sampleLines.Bytes())
+		}()
 	}
-	defer c.cleanup(ctx, conn)
 
-	_, err = conn.ExecContext(ctx, fmt.Sprintf(sqlCreateTmpTable, c.cfg.table))
+	b := batch{samples: samples, late: late}
+	err = c.writeBatch(ctx, b)
+	if err != nil && c.cfg.PartialAccept && isDataError(err) {
+		return stats, c.writePartial(ctx, b, err, &stats)
+	}
 	if err != nil {
-		log.Error("msg", "Error executing create tmp table", "err", err)
-		return err
+		return stats, err
 	}
+	if c.cfg.CommitVisibilityCheck {
+		if err := c.checkVisibility(ctx, b.samples); err != nil {
+			return stats, err
+		}
+	}
+	stats.Written = b.size()
 
-	copyTable := fmt.Sprintf("%s_tmp", c.cfg.table)
-	var inputRows [][]interface{} = nil
+	duration := time.Since(begin).Seconds()
 
-	for _, sample := range samples {
-		timestamp := sample.Timestamp.Time().UTC()
-		metricName, metricJson := metricMetaJson(sample.Metric)
-		line := fmt.Sprintf("%v\t%v\t%v\t%v", timestamp.Format(time.RFC3339), sample.Value, metricName, metricJson)
-		if c.cfg.pgPrometheusLogSamples {
-			fmt.Println(line)
-		}
-		inputRows = append(inputRows, []interface{}{timestamp, float64(sample.Value), metricName, metricJson})
+	log.Debug("msg", "Wrote samples", "count", len(samples), "duration", duration)
+
+	return stats, nil
+}
+
+// writeBatch writes the samples of a batch, and its late samples to the overflow table, in one session.
+// A COPY failing on a sample is reported as a *rowError.
+func (c *Client) writeBatch(ctx context.Context, b batch) error {
+	if c.knownSeries != nil {
+		return c.writeKnown(ctx, b)
 	}
-	err = conn.Raw(func(driverConn any) error {
-		conn := driverConn.(*pgx_stdlib.Conn).Conn()
-		_, err := conn.CopyFrom(ctx, []string{copyTable}, []string{"time", "value", "metric_name", "labels"}, pgx.CopyFromRows(inputRows))
-		return err
-	})
+	conn, err := c.acquireConn(ctx)
 	if err != nil {
-		log.Error("msg", "Error on copy", "err", err)
-		return err
+		log.Error("msg", "Failed to acquire database connection", "err", err)
+		return &WriteError{Phase: ErrConnAcquire, Err: err}
+	}
+	unlogged := c.cfg.StagingMode == stagingModeUnlogged
+	w := &writeSession{conn: conn, staging: c.staging, single: unlogged, synchronousCommit: c.cfg.SynchronousCommit}
+	failed := func(phase error, err error) error {
+		return &WriteError{Phase: phase, Rows: w.rows, Err: err}
+	}
+	// open is set while a transaction is open on conn, which is rolled back if the write fails
+	open := false
+	defer func() {
+		if open {
+			ctx, cancel := cleanupContext(ctx)
+			_, err := conn.ExecContext(ctx, "rollback")
+			cancel()
+			if err != nil {
+				log.Error("msg", "Failed to roll back, discarding connection", "err", err)
+				c.discard(conn)
+				return
+			}
+		}
+		if unlogged {
+			_ = conn.Close()
+		} else {
+			c.cleanup(ctx, conn)
+		}
+	}()
+	begin := func() error {
+		if _, err := conn.ExecContext(ctx, "begin"); err != nil {
+			log.Error("msg", "Error on transaction setup", "err", err)
+			return err
+		}
+		open = true
+		if err := w.setSynchronousCommit(ctx, conn); err != nil {
+			log.Error("msg", "Error on transaction setup", "err", err)
+			return err
+		}
+		return nil
+	}
+	if unlogged {
+		if err := begin(); err != nil {
+			return failed(ErrStaging, err)
+		}
+	} else {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(sqlCreateTempStaging, c.staging, c.labels.stagingColumns()))
+		if err != nil {
+			log.Error("msg", "Error executing create tmp table", "err", err)
+			return failed(ErrStaging, err)
+		}
 	}
 
-	err = c.insertLabels(ctx, conn)
-	if err != nil {
-		return err
+	groups := c.copyGroups(b.samples, c.copyOrder(b.samples))
+	for n, group := range groups {
+		err = c.copyRows(ctx, conn, b.samples, group)
+		if err != nil && len(groups) > 1 {
+			// a failed COPY fails the write, the metrics after it aren't copied
+			metric := b.samples[group[0]].Metric[model.MetricNameLabel]
+			err = fmt.Errorf("error copying the samples of metric %q (%d of %d metrics): %w", metric, n+1, len(groups), err)
+		}
+		if err != nil {
+			log.Error("msg", "Error on copy", "err", err)
+			if line := copyErrorLine(err); line > 0 && line <= len(group) {
+				return failed(ErrStaging, &rowError{index: group[line-1], err: err})
+			}
+			return failed(ErrStaging, err)
+		}
+		w.rows += int64(len(group))
 	}
 
-	err = c.insertValues(ctx, conn)
+	if c.labelCache == nil || !c.labelCache.known(b.samples) {
+		err = traced(ctx, "insert_labels", func(ctx context.Context) error {
+			return c.labels.insertLabels(ctx, w)
+		})
+		if err != nil {
+			return failed(ErrLabelInsert, err)
+		}
+	}
+	if c.cfg.Provenance {
+		if err := traced(ctx, "provenance", func(ctx context.Context) error {
+			return c.updateProvenance(ctx, w)
+		}); err != nil {
+			return failed(ErrLabelInsert, err)
+		}
+	}
+
+	if !w.single && len(b.late) > 0 {
+		// the values are committed together with the late samples, so that retrying a failed write of the
+		// overflow table doesn't write them twice
+		if err := begin(); err != nil {
+			return failed(ErrStaging, err)
+		}
+		w.single = true
+	}
+	err = traced(ctx, "insert_values", func(ctx context.Context) error {
+		return c.labels.insertValues(ctx, w)
+	})
 	if err != nil {
-		return err
+		if c.horizon != nil && isCompressedChunkConflict(err) {
+			c.horizon.requestRefresh()
+		}
+		return failed(ErrValueInsert, err)
+	}
+	if len(b.late) > 0 {
+		err := traced(ctx, "write_overflow", func(ctx context.Context) error {
+			return c.writeOverflow(ctx, conn, b.late)
+		}, attribute.Int("db.rows", len(b.late)))
+		if err != nil {
+			log.Error("msg", "Error writing samples to the overflow table", "err", err)
+			return failed(ErrValueInsert, err)
+		}
+		w.rows += int64(len(b.late))
+	}
+	if unlogged {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(sqlClearStaging, c.staging)); err != nil {
+			log.Error("msg", "Error clearing staging table", "err", err)
+			return failed(ErrStaging, err)
+		}
+	}
+	if open {
+		err := traced(ctx, "commit", func(ctx context.Context) error {
+			return w.commit(func() error {
+				_, err := conn.ExecContext(ctx, "commit")
+				return err
+			})
+		})
+		if err != nil {
+			log.Error("msg", "Error on Commit", "err", err)
+			return failed(ErrCommit, err)
+		}
+		open = false
+	}
+	if c.labelCache != nil {
+		c.labelCache.add(b.samples)
+	}
+	if c.watermarks != nil {
+		c.watermarks.advance(b.samples)
 	}
+	return nil
+}
 
-	duration := time.Since(begin).Seconds()
+// traced runs a phase of a write in a span named after the phase, observing its duration.
+func traced(ctx context.Context, phase string, run func(ctx context.Context) error, attrs ...attribute.KeyValue) error {
+	defer observePhase(ctx, phase, time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "db."+phase, trace.WithAttributes(attrs...))
+	defer span.End()
+	err := run(ctx)
+	tracing.RecordError(span, err)
+	return err
+}
 
-	log.Debug("msg", "Wrote samples", "count", len(samples), "duration", duration)
+// copyRows copies the samples at the indexes of order into the staging table, in that order.
+func (c *Client) copyRows(ctx context.Context, conn *sql.Conn, samples model.Samples, order []int) error {
+	copyTable := c.staging
+	inputRows := make([][]interface{}, 0, len(order))
+	for _, i := range order {
+		sample := samples[i]
+		timestamp := sample.Timestamp.Time().UTC()
+		metricName, metricJson := c.seriesJson(ctx, sample.Metric)
+		inputRows = append(inputRows, c.labels.copyRow(timestamp, float64(sample.Value), metricName, metricJson, sample.Metric))
+	}
+	return traced(ctx, "copy", func(ctx context.Context) error {
+		return conn.Raw(func(driverConn any) error {
+			conn := driverConn.(*pgx_stdlib.Conn).Conn()
+			_, err := conn.CopyFrom(ctx, []string{copyTable}, c.labels.copyColumns(), pgx.CopyFromRows(inputRows))
+			return err
+		})
+	}, attribute.Int("db.rows", len(inputRows)))
+}
 
-	return nil
+// copyGroups splits the copy order by metric name, in the order of the metric names, with GroupCopyByMetric
+// if the samples are of at most GroupCopyMaxGroups metrics. Otherwise, the copy order is the only group.
+func (c *Client) copyGroups(samples model.Samples, order []int) [][]int {
+	if !c.cfg.GroupCopyByMetric {
+		return [][]int{order}
+	}
+	byMetric := make(map[model.LabelValue][]int)
+	for _, i := range order {
+		name := samples[i].Metric[model.MetricNameLabel]
+		if _, ok := byMetric[name]; !ok && len(byMetric) == c.cfg.GroupCopyMaxGroups {
+			return [][]int{order}
+		}
+		byMetric[name] = append(byMetric[name], i)
+	}
+	names := make([]string, 0, len(byMetric))
+	for name := range byMetric {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	groups := make([][]int, len(names))
+	for i, name := range names {
+		groups[i] = byMetric[model.LabelValue(name)]
+	}
+	return groups
+}
+
+// copyOrder returns the indexes of the samples in the order they are copied. With SortBatch, samples are
+// ordered by fingerprint and timestamp; only the indexes are sorted, so the samples aren't moved.
+func (c *Client) copyOrder(samples model.Samples) []int {
+	order := make([]int, len(samples))
+	for i := range order {
+		order[i] = i
+	}
+	if !c.cfg.SortBatch {
+		return order
+	}
+	fingerprints := make([]model.Fingerprint, len(samples))
+	for i, s := range samples {
+		fingerprints[i] = s.Metric.Fingerprint()
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if fingerprints[a] != fingerprints[b] {
+			return fingerprints[a] < fingerprints[b]
+		}
+		return samples[a].Timestamp < samples[b].Timestamp
+	})
+	return order
 }
 
+// Close stops the background tasks of the client and closes its connections. The client must not be used
+// afterwards.
 func (c *Client) Close() {
-	if c.DB != nil {
-		if err := c.DB.Close(); err != nil {
+	if c.stop != nil {
+		close(c.stop)
+	}
+	if c.stagingOwner != "" {
+		c.releaseStaging()
+	}
+	for _, db := range []*sql.DB{c.DB, c.lowPriority} {
+		if db == nil {
+			continue
+		}
+		if err := db.Close(); err != nil {
 			log.Error("msg", err.Error())
 		}
 	}
 }
 
-// HealthCheck implements the healtcheck interface
-func (c *Client) HealthCheck() error {
-	rows, err := c.DB.Query(sqlHealthCheck)
+// OnReject sets a function receiving the samples the client drops instead of writing them, with the reason.
+// It must not block. It is not safe to call while writes are running.
+func (c *Client) OnReject(handler func(reason string, samples model.Samples)) {
+	c.onReject = handler
+}
 
-	if err != nil {
+// reject counts the samples dropped for reason in the stats of the write, and passes them to the OnReject
+// handler.
+func (c *Client) reject(stats *writers.WriteStats, reason string, samples model.Samples) {
+	stats.Drop(reason, len(samples))
+	if c.onReject != nil && len(samples) > 0 {
+		c.onReject(reason, samples)
+	}
+}
+
+// recordHost remembers the host the latest connection was established to, counting host changes as failovers.
+func (c *Client) recordHost(host string) {
+	previous, _ := c.currentHost.Swap(host).(string)
+	if previous != "" && previous != host {
+		FailoverEvents.Inc()
+		log.Warn("msg", "Database host changed, assuming failover", "previous", previous, "current", host)
+	}
+}
+
+// CurrentHost returns the address of the database host the latest connection was established to.
+func (c *Client) CurrentHost() string {
+	host, _ := c.currentHost.Load().(string)
+	return host
+}
+
+// HealthCheck implements the healtcheck interface. It queries the database time, establishing a connection if
+// there is none, and measures the clock skew from it. It fails with ErrCircuitOpen while the circuit breaker
+// is open.
+func (c *Client) HealthCheck() error {
+	if c.breaker != nil && c.breaker.open() {
+		return c.breaker.openError()
+	}
+	if err := c.measureClockSkew(context.Background()); err != nil {
 		log.Debug("msg", "Health check error", "err", err)
 		return err
 	}
-
-	_ = rows.Close()
+	log.Debug("msg", "Health check succeeded", "host", c.CurrentHost())
 	return nil
 }
 
+// Table returns the prefix of the tables the client writes to, which is also the name of the query view.
+func (c *Client) Table() string {
+	return c.cfg.Table
+}
+
 // Name identifies the client as a PostgreSQL client.
 func (c *Client) Name() string {
 	return "PostgreSQL"
@@ -0,0 +1,453 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+func init() {
+	log.Init("debug")
+}
+
+// permutedMetric rebuilds the metric by inserting its labels in a random order.
+func permutedMetric(m model.Metric, rnd *rand.Rand) model.Metric {
+	names := make([]model.LabelName, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	rnd.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	permuted := make(model.Metric, len(m))
+	for _, name := range names {
+		permuted[name] = m[name]
+	}
+	return permuted
+}
+
+func TestMetricMetaJsonCanonical(t *testing.T) {
+	testCases := []struct {
+		name     string
+		metric   model.Metric
+		expected string
+	}{
+		{
+			name:     "no labels",
+			metric:   model.Metric{model.MetricNameLabel: "up"},
+			expected: `{}`,
+		},
+		{
+			name:     "no name",
+			metric:   model.Metric{"job": "node"},
+			expected: `{"job": "node"}`,
+		},
+		{
+			name:     "plain",
+			metric:   model.Metric{model.MetricNameLabel: "up", "job": "node", "instance": "host:9100"},
+			expected: `{"instance": "host:9100","job": "node"}`,
+		},
+		{
+			name: "quotes and backslashes",
+			metric: model.Metric{
+				model.MetricNameLabel: "up",
+				"a":                   "1",
+				`a"`:                  "2",
+				`a\`:                  "3",
+				"a b":                 `"quoted"`,
+			},
+			expected: `{"a": "1","a b": "\"quoted\"","a\"": "2","a\\": "3"}`,
+		},
+		{
+			name: "non-ascii and empty values",
+			metric: model.Metric{
+				model.MetricNameLabel: "up",
+				"\u00e9":              "",
+				"z":                   "\u00fc",
+				"Z":                   "",
+				"\u3000":              "\u3000",
+			},
+			expected: "{\"Z\": \"\",\"z\": \"\u00fc\",\"\u00e9\": \"\",\"\u3000\": \"\u3000\"}",
+		},
+	}
+
+	rnd := rand.New(rand.NewSource(42))
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			_, expectedJson := MetricMetaJson(c.metric)
+			if expectedJson != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, expectedJson)
+			}
+			for i := 0; i < 50; i++ {
+				_, labelsJson := MetricMetaJson(permutedMetric(c.metric, rnd))
+				if labelsJson != expectedJson {
+					t.Fatalf("Permuted metric rendered differently: %s != %s", labelsJson, expectedJson)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricMetaJsonRoundTrip(t *testing.T) {
+	metric := model.Metric{
+		model.MetricNameLabel: "node_cpu_seconds_total",
+		`"`:                   `\`,
+		"tab\t":               "new\nline",
+		"日本":                  "語",
+		"empty":               "",
+	}
+	name, labelsJson := MetricMetaJson(metric)
+	if name != "node_cpu_seconds_total" {
+		t.Errorf("Unexpected metric name %q", name)
+	}
+	decoded := map[string]string{}
+	if err := json.Unmarshal([]byte(labelsJson), &decoded); err != nil {
+		t.Fatalf("Rendered labels are not valid JSON: %v", err)
+	}
+	if len(decoded) != len(metric)-1 {
+		t.Errorf("Expected %d labels, got %d", len(metric)-1, len(decoded))
+	}
+	for label, value := range metric {
+		if label == model.MetricNameLabel {
+			continue
+		}
+		if decoded[string(label)] != string(value) {
+			t.Errorf("Label %q: expected %q, got %q", label, value, decoded[string(label)])
+		}
+	}
+}
+
+func TestRecordHostCountsFailovers(t *testing.T) {
+	client := &Client{}
+	before := testutil.ToFloat64(FailoverEvents)
+	client.recordHost("10.0.0.1:5432")
+	client.recordHost("10.0.0.1:5432")
+	if delta := testutil.ToFloat64(FailoverEvents) - before; delta != 0 {
+		t.Errorf("Expected no failover, got %v", delta)
+	}
+	client.recordHost("10.0.0.2:5432")
+	if delta := testutil.ToFloat64(FailoverEvents) - before; delta != 1 {
+		t.Errorf("Expected one failover, got %v", delta)
+	}
+	if host := client.CurrentHost(); host != "10.0.0.2:5432" {
+		t.Errorf("Unexpected current host %q", host)
+	}
+}
+
+// benchmarkWrite copies a batch of samples into a scratch normalized layout. It needs a database, given as
+// connection string in TS_PROM_BENCH_PG_DSN.
+func benchmarkWrite(b *testing.B, batchSize int, configure func(cfg *Config)) {
+	dsn := os.Getenv("TS_PROM_BENCH_PG_DSN")
+	if dsn == "" {
+		b.Skip("TS_PROM_BENCH_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	cfg := &Config{Table: "bench_metrics"}
+	configure(cfg)
+	client := &Client{DB: db, cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	if err := client.EnsureSchema(); err != nil {
+		b.Fatal(err)
+	}
+
+	samples := make(model.Samples, 0, batchSize)
+	now := model.Now()
+	for i := 0; i < cap(samples); i++ {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "bench", "instance": model.LabelValue(fmt.Sprintf("host-%d", i%1000)), "job": "node"},
+			Value:     model.SampleValue(i),
+			Timestamp: now.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Write(samples); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "samples/s")
+}
+
+// The samples of the benchmark batches interleave 1000 series, as scrapes of many targets do.
+func BenchmarkWriteUnsorted10k(b *testing.B) {
+	benchmarkWrite(b, 10000, func(cfg *Config) {})
+}
+
+func BenchmarkWriteSorted10k(b *testing.B) {
+	benchmarkWrite(b, 10000, func(cfg *Config) { cfg.SortBatch = true })
+}
+
+func BenchmarkWriteUnsorted100k(b *testing.B) {
+	benchmarkWrite(b, 100000, func(cfg *Config) {})
+}
+
+func BenchmarkWriteSorted100k(b *testing.B) {
+	benchmarkWrite(b, 100000, func(cfg *Config) { cfg.SortBatch = true })
+}
+
+// TestWriteTimestampRoundTrip writes a sample on a session in another time zone and reads back its exact
+// timestamp. It needs a database, given as connection string in TS_PROM_TEST_PG_DSN.
+func TestWriteTimestampRoundTrip(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn+" timezone=Asia/Kathmandu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "tz_test_metrics"
+	cfg.LabelStorage = labelStorageNormalized
+	cfg.CheckIndexes = false
+	client := &Client{DB: db, cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, table := range []string{"view " + cfg.Table, "table " + cfg.Table + "_values", "table " + cfg.Table + "_label_kv", "table " + cfg.Table + "_label_keys", "table " + cfg.Table + "_labels"} {
+			_, _ = db.Exec("drop " + table + " cascade")
+		}
+	}()
+
+	timestamp := model.Time(1700000000123)
+	sample := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "tz_round_trip"}, Value: 1, Timestamp: timestamp}
+	if err := client.Write(model.Samples{sample}); err != nil {
+		t.Fatal(err)
+	}
+	var written time.Time
+	if err := db.QueryRow("select time from tz_test_metrics where name = 'tz_round_trip'").Scan(&written); err != nil {
+		t.Fatal(err)
+	}
+	if read := model.TimeFromUnixNano(written.UnixNano()); read != timestamp {
+		t.Errorf("Expected timestamp %d to be read back, got %d", timestamp, read)
+	}
+}
+
+// TestWriteCancelledDuringCopy cancels a write during its COPY and checks that the following writes on the
+// pool of a single connection succeed. It needs a database, given as connection string in TS_PROM_TEST_PG_DSN.
+func TestWriteCancelledDuringCopy(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	monitor, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "cancel_test_metrics"
+	cfg.LabelStorage = labelStorageNormalized
+	cfg.CheckIndexes = false
+	client := &Client{DB: db, cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, table := range []string{"view " + cfg.Table, "table " + cfg.Table + "_values", "table " + cfg.Table + "_label_kv", "table " + cfg.Table + "_label_keys", "table " + cfg.Table + "_labels"} {
+			_, _ = monitor.Exec("drop " + table + " cascade")
+		}
+	}()
+
+	samples := make(model.Samples, 0, 500000)
+	for i := 0; i < cap(samples); i++ {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "cancelled", "instance": model.LabelValue(fmt.Sprintf("host-%d", i%1000))},
+			Value:     model.SampleValue(i),
+			Timestamp: model.Time(1700000000000 + int64(i)),
+		})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		for ctx.Err() == nil {
+			var copying bool
+			err := monitor.QueryRow("select exists (select 1 from pg_stat_activity where state = 'active' and query ilike 'copy %')").Scan(&copying)
+			if err != nil || copying {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if _, err := client.WriteContext(ctx, samples); err == nil {
+		t.Log("The write completed before it was cancelled")
+	}
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := client.Write(samples[:10]); err != nil {
+			t.Fatalf("Expected the write after the cancelled one to succeed, got %v", err)
+		}
+	}
+}
+
+// TestCleanupCancelled checks that the temp table of a cancelled write is dropped, and that the connection
+// is discarded if it can't be.
+func TestCleanupCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, failing := range []bool{false, true} {
+		recording := &recordingDB{}
+		if failing {
+			recording.errs = map[string]error{"drop table": errors.New("connection reset by peer")}
+		}
+		db := sql.OpenDB(recording)
+		client := &Client{DB: db, cfg: DefaultConfig(), staging: "metrics_staging"}
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.cleanup(ctx, conn)
+		if statements := recording.recorded(); len(statements) != 1 || statements[0] != "drop table if exists metrics_staging;" {
+			t.Errorf("Expected the temp table to be dropped, got %v", statements)
+		}
+		stats := db.Stats()
+		if failing && (stats.OpenConnections != 0 || client.brokenConns.Load() != 1) {
+			t.Errorf("Expected the connection to be discarded, got %d open connections", stats.OpenConnections)
+		}
+		if !failing && (stats.Idle != 1 || client.brokenConns.Load() != 0) {
+			t.Errorf("Expected the connection to be returned to the pool, got %d idle connections", stats.Idle)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	db, err := sql.Open("pgx", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	client := &Client{DB: db, cfg: DefaultConfig(), labels: &jsonbLabelStore{table: "metrics"}}
+	if err := client.Write(model.Samples{}); err != nil {
+		t.Errorf("Expected writing no samples to succeed without database, got %v", err)
+	}
+	if open := db.Stats().OpenConnections; open != 0 {
+		t.Errorf("Expected no connection to be opened, got %d", open)
+	}
+}
+
+func TestCopyOrder(t *testing.T) {
+	a := model.Metric{model.MetricNameLabel: "up", "job": "a"}
+	b := model.Metric{model.MetricNameLabel: "up", "job": "b"}
+	samples := model.Samples{
+		{Metric: a, Timestamp: 3},
+		{Metric: b, Timestamp: 2},
+		{Metric: a, Timestamp: 1},
+		{Metric: b, Timestamp: 1},
+	}
+	client := &Client{cfg: &Config{}}
+	if order := client.copyOrder(samples); fmt.Sprint(order) != "[0 1 2 3]" {
+		t.Errorf("Expected samples in received order, got %v", order)
+	}
+	client.cfg.SortBatch = true
+	expected := "[2 0 3 1]"
+	if b.Fingerprint() < a.Fingerprint() {
+		expected = "[3 1 2 0]"
+	}
+	if order := client.copyOrder(samples); fmt.Sprint(order) != expected {
+		t.Errorf("Expected %s, got %v", expected, order)
+	}
+}
+
+func TestCopyGroups(t *testing.T) {
+	up := model.Metric{model.MetricNameLabel: "up", "job": "a"}
+	load := model.Metric{model.MetricNameLabel: "node_load1", "job": "a"}
+	requests := model.Metric{model.MetricNameLabel: "http_requests_total", "job": "a"}
+	samples := model.Samples{
+		{Metric: up, Timestamp: 1},
+		{Metric: load, Timestamp: 1},
+		{Metric: up, Timestamp: 2},
+		{Metric: requests, Timestamp: 1},
+		{Metric: load, Timestamp: 2},
+	}
+	order := []int{0, 1, 2, 3, 4}
+	client := &Client{cfg: &Config{GroupCopyMaxGroups: 3}}
+	if groups := client.copyGroups(samples, order); fmt.Sprint(groups) != "[[0 1 2 3 4]]" {
+		t.Errorf("Expected a single group without grouping by metric, got %v", groups)
+	}
+	client.cfg.GroupCopyByMetric = true
+	if groups := client.copyGroups(samples, order); fmt.Sprint(groups) != "[[3] [1 4] [0 2]]" {
+		t.Errorf("Expected the samples grouped by metric name in copy order, got %v", groups)
+	}
+	if groups := client.copyGroups(samples, []int{4, 3, 2, 1, 0}); fmt.Sprint(groups) != "[[3] [4 1] [2 0]]" {
+		t.Errorf("Expected the copy order to be kept within groups, got %v", groups)
+	}
+	client.cfg.GroupCopyMaxGroups = 2
+	if groups := client.copyGroups(samples, order); fmt.Sprint(groups) != "[[0 1 2 3 4]]" {
+		t.Errorf("Expected a single group beyond the maximum number of groups, got %v", groups)
+	}
+}
+
+func TestNewClientErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PasswordFile, cfg.PasswordCommand = "/run/secrets/pg", "cat /run/secrets/pg"
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for password file and command")
+	}
+	cfg = DefaultConfig()
+	cfg.PartitionByMetric = true
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for partitioning the jsonb layout")
+	}
+	cfg = DefaultConfig()
+	cfg.LowPriorityMaxOpenConns = 0
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for a low priority pool without connections")
+	}
+	cfg = DefaultConfig()
+	cfg.GroupCopyByMetric, cfg.GroupCopyMaxGroups = true, 0
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for grouping the COPY by metric without groups")
+	}
+	cfg = DefaultConfig()
+	cfg.ApplyChunkRecommendation = true
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for applying chunk recommendations without chunk advisor")
+	}
+
+	client, err := NewClient(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestRegisterFlagsPrefixed(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	primary := RegisterFlags(fs, "pg", &Config{})
+	secondary := RegisterFlags(fs, "pg2", &Config{})
+	if err := fs.Parse([]string{"-pg-host=db1", "-pg2-host=db2", "-pg2-table=mirror"}); err != nil {
+		t.Fatal(err)
+	}
+	if primary.Host != "db1" || secondary.Host != "db2" {
+		t.Errorf("Unexpected hosts %q and %q", primary.Host, secondary.Host)
+	}
+	if primary.Table != "metrics" || secondary.Table != "mirror" {
+		t.Errorf("Unexpected tables %q and %q", primary.Table, secondary.Table)
+	}
+	if usage := fs.Lookup("pg2-password-command").Usage; !strings.Contains(usage, "-pg2-password-file") {
+		t.Errorf("Usage refers to the wrong flag: %s", usage)
+	}
+}
@@ -0,0 +1,115 @@
+package pgprometheus
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// clockSkewLogInterval is how often a clock skew over the threshold is logged while it lasts.
+const clockSkewLogInterval = 10 * time.Minute
+
+// ClockSkew is the difference between the database clock and the local clock, as of the latest measurement.
+var ClockSkew = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "adapter_db_clock_skew_seconds",
+		Help: "Difference between the database clock and the local clock in seconds, positive if the local clock is behind, as of the latest health check.",
+	},
+)
+
+// clockSkew is the latest measured difference between the database clock and the local clock. A skew larger
+// than threshold is logged as a warning, 0 disables the warning.
+type clockSkew struct {
+	threshold time.Duration
+	skew      atomic.Int64
+
+	mutex   sync.Mutex
+	over    bool
+	lastLog time.Time
+}
+
+// observe records the database time returned by a query sent at sent and answered at received. It is
+// compared to the local time halfway, so the error of the skew is at most half the round trip.
+func (c *clockSkew) observe(sent time.Time, received time.Time, db time.Time) time.Duration {
+	skew := db.Sub(sent.Add(received.Sub(sent) / 2))
+	c.skew.Store(int64(skew))
+	ClockSkew.Set(skew.Seconds())
+	c.check(skew, received)
+	return skew
+}
+
+// check logs a warning when the skew exceeds the threshold, again every clockSkewLogInterval while it does.
+func (c *clockSkew) check(skew time.Duration, now time.Time) {
+	if c.threshold <= 0 {
+		return
+	}
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch {
+	case abs > c.threshold:
+		if !c.over || now.Sub(c.lastLog) >= clockSkewLogInterval {
+			c.lastLog = now
+			log.Warn("msg", "Clock skew between the adapter and the database over the threshold, sample ages are off by as much", "skew", skew, "threshold", c.threshold)
+		}
+		c.over = true
+	case c.over:
+		c.over = false
+		log.Info("msg", "Clock skew between the adapter and the database back under the threshold", "skew", skew)
+	}
+}
+
+// now returns the local time corrected by the latest skew, which is the local time until one was measured.
+func (c *clockSkew) now(local time.Time) time.Time {
+	return local.Add(time.Duration(c.skew.Load()))
+}
+
+// measureClockSkew runs the health check query, recording the skew of the clocks from the database time
+// it returns.
+func (c *Client) measureClockSkew(ctx context.Context) error {
+	var now time.Time
+	sent := time.Now()
+	if err := c.DB.QueryRowContext(ctx, sqlHealthCheck).Scan(&now); err != nil {
+		return err
+	}
+	if c.clock != nil {
+		skew := c.clock.observe(sent, time.Now(), now)
+		log.Debug("msg", "Measured clock skew", "skew", skew)
+	}
+	return nil
+}
+
+// checkClock measures the clock skew every interval until the client is closed, besides the health checks.
+func (c *Client) checkClock(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := c.measureClockSkew(ctx); err != nil {
+			log.Debug("msg", "Error measuring the clock skew, keeping the previous one", "err", err)
+		}
+		cancel()
+	}
+}
+
+// DBNow returns the current time of the database clock, estimated from the local time and the latest
+// measured clock skew.
+func (c *Client) DBNow() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.now(time.Now())
+}
@@ -0,0 +1,43 @@
+package pgprometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClockSkew(t *testing.T) {
+	c := &clockSkew{threshold: time.Minute}
+	local := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if now := c.now(local); !now.Equal(local) {
+		t.Errorf("Expected the local time before the skew is measured, got %v", now)
+	}
+
+	// the database answered halfway through a 2s round trip, 4 minutes ahead
+	skew := c.observe(local, local.Add(2*time.Second), local.Add(4*time.Minute+time.Second))
+	if skew != 4*time.Minute {
+		t.Errorf("Expected a skew of 4m, got %v", skew)
+	}
+	if gauge := testutil.ToFloat64(ClockSkew); gauge != 240 {
+		t.Errorf("Expected the gauge to be 240, got %v", gauge)
+	}
+	if now := c.now(local); !now.Equal(local.Add(4 * time.Minute)) {
+		t.Errorf("Expected the local time corrected by the skew, got %v", now)
+	}
+	if !c.over {
+		t.Error("Expected the skew to be over the threshold")
+	}
+
+	c.observe(local, local, local.Add(-30*time.Second))
+	if gauge := testutil.ToFloat64(ClockSkew); gauge != -30 {
+		t.Errorf("Expected a database clock behind to be negative, got %v", gauge)
+	}
+	if c.over {
+		t.Error("Expected the skew to be back under the threshold")
+	}
+	c.observe(local, local, local.Add(-2*time.Minute))
+	if !c.over {
+		t.Error("Expected a negative skew to be compared by its size")
+	}
+}
@@ -0,0 +1,88 @@
+package pgprometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// synchronousCommitModes are the accepted values of synchronous_commit.
+var synchronousCommitModes = map[string]bool{"on": true, "off": true, "local": true, "remote_write": true, "remote_apply": true}
+
+// ErrNotVisible is returned by writes of which the samples committed, but weren't visible to another
+// connection afterwards.
+var ErrNotVisible = errors.New("committed samples aren't visible")
+
+// CommitDuration observes the commits of writes by synchronous_commit mode, "default" being the server setting.
+var CommitDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "write_commit_duration_seconds",
+		Help:    "Duration of the commits of writes, by synchronous_commit mode.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	},
+	[]string{"synchronous_commit"},
+)
+
+// VisibilityCheckDuration observes the checks that the samples of writes are visible after the commit.
+var VisibilityCheckDuration = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "write_visibility_check_duration_seconds",
+		Help:    "Duration of the checks that committed samples are visible to another connection.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	},
+)
+
+// VisibilityCheckFailures counts the writes of which the committed samples weren't visible.
+var VisibilityCheckFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "write_visibility_check_failures_total",
+		Help: "Total number of writes of which the committed samples weren't visible to another connection.",
+	},
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlSetSynchronousCommit = "set local synchronous_commit = %s"
+	sqlVisibilityCheck      = "select count(*) from %s_values where time = $1"
+)
+
+// commitMode returns the synchronous_commit label of the commit duration.
+func commitMode(synchronousCommit string) string {
+	if synchronousCommit == "" {
+		return "default"
+	}
+	return synchronousCommit
+}
+
+// checkVisibility makes sure the latest sample of a committed write can be read by another connection of
+// the pool.
+func (c *Client) checkVisibility(ctx context.Context, samples model.Samples) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	latest := samples[0].Timestamp
+	for _, s := range samples[1:] {
+		if s.Timestamp > latest {
+			latest = s.Timestamp
+		}
+	}
+	begin := time.Now()
+	var count int64
+	err := c.DB.QueryRowContext(ctx, fmt.Sprintf(sqlVisibilityCheck, c.cfg.Table), latest.Time().UTC()).Scan(&count)
+	VisibilityCheckDuration.Observe(time.Since(begin).Seconds())
+	if err != nil {
+		return fmt.Errorf("error checking the visibility of committed samples: %w", err)
+	}
+	if count == 0 {
+		VisibilityCheckFailures.Inc()
+		log.Error("msg", "Committed samples aren't visible", "time", latest.Time().UTC())
+		return ErrNotVisible
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+func TestSynchronousCommitValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SynchronousCommit = "sometimes"
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for unknown synchronous commit mode")
+	}
+	cfg.SynchronousCommit = "remote_apply"
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if class, _ := ClassifyError(fmt.Errorf("write: %w", ErrNotVisible)); class != ErrorClassNotVisible {
+		t.Errorf("Expected class %q, got %q", ErrorClassNotVisible, class)
+	}
+}
+
+// TestWriteSynchronousCommit writes with synchronous_commit off and the visibility check in both staging
+// modes, and checks the commits are observed by mode. It needs a database, given as connection string in
+// TS_PROM_TEST_PG_DSN.
+func TestWriteSynchronousCommit(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, mode := range []string{stagingModeTemp, stagingModeUnlogged} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Table = "sync_commit_test_metrics"
+			cfg.LabelStorage = labelStorageNormalized
+			cfg.StagingMode = mode
+			cfg.StagingInstanceID = "test"
+			cfg.CheckIndexes = false
+			cfg.SynchronousCommit = "off"
+			cfg.CommitVisibilityCheck = true
+			client := &Client{DB: db, cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+			if err := client.EnsureSchema(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if client.stagingOwner != "" {
+					client.releaseStaging()
+				}
+				for _, table := range []string{"view " + cfg.Table, "table " + cfg.Table + "_values", "table " + cfg.Table + "_label_kv", "table " + cfg.Table + "_label_keys", "table " + cfg.Table + "_labels", "table if exists " + client.staging, "table if exists " + cfg.Table + "_staging_registry"} {
+					_, _ = db.Exec("drop " + table + " cascade")
+				}
+			}()
+
+			commits := commitCount(t, "off")
+			checks := testutil.ToFloat64(VisibilityCheckFailures)
+			sample := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "sync_commit"}, Value: 1, Timestamp: 1700000000000}
+			if err := client.Write(model.Samples{sample}); err != nil {
+				t.Fatal(err)
+			}
+			if observed := commitCount(t, "off") - commits; observed == 0 {
+				t.Error("Expected the commits to be observed as synchronous_commit off")
+			}
+			if failures := testutil.ToFloat64(VisibilityCheckFailures); failures != checks {
+				t.Errorf("Expected the samples to be visible, got %v failures", failures-checks)
+			}
+		})
+	}
+}
+
+// commitCount returns the number of commits observed with a synchronous_commit mode.
+func commitCount(t *testing.T, mode string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := CommitDuration.WithLabelValues(mode).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
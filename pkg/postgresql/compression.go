@@ -0,0 +1,154 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	pgx_stdlib "github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// Policies for samples falling into compressed chunks.
+const (
+	lateDataWrite    = "write"
+	lateDataDrop     = "drop"
+	lateDataOverflow = "overflow"
+)
+
+// CompressedChunkSamples counts the samples dropped for falling into a compressed chunk.
+var CompressedChunkSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "dropped_samples_compressed_chunk_total",
+		Help: "Total number of samples dropped because they are older than the compression horizon of the values table.",
+	},
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlCompressionHorizon = "select max(range_end) from timescaledb_information.chunks where hypertable_schema = current_schema() and hypertable_name = $1 and is_compressed"
+	sqlCreateOverflow     = "create table if not exists %s_values_overflow (time timestamp with time zone not null, value double precision, metric_name text not null, labels jsonb not null);"
+)
+
+// compressionHorizon caches the end of the newest compressed chunk of the values table. Samples before it
+// would be written into a compressed chunk. It is refreshed periodically, and early after an insert ran into
+// a compressed chunk.
+type compressionHorizon struct {
+	interval time.Duration
+	lookup   func(ctx context.Context) (time.Time, error)
+	horizon  atomic.Int64
+	refresh  chan struct{}
+}
+
+func newCompressionHorizon(interval time.Duration, lookup func(ctx context.Context) (time.Time, error)) *compressionHorizon {
+	return &compressionHorizon{interval: interval, lookup: lookup, refresh: make(chan struct{}, 1)}
+}
+
+// run refreshes the horizon every interval and when requested until stop is closed.
+func (h *compressionHorizon) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.update()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-h.refresh:
+		}
+	}
+}
+
+func (h *compressionHorizon) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	horizon, err := h.lookup(ctx)
+	if err != nil {
+		log.Warn("msg", "Error looking up the compression horizon, keeping the previous one", "err", err)
+		return
+	}
+	h.set(horizon)
+}
+
+func (h *compressionHorizon) set(horizon time.Time) {
+	if horizon.IsZero() {
+		h.horizon.Store(0)
+		return
+	}
+	h.horizon.Store(horizon.UnixNano())
+}
+
+// requestRefresh makes run refresh the horizon without waiting for the next interval.
+func (h *compressionHorizon) requestRefresh() {
+	select {
+	case h.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// split splits off the samples before the horizon.
+func (h *compressionHorizon) split(samples model.Samples) (current model.Samples, late model.Samples) {
+	horizon := h.horizon.Load()
+	if horizon == 0 {
+		return samples, nil
+	}
+	current = make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		if s.Timestamp.UnixNano() < horizon {
+			late = append(late, s)
+			continue
+		}
+		current = append(current, s)
+	}
+	return current, late
+}
+
+// isCompressedChunkConflict tells whether an insert failed because it hit a compressed chunk.
+func isCompressedChunkConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "0A000" && strings.Contains(pgErr.Message, "compressed")
+}
+
+// lookupCompressionHorizon queries the end of the newest compressed chunk of the values table, or the zero
+// time if no chunk is compressed.
+func (c *Client) lookupCompressionHorizon(ctx context.Context) (time.Time, error) {
+	var horizon sql.NullTime
+	if err := c.DB.QueryRowContext(ctx, sqlCompressionHorizon, c.cfg.Table+"_values").Scan(&horizon); err != nil {
+		return time.Time{}, err
+	}
+	return horizon.Time, nil
+}
+
+// ensureOverflow creates the table samples before the compression horizon are routed to.
+func (c *Client) ensureOverflow(ctx context.Context) error {
+	if c.cfg.LateDataPolicy != lateDataOverflow {
+		return nil
+	}
+	if _, err := c.DB.ExecContext(ctx, fmt.Sprintf(sqlCreateOverflow, c.cfg.Table)); err != nil {
+		return fmt.Errorf("error creating overflow table: %w", err)
+	}
+	return nil
+}
+
+// writeOverflow copies samples into the overflow table, keeping their labels with each sample.
+func (c *Client) writeOverflow(ctx context.Context, conn *sql.Conn, samples model.Samples) error {
+	rows := make([][]interface{}, 0, len(samples))
+	for _, s := range samples {
+		metricName, labelsJson := c.seriesJson(ctx, s.Metric)
+		rows = append(rows, []interface{}{s.Timestamp.Time().UTC(), float64(s.Value), metricName, labelsJson})
+	}
+	return conn.Raw(func(driverConn any) error {
+		conn := driverConn.(*pgx_stdlib.Conn).Conn()
+		_, err := conn.CopyFrom(ctx, []string{c.cfg.Table + "_values_overflow"}, []string{"time", "value", "metric_name", "labels"}, pgx.CopyFromRows(rows))
+		return err
+	})
+}
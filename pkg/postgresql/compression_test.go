@@ -0,0 +1,68 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/common/model"
+)
+
+func TestCompressionHorizonSplit(t *testing.T) {
+	h := newCompressionHorizon(time.Minute, nil)
+	samples := model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: 2000},
+		{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: 3000},
+	}
+	current, late := h.split(samples)
+	if !current.Equal(samples) || len(late) != 0 {
+		t.Errorf("Expected all samples to be current without a horizon, got %v and %v", current, late)
+	}
+
+	h.set(model.Time(2000).Time())
+	current, late = h.split(samples)
+	if !current.Equal(samples[1:]) {
+		t.Errorf("Expected %v, got %v", samples[1:], current)
+	}
+	if !late.Equal(samples[:1]) {
+		t.Errorf("Expected %v to be late, got %v", samples[:1], late)
+	}
+}
+
+func TestCompressionHorizonRequestRefresh(t *testing.T) {
+	h := newCompressionHorizon(time.Minute, nil)
+	// requests don't block while a refresh is pending
+	h.requestRefresh()
+	h.requestRefresh()
+	if len(h.refresh) != 1 {
+		t.Errorf("Expected one pending refresh, got %d", len(h.refresh))
+	}
+}
+
+func TestIsCompressedChunkConflict(t *testing.T) {
+	conflict := &pgconn.PgError{Code: "0A000", Message: "insert into a compressed chunk that has primary or unique constraint is not supported"}
+	if !isCompressedChunkConflict(fmt.Errorf("values: %w", conflict)) {
+		t.Error("Expected compressed chunk conflict")
+	}
+	if isCompressedChunkConflict(&pgconn.PgError{Code: "0A000", Message: "cannot copy to view"}) {
+		t.Error("Expected other unsupported features not to be a compressed chunk conflict")
+	}
+	if isCompressedChunkConflict(&pgconn.PgError{Code: "23505", Message: "compressed"}) {
+		t.Error("Expected other SQLSTATEs not to be a compressed chunk conflict")
+	}
+}
+
+func TestNewClientLateDataErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LateDataPolicy = "ignore"
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for unknown late data policy")
+	}
+	cfg = DefaultConfig()
+	cfg.LabelStorage, cfg.PartitionByMetric, cfg.LateDataPolicy = labelStorageNormalized, true, lateDataDrop
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for late data policy with partitioning by metric")
+	}
+}
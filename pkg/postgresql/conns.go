@@ -0,0 +1,115 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+var connectionsRecycledDesc = prometheus.NewDesc(
+	"database_connections_recycled_total",
+	"Total number of pooled database connections closed, by reason.",
+	[]string{"reason"}, nil,
+)
+
+// connectionStats exposes why connections left the pool, to verify the lifetime settings take effect.
+type connectionStats struct {
+	client *Client
+}
+
+func (s connectionStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionsRecycledDesc
+}
+
+func (s connectionStats) Collect(ch chan<- prometheus.Metric) {
+	stats := s.client.DB.Stats()
+	ch <- prometheus.MustNewConstMetric(connectionsRecycledDesc, prometheus.CounterValue, float64(stats.MaxLifetimeClosed), "lifetime")
+	ch <- prometheus.MustNewConstMetric(connectionsRecycledDesc, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed), "idle")
+	ch <- prometheus.MustNewConstMetric(connectionsRecycledDesc, prometheus.CounterValue, float64(stats.MaxIdleClosed), "pool_full")
+	ch <- prometheus.MustNewConstMetric(connectionsRecycledDesc, prometheus.CounterValue, float64(s.client.brokenConns.Load()), "broken")
+}
+
+// ConnectionStats returns a collector for the connection pool of the client.
+func (c *Client) ConnectionStats() prometheus.Collector {
+	return connectionStats{client: c}
+}
+
+// keepalive periodically pings the idle connections, so that connections dropped by proxies or NAT
+// gateways are discarded before a write runs into them.
+func (c *Client) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.pingIdleConns(interval)
+		}
+	}
+}
+
+func (c *Client) pingIdleConns(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	idle := c.DB.Stats().Idle
+	for i := 0; i < idle; i++ {
+		conn, err := c.DB.Conn(ctx)
+		if err != nil {
+			log.Debug("msg", "Keepalive could not acquire connection", "err", err)
+			return
+		}
+		// keep the connection checked out, so the next iteration gets another idle one
+		defer func() {
+			_ = conn.Close()
+		}()
+		if err := conn.PingContext(ctx); err != nil {
+			log.Debug("msg", "Keepalive ping failed, discarding connection", "err", err)
+			c.discard(conn)
+		}
+	}
+}
+
+// WarmConnections opens WarmConnections connections of the pool concurrently and pings them, so that the
+// first writes after startup don't wait for connections to be established, with their password lookup and
+// TLS handshake. The connections are all held until each is ready, so that they are distinct, then returned
+// to the pool. It returns the number of connections warmed, and the errors of the others.
+func (c *Client) WarmConnections(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.WarmConnectionsTimeout)
+	defer cancel()
+	conns := make([]*sql.Conn, c.cfg.WarmConnections)
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := c.DB.Conn(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if err := conn.PingContext(ctx); err != nil {
+				errs[i] = err
+				c.discard(conn)
+				return
+			}
+			conns[i] = conn
+		}(i)
+	}
+	wg.Wait()
+	warmed := 0
+	for _, conn := range conns {
+		if conn != nil {
+			warmed++
+			_ = conn.Close()
+		}
+	}
+	return warmed, errors.Join(errs...)
+}
@@ -0,0 +1,118 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectionStats(t *testing.T) {
+	db, err := sql.Open("pgx", "host=localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{DB: db}
+	defer client.Close()
+	client.brokenConns.Add(2)
+
+	expected := `
+# HELP database_connections_recycled_total Total number of pooled database connections closed, by reason.
+# TYPE database_connections_recycled_total counter
+database_connections_recycled_total{reason="broken"} 2
+database_connections_recycled_total{reason="idle"} 0
+database_connections_recycled_total{reason="lifetime"} 0
+database_connections_recycled_total{reason="pool_full"} 0
+`
+	if err := testutil.CollectAndCompare(client.ConnectionStats(), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+// warmConnector opens connections of which the pings fail after the first failAfter connections.
+type warmConnector struct {
+	failAfter int64
+	opened    atomic.Int64
+}
+
+func (c *warmConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &warmConn{fail: c.opened.Add(1) > c.failAfter}, nil
+}
+
+func (c *warmConnector) Driver() driver.Driver {
+	return nil
+}
+
+type warmConn struct {
+	fail bool
+}
+
+func (c *warmConn) Ping(ctx context.Context) error {
+	if c.fail {
+		return errors.New("connection reset by peer")
+	}
+	return nil
+}
+
+func (c *warmConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *warmConn) Close() error {
+	return nil
+}
+
+func (c *warmConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestWarmConnections(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		failAfter int64
+		warmed    int
+		idle      int
+	}{
+		{"all", 10, 4, 4},
+		{"some failing", 3, 3, 3},
+	} {
+		connector := &warmConnector{failAfter: c.failAfter}
+		db := sql.OpenDB(connector)
+		db.SetMaxIdleConns(10)
+		client := &Client{DB: db, cfg: &Config{WarmConnections: 4, WarmConnectionsTimeout: time.Second}}
+		warmed, err := client.WarmConnections(context.Background())
+		if (err != nil) != (warmed < 4) {
+			t.Errorf("%s: expected an error only if connections failed, got %v", c.name, err)
+		}
+		if warmed != c.warmed || connector.opened.Load() != 4 {
+			t.Errorf("%s: expected %d of 4 distinct connections warmed, got %d of %d", c.name, c.warmed, warmed, connector.opened.Load())
+		}
+		if idle := db.Stats().Idle; idle != c.idle {
+			t.Errorf("%s: expected %d idle connections in the pool, got %d", c.name, c.idle, idle)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestNewClientWarmConnectionsErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		cfg  func(cfg *Config)
+	}{
+		{"negative", func(cfg *Config) { cfg.WarmConnections = -1 }},
+		{"beyond idle connections", func(cfg *Config) { cfg.WarmConnections = cfg.MaxIdleConns + 1 }},
+		{"timeout", func(cfg *Config) { cfg.WarmConnections, cfg.WarmConnectionsTimeout = 1, 0 }},
+	} {
+		cfg := DefaultConfig()
+		c.cfg(cfg)
+		if _, err := NewClient(cfg); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
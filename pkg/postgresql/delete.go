@@ -0,0 +1,113 @@
+package pgprometheus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// DeleteOptions controls how DeleteSeries removes samples.
+type DeleteOptions struct {
+	// BatchSize is the maximum number of samples deleted per statement.
+	BatchSize int
+	// BatchPause is the time to sleep between batches, to limit the load on the database.
+	BatchPause time.Duration
+	// RemoveOrphans also deletes the label sets that have no samples left.
+	RemoveOrphans bool
+}
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlDeleteValuesBatch = "delete from %s_values where (tableoid, ctid) in (select tableoid, ctid from %s_values v where %s limit %s)"
+	sqlDeleteOrphans     = "delete from %s_labels l where l.id = any($1) and not exists (select 1 from %s_values v where v.labels_id = l.id)"
+)
+
+// DeleteSeries deletes the samples between start and end of the series matching any of the selectors, in batches
+// of at most opts.BatchSize rows. Zero times leave the respective bound open. progress, if not nil, is called with
+// the total number of deleted samples after every batch.
+func (c *Client) DeleteSeries(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, opts DeleteOptions, progress func(deleted int64)) error {
+	ids, err := c.seriesIDs(ctx, selectors)
+	if err != nil {
+		return err
+	}
+	log.Info("msg", "Deleting series", "series", len(ids), "start", start, "end", end)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := sqlArgs{}
+	conditions := fmt.Sprintf("v.labels_id = any(%s)", args.add(ids))
+	if !start.IsZero() {
+		conditions += fmt.Sprintf(" and v.time >= %s", args.add(start))
+	}
+	if !end.IsZero() {
+		conditions += fmt.Sprintf(" and v.time <= %s", args.add(end))
+	}
+	// (tableoid, ctid) identifies a row across the chunks of a hypertable
+	query := fmt.Sprintf(sqlDeleteValuesBatch, c.cfg.Table, c.cfg.Table, conditions, args.add(opts.BatchSize))
+
+	var deleted int64
+	for {
+		res, err := c.DB.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		deleted += n
+		if progress != nil {
+			progress(deleted)
+		}
+		if n < int64(opts.BatchSize) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(opts.BatchPause):
+		}
+	}
+
+	if opts.RemoveOrphans {
+		if err := c.labels.deleteOrphans(ctx, c.DB, ids); err != nil {
+			return fmt.Errorf("error removing orphaned label sets: %w", err)
+		}
+		if c.labelCache != nil {
+			// the removed label sets would be inserted again by the next write of their series
+			c.labelCache.flush()
+		}
+	}
+	return nil
+}
+
+// seriesIDs resolves the ids of the label sets matching any of the selectors.
+func (c *Client) seriesIDs(ctx context.Context, selectors [][]*labels.Matcher) ([]int64, error) {
+	args := sqlArgs{}
+	condition, err := selectorsToSQL("l", selectors, &args)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("select l.id from %s l where %s", c.labels.labelsRelation(), condition)
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
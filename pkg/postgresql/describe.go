@@ -0,0 +1,137 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// describeTimeout bounds all the queries of Describe together.
+const describeTimeout = 10 * time.Second
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlDescribeServer     = "select current_setting('server_version'), current_user, current_database(), coalesce(current_schema(), ''), current_setting('search_path')"
+	sqlDescribeTimescale  = "select extversion from pg_extension where extname = 'timescaledb'"
+	sqlDescribeRelation   = "select c.relkind::text, case when c.relkind = 'p' then coalesce((select sum(greatest(p.reltuples, 0)) from pg_inherits i join pg_class p on p.oid = i.inhrelid where i.inhparent = c.oid), 0) else c.reltuples end::bigint from pg_class c where c.oid = to_regclass($1)"
+	sqlDescribeHyperCount = "select approximate_row_count($1::regclass)"
+)
+
+// relationKinds names the pg_class relkinds.
+var relationKinds = map[string]string{"r": "table", "p": "partitioned table", "v": "view", "m": "materialized view", "f": "foreign table"}
+
+// Description summarizes the database the client writes to, see Describe.
+type Description struct {
+	ServerVersion string `json:"serverVersion"`
+	// TimescaleDB is the version of the timescaledb extension, empty if it isn't installed.
+	TimescaleDB string `json:"timescaledb"`
+	User        string `json:"user"`
+	Database    string `json:"database"`
+	Schema      string `json:"schema"`
+	SearchPath  string `json:"searchPath"`
+	// SchemaLayout is the layout of the tables detected by EnsureSchema, empty before.
+	SchemaLayout string         `json:"schemaLayout"`
+	Relations    []RelationInfo `json:"relations"`
+	Indexes      []IndexStatus  `json:"indexes"`
+	// ChunkInterval is the latest chunk interval recommendation, nil without ChunkAdvisorInterval or before
+	// the first one.
+	ChunkInterval *ChunkIntervalRecommendation `json:"chunkInterval,omitempty"`
+}
+
+// RelationInfo describes a table or view the adapter uses.
+type RelationInfo struct {
+	Name   string `json:"name"`
+	Exists bool   `json:"exists"`
+	Kind   string `json:"kind,omitempty"`
+	// EstimatedRows is the row count estimated by the planner statistics, nil for views and tables never
+	// analyzed.
+	EstimatedRows *int64 `json:"estimatedRows,omitempty"`
+}
+
+// describedRelations returns the tables and views used with the configuration, the view named after the
+// table first.
+func (c *Client) describedRelations() []string {
+	t := c.cfg.Table
+	relations := append([]string{t}, c.relations()...)
+	if c.cfg.LateDataPolicy == lateDataOverflow {
+		relations = append(relations, t+"_values_overflow")
+	}
+	if c.cfg.StagingMode == stagingModeUnlogged {
+		relations = append(relations, c.staging)
+	}
+	return relations
+}
+
+// Describe gathers the server version, the timescaledb version, the session user, schema and search_path,
+// whether the tables, views and indexes the adapter uses exist and the estimated row counts of the tables,
+// and the latest chunk interval recommendation.
+// The queries run in a read-only transaction and get describeTimeout altogether.
+func (c *Client) Describe(ctx context.Context) (*Description, error) {
+	ctx, cancel := context.WithTimeout(ctx, describeTimeout)
+	defer cancel()
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	d := &Description{SchemaLayout: c.schemaLayout}
+	if c.chunkAdvisor != nil {
+		d.ChunkInterval = c.chunkAdvisor.latest.Load()
+	}
+	if err := tx.QueryRowContext(ctx, sqlDescribeServer).Scan(&d.ServerVersion, &d.User, &d.Database, &d.Schema, &d.SearchPath); err != nil {
+		return nil, fmt.Errorf("error describing the server: %w", err)
+	}
+	err = tx.QueryRowContext(ctx, sqlDescribeTimescale).Scan(&d.TimescaleDB)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error looking up the timescaledb extension: %w", err)
+	}
+	for _, name := range c.describedRelations() {
+		relation, err := describeRelation(ctx, tx, name, d.TimescaleDB != "")
+		if err != nil {
+			return nil, fmt.Errorf("error describing %s: %w", name, err)
+		}
+		d.Relations = append(d.Relations, relation)
+	}
+	if d.Indexes, err = c.indexStatuses(ctx, tx); err != nil {
+		return nil, fmt.Errorf("error looking up indexes: %w", err)
+	}
+	return d, nil
+}
+
+func describeRelation(ctx context.Context, tx *sql.Tx, name string, timescale bool) (RelationInfo, error) {
+	relation := RelationInfo{Name: name}
+	var kind string
+	var rows int64
+	err := tx.QueryRowContext(ctx, sqlDescribeRelation, name).Scan(&kind, &rows)
+	if err == sql.ErrNoRows {
+		return relation, nil
+	}
+	if err != nil {
+		return relation, err
+	}
+	relation.Exists, relation.Kind = true, relationKinds[kind]
+	if relation.Kind == "" {
+		relation.Kind = kind
+	}
+	if timescale && kind == "r" {
+		var hypertable bool
+		if err := tx.QueryRowContext(ctx, sqlIsHypertable, name).Scan(&hypertable); err != nil {
+			return relation, err
+		}
+		if hypertable {
+			// the statistics of a hypertable are those of its chunks
+			relation.Kind = "hypertable"
+			if err := tx.QueryRowContext(ctx, sqlDescribeHyperCount, name).Scan(&rows); err != nil {
+				return relation, err
+			}
+		}
+	}
+	if kind != "v" && rows >= 0 {
+		relation.EstimatedRows = &rows
+	}
+	return relation, nil
+}
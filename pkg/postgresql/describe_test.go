@@ -0,0 +1,68 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDescribedRelations(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LabelStorage = labelStorageNormalized
+	cfg.LateDataPolicy = lateDataOverflow
+	cfg.StagingMode = stagingModeUnlogged
+	cfg.StagingInstanceID = "a"
+	client := &Client{cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	expected := []string{"metrics", "metrics_values", "metrics_labels", "metrics_label_keys", "metrics_label_kv", "metrics_values_overflow", "metrics_staging_a"}
+	if relations := client.describedRelations(); !reflect.DeepEqual(relations, expected) {
+		t.Errorf("Expected %v, got %v", expected, relations)
+	}
+}
+
+// TestDescribe describes a database with the normalized layout set up. It needs a database, given as
+// connection string in TS_PROM_TEST_PG_DSN.
+func TestDescribe(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "describe_test_metrics"
+	cfg.LabelStorage = labelStorageNormalized
+	cfg.CheckIndexes = false
+	client := &Client{DB: db, cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, table := range []string{"view " + cfg.Table, "table " + cfg.Table + "_values", "table " + cfg.Table + "_label_kv", "table " + cfg.Table + "_label_keys", "table " + cfg.Table + "_labels"} {
+			_, _ = db.Exec("drop " + table + " cascade")
+		}
+	}()
+
+	d, err := client.Describe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ServerVersion == "" || d.User == "" || d.SearchPath == "" {
+		t.Errorf("Expected the server and session to be described, got %+v", d)
+	}
+	for _, relation := range d.Relations {
+		if !relation.Exists {
+			t.Errorf("Expected %s to exist", relation.Name)
+		}
+	}
+	if d.Relations[0].Kind != "view" || d.Relations[0].EstimatedRows != nil {
+		t.Errorf("Expected the view first, without row estimate, got %+v", d.Relations[0])
+	}
+	if len(d.Indexes) != len(client.labels.expectedIndexes()) {
+		t.Errorf("Expected %d indexes, got %d", len(client.labels.expectedIndexes()), len(d.Indexes))
+	}
+}
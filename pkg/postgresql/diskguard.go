@@ -0,0 +1,147 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// diskGuardLogInterval is how often the rejection of writes is logged while the database is full.
+const diskGuardLogInterval = time.Minute
+
+// ErrStorageFull is the error of writes while the database is over its size or disk usage limit.
+var ErrStorageFull = errors.New("database is over its size limit, writes are rejected")
+
+// StorageFull is 1 while writes are rejected because the database is over its limit.
+var StorageFull = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "database_storage_full",
+		Help: "1 while writes are rejected because the database is over its size or disk usage limit, 0 otherwise.",
+	},
+)
+
+var validFunctionName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlDatabaseSize = "select pg_database_size(current_database())"
+	sqlDiskUsage    = "select used_bytes, total_bytes from %s()"
+)
+
+// diskUsage is the storage used by the database, and by the volume it is on if known (total is 0 otherwise).
+type diskUsage struct {
+	databaseBytes int64
+	usedBytes     int64
+	totalBytes    int64
+}
+
+// diskGuard switches writes off while the database is over its size limit, or its volume over its usage
+// limit, and back on once usage dropped below resumeRatio of the limits.
+type diskGuard struct {
+	maxBytes    int64
+	maxPercent  float64
+	resumeRatio float64
+	interval    time.Duration
+	lookup      func(ctx context.Context) (diskUsage, error)
+	now         func() time.Time
+
+	full    atomic.Bool
+	lastLog time.Time
+}
+
+func newDiskGuard(cfg *Config, lookup func(ctx context.Context) (diskUsage, error)) *diskGuard {
+	return &diskGuard{
+		maxBytes:    cfg.MaxDatabaseBytes,
+		maxPercent:  cfg.MaxDiskUsagePercent,
+		resumeRatio: cfg.DiskGuardResumeRatio,
+		interval:    cfg.DiskGuardInterval,
+		lookup:      lookup,
+		now:         time.Now,
+	}
+}
+
+// run checks the usage every interval until stop is closed.
+func (g *diskGuard) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.update()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *diskGuard) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), g.interval)
+	defer cancel()
+	usage, err := g.lookup(ctx)
+	if err != nil {
+		log.Warn("msg", "Error looking up the database size, keeping the previous state", "err", err)
+		return
+	}
+	g.check(usage)
+}
+
+// check updates the state from the usage, logging an error every diskGuardLogInterval while full.
+func (g *diskGuard) check(usage diskUsage) {
+	now := g.now()
+	if !g.full.Load() {
+		if g.over(usage, 1) {
+			g.full.Store(true)
+			StorageFull.Set(1)
+			g.logFull(usage, now)
+		}
+		return
+	}
+	if !g.over(usage, g.resumeRatio) {
+		g.full.Store(false)
+		StorageFull.Set(0)
+		log.Info("msg", "Database usage dropped below the limit, writes resume", "database_bytes", usage.databaseBytes, "used_bytes", usage.usedBytes, "total_bytes", usage.totalBytes)
+		return
+	}
+	if now.Sub(g.lastLog) >= diskGuardLogInterval {
+		g.logFull(usage, now)
+	}
+}
+
+func (g *diskGuard) logFull(usage diskUsage, now time.Time) {
+	g.lastLog = now
+	log.Error("msg", "Database over its size limit, rejecting writes", "database_bytes", usage.databaseBytes, "max_database_bytes", g.maxBytes,
+		"used_bytes", usage.usedBytes, "total_bytes", usage.totalBytes, "max_disk_usage_percent", g.maxPercent)
+}
+
+// over tells whether the usage exceeds the given ratio of one of the limits.
+func (g *diskGuard) over(usage diskUsage, ratio float64) bool {
+	if g.maxBytes > 0 && float64(usage.databaseBytes) >= ratio*float64(g.maxBytes) {
+		return true
+	}
+	return g.maxPercent > 0 && usage.totalBytes > 0 && 100*float64(usage.usedBytes)/float64(usage.totalBytes) >= ratio*g.maxPercent
+}
+
+// lookupDiskUsage queries the size of the database and, with DiskUsageFunction, the usage of its volume.
+func (c *Client) lookupDiskUsage(ctx context.Context) (diskUsage, error) {
+	var usage diskUsage
+	if err := c.DB.QueryRowContext(ctx, sqlDatabaseSize).Scan(&usage.databaseBytes); err != nil {
+		return usage, err
+	}
+	if c.cfg.DiskUsageFunction == "" {
+		return usage, nil
+	}
+	var used, total sql.NullInt64
+	if err := c.DB.QueryRowContext(ctx, fmt.Sprintf(sqlDiskUsage, c.cfg.DiskUsageFunction)).Scan(&used, &total); err != nil {
+		return usage, fmt.Errorf("error calling %s: %w", c.cfg.DiskUsageFunction, err)
+	}
+	usage.usedBytes, usage.totalBytes = used.Int64, total.Int64
+	return usage, nil
+}
@@ -0,0 +1,117 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestDiskGuardHysteresis(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxDatabaseBytes = 1000
+	g := newDiskGuard(cfg, nil)
+	steps := []struct {
+		databaseBytes int64
+		full          bool
+	}{
+		{databaseBytes: 500, full: false},
+		{databaseBytes: 1000, full: true},
+		// writes only resume below 90% of the limit
+		{databaseBytes: 950, full: true},
+		{databaseBytes: 899, full: false},
+		{databaseBytes: 950, full: false},
+	}
+	for i, step := range steps {
+		g.check(diskUsage{databaseBytes: step.databaseBytes})
+		if g.full.Load() != step.full {
+			t.Errorf("Step %d: expected full %v at %d bytes", i, step.full, step.databaseBytes)
+		}
+		if gauge := testutil.ToFloat64(StorageFull); gauge != map[bool]float64{false: 0, true: 1}[step.full] {
+			t.Errorf("Step %d: unexpected gauge value %v", i, gauge)
+		}
+	}
+}
+
+func TestDiskGuardUsagePercent(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxDiskUsagePercent = 80
+	g := newDiskGuard(cfg, nil)
+	g.check(diskUsage{databaseBytes: 1 << 40})
+	if g.full.Load() {
+		t.Error("Expected no limit on the database size, nor on an unknown disk usage")
+	}
+	g.check(diskUsage{usedBytes: 85, totalBytes: 100})
+	if !g.full.Load() {
+		t.Error("Expected 85% disk usage to be over the limit")
+	}
+	g.check(diskUsage{usedBytes: 73, totalBytes: 100})
+	if !g.full.Load() {
+		t.Error("Expected 73% disk usage to be within the hysteresis")
+	}
+	g.check(diskUsage{usedBytes: 71, totalBytes: 100})
+	if g.full.Load() {
+		t.Error("Expected writes to resume at 71% disk usage")
+	}
+}
+
+func TestDiskGuardLogsEveryMinute(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxDatabaseBytes = 1000
+	g := newDiskGuard(cfg, nil)
+	now := time.Unix(1000, 0)
+	g.now = func() time.Time { return now }
+	g.check(diskUsage{databaseBytes: 2000})
+	if !g.lastLog.Equal(now) {
+		t.Error("Expected an error to be logged when the database fills up")
+	}
+	now = now.Add(30 * time.Second)
+	g.check(diskUsage{databaseBytes: 2000})
+	if g.lastLog.Equal(now) {
+		t.Error("Expected no error to be logged again within a minute")
+	}
+	now = now.Add(30 * time.Second)
+	g.check(diskUsage{databaseBytes: 2000})
+	if !g.lastLog.Equal(now) {
+		t.Error("Expected the error to be logged again after a minute")
+	}
+}
+
+func TestWriteStorageFull(t *testing.T) {
+	db, err := sql.Open("pgx", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.MaxDatabaseBytes = 1000
+	client := &Client{DB: db, cfg: cfg, labels: &jsonbLabelStore{table: "metrics"}, diskGuard: newDiskGuard(cfg, nil)}
+	client.diskGuard.check(diskUsage{databaseBytes: 1000})
+	err = client.Write(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1, Timestamp: 1}})
+	if !errors.Is(err, ErrStorageFull) {
+		t.Errorf("Expected the write to be rejected, got %v", err)
+	}
+	if class, _ := ClassifyError(err); class != ErrorClassStorageFull {
+		t.Errorf("Expected class %q, got %q", ErrorClassStorageFull, class)
+	}
+	if open := db.Stats().OpenConnections; open != 0 {
+		t.Errorf("Expected no connection to be opened, got %d", open)
+	}
+}
+
+func TestNewClientDiskGuardErrors(t *testing.T) {
+	for name, setup := range map[string]func(cfg *Config){
+		"percent without function": func(cfg *Config) { cfg.MaxDiskUsagePercent = 90 },
+		"invalid function name":    func(cfg *Config) { cfg.MaxDatabaseBytes = 1; cfg.DiskUsageFunction = "usage(); drop table x; --" },
+		"invalid resume ratio":     func(cfg *Config) { cfg.MaxDatabaseBytes = 1; cfg.DiskGuardResumeRatio = 1.5 },
+	} {
+		cfg := DefaultConfig()
+		setup(cfg)
+		if _, err := NewClient(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Error classes of errors that don't come from the database.
+const (
+	ErrorClassTimeout     = "timeout"
+	ErrorClassCanceled    = "canceled"
+	ErrorClassNetwork     = "network"
+	ErrorClassUnknown     = "unknown"
+	ErrorClassOther       = "other_postgres"
+	ErrorClassStorageFull = "storage_full"
+	ErrorClassCircuitOpen = "circuit_open"
+	ErrorClassNotVisible  = "not_visible"
+	ErrorClassCollision   = "fingerprint_collision"
+)
+
+// sqlStateClasses names the SQLSTATE classes, by their first two characters.
+var sqlStateClasses = map[string]string{
+	"08": "connection_exception",
+	"0A": "feature_not_supported",
+	"22": "data_exception",
+	"23": "integrity_constraint_violation",
+	"25": "invalid_transaction_state",
+	"28": "invalid_authorization",
+	"3D": "invalid_catalog_name",
+	"3F": "invalid_schema_name",
+	"40": "transaction_rollback",
+	"42": "syntax_error_or_access_rule_violation",
+	"53": "insufficient_resources",
+	"54": "program_limit_exceeded",
+	"55": "object_not_in_prerequisite_state",
+	"57": "operator_intervention",
+	"58": "system_error",
+	"XX": "internal_error",
+}
+
+// ClassifyError returns the class of an error from the write path, and its SQLSTATE if it was raised by the
+// database. Database errors are classed by SQLSTATE class (eg. insufficient_resources for a full disk),
+// other errors as storage_full, circuit_open, not_visible, fingerprint_collision, timeout, canceled, network
+// or unknown.
+func ClassifyError(err error) (class string, sqlState string) {
+	if errors.Is(err, ErrStorageFull) {
+		return ErrorClassStorageFull, ""
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return ErrorClassCircuitOpen, ""
+	}
+	if errors.Is(err, ErrNotVisible) {
+		return ErrorClassNotVisible, ""
+	}
+	var collision *FingerprintCollisionError
+	if errors.As(err, &collision) {
+		return ErrorClassCollision, ""
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if len(pgErr.Code) == 5 {
+			if class, ok := sqlStateClasses[pgErr.Code[:2]]; ok {
+				return class, pgErr.Code
+			}
+		}
+		return ErrorClassOther, pgErr.Code
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), pgconn.Timeout(err):
+		return ErrorClassTimeout, ""
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled, ""
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, driver.ErrBadConn):
+		return ErrorClassNetwork, ""
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return ErrorClassNetwork, ""
+	}
+	return ErrorClassUnknown, ""
+}
+
+// nonRetryableClasses are the error classes of writes that fail the same way when retried, because of the
+// samples themselves.
+var nonRetryableClasses = map[string]bool{
+	"data_exception":                 true,
+	"integrity_constraint_violation": true,
+	"program_limit_exceeded":         true,
+	ErrorClassCollision:              true,
+}
+
+// RetryableErrorClass tells whether a write failing with an error of the class returned by ClassifyError may
+// succeed when retried.
+func RetryableErrorClass(class string) bool {
+	return !nonRetryableClasses[class]
+}
@@ -0,0 +1,55 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		class    string
+		sqlState string
+	}{
+		{name: "disk full", err: &pgconn.PgError{Code: "53100"}, class: "insufficient_resources", sqlState: "53100"},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}, class: "transaction_rollback", sqlState: "40P01"},
+		{name: "permission denied", err: &pgconn.PgError{Code: "42501"}, class: "syntax_error_or_access_rule_violation", sqlState: "42501"},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, class: "integrity_constraint_violation", sqlState: "23505"},
+		{name: "admin shutdown", err: &pgconn.PgError{Code: "57P01"}, class: "operator_intervention", sqlState: "57P01"},
+		{name: "connection failure", err: &pgconn.PgError{Code: "08006"}, class: "connection_exception", sqlState: "08006"},
+		{name: "wrapped", err: fmt.Errorf("insert: %w", &pgconn.PgError{Code: "XX000"}), class: "internal_error", sqlState: "XX000"},
+		{name: "unknown class", err: &pgconn.PgError{Code: "P0001"}, class: ErrorClassOther, sqlState: "P0001"},
+		{name: "deadline", err: fmt.Errorf("copy: %w", context.DeadlineExceeded), class: ErrorClassTimeout},
+		{name: "canceled", err: context.Canceled, class: ErrorClassCanceled},
+		{name: "network", err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, class: ErrorClassNetwork},
+		{name: "bad conn", err: driver.ErrBadConn, class: ErrorClassNetwork},
+		{name: "other", err: errors.New("boom"), class: ErrorClassUnknown},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			class, sqlState := ClassifyError(c.err)
+			if class != c.class || sqlState != c.sqlState {
+				t.Errorf("Expected %s/%s, got %s/%s", c.class, c.sqlState, class, sqlState)
+			}
+		})
+	}
+}
+
+func TestRetryableErrorClass(t *testing.T) {
+	for code, expected := range map[string]bool{"22003": false, "23505": false, "54000": false, "53100": true, "40P01": true, "08006": true} {
+		class, _ := ClassifyError(&pgconn.PgError{Code: code})
+		if retryable := RetryableErrorClass(class); retryable != expected {
+			t.Errorf("Expected %s (%s) to be retryable %v", code, class, expected)
+		}
+	}
+	if !RetryableErrorClass(ErrorClassNetwork) || !RetryableErrorClass(ErrorClassUnknown) {
+		t.Error("Expected network and unknown errors to be retryable")
+	}
+}
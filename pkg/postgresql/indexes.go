@@ -0,0 +1,255 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// Index statuses reported by CheckIndexes
+const (
+	IndexOK       = "ok"
+	IndexMissing  = "missing"
+	IndexInvalid  = "invalid"
+	IndexCreating = "creating"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlListIndexes     = "select t.relname, c.relname, am.amname, i.indisunique, i.indisvalid, array_to_string(array(select pg_get_indexdef(i.indexrelid, k, true) from generate_series(1, i.indnkeyatts) k order by k), ',') from pg_index i join pg_class c on c.oid = i.indexrelid join pg_class t on t.oid = i.indrelid join pg_am am on am.oid = c.relam where t.relnamespace = current_schema()::regnamespace and t.relname = any($1)"
+	sqlIsHypertable    = "select exists (select 1 from timescaledb_information.hypertables where hypertable_schema = current_schema() and hypertable_name = $1)"
+	sqlIndexProgress   = "select phase, blocks_done, blocks_total from pg_stat_progress_create_index where pid = $1"
+	sqlBackendPid      = "select pg_backend_pid()"
+	indexCreateRetries = 3
+	indexProgressEvery = 30 * time.Second
+)
+
+// expectedIndex is an index queries or writes rely on.
+type expectedIndex struct {
+	table   string
+	method  string
+	unique  bool
+	columns []string
+}
+
+func (i expectedIndex) name() string {
+	return fmt.Sprintf("%s_%s_%s_idx", i.table, strings.Join(i.columns, "_"), i.method)
+}
+
+func (i expectedIndex) String() string {
+	kind := i.method
+	if i.unique {
+		kind = "unique " + kind
+	}
+	return fmt.Sprintf("%s index on %s (%s)", kind, i.table, strings.Join(i.columns, ", "))
+}
+
+// matches tells whether an existing index serves the purpose of the expected one. Unique indexes need the
+// exact columns, other indexes only need to start with them.
+func (i expectedIndex) matches(method string, unique bool, columns []string) bool {
+	if method != i.method || (i.unique && !unique) || len(columns) < len(i.columns) || (i.unique && len(columns) != len(i.columns)) {
+		return false
+	}
+	for n, column := range i.columns {
+		if columns[n] != column {
+			return false
+		}
+	}
+	return true
+}
+
+// indexColumns splits the key columns listed by sqlListIndexes, unquoting them (eg. "time").
+func indexColumns(list string) []string {
+	columns := strings.Split(list, ",")
+	for n, column := range columns {
+		columns[n] = strings.Trim(column, `"`)
+	}
+	return columns
+}
+
+// IndexStatus is the state of an index the adapter expects.
+type IndexStatus struct {
+	Index  string `json:"index"`
+	Status string `json:"status"`
+
+	expected expectedIndex
+	// invalid is the name of an invalid index left over by an interrupted build.
+	invalid string
+}
+
+// CheckIndexes looks for the indexes the adapter relies on and logs a warning for each missing or invalid one.
+// With CreateMissingIndexes, it creates them in the background, unless that is already running.
+func (c *Client) CheckIndexes(ctx context.Context) ([]IndexStatus, error) {
+	statuses, err := c.indexStatuses(ctx, c.DB)
+	if err != nil {
+		return nil, err
+	}
+	var missing []IndexStatus
+	for n, status := range statuses {
+		switch status.Status {
+		case IndexMissing:
+			log.Warn("msg", "Missing index, queries and writes may be slow", "index", status.Index, "create", status.expected.createStatement(false))
+		case IndexInvalid:
+			log.Warn("msg", "Invalid index left over by an interrupted build, drop and create it again", "index", status.Index, "name", status.invalid)
+		default:
+			continue
+		}
+		if c.cfg.CreateMissingIndexes {
+			missing = append(missing, status)
+			statuses[n].Status = IndexCreating
+		}
+	}
+	if len(missing) > 0 {
+		if c.creatingIndexes.CompareAndSwap(false, true) {
+			go c.createIndexes(missing)
+		} else {
+			log.Info("msg", "Index creation is already running")
+		}
+	}
+	return statuses, nil
+}
+
+// indexStatuses looks up the state of the indexes the adapter relies on, without side effects.
+func (c *Client) indexStatuses(ctx context.Context, q execer) ([]IndexStatus, error) {
+	expected := c.labels.expectedIndexes()
+	tables := make([]string, 0, len(expected))
+	for _, idx := range expected {
+		tables = append(tables, idx.table)
+	}
+	rows, err := q.QueryContext(ctx, sqlListIndexes, tables)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	statuses := make([]IndexStatus, len(expected))
+	for n, idx := range expected {
+		statuses[n] = IndexStatus{Index: idx.String(), Status: IndexMissing, expected: idx}
+	}
+	for rows.Next() {
+		var table, name, method, columns string
+		var unique, valid bool
+		if err := rows.Scan(&table, &name, &method, &unique, &valid, &columns); err != nil {
+			return nil, err
+		}
+		for n, idx := range expected {
+			if idx.table != table || !idx.matches(method, unique, indexColumns(columns)) || statuses[n].Status == IndexOK {
+				continue
+			}
+			if valid {
+				statuses[n].Status = IndexOK
+			} else {
+				statuses[n].Status, statuses[n].invalid = IndexInvalid, name
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func (i expectedIndex) createStatement(hypertable bool) string {
+	unique := ""
+	if i.unique {
+		unique = "unique "
+	}
+	if hypertable {
+		// hypertables don't support concurrent builds, building per chunk doesn't block writes for long
+		return fmt.Sprintf("create %sindex if not exists %s on %s using %s (%s) with (timescaledb.transaction_per_chunk)",
+			unique, i.name(), i.table, i.method, strings.Join(i.columns, ", "))
+	}
+	return fmt.Sprintf("create %sindex concurrently if not exists %s on %s using %s (%s)",
+		unique, i.name(), i.table, i.method, strings.Join(i.columns, ", "))
+}
+
+// createIndexes builds the missing indexes one after the other, dropping invalid ones first.
+func (c *Client) createIndexes(missing []IndexStatus) {
+	defer c.creatingIndexes.Store(false)
+	ctx := context.Background()
+	for n, status := range missing {
+		log.Info("msg", "Creating index", "index", status.Index, "progress", fmt.Sprintf("%d/%d", n+1, len(missing)))
+		begin := time.Now()
+		invalid := status.invalid
+		var err error
+		for attempt := 1; attempt <= indexCreateRetries; attempt++ {
+			if err = c.createIndex(ctx, status.expected, invalid); err == nil {
+				break
+			}
+			log.Warn("msg", "Error creating index", "index", status.Index, "attempt", attempt, "err", err)
+			// a failed build leaves an invalid index behind
+			invalid = status.expected.name()
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err != nil {
+			log.Error("msg", "Giving up creating index", "index", status.Index, "err", err)
+			continue
+		}
+		log.Info("msg", "Created index", "index", status.Index, "duration", time.Since(begin))
+	}
+}
+
+func (c *Client) createIndex(ctx context.Context, idx expectedIndex, invalid string) error {
+	var timescale, hypertable bool
+	if err := c.DB.QueryRowContext(ctx, sqlStatsTimescale).Scan(&timescale); err != nil {
+		return err
+	}
+	if timescale {
+		if err := c.DB.QueryRowContext(ctx, sqlIsHypertable, idx.table).Scan(&hypertable); err != nil {
+			return err
+		}
+	}
+	conn, err := c.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if invalid != "" {
+		drop := "drop index concurrently if exists %s"
+		if hypertable {
+			drop = "drop index if exists %s"
+		}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(drop, invalid)); err != nil {
+			return err
+		}
+	}
+	var pid int
+	if err := conn.QueryRowContext(ctx, sqlBackendPid).Scan(&pid); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go c.logIndexProgress(idx, pid, done)
+	_, err = conn.ExecContext(ctx, idx.createStatement(hypertable))
+	return err
+}
+
+// logIndexProgress periodically logs the progress of an index build running on the backend pid.
+func (c *Client) logIndexProgress(idx expectedIndex, pid int, done <-chan struct{}) {
+	ticker := time.NewTicker(indexProgressEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var phase string
+		var blocksDone, blocksTotal sql.NullInt64
+		err := c.DB.QueryRow(sqlIndexProgress, pid).Scan(&phase, &blocksDone, &blocksTotal)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Debug("msg", "Error reading index build progress", "err", err)
+			}
+			continue
+		}
+		log.Info("msg", "Index build progress", "index", idx.String(), "phase", phase, "blocks_done", blocksDone.Int64, "blocks_total", blocksTotal.Int64)
+	}
+}
@@ -0,0 +1,48 @@
+package pgprometheus
+
+import (
+	"testing"
+)
+
+func TestExpectedIndexMatches(t *testing.T) {
+	labels := expectedIndex{table: "metrics_labels", method: "btree", unique: true, columns: []string{"metric_name", "labels"}}
+	gin := expectedIndex{table: "metrics_labels", method: "gin", columns: []string{"labels"}}
+	values := expectedIndex{table: "metrics_values", method: "btree", columns: []string{"time"}}
+
+	tests := []struct {
+		expected expectedIndex
+		method   string
+		unique   bool
+		columns  string
+		matches  bool
+	}{
+		{labels, "btree", true, "metric_name,labels", true},
+		{labels, "btree", false, "metric_name,labels", false},
+		{labels, "btree", true, "metric_name", false},
+		{labels, "btree", true, "metric_name,labels,id", false},
+		{labels, "hash", true, "metric_name,labels", false},
+		{gin, "gin", false, "labels", true},
+		{gin, "btree", false, "labels", false},
+		{values, "btree", false, `"time"`, true},
+		{values, "btree", true, `"time",labels_id`, true},
+		{values, "btree", false, `labels_id,"time"`, false},
+	}
+	for _, test := range tests {
+		if matches := test.expected.matches(test.method, test.unique, indexColumns(test.columns)); matches != test.matches {
+			t.Errorf("%s: expected %v for %s index (%s), got %v", test.expected, test.matches, test.method, test.columns, matches)
+		}
+	}
+}
+
+func TestExpectedIndexCreateStatement(t *testing.T) {
+	idx := expectedIndex{table: "metrics_labels", method: "btree", unique: true, columns: []string{"metric_name", "labels"}}
+	expected := "create unique index concurrently if not exists metrics_labels_metric_name_labels_btree_idx on metrics_labels using btree (metric_name, labels)"
+	if statement := idx.createStatement(false); statement != expected {
+		t.Errorf("Expected %q, got %q", expected, statement)
+	}
+	idx = expectedIndex{table: "metrics_values", method: "btree", columns: []string{"time"}}
+	expected = "create index if not exists metrics_values_time_btree_idx on metrics_values using btree (time) with (timescaledb.transaction_per_chunk)"
+	if statement := idx.createStatement(true); statement != expected {
+		t.Errorf("Expected %q, got %q", expected, statement)
+	}
+}
@@ -0,0 +1,262 @@
+package pgprometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	pgx_stdlib "github.com/jackc/pgx/v5/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// UnknownSeriesSamples counts the samples dropped with LabelsReadOnly because their label set isn't stored.
+var UnknownSeriesSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "dropped_samples_unknown_series_total",
+		Help: "Total number of samples dropped because their label set isn't in the labels table loaded with -pg-labels-readonly.",
+	},
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlKnownSeries = "select id, metric_name, labels from %s_labels limit $1"
+)
+
+// knownSeries maps the series of the labels table to their IDs, for writes with LabelsReadOnly to resolve
+// the labels_id of their samples without inserting labels. The map is loaded as a whole and swapped, so
+// lookups don't lock. Until it is loaded, no series is known.
+type knownSeries struct {
+	interval time.Duration
+	load     func(ctx context.Context) (map[model.Fingerprint]int64, error)
+	ids      atomic.Pointer[map[model.Fingerprint]int64]
+}
+
+func newKnownSeries(interval time.Duration, load func(ctx context.Context) (map[model.Fingerprint]int64, error)) *knownSeries {
+	return &knownSeries{interval: interval, load: load}
+}
+
+// reload loads the series and returns how many there are. The previous series stay known if it fails.
+func (k *knownSeries) reload(ctx context.Context) (int, error) {
+	ids, err := k.load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	k.ids.Store(&ids)
+	return len(ids), nil
+}
+
+// run reloads the series every interval until stop is closed.
+func (k *knownSeries) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), k.interval)
+		n, err := k.reload(ctx)
+		cancel()
+		if err != nil {
+			log.Warn("msg", "Error reloading the label sets, keeping the previous ones", "err", err)
+			continue
+		}
+		log.Debug("msg", "Reloaded the label sets", "series", n)
+	}
+}
+
+// id returns the ID of the label set of a metric.
+func (k *knownSeries) id(m model.Metric) (int64, bool) {
+	p := k.ids.Load()
+	if p == nil {
+		return 0, false
+	}
+	id, ok := (*p)[m.Fingerprint()]
+	return id, ok
+}
+
+// split splits off the samples of which the label set isn't known.
+func (k *knownSeries) split(samples model.Samples) (known model.Samples, unknown model.Samples) {
+	known = make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		if _, ok := k.id(s.Metric); !ok {
+			unknown = append(unknown, s)
+			continue
+		}
+		known = append(known, s)
+	}
+	return known, unknown
+}
+
+// loadKnownSeries reads the label sets of the labels table, failing if there are more than
+// LabelsReadOnlyMaxSeries. A series stored in both metric name layouts maps to the label set in the
+// configured one.
+func (c *Client) loadKnownSeries(ctx context.Context) (map[model.Fingerprint]int64, error) {
+	max := c.cfg.LabelsReadOnlyMaxSeries
+	rows, err := c.DB.QueryContext(ctx, fmt.Sprintf(sqlKnownSeries, c.cfg.Table), max+1)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the label sets: %w", err)
+	}
+	defer rows.Close()
+	ids := make(map[model.Fingerprint]int64)
+	configured := make(map[model.Fingerprint]bool)
+	for rows.Next() {
+		var (
+			id         int64
+			metricName string
+			labelsJson []byte
+		)
+		if err := rows.Scan(&id, &metricName, &labelsJson); err != nil {
+			return nil, fmt.Errorf("error loading the label sets: %w", err)
+		}
+		var labels map[string]string
+		if err := json.Unmarshal(labelsJson, &labels); err != nil {
+			return nil, fmt.Errorf("error decoding the label set %d: %w", id, err)
+		}
+		_, withName := labels[model.MetricNameLabel]
+		m := make(model.Metric, len(labels)+1)
+		for name, value := range labels {
+			m[model.LabelName(name)] = model.LabelValue(value)
+		}
+		m[model.MetricNameLabel] = model.LabelValue(metricName)
+		fp := m.Fingerprint()
+		if _, ok := ids[fp]; ok && configured[fp] {
+			continue
+		}
+		ids[fp] = id
+		configured[fp] = withName == c.cfg.MetricNameInLabels
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading the label sets: %w", err)
+	}
+	if len(ids) > max {
+		return nil, fmt.Errorf("the labels table %s_labels holds more than %d label sets, the maximum for loading them", c.cfg.Table, max)
+	}
+	return ids, nil
+}
+
+// ReloadLabels loads the label sets of the labels table again with LabelsReadOnly, for series provisioned
+// since the last load to be written. It returns the number of series, or false if LabelsReadOnly is off.
+func (c *Client) ReloadLabels(ctx context.Context) (int, bool, error) {
+	if c.knownSeries == nil {
+		return 0, false, nil
+	}
+	n, err := c.knownSeries.reload(ctx)
+	return n, true, err
+}
+
+// writeKnown writes the samples of a batch, of which the label sets are known, with LabelsReadOnly. They are
+// copied into the values table directly with the IDs of their label sets, in a transaction with the late
+// samples going to the overflow table. A COPY failing on a sample is reported as a *rowError.
+func (c *Client) writeKnown(ctx context.Context, b batch) error {
+	if b.size() == 0 {
+		return nil
+	}
+	order := c.copyOrder(b.samples)
+	rows := make([][]interface{}, 0, len(order))
+	for _, i := range order {
+		sample := b.samples[i]
+		id, ok := c.knownSeries.id(sample.Metric)
+		if !ok {
+			// the label sets were reloaded since the samples were split, without this one
+			return fmt.Errorf("the label set of %s is no longer in the labels table", sample.Metric)
+		}
+		rows = append(rows, []interface{}{sample.Timestamp.Time().UTC(), float64(sample.Value), id})
+	}
+	conn, err := c.acquireConn(ctx)
+	if err != nil {
+		log.Error("msg", "Failed to acquire database connection", "err", err)
+		return &WriteError{Phase: ErrConnAcquire, Err: err}
+	}
+	w := &writeSession{conn: conn, single: true, synchronousCommit: c.cfg.SynchronousCommit}
+	failed := func(phase error, err error) error {
+		return &WriteError{Phase: phase, Rows: w.rows, Err: err}
+	}
+	open := false
+	defer func() {
+		if open {
+			ctx, cancel := cleanupContext(ctx)
+			_, err := conn.ExecContext(ctx, "rollback")
+			cancel()
+			if err != nil {
+				log.Error("msg", "Failed to roll back, discarding connection", "err", err)
+				c.discard(conn)
+				return
+			}
+		}
+		_ = conn.Close()
+	}()
+	if _, err := conn.ExecContext(ctx, "begin"); err != nil {
+		log.Error("msg", "Error on transaction setup", "err", err)
+		return failed(ErrStaging, err)
+	}
+	open = true
+	if err := w.setSynchronousCommit(ctx, conn); err != nil {
+		log.Error("msg", "Error on transaction setup", "err", err)
+		return failed(ErrStaging, err)
+	}
+	err = traced(ctx, "copy", func(ctx context.Context) error {
+		return conn.Raw(func(driverConn any) error {
+			conn := driverConn.(*pgx_stdlib.Conn).Conn()
+			_, err := conn.CopyFrom(ctx, []string{c.cfg.Table + "_values"}, []string{"time", "value", "labels_id"}, pgx.CopyFromRows(rows))
+			return err
+		})
+	}, attribute.Int("db.rows", len(rows)))
+	if err != nil {
+		log.Error("msg", "Error on copy", "err", err)
+		if c.horizon != nil && isCompressedChunkConflict(err) {
+			c.horizon.requestRefresh()
+		}
+		if line := copyErrorLine(err); line > 0 && line <= len(order) {
+			return failed(ErrValueInsert, &rowError{index: order[line-1], err: err})
+		}
+		return failed(ErrValueInsert, err)
+	}
+	w.rows += int64(len(rows))
+	if len(b.late) > 0 {
+		err := traced(ctx, "write_overflow", func(ctx context.Context) error {
+			return c.writeOverflow(ctx, conn, b.late)
+		}, attribute.Int("db.rows", len(b.late)))
+		if err != nil {
+			log.Error("msg", "Error writing samples to the overflow table", "err", err)
+			return failed(ErrValueInsert, err)
+		}
+		w.rows += int64(len(b.late))
+	}
+	err = traced(ctx, "commit", func(ctx context.Context) error {
+		return w.commit(func() error {
+			_, err := conn.ExecContext(ctx, "commit")
+			return err
+		})
+	})
+	if err != nil {
+		log.Error("msg", "Error on Commit", "err", err)
+		return failed(ErrCommit, err)
+	}
+	open = false
+	if c.watermarks != nil {
+		c.watermarks.advance(b.samples)
+	}
+	return nil
+}
+
+// ensureKnownSeries loads the label sets on startup with LabelsReadOnly.
+func (c *Client) ensureKnownSeries(ctx context.Context) error {
+	if c.knownSeries == nil {
+		return nil
+	}
+	n, err := c.knownSeries.reload(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info("msg", "Loaded the label sets, samples of other series are dropped", "series", n)
+	return nil
+}
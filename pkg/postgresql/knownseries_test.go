@@ -0,0 +1,131 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestKnownSeriesSplit(t *testing.T) {
+	up := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	ids := map[model.Fingerprint]int64{up.Fingerprint(): 7}
+	k := newKnownSeries(time.Minute, func(ctx context.Context) (map[model.Fingerprint]int64, error) {
+		return ids, nil
+	})
+	samples := model.Samples{
+		{Metric: up, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "other"}, Timestamp: 1000},
+	}
+	known, unknown := k.split(samples)
+	if len(known) != 0 || !unknown.Equal(samples) {
+		t.Errorf("Expected no series to be known before loading, got %v and %v", known, unknown)
+	}
+
+	if n, err := k.reload(context.Background()); n != 1 || err != nil {
+		t.Fatalf("Expected 1 series to be loaded, got %d and %v", n, err)
+	}
+	known, unknown = k.split(samples)
+	if !known.Equal(samples[:1]) || !unknown.Equal(samples[1:]) {
+		t.Errorf("Expected %v to be known and %v unknown, got %v and %v", samples[:1], samples[1:], known, unknown)
+	}
+	if id, ok := k.id(up); id != 7 || !ok {
+		t.Errorf("Expected ID 7, got %d", id)
+	}
+
+	// a failed reload keeps the series
+	k.load = func(ctx context.Context) (map[model.Fingerprint]int64, error) {
+		return nil, errors.New("connection refused")
+	}
+	if _, err := k.reload(context.Background()); err == nil {
+		t.Error("Expected the reload to fail")
+	}
+	if _, ok := k.id(up); !ok {
+		t.Error("Expected the series to stay known after a failed reload")
+	}
+}
+
+func TestNewClientLabelsReadOnlyErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		cfg  func(cfg *Config)
+	}{
+		{"normalized", func(cfg *Config) { cfg.LabelStorage = labelStorageNormalized }},
+		{"max series", func(cfg *Config) { cfg.LabelsReadOnlyMaxSeries = 0 }},
+		{"refresh interval", func(cfg *Config) { cfg.LabelsReadOnlyRefreshInterval = -time.Second }},
+	} {
+		cfg := DefaultConfig()
+		cfg.LabelsReadOnly = true
+		c.cfg(cfg)
+		if _, err := NewClient(cfg); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+// TestWriteLabelsReadOnly writes samples of a provisioned series and of an unknown one with read-only
+// labels, and checks that only the samples of the provisioned series are written, without adding label sets.
+// It needs a database, given as connection string in TS_PROM_TEST_PG_DSN.
+func TestWriteLabelsReadOnly(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "readonly_test_metrics"
+	cfg.CheckIndexes = false
+	cfg.LabelsReadOnly = true
+	cfg.LabelsReadOnlyMaxSeries = 2
+	for _, statement := range []string{
+		"create table readonly_test_metrics_labels (id serial primary key, metric_name text not null, labels jsonb not null, unique (metric_name, labels))",
+		"create table readonly_test_metrics_values (time timestamp with time zone not null, value double precision, labels_id integer references readonly_test_metrics_labels (id))",
+		`insert into readonly_test_metrics_labels (metric_name, labels) values ('up', '{"job": "node"}')`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		_, _ = db.Exec("drop table readonly_test_metrics_values, readonly_test_metrics_labels")
+	}()
+	client := &Client{DB: db, cfg: cfg, labels: &jsonbLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	client.knownSeries = newKnownSeries(0, client.loadKnownSeries)
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := client.WriteContext(context.Background(), model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node"}, Value: 1, Timestamp: 1000},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "other"}, Value: 1, Timestamp: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 1 || stats.Dropped["unknown_series"] != 1 {
+		t.Errorf("Expected 1 sample written and 1 dropped, got %+v", stats)
+	}
+	var labelSets, values int
+	if err := db.QueryRow("select (select count(*) from readonly_test_metrics_labels), (select count(*) from readonly_test_metrics_values)").Scan(&labelSets, &values); err != nil {
+		t.Fatal(err)
+	}
+	if labelSets != 1 || values != 1 {
+		t.Errorf("Expected 1 label set and 1 sample, got %d and %d", labelSets, values)
+	}
+
+	// the maximum is enforced when loading
+	if _, err := db.Exec(`insert into readonly_test_metrics_labels (metric_name, labels) values ('up', '{"job": "a"}'), ('up', '{"job": "b"}')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.ReloadLabels(context.Background()); err == nil {
+		t.Error("Expected loading more label sets than the maximum to fail")
+	}
+}
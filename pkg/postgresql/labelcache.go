@@ -0,0 +1,132 @@
+package pgprometheus
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+// LabelCacheStats is the state of the label cache reported by the admin API.
+type LabelCacheStats struct {
+	Size     int    `json:"size"`
+	Capacity int    `json:"capacity"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	// Hottest are the cached series with the most hits.
+	Hottest []LabelCacheEntry `json:"hottest"`
+}
+
+// LabelCacheEntry is a cached series with its number of hits.
+type LabelCacheEntry struct {
+	Series string `json:"series"`
+	Hits   uint64 `json:"hits"`
+}
+
+type labelCacheEntry struct {
+	fingerprint model.Fingerprint
+	series      string
+	hits        uint64
+}
+
+// labelCache is a bounded LRU of the series whose label sets are known to be stored. Writes of batches with
+// only known series skip inserting labels. It goes stale when label sets are removed by hand, eg. by
+// truncating the labels table, and has to be flushed then.
+type labelCache struct {
+	size int
+
+	mutex   sync.Mutex
+	hits    uint64
+	misses  uint64
+	entries *list.List
+	index   map[model.Fingerprint]*list.Element
+}
+
+func newLabelCache(size int) *labelCache {
+	return &labelCache{size: size, entries: list.New(), index: map[model.Fingerprint]*list.Element{}}
+}
+
+// known tells whether the label sets of all samples are stored, counting a hit or a miss per sample.
+func (l *labelCache) known(samples model.Samples) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	all := true
+	for _, s := range samples {
+		element, ok := l.index[s.Metric.Fingerprint()]
+		if !ok {
+			l.misses++
+			all = false
+			continue
+		}
+		l.hits++
+		element.Value.(*labelCacheEntry).hits++
+		l.entries.MoveToFront(element)
+	}
+	return all
+}
+
+// add records the label sets of the samples as stored.
+func (l *labelCache) add(samples model.Samples) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		if element, ok := l.index[fp]; ok {
+			l.entries.MoveToFront(element)
+			continue
+		}
+		l.index[fp] = l.entries.PushFront(&labelCacheEntry{fingerprint: fp, series: s.Metric.String()})
+		if l.entries.Len() > l.size {
+			oldest := l.entries.Back()
+			l.entries.Remove(oldest)
+			delete(l.index, oldest.Value.(*labelCacheEntry).fingerprint)
+		}
+	}
+}
+
+// flush forgets all series and returns how many there were.
+func (l *labelCache) flush() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	n := l.entries.Len()
+	l.entries.Init()
+	l.index = map[model.Fingerprint]*list.Element{}
+	return n
+}
+
+// stats returns the state of the cache with the top series with the most hits.
+func (l *labelCache) stats(top int) LabelCacheStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	hottest := make([]LabelCacheEntry, 0, l.entries.Len())
+	for element := l.entries.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*labelCacheEntry)
+		hottest = append(hottest, LabelCacheEntry{Series: entry.series, Hits: entry.hits})
+	}
+	sort.SliceStable(hottest, func(i, j int) bool {
+		return hottest[i].Hits > hottest[j].Hits
+	})
+	if len(hottest) > top {
+		hottest = hottest[:top]
+	}
+	return LabelCacheStats{Size: l.entries.Len(), Capacity: l.size, Hits: l.hits, Misses: l.misses, Hottest: hottest}
+}
+
+// LabelCacheStats returns the state of the label cache with its top series with the most hits, or false if
+// the cache is disabled.
+func (c *Client) LabelCacheStats(top int) (LabelCacheStats, bool) {
+	if c.labelCache == nil {
+		return LabelCacheStats{}, false
+	}
+	return c.labelCache.stats(top), true
+}
+
+// FlushLabelCache empties the label cache, so that the next writes insert the label sets of their series
+// again. It returns the number of series flushed, or false if the cache is disabled.
+func (c *Client) FlushLabelCache() (int, bool) {
+	if c.labelCache == nil {
+		return 0, false
+	}
+	return c.labelCache.flush(), true
+}
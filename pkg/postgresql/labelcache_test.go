@@ -0,0 +1,100 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestLabelCache(t *testing.T) {
+	cache := newLabelCache(2)
+	a := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "job": "a"}}
+	b := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "job": "b"}}
+	c := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "job": "c"}}
+
+	if cache.known(model.Samples{a, b}) {
+		t.Error("Expected an empty cache to know no series")
+	}
+	cache.add(model.Samples{a, b})
+	if !cache.known(model.Samples{a, b, a}) {
+		t.Error("Expected the added series to be known")
+	}
+	if cache.known(model.Samples{a, c}) {
+		t.Error("Expected a batch with an unknown series not to be known")
+	}
+
+	stats := cache.stats(1)
+	if stats.Size != 2 || stats.Capacity != 2 || stats.Hits != 4 || stats.Misses != 3 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if len(stats.Hottest) != 1 || stats.Hottest[0] != (LabelCacheEntry{Series: `up{job="a"}`, Hits: 3}) {
+		t.Errorf("Expected the most hit series first, got %+v", stats.Hottest)
+	}
+
+	// b is the least recently used series
+	cache.add(model.Samples{c})
+	if cache.known(model.Samples{b}) || !cache.known(model.Samples{a, c}) {
+		t.Error("Expected the least recently used series to be evicted")
+	}
+
+	if n := cache.flush(); n != 2 {
+		t.Errorf("Expected 2 series to be flushed, got %d", n)
+	}
+	if cache.known(model.Samples{a}) || cache.stats(10).Size != 0 {
+		t.Error("Expected the flushed cache to be empty")
+	}
+}
+
+// TestLabelCacheTruncate writes a series, truncates the labels table and checks that the next write of the
+// series fails while it is cached, and succeeds once the cache is flushed. It needs a database, given as
+// connection string in TS_PROM_TEST_PG_DSN.
+func TestLabelCacheTruncate(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "label_cache_test_metrics"
+	cfg.LabelStorage = labelStorageNormalized
+	cfg.CheckIndexes = false
+	client := &Client{DB: db, cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg), labelCache: newLabelCache(10)}
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = db.Exec("drop view label_cache_test_metrics; drop table label_cache_test_metrics_values, label_cache_test_metrics_label_kv, label_cache_test_metrics_label_keys, label_cache_test_metrics_labels cascade")
+	}()
+
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	if err := client.Write(model.Samples{{Metric: metric, Value: 1, Timestamp: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("truncate label_cache_test_metrics_labels cascade"); err != nil {
+		t.Fatal(err)
+	}
+	// the cached series skips the labels insert, its values find no label set
+	if err := client.Write(model.Samples{{Metric: metric, Value: 2, Timestamp: 2}}); err == nil {
+		t.Fatal("Expected the write of a cached series without label set to fail")
+	}
+	if n, _ := client.FlushLabelCache(); n != 1 {
+		t.Errorf("Expected 1 series to be flushed, got %d", n)
+	}
+	if err := client.Write(model.Samples{{Metric: metric, Value: 3, Timestamp: 3}}); err != nil {
+		t.Fatalf("Expected the write to succeed after the flush, got %v", err)
+	}
+	var samples int
+	err = db.QueryRow("select count(*) from label_cache_test_metrics where labels->>'job' = 'node'").Scan(&samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples != 1 {
+		t.Errorf("Expected the sample written after the flush, got %d samples", samples)
+	}
+}
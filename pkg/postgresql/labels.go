@@ -0,0 +1,395 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const (
+	labelStorageJsonb      = "jsonb"
+	labelStorageNormalized = "normalized"
+
+	sqlUndefinedTableSQLState = "42P01"
+)
+
+// isUndefinedTable tells whether a statement failed because a table doesn't exist.
+func isUndefinedTable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == sqlUndefinedTableSQLState
+}
+
+// labelStore abstracts the table layout used to persist label sets. Samples are always copied into
+// a staging table first; the store decides what that table looks like and how its contents end up in
+// the labels and values tables.
+type labelStore interface {
+	// ensureSchema creates the tables and the query view required by the layout, and the columns of the
+	// promoted labels. It returns the promoted labels of which the columns still need to be backfilled.
+	ensureSchema(ctx context.Context, db *sql.DB) ([]string, error)
+	// stagingColumns returns the column definitions of the staging table.
+	stagingColumns() string
+	copyColumns() []string
+	// copyRow returns the values copied into the temp table for a sample.
+	copyRow(timestamp time.Time, value float64, metricName string, labelsJson string, metric model.Metric) []interface{}
+	insertLabels(ctx context.Context, w *writeSession) error
+	insertValues(ctx context.Context, w *writeSession) error
+	// labelsRelation returns a relation with the columns id, metric_name and labels (jsonb) for queries.
+	labelsRelation() string
+	// deleteOrphans removes the label sets among ids that have no samples left.
+	deleteOrphans(ctx context.Context, db *sql.DB, ids []int64) error
+	// expectedIndexes returns the indexes queries and writes rely on.
+	expectedIndexes() []expectedIndex
+	// seriesJson returns the metric name and the labels jsonb text copied into the staging table for a metric.
+	seriesJson(m model.Metric) (string, string)
+	// renderSeries is seriesJson for a series.
+	renderSeries(s *Series) (string, string)
+	// checkLayout warns about label sets stored in another layout than the configured one.
+	checkLayout(ctx context.Context, db *sql.DB) error
+	// provenanceMatch returns the condition matching a staged sample to its label set lbl.
+	provenanceMatch() string
+	// promotedBackfill returns the statement populating the column of a promoted label for the label sets
+	// with IDs in ($1, $2], given the label as $3.
+	promotedBackfill(label string) string
+}
+
+func newLabelStore(storage string, table string, partitionByMetric bool, metricNameInLabels bool, promoted []string) (labelStore, error) {
+	switch storage {
+	case labelStorageJsonb:
+		if partitionByMetric {
+			return nil, fmt.Errorf("partitioning by metric requires the %q label storage", labelStorageNormalized)
+		}
+		return &jsonbLabelStore{table: table, metricNameInLabels: metricNameInLabels, promoted: promoted}, nil
+	case labelStorageNormalized:
+		return &normalizedLabelStore{table: table, partitionByMetric: partitionByMetric, metricNameInLabels: metricNameInLabels, promoted: promoted}, nil
+	default:
+		return nil, fmt.Errorf("unknown label storage %q, expected %q or %q", storage, labelStorageJsonb, labelStorageNormalized)
+	}
+}
+
+// jsonbLabelStore keeps every label set as a single jsonb document in the labels table.
+// The tables are expected to exist already, only the columns of promoted labels are added.
+// With metricNameInLabels, the document includes __name__, which the metric_name column still holds too.
+// Label sets stored in the other layout are only matched once checkLayout found some, so that switching
+// layouts doesn't create a second label set for a series.
+type jsonbLabelStore struct {
+	table              string
+	metricNameInLabels bool
+	promoted           []string
+	otherLayout        atomic.Bool
+}
+
+func (s *jsonbLabelStore) ensureSchema(ctx context.Context, db *sql.DB) ([]string, error) {
+	_, backfill, err := ensurePromotedColumns(ctx, db, s.table, s.promoted)
+	return backfill, err
+}
+
+func (s *jsonbLabelStore) stagingColumns() string {
+	return sqlStagingColumns
+}
+
+func (s *jsonbLabelStore) copyColumns() []string {
+	return []string{"time", "value", "metric_name", "labels"}
+}
+
+func (s *jsonbLabelStore) copyRow(timestamp time.Time, value float64, metricName string, labelsJson string, metric model.Metric) []interface{} {
+	return []interface{}{timestamp, value, metricName, labelsJson}
+}
+
+func (s *jsonbLabelStore) labelsRelation() string {
+	return fmt.Sprintf("%s_labels", s.table)
+}
+
+func (s *jsonbLabelStore) insertLabels(ctx context.Context, w *writeSession) error {
+	columns, values := promotedInsert(s.promoted)
+	query := fmt.Sprintf(sqlInsertLabels, s.table, columns, values, w.staging)
+	if s.otherLayout.Load() {
+		query = fmt.Sprintf(sqlInsertLabelsAnyLayout, s.table, columns, values, w.staging, s.table, s.otherLayoutLabels())
+	}
+	return w.exec(ctx, query, "labels")
+}
+
+func (s *jsonbLabelStore) insertValues(ctx context.Context, w *writeSession) error {
+	query := fmt.Sprintf(sqlInsertValues, s.table, w.staging, s.table)
+	if s.otherLayout.Load() {
+		query = fmt.Sprintf(sqlInsertValuesAnyLayout, s.table, w.staging, s.table, s.otherLayoutLabels())
+	}
+	return w.exec(ctx, query, "values")
+}
+
+// otherLayoutLabels returns the expression of the labels of a staged sample in the layout not configured.
+func (s *jsonbLabelStore) otherLayoutLabels() string {
+	if s.metricNameInLabels {
+		return sqlLabelsWithoutName
+	}
+	return sqlLabelsWithName
+}
+
+func (s *jsonbLabelStore) expectedIndexes() []expectedIndex {
+	return append([]expectedIndex{
+		{table: s.table + "_labels", method: "btree", unique: true, columns: []string{"metric_name", "labels"}},
+		{table: s.table + "_labels", method: "gin", columns: []string{"labels"}},
+		{table: s.table + "_values", method: "btree", columns: []string{"time"}},
+	}, promotedIndexes(s.table, s.promoted)...)
+}
+
+func (s *jsonbLabelStore) deleteOrphans(ctx context.Context, db *sql.DB, ids []int64) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sqlDeleteOrphans, s.table, s.table), ids)
+	return err
+}
+
+func (s *jsonbLabelStore) seriesJson(m model.Metric) (string, string) {
+	return metricMetaJson(m, s.metricNameInLabels)
+}
+
+func (s *jsonbLabelStore) renderSeries(series *Series) (string, string) {
+	if s.metricNameInLabels {
+		return labelsMetaJson(series.Labels, true)
+	}
+	return series.MetricName, series.LabelsJson
+}
+
+// checkLayout looks for label sets with and without __name__. Label sets in the layout not configured are
+// matched by writes from then on, and logged with the statement migrating them.
+func (s *jsonbLabelStore) checkLayout(ctx context.Context, db *sql.DB) error {
+	var withName, withoutName bool
+	err := db.QueryRowContext(ctx, fmt.Sprintf(sqlLabelLayouts, s.table, s.table)).Scan(&withName, &withoutName)
+	if isUndefinedTable(err) {
+		// the jsonb layout doesn't create the tables, writes will tell
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking the label layout: %w", err)
+	}
+	other, migration := withName, fmt.Sprintf(sqlMigrateLabelsWithoutName, s.table, s.table)
+	if s.metricNameInLabels {
+		other, migration = withoutName, fmt.Sprintf(sqlMigrateLabelsWithName, s.table, s.table)
+	}
+	s.otherLayout.Store(other)
+	if other {
+		log.Warn("msg", "The labels table has label sets in the other metric name layout, matching both layouts on writes. Migrate them while no adapter writes with the other layout",
+			"table", s.table+"_labels", "metric_name_in_labels", s.metricNameInLabels, "mixed", withName && withoutName, "migration", migration)
+	}
+	return nil
+}
+
+// provenanceMatch matches the configured metric name layout only, label sets in the other layout aren't
+// updated until they are migrated.
+func (s *jsonbLabelStore) provenanceMatch() string {
+	return sqlJsonbProvenanceMatch
+}
+
+func (s *jsonbLabelStore) promotedBackfill(label string) string {
+	return fmt.Sprintf(sqlJsonbBackfill, s.table, label, label)
+}
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlNormalizedCreateLabels       = "create table if not exists %s_labels (id serial primary key, metric_name text not null, fingerprint bigint not null, unique (metric_name, fingerprint));"
+	sqlNormalizedCreateLabelKeys    = "create table if not exists %s_label_keys (id serial primary key, key text not null unique);"
+	sqlNormalizedCreateLabelKv      = "create table if not exists %s_label_kv (labels_id integer not null references %s_labels (id), key_id integer not null references %s_label_keys (id), value text not null, primary key (labels_id, key_id));"
+	sqlNormalizedCreateLabelKvIx    = "create index if not exists %s_label_kv_key_value_idx on %s_label_kv (key_id, value);"
+	sqlNormalizedCreateValues       = "create table if not exists %s_values (time timestamp with time zone not null, value double precision, labels_id integer not null references %s_labels (id));"
+	sqlNormalizedCreateHyper        = "do $$ begin if exists (select 1 from pg_extension where extname = 'timescaledb') then perform create_hypertable('%s_values', 'time'%s, if_not_exists => true); end if; end $$;"
+	sqlNormalizedCreateView         = "create or replace view %s as select v.time, v.value, l.metric_name as name, coalesce(kv.labels, '{}'::jsonb) as labels%s from %s_values v join %s_labels l on l.id = v.labels_id left join lateral (select jsonb_object_agg(k.key, lkv.value) as labels from %s_label_kv lkv join %s_label_keys k on k.id = lkv.key_id where lkv.labels_id = l.id) kv on true;"
+	sqlNormalizedCreateViewWithName = "create or replace view %s as select v.time, v.value, l.metric_name as name, jsonb_build_object('__name__', l.metric_name) || coalesce(kv.labels, '{}'::jsonb) as labels%s from %s_values v join %s_labels l on l.id = v.labels_id left join lateral (select jsonb_object_agg(k.key, lkv.value) as labels from %s_label_kv lkv join %s_label_keys k on k.id = lkv.key_id where lkv.labels_id = l.id) kv on true;"
+	sqlNormalizedStagingColumns     = "time timestamp with time zone, value double precision, metric_name text, fingerprint bigint, labels jsonb"
+	sqlNormalizedInsertLabelKeys    = "insert into %s_label_keys (key) select distinct jsonb_object_keys(sample.labels) from %s sample on conflict do nothing;"
+	// the key/value pairs of a label set are inserted along with it, and only then, so that a label set
+	// colliding on the fingerprint of a stored one never adds its pairs to it
+	sqlNormalizedInsertLabels = "with sample as (select distinct on (metric_name, fingerprint) metric_name, fingerprint, labels from %s), lbl as (insert into %s_labels (metric_name, fingerprint%s) select sample.metric_name, sample.fingerprint%s from sample on conflict do nothing returning id, metric_name, fingerprint) insert into %s_label_kv (labels_id, key_id, value) select lbl.id, k.id, kv.value from lbl join sample on sample.metric_name = lbl.metric_name and sample.fingerprint = lbl.fingerprint cross join lateral jsonb_each_text(sample.labels) kv join %s_label_keys k on k.key = kv.key;"
+	// fingerprints are 64 bit hashes, the label sets they stand for are compared to tell collisions
+	sqlNormalizedCollision      = "select sample.metric_name, sample.fingerprint from (select distinct metric_name, fingerprint, labels from %s) sample join %s_labels lbl on lbl.metric_name = sample.metric_name and lbl.fingerprint = sample.fingerprint where sample.labels <> coalesce((select jsonb_object_agg(k.key, kv.value) from %s_label_kv kv join %s_label_keys k on k.id = kv.key_id where kv.labels_id = lbl.id), '{}'::jsonb) limit 1;"
+	sqlNormalizedLabelsRelation = "(select l.id, l.metric_name, coalesce((select jsonb_object_agg(k.key, kv.value) from %s_label_kv kv join %s_label_keys k on k.id = kv.key_id where kv.labels_id = l.id), '{}'::jsonb) as labels from %s_labels l)"
+	sqlNormalizedDeleteOrphanKv = "delete from %s_label_kv kv where kv.labels_id = any($1) and not exists (select 1 from %s_values v where v.labels_id = kv.labels_id)"
+	sqlNormalizedInsertValues   = "insert into %s_values (time, value, labels_id) select sample.time, sample.value, lbl.id from %s sample left join %s_labels lbl on lbl.metric_name = sample.metric_name and lbl.fingerprint = sample.fingerprint;"
+)
+
+// FingerprintCollisionError is returned by writes with the normalized label storage when a label set has
+// the same fingerprint as another label set of the same metric. Its samples would be written to the other
+// series, so the write fails instead.
+type FingerprintCollisionError struct {
+	MetricName  string
+	Fingerprint int64
+}
+
+func (e *FingerprintCollisionError) Error() string {
+	return fmt.Sprintf("a label set of metric %s collides with a stored one on fingerprint %d", e.MetricName, e.Fingerprint)
+}
+
+// normalizedLabelStore splits label sets into a key dictionary and a key/value table, with the labels
+// table only holding the metric name and the fingerprint of the label set, which writes compare to the
+// stored label set to detect fingerprint collisions. The view named after the
+// table reassembles the labels into the same shape as the jsonb layout, including __name__ with
+// metricNameInLabels, and exposes the columns of promoted labels.
+// With partitionByMetric, the values table is list partitioned by metric name instead of being a hypertable,
+// and partitions are created as new metrics show up. Otherwise, the values hypertable is created with chunks
+// of chunkInterval, the TimescaleDB default if 0.
+type normalizedLabelStore struct {
+	table              string
+	partitionByMetric  bool
+	metricNameInLabels bool
+	promoted           []string
+	chunkInterval      time.Duration
+}
+
+func (s *normalizedLabelStore) ensureSchema(ctx context.Context, db *sql.DB) ([]string, error) {
+	t := s.table
+	statements := []string{
+		fmt.Sprintf(sqlNormalizedCreateLabels, t),
+		fmt.Sprintf(sqlNormalizedCreateLabelKeys, t),
+		fmt.Sprintf(sqlNormalizedCreateLabelKv, t, t, t),
+		fmt.Sprintf(sqlNormalizedCreateLabelKvIx, t, t),
+	}
+	if s.partitionByMetric {
+		statements = append(statements, fmt.Sprintf(sqlPartitionedCreateValues, t, t))
+	} else {
+		statements = append(statements, fmt.Sprintf(sqlNormalizedCreateValues, t, t), fmt.Sprintf(sqlNormalizedCreateHyper, t, chunkIntervalArg(s.chunkInterval)))
+	}
+	for _, statement := range statements {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, fmt.Errorf("error setting up normalized label schema: %w", err)
+		}
+	}
+	columns, backfill, err := ensurePromotedColumns(ctx, db, t, s.promoted)
+	if err != nil {
+		return nil, err
+	}
+	var viewColumns strings.Builder
+	for _, column := range columns {
+		fmt.Fprintf(&viewColumns, ", l.%s", column)
+	}
+	view := sqlNormalizedCreateView
+	if s.metricNameInLabels {
+		view = sqlNormalizedCreateViewWithName
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(view, t, viewColumns.String(), t, t, t, t)); err != nil {
+		return nil, fmt.Errorf("error setting up normalized label schema: %w", err)
+	}
+	return backfill, nil
+}
+
+func (s *normalizedLabelStore) stagingColumns() string {
+	return sqlNormalizedStagingColumns
+}
+
+func (s *normalizedLabelStore) copyColumns() []string {
+	return []string{"time", "value", "metric_name", "fingerprint", "labels"}
+}
+
+func (s *normalizedLabelStore) copyRow(timestamp time.Time, value float64, metricName string, labelsJson string, metric model.Metric) []interface{} {
+	return []interface{}{timestamp, value, metricName, int64(metric.Fingerprint()), labelsJson}
+}
+
+func (s *normalizedLabelStore) labelsRelation() string {
+	return fmt.Sprintf(sqlNormalizedLabelsRelation, s.table, s.table, s.table)
+}
+
+func (s *normalizedLabelStore) insertLabels(ctx context.Context, w *writeSession) error {
+	t := s.table
+	columns, values := promotedInsert(s.promoted)
+	if err := w.exec(ctx, fmt.Sprintf(sqlNormalizedInsertLabelKeys, t, w.staging), "label keys"); err != nil {
+		return err
+	}
+	if err := w.exec(ctx, fmt.Sprintf(sqlNormalizedInsertLabels, w.staging, t, columns, values, t, t), "labels"); err != nil {
+		return err
+	}
+	return w.inTx(ctx, "fingerprint collisions", func(ex execer) error {
+		rows, err := ex.QueryContext(ctx, fmt.Sprintf(sqlNormalizedCollision, w.staging, t, t, t))
+		if err != nil {
+			log.Error("msg", "Error checking fingerprint collisions", "err", err)
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return rows.Err()
+		}
+		collision := &FingerprintCollisionError{}
+		if err := rows.Scan(&collision.MetricName, &collision.Fingerprint); err != nil {
+			return err
+		}
+		log.Error("msg", "Label sets collide on their fingerprint", "metric_name", collision.MetricName, "fingerprint", collision.Fingerprint)
+		return collision
+	})
+}
+
+func (s *normalizedLabelStore) insertValues(ctx context.Context, w *writeSession) error {
+	if !s.partitionByMetric {
+		query := fmt.Sprintf(sqlNormalizedInsertValues, s.table, w.staging, s.table)
+		return w.exec(ctx, query, "values")
+	}
+	query := fmt.Sprintf(sqlPartitionedInsertValues, s.table, w.staging, s.table)
+	if err := w.savepoint(ctx, "insert_values"); err != nil {
+		return err
+	}
+	err := w.exec(ctx, query, "values")
+	if !isMissingPartition(err) {
+		return err
+	}
+	if err := w.rollbackToSavepoint(ctx, "insert_values"); err != nil {
+		return err
+	}
+	log.Info("msg", "Creating partitions for new metrics")
+	if err := createMetricPartitions(ctx, w, s.table); err != nil {
+		return err
+	}
+	return w.exec(ctx, query, "values")
+}
+
+func (s *normalizedLabelStore) expectedIndexes() []expectedIndex {
+	indexes := []expectedIndex{
+		{table: s.table + "_labels", method: "btree", unique: true, columns: []string{"metric_name", "fingerprint"}},
+		{table: s.table + "_label_kv", method: "btree", columns: []string{"key_id", "value"}},
+	}
+	if !s.partitionByMetric {
+		// partitioned tables can't be indexed concurrently, their partitions are created with their indexes
+		indexes = append(indexes, expectedIndex{table: s.table + "_values", method: "btree", columns: []string{"time"}})
+	}
+	return append(indexes, promotedIndexes(s.table, s.promoted)...)
+}
+
+func (s *normalizedLabelStore) seriesJson(m model.Metric) (string, string) {
+	return MetricMetaJson(m)
+}
+
+func (s *normalizedLabelStore) renderSeries(series *Series) (string, string) {
+	return series.MetricName, series.LabelsJson
+}
+
+// checkLayout has nothing to check: the metric name is never stored among the labels, the view adds it.
+func (s *normalizedLabelStore) checkLayout(ctx context.Context, db *sql.DB) error {
+	return nil
+}
+
+func (s *normalizedLabelStore) provenanceMatch() string {
+	return sqlNormalizedProvenanceMatch
+}
+
+func (s *normalizedLabelStore) promotedBackfill(label string) string {
+	return fmt.Sprintf(sqlNormalizedBackfill, s.table, label, s.table, s.table, label)
+}
+
+func (s *normalizedLabelStore) deleteOrphans(ctx context.Context, db *sql.DB, ids []int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlNormalizedDeleteOrphanKv, s.table, s.table), ids); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlDeleteOrphans, s.table, s.table), ids); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
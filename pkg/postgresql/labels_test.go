@@ -0,0 +1,365 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// recordingDB is a database recording the statements it runs. Queries containing a key of rows return
+// its rows, statements containing a key of errs fail with its error.
+type recordingDB struct {
+	mutex      sync.Mutex
+	statements []string
+	rows       map[string][][]driver.Value
+	errs       map[string]error
+}
+
+func (d *recordingDB) Connect(context.Context) (driver.Conn, error) {
+	return &recordingConn{db: d}, nil
+}
+
+func (d *recordingDB) Driver() driver.Driver {
+	return nil
+}
+
+func (d *recordingDB) run(query string) ([][]driver.Value, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statements = append(d.statements, query)
+	for key, err := range d.errs {
+		if strings.Contains(query, key) {
+			return nil, err
+		}
+	}
+	for key, rows := range d.rows {
+		if strings.Contains(query, key) {
+			return rows, nil
+		}
+	}
+	return nil, nil
+}
+
+// recorded returns the statements run so far.
+func (d *recordingDB) recorded() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.statements...)
+}
+
+type recordingConn struct {
+	db *recordingDB
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{db: c.db, query: query}, nil
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	_, err := c.db.run("begin")
+	return recordingTx{db: c.db}, err
+}
+
+type recordingTx struct {
+	db *recordingDB
+}
+
+func (tx recordingTx) Commit() error {
+	_, err := tx.db.run("commit")
+	return err
+}
+
+func (tx recordingTx) Rollback() error {
+	_, err := tx.db.run("rollback")
+	return err
+}
+
+type recordingStmt struct {
+	db    *recordingDB
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec([]driver.Value) (driver.Result, error) {
+	_, err := s.db.run(s.query)
+	return driver.RowsAffected(0), err
+}
+
+func (s *recordingStmt) Query([]driver.Value) (driver.Rows, error) {
+	rows, err := s.db.run(s.query)
+	return &recordingRows{rows: rows}, err
+}
+
+type recordingRows struct {
+	rows [][]driver.Value
+}
+
+func (r *recordingRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"result"}
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *recordingRows) Close() error { return nil }
+
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// recordingSession returns a write session on a recordingDB, of which statements commit on their own.
+func recordingSession(t *testing.T, db *recordingDB) *writeSession {
+	t.Helper()
+	conn, err := sql.OpenDB(db).Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return &writeSession{conn: conn, staging: "metrics_tmp"}
+}
+
+func TestNewLabelStore(t *testing.T) {
+	if _, err := newLabelStore("columnar", "metrics", false, false, nil); err == nil {
+		t.Error("Expected error for unknown label storage")
+	}
+	if _, err := newLabelStore(labelStorageJsonb, "metrics", true, false, nil); err == nil {
+		t.Error("Expected error for partitioning the jsonb layout")
+	}
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	for _, storage := range []string{labelStorageJsonb, labelStorageNormalized} {
+		store, err := newLabelStore(storage, "metrics", false, false, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", storage, err)
+		}
+		row := store.copyRow(time.Unix(0, 0), 1, "up", `{"job": "node"}`, metric)
+		if len(row) != len(store.copyColumns()) {
+			t.Errorf("%s: row has %d values for %d columns", storage, len(row), len(store.copyColumns()))
+		}
+	}
+}
+
+func TestNormalizedLabelStoreStatements(t *testing.T) {
+	store := &normalizedLabelStore{table: "metrics", promoted: []string{"job"}}
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	row := store.copyRow(time.Unix(0, 0), 1, "up", `{"job": "node"}`, metric)
+	expected := []interface{}{time.Unix(0, 0), 1.0, "up", int64(metric.Fingerprint()), `{"job": "node"}`}
+	for i, column := range store.copyColumns() {
+		if row[i] != expected[i] {
+			t.Errorf("Expected %s to be copied as %v, got %v", column, expected[i], row[i])
+		}
+	}
+
+	db := &recordingDB{}
+	w := recordingSession(t, db)
+	if err := store.insertLabels(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.insertValues(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+	var statements []string
+	for _, statement := range db.recorded() {
+		if statement != "begin" && statement != "commit" && statement != "rollback" {
+			statements = append(statements, statement)
+		}
+	}
+	for i, fragments := range [][]string{
+		{"insert into metrics_label_keys (key)", "from metrics_tmp"},
+		// the key/value pairs only go to the label sets the statement inserts
+		{"insert into metrics_labels (metric_name, fingerprint, job)", "sample.labels->>'job'", "on conflict do nothing returning id", "insert into metrics_label_kv", "from lbl join sample"},
+		{"from metrics_tmp) sample join metrics_labels lbl on lbl.metric_name = sample.metric_name and lbl.fingerprint = sample.fingerprint where sample.labels <>"},
+		{"insert into metrics_values (time, value, labels_id)", "lbl.metric_name = sample.metric_name and lbl.fingerprint = sample.fingerprint"},
+	} {
+		if i >= len(statements) {
+			t.Fatalf("Expected %d statements, got %v", i+1, statements)
+		}
+		for _, fragment := range fragments {
+			if !strings.Contains(statements[i], fragment) {
+				t.Errorf("Expected statement %d to contain %q, got %s", i, fragment, statements[i])
+			}
+		}
+	}
+	if len(statements) != 4 {
+		t.Errorf("Expected 4 statements, got %v", statements)
+	}
+
+	// the query and delete paths expect the columns of the jsonb labels table
+	relation := store.labelsRelation()
+	for _, fragment := range []string{"select l.id, l.metric_name,", "'{}'::jsonb) as labels from metrics_labels l"} {
+		if !strings.Contains(relation, fragment) {
+			t.Errorf("Expected the labels relation to contain %q, got %s", fragment, relation)
+		}
+	}
+	index := store.expectedIndexes()[0]
+	if !index.unique || index.table != "metrics_labels" || strings.Join(index.columns, ",") != "metric_name,fingerprint" {
+		t.Errorf("Expected the unique key on metric_name and fingerprint, got %+v", index)
+	}
+}
+
+func TestNormalizedLabelStoreCollision(t *testing.T) {
+	store := &normalizedLabelStore{table: "metrics"}
+	db := &recordingDB{rows: map[string][][]driver.Value{"where sample.labels <>": {{"up", int64(42)}}}}
+	err := store.insertLabels(context.Background(), recordingSession(t, db))
+	var collision *FingerprintCollisionError
+	if !errors.As(err, &collision) || collision.MetricName != "up" || collision.Fingerprint != 42 {
+		t.Fatalf("Expected a collision of up on fingerprint 42, got %v", err)
+	}
+	if class, _ := ClassifyError(err); class != ErrorClassCollision || RetryableErrorClass(class) {
+		t.Errorf("Expected a collision not to be retryable, got class %q", class)
+	}
+}
+
+func TestSeriesJsonMetricNameInLabels(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "node", "Zone": "a"}
+	for _, c := range []struct {
+		store    labelStore
+		expected string
+	}{
+		{store: &jsonbLabelStore{table: "metrics"}, expected: `{"Zone": "a","job": "node"}`},
+		{store: &jsonbLabelStore{table: "metrics", metricNameInLabels: true}, expected: `{"Zone": "a","__name__": "up","job": "node"}`},
+		// the normalized layout never stores the name among the labels, its view adds it
+		{store: &normalizedLabelStore{table: "metrics", metricNameInLabels: true}, expected: `{"Zone": "a","job": "node"}`},
+	} {
+		name, labelsJson := c.store.seriesJson(metric)
+		if name != "up" {
+			t.Errorf("%T: unexpected metric name %q", c.store, name)
+		}
+		if labelsJson != c.expected {
+			t.Errorf("%T: expected %s, got %s", c.store, c.expected, labelsJson)
+		}
+	}
+}
+
+func TestJsonbLabelStoreOtherLayout(t *testing.T) {
+	if s := (&jsonbLabelStore{table: "metrics"}); s.otherLayoutLabels() != sqlLabelsWithName {
+		t.Errorf("Expected label sets with the name to be the other layout, got %s", s.otherLayoutLabels())
+	}
+	if s := (&jsonbLabelStore{table: "metrics", metricNameInLabels: true}); s.otherLayoutLabels() != sqlLabelsWithoutName {
+		t.Errorf("Expected label sets without the name to be the other layout, got %s", s.otherLayoutLabels())
+	}
+}
+
+// TestMetricNameInLabelsSwitch enables the metric name in the labels on a table written without it, and
+// checks the series keeps its label set. It needs a database, given as connection string in
+// TS_PROM_TEST_PG_DSN.
+func TestMetricNameInLabelsSwitch(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "name_layout_test_metrics"
+	cfg.CheckIndexes = false
+	for _, statement := range []string{
+		"create table name_layout_test_metrics_labels (id serial primary key, metric_name text not null, labels jsonb not null, unique (metric_name, labels))",
+		"create table name_layout_test_metrics_values (time timestamp with time zone not null, value double precision, labels_id integer references name_layout_test_metrics_labels (id))",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		_, _ = db.Exec("drop table name_layout_test_metrics_values, name_layout_test_metrics_labels")
+	}()
+
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	for i, nameInLabels := range []bool{false, true} {
+		cfg.MetricNameInLabels = nameInLabels
+		client := &Client{DB: db, cfg: cfg, labels: &jsonbLabelStore{table: cfg.Table, metricNameInLabels: nameInLabels}, staging: stagingTable(cfg)}
+		if err := client.EnsureSchema(); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Write(model.Samples{{Metric: metric, Value: 1, Timestamp: model.Time(i + 1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var labelSets, unlabelled int
+	if err := db.QueryRow("select count(*) from name_layout_test_metrics_labels").Scan(&labelSets); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("select count(*) from name_layout_test_metrics_values where labels_id is null").Scan(&unlabelled); err != nil {
+		t.Fatal(err)
+	}
+	if labelSets != 1 || unlabelled != 0 {
+		t.Errorf("Expected both samples on a single label set, got %d label sets and %d samples without", labelSets, unlabelled)
+	}
+}
+
+// TestNormalizedFingerprintCollision stores a label set under the fingerprint of another, and checks that
+// writing the other fails instead of adding its samples to the stored series. It needs a database, given as
+// connection string in TS_PROM_TEST_PG_DSN.
+func TestNormalizedFingerprintCollision(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "collision_test_metrics"
+	cfg.LabelStorage = labelStorageNormalized
+	cfg.CheckIndexes = false
+	client := &Client{DB: db, cfg: cfg, labels: &normalizedLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = db.Exec("drop view collision_test_metrics; drop table collision_test_metrics_values, collision_test_metrics_label_kv, collision_test_metrics_label_keys, collision_test_metrics_labels cascade")
+	}()
+
+	stored := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	other := model.Metric{model.MetricNameLabel: "up", "job": "db"}
+	if err := client.Write(model.Samples{{Metric: stored, Value: 1, Timestamp: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// force the collision: the stored label set takes the fingerprint of the other
+	if _, err := db.Exec("update collision_test_metrics_labels set fingerprint = $1", int64(other.Fingerprint())); err != nil {
+		t.Fatal(err)
+	}
+	err = client.Write(model.Samples{{Metric: other, Value: 2, Timestamp: 2}})
+	var collision *FingerprintCollisionError
+	if !errors.As(err, &collision) {
+		t.Fatalf("Expected a fingerprint collision, got %v", err)
+	}
+	var samples int
+	if err := db.QueryRow("select count(*) from collision_test_metrics_values").Scan(&samples); err != nil {
+		t.Fatal(err)
+	}
+	var pairs int
+	if err := db.QueryRow("select count(*) from collision_test_metrics_label_kv").Scan(&pairs); err != nil {
+		t.Fatal(err)
+	}
+	if samples != 1 || pairs != 1 {
+		t.Errorf("Expected the stored series to be left alone, got %d samples and %d label pairs", samples, pairs)
+	}
+}
@@ -0,0 +1,168 @@
+package pgprometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// InvalidSamples counts the samples rejected by partial writes.
+var InvalidSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "rejected_samples_invalid_data_total",
+		Help: "Total number of samples rejected by the database as invalid data and left out of partially accepted writes.",
+	},
+)
+
+// PartialWriteError is returned by writes with PartialAccept that committed some samples and rejected the
+// others as invalid data.
+type PartialWriteError struct {
+	Written  int
+	Rejected int
+	// Err is the first error the database raised on the invalid data.
+	Err error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("%d of %d samples rejected as invalid data: %v", e.Rejected, e.Written+e.Rejected, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// rowError is a COPY error the database attributed to the sample at index in the batch.
+type rowError struct {
+	index int
+	err   error
+}
+
+func (e *rowError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rowError) Unwrap() error {
+	return e.err
+}
+
+var copyLinePattern = regexp.MustCompile(`^COPY \S+, line (\d+)`)
+
+// copyErrorLine returns the line of the COPY input the error was raised on, counting from 1, or 0.
+func copyErrorLine(err error) int {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return 0
+	}
+	match := copyLinePattern.FindStringSubmatch(pgErr.Where)
+	if match == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(match[1])
+	return line
+}
+
+// isDataError tells whether the database rejected a write for the data it contains, rather than for its own
+// state, so that writing the batch without the offending samples may succeed.
+func isDataError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || len(pgErr.Code) != 5 {
+		return false
+	}
+	switch pgErr.Code {
+	case "23502", "23514", "54000": // not_null_violation, check_violation, program_limit_exceeded
+		return true
+	}
+	return pgErr.Code[:2] == "22"
+}
+
+// batch is the samples of a write, and those of them going to the overflow table.
+type batch struct {
+	samples model.Samples
+	late    model.Samples
+}
+
+func (b batch) size() int {
+	return len(b.samples) + len(b.late)
+}
+
+func (b batch) all() model.Samples {
+	return append(append(model.Samples{}, b.samples...), b.late...)
+}
+
+// split halves the batch, the late samples coming after the others.
+func (b batch) split() (batch, batch) {
+	n := b.size() / 2
+	if n <= len(b.samples) {
+		return batch{samples: b.samples[:n]}, batch{samples: b.samples[n:], late: b.late}
+	}
+	n -= len(b.samples)
+	return batch{samples: b.samples, late: b.late[:n]}, batch{late: b.late[n:]}
+}
+
+// without returns the batch without the sample at index of its samples.
+func (b batch) without(index int) batch {
+	samples := append(append(make(model.Samples, 0, len(b.samples)-1), b.samples[:index]...), b.samples[index+1:]...)
+	return batch{samples: samples, late: b.late}
+}
+
+// writePartial writes the batch that failed with a data error without the offending samples. The sample a
+// COPY error names is left out right away, otherwise the batch is bisected until the failing parts are single
+// samples or PartialAcceptMaxDepth is reached, rejecting what still fails then. Parts are committed as they
+// succeed, so an error other than a data error may leave part of the batch written. The rejected samples and
+// the written ones are counted in stats.
+func (c *Client) writePartial(ctx context.Context, b batch, err error, stats *writers.WriteStats) error {
+	var rejected model.Samples
+	if err := c.bisect(ctx, b, err, 0, &rejected); err != nil {
+		return err
+	}
+	stats.Written = b.size() - len(rejected)
+	if len(rejected) == 0 {
+		// the data error didn't happen again
+		return nil
+	}
+	InvalidSamples.Add(float64(len(rejected)))
+	c.reject(stats, "invalid_data", rejected)
+	log.Warn("msg", "Rejected invalid samples, wrote the rest of the batch", "rejected", len(rejected), "written", b.size()-len(rejected), "err", err)
+	return &PartialWriteError{Written: b.size() - len(rejected), Rejected: len(rejected), Err: err}
+}
+
+// bisect handles the error of writing the batch, adding the samples it gives up on to rejected.
+func (c *Client) bisect(ctx context.Context, b batch, err error, depth int, rejected *model.Samples) error {
+	if !isDataError(err) {
+		return err
+	}
+	var rowErr *rowError
+	switch {
+	case b.size() == 1 || depth >= c.cfg.PartialAcceptMaxDepth:
+		*rejected = append(*rejected, b.all()...)
+		return nil
+	case errors.As(err, &rowErr) && rowErr.index < len(b.samples):
+		*rejected = append(*rejected, b.samples[rowErr.index])
+		return c.retry(ctx, b.without(rowErr.index), depth+1, rejected)
+	}
+	left, right := b.split()
+	if err := c.retry(ctx, left, depth+1, rejected); err != nil {
+		return err
+	}
+	return c.retry(ctx, right, depth+1, rejected)
+}
+
+func (c *Client) retry(ctx context.Context, b batch, depth int, rejected *model.Samples) error {
+	if b.size() == 0 {
+		return nil
+	}
+	err := c.writeBatch(ctx, b)
+	if err == nil {
+		return nil
+	}
+	return c.bisect(ctx, b, err, depth, rejected)
+}
@@ -0,0 +1,191 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+func TestIsDataError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{err: &pgconn.PgError{Code: "22P05"}, expected: true},
+		{err: fmt.Errorf("copy: %w", &pgconn.PgError{Code: "22021"}), expected: true},
+		{err: &pgconn.PgError{Code: "23502"}, expected: true},
+		{err: &pgconn.PgError{Code: "54000"}, expected: true},
+		{err: &pgconn.PgError{Code: "53100"}, expected: false},
+		{err: &pgconn.PgError{Code: "23505"}, expected: false},
+		{err: errors.New("connection reset"), expected: false},
+	}
+	for _, c := range testCases {
+		if actual := isDataError(c.err); actual != c.expected {
+			t.Errorf("Expected isDataError(%v) to be %v", c.err, c.expected)
+		}
+	}
+}
+
+func TestCopyErrorLine(t *testing.T) {
+	err := &pgconn.PgError{Code: "22P05", Where: "COPY metrics_copy, line 17, column labels: \"{}\""}
+	if line := copyErrorLine(err); line != 17 {
+		t.Errorf("Expected line 17, got %d", line)
+	}
+	if line := copyErrorLine(&pgconn.PgError{Code: "22P05"}); line != 0 {
+		t.Errorf("Expected no line, got %d", line)
+	}
+}
+
+func TestBatchSplit(t *testing.T) {
+	samples := make(model.Samples, 5)
+	for i := range samples {
+		samples[i] = &model.Sample{Value: model.SampleValue(i)}
+	}
+	testCases := []struct {
+		batch       batch
+		left, right [2]int
+	}{
+		{batch: batch{samples: samples[:4], late: samples[4:]}, left: [2]int{2, 0}, right: [2]int{2, 1}},
+		{batch: batch{samples: samples[:1], late: samples[1:]}, left: [2]int{1, 1}, right: [2]int{0, 3}},
+		{batch: batch{samples: samples[:1], late: samples[1:2]}, left: [2]int{1, 0}, right: [2]int{0, 1}},
+	}
+	for _, c := range testCases {
+		left, right := c.batch.split()
+		if len(left.samples) != c.left[0] || len(left.late) != c.left[1] || len(right.samples) != c.right[0] || len(right.late) != c.right[1] {
+			t.Errorf("Unexpected split of %d+%d samples: %d+%d and %d+%d", len(c.batch.samples), len(c.batch.late), len(left.samples), len(left.late), len(right.samples), len(right.late))
+		}
+		if len(left.all())+len(right.all()) != c.batch.size() {
+			t.Errorf("Expected the halves to keep all samples")
+		}
+	}
+
+	b := batch{samples: samples[:3]}.without(1)
+	if len(b.samples) != 2 || b.samples[0].Value != 0 || b.samples[1].Value != 2 {
+		t.Errorf("Unexpected samples without the second one: %v", b.samples)
+	}
+	if len(samples) != 5 || samples[1].Value != 1 {
+		t.Error("Expected the original samples to stay untouched")
+	}
+}
+
+// TestWritePartialAccept writes a batch with a label value jsonb doesn't accept and checks that the other
+// samples are written. It needs a database, given as connection string in TS_PROM_TEST_PG_DSN.
+func TestWritePartialAccept(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "partial_test_metrics"
+	cfg.CheckIndexes = false
+	cfg.PartialAccept = true
+	client := &Client{DB: db, cfg: cfg, labels: &jsonbLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, table := range []string{"view " + cfg.Table, "table " + cfg.Table + "_values", "table " + cfg.Table + "_labels"} {
+			_, _ = db.Exec("drop " + table + " cascade")
+		}
+	}()
+	var rejected model.Samples
+	client.OnReject(func(reason string, samples model.Samples) {
+		rejected = append(rejected, samples...)
+	})
+
+	var samples model.Samples
+	for i := 0; i < 10; i++ {
+		value := model.LabelValue(fmt.Sprint(i))
+		if i == 3 || i == 7 {
+			// jsonb can't store the NUL character
+			value = "\x00"
+		}
+		samples = append(samples, &model.Sample{Metric: model.Metric{model.MetricNameLabel: "partial", "i": value}, Value: 1, Timestamp: model.Time(i)})
+	}
+	err = client.Write(samples)
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) || partial.Written != 8 || partial.Rejected != 2 {
+		t.Fatalf("Expected 8 samples to be written and 2 rejected, got %v", err)
+	}
+	if len(rejected) != 2 {
+		t.Errorf("Expected the 2 invalid samples to be handed to the reject handler, got %d", len(rejected))
+	}
+	var count int
+	if err := db.QueryRow("select count(*) from partial_test_metrics_values").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 8 {
+		t.Errorf("Expected 8 samples to be written, got %d", count)
+	}
+}
+
+// TestWritePartialAcceptOverflow writes a batch whose late samples fail in the overflow table with the temp
+// staging table, and checks that retrying it doesn't write the other samples twice. It needs a database,
+// given as connection string in TS_PROM_TEST_PG_DSN.
+func TestWritePartialAcceptOverflow(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "partial_overflow_test_metrics"
+	cfg.CheckIndexes = false
+	cfg.PartialAccept = true
+	cfg.LateDataPolicy = lateDataOverflow
+	client := &Client{DB: db, cfg: cfg, labels: &jsonbLabelStore{table: cfg.Table}, staging: stagingTable(cfg)}
+	if err := client.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, table := range []string{"view " + cfg.Table, "table " + cfg.Table + "_values", "table " + cfg.Table + "_labels", "table " + cfg.Table + "_values_overflow"} {
+			_, _ = db.Exec("drop " + table + " cascade")
+		}
+	}()
+
+	sample := func(i int, value model.LabelValue) *model.Sample {
+		return &model.Sample{Metric: model.Metric{model.MetricNameLabel: "partial", "i": value}, Value: 1, Timestamp: model.Time(i)}
+	}
+	// jsonb can't store the NUL character
+	b := batch{
+		samples: model.Samples{sample(10, "a"), sample(11, "b"), sample(12, "c")},
+		late:    model.Samples{sample(1, "d"), sample(2, "\x00")},
+	}
+	ctx := context.Background()
+	err = client.writeBatch(ctx, b)
+	if !isDataError(err) {
+		t.Fatalf("Expected the late samples to fail with a data error, got %v", err)
+	}
+	stats := &writers.WriteStats{}
+	err = client.writePartial(ctx, b, err, stats)
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) || partial.Written != 4 || partial.Rejected != 1 {
+		t.Fatalf("Expected 4 samples to be written and 1 rejected, got %v", err)
+	}
+	for table, expected := range map[string]int{cfg.Table + "_values": 3, cfg.Table + "_values_overflow": 1} {
+		var count int
+		if err := db.QueryRow("select count(*) from " + table).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Errorf("Expected %d rows in %s, got %d", expected, table, count)
+		}
+	}
+}
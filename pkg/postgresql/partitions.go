@@ -0,0 +1,84 @@
+package pgprometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlPartitionedCreateValues  = "create table if not exists %s_values (time timestamp with time zone not null, value double precision, labels_id integer not null references %s_labels (id), metric_name text not null) partition by list (metric_name);"
+	sqlPartitionedInsertValues  = "insert into %s_values (time, value, labels_id, metric_name) select sample.time, sample.value, lbl.id, sample.metric_name from %s sample left join %s_labels lbl on lbl.metric_name = sample.metric_name and lbl.fingerprint = sample.fingerprint;"
+	sqlPartitionMetricNames     = "select distinct metric_name from %s;"
+	sqlPartitionLock            = "select pg_advisory_xact_lock(hashtext($1));"
+	sqlCreateMetricPartition    = "create table if not exists %s partition of %s for values in (%s);"
+	sqlMissingPartitionSQLState = "23514"
+)
+
+// isMissingPartition tells whether an insert failed because there is no partition for a row.
+func isMissingPartition(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == sqlMissingPartitionSQLState && strings.Contains(pgErr.Message, "no partition")
+}
+
+// metricPartitionName returns the name of the values partition of a metric. Metric names are hashed, as they
+// may be longer than identifiers are allowed to be.
+func metricPartitionName(table string, metricName string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(metricName))
+	return fmt.Sprintf("%s_values_%016x", table, h.Sum64())
+}
+
+// quoteLiteral quotes a string for use as SQL literal, assuming standard_conforming_strings.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// createMetricPartitions creates the missing values partitions for the metrics in the staging table. Adapter
+// replicas serialize on an advisory lock, so they don't race creating the same partition.
+func createMetricPartitions(ctx context.Context, w *writeSession, table string) error {
+	rows, err := w.conn.QueryContext(ctx, fmt.Sprintf(sqlPartitionMetricNames, w.staging))
+	if err != nil {
+		return err
+	}
+	var metricNames []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		metricNames = append(metricNames, name)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	err = w.inTx(ctx, "partitions", func(tx execer) error {
+		if _, err := tx.ExecContext(ctx, sqlPartitionLock, table+"_values_partitions"); err != nil {
+			return err
+		}
+		parent := pgx.Identifier{table + "_values"}.Sanitize()
+		for _, name := range metricNames {
+			partition := pgx.Identifier{metricPartitionName(table, name)}.Sanitize()
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlCreateMetricPartition, partition, parent, quoteLiteral(name))); err != nil {
+				return fmt.Errorf("error creating partition for metric %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Debug("msg", "Ensured metric partitions", "metrics", len(metricNames))
+	return nil
+}
@@ -0,0 +1,40 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestMetricPartitionName(t *testing.T) {
+	name := metricPartitionName("metrics", "node_cpu_seconds_total")
+	if name != metricPartitionName("metrics", "node_cpu_seconds_total") {
+		t.Error("Partition name is not stable")
+	}
+	if name == metricPartitionName("metrics", "node_cpu_seconds") {
+		t.Error("Different metrics share a partition name")
+	}
+	if len(name) != len("metrics_values_")+16 {
+		t.Errorf("Unexpected partition name %q", name)
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	if quoted := quoteLiteral(`it's`); quoted != `'it''s'` {
+		t.Errorf("Unexpected literal %s", quoted)
+	}
+}
+
+func TestIsMissingPartition(t *testing.T) {
+	err := &pgconn.PgError{Code: "23514", Message: "no partition of relation \"metrics_values\" found for row"}
+	if !isMissingPartition(fmt.Errorf("copy: %w", err)) {
+		t.Error("Expected missing partition error")
+	}
+	if isMissingPartition(&pgconn.PgError{Code: "23514", Message: "new row violates check constraint"}) {
+		t.Error("Check constraint violation is no missing partition")
+	}
+	if isMissingPartition(nil) {
+		t.Error("nil is no missing partition")
+	}
+}
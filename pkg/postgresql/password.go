@@ -0,0 +1,127 @@
+package pgprometheus
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const maxLoggedCommandOutput = 256
+
+// PasswordCommandFailures counts failed executions of the password command.
+var PasswordCommandFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "password_command_failures_total",
+		Help: "Total number of failed executions of the command retrieving the database password.",
+	},
+)
+
+// passwordCommand runs a shell command to retrieve the database password. The password is cached until
+// a connection attempt fails authentication, so the pool only waits for the command when credentials rotate.
+type passwordCommand struct {
+	command string
+	timeout time.Duration
+
+	mutex    sync.Mutex
+	password string
+	valid    bool
+}
+
+func newPasswordCommand(command string, timeout time.Duration) *passwordCommand {
+	return &passwordCommand{command: command, timeout: timeout}
+}
+
+// get returns the cached password, running the command if there is none.
+func (p *passwordCommand) get(ctx context.Context) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.valid {
+		return p.password, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// don't wait for children of the shell that keep the output open after a timeout
+	cmd.WaitDelay = time.Second
+	log.Debug("msg", "Running password command")
+	if err := cmd.Run(); err != nil {
+		PasswordCommandFailures.Inc()
+		// stdout may contain (part of) a secret, so only stderr is logged
+		log.Error("msg", "Password command failed", "err", err, "stderr", sanitizeCommandOutput(stderr.String(), p.password))
+		return "", fmt.Errorf("password command failed: %w", err)
+	}
+	password := strings.TrimRight(stdout.String(), "\r\n")
+	if password == "" {
+		PasswordCommandFailures.Inc()
+		return "", errors.New("password command returned an empty password")
+	}
+	p.password = password
+	p.valid = true
+	return password, nil
+}
+
+// invalidate makes the next connection attempt run the command again.
+func (p *passwordCommand) invalidate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.valid = false
+}
+
+// sanitizeCommandOutput makes command output safe to log: the known secret is redacted, control
+// characters are dropped and the output is truncated.
+func sanitizeCommandOutput(output string, secret string) string {
+	if secret != "" {
+		output = strings.ReplaceAll(output, secret, "<redacted>")
+	}
+	output = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.TrimSpace(output))
+	if len(output) > maxLoggedCommandOutput {
+		output = output[:maxLoggedCommandOutput] + "..."
+	}
+	return output
+}
+
+// isAuthenticationError tells whether the server rejected the credentials of a connection attempt.
+func isAuthenticationError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// invalid_authorization_specification and invalid_password
+	return pgErr.Code == "28000" || pgErr.Code == "28P01"
+}
+
+// reauthConnector invalidates the cached password whenever a connection fails authentication.
+type reauthConnector struct {
+	driver.Connector
+	password *passwordCommand
+}
+
+func (c *reauthConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil && isAuthenticationError(err) {
+		log.Warn("msg", "Database authentication failed, password command will run again on the next connection attempt")
+		c.password.invalidate()
+	}
+	return conn, err
+}
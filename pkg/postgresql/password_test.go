@@ -0,0 +1,83 @@
+package pgprometheus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPasswordCommandCachesUntilInvalidated(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "runs")
+	p := newPasswordCommand(fmt.Sprintf("echo run >> %s; echo secret", counter), 5*time.Second)
+	for i := 0; i < 3; i++ {
+		password, err := p.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if password != "secret" {
+			t.Errorf("Expected password without trailing newline, got %q", password)
+		}
+	}
+	p.invalidate()
+	if _, err := p.get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(runs), "run"); n != 2 {
+		t.Errorf("Expected the command to run twice, got %d", n)
+	}
+}
+
+func TestPasswordCommandFailures(t *testing.T) {
+	testCases := []struct {
+		name    string
+		command string
+	}{
+		{name: "exit code", command: "echo oops >&2; exit 1"},
+		{name: "timeout", command: "exec sleep 5"},
+		{name: "empty output", command: "true"},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			before := testutil.ToFloat64(PasswordCommandFailures)
+			p := newPasswordCommand(c.command, 100*time.Millisecond)
+			if _, err := p.get(context.Background()); err == nil {
+				t.Fatal("Expected an error")
+			}
+			if delta := testutil.ToFloat64(PasswordCommandFailures) - before; delta != 1 {
+				t.Errorf("Expected one failure, got %v", delta)
+			}
+		})
+	}
+}
+
+func TestSanitizeCommandOutput(t *testing.T) {
+	if out := sanitizeCommandOutput("token hunter2 expired\n\x1b[31mretry\n", "hunter2"); out != "token <redacted> expired  [31mretry" {
+		t.Errorf("Unexpected sanitized output %q", out)
+	}
+	if out := sanitizeCommandOutput(strings.Repeat("x", 1000), ""); len(out) != maxLoggedCommandOutput+3 {
+		t.Errorf("Expected output to be truncated, got %d bytes", len(out))
+	}
+}
+
+func TestIsAuthenticationError(t *testing.T) {
+	if !isAuthenticationError(fmt.Errorf("connect: %w", &pgconn.PgError{Code: "28P01"})) {
+		t.Error("Expected invalid_password to be an authentication error")
+	}
+	if isAuthenticationError(&pgconn.PgError{Code: "57P03"}) {
+		t.Error("Expected cannot_connect_now not to be an authentication error")
+	}
+	if isAuthenticationError(context.DeadlineExceeded) {
+		t.Error("Expected a timeout not to be an authentication error")
+	}
+}
@@ -0,0 +1,72 @@
+package pgprometheus
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const (
+	// maxExactInteger is 2^53, from which not every integer is a float64: 2^53+1 rounds to 2^53.
+	maxExactInteger = 1 << 53
+	// impreciseLogInterval is how often samples with imprecise values are logged while they come in.
+	impreciseLogInterval = 10 * time.Minute
+)
+
+// ImpreciseSamples counts the samples of which the value is an integer of magnitude 2^53 or more.
+var ImpreciseSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "imprecise_samples_total",
+		Help: "Total number of samples with an integer value of magnitude 2^53 or more, from which float64 can't represent every integer, so the value may have been rounded, eg. by the sender. The values are stored as received.",
+	},
+)
+
+// impreciseValue tells whether v is an integer too large for float64 to represent its neighbours. Every
+// finite float64 of magnitude 2^53 or more is an integer.
+func impreciseValue(v float64) bool {
+	return !math.IsInf(v, 0) && math.Abs(v) >= maxExactInteger
+}
+
+// precisionCheck counts the samples with imprecise values, logging a warning with an example at most every
+// impreciseLogInterval.
+type precisionCheck struct {
+	mutex      sync.Mutex
+	lastLog    time.Time
+	suppressed int
+}
+
+// check counts the samples with imprecise values and returns how many there were.
+func (p *precisionCheck) check(samples model.Samples, now time.Time) int {
+	var imprecise int
+	var example *model.Sample
+	for _, sample := range samples {
+		if impreciseValue(float64(sample.Value)) {
+			imprecise++
+			if example == nil {
+				example = sample
+			}
+		}
+	}
+	if imprecise == 0 {
+		return 0
+	}
+	ImpreciseSamples.Add(float64(imprecise))
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.lastLog.IsZero() && now.Sub(p.lastLog) < impreciseLogInterval {
+		p.suppressed += imprecise
+		return imprecise
+	}
+	// the count includes the samples suppressed since the previous warning
+	log.Warn("msg", "Samples have integer values of magnitude 2^53 or more, which float64 can't represent exactly, precision may have been lost before they were received",
+		"count", imprecise+p.suppressed, "series", example.Metric.String(), "value", strconv.FormatFloat(float64(example.Value), 'f', -1, 64))
+	p.lastLog = now
+	p.suppressed = 0
+	return imprecise
+}
@@ -0,0 +1,70 @@
+package pgprometheus
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestImpreciseValue(t *testing.T) {
+	for _, c := range []struct {
+		value     float64
+		imprecise bool
+	}{
+		{value: 0},
+		{value: 1.5},
+		{value: 1<<53 - 1},
+		{value: -(1<<53 - 1)},
+		{value: 4503599627370495.5},
+		{value: 1 << 53, imprecise: true},
+		{value: -(1 << 53), imprecise: true},
+		{value: 1<<53 + 2, imprecise: true},
+		{value: 1e300, imprecise: true},
+		{value: math.MaxFloat64, imprecise: true},
+		{value: math.Inf(1)},
+		{value: math.Inf(-1)},
+		{value: math.NaN()},
+	} {
+		if got := impreciseValue(c.value); got != c.imprecise {
+			t.Errorf("impreciseValue(%v): expected %v, got %v", c.value, c.imprecise, got)
+		}
+	}
+}
+
+func TestPrecisionCheck(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "ifHCInOctets", "instance": "core-router"}
+	samples := model.Samples{
+		{Metric: metric, Value: 1 << 60},
+		{Metric: metric, Value: 42},
+		{Metric: metric, Value: model.SampleValue(math.NaN())},
+		{Metric: metric, Value: -(1 << 54)},
+	}
+	var p precisionCheck
+	before := testutil.ToFloat64(ImpreciseSamples)
+	now := time.Unix(1000, 0)
+	if n := p.check(samples, now); n != 2 {
+		t.Errorf("Expected 2 imprecise samples, got %d", n)
+	}
+	if !p.lastLog.Equal(now) {
+		t.Error("Expected the first imprecise samples to be logged")
+	}
+
+	// within the log interval, the samples are counted but not logged
+	if n := p.check(samples, now.Add(time.Minute)); n != 2 || p.suppressed != 2 || !p.lastLog.Equal(now) {
+		t.Errorf("Expected the samples not to be logged again, got %d imprecise and %d suppressed", n, p.suppressed)
+	}
+	if n := p.check(samples[1:3], now.Add(2*time.Minute)); n != 0 || p.suppressed != 2 {
+		t.Errorf("Expected precise samples not to be counted, got %d", n)
+	}
+	later := now.Add(impreciseLogInterval)
+	p.check(samples, later)
+	if !p.lastLog.Equal(later) || p.suppressed != 0 {
+		t.Error("Expected the samples to be logged again after the log interval")
+	}
+	if counted := testutil.ToFloat64(ImpreciseSamples) - before; counted != 6 {
+		t.Errorf("Expected 6 imprecise samples to be counted, got %v", counted)
+	}
+}
@@ -0,0 +1,72 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// Priorities of writes, as values of the priority label of WritePhaseDuration.
+const (
+	priorityLive = "live"
+	priorityLow  = "low"
+)
+
+// WritePhaseDuration observes the database phases of writes, by priority. The acquire phase is the wait for
+// a connection of the pool of the priority.
+var WritePhaseDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "write_phase_duration_seconds",
+		Help:    "Duration of the database phases of writes (acquire, copy, insert_labels, provenance, insert_values, write_overflow, commit), by priority (live or low).",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 16),
+	},
+	[]string{"phase", "priority"},
+)
+
+type priorityKey struct{}
+
+// withPriority returns a context of which the writes have the given priority.
+func withPriority(ctx context.Context, priority string) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// writePriority returns the priority of the writes of ctx, live unless set otherwise.
+func writePriority(ctx context.Context) string {
+	if priority, ok := ctx.Value(priorityKey{}).(string); ok {
+		return priority
+	}
+	return priorityLive
+}
+
+// WriteLowPriority writes samples like WriteContext, on the connections of the low priority pool, which is
+// separate from the pool of the live writes and of LowPriorityMaxOpenConns connections. Backfills and
+// replays use it so that they can't take the connections live writes need, while always getting at least one
+// connection themselves.
+func (c *Client) WriteLowPriority(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	return c.WriteContext(withPriority(ctx, priorityLow), samples)
+}
+
+// acquireConn acquires a connection for a write, from the pool of its priority.
+func (c *Client) acquireConn(ctx context.Context) (*sql.Conn, error) {
+	db := c.DB
+	if writePriority(ctx) == priorityLow && c.lowPriority != nil {
+		db = c.lowPriority
+	}
+	var conn *sql.Conn
+	err := traced(ctx, "acquire", func(ctx context.Context) error {
+		var err error
+		conn, err = db.Conn(ctx)
+		return err
+	})
+	return conn, err
+}
+
+// observePhase observes the duration of a write phase since begin, by the priority of ctx.
+func observePhase(ctx context.Context, phase string, begin time.Time) {
+	WritePhaseDuration.WithLabelValues(phase, writePriority(ctx)).Observe(time.Since(begin).Seconds())
+}
@@ -0,0 +1,72 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestWritePriority(t *testing.T) {
+	ctx := context.Background()
+	if priority := writePriority(ctx); priority != priorityLive {
+		t.Errorf("Expected writes to be live by default, got %q", priority)
+	}
+	if priority := writePriority(withPriority(ctx, priorityLow)); priority != priorityLow {
+		t.Errorf("Expected a low priority write, got %q", priority)
+	}
+}
+
+// TestLowPriorityPoolSaturated holds all the connections of the low priority pool, as concurrent backfills
+// would, and checks that live writes still get a connection while low priority writes wait.
+func TestLowPriorityPoolSaturated(t *testing.T) {
+	live, lowPriority := sql.OpenDB(&recordingDB{}), sql.OpenDB(&recordingDB{})
+	live.SetMaxOpenConns(1)
+	lowPriority.SetMaxOpenConns(2)
+	client := &Client{DB: live, lowPriority: lowPriority}
+	defer client.Close()
+
+	lowCtx := withPriority(context.Background(), priorityLow)
+	acquiredBefore := phaseCount(t, "acquire", priorityLow)
+	for i := 0; i < 2; i++ {
+		conn, err := client.acquireConn(lowCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	if acquired := phaseCount(t, "acquire", priorityLow) - acquiredBefore; acquired != 2 {
+		t.Errorf("Expected 2 low priority acquisitions to be observed, got %d", acquired)
+	}
+
+	ctx, cancel := context.WithTimeout(lowCtx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.acquireConn(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected low priority writes to wait for their pool, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := client.acquireConn(ctx)
+	if err != nil {
+		t.Fatalf("Expected live writes not to be blocked by low priority writes, got %v", err)
+	}
+	defer conn.Close()
+	if n := live.Stats().OpenConnections; n != 1 {
+		t.Errorf("Expected the live write to use the live pool, got %d open connections", n)
+	}
+}
+
+// phaseCount returns the number of write phases observed with a priority.
+func phaseCount(t *testing.T, phase string, priority string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := WritePhaseDuration.WithLabelValues(phase, priority).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,191 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// validPromotedLabel restricts promoted labels to names usable as column names without quoting.
+var validPromotedLabel = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// reservedPromotedLabels are the columns of the labels tables and of the view.
+var reservedPromotedLabels = map[string]bool{"id": true, "metric_name": true, "labels": true, "fingerprint": true, "time": true, "value": true, "name": true, "first_seen": true, "last_seen": true, "written_by": true}
+
+const (
+	// promotedColumnComment marks the columns of promoted labels, promotedBackfilledComment once they are
+	// backfilled.
+	promotedColumnComment     = "promoted label"
+	promotedBackfilledComment = "promoted label, backfilled"
+	promotedBackfillBatch     = 10000
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlPromotedColumns      = "select a.attname, coalesce(col_description(a.attrelid, a.attnum), '') from pg_attribute a where a.attrelid = to_regclass($1) and a.attnum > 0 and not a.attisdropped order by a.attnum"
+	sqlPromotedNeedsQuoting = "select quote_ident($1) <> $1"
+	sqlPromotedAddColumn    = "alter table %s_labels add column if not exists %s text"
+	sqlPromotedCreateIndex  = "create index concurrently if not exists %s on %s_labels using btree (%s)"
+	sqlPromotedMaxID        = "select coalesce(max(id), 0) from %s_labels"
+	sqlPromotedComment      = "comment on column %s_labels.%s is '%s'"
+	sqlJsonbBackfill        = "update %s_labels set %s = labels->>$3 where id > $1 and id <= $2 and %s is null and labels ? $3"
+	sqlNormalizedBackfill   = "update %s_labels l set %s = kv.value from %s_label_kv kv join %s_label_keys k on k.id = kv.key_id where kv.labels_id = l.id and k.key = $3 and l.id > $1 and l.id <= $2 and l.%s is null"
+)
+
+// parsePromotedLabels splits a comma-separated list of labels to promote to columns.
+func parsePromotedLabels(list string) ([]string, error) {
+	var promoted []string
+	seen := map[string]bool{}
+	for _, label := range strings.Split(list, ",") {
+		label = strings.TrimSpace(label)
+		switch {
+		case label == "":
+			continue
+		case !validPromotedLabel.MatchString(label):
+			return nil, fmt.Errorf("invalid promoted label %q, only lower case letters, digits and underscores are allowed", label)
+		case reservedPromotedLabels[label]:
+			return nil, fmt.Errorf("the label %q can't be promoted, a column of the labels table or the view has that name", label)
+		case seen[label]:
+			continue
+		}
+		seen[label] = true
+		promoted = append(promoted, label)
+	}
+	return promoted, nil
+}
+
+// promotedInsert returns the columns and values the promoted labels add to the insert of new label sets,
+// taken from the labels of the staged samples.
+func promotedInsert(promoted []string) (string, string) {
+	var columns, values strings.Builder
+	for _, label := range promoted {
+		fmt.Fprintf(&columns, ", %s", label)
+		fmt.Fprintf(&values, ", sample.labels->>'%s'", label)
+	}
+	return columns.String(), values.String()
+}
+
+// promotedIndexes returns the indexes of the columns of the promoted labels.
+func promotedIndexes(table string, promoted []string) []expectedIndex {
+	indexes := make([]expectedIndex, 0, len(promoted))
+	for _, label := range promoted {
+		indexes = append(indexes, expectedIndex{table: table + "_labels", method: "btree", columns: []string{label}})
+	}
+	return indexes
+}
+
+// ensurePromotedColumns adds the missing columns of the promoted labels to the labels table, and their
+// indexes. It returns the columns of labels promoted now or before, in table order, and the promoted labels
+// of which the columns aren't backfilled yet. Columns of labels no longer promoted are kept, they just
+// aren't populated anymore; they stay in the view, which can't drop columns. Nothing is done if the labels
+// table doesn't exist.
+func ensurePromotedColumns(ctx context.Context, db *sql.DB, table string, promoted []string) ([]string, []string, error) {
+	for _, label := range promoted {
+		var needsQuoting bool
+		if err := db.QueryRowContext(ctx, sqlPromotedNeedsQuoting, label).Scan(&needsQuoting); err != nil {
+			return nil, nil, fmt.Errorf("error checking promoted label %q: %w", label, err)
+		}
+		if needsQuoting {
+			return nil, nil, fmt.Errorf("the label %q can't be promoted, it is a reserved word in PostgreSQL", label)
+		}
+	}
+	rows, err := db.QueryContext(ctx, sqlPromotedColumns, table+"_labels")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing the columns of the labels table: %w", err)
+	}
+	var names []string
+	comments := map[string]string{}
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			_ = rows.Close()
+			return nil, nil, err
+		}
+		names = append(names, name)
+		comments[name] = comment
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(names) == 0 {
+		// the jsonb layout doesn't create the tables, writes will tell
+		return nil, nil, nil
+	}
+
+	isPromoted := map[string]bool{}
+	for _, label := range promoted {
+		isPromoted[label] = true
+	}
+	var columns, backfill []string
+	for _, name := range names {
+		switch {
+		case isPromoted[name]:
+			columns = append(columns, name)
+		case strings.HasPrefix(comments[name], promotedColumnComment):
+			log.Info("msg", "Label isn't promoted anymore, its column is kept but not populated", "table", table+"_labels", "column", name)
+			columns = append(columns, name)
+		}
+	}
+	for _, label := range promoted {
+		if _, ok := comments[label]; !ok {
+			log.Info("msg", "Promoting label to a column of the labels table", "table", table+"_labels", "label", label)
+			if _, err := db.ExecContext(ctx, fmt.Sprintf(sqlPromotedAddColumn, table, label)); err != nil {
+				return nil, nil, fmt.Errorf("error adding the column of promoted label %q: %w", label, err)
+			}
+			if _, err := db.ExecContext(ctx, fmt.Sprintf(sqlPromotedComment, table, label, promotedColumnComment)); err != nil {
+				return nil, nil, fmt.Errorf("error marking the column of promoted label %q: %w", label, err)
+			}
+			columns = append(columns, label)
+		}
+		if comments[label] != promotedBackfilledComment {
+			backfill = append(backfill, label)
+		}
+	}
+	for _, idx := range promotedIndexes(table, promoted) {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(sqlPromotedCreateIndex, idx.name(), table, idx.columns[0])); err != nil {
+			return nil, nil, fmt.Errorf("error creating the index of promoted label %q: %w", idx.columns[0], err)
+		}
+	}
+	return columns, backfill, nil
+}
+
+// backfillPromoted populates the columns of newly promoted labels for the label sets inserted before, in
+// batches of label set IDs, and marks each column as backfilled once done. Label sets inserted meanwhile
+// are populated by the writes. An interrupted backfill starts over on the next start.
+func (c *Client) backfillPromoted(labels []string) {
+	ctx := context.Background()
+	for _, label := range labels {
+		var maxID int64
+		if err := c.DB.QueryRowContext(ctx, fmt.Sprintf(sqlPromotedMaxID, c.cfg.Table)).Scan(&maxID); err != nil {
+			log.Error("msg", "Error backfilling promoted label", "label", label, "err", err)
+			return
+		}
+		log.Info("msg", "Backfilling promoted label", "label", label, "max_id", maxID)
+		statement := c.labels.promotedBackfill(label)
+		var updated int64
+		for from := int64(0); from < maxID; from += promotedBackfillBatch {
+			select {
+			case <-c.stop:
+				return
+			default:
+			}
+			result, err := c.DB.ExecContext(ctx, statement, from, from+promotedBackfillBatch, label)
+			if err != nil {
+				log.Error("msg", "Error backfilling promoted label, it is retried on the next start", "label", label, "err", err)
+				return
+			}
+			rows, _ := result.RowsAffected()
+			updated += rows
+		}
+		if _, err := c.DB.ExecContext(ctx, fmt.Sprintf(sqlPromotedComment, c.cfg.Table, label, promotedBackfilledComment)); err != nil {
+			log.Error("msg", "Error marking promoted label as backfilled", "label", label, "err", err)
+			return
+		}
+		log.Info("msg", "Backfilled promoted label", "label", label, "updated", updated)
+	}
+}
@@ -0,0 +1,130 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestParsePromotedLabels(t *testing.T) {
+	promoted, err := parsePromotedLabels(" cluster, namespace,,job,cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"cluster", "namespace", "job"}; !reflect.DeepEqual(promoted, expected) {
+		t.Errorf("Expected %v, got %v", expected, promoted)
+	}
+	if promoted, err := parsePromotedLabels(""); err != nil || len(promoted) != 0 {
+		t.Errorf("Expected no promoted labels, got %v, %v", promoted, err)
+	}
+	for _, list := range []string{"Cluster", "job-name", "1st", "cluster,labels", "name", "job;drop table metrics_labels"} {
+		if _, err := parsePromotedLabels(list); err == nil {
+			t.Errorf("Expected %q to be rejected", list)
+		}
+	}
+}
+
+func TestPromotedInsert(t *testing.T) {
+	store := &jsonbLabelStore{table: "metrics", promoted: []string{"cluster", "job"}}
+	columns, values := promotedInsert(store.promoted)
+	if columns != ", cluster, job" || values != ", sample.labels->>'cluster', sample.labels->>'job'" {
+		t.Errorf("Unexpected promoted columns %q and values %q", columns, values)
+	}
+	if columns, values := promotedInsert(nil); columns != "" || values != "" {
+		t.Errorf("Expected no promoted columns, got %q and %q", columns, values)
+	}
+	indexes := store.expectedIndexes()
+	last := indexes[len(indexes)-1]
+	if last.table != "metrics_labels" || last.method != "btree" || !reflect.DeepEqual(last.columns, []string{"job"}) {
+		t.Errorf("Expected a btree index on the promoted column, got %s", last)
+	}
+}
+
+// TestPromotedLabels promotes labels on a normalized table with existing label sets, checks they are
+// backfilled and exposed by the view, then removes one from the promoted labels. It needs a database, given as
+// connection string in TS_PROM_TEST_PG_DSN.
+func TestPromotedLabels(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "promoted_test_metrics"
+	cfg.LabelStorage = labelStorageNormalized
+	cfg.CheckIndexes = false
+	defer func() {
+		_, _ = db.Exec("drop view if exists promoted_test_metrics")
+		_, _ = db.Exec("drop table if exists promoted_test_metrics_values, promoted_test_metrics_label_kv, promoted_test_metrics_label_keys, promoted_test_metrics_labels")
+	}()
+	client := func(promotedLabels string) *Client {
+		promoted, err := parsePromotedLabels(promotedLabels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.PromotedLabels = promotedLabels
+		labels, err := newLabelStore(cfg.LabelStorage, cfg.Table, false, false, promoted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Client{DB: db, cfg: cfg, labels: labels, staging: stagingTable(cfg), stop: make(chan struct{})}
+	}
+
+	before := client("")
+	if err := before.EnsureSchema(); err != nil {
+		t.Fatal(err)
+	}
+	old := model.Metric{model.MetricNameLabel: "up", "job": "node", "cluster": "eu"}
+	if err := before.Write(model.Samples{{Metric: old, Value: 1, Timestamp: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	promoted := client("cluster,job")
+	backfill, err := promoted.labels.ensureSchema(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(backfill, []string{"cluster", "job"}) {
+		t.Fatalf("Expected both labels to be backfilled, got %v", backfill)
+	}
+	promoted.backfillPromoted(backfill)
+	if err := promoted.Write(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up", "job": "api"}, Value: 1, Timestamp: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("select job, cluster from promoted_test_metrics order by time")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]sql.NullString
+	for rows.Next() {
+		var job, cluster sql.NullString
+		if err := rows.Scan(&job, &cluster); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, [2]sql.NullString{job, cluster})
+	}
+	_ = rows.Close()
+	expected := [][2]sql.NullString{{{String: "node", Valid: true}, {String: "eu", Valid: true}}, {{String: "api", Valid: true}, {}}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected promoted columns %v, got %v", expected, got)
+	}
+
+	// the column of cluster is kept, and so is its place in the view
+	removed := client("job")
+	if backfill, err := removed.labels.ensureSchema(context.Background(), db); err != nil || len(backfill) != 0 {
+		t.Fatalf("Expected nothing to backfill, got %v, %v", backfill, err)
+	}
+	var cluster string
+	if err := db.QueryRow("select cluster from promoted_test_metrics where time = $1", time.Unix(0, 1e6).UTC()).Scan(&cluster); err != nil || cluster != "eu" {
+		t.Errorf("Expected the cluster column to be kept, got %q, %v", cluster, err)
+	}
+}
@@ -0,0 +1,182 @@
+package pgprometheus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ErrUnsupportedExpression is returned for valid PromQL outside of the subset QueryRange can translate.
+var ErrUnsupportedExpression = errors.New("unsupported expression")
+
+// ErrTooManySamples is returned when a query returns more samples than allowed.
+var ErrTooManySamples = errors.New("query returns too many samples")
+
+// QueryRange evaluates a PromQL expression over the given range. Only a subset of PromQL is supported:
+// instant vector selectors, rate() over range selectors and sum (optionally by labels) over either.
+// Everything is evaluated in the database, so results are approximations of what Prometheus returns:
+//   - a selector yields the last sample of each step, stamped with the end of the step;
+//   - rate() is the difference between the highest and the lowest sample of the window divided by its
+//     length, ignoring counter resets and without extrapolation.
+//
+// ErrTooManySeries is returned if the result has more than limit series, ErrTooManySamples if it has more
+// than maxSamples samples (0 means no limit). Either aborts the query in the database.
+func (c *Client) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration, limit int, maxSamples int) (model.Matrix, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	args := sqlArgs{}
+	exprSQL, err := c.exprToSQL(expr, start, end, step, &args)
+	if err != nil {
+		return nil, err
+	}
+	// canceling the context aborts the query, rows.Close would read the remaining rows
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rows, err := c.DB.QueryContext(ctx, fmt.Sprintf("select q.t, q.metric_name, q.labels, q.value from (%s) q order by q.metric_name, q.labels, q.t", exprSQL), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	result := model.Matrix{}
+	var current *model.SampleStream
+	var currentName string
+	var currentLabels []byte
+	samples := 0
+	for rows.Next() {
+		var t time.Time
+		var metricName string
+		var labelsJson []byte
+		var value float64
+		if err := rows.Scan(&t, &metricName, &labelsJson, &value); err != nil {
+			return nil, err
+		}
+		if current == nil || metricName != currentName || string(labelsJson) != string(currentLabels) {
+			if len(result) == limit {
+				cancel()
+				return nil, ErrTooManySeries
+			}
+			metric := model.Metric{}
+			if err := json.Unmarshal(labelsJson, &metric); err != nil {
+				return nil, fmt.Errorf("error decoding labels of series %s: %w", metricName, err)
+			}
+			if metricName != "" {
+				metric[model.MetricNameLabel] = model.LabelValue(metricName)
+			}
+			current = &model.SampleStream{Metric: metric}
+			currentName, currentLabels = metricName, labelsJson
+			result = append(result, current)
+		}
+		if samples++; maxSamples > 0 && samples > maxSamples {
+			cancel()
+			return nil, ErrTooManySamples
+		}
+		current.Values = append(current.Values, model.SamplePair{Timestamp: model.TimeFromUnixNano(t.UnixNano()), Value: model.SampleValue(value)})
+	}
+	return result, rows.Err()
+}
+
+// exprToSQL translates a PromQL expression into a query returning the columns t, metric_name, labels and
+// value, with one row per series and step.
+func (c *Client) exprToSQL(expr parser.Expr, start, end time.Time, step time.Duration, args *sqlArgs) (string, error) {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return c.exprToSQL(e.Expr, start, end, step, args)
+	case *parser.VectorSelector:
+		return c.selectorToSQL(e, start, end, step, args)
+	case *parser.Call:
+		if e.Func.Name != "rate" {
+			break
+		}
+		matrix, ok := e.Args[0].(*parser.MatrixSelector)
+		if !ok {
+			break
+		}
+		return c.rateToSQL(matrix, start, end, step, args)
+	case *parser.AggregateExpr:
+		if e.Op != parser.SUM || e.Without {
+			break
+		}
+		inner, err := c.exprToSQL(e.Expr, start, end, step, args)
+		if err != nil {
+			return "", err
+		}
+		group := "'{}'::jsonb"
+		if len(e.Grouping) > 0 {
+			fields := make([]string, 0, len(e.Grouping))
+			for _, name := range e.Grouping {
+				value := "nullif(g.metric_name, '')"
+				if name != model.MetricNameLabel {
+					value = fmt.Sprintf("g.labels->>%s", args.add(name))
+				}
+				fields = append(fields, fmt.Sprintf("%s::text, %s", args.add(name), value))
+			}
+			group = fmt.Sprintf("jsonb_strip_nulls(jsonb_build_object(%s))", strings.Join(fields, ", "))
+		}
+		return fmt.Sprintf("select g.t, '' as metric_name, %s as labels, sum(g.value) as value from (%s) g group by 1, 3", group, inner), nil
+	}
+	return "", fmt.Errorf("%w %q: only vector selectors, rate() and sum by() are supported", ErrUnsupportedExpression, expr.String())
+}
+
+// selectorToSQL buckets the samples of the selected series by step, taking the last sample of each bucket.
+func (c *Client) selectorToSQL(vs *parser.VectorSelector, start, end time.Time, step time.Duration, args *sqlArgs) (string, error) {
+	if err := checkPlainSelector(vs); err != nil {
+		return "", err
+	}
+	condition, err := matchersToSQL("l", vs.LabelMatchers, args)
+	if err != nil {
+		return "", err
+	}
+	stepInterval := intervalArg(step, args)
+	return fmt.Sprintf("select time_bucket(%s, v.time, %s::timestamptz) + %s as t, l.metric_name, l.labels, last(v.value, v.time) as value "+
+		"from %s_values v join %s l on l.id = v.labels_id where %s and v.time >= %s::timestamptz - %s and v.time < %s "+
+		"group by 1, l.id, l.metric_name, l.labels",
+		stepInterval, args.add(start), stepInterval, c.cfg.Table, c.labels.labelsRelation(), condition,
+		args.add(start), stepInterval, args.add(end)), nil
+}
+
+// rateToSQL approximates the per-second rate of the selected series for each step as max(value) - min(value)
+// over the window ending at the step.
+func (c *Client) rateToSQL(ms *parser.MatrixSelector, start, end time.Time, step time.Duration, args *sqlArgs) (string, error) {
+	vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+	if !ok {
+		return "", fmt.Errorf("%w %q: rate() needs a range selector", ErrUnsupportedExpression, ms.String())
+	}
+	if err := checkPlainSelector(vs); err != nil {
+		return "", err
+	}
+	condition, err := matchersToSQL("l", vs.LabelMatchers, args)
+	if err != nil {
+		return "", err
+	}
+	window := intervalArg(ms.Range, args)
+	return fmt.Sprintf("select s.t, '' as metric_name, l.labels, (max(v.value) - min(v.value)) / %s as value "+
+		"from generate_series(%s::timestamptz, %s::timestamptz, %s) s(t) "+
+		"join %s_values v on v.time > s.t - %s and v.time <= s.t join %s l on l.id = v.labels_id where %s "+
+		"group by s.t, l.id, l.labels having count(*) > 1",
+		args.add(ms.Range.Seconds()), args.add(start), args.add(end), intervalArg(step, args),
+		c.cfg.Table, window, c.labels.labelsRelation(), condition), nil
+}
+
+// checkPlainSelector rejects selector modifiers that aren't translated.
+func checkPlainSelector(vs *parser.VectorSelector) error {
+	if vs.OriginalOffset != 0 || vs.Timestamp != nil || vs.StartOrEnd != 0 {
+		return fmt.Errorf("%w %q: offset and @ modifiers are not supported", ErrUnsupportedExpression, vs.String())
+	}
+	return nil
+}
+
+// intervalArg adds a duration as argument and returns it as SQL interval.
+func intervalArg(d time.Duration, args *sqlArgs) string {
+	return fmt.Sprintf("(%s::float8 * interval '1 second')", args.add(d.Seconds()))
+}
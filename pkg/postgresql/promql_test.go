@@ -0,0 +1,66 @@
+package pgprometheus
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+func TestExprToSQL(t *testing.T) {
+	client := &Client{cfg: &Config{Table: "metrics"}, labels: &jsonbLabelStore{table: "metrics"}}
+	testCases := []struct {
+		query       string
+		contains    []string
+		unsupported bool
+	}{
+		{query: `up{job="node"}`, contains: []string{"time_bucket(", "last(v.value, v.time)", "l.metric_name = $", "from metrics_values v join metrics_labels l"}},
+		{query: `rate(http_requests_total[5m])`, contains: []string{"generate_series(", "(max(v.value) - min(v.value)) / $", "'' as metric_name"}},
+		{query: `sum(up)`, contains: []string{"'{}'::jsonb as labels", "sum(g.value)"}},
+		{query: `sum by (job, __name__) (rate(errors_total{code=~"5.."}[1m]))`, contains: []string{"jsonb_build_object(", "nullif(g.metric_name, '')", "l.labels->>$"}},
+		{query: `(up)`, contains: []string{"last(v.value, v.time)"}},
+		{query: `avg(up)`, unsupported: true},
+		{query: `sum without (job) (up)`, unsupported: true},
+		{query: `irate(up[5m])`, unsupported: true},
+		{query: `up offset 5m`, unsupported: true},
+		{query: `rate(up[5m] @ 100)`, unsupported: true},
+		{query: `up + up`, unsupported: true},
+		{query: `1`, unsupported: true},
+	}
+	for _, c := range testCases {
+		t.Run(c.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(c.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := sqlArgs{}
+			query, err := client.exprToSQL(expr, time.Unix(0, 0), time.Unix(3600, 0), time.Minute, &args)
+			if c.unsupported {
+				if !errors.Is(err, ErrUnsupportedExpression) {
+					t.Errorf("Expected unsupported expression, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fragment := range c.contains {
+				if !strings.Contains(query, fragment) {
+					t.Errorf("Expected %q in %s", fragment, query)
+				}
+			}
+			used := map[string]bool{}
+			for _, m := range placeholder.FindAllStringSubmatch(query, -1) {
+				used[m[1]] = true
+			}
+			if len(used) != len(args) {
+				t.Errorf("Query uses %d of %d arguments: %s", len(used), len(args), query)
+			}
+		})
+	}
+}
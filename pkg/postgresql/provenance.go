@@ -0,0 +1,64 @@
+package pgprometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlProvenanceColumns = "alter table %s_labels add column if not exists first_seen timestamp with time zone, add column if not exists last_seen timestamp with time zone, add column if not exists written_by jsonb not null default '[]'::jsonb"
+	// the label sets of the staged samples are updated unless they were seen within the interval ($2 seconds)
+	// by a writer they list already ($1, a jsonb array of at most one source). Label sets another write holds
+	// are skipped rather than waited for, the next write of the series updates them.
+	sqlProvenanceUpdate = "with target as (select lbl.id from %s_labels lbl where exists (select 1 from %s sample where %s) and (lbl.last_seen is null or lbl.last_seen < now() - make_interval(secs => $2) or not lbl.written_by @> $1::jsonb) order by lbl.id for update of lbl skip locked) " +
+		"update %s_labels l set first_seen = coalesce(l.first_seen, now()), last_seen = now(), written_by = case when l.written_by @> $1::jsonb then l.written_by else l.written_by || $1::jsonb end from target where l.id = target.id"
+	sqlJsonbProvenanceMatch      = "lbl.metric_name = sample.metric_name and lbl.labels = sample.labels"
+	sqlNormalizedProvenanceMatch = "lbl.metric_name = sample.metric_name and lbl.fingerprint = sample.fingerprint"
+)
+
+type sourceKey struct{}
+
+// WithSource returns a context of which the writes are recorded as written by source with Provenance.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// writtenBy returns the jsonb array of the source of the writes of ctx, empty if it has none.
+func writtenBy(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	if source == "" {
+		return "[]"
+	}
+	array, _ := json.Marshal([]string{toValidUTF8(source)})
+	return string(array)
+}
+
+// ensureProvenance adds the provenance columns to the labels table.
+func (c *Client) ensureProvenance(ctx context.Context) error {
+	_, err := c.DB.ExecContext(ctx, fmt.Sprintf(sqlProvenanceColumns, c.cfg.Table))
+	if isUndefinedTable(err) {
+		return fmt.Errorf("provenance requires the labels table %s_labels to exist", c.cfg.Table)
+	}
+	if err != nil {
+		return fmt.Errorf("error adding the provenance columns: %w", err)
+	}
+	return nil
+}
+
+// updateProvenance records the label sets of the staged samples as seen now by the source of ctx, at most
+// once per ProvenanceInterval unless the source is new to a label set.
+func (c *Client) updateProvenance(ctx context.Context, w *writeSession) error {
+	t := c.cfg.Table
+	query := fmt.Sprintf(sqlProvenanceUpdate, t, w.staging, c.labels.provenanceMatch(), t)
+	return w.inTx(ctx, "provenance", func(ex execer) error {
+		if _, err := ex.ExecContext(ctx, query, writtenBy(ctx), c.cfg.ProvenanceInterval.Seconds()); err != nil {
+			log.Error("msg", "Error executing statement", "err", err, "desc", "provenance")
+			return err
+		}
+		return nil
+	})
+}
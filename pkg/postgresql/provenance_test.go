@@ -0,0 +1,131 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestWrittenBy(t *testing.T) {
+	for _, c := range []struct {
+		ctx  context.Context
+		want string
+	}{
+		{context.Background(), "[]"},
+		{WithSource(context.Background(), ""), "[]"},
+		{WithSource(context.Background(), "prom-a"), `["prom-a"]`},
+		{WithSource(context.Background(), "a\"b\xff"), `["a\"b` + "�" + `"]`},
+	} {
+		if got := writtenBy(c.ctx); got != c.want {
+			t.Errorf("Expected %s, got %s", c.want, got)
+		}
+	}
+}
+
+func TestNewClientProvenanceErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Provenance, cfg.LabelsReadOnly = true, true
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for provenance with read-only labels")
+	}
+	cfg = DefaultConfig()
+	cfg.Provenance, cfg.ProvenanceInterval = true, -time.Second
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for a negative provenance interval")
+	}
+	if _, err := parsePromotedLabels("written_by"); err == nil {
+		t.Error("Expected error for promoting a label named after a provenance column")
+	}
+}
+
+// TestProvenance writes a series from several sources in both label layouts, checking the provenance columns
+// and the throttling of last_seen. It needs a database, given as connection string in TS_PROM_TEST_PG_DSN.
+func TestProvenance(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, storage := range []string{labelStorageJsonb, labelStorageNormalized} {
+		t.Run(storage, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Table = "provenance_test_metrics"
+			cfg.LabelStorage = storage
+			cfg.CheckIndexes = false
+			cfg.Provenance = true
+			defer func() {
+				_, _ = db.Exec("drop view if exists provenance_test_metrics")
+				_, _ = db.Exec("drop table if exists provenance_test_metrics_values, provenance_test_metrics_label_kv, provenance_test_metrics_label_keys, provenance_test_metrics_labels")
+			}()
+			if storage == labelStorageJsonb {
+				for _, statement := range []string{
+					"create table provenance_test_metrics_labels (id serial primary key, metric_name text not null, labels jsonb not null, unique (metric_name, labels))",
+					"create table provenance_test_metrics_values (time timestamp with time zone not null, value double precision, labels_id integer references provenance_test_metrics_labels (id))",
+				} {
+					if _, err := db.Exec(statement); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			labels, err := newLabelStore(cfg.LabelStorage, cfg.Table, false, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &Client{DB: db, cfg: cfg, labels: labels, staging: stagingTable(cfg), stop: make(chan struct{})}
+			if err := client.EnsureSchema(); err != nil {
+				t.Fatal(err)
+			}
+
+			metric := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+			write := func(source string) {
+				t.Helper()
+				ctx := WithSource(context.Background(), source)
+				if _, err := client.WriteContext(ctx, model.Samples{{Metric: metric, Value: 1, Timestamp: model.Now()}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			type provenance struct {
+				firstSeen, lastSeen time.Time
+				writtenBy           string
+			}
+			read := func() provenance {
+				t.Helper()
+				var p provenance
+				err := db.QueryRow("select first_seen, last_seen, written_by::text from provenance_test_metrics_labels where metric_name = 'up'").Scan(&p.firstSeen, &p.lastSeen, &p.writtenBy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return p
+			}
+
+			write("prom-a")
+			first := read()
+			if !first.firstSeen.Equal(first.lastSeen) || first.writtenBy != `["prom-a"]` {
+				t.Fatalf("Unexpected provenance of a new series %+v", first)
+			}
+			write("prom-a")
+			write("")
+			if throttled := read(); throttled != first {
+				t.Errorf("Expected last_seen to be throttled, got %+v after %+v", throttled, first)
+			}
+			write("prom-b")
+			second := read()
+			if !second.firstSeen.Equal(first.firstSeen) || !second.lastSeen.After(first.lastSeen) || second.writtenBy != `["prom-a", "prom-b"]` {
+				t.Errorf("Expected a new source to be recorded right away, got %+v after %+v", second, first)
+			}
+			cfg.ProvenanceInterval = 0
+			write("prom-a")
+			if third := read(); !third.lastSeen.After(second.lastSeen) || third.writtenBy != second.writtenBy {
+				t.Errorf("Expected last_seen to be updated without interval, got %+v after %+v", third, second)
+			}
+		})
+	}
+}
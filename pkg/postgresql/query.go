@@ -0,0 +1,257 @@
+package pgprometheus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ErrTooManySeries is returned when a query matches more series than allowed.
+var ErrTooManySeries = errors.New("query matches too many series")
+
+// sqlArgs collects positional query arguments while SQL fragments are being generated.
+type sqlArgs []interface{}
+
+// add appends an argument and returns its placeholder.
+func (a *sqlArgs) add(value interface{}) string {
+	*a = append(*a, value)
+	return fmt.Sprintf("$%d", len(*a))
+}
+
+// matchersToSQL translates the matchers of a single series selector into a SQL condition over the
+// metric_name and labels columns of the relation aliased as alias. A missing label is treated like a
+// label with an empty value, as Prometheus does. All read paths go through this function so that
+// matchers behave identically everywhere.
+func matchersToSQL(alias string, matchers []*labels.Matcher, args *sqlArgs) (string, error) {
+	if len(matchers) == 0 {
+		return "true", nil
+	}
+	conditions := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Type == labels.MatchEqual && m.Name != model.MetricNameLabel && m.Value != "" {
+			// containment can use the GIN index on the labels column
+			containment, err := json.Marshal(map[string]string{m.Name: m.Value})
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, fmt.Sprintf("%s.labels @> %s::jsonb", alias, args.add(string(containment))))
+			continue
+		}
+		column := fmt.Sprintf("%s.metric_name", alias)
+		if m.Name != model.MetricNameLabel {
+			column = fmt.Sprintf("coalesce(%s.labels->>%s, '')", alias, args.add(m.Name))
+		}
+		switch m.Type {
+		case labels.MatchEqual:
+			conditions = append(conditions, fmt.Sprintf("%s = %s", column, args.add(m.Value)))
+		case labels.MatchNotEqual:
+			conditions = append(conditions, fmt.Sprintf("%s <> %s", column, args.add(m.Value)))
+		case labels.MatchRegexp:
+			conditions = append(conditions, fmt.Sprintf("%s ~ %s", column, args.add(anchorRegex(m.Value))))
+		case labels.MatchNotRegexp:
+			conditions = append(conditions, fmt.Sprintf("%s !~ %s", column, args.add(anchorRegex(m.Value))))
+		default:
+			return "", fmt.Errorf("unsupported matcher type %v", m.Type)
+		}
+	}
+	return strings.Join(conditions, " and "), nil
+}
+
+// selectorsToSQL combines several series selectors into a single condition matching any of them.
+func selectorsToSQL(alias string, selectors [][]*labels.Matcher, args *sqlArgs) (string, error) {
+	if len(selectors) == 0 {
+		return "true", nil
+	}
+	conditions := make([]string, 0, len(selectors))
+	for _, matchers := range selectors {
+		condition, err := matchersToSQL(alias, matchers, args)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, "("+condition+")")
+	}
+	return strings.Join(conditions, " or "), nil
+}
+
+// anchorRegex anchors a Prometheus regular expression, which always has to match the full value.
+func anchorRegex(re string) string {
+	return "^(?:" + re + ")$"
+}
+
+// seriesCondition returns the condition selecting series matching the selectors that have samples between
+// start and end. Zero times leave the respective bound open.
+func (c *Client) seriesCondition(alias string, selectors [][]*labels.Matcher, start, end time.Time, args *sqlArgs) (string, error) {
+	condition, err := selectorsToSQL(alias, selectors, args)
+	if err != nil {
+		return "", err
+	}
+	var bounds []string
+	if !start.IsZero() {
+		bounds = append(bounds, fmt.Sprintf("v.time >= %s", args.add(start)))
+	}
+	if !end.IsZero() {
+		bounds = append(bounds, fmt.Sprintf("v.time <= %s", args.add(end)))
+	}
+	if len(bounds) > 0 {
+		condition = fmt.Sprintf("(%s) and exists (select 1 from %s_values v where v.labels_id = %s.id and %s)",
+			condition, c.cfg.Table, alias, strings.Join(bounds, " and "))
+	}
+	return condition, nil
+}
+
+// LabelNames returns the sorted label names of the series matching any of the selectors, including
+// the metric name label.
+func (c *Client) LabelNames(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]string, error) {
+	args := sqlArgs{}
+	condition, err := c.seriesCondition("l", selectors, start, end, &args)
+	if err != nil {
+		return nil, err
+	}
+	relation := c.labels.labelsRelation()
+	query := fmt.Sprintf("select name from (select jsonb_object_keys(l.labels) as name from %s l where %s union select '%s' from %s l where %s) names order by name limit %s",
+		relation, condition, model.MetricNameLabel, relation, condition, args.add(limit))
+	return c.queryStrings(ctx, query, args)
+}
+
+// LabelValues returns the sorted values of the given label for the series matching any of the selectors.
+func (c *Client) LabelValues(ctx context.Context, name string, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]string, error) {
+	args := sqlArgs{}
+	condition, err := c.seriesCondition("l", selectors, start, end, &args)
+	if err != nil {
+		return nil, err
+	}
+	value := "l.metric_name"
+	if name != model.MetricNameLabel {
+		value = fmt.Sprintf("l.labels->>%s", args.add(name))
+	}
+	query := fmt.Sprintf("select distinct %s as value from %s l where %s is not null and %s order by value limit %s",
+		value, c.labels.labelsRelation(), value, condition, args.add(limit))
+	return c.queryStrings(ctx, query, args)
+}
+
+// Series returns the label sets, including the metric name, of the series matching any of the selectors.
+// ErrTooManySeries is returned if more than limit series match.
+func (c *Client) Series(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time, limit int) ([]model.Metric, error) {
+	args := sqlArgs{}
+	condition, err := c.seriesCondition("l", selectors, start, end, &args)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("select l.metric_name, l.labels from %s l where %s limit %s",
+		c.labels.labelsRelation(), condition, args.add(limit+1))
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	result := []model.Metric{}
+	for rows.Next() {
+		if len(result) == limit {
+			return nil, ErrTooManySeries
+		}
+		var metricName string
+		var labelsJson []byte
+		if err := rows.Scan(&metricName, &labelsJson); err != nil {
+			return nil, err
+		}
+		metric := model.Metric{}
+		if err := json.Unmarshal(labelsJson, &metric); err != nil {
+			return nil, fmt.Errorf("error decoding labels of series %s: %w", metricName, err)
+		}
+		if metricName != "" {
+			metric[model.MetricNameLabel] = model.LabelValue(metricName)
+		}
+		result = append(result, metric)
+	}
+	return result, rows.Err()
+}
+
+// CountSamples returns the number of samples between start and end of the series matching any of the
+// selectors. Zero times leave the respective bound open.
+func (c *Client) CountSamples(ctx context.Context, selectors [][]*labels.Matcher, start, end time.Time) (int64, error) {
+	args := sqlArgs{}
+	condition, err := selectorsToSQL("l", selectors, &args)
+	if err != nil {
+		return 0, err
+	}
+	condition = "(" + condition + ")"
+	if !start.IsZero() {
+		condition += fmt.Sprintf(" and v.time >= %s", args.add(start))
+	}
+	if !end.IsZero() {
+		condition += fmt.Sprintf(" and v.time <= %s", args.add(end))
+	}
+	query := fmt.Sprintf("select count(*) from %s_values v join %s l on l.id = v.labels_id where %s",
+		c.cfg.Table, c.labels.labelsRelation(), condition)
+	var count int64
+	err = c.DB.QueryRowContext(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
+// LatestSamples returns the latest sample since the given time of each series matching any of the selectors,
+// in a single query. ErrTooManySeries is returned if more than limit series match.
+func (c *Client) LatestSamples(ctx context.Context, selectors [][]*labels.Matcher, since time.Time, limit int) (model.Vector, error) {
+	args := sqlArgs{}
+	condition, err := selectorsToSQL("l", selectors, &args)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("select distinct on (v.labels_id) l.metric_name, l.labels, v.time, v.value from %s_values v join %s l on l.id = v.labels_id where (%s) and v.time >= %s order by v.labels_id, v.time desc limit %s",
+		c.cfg.Table, c.labels.labelsRelation(), condition, args.add(since), args.add(limit+1))
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	result := model.Vector{}
+	for rows.Next() {
+		if len(result) == limit {
+			return nil, ErrTooManySeries
+		}
+		var metricName string
+		var labelsJson []byte
+		var t time.Time
+		var value float64
+		if err := rows.Scan(&metricName, &labelsJson, &t, &value); err != nil {
+			return nil, err
+		}
+		metric := model.Metric{}
+		if err := json.Unmarshal(labelsJson, &metric); err != nil {
+			return nil, fmt.Errorf("error decoding labels of series %s: %w", metricName, err)
+		}
+		if metricName != "" {
+			metric[model.MetricNameLabel] = model.LabelValue(metricName)
+		}
+		result = append(result, &model.Sample{Metric: metric, Value: model.SampleValue(value), Timestamp: model.TimeFromUnixNano(t.UnixNano())})
+	}
+	return result, rows.Err()
+}
+
+func (c *Client) queryStrings(ctx context.Context, query string, args sqlArgs) ([]string, error) {
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	result := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	return result, rows.Err()
+}
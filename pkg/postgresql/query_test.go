@@ -0,0 +1,119 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestMatchersToSQL(t *testing.T) {
+	testCases := []struct {
+		name      string
+		matchers  []*labels.Matcher
+		condition string
+		args      sqlArgs
+	}{
+		{
+			name:      "empty",
+			condition: "true",
+		},
+		{
+			name:      "metric name",
+			matchers:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")},
+			condition: "l.metric_name = $1",
+			args:      sqlArgs{"up"},
+		},
+		{
+			name:      "label equality uses containment",
+			matchers:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", `no"de`)},
+			condition: "l.labels @> $1::jsonb",
+			args:      sqlArgs{`{"job":"no\"de"}`},
+		},
+		{
+			name:      "empty equality matches missing label",
+			matchers:  []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "")},
+			condition: "coalesce(l.labels->>$1, '') = $2",
+			args:      sqlArgs{"job", ""},
+		},
+		{
+			name: "regex and negations",
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchRegexp, "__name__", "node_.*"),
+				labels.MustNewMatcher(labels.MatchNotEqual, "mode", "idle"),
+				labels.MustNewMatcher(labels.MatchNotRegexp, "cpu", "1|2"),
+			},
+			condition: "l.metric_name ~ $1 and coalesce(l.labels->>$2, '') <> $3 and coalesce(l.labels->>$4, '') !~ $5",
+			args:      sqlArgs{"^(?:node_.*)$", "mode", "idle", "cpu", "^(?:1|2)$"},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			args := sqlArgs{}
+			condition, err := matchersToSQL("l", c.matchers, &args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if condition != c.condition {
+				t.Errorf("Expected condition %q, got %q", c.condition, condition)
+			}
+			if len(args) != len(c.args) || (len(args) > 0 && !reflect.DeepEqual(args, c.args)) {
+				t.Errorf("Expected args %v, got %v", c.args, args)
+			}
+		})
+	}
+}
+
+func TestSelectorsToSQL(t *testing.T) {
+	args := sqlArgs{}
+	condition, err := selectorsToSQL("l", [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "up")},
+		{labels.MustNewMatcher(labels.MatchEqual, "__name__", "down")},
+	}, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "(l.metric_name = $1) or (l.metric_name = $2)"; condition != expected {
+		t.Errorf("Expected condition %q, got %q", expected, condition)
+	}
+}
+
+func TestLatestSamples(t *testing.T) {
+	at := time.Unix(1700000000, 0).UTC()
+	db := &recordingDB{rows: map[string][][]driver.Value{"select distinct on (v.labels_id)": {
+		{"up", []byte(`{"job":"node"}`), at, 1.0},
+		{"up", []byte(`{"job":"api"}`), at.Add(-time.Second), 0.0},
+	}}}
+	client := &Client{DB: sql.OpenDB(db), cfg: &Config{Table: "metrics"}, labels: &jsonbLabelStore{table: "metrics"}}
+	defer client.Close()
+	selectors := [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "up")}}
+
+	samples, err := client.LatestSamples(context.Background(), selectors, at.Add(-5*time.Minute), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := model.Vector{
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node"}, Value: 1, Timestamp: model.TimeFromUnixNano(at.UnixNano())},
+		{Metric: model.Metric{model.MetricNameLabel: "up", "job": "api"}, Value: 0, Timestamp: model.TimeFromUnixNano(at.Add(-time.Second).UnixNano())},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Expected %v, got %v", expected, samples)
+	}
+	query := db.recorded()[0]
+	for _, fragment := range []string{"from metrics_values v join metrics_labels l on l.id = v.labels_id", "where ((l.metric_name = $1)) and v.time >= $2", "order by v.labels_id, v.time desc limit $3"} {
+		if !strings.Contains(query, fragment) {
+			t.Errorf("Expected the query to contain %q, got %s", fragment, query)
+		}
+	}
+
+	if _, err := client.LatestSamples(context.Background(), selectors, at.Add(-5*time.Minute), 1); !errors.Is(err, ErrTooManySeries) {
+		t.Errorf("Expected too many series, got %v", err)
+	}
+}
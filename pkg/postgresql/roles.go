@@ -0,0 +1,148 @@
+package pgprometheus
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RolesConfig describes the least-privilege roles of an adapter deployment.
+type RolesConfig struct {
+	// Database and Schema hold the tables, Schema is created if needed and made the search_path of the roles.
+	Database string
+	Schema   string
+	// Role is the login role of the adapter, Password its password, left unchanged if empty.
+	Role     string
+	Password string
+	// ReadOnlyRole is an optional login role of query clients such as Grafana, with ReadOnlyPassword.
+	ReadOnlyRole     string
+	ReadOnlyPassword string
+	// CreateObjects grants CREATE on the schema to the adapter role, for configurations creating tables at
+	// runtime, such as the unlogged staging tables.
+	CreateObjects bool
+}
+
+// RolesStatement is a statement setting up roles. Display is its text with the passwords redacted.
+type RolesStatement struct {
+	SQL     string
+	Display string
+}
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlRolesCreateSchema  = "create schema if not exists %s"
+	sqlRolesCreateRole    = "do $$ begin if not exists (select 1 from pg_roles where rolname = %s) then create role %s login; end if; end $$"
+	sqlRolesPassword      = "alter role %s password %s"
+	sqlRolesSearchPath    = "alter role %s in database %s set search_path = %s"
+	sqlRolesSchemaUsage   = "grant usage on schema %s to %s"
+	sqlRolesSchemaCreate  = "grant create on schema %s to %s"
+	sqlRolesTemp          = "grant connect, temporary on database %s to %s"
+	sqlRolesConnect       = "grant connect on database %s to %s"
+	sqlRolesWriteTables   = "grant select, insert, delete on all tables in schema %s to %s"
+	sqlRolesReadTables    = "grant select on all tables in schema %s to %s"
+	sqlRolesSequences     = "grant usage, select on all sequences in schema %s to %s"
+	sqlRolesDefaultWrite  = "alter default privileges in schema %s grant select, insert, delete on tables to %s"
+	sqlRolesDefaultRead   = "alter default privileges in schema %s grant select on tables to %s"
+	sqlRolesDefaultSeqs   = "alter default privileges in schema %s grant usage, select on sequences to %s"
+	sqlRolesTimescaleFunc = "do $$ declare s text; begin select n.nspname into s from pg_extension e join pg_namespace n on n.oid = e.extnamespace where e.extname = 'timescaledb'; " +
+		"if s is not null then execute format('grant usage on schema %%I to %%I', s, %s); " +
+		"execute format('grant execute on function %%I.hypertable_size(regclass), %%I.hypertable_detailed_size(regclass), %%I.approximate_row_count(regclass) to %%I', s, s, s, %s); end if; end $$"
+)
+
+// RolesSetup returns the statements creating the schema and the roles, which run before the tables are
+// created. They are idempotent.
+func RolesSetup(cfg *RolesConfig) []RolesStatement {
+	schema := pgx.Identifier{cfg.Schema}.Sanitize()
+	database := pgx.Identifier{cfg.Database}.Sanitize()
+	statements := []RolesStatement{plainStatement(fmt.Sprintf(sqlRolesCreateSchema, schema))}
+	for _, r := range []struct{ name, password string }{{cfg.Role, cfg.Password}, {cfg.ReadOnlyRole, cfg.ReadOnlyPassword}} {
+		if r.name == "" {
+			continue
+		}
+		role := pgx.Identifier{r.name}.Sanitize()
+		statements = append(statements, plainStatement(fmt.Sprintf(sqlRolesCreateRole, quoteLiteral(r.name), role)))
+		if r.password != "" {
+			statements = append(statements, RolesStatement{
+				SQL:     fmt.Sprintf(sqlRolesPassword, role, quoteLiteral(r.password)),
+				Display: fmt.Sprintf(sqlRolesPassword, role, "'<redacted>'"),
+			})
+		}
+		statements = append(statements, plainStatement(fmt.Sprintf(sqlRolesSearchPath, role, database, schema)))
+	}
+	return statements
+}
+
+// RolesGrants returns the statements granting the roles their privileges on the tables of the schema,
+// which run once the tables exist. The adapter role may use temp tables, and select, insert and delete
+// in the tables, delete being needed by the self-test and the admin API; the TimescaleDB size functions of
+// the statistics are granted explicitly in case they were revoked from public. The read-only role may
+// select only. Tables created later in the schema by the role running them get the same privileges.
+func RolesGrants(cfg *RolesConfig) []RolesStatement {
+	schema := pgx.Identifier{cfg.Schema}.Sanitize()
+	database := pgx.Identifier{cfg.Database}.Sanitize()
+	role := pgx.Identifier{cfg.Role}.Sanitize()
+	statements := []RolesStatement{
+		plainStatement(fmt.Sprintf(sqlRolesTemp, database, role)),
+		plainStatement(fmt.Sprintf(sqlRolesSchemaUsage, schema, role)),
+	}
+	if cfg.CreateObjects {
+		statements = append(statements, plainStatement(fmt.Sprintf(sqlRolesSchemaCreate, schema, role)))
+	}
+	statements = append(statements,
+		plainStatement(fmt.Sprintf(sqlRolesWriteTables, schema, role)),
+		plainStatement(fmt.Sprintf(sqlRolesSequences, schema, role)),
+		plainStatement(fmt.Sprintf(sqlRolesDefaultWrite, schema, role)),
+		plainStatement(fmt.Sprintf(sqlRolesDefaultSeqs, schema, role)),
+		plainStatement(fmt.Sprintf(sqlRolesTimescaleFunc, quoteLiteral(cfg.Role), quoteLiteral(cfg.Role))),
+	)
+	if cfg.ReadOnlyRole != "" {
+		readOnly := pgx.Identifier{cfg.ReadOnlyRole}.Sanitize()
+		statements = append(statements,
+			plainStatement(fmt.Sprintf(sqlRolesConnect, database, readOnly)),
+			plainStatement(fmt.Sprintf(sqlRolesSchemaUsage, schema, readOnly)),
+			plainStatement(fmt.Sprintf(sqlRolesReadTables, schema, readOnly)),
+			plainStatement(fmt.Sprintf(sqlRolesDefaultRead, schema, readOnly)),
+		)
+	}
+	return statements
+}
+
+func plainStatement(sql string) RolesStatement {
+	return RolesStatement{SQL: sql, Display: sql}
+}
+
+// validateRoleName rejects role names postgres would truncate or that are reserved.
+func validateRoleName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("the role name is empty")
+	case len(name) > 63:
+		return fmt.Errorf("role name %q is longer than 63 bytes", name)
+	case strings.HasPrefix(name, "pg_") || name == "public":
+		return fmt.Errorf("role name %q is reserved", name)
+	case strings.Contains(name, "$"):
+		// the name is quoted inside dollar-quoted blocks
+		return fmt.Errorf("role name %q contains a $", name)
+	}
+	return nil
+}
+
+// Validate checks the names of the roles and the schema.
+func (cfg *RolesConfig) Validate() error {
+	if cfg.Schema == "" || cfg.Database == "" {
+		return fmt.Errorf("the schema and the database must be set")
+	}
+	if err := validateRoleName(cfg.Role); err != nil {
+		return err
+	}
+	if cfg.ReadOnlyRole != "" {
+		if err := validateRoleName(cfg.ReadOnlyRole); err != nil {
+			return err
+		}
+		if cfg.ReadOnlyRole == cfg.Role {
+			return fmt.Errorf("the read-only role must differ from the adapter role")
+		}
+	}
+	return nil
+}
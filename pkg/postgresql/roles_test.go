@@ -0,0 +1,73 @@
+package pgprometheus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRolesStatements(t *testing.T) {
+	cfg := &RolesConfig{Database: "prom", Schema: "metrics", Role: "adapter", Password: "it's secret", ReadOnlyRole: "grafana"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var setup, grants []string
+	for _, s := range RolesSetup(cfg) {
+		if strings.Contains(s.Display, "secret") {
+			t.Errorf("Expected the password to be redacted, got %q", s.Display)
+		}
+		setup = append(setup, s.SQL)
+	}
+	for _, s := range RolesGrants(cfg) {
+		grants = append(grants, s.SQL)
+	}
+	all := strings.Join(append(setup, grants...), "\n")
+	for _, expected := range []string{
+		`create schema if not exists "metrics"`,
+		`then create role "adapter" login;`,
+		`alter role "adapter" password 'it''s secret'`,
+		`alter role "grafana" in database "prom" set search_path = "metrics"`,
+		`grant connect, temporary on database "prom" to "adapter"`,
+		`grant select, insert, delete on all tables in schema "metrics" to "adapter"`,
+		`grant usage, select on all sequences in schema "metrics" to "adapter"`,
+		`grant execute on function %I.hypertable_size(regclass)`,
+		`grant select on all tables in schema "metrics" to "grafana"`,
+		`alter default privileges in schema "metrics" grant select on tables to "grafana"`,
+	} {
+		if !strings.Contains(all, expected) {
+			t.Errorf("Expected the statements to contain %q, got\n%s", expected, all)
+		}
+	}
+	for _, unexpected := range []string{`grant create on schema`, `alter role "grafana" password`, `insert on all tables in schema "metrics" to "grafana"`} {
+		if strings.Contains(all, unexpected) {
+			t.Errorf("Expected the statements not to contain %q, got\n%s", unexpected, all)
+		}
+	}
+
+	cfg.CreateObjects = true
+	cfg.ReadOnlyRole = ""
+	grants = grants[:0]
+	for _, s := range RolesGrants(cfg) {
+		grants = append(grants, s.SQL)
+		if strings.Contains(s.SQL, "grafana") {
+			t.Errorf("Expected no statement for the read-only role, got %q", s.SQL)
+		}
+	}
+	if all := strings.Join(grants, "\n"); !strings.Contains(all, `grant create on schema "metrics" to "adapter"`) {
+		t.Errorf("Expected CREATE to be granted on the schema, got\n%s", all)
+	}
+}
+
+func TestRolesConfigValidate(t *testing.T) {
+	for _, cfg := range []RolesConfig{
+		{Database: "prom", Schema: "public"},
+		{Database: "prom", Schema: "public", Role: "pg_adapter"},
+		{Database: "prom", Schema: "public", Role: "adapter$$"},
+		{Database: "prom", Schema: "public", Role: strings.Repeat("a", 64)},
+		{Database: "prom", Schema: "public", Role: "adapter", ReadOnlyRole: "adapter"},
+		{Database: "prom", Role: "adapter"},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package pgprometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const (
+	sampleLogStdout        = "-"
+	sampleLogFlushInterval = time.Second
+)
+
+// sampleLog writes the raw sample lines of -pg-prometheus-log-samples to stdout or to a file rotated by size.
+// It is safe for concurrent use; the lines of a write are kept together. If the file can't be written, the
+// log disables itself instead of failing writes.
+type sampleLog struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mutex    sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	disabled bool
+}
+
+// newSampleLog opens the sample log at path, "-" meaning stdout. Files are rotated once they reach maxSize
+// bytes (0 means never), keeping the given number of rotated files as path.1, path.2 and so on.
+func newSampleLog(path string, maxSize int64, keep int) (*sampleLog, error) {
+	l := &sampleLog{path: path, maxSize: maxSize, keep: keep}
+	if path == sampleLogStdout {
+		l.writer = bufio.NewWriter(os.Stdout)
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *sampleLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.writer, l.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// write appends the lines of a write.
+func (l *sampleLog) write(lines []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.disabled {
+		return
+	}
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(lines)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.disable(err)
+			return
+		}
+	}
+	n, err := l.writer.Write(lines)
+	l.size += int64(n)
+	if err != nil {
+		l.disable(err)
+	}
+}
+
+// rotate moves the current file to path.1, shifting the older files, and starts a new one. The caller must
+// hold the mutex.
+func (l *sampleLog) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	if l.keep <= 0 {
+		if err := os.Remove(l.path); err != nil {
+			return err
+		}
+		return l.open()
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// disable stops logging samples after an error. The caller must hold the mutex.
+func (l *sampleLog) disable(err error) {
+	log.Error("msg", "Error writing the sample log, logging samples is disabled", "path", l.path, "err", err)
+	l.disabled = true
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *sampleLog) flush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.disabled {
+		return
+	}
+	if err := l.writer.Flush(); err != nil {
+		l.disable(err)
+	}
+}
+
+// run flushes the buffered lines every interval until stop is closed, then closes the file.
+func (l *sampleLog) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-stop:
+			l.close()
+			return
+		}
+	}
+}
+
+func (l *sampleLog) close() {
+	l.flush()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+	l.disabled = true
+}
+
+// appendSampleLine appends the line logged for a sample: the time, in RFC 3339 and in epoch milliseconds,
+// the value, the metric name and the labels.
+func appendSampleLine(w io.Writer, timestamp time.Time, millis int64, value model.SampleValue, metricName, labelsJson string) {
+	// epoch milliseconds next to the readable time, to diff against the sent samples
+	_, _ = fmt.Fprintf(w, "%v\t%d\t%v\t%v\t%v\n", timestamp.Format(time.RFC3339), millis, value, metricName, labelsJson)
+}
@@ -0,0 +1,86 @@
+package pgprometheus
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSampleLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.log")
+	l, err := newSampleLog(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 10; i++ {
+		l.write(line)
+	}
+	l.close()
+
+	// 40 byte lines, two per 100 byte file
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, bytes.Repeat(line, 2)) {
+			t.Errorf("Expected %s to contain two lines, got %q", name, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files to be kept, got %v", err)
+	}
+}
+
+func TestSampleLogConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "samples.log")
+	l, err := newSampleLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var lines bytes.Buffer
+			for j := 0; j < 100; j++ {
+				appendSampleLine(&lines, time.UnixMilli(1700000000123).UTC(), 1700000000123, 1, "up", `{"writer": "`+string(rune('a'+i))+`"}`)
+			}
+			l.write(lines.Bytes())
+		}(i)
+	}
+	wg.Wait()
+	l.close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 1000 {
+		t.Fatalf("Expected 1000 lines, got %d", len(lines))
+	}
+	if lines[0][:len(lines[0])-3] != "2023-11-14T22:13:20Z\t1700000000123\t1\tup\t{\"writer\": \"" {
+		t.Errorf("Unexpected line %q", lines[0])
+	}
+	// the lines of a write stay together
+	for i := 0; i < len(lines); i += 100 {
+		for _, line := range lines[i : i+100] {
+			if line != lines[i] {
+				t.Fatalf("Expected the lines of a write to stay together, got %q after %q", line, lines[i])
+			}
+		}
+	}
+}
+
+func TestSampleLogOpenError(t *testing.T) {
+	if _, err := newSampleLog(filepath.Join(t.TempDir(), "missing", "samples.log"), 0, 0); err == nil {
+		t.Error("Expected opening a file in a missing directory to fail")
+	}
+}
@@ -0,0 +1,206 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The table layouts the schema probe tells apart.
+const (
+	// SchemaLayoutNone is reported when none of the tables exist yet.
+	SchemaLayoutNone = "none"
+	// SchemaLayoutJsonb has the label sets as jsonb documents in the labels table.
+	SchemaLayoutJsonb = "jsonb"
+	// SchemaLayoutNormalized has the label sets split into the label keys and label key/value tables.
+	SchemaLayoutNormalized = "normalized"
+	// SchemaLayoutPgPrometheusNormalized is the normalized layout of the pg_prometheus extension, with the
+	// same tables as the jsonb layout and a view of prom_sample values.
+	SchemaLayoutPgPrometheusNormalized = "pg_prometheus_normalized"
+	// SchemaLayoutPgPrometheusRaw is the raw layout of the pg_prometheus extension, a single table of
+	// prom_sample values.
+	SchemaLayoutPgPrometheusRaw = "pg_prometheus_raw"
+	// SchemaLayoutUnknown is reported for tables matching none of the layouts.
+	SchemaLayoutUnknown = "unknown"
+)
+
+// SchemaLayout is set to 1 for the layout of the tables detected at startup.
+var SchemaLayout = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "schema_layout_info",
+		Help: "Layout of the tables detected at startup, by layout.",
+	},
+	[]string{"layout"},
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlSchemaColumns      = "select a.attname, format_type(a.atttypid, a.atttypmod) from pg_attribute a where a.attrelid = to_regclass($1) and a.attnum > 0 and not a.attisdropped"
+	sqlSchemaRelkind      = "select coalesce((select relkind::text from pg_class where oid = to_regclass($1)), '')"
+	sqlSchemaPgPrometheus = "select exists (select 1 from pg_extension where extname = 'pg_prometheus')"
+)
+
+// schemaProbe holds what the probe found of the tables: the columns of each relation by name with their
+// types, nil for relations that don't exist.
+type schemaProbe struct {
+	table             string
+	main              map[string]string
+	labels            map[string]string
+	values            map[string]string
+	labelKv           bool
+	valuesPartitioned bool
+	pgPrometheus      bool
+}
+
+// probeSchema looks up the columns of the relations of table.
+func probeSchema(ctx context.Context, db *sql.DB, table string) (schemaProbe, error) {
+	p := schemaProbe{table: table}
+	for _, r := range []struct {
+		name    string
+		columns *map[string]string
+	}{{table, &p.main}, {table + "_labels", &p.labels}, {table + "_values", &p.values}} {
+		columns, err := relationColumns(ctx, db, r.name)
+		if err != nil {
+			return p, fmt.Errorf("error probing the columns of %s: %w", r.name, err)
+		}
+		*r.columns = columns
+	}
+	var kind string
+	if err := db.QueryRowContext(ctx, sqlSchemaRelkind, table+"_label_kv").Scan(&kind); err != nil {
+		return p, fmt.Errorf("error probing %s_label_kv: %w", table, err)
+	}
+	p.labelKv = kind != ""
+	if err := db.QueryRowContext(ctx, sqlSchemaRelkind, table+"_values").Scan(&kind); err != nil {
+		return p, fmt.Errorf("error probing %s_values: %w", table, err)
+	}
+	p.valuesPartitioned = kind == "p"
+	if err := db.QueryRowContext(ctx, sqlSchemaPgPrometheus).Scan(&p.pgPrometheus); err != nil {
+		return p, fmt.Errorf("error looking up the pg_prometheus extension: %w", err)
+	}
+	return p, nil
+}
+
+// relationColumns returns the types of the columns of a relation by name, or nil if it doesn't exist.
+func relationColumns(ctx context.Context, db *sql.DB, relation string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, sqlSchemaColumns, relation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns map[string]string
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		if columns == nil {
+			columns = map[string]string{}
+		}
+		columns[name] = dataType
+	}
+	return columns, rows.Err()
+}
+
+// layout returns the layout of the probed tables, and for SchemaLayoutUnknown what doesn't match.
+func (p schemaProbe) layout() (string, []string) {
+	hasPromSample := false
+	for _, dataType := range p.main {
+		if dataType == "prom_sample" {
+			hasPromSample = true
+		}
+	}
+	if p.labels == nil && p.values == nil {
+		switch {
+		case hasPromSample:
+			return SchemaLayoutPgPrometheusRaw, nil
+		case p.main != nil:
+			return SchemaLayoutUnknown, []string{fmt.Sprintf("%s exists without %s_labels and %s_values", p.table, p.table, p.table)}
+		}
+		return SchemaLayoutNone, nil
+	}
+	if p.labels == nil {
+		return SchemaLayoutUnknown, []string{fmt.Sprintf("%s_values exists without %s_labels", p.table, p.table)}
+	}
+
+	layout := SchemaLayoutJsonb
+	required := map[string][]string{"id": {"integer", "bigint"}, "metric_name": {"text"}}
+	if _, ok := p.labels["labels"]; ok {
+		required["labels"] = []string{"jsonb"}
+		if hasPromSample || p.pgPrometheus {
+			layout = SchemaLayoutPgPrometheusNormalized
+		}
+	} else {
+		layout = SchemaLayoutNormalized
+		required["fingerprint"] = []string{"bigint"}
+	}
+	mismatches := columnMismatches(p.table+"_labels", p.labels, required)
+	if layout == SchemaLayoutNormalized && !p.labelKv {
+		mismatches = append(mismatches, fmt.Sprintf("%s_labels has no labels column, but %s_label_kv doesn't exist", p.table, p.table))
+	}
+	if p.values != nil {
+		// the type of the time column is checked on its own, with the statement converting it
+		mismatches = append(mismatches, columnMismatches(p.table+"_values", p.values, map[string][]string{
+			"time":      nil,
+			"value":     {"double precision"},
+			"labels_id": {"integer", "bigint"},
+		})...)
+	}
+	if len(mismatches) > 0 {
+		return SchemaLayoutUnknown, mismatches
+	}
+	return layout, nil
+}
+
+// columnMismatches lists the required columns missing from a relation or of another type, nil types
+// accepting any type.
+func columnMismatches(relation string, columns map[string]string, required map[string][]string) []string {
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var mismatches []string
+	for _, name := range names {
+		dataType, ok := columns[name]
+		types := required[name]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s has no %s column", relation, name))
+		case types != nil && !slices.Contains(types, dataType):
+			mismatches = append(mismatches, fmt.Sprintf("the %s column of %s is a %s, expected %s", name, relation, dataType, strings.Join(types, " or ")))
+		}
+	}
+	return mismatches
+}
+
+// checkSchemaLayout makes sure the adapter can write to the tables with its configuration, returning an
+// error naming the mismatch otherwise.
+func (c *Client) checkSchemaLayout(p schemaProbe) error {
+	layout, mismatches := p.layout()
+	t := c.cfg.Table
+	switch layout {
+	case SchemaLayoutNone:
+		return nil
+	case SchemaLayoutPgPrometheusRaw:
+		return fmt.Errorf("%s holds prom_sample values of the pg_prometheus raw layout, which the adapter can't write to; use another table or migrate the samples to the %q label storage", t, labelStorageJsonb)
+	case SchemaLayoutUnknown:
+		return fmt.Errorf("the tables of %s match no layout the adapter supports: %s", t, strings.Join(mismatches, "; "))
+	case SchemaLayoutJsonb, SchemaLayoutPgPrometheusNormalized:
+		if c.cfg.LabelStorage != labelStorageJsonb {
+			return fmt.Errorf("the tables of %s have the %s layout, which requires the %q label storage, not %q", t, layout, labelStorageJsonb, c.cfg.LabelStorage)
+		}
+	case SchemaLayoutNormalized:
+		if c.cfg.LabelStorage != labelStorageNormalized {
+			return fmt.Errorf("the tables of %s have the %s layout, which requires the %q label storage, not %q", t, layout, labelStorageNormalized, c.cfg.LabelStorage)
+		}
+		if p.values != nil && p.valuesPartitioned != c.cfg.PartitionByMetric {
+			return fmt.Errorf("%s_values is partitioned by metric: %v, but partitioning by metric is configured: %v", t, p.valuesPartitioned, c.cfg.PartitionByMetric)
+		}
+	}
+	return nil
+}
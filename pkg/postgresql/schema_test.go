@@ -0,0 +1,97 @@
+package pgprometheus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemaLayout(t *testing.T) {
+	jsonbLabels := map[string]string{"id": "integer", "metric_name": "text", "labels": "jsonb"}
+	normalizedLabels := map[string]string{"id": "integer", "metric_name": "text", "fingerprint": "bigint"}
+	values := map[string]string{"time": "timestamp with time zone", "value": "double precision", "labels_id": "integer"}
+	for _, c := range []struct {
+		name     string
+		probe    schemaProbe
+		layout   string
+		mismatch string
+	}{
+		{name: "empty", probe: schemaProbe{}, layout: SchemaLayoutNone},
+		{name: "jsonb", probe: schemaProbe{labels: jsonbLabels, values: values}, layout: SchemaLayoutJsonb},
+		{name: "jsonb without values", probe: schemaProbe{labels: jsonbLabels}, layout: SchemaLayoutJsonb},
+		{name: "normalized", probe: schemaProbe{main: map[string]string{"labels": "jsonb"}, labels: normalizedLabels, values: values, labelKv: true}, layout: SchemaLayoutNormalized},
+		{
+			name:   "pg_prometheus normalized",
+			probe:  schemaProbe{main: map[string]string{"sample": "prom_sample", "labels": "jsonb"}, labels: jsonbLabels, values: values},
+			layout: SchemaLayoutPgPrometheusNormalized,
+		},
+		{name: "pg_prometheus extension", probe: schemaProbe{labels: jsonbLabels, values: values, pgPrometheus: true}, layout: SchemaLayoutPgPrometheusNormalized},
+		{name: "pg_prometheus raw", probe: schemaProbe{main: map[string]string{"sample": "prom_sample"}}, layout: SchemaLayoutPgPrometheusRaw},
+		{name: "other table", probe: schemaProbe{main: map[string]string{"id": "integer"}}, layout: SchemaLayoutUnknown, mismatch: "metrics exists without"},
+		{name: "values only", probe: schemaProbe{values: values}, layout: SchemaLayoutUnknown, mismatch: "metrics_values exists without metrics_labels"},
+		{name: "normalized without kv", probe: schemaProbe{labels: normalizedLabels, values: values}, layout: SchemaLayoutUnknown, mismatch: "metrics_label_kv doesn't exist"},
+		{
+			name:     "labels of another type",
+			probe:    schemaProbe{labels: map[string]string{"id": "integer", "metric_name": "text", "labels": "json"}, values: values},
+			layout:   SchemaLayoutUnknown,
+			mismatch: "the labels column of metrics_labels is a json, expected jsonb",
+		},
+		{
+			name:     "values without labels_id",
+			probe:    schemaProbe{labels: jsonbLabels, values: map[string]string{"time": "timestamp without time zone", "value": "double precision"}},
+			layout:   SchemaLayoutUnknown,
+			mismatch: "metrics_values has no labels_id column",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.probe.table = "metrics"
+			layout, mismatches := c.probe.layout()
+			if layout != c.layout {
+				t.Errorf("Expected layout %s, got %s (%v)", c.layout, layout, mismatches)
+			}
+			if joined := strings.Join(mismatches, "; "); !strings.Contains(joined, c.mismatch) || (c.mismatch == "") != (joined == "") {
+				t.Errorf("Expected mismatch %q, got %q", c.mismatch, joined)
+			}
+		})
+	}
+}
+
+func TestCheckSchemaLayout(t *testing.T) {
+	jsonbLabels := map[string]string{"id": "integer", "metric_name": "text", "labels": "jsonb"}
+	normalized := schemaProbe{
+		labels:            map[string]string{"id": "integer", "metric_name": "text", "fingerprint": "bigint"},
+		values:            map[string]string{"time": "timestamp with time zone", "value": "double precision", "labels_id": "integer", "metric_name": "text"},
+		labelKv:           true,
+		valuesPartitioned: true,
+	}
+	for _, c := range []struct {
+		name              string
+		probe             schemaProbe
+		storage           string
+		partitionByMetric bool
+		err               string
+	}{
+		{name: "empty", probe: schemaProbe{}, storage: labelStorageNormalized},
+		{name: "pg_prometheus normalized with jsonb", probe: schemaProbe{labels: jsonbLabels, pgPrometheus: true}, storage: labelStorageJsonb},
+		{name: "jsonb with normalized", probe: schemaProbe{labels: jsonbLabels}, storage: labelStorageNormalized, err: `the jsonb layout, which requires the "jsonb" label storage`},
+		{name: "normalized with jsonb", probe: normalized, storage: labelStorageJsonb, partitionByMetric: true, err: `requires the "normalized" label storage`},
+		{name: "partitioned", probe: normalized, storage: labelStorageNormalized, partitionByMetric: true},
+		{name: "partitioned not configured", probe: normalized, storage: labelStorageNormalized, err: "metrics_values is partitioned by metric: true"},
+		{name: "raw", probe: schemaProbe{main: map[string]string{"sample": "prom_sample"}}, storage: labelStorageJsonb, err: "pg_prometheus raw layout"},
+		{name: "unknown", probe: schemaProbe{labels: map[string]string{"id": "integer"}}, storage: labelStorageJsonb, err: "match no layout the adapter supports: metrics_labels has no fingerprint column"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Table = "metrics"
+			cfg.LabelStorage = c.storage
+			cfg.PartitionByMetric = c.partitionByMetric
+			c.probe.table = cfg.Table
+			err := (&Client{cfg: cfg}).checkSchemaLayout(c.probe)
+			switch {
+			case c.err == "" && err != nil:
+				t.Errorf("Expected no error, got %v", err)
+			case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+				t.Errorf("Expected error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// SelfTestMetric is the name of the synthetic metric written by SelfTest.
+const SelfTestMetric = "adapter_self_test"
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlSelfTestRead      = "select v.value from %s_values v join %s l on l.id = v.labels_id where l.metric_name = $1 and l.labels @> $2::jsonb and v.time = $3"
+	sqlSelfTestReadOnly  = "select 1 from %s_values v join %s l on l.id = v.labels_id limit 1"
+	selfTestDeleteBatch  = 1000
+	selfTestPhaseWrite   = "write"
+	selfTestPhaseRead    = "read"
+	selfTestPhaseDelete  = "delete"
+	selfTestPhaseConnect = "connect"
+)
+
+// SelfTestError tells which phase of the self-test failed.
+type SelfTestError struct {
+	Phase string
+	Err   error
+}
+
+func (e *SelfTestError) Error() string {
+	return fmt.Sprintf("self-test failed in %s phase: %v", e.Phase, e.Err)
+}
+
+func (e *SelfTestError) Unwrap() error {
+	return e.Err
+}
+
+// SelfTest checks the write pipeline end to end: it writes a sample of SelfTestMetric labelled with the
+// given instance through Write, reads it back and deletes it again. With write unset, eg. on replicas
+// that aren't the leader, or with LabelsReadOnly, only read access to the tables is verified. Failures
+// are returned as *SelfTestError.
+func (c *Client) SelfTest(ctx context.Context, instance string, write bool) error {
+	if err := c.DB.PingContext(ctx); err != nil {
+		return &SelfTestError{Phase: selfTestPhaseConnect, Err: err}
+	}
+	relation := c.labels.labelsRelation()
+	if c.knownSeries != nil && write {
+		// the sample of the self-test would be dropped, its series isn't provisioned
+		log.Info("msg", "Self-test can't write with read-only labels, verifying read access only")
+		write = false
+	}
+	if !write {
+		var one int
+		err := c.DB.QueryRowContext(ctx, fmt.Sprintf(sqlSelfTestReadOnly, c.cfg.Table, relation)).Scan(&one)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return &SelfTestError{Phase: selfTestPhaseRead, Err: err}
+		}
+		log.Info("msg", "Self-test verified read access, skipped writing")
+		return nil
+	}
+
+	now := time.Now()
+	sample := &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: SelfTestMetric, "instance": model.LabelValue(instance)},
+		Value:     model.SampleValue(now.UnixNano() % 1000000),
+		Timestamp: model.TimeFromUnixNano(now.UnixNano()),
+	}
+	if err := c.Write(model.Samples{sample}); err != nil {
+		return &SelfTestError{Phase: selfTestPhaseWrite, Err: err}
+	}
+
+	ts := sample.Timestamp.Time()
+	labelsJson, err := json.Marshal(map[string]string{"instance": instance})
+	if err != nil {
+		return &SelfTestError{Phase: selfTestPhaseRead, Err: err}
+	}
+	var value float64
+	err = c.DB.QueryRowContext(ctx, fmt.Sprintf(sqlSelfTestRead, c.cfg.Table, relation), SelfTestMetric, string(labelsJson), ts).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("sample written at %v not found", ts)
+	} else if err == nil && value != float64(sample.Value) {
+		err = fmt.Errorf("read back value %v, wrote %v", value, sample.Value)
+	}
+	if err != nil {
+		return &SelfTestError{Phase: selfTestPhaseRead, Err: err}
+	}
+
+	selectors := [][]*labels.Matcher{{
+		labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, SelfTestMetric),
+		labels.MustNewMatcher(labels.MatchEqual, "instance", instance),
+	}}
+	opts := DeleteOptions{BatchSize: selfTestDeleteBatch, RemoveOrphans: true}
+	if err := c.DeleteSeries(ctx, selectors, ts, ts, opts, nil); err != nil {
+		return &SelfTestError{Phase: selfTestPhaseDelete, Err: err}
+	}
+	log.Info("msg", "Self-test passed", "metric", SelfTestMetric, "instance", instance)
+	return nil
+}
@@ -0,0 +1,17 @@
+package pgprometheus
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSelfTestError(t *testing.T) {
+	err := error(&SelfTestError{Phase: selfTestPhaseRead, Err: context.DeadlineExceeded})
+	if err.Error() != "self-test failed in read phase: context deadline exceeded" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected the cause to be unwrapped")
+	}
+}
@@ -0,0 +1,209 @@
+package pgprometheus
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// FNV-1a, as model.Fingerprint hashes label sets
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// Series is a series of a decoded write request. Its labels are sorted by name and reference the strings of
+// the request, so converting a request doesn't build a model.Metric map per series. The fingerprint and the
+// canonical label set of MetricMetaJson are computed once, on conversion.
+type Series struct {
+	Labels      []prompb.Label
+	Samples     []prompb.Sample
+	Fingerprint model.Fingerprint
+	MetricName  string
+	LabelsJson  string
+}
+
+// NewSeries converts a series of a write request, sorting its labels in place.
+func NewSeries(ts prompb.TimeSeries) Series {
+	if !slices.IsSortedFunc(ts.Labels, compareLabels) {
+		slices.SortFunc(ts.Labels, compareLabels)
+	}
+	metricName, labelsJson := labelsMetaJson(ts.Labels, false)
+	return Series{
+		Labels:      ts.Labels,
+		Samples:     ts.Samples,
+		Fingerprint: labelsFingerprint(ts.Labels),
+		MetricName:  metricName,
+		LabelsJson:  labelsJson,
+	}
+}
+
+// SeriesFromRequest converts the series of a write request.
+func SeriesFromRequest(req *prompb.WriteRequest) []Series {
+	series := make([]Series, len(req.Timeseries))
+	for i, ts := range req.Timeseries {
+		series[i] = NewSeries(ts)
+	}
+	return series
+}
+
+// Metric returns the label set of the series as a model.Metric.
+func (s *Series) Metric() model.Metric {
+	metric := make(model.Metric, len(s.Labels))
+	for _, l := range s.Labels {
+		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return metric
+}
+
+// SeriesToSamples converts series to samples for the writers taking model.Samples. The samples of a series
+// share its metric.
+func SeriesToSamples(series []Series) model.Samples {
+	n := 0
+	for i := range series {
+		n += len(series[i].Samples)
+	}
+	samples := make(model.Samples, 0, n)
+	for i := range series {
+		metric := series[i].Metric()
+		for _, s := range series[i].Samples {
+			samples = append(samples, &model.Sample{Metric: metric, Value: model.SampleValue(s.Value), Timestamp: model.Time(s.Timestamp)})
+		}
+	}
+	return samples
+}
+
+// SeriesWriter is implemented by the writers that take series as converted from write requests.
+type SeriesWriter interface {
+	WriteSeries(ctx context.Context, series []Series) (writers.WriteStats, error)
+}
+
+// WriteSeries writes series with w, converting them to model.Samples unless w is a SeriesWriter.
+func WriteSeries(ctx context.Context, w writers.Writer, series []Series) (writers.WriteStats, error) {
+	if sw, ok := w.(SeriesWriter); ok {
+		return sw.WriteSeries(ctx, series)
+	}
+	return w.WriteContext(ctx, SeriesToSamples(series))
+}
+
+type renderedSeriesKey struct{}
+
+// renderedSeries are the label sets of the series of a write, as copied into the staging table, by
+// fingerprint.
+type renderedSeries map[model.Fingerprint][2]string
+
+// WriteSeries writes the samples of series like WriteContext, rendering their label sets once per series
+// instead of once per sample. Samples of which the label set is changed on the way, eg. to valid UTF-8, are
+// rendered again.
+func (c *Client) WriteSeries(ctx context.Context, series []Series) (writers.WriteStats, error) {
+	rendered := make(renderedSeries, len(series))
+	for i := range series {
+		metricName, labelsJson := c.labels.renderSeries(&series[i])
+		rendered[series[i].Fingerprint] = [2]string{metricName, labelsJson}
+	}
+	return c.WriteContext(context.WithValue(ctx, renderedSeriesKey{}, rendered), SeriesToSamples(series))
+}
+
+// seriesJson returns the metric name and the labels jsonb text copied into the staging table for a metric,
+// as rendered by WriteSeries if it was.
+func (c *Client) seriesJson(ctx context.Context, m model.Metric) (string, string) {
+	if rendered, ok := ctx.Value(renderedSeriesKey{}).(renderedSeries); ok {
+		if r, ok := rendered[m.Fingerprint()]; ok {
+			return r[0], r[1]
+		}
+	}
+	return c.labels.seriesJson(m)
+}
+
+func compareLabels(a, b prompb.Label) int {
+	return strings.Compare(a.Name, b.Name)
+}
+
+// labelsFingerprint returns the fingerprint of labels sorted by name, the same as that of the model.Metric.
+func labelsFingerprint(labels []prompb.Label) model.Fingerprint {
+	h := uint64(fnvOffset64)
+	for _, l := range labels {
+		h = fnvAdd(h, l.Name)
+		h = fnvAddByte(h, model.SeparatorByte)
+		h = fnvAdd(h, l.Value)
+		h = fnvAddByte(h, model.SeparatorByte)
+	}
+	return model.Fingerprint(h)
+}
+
+func fnvAdd(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+func fnvAddByte(h uint64, b byte) uint64 {
+	h ^= uint64(b)
+	h *= fnvPrime64
+	return h
+}
+
+// labelsMetaJson is metricMetaJson for labels sorted by name.
+func labelsMetaJson(labels []prompb.Label, withName bool) (string, string) {
+	var metricName string
+	var b strings.Builder
+	b.WriteByte('{')
+	first := true
+	for _, l := range labels {
+		if l.Name == model.MetricNameLabel {
+			metricName = toValidUTF8(l.Value)
+			if !withName {
+				continue
+			}
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		writeJsonString(&b, toValidUTF8(l.Name))
+		b.WriteString(": ")
+		writeJsonString(&b, toValidUTF8(l.Value))
+	}
+	b.WriteByte('}')
+	return metricName, b.String()
+}
+
+// writeJsonString writes s as a JSON string, the same as json.Marshal. Only strings that need escaping go
+// through json.Marshal.
+func writeJsonString(b *strings.Builder, s string) {
+	if !jsonSafe(s) {
+		escaped, _ := json.Marshal(s)
+		b.Write(escaped)
+		return
+	}
+	b.WriteByte('"')
+	b.WriteString(s)
+	b.WriteByte('"')
+}
+
+// jsonSafe tells whether json.Marshal leaves the characters of a valid UTF-8 string as they are.
+func jsonSafe(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c < utf8.RuneSelf:
+			if c < 0x20 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+				return false
+			}
+		case c == 0xe2:
+			// U+2028 and U+2029 are escaped
+			if i+2 < len(s) && s[i+1] == 0x80 && (s[i+2] == 0xa8 || s[i+2] == 0xa9) {
+				return false
+			}
+		}
+	}
+	return true
+}
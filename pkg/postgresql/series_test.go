@@ -0,0 +1,241 @@
+package pgprometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+// legacyMetricMetaJson is metricMetaJson as it was before label sets were rendered from sorted labels. The
+// rendering must not change, as lookups by label set compare the bytes.
+func legacyMetricMetaJson(m model.Metric, withName bool) (string, string) {
+	metricName := toValidUTF8(string(m[model.MetricNameLabel]))
+	labelNames := make([]string, 0, len(m))
+	for label := range m {
+		if withName || label != model.MetricNameLabel {
+			labelNames = append(labelNames, string(label))
+		}
+	}
+	if len(labelNames) == 0 {
+		return metricName, "{}"
+	}
+	sort.Strings(labelNames)
+
+	labelStrings := make([]string, 0, len(labelNames))
+	for _, label := range labelNames {
+		value := m[model.LabelName(label)]
+		escapedLabel, _ := json.Marshal(toValidUTF8(label))
+		escapedValue, _ := json.Marshal(toValidUTF8(string(value)))
+		labelStrings = append(labelStrings, fmt.Sprintf("%s: %s", escapedLabel, escapedValue))
+	}
+	return metricName, fmt.Sprintf("{%s}", strings.Join(labelStrings, ","))
+}
+
+func TestNewSeries(t *testing.T) {
+	ts := prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "job", Value: "node"}, {Name: "__name__", Value: "up"}, {Name: "instance", Value: "a<b>"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 0, Timestamp: 2000}},
+	}
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "node", "instance": "a<b>"}
+	s := NewSeries(ts)
+	if s.Labels[0].Name != model.MetricNameLabel || s.Labels[1].Name != "instance" || s.Labels[2].Name != "job" {
+		t.Errorf("Expected the labels sorted by name, got %v", s.Labels)
+	}
+	if s.Fingerprint != metric.Fingerprint() {
+		t.Errorf("Expected fingerprint %v, got %v", metric.Fingerprint(), s.Fingerprint)
+	}
+	if s.MetricName != "up" || s.LabelsJson != `{"instance": "a\u003cb\u003e","job": "node"}` {
+		t.Errorf("Unexpected label set %q %q", s.MetricName, s.LabelsJson)
+	}
+	if !s.Metric().Equal(metric) {
+		t.Errorf("Expected %v, got %v", metric, s.Metric())
+	}
+
+	samples := SeriesToSamples([]Series{s})
+	expected := model.Samples{{Metric: metric, Value: 1, Timestamp: 1000}, {Metric: metric, Value: 0, Timestamp: 2000}}
+	if !samples.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, samples)
+	}
+}
+
+// seriesWriter records whether it was given series or samples.
+type seriesWriter struct {
+	series  []Series
+	samples model.Samples
+}
+
+func (w *seriesWriter) WriteContext(ctx context.Context, samples model.Samples) (writers.WriteStats, error) {
+	w.samples = samples
+	return writers.WriteStats{Written: len(samples)}, nil
+}
+
+func (w *seriesWriter) Name() string {
+	return "series"
+}
+
+func (w *seriesWriter) WriteSeries(ctx context.Context, series []Series) (writers.WriteStats, error) {
+	w.series = series
+	return writers.WriteStats{Written: len(series)}, nil
+}
+
+// samplesOnly hides the WriteSeries of a writer.
+type samplesOnly struct {
+	writers.Writer
+}
+
+func TestWriteSeries(t *testing.T) {
+	series := SeriesFromRequest(&prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}})
+	w := &seriesWriter{}
+	if _, err := WriteSeries(context.Background(), w, series); err != nil || len(w.series) != 1 || w.samples != nil {
+		t.Errorf("Expected the series to be written as such, got %v and %v", w.series, w.samples)
+	}
+	w = &seriesWriter{}
+	if _, err := WriteSeries(context.Background(), samplesOnly{w}, series); err != nil || w.series != nil || len(w.samples) != 1 {
+		t.Errorf("Expected the series to be converted to samples, got %v and %v", w.series, w.samples)
+	}
+}
+
+func TestRenderedSeries(t *testing.T) {
+	series := NewSeries(prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}}})
+	for _, c := range []struct {
+		store labelStore
+		want  string
+	}{
+		{&jsonbLabelStore{}, `{"job": "node"}`},
+		{&jsonbLabelStore{metricNameInLabels: true}, `{"__name__": "up","job": "node"}`},
+		{&normalizedLabelStore{}, `{"job": "node"}`},
+	} {
+		client := &Client{labels: c.store}
+		ctx := context.WithValue(context.Background(), renderedSeriesKey{}, renderedSeries{series.Fingerprint: [2]string{"rendered", "{}"}})
+		if name, labels := client.seriesJson(ctx, series.Metric()); name != "rendered" || labels != "{}" {
+			t.Errorf("Expected the rendered label set, got %q %q", name, labels)
+		}
+		// label sets changed on the way are rendered again
+		changed := model.Metric{model.MetricNameLabel: "up"}
+		if name, _ := client.seriesJson(ctx, changed); name != "up" {
+			t.Errorf("Expected the label set of %v to be rendered, got metric name %q", changed, name)
+		}
+		name, labels := c.store.renderSeries(&series)
+		wantName, wantLabels := c.store.seriesJson(series.Metric())
+		if name != wantName || labels != wantLabels || labels != c.want {
+			t.Errorf("Expected %q %q, got %q %q", wantName, c.want, name, labels)
+		}
+	}
+}
+
+// FuzzLabelsMetaJson checks that label sets render to the same bytes and fingerprint from sorted labels as
+// from a model.Metric. The input is split into names and values at NUL bytes.
+func FuzzLabelsMetaJson(f *testing.F) {
+	for _, seed := range []string{
+		"__name__\x00up\x00job\x00node",
+		"job\x00a\"b\\c\x00instance\x00<&>  ",
+		"\xff\xfe\x00v\x00a\x00\xc3\x28\x00\x01\x00\x7f\b\f\n\t",
+		"__name__\x00",
+		"",
+	} {
+		f.Add(seed, false)
+	}
+	f.Fuzz(func(t *testing.T, input string, withName bool) {
+		parts := strings.Split(input, "\x00")
+		metric := model.Metric{}
+		var labels []prompb.Label
+		for i := 0; i+1 < len(parts); i += 2 {
+			if _, ok := metric[model.LabelName(parts[i])]; ok {
+				continue
+			}
+			metric[model.LabelName(parts[i])] = model.LabelValue(parts[i+1])
+			labels = append(labels, prompb.Label{Name: parts[i], Value: parts[i+1]})
+		}
+		wantName, wantLabels := legacyMetricMetaJson(metric, withName)
+		if name, labels := metricMetaJson(metric, withName); name != wantName || labels != wantLabels {
+			t.Errorf("metricMetaJson rendered %q %q, expected %q %q", name, labels, wantName, wantLabels)
+		}
+		s := NewSeries(prompb.TimeSeries{Labels: labels})
+		if name, labels := labelsMetaJson(s.Labels, withName); name != wantName || labels != wantLabels {
+			t.Errorf("labelsMetaJson rendered %q %q, expected %q %q", name, labels, wantName, wantLabels)
+		}
+		if s.Fingerprint != metric.Fingerprint() {
+			t.Errorf("Expected fingerprint %v, got %v", metric.Fingerprint(), s.Fingerprint)
+		}
+	})
+}
+
+// benchmarkRequest returns a write request of 10000 series with 10 labels and 2 samples each.
+func benchmarkRequest() *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	for i := 0; i < 10000; i++ {
+		labels := []prompb.Label{{Name: "__name__", Value: fmt.Sprintf("metric_%d", i%100)}}
+		for j := 0; j < 9; j++ {
+			labels = append(labels, prompb.Label{Name: fmt.Sprintf("label_%d", j), Value: fmt.Sprintf("value_%d_%d", j, i)})
+		}
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: labels, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}}})
+	}
+	return req
+}
+
+// BenchmarkConvertRequest compares converting a request to model.Samples, with a map per series, and
+// rendering the label set of each sample for the COPY, with converting it to series.
+func BenchmarkConvertRequest(b *testing.B) {
+	req := benchmarkRequest()
+	b.Run("samples", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var samples model.Samples
+			for _, ts := range req.Timeseries {
+				metric := make(model.Metric, len(ts.Labels))
+				for _, l := range ts.Labels {
+					metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+				}
+				for _, s := range ts.Samples {
+					samples = append(samples, &model.Sample{Metric: metric, Value: model.SampleValue(s.Value), Timestamp: model.Time(s.Timestamp)})
+				}
+			}
+			for _, s := range samples {
+				legacyMetricMetaJson(s.Metric, false)
+			}
+		}
+	})
+	b.Run("series", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			SeriesFromRequest(req)
+		}
+	})
+}
+
+// BenchmarkLabelsMetaJson compares rendering a label set from a model.Metric with the implementation before
+// series, and from sorted labels.
+func BenchmarkLabelsMetaJson(b *testing.B) {
+	req := benchmarkRequest()
+	series := NewSeries(req.Timeseries[0])
+	metric, labels := series.Metric(), series.Labels
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			legacyMetricMetaJson(metric, false)
+		}
+	})
+	b.Run("metric", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			metricMetaJson(metric, false)
+		}
+	})
+	b.Run("labels", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			labelsMetaJson(labels, false)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package pgprometheus
+
+import (
+	"flag"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/writers"
+)
+
+func init() {
+	writers.Register(writers.DefaultStorage, "pg", func(*writers.Sinks) writers.Sink {
+		return &Sink{Config: *DefaultConfig()}
+	})
+}
+
+// Sink is the PostgreSQL storage of the writers registry, building a Client with Config.
+type Sink struct {
+	Config Config
+}
+
+// RegisterFlags registers the flags of Config with prefix.
+func (s *Sink) RegisterFlags(fs *flag.FlagSet, prefix string) {
+	RegisterFlags(fs, prefix, &s.Config)
+}
+
+// New creates the Client and sets up the database schema.
+func (s *Sink) New() (writers.Writer, error) {
+	client, err := NewClient(&s.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.EnsureSchema(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
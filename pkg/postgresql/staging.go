@@ -0,0 +1,241 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const (
+	stagingModeTemp     = "temp"
+	stagingModeUnlogged = "unlogged"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlCreateTempStaging     = "create temporary table %s (%s) on commit preserve rows;"
+	sqlCreateUnloggedStaging = "create unlogged table if not exists %s (%s);"
+	// concurrent writes share the staging table, each only seeing its own rows until it commits. truncate
+	// would need an exclusive lock and deadlock them.
+	sqlClearStaging = "delete from %s;"
+	// a claim is taken over once its heartbeat is older than the TTL, and refreshed by its owner
+	sqlCreateStagingRegistry = "create table if not exists %s_staging_registry (staging_table text primary key, owner text not null, heartbeat timestamp with time zone not null);"
+	sqlClaimStaging          = "insert into %s_staging_registry as r (staging_table, owner, heartbeat) values ($1, $2, now()) on conflict (staging_table) do update set owner = excluded.owner, heartbeat = now() where r.owner = excluded.owner or r.heartbeat < now() - make_interval(secs => $3) returning owner;"
+	sqlReleaseStaging        = "delete from %s_staging_registry where staging_table = $1 and owner = $2;"
+	sqlSavepoint             = "savepoint %s;"
+	sqlRollbackToSavepoint   = "rollback to savepoint %s;"
+)
+
+const (
+	// stagingHeartbeat is the interval at which an adapter refreshes the claim on its unlogged staging table.
+	stagingHeartbeat = 10 * time.Second
+	// stagingClaimTTL is how long a claim that isn't refreshed blocks other adapters, eg. after a crash.
+	stagingClaimTTL = 3 * stagingHeartbeat
+)
+
+var invalidInstanceIDChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// stagingTable returns the name of the table samples are copied into before they are inserted.
+func stagingTable(cfg *Config) string {
+	if cfg.StagingMode == stagingModeUnlogged {
+		return fmt.Sprintf("%s_staging_%s", cfg.Table, cfg.StagingInstanceID)
+	}
+	return cfg.Table + "_tmp"
+}
+
+// defaultInstanceID derives the staging instance ID from the hostname.
+func defaultInstanceID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("error getting the hostname for the staging instance ID: %w", err)
+	}
+	return strings.Trim(invalidInstanceIDChars.ReplaceAllString(strings.ToLower(hostname), "_"), "_"), nil
+}
+
+// claimStaging claims the unlogged staging table in the staging registry, so that two adapters configured
+// with the same instance ID don't write through the same table. Session advisory locks would not stay with
+// the adapter through transaction pooling, so the claim is a row, refreshed by a heartbeat until the client
+// is closed.
+func (c *Client) claimStaging(ctx context.Context) error {
+	if _, err := c.DB.ExecContext(ctx, fmt.Sprintf(sqlCreateStagingRegistry, c.cfg.Table)); err != nil {
+		return fmt.Errorf("error creating staging registry: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(), time.Now().UnixNano())
+	claimed, err := c.refreshStagingClaim(ctx, owner)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return fmt.Errorf("staging table %s is used by another adapter, configure a unique instance ID", c.staging)
+	}
+	c.stagingOwner = owner
+	if c.stop != nil {
+		go c.stagingHeartbeat(owner)
+	}
+	return nil
+}
+
+// refreshStagingClaim claims the staging table for owner, or refreshes its claim, and tells whether owner
+// holds the claim.
+func (c *Client) refreshStagingClaim(ctx context.Context, owner string) (bool, error) {
+	var claimedBy string
+	err := c.DB.QueryRowContext(ctx, fmt.Sprintf(sqlClaimStaging, c.cfg.Table), c.staging, owner, stagingClaimTTL.Seconds()).Scan(&claimedBy)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error claiming staging table: %w", err)
+	}
+	return true, nil
+}
+
+// stagingHeartbeat refreshes the claim on the staging table until the client is closed.
+func (c *Client) stagingHeartbeat(owner string) {
+	ticker := time.NewTicker(stagingHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), stagingHeartbeat)
+			claimed, err := c.refreshStagingClaim(ctx, owner)
+			cancel()
+			if err != nil {
+				log.Warn("msg", "Error refreshing the claim on the staging table", "table", c.staging, "err", err)
+			} else if !claimed {
+				log.Error("msg", "The staging table was claimed by another adapter, configure a unique instance ID", "table", c.staging)
+			}
+		}
+	}
+}
+
+// releaseStaging removes the claim on the staging table, so that a restarted adapter can claim it right away.
+func (c *Client) releaseStaging() {
+	ctx, cancel := context.WithTimeout(context.Background(), stagingHeartbeat)
+	defer cancel()
+	if _, err := c.DB.ExecContext(ctx, fmt.Sprintf(sqlReleaseStaging, c.cfg.Table), c.staging, c.stagingOwner); err != nil {
+		log.Warn("msg", "Error releasing the claim on the staging table", "table", c.staging, "err", err)
+	}
+	c.stagingOwner = ""
+}
+
+// ensureStaging sets up the unlogged staging table. Temporary staging tables are created by each write.
+func (c *Client) ensureStaging(ctx context.Context) error {
+	if c.cfg.StagingMode != stagingModeUnlogged || c.stagingOwner != "" {
+		return nil
+	}
+	if err := c.claimStaging(ctx); err != nil {
+		return err
+	}
+	if _, err := c.DB.ExecContext(ctx, fmt.Sprintf(sqlCreateUnloggedStaging, c.staging, c.labels.stagingColumns())); err != nil {
+		return fmt.Errorf("error creating staging table: %w", err)
+	}
+	log.Info("msg", "Using unlogged staging table", "table", c.staging)
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// writeSession runs the statements of a write on one connection. With a temporary staging table, every
+// statement commits on its own. With an unlogged staging table the whole write is a single transaction,
+// begun and committed by Write, so that it works through transaction pooling. Either way, each transaction
+// sets synchronousCommit if not empty.
+type writeSession struct {
+	conn              *sql.Conn
+	staging           string
+	single            bool
+	synchronousCommit string
+	// rows counts the rows affected by the statements of the write so far
+	rows int64
+}
+
+// setSynchronousCommit sets synchronous_commit for the current transaction.
+func (w *writeSession) setSynchronousCommit(ctx context.Context, ex execer) error {
+	if w.synchronousCommit == "" {
+		return nil
+	}
+	_, err := ex.ExecContext(ctx, fmt.Sprintf(sqlSetSynchronousCommit, w.synchronousCommit))
+	return err
+}
+
+// commit commits the transaction of the write, observing its duration.
+func (w *writeSession) commit(commit func() error) error {
+	begin := time.Now()
+	err := commit()
+	CommitDuration.WithLabelValues(commitMode(w.synchronousCommit)).Observe(time.Since(begin).Seconds())
+	return err
+}
+
+// inTx runs f in the transaction of the write, or in a new transaction if statements commit on their own.
+func (w *writeSession) inTx(ctx context.Context, queryDescription string, f func(ex execer) error) error {
+	if w.single {
+		return f(w.conn)
+	}
+	tx, err := w.conn.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("msg", "Error on transaction setup", "err", err, "desc", queryDescription)
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := w.setSynchronousCommit(ctx, tx); err != nil {
+		log.Error("msg", "Error on transaction setup", "err", err, "desc", queryDescription)
+		return err
+	}
+	if err := f(tx); err != nil {
+		return err
+	}
+	if err := w.commit(tx.Commit); err != nil {
+		log.Error("msg", "Error on Commit", "err", err, "desc", queryDescription)
+		return err
+	}
+	return nil
+}
+
+// exec runs a statement moving rows out of the staging table.
+func (w *writeSession) exec(ctx context.Context, query string, queryDescription string) error {
+	var affected int64
+	err := w.inTx(ctx, queryDescription, func(ex execer) error {
+		result, err := ex.ExecContext(ctx, query)
+		if err != nil {
+			log.Error("msg", "Error executing statement", "err", err, "desc", queryDescription)
+			return err
+		}
+		affected, _ = result.RowsAffected()
+		return nil
+	})
+	if err == nil {
+		w.rows += affected
+	}
+	return err
+}
+
+// savepoint marks a point the single transaction of the write can be rolled back to after a failed statement.
+// It does nothing if statements commit on their own.
+func (w *writeSession) savepoint(ctx context.Context, name string) error {
+	if !w.single {
+		return nil
+	}
+	_, err := w.conn.ExecContext(ctx, fmt.Sprintf(sqlSavepoint, name))
+	return err
+}
+
+func (w *writeSession) rollbackToSavepoint(ctx context.Context, name string) error {
+	if !w.single {
+		return nil
+	}
+	_, err := w.conn.ExecContext(ctx, fmt.Sprintf(sqlRollbackToSavepoint, name))
+	return err
+}
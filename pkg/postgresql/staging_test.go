@@ -0,0 +1,77 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStagingTable(t *testing.T) {
+	cfg := DefaultConfig()
+	if table := stagingTable(cfg); table != "metrics_tmp" {
+		t.Errorf("Unexpected temporary staging table %q", table)
+	}
+	cfg.StagingMode, cfg.StagingInstanceID = stagingModeUnlogged, "adapter_1"
+	if table := stagingTable(cfg); table != "metrics_staging_adapter_1" {
+		t.Errorf("Unexpected unlogged staging table %q", table)
+	}
+}
+
+func TestNewClientStagingErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.StagingMode = "logged"
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for unknown staging mode")
+	}
+	cfg = DefaultConfig()
+	cfg.StagingMode, cfg.StagingInstanceID = stagingModeUnlogged, "adapter-1"
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("Expected error for invalid instance ID")
+	}
+}
+
+// TestStagingClaim checks that a second adapter with the same instance ID can't claim the unlogged staging
+// table until the first releases it or stops refreshing its claim. It needs a database, given as connection
+// string in TS_PROM_TEST_PG_DSN.
+func TestStagingClaim(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cfg := DefaultConfig()
+	cfg.Table = "staging_claim_test_metrics"
+	cfg.StagingMode, cfg.StagingInstanceID = stagingModeUnlogged, "test"
+	defer func() {
+		_, _ = db.Exec("drop table if exists " + cfg.Table + "_staging_registry")
+	}()
+	first := &Client{DB: db, cfg: cfg, staging: stagingTable(cfg)}
+	second := &Client{DB: db, cfg: cfg, staging: stagingTable(cfg)}
+	ctx := context.Background()
+	if err := first.claimStaging(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.claimStaging(ctx); err == nil {
+		t.Fatal("Expected the claimed staging table to be refused")
+	}
+	first.releaseStaging()
+	if err := second.claimStaging(ctx); err != nil {
+		t.Fatalf("Expected the released staging table to be claimable, got %v", err)
+	}
+	// a crashed adapter stops refreshing its claim
+	if _, err := db.Exec("update "+cfg.Table+"_staging_registry set heartbeat = now() - make_interval(secs => $1)", (stagingClaimTTL + time.Second).Seconds()); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.claimStaging(ctx); err != nil {
+		t.Errorf("Expected a stale claim to be taken over, got %v", err)
+	}
+	if claimed, err := second.refreshStagingClaim(ctx, second.stagingOwner); err != nil || claimed {
+		t.Errorf("Expected the previous owner to have lost its claim, got %v, %v", claimed, err)
+	}
+}
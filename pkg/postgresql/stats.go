@@ -0,0 +1,287 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlStatsDatabase    = "select numbackends, xact_commit, xact_rollback, blks_read, blks_hit, deadlocks from pg_stat_database where datname = current_database()"
+	sqlStatsTimescale   = "select exists (select 1 from pg_extension where extname = 'timescaledb')"
+	sqlStatsChunks      = "select hypertable_name, count(*) from timescaledb_information.chunks where hypertable_schema = current_schema() and hypertable_name = any($1) group by hypertable_name"
+	sqlStatsSizes       = "select c.relname, pg_table_size(c.oid), pg_indexes_size(c.oid) from pg_class c where c.oid = any(array(select to_regclass(t) from unnest($1::text[]) t))"
+	sqlStatsHyperSizes  = "select h.hypertable_name, s.table_bytes + s.toast_bytes, s.index_bytes from timescaledb_information.hypertables h, hypertable_detailed_size(format('%I.%I', h.hypertable_schema, h.hypertable_name)::regclass) s where h.hypertable_schema = current_schema() and h.hypertable_name = any($1)"
+	sqlStatsReplication = "select format('%s/%s', application_name, coalesce(host(client_addr), 'local')), max(coalesce(extract(epoch from replay_lag), 0)) from pg_stat_replication group by 1"
+	sqlStatsReplay      = "select pg_is_in_recovery(), coalesce(extract(epoch from now() - pg_last_xact_replay_timestamp()), 0)"
+)
+
+var (
+	pgStatsUpDesc = prometheus.NewDesc(
+		"adapter_pg_up",
+		"Whether the last collection of database statistics succeeded.",
+		nil, nil,
+	)
+	pgStatsDurationDesc = prometheus.NewDesc(
+		"adapter_pg_stats_collection_duration_seconds",
+		"Duration of the last collection of database statistics.",
+		nil, nil,
+	)
+	pgBackendsDesc = prometheus.NewDesc(
+		"adapter_pg_database_backends",
+		"Number of backends connected to the database.",
+		nil, nil,
+	)
+	pgDatabaseCounterDescs = []*prometheus.Desc{
+		prometheus.NewDesc("adapter_pg_database_xact_commit_total", "Transactions committed in the database.", nil, nil),
+		prometheus.NewDesc("adapter_pg_database_xact_rollback_total", "Transactions rolled back in the database.", nil, nil),
+		prometheus.NewDesc("adapter_pg_database_blks_read_total", "Disk blocks read in the database.", nil, nil),
+		prometheus.NewDesc("adapter_pg_database_blks_hit_total", "Disk blocks found in the buffer cache of the database.", nil, nil),
+		prometheus.NewDesc("adapter_pg_database_deadlocks_total", "Deadlocks detected in the database.", nil, nil),
+	}
+	pgChunksDesc = prometheus.NewDesc(
+		"adapter_pg_hypertable_chunks",
+		"Number of chunks of the adapter's hypertables.",
+		[]string{"hypertable"}, nil,
+	)
+	pgRelationSizeDesc = prometheus.NewDesc(
+		"adapter_pg_relation_size_bytes",
+		"Size of the adapter's tables, by kind (table or index). Hypertables include all chunks.",
+		[]string{"relation", "kind"}, nil,
+	)
+	pgReplicationLagDesc = prometheus.NewDesc(
+		"adapter_pg_replication_lag_seconds",
+		"Replay lag of the streaming replicas of the database, as seen by the primary.",
+		[]string{"replica"}, nil,
+	)
+	pgReplayLagDesc = prometheus.NewDesc(
+		"adapter_pg_replay_lag_seconds",
+		"Time since the last replayed transaction, if the database is a standby.",
+		nil, nil,
+	)
+)
+
+// databaseStats periodically collects health statistics of the database on a dedicated connection and
+// exposes the last results. Failures only set adapter_pg_up to 0, so they never break a scrape.
+type databaseStats struct {
+	client   *Client
+	interval time.Duration
+	timeout  time.Duration
+
+	conn *sql.Conn
+
+	lock     sync.Mutex
+	metrics  []prometheus.Metric
+	up       float64
+	duration float64
+}
+
+func newDatabaseStats(client *Client, interval, timeout time.Duration) *databaseStats {
+	return &databaseStats{client: client, interval: interval, timeout: timeout}
+}
+
+func (s *databaseStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pgStatsUpDesc
+	ch <- pgStatsDurationDesc
+	ch <- pgBackendsDesc
+	for _, desc := range pgDatabaseCounterDescs {
+		ch <- desc
+	}
+	ch <- pgChunksDesc
+	ch <- pgRelationSizeDesc
+	ch <- pgReplicationLagDesc
+	ch <- pgReplayLagDesc
+}
+
+func (s *databaseStats) Collect(ch chan<- prometheus.Metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ch <- prometheus.MustNewConstMetric(pgStatsUpDesc, prometheus.GaugeValue, s.up)
+	ch <- prometheus.MustNewConstMetric(pgStatsDurationDesc, prometheus.GaugeValue, s.duration)
+	for _, m := range s.metrics {
+		ch <- m
+	}
+}
+
+// run collects the statistics every interval until the client is closed.
+func (s *databaseStats) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	defer s.release()
+	for {
+		s.update()
+		select {
+		case <-s.client.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *databaseStats) update() {
+	begin := time.Now()
+	metrics, err := s.collect()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.duration = time.Since(begin).Seconds()
+	if err != nil {
+		log.Warn("msg", "Error collecting database statistics", "err", err)
+		s.up = 0
+		s.metrics = nil
+		s.release()
+		return
+	}
+	s.up = 1
+	s.metrics = metrics
+}
+
+func (s *databaseStats) release() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// collect runs the statistics queries in a read-only transaction with a statement timeout.
+func (s *databaseStats) collect() ([]prometheus.Metric, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if s.conn == nil {
+		conn, err := s.client.DB.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	tx, err := s.conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("set local statement_timeout = %d", s.timeout.Milliseconds())); err != nil {
+		return nil, err
+	}
+
+	var metrics []prometheus.Metric
+	var backends float64
+	counters := make([]float64, len(pgDatabaseCounterDescs))
+	err = tx.QueryRowContext(ctx, sqlStatsDatabase).Scan(&backends, &counters[0], &counters[1], &counters[2], &counters[3], &counters[4])
+	if err != nil {
+		return nil, err
+	}
+	metrics = append(metrics, prometheus.MustNewConstMetric(pgBackendsDesc, prometheus.GaugeValue, backends))
+	for i, desc := range pgDatabaseCounterDescs {
+		metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.CounterValue, counters[i]))
+	}
+
+	relations := s.client.relations()
+	var timescale bool
+	if err := tx.QueryRowContext(ctx, sqlStatsTimescale).Scan(&timescale); err != nil {
+		return nil, err
+	}
+	if timescale {
+		err = queryLabelledValues(ctx, tx, sqlStatsChunks, relations, func(name string, values []float64) {
+			metrics = append(metrics, prometheus.MustNewConstMetric(pgChunksDesc, prometheus.GaugeValue, values[0], name))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sizes := map[string][]float64{}
+	err = queryLabelledValues(ctx, tx, sqlStatsSizes, relations, func(name string, values []float64) {
+		sizes[name] = values
+	})
+	if err != nil {
+		return nil, err
+	}
+	if timescale {
+		// the hypertable itself is empty, its data is in the chunks
+		err = queryLabelledValues(ctx, tx, sqlStatsHyperSizes, relations, func(name string, values []float64) {
+			sizes[name] = values
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, values := range sizes {
+		metrics = append(metrics,
+			prometheus.MustNewConstMetric(pgRelationSizeDesc, prometheus.GaugeValue, values[0], name, "table"),
+			prometheus.MustNewConstMetric(pgRelationSizeDesc, prometheus.GaugeValue, values[1], name, "index"),
+		)
+	}
+
+	err = queryLabelledValues(ctx, tx, sqlStatsReplication, nil, func(name string, values []float64) {
+		metrics = append(metrics, prometheus.MustNewConstMetric(pgReplicationLagDesc, prometheus.GaugeValue, values[0], name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var standby bool
+	var replayLag float64
+	if err := tx.QueryRowContext(ctx, sqlStatsReplay).Scan(&standby, &replayLag); err != nil {
+		return nil, err
+	}
+	if standby {
+		metrics = append(metrics, prometheus.MustNewConstMetric(pgReplayLagDesc, prometheus.GaugeValue, replayLag))
+	}
+	return metrics, nil
+}
+
+// queryLabelledValues runs a query returning a name and numeric values per row, passing relations as the
+// only argument unless it is nil.
+func queryLabelledValues(ctx context.Context, tx *sql.Tx, query string, relations []string, f func(name string, values []float64)) error {
+	var args []interface{}
+	if relations != nil {
+		args = append(args, relations)
+	}
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		values := make([]float64, len(columns)-1)
+		dest := []interface{}{&name}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		f(name, values)
+	}
+	return rows.Err()
+}
+
+// relations returns the names of the tables the adapter writes to.
+func (c *Client) relations() []string {
+	t := c.cfg.Table
+	if _, ok := c.labels.(*normalizedLabelStore); ok {
+		return []string{t + "_values", t + "_labels", t + "_label_keys", t + "_label_kv"}
+	}
+	return []string{t + "_values", t + "_labels"}
+}
+
+// DatabaseStats returns the collector for the database statistics, or nil if they are disabled.
+func (c *Client) DatabaseStats() prometheus.Collector {
+	if c.stats == nil {
+		return nil
+	}
+	return c.stats
+}
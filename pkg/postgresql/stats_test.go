@@ -0,0 +1,42 @@
+package pgprometheus
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDatabaseStatsDown(t *testing.T) {
+	db, err := sql.Open("pgx", "host=127.0.0.1 port=1 connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{DB: db, cfg: &Config{Table: "metrics"}, labels: &jsonbLabelStore{table: "metrics"}}
+	defer client.Close()
+	stats := newDatabaseStats(client, time.Minute, time.Second)
+	stats.update()
+
+	expected := `
+# HELP adapter_pg_up Whether the last collection of database statistics succeeded.
+# TYPE adapter_pg_up gauge
+adapter_pg_up 0
+`
+	if err := testutil.CollectAndCompare(stats, strings.NewReader(expected), "adapter_pg_up"); err != nil {
+		t.Error(err)
+	}
+	if client.DatabaseStats() != nil {
+		t.Error("Expected no collector when the statistics are disabled")
+	}
+}
+
+func TestRelations(t *testing.T) {
+	client := &Client{cfg: &Config{Table: "metrics"}, labels: &normalizedLabelStore{table: "metrics"}}
+	expected := []string{"metrics_values", "metrics_labels", "metrics_label_keys", "metrics_label_kv"}
+	if relations := client.relations(); !reflect.DeepEqual(relations, expected) {
+		t.Errorf("Expected %v, got %v", expected, relations)
+	}
+}
@@ -0,0 +1,101 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlReportHypertable  = "select exists (select 1 from timescaledb_information.hypertables where hypertable_schema = current_schema() and hypertable_name = $1)"
+	sqlReportRows        = "select greatest(coalesce((select reltuples from pg_class where oid = to_regclass($1)), 0), 0)::bigint"
+	sqlReportHyperRows   = "select approximate_row_count(to_regclass($1))"
+	sqlReportCompression = "select coalesce(sum(before_compression_total_bytes), 0), coalesce(sum(after_compression_total_bytes), 0) from hypertable_compression_stats(to_regclass($1))"
+)
+
+// StorageReport is the size on disk of the tables the adapter writes to.
+type StorageReport struct {
+	// ValuesBytes is the size of the values table, LabelsBytes that of the label tables, without indexes.
+	ValuesBytes int64
+	LabelsBytes int64
+	// IndexBytes is the size of the indexes of all tables.
+	IndexBytes int64
+	// Samples is the estimated number of rows of the values table, from the statistics of the planner.
+	Samples int64
+	// CompressionRatio is the size of the compressed chunks of the values hypertable before compression over
+	// their size after, 0 if no chunk is compressed.
+	CompressionRatio float64
+}
+
+// TotalBytes returns the size of the tables with their indexes.
+func (r StorageReport) TotalBytes() int64 {
+	return r.ValuesBytes + r.LabelsBytes + r.IndexBytes
+}
+
+// StorageReport measures the size of the tables the adapter writes to in a read-only transaction, with the
+// statements bounded by timeout. Hypertables are measured with hypertable_detailed_size, which sums up their
+// chunks, and their rows estimated with approximate_row_count.
+func (c *Client) StorageReport(ctx context.Context, timeout time.Duration) (StorageReport, error) {
+	var report StorageReport
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("set local statement_timeout = %d", timeout.Milliseconds())); err != nil {
+		return report, err
+	}
+	relations := c.relations()
+	values := relations[0]
+	sizes := map[string][]float64{}
+	err = queryLabelledValues(ctx, tx, sqlStatsSizes, relations, func(name string, v []float64) {
+		sizes[name] = v
+	})
+	if err != nil {
+		return report, err
+	}
+	var timescale, hypertable bool
+	if err := tx.QueryRowContext(ctx, sqlStatsTimescale).Scan(&timescale); err != nil {
+		return report, err
+	}
+	if timescale {
+		if err := tx.QueryRowContext(ctx, sqlReportHypertable, values).Scan(&hypertable); err != nil {
+			return report, err
+		}
+		err = queryLabelledValues(ctx, tx, sqlStatsHyperSizes, relations, func(name string, v []float64) {
+			sizes[name] = v
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	for name, v := range sizes {
+		if name == values {
+			report.ValuesBytes += int64(v[0])
+		} else {
+			report.LabelsBytes += int64(v[0])
+		}
+		report.IndexBytes += int64(v[1])
+	}
+	rows := sqlReportRows
+	if hypertable {
+		rows = sqlReportHyperRows
+	}
+	if err := tx.QueryRowContext(ctx, rows, values).Scan(&report.Samples); err != nil {
+		return report, err
+	}
+	if hypertable {
+		var before, after float64
+		if err := tx.QueryRowContext(ctx, sqlReportCompression, values).Scan(&before, &after); err != nil {
+			return report, err
+		}
+		if after > 0 {
+			report.CompressionRatio = before / after
+		}
+	}
+	return report, nil
+}
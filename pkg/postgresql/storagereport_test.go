@@ -0,0 +1,51 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestStorageReport measures plain tables of the jsonb layout. It needs a database, given as connection
+// string in TS_PROM_TEST_PG_DSN.
+func TestStorageReport(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		"create table report_test_metrics_labels (id serial primary key, metric_name text not null, labels jsonb not null, unique (metric_name, labels))",
+		"create table report_test_metrics_values (time timestamp with time zone not null, value double precision, labels_id integer references report_test_metrics_labels (id))",
+		`insert into report_test_metrics_labels (metric_name, labels) values ('up', '{"job": "node"}')`,
+		"insert into report_test_metrics_values select to_timestamp(i), i, 1 from generate_series(1, 1000) i",
+		"analyze report_test_metrics_labels, report_test_metrics_values",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		_, _ = db.Exec("drop table report_test_metrics_values, report_test_metrics_labels")
+	}()
+	client := &Client{DB: db, cfg: &Config{Table: "report_test_metrics"}, labels: &jsonbLabelStore{table: "report_test_metrics"}}
+	report, err := client.StorageReport(context.Background(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ValuesBytes <= 0 || report.LabelsBytes <= 0 || report.IndexBytes <= 0 {
+		t.Errorf("Expected the sizes of the tables and their indexes, got %+v", report)
+	}
+	if report.Samples != 1000 || report.CompressionRatio != 0 {
+		t.Errorf("Expected 1000 samples without compression, got %+v", report)
+	}
+	if report.TotalBytes() != report.ValuesBytes+report.LabelsBytes+report.IndexBytes {
+		t.Errorf("Expected the total to sum up the sizes, got %d", report.TotalBytes())
+	}
+}
@@ -0,0 +1,78 @@
+package pgprometheus
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// connParam renders a value of a connection string parameter, quoted so that paths may contain spaces.
+func connParam(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// tlsConnParams returns the connection string parameters of the certificate files of the configuration,
+// after checking that the files exist and parse. pgx reads them as well, but its errors don't tell which
+// setting is wrong.
+func tlsConnParams(cfg *Config) (string, error) {
+	var params []string
+	if cfg.SSLRootCert != "" {
+		pem, err := os.ReadFile(cfg.SSLRootCert)
+		if err != nil {
+			return "", fmt.Errorf("error reading the root certificate: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("the root certificate file %s has no PEM encoded certificate", cfg.SSLRootCert)
+		}
+		params = append(params, "sslrootcert="+connParam(cfg.SSLRootCert))
+	}
+	switch {
+	case cfg.SSLCert == "" && cfg.SSLKey == "":
+	case cfg.SSLCert == "" || cfg.SSLKey == "":
+		return "", fmt.Errorf("a client certificate and its key must be given together")
+	default:
+		if _, err := tls.LoadX509KeyPair(cfg.SSLCert, cfg.SSLKey); err != nil {
+			return "", fmt.Errorf("error loading the client certificate: %w", err)
+		}
+		params = append(params, "sslcert="+connParam(cfg.SSLCert), "sslkey="+connParam(cfg.SSLKey))
+	}
+	if len(params) > 0 && (cfg.SSLMode == "disable" || cfg.SSLMode == "allow" || cfg.SSLMode == "prefer") {
+		return "", fmt.Errorf("certificates require the ssl mode require, verify-ca or verify-full, got %q", cfg.SSLMode)
+	}
+	return strings.Join(params, " "), nil
+}
+
+// describeTLSError explains why the server certificate failed verification, if it did.
+func describeTLSError(err error) error {
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) {
+		return fmt.Errorf("the server certificate is valid for other host names than %s, connect by one of those or use the ssl mode verify-ca: %w", hostnameErr.Host, err)
+	}
+	var authorityErr x509.UnknownAuthorityError
+	if errors.As(err, &authorityErr) {
+		return fmt.Errorf("the server certificate isn't signed by the root certificate: %w", err)
+	}
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &invalidErr) {
+		return fmt.Errorf("the server certificate is invalid: %w", err)
+	}
+	return err
+}
+
+// tlsConnector explains failed verifications of the server certificate.
+type tlsConnector struct {
+	driver.Connector
+}
+
+func (c *tlsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		err = describeTLSError(err)
+	}
+	return conn, err
+}
@@ -0,0 +1,199 @@
+package pgprometheus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate and its key, signed by parent or self-signed.
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func newTestCA(t *testing.T, name string) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: name}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+}
+
+// writeFiles writes the certificate and its key as PEM files, returning their paths.
+func (c *testCertificate) writeFiles(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// serveTLS accepts PostgreSQL connections requesting TLS and completes the TLS handshake with the certificate,
+// closing the connections right after.
+func serveTLS(t *testing.T, cert *testCertificate) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.der}, PrivateKey: cert.key}}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// SSLRequest
+				if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte("S")); err != nil {
+					return
+				}
+				_ = tls.Server(conn, tlsConfig).Handshake()
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestTLSVerificationErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test root")
+	caPath, _ := ca.writeFiles(t, dir, "root")
+	otherCAPath, _ := newTestCA(t, "other root").writeFiles(t, dir, "other")
+	server := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "db.example.test"}, DNSNames: []string{"db.example.test"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+	port := serveTLS(t, server)
+
+	for _, c := range []struct {
+		name     string
+		sslMode  string
+		rootCert string
+		expected string
+	}{
+		{name: "hostname mismatch", sslMode: "verify-full", rootCert: caPath, expected: "valid for other host names than 127.0.0.1"},
+		{name: "unknown authority", sslMode: "verify-ca", rootCert: otherCAPath, expected: "isn't signed by the root certificate"},
+		{name: "unknown authority with require", sslMode: "require", rootCert: otherCAPath, expected: "isn't signed by the root certificate"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.Host, cfg.Port = "127.0.0.1", port
+			cfg.SSLMode, cfg.SSLRootCert = c.sslMode, c.rootCert
+			cfg.CircuitBreakerFailures = 0
+			client, err := NewClient(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			err = client.HealthCheck()
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Errorf("Expected an error containing %q, got %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestTLSConnParams(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test root")
+	caPath, _ := ca.writeFiles(t, dir, "root")
+	client := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "adapter"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	certPath, keyPath := client.writeFiles(t, dir, "client's cert")
+	_, otherKeyPath := newTestCA(t, "other").writeFiles(t, dir, "other")
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{SSLMode: "verify-full", SSLRootCert: caPath, SSLCert: certPath, SSLKey: keyPath}
+	params, err := tlsConnParams(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "sslrootcert='" + caPath + "' sslcert='" + strings.ReplaceAll(certPath, "'", `\'`) + "' sslkey='" + strings.ReplaceAll(keyPath, "'", `\'`) + "'"
+	if params != expected {
+		t.Errorf("Expected %s, got %s", expected, params)
+	}
+	// pgx loads the files of the quoted paths
+	full := DefaultConfig()
+	full.SSLMode, full.SSLRootCert, full.SSLCert, full.SSLKey = cfg.SSLMode, cfg.SSLRootCert, cfg.SSLCert, cfg.SSLKey
+	if c, err := NewClient(full); err != nil {
+		t.Errorf("Expected the client to accept the certificates, got %v", err)
+	} else {
+		c.Close()
+	}
+
+	for name, cfg := range map[string]*Config{
+		"missing root":      {SSLMode: "verify-ca", SSLRootCert: filepath.Join(dir, "missing.crt")},
+		"invalid root":      {SSLMode: "verify-ca", SSLRootCert: garbage},
+		"cert without key":  {SSLMode: "require", SSLCert: certPath},
+		"mismatched key":    {SSLMode: "require", SSLCert: certPath, SSLKey: otherKeyPath},
+		"unverified mode":   {SSLMode: "prefer", SSLRootCert: caPath},
+		"disabled with key": {SSLMode: "disable", SSLCert: certPath, SSLKey: keyPath},
+	} {
+		if _, err := tlsConnParams(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if params, err := tlsConnParams(&Config{SSLMode: "disable"}); err != nil || params != "" {
+		t.Errorf("Expected no parameters without certificates, got %q, %v", params, err)
+	}
+}
+
+func TestConnParamQuoting(t *testing.T) {
+	for value, expected := range map[string]string{
+		"/etc/ssl/root.crt":    "'/etc/ssl/root.crt'",
+		`C:\certs\my root.crt`: `'C:\\certs\\my root.crt'`,
+		"it's.crt":             `'it\'s.crt'`,
+	} {
+		if quoted := connParam(value); quoted != expected {
+			t.Errorf("Expected %s, got %s", expected, quoted)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// TSDBStatusLimit is the number of entries of each top list of the TSDB status.
+const TSDBStatusLimit = 10
+
+// noinspection SqlNoDataSourceInspection
+const (
+	// sqlStatusPairs is the relation of the label pairs of the label sets, including the metric name
+	sqlStatusPairs           = "(select l.id, p.key, p.value from %s l, jsonb_each_text(l.labels || jsonb_build_object('%s', l.metric_name)) p) p"
+	sqlStatusSeries          = "select count(*) from %s"
+	sqlStatusSeriesByMetric  = "select metric_name, count(*) from %s group by metric_name order by 2 desc, 1 limit $1"
+	sqlStatusLabelNames      = "select p.key, count(distinct p.value), sum(pg_column_size(p.value)) from %s group by p.key"
+	sqlStatusSeriesByPair    = "select p.key || '=' || p.value, count(*) from %s group by p.key, p.value order by 2 desc, 1 limit $1"
+	sqlStatusLabelPairsCount = "select count(*) from (select distinct p.key, p.value from %s) pairs"
+)
+
+// TSDBStat is an entry of a top list of the TSDB status.
+type TSDBStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// TSDBHeadStats are the totals of the TSDB status. Only the fields derived from the label sets are set.
+type TSDBHeadStats struct {
+	NumSeries     uint64 `json:"numSeries"`
+	NumLabelPairs uint64 `json:"numLabelPairs"`
+}
+
+// TSDBStatus is the cardinality of the stored label sets, in the shape of the /api/v1/status/tsdb response of
+// Prometheus. MemoryInBytesByLabelName approximates the memory of Prometheus with the size on disk of the
+// label values.
+type TSDBStatus struct {
+	HeadStats                   TSDBHeadStats `json:"headStats"`
+	SeriesCountByMetricName     []TSDBStat    `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName  []TSDBStat    `json:"labelValueCountByLabelName"`
+	MemoryInBytesByLabelName    []TSDBStat    `json:"memoryInBytesByLabelName"`
+	SeriesCountByLabelValuePair []TSDBStat    `json:"seriesCountByLabelValuePair"`
+}
+
+// TSDBStatus aggregates the label sets of the labels table into the TSDB status, in a read-only transaction
+// with the statements bounded by timeout. The aggregations scan the whole labels table.
+func (c *Client) TSDBStatus(ctx context.Context, timeout time.Duration) (TSDBStatus, error) {
+	var status TSDBStatus
+	tx, err := c.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return status, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("set local statement_timeout = %d", timeout.Milliseconds())); err != nil {
+		return status, err
+	}
+	relation := c.labels.labelsRelation()
+	pairs := fmt.Sprintf(sqlStatusPairs, relation, model.MetricNameLabel)
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(sqlStatusSeries, relation)).Scan(&status.HeadStats.NumSeries); err != nil {
+		return status, err
+	}
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(sqlStatusLabelPairsCount, pairs)).Scan(&status.HeadStats.NumLabelPairs); err != nil {
+		return status, err
+	}
+	if status.SeriesCountByMetricName, err = queryTSDBStats(ctx, tx, fmt.Sprintf(sqlStatusSeriesByMetric, relation)); err != nil {
+		return status, err
+	}
+	if status.SeriesCountByLabelValuePair, err = queryTSDBStats(ctx, tx, fmt.Sprintf(sqlStatusSeriesByPair, pairs)); err != nil {
+		return status, err
+	}
+	// there are few label names, so both of their lists are sorted here
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(sqlStatusLabelNames, pairs))
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+	var values, bytes []TSDBStat
+	for rows.Next() {
+		var (
+			name       string
+			count, sum uint64
+		)
+		if err := rows.Scan(&name, &count, &sum); err != nil {
+			return status, err
+		}
+		values = append(values, TSDBStat{Name: name, Value: count})
+		bytes = append(bytes, TSDBStat{Name: name, Value: sum})
+	}
+	if err := rows.Err(); err != nil {
+		return status, err
+	}
+	status.LabelValueCountByLabelName = topTSDBStats(values)
+	status.MemoryInBytesByLabelName = topTSDBStats(bytes)
+	return status, nil
+}
+
+func queryTSDBStats(ctx context.Context, tx *sql.Tx, query string) ([]TSDBStat, error) {
+	rows, err := tx.QueryContext(ctx, query, TSDBStatusLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := []TSDBStat{}
+	for rows.Next() {
+		var stat TSDBStat
+		if err := rows.Scan(&stat.Name, &stat.Value); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// topTSDBStats returns the TSDBStatusLimit entries with the highest values, the highest first.
+func topTSDBStats(stats []TSDBStat) []TSDBStat {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Value != stats[j].Value {
+			return stats[i].Value > stats[j].Value
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	if len(stats) > TSDBStatusLimit {
+		stats = stats[:TSDBStatusLimit]
+	}
+	if stats == nil {
+		stats = []TSDBStat{}
+	}
+	return stats
+}
@@ -0,0 +1,73 @@
+package pgprometheus
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopTSDBStats(t *testing.T) {
+	var stats []TSDBStat
+	for i := 0; i < TSDBStatusLimit+2; i++ {
+		stats = append(stats, TSDBStat{Name: string(rune('a' + i)), Value: uint64(i % 3)})
+	}
+	top := topTSDBStats(stats)
+	if len(top) != TSDBStatusLimit {
+		t.Fatalf("Expected %d entries, got %d", TSDBStatusLimit, len(top))
+	}
+	if want := []TSDBStat{{"c", 2}, {"f", 2}, {"i", 2}, {"l", 2}}; !reflect.DeepEqual(top[:4], want) {
+		t.Errorf("Expected the highest values first by name, got %v", top[:4])
+	}
+	if top := topTSDBStats(nil); top == nil || len(top) != 0 {
+		t.Errorf("Expected an empty list, got %#v", top)
+	}
+}
+
+// TestTSDBStatus aggregates label sets of the jsonb layout. It needs a database, given as connection string
+// in TS_PROM_TEST_PG_DSN.
+func TestTSDBStatus(t *testing.T) {
+	dsn := os.Getenv("TS_PROM_TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TS_PROM_TEST_PG_DSN not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		"create table status_test_metrics_labels (id serial primary key, metric_name text not null, labels jsonb not null, unique (metric_name, labels))",
+		`insert into status_test_metrics_labels (metric_name, labels) values ('up', '{"job": "node", "instance": "a"}'), ('up', '{"job": "node", "instance": "b"}'), ('http_requests_total', '{"job": "api"}')`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		_, _ = db.Exec("drop table status_test_metrics_labels")
+	}()
+	client := &Client{DB: db, cfg: &Config{Table: "status_test_metrics"}, labels: &jsonbLabelStore{table: "status_test_metrics"}}
+	status, err := client.TSDBStatus(context.Background(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// __name__=up, __name__=http_requests_total, job=node, job=api, instance=a, instance=b
+	if status.HeadStats != (TSDBHeadStats{NumSeries: 3, NumLabelPairs: 6}) {
+		t.Errorf("Unexpected head stats %+v", status.HeadStats)
+	}
+	if want := []TSDBStat{{"up", 2}, {"http_requests_total", 1}}; !reflect.DeepEqual(status.SeriesCountByMetricName, want) {
+		t.Errorf("Expected series by metric name %v, got %v", want, status.SeriesCountByMetricName)
+	}
+	if want := []TSDBStat{{"__name__", 2}, {"instance", 2}, {"job", 2}}; !reflect.DeepEqual(status.LabelValueCountByLabelName, want) {
+		t.Errorf("Expected label value counts %v, got %v", want, status.LabelValueCountByLabelName)
+	}
+	if len(status.MemoryInBytesByLabelName) != 3 || status.MemoryInBytesByLabelName[0].Value == 0 {
+		t.Errorf("Expected the size of the values of 3 label names, got %v", status.MemoryInBytesByLabelName)
+	}
+	if want := (TSDBStat{"__name__=up", 2}); status.SeriesCountByLabelValuePair[0] != want {
+		t.Errorf("Expected %v first, got %v", want, status.SeriesCountByLabelValuePair)
+	}
+}
@@ -0,0 +1,102 @@
+package pgprometheus
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Policies for label names and values that aren't valid UTF-8, which PostgreSQL refuses.
+const (
+	invalidUTF8Replace = "replace"
+	invalidUTF8Base64  = "base64"
+	invalidUTF8Drop    = "drop"
+)
+
+// Base64LabelsLabel lists the labels of which the values were base64 encoded by the base64 policy for
+// invalid UTF-8, comma-separated and ordered.
+const Base64LabelsLabel = "__base64_labels__"
+
+// InvalidUTF8Samples counts the samples with label names or values that aren't valid UTF-8.
+var InvalidUTF8Samples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "invalid_utf8_samples_total",
+		Help: "Total number of samples with label names or values that aren't valid UTF-8, handled according to the invalid UTF-8 policy.",
+	},
+)
+
+// toValidUTF8 replaces each run of bytes that aren't valid UTF-8 with a single U+FFFD.
+func toValidUTF8(s string) string {
+	return strings.ToValidUTF8(s, string(utf8.RuneError))
+}
+
+func validMetric(m model.Metric) bool {
+	for name, value := range m {
+		if !utf8.ValidString(string(name)) || !utf8.ValidString(string(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeMetric returns the metric with valid UTF-8 label names and values. Names are always replaced,
+// values are base64 encoded with the base64 policy and replaced otherwise. Names that only differ in invalid
+// bytes end up the same, the value of the greatest raw name is kept.
+func normalizeMetric(m model.Metric, policy string) model.Metric {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	normalized := make(model.Metric, len(m)+1)
+	var encoded []string
+	for _, name := range names {
+		value := m[model.LabelName(name)]
+		validName := model.LabelName(toValidUTF8(string(name)))
+		switch {
+		case utf8.ValidString(string(value)):
+			normalized[validName] = value
+		case policy == invalidUTF8Base64:
+			normalized[validName] = model.LabelValue(base64.StdEncoding.EncodeToString([]byte(value)))
+			encoded = append(encoded, string(validName))
+		default:
+			normalized[validName] = model.LabelValue(toValidUTF8(string(value)))
+		}
+	}
+	if len(encoded) > 0 {
+		sort.Strings(encoded)
+		normalized[Base64LabelsLabel] = model.LabelValue(strings.Join(encoded, ","))
+	}
+	return normalized
+}
+
+// normalizeUTF8 applies the invalid UTF-8 policy to the samples, returning the samples to write and the
+// dropped ones. Samples are only copied if their metric is invalid; the metrics of the others are shared.
+func normalizeUTF8(samples model.Samples, policy string) (model.Samples, model.Samples) {
+	var normalized, dropped model.Samples
+	for i, sample := range samples {
+		if validMetric(sample.Metric) {
+			if normalized != nil {
+				normalized = append(normalized, sample)
+			}
+			continue
+		}
+		if normalized == nil {
+			normalized = append(make(model.Samples, 0, len(samples)), samples[:i]...)
+		}
+		InvalidUTF8Samples.Inc()
+		if policy == invalidUTF8Drop {
+			dropped = append(dropped, sample)
+			continue
+		}
+		normalized = append(normalized, &model.Sample{Metric: normalizeMetric(sample.Metric, policy), Value: sample.Value, Timestamp: sample.Timestamp})
+	}
+	if normalized == nil {
+		return samples, nil
+	}
+	return normalized, dropped
+}
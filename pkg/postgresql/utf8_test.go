@@ -0,0 +1,105 @@
+package pgprometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestMetricMetaJsonInvalidUTF8(t *testing.T) {
+	testCases := []struct {
+		name         string
+		metric       model.Metric
+		expectedName string
+		expected     string
+	}{
+		{
+			name:         "invalid value",
+			metric:       model.Metric{model.MetricNameLabel: "up", "job": "a\xffb"},
+			expectedName: "up",
+			expected:     "{\"job\": \"a\xef\xbf\xbdb\"}",
+		},
+		{
+			name:         "run of invalid bytes",
+			metric:       model.Metric{model.MetricNameLabel: "up", "job": "\xc3\x28\xfe\xff"},
+			expectedName: "up",
+			expected:     "{\"job\": \"\xef\xbf\xbd(\xef\xbf\xbd\"}",
+		},
+		{
+			name:         "invalid name and metric name",
+			metric:       model.Metric{model.MetricNameLabel: "up\x80", "j\xffob": "node"},
+			expectedName: "up\xef\xbf\xbd",
+			expected:     "{\"j\xef\xbf\xbdob\": \"node\"}",
+		},
+		{
+			name:         "truncated multi-byte sequence",
+			metric:       model.Metric{model.MetricNameLabel: "up", "city": "K\xc3\xb8benhav\xe2\x82"},
+			expectedName: "up",
+			expected:     "{\"city\": \"K\xc3\xb8benhav\xef\xbf\xbd\"}",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			name, labelsJson := MetricMetaJson(c.metric)
+			if name != c.expectedName {
+				t.Errorf("Expected metric name %q, got %q", c.expectedName, name)
+			}
+			if labelsJson != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, labelsJson)
+			}
+		})
+	}
+}
+
+func TestNormalizeUTF8(t *testing.T) {
+	valid := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "job": "node"}, Value: 1, Timestamp: 1}
+	invalid := &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "job": "a\xffb", "in\xffstance": "c\xfe"}, Value: 2, Timestamp: 2}
+	testCases := []struct {
+		policy   string
+		expected model.Metric
+	}{
+		{
+			policy:   invalidUTF8Replace,
+			expected: model.Metric{model.MetricNameLabel: "up", "job": "a\xef\xbf\xbdb", "in\xef\xbf\xbdstance": "c\xef\xbf\xbd"},
+		},
+		{
+			policy:   invalidUTF8Base64,
+			expected: model.Metric{model.MetricNameLabel: "up", "job": "Yf9i", "in\xef\xbf\xbdstance": "Y/4=", Base64LabelsLabel: "in\xef\xbf\xbdstance,job"},
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.policy, func(t *testing.T) {
+			samples, dropped := normalizeUTF8(model.Samples{valid, invalid}, c.policy)
+			if len(dropped) != 0 || len(samples) != 2 {
+				t.Fatalf("Expected 2 samples and none dropped, got %d and %d", len(samples), len(dropped))
+			}
+			if samples[0] != valid {
+				t.Error("Expected the valid sample to be kept as is")
+			}
+			if !samples[1].Metric.Equal(c.expected) {
+				t.Errorf("Expected %v, got %v", c.expected, samples[1].Metric)
+			}
+			if samples[1].Value != 2 || samples[1].Timestamp != 2 {
+				t.Errorf("Expected the value and timestamp to be kept, got %v", samples[1])
+			}
+			if invalid.Metric["job"] != "a\xffb" {
+				t.Error("Expected the original metric to stay untouched")
+			}
+		})
+	}
+
+	t.Run(invalidUTF8Drop, func(t *testing.T) {
+		samples, dropped := normalizeUTF8(model.Samples{invalid, valid}, invalidUTF8Drop)
+		if len(samples) != 1 || samples[0] != valid {
+			t.Errorf("Expected only the valid sample to be kept, got %v", samples)
+		}
+		if len(dropped) != 1 || dropped[0] != invalid {
+			t.Errorf("Expected the invalid sample to be dropped, got %v", dropped)
+		}
+	})
+
+	all := model.Samples{valid, valid}
+	if samples, _ := normalizeUTF8(all, invalidUTF8Drop); &samples[0] != &all[0] {
+		t.Error("Expected valid samples not to be copied")
+	}
+}
@@ -0,0 +1,135 @@
+package pgprometheus
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// OutOfOrderSamples counts the samples dropped for being older than the committed samples of their series.
+var OutOfOrderSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "out_of_order_samples_dropped_total",
+		Help: "Total number of samples dropped because they are older than the latest committed sample of their series minus the tolerance.",
+	},
+)
+
+// noinspection SqlNoDataSourceInspection
+const sqlSeriesWatermark = "select max(v.time) from %s_values v where v.labels_id in (select l.id from %s l where l.metric_name = $1 and l.labels in ($2::jsonb, $3::jsonb))"
+
+type watermarkEntry struct {
+	fingerprint model.Fingerprint
+	timestamp   model.Time
+}
+
+// watermarkCache is a bounded LRU of the latest committed timestamp per series. Missing series are
+// looked up lazily through lookup.
+type watermarkCache struct {
+	size      int
+	tolerance time.Duration
+	lookup    func(ctx context.Context, metric model.Metric) (model.Time, error)
+
+	mutex   sync.Mutex
+	entries *list.List
+	index   map[model.Fingerprint]*list.Element
+}
+
+func newWatermarkCache(size int, tolerance time.Duration, lookup func(ctx context.Context, metric model.Metric) (model.Time, error)) *watermarkCache {
+	return &watermarkCache{
+		size:      size,
+		tolerance: tolerance,
+		lookup:    lookup,
+		entries:   list.New(),
+		index:     map[model.Fingerprint]*list.Element{},
+	}
+}
+
+func (w *watermarkCache) get(fp model.Fingerprint) (model.Time, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	element, ok := w.index[fp]
+	if !ok {
+		return 0, false
+	}
+	w.entries.MoveToFront(element)
+	return element.Value.(*watermarkEntry).timestamp, true
+}
+
+// raise sets the watermark of the series, unless it is already higher.
+func (w *watermarkCache) raise(fp model.Fingerprint, timestamp model.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if element, ok := w.index[fp]; ok {
+		entry := element.Value.(*watermarkEntry)
+		if timestamp > entry.timestamp {
+			entry.timestamp = timestamp
+		}
+		w.entries.MoveToFront(element)
+		return
+	}
+	w.index[fp] = w.entries.PushFront(&watermarkEntry{fingerprint: fp, timestamp: timestamp})
+	if w.entries.Len() > w.size {
+		oldest := w.entries.Back()
+		w.entries.Remove(oldest)
+		delete(w.index, oldest.Value.(*watermarkEntry).fingerprint)
+	}
+}
+
+// filter splits off the samples older than the watermark of their series minus the tolerance. Series whose
+// watermark can't be looked up are let through.
+func (w *watermarkCache) filter(ctx context.Context, samples model.Samples) (accepted model.Samples, rejected model.Samples) {
+	tolerance := model.Duration(w.tolerance)
+	accepted = make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		watermark, ok := w.get(fp)
+		if !ok {
+			var err error
+			watermark, err = w.lookup(ctx, s.Metric)
+			if err != nil {
+				log.Warn("msg", "Error looking up latest sample of series, accepting sample", "err", err)
+				accepted = append(accepted, s)
+				continue
+			}
+			w.raise(fp, watermark)
+		}
+		if s.Timestamp.Add(time.Duration(tolerance)) < watermark {
+			OutOfOrderSamples.Inc()
+			rejected = append(rejected, s)
+			continue
+		}
+		accepted = append(accepted, s)
+	}
+	return accepted, rejected
+}
+
+// advance raises the watermarks to the committed samples.
+func (w *watermarkCache) advance(samples model.Samples) {
+	for _, s := range samples {
+		w.raise(s.Metric.Fingerprint(), s.Timestamp)
+	}
+}
+
+// latestSampleTime looks up the timestamp of the latest committed sample of the series, with or without the
+// metric name in its labels.
+func (c *Client) latestSampleTime(ctx context.Context, metric model.Metric) (model.Time, error) {
+	metricName, labelsJson := MetricMetaJson(metric)
+	_, labelsJsonWithName := metricMetaJson(metric, true)
+	var latest sql.NullTime
+	query := fmt.Sprintf(sqlSeriesWatermark, c.cfg.Table, c.labels.labelsRelation())
+	if err := c.DB.QueryRowContext(ctx, query, metricName, labelsJson, labelsJsonWithName).Scan(&latest); err != nil {
+		return 0, err
+	}
+	if !latest.Valid {
+		return 0, nil
+	}
+	return model.TimeFromUnixNano(latest.Time.UnixNano()), nil
+}
@@ -0,0 +1,76 @@
+package pgprometheus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func TestWatermarkCacheFilter(t *testing.T) {
+	lookups := 0
+	stored := map[model.LabelValue]model.Time{"a": 1000, "b": 0}
+	cache := newWatermarkCache(10, 100*time.Millisecond, func(ctx context.Context, metric model.Metric) (model.Time, error) {
+		lookups++
+		if metric["job"] == "broken" {
+			return 0, errors.New("database down")
+		}
+		return stored[metric["job"]], nil
+	})
+	a := model.Metric{model.MetricNameLabel: "up", "job": "a"}
+	b := model.Metric{model.MetricNameLabel: "up", "job": "b"}
+	broken := model.Metric{model.MetricNameLabel: "up", "job": "broken"}
+
+	before := testutil.ToFloat64(OutOfOrderSamples)
+	samples := model.Samples{
+		{Metric: a, Timestamp: 850},
+		{Metric: a, Timestamp: 950},
+		{Metric: a, Timestamp: 1200},
+		{Metric: b, Timestamp: 10},
+		{Metric: broken, Timestamp: 10},
+	}
+	accepted, rejected := cache.filter(context.Background(), samples)
+	expected := model.Samples{samples[1], samples[2], samples[3], samples[4]}
+	if !accepted.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, accepted)
+	}
+	if !rejected.Equal(model.Samples{samples[0]}) {
+		t.Errorf("Expected the oldest sample to be rejected, got %v", rejected)
+	}
+	if delta := testutil.ToFloat64(OutOfOrderSamples) - before; delta != 1 {
+		t.Errorf("Expected one dropped sample, got %v", delta)
+	}
+	if lookups != 3 {
+		t.Errorf("Expected one lookup per series, got %d", lookups)
+	}
+
+	cache.advance(accepted)
+	accepted, _ = cache.filter(context.Background(), model.Samples{{Metric: a, Timestamp: 1050}, {Metric: a, Timestamp: 1150}})
+	if len(accepted) != 1 || accepted[0].Timestamp != 1150 {
+		t.Errorf("Expected the committed samples to raise the watermark, got %v", accepted)
+	}
+	if lookups != 3 {
+		t.Errorf("Expected cached series not to be looked up again, got %d lookups", lookups)
+	}
+}
+
+func TestWatermarkCacheEviction(t *testing.T) {
+	cache := newWatermarkCache(2, 0, nil)
+	cache.raise(1, 10)
+	cache.raise(2, 20)
+	cache.get(1)
+	cache.raise(3, 30)
+	if _, ok := cache.get(2); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if ts, ok := cache.get(1); !ok || ts != 10 {
+		t.Errorf("Expected recently used entry to be kept, got %v %v", ts, ok)
+	}
+	cache.raise(1, 5)
+	if ts, _ := cache.get(1); ts != 10 {
+		t.Errorf("Expected watermark not to move backwards, got %v", ts)
+	}
+}
@@ -0,0 +1,38 @@
+package pgprometheus
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Phases of the writes failing with a *WriteError, which errors.Is matches. ErrStaging covers setting up the
+// session of the write and copying the samples into the staging table, ErrLabelInsert inserting the label
+// sets and updating their provenance, and ErrValueInsert inserting the values, into the overflow table too,
+// or copying them into the values table with LabelsReadOnly.
+var (
+	ErrConnAcquire = errors.New("acquiring a connection")
+	ErrStaging     = errors.New("staging the samples")
+	ErrLabelInsert = errors.New("inserting the label sets")
+	ErrValueInsert = errors.New("inserting the values")
+	ErrCommit      = errors.New("committing")
+)
+
+// WriteError is returned by writes failing in one of their phases, so that callers can tell a session that
+// couldn't be set up, worth retrying on another connection, from samples the database refused. It wraps the
+// cause, which ClassifyError classes as before.
+type WriteError struct {
+	// Phase is ErrConnAcquire, ErrStaging, ErrLabelInsert, ErrValueInsert or ErrCommit.
+	Phase error
+	// Rows is the number of rows affected by the statements of the write before it failed, eg. samples staged
+	// and label sets inserted. Statements committing on their own, with the temp staging mode, stay committed.
+	Rows int64
+	Err  error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("error %v: %v", e.Phase, e.Err)
+}
+
+func (e *WriteError) Unwrap() []error {
+	return []error{e.Phase, e.Err}
+}
@@ -0,0 +1,279 @@
+package pgprometheus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/prometheus/common/model"
+)
+
+// Type OIDs of the columns of the staging and values tables, as described to COPY.
+var fakeColumnTypes = map[string]uint32{
+	"time":        1184,
+	"value":       701,
+	"metric_name": 25,
+	"labels":      3802,
+	"fingerprint": 20,
+	"labels_id":   20,
+}
+
+// fakePostgres speaks just enough of the PostgreSQL protocol for writes: statements succeed, inserts report
+// one row, until the first failures statements starting with failOn, which fail with failure. COPY input is
+// read before a COPY fails, like a COPY failing on its data.
+type fakePostgres struct {
+	listener net.Listener
+	failOn   string
+	failure  *pgproto3.ErrorResponse
+	failures int
+
+	mutex      sync.Mutex
+	statements []string
+}
+
+func newFakePostgres(t *testing.T, failOn string, failure *pgproto3.ErrorResponse) *fakePostgres {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakePostgres{listener: listener, failOn: failOn, failure: failure, failures: 1}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return s
+}
+
+// client returns a client of the server, configured by configure.
+func (s *fakePostgres) client(t *testing.T, configure func(cfg *Config)) *Client {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = s.listener.Addr().(*net.TCPAddr).Port
+	cfg.ClockSkewCheckInterval = 0
+	if configure != nil {
+		configure(cfg)
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// exec records a statement, returning the failure if it fails.
+func (s *fakePostgres) exec(query string) *pgproto3.ErrorResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statements = append(s.statements, query)
+	if s.failOn != "" && s.failures > 0 && strings.HasPrefix(strings.ToLower(query), s.failOn) {
+		s.failures--
+		return s.failure
+	}
+	return nil
+}
+
+func (s *fakePostgres) serve(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	for name, value := range map[string]string{"server_version": "16.0", "client_encoding": "UTF8", "standard_conforming_strings": "on", "DateStyle": "ISO, MDY", "integer_datetimes": "on", "TimeZone": "UTC"} {
+		backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	txStatus := byte('I')
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+	var described string
+	for {
+		if err := backend.Flush(); err != nil {
+			return
+		}
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.Parse:
+			described = msg.Query
+			backend.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Describe:
+			backend.Send(&pgproto3.ParameterDescription{})
+			backend.Send(describeColumns(described))
+		case *pgproto3.Sync:
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		case *pgproto3.Terminate:
+			return
+		case *pgproto3.Query:
+			query := msg.String
+			failure := s.exec(query)
+			tag := strings.ToUpper(strings.Fields(query)[0])
+			switch tag {
+			case "COPY":
+				backend.Send(&pgproto3.CopyInResponse{OverallFormat: 1})
+				if err := backend.Flush(); err != nil {
+					return
+				}
+				if !receiveCopy(backend) {
+					return
+				}
+				tag = "COPY 1"
+			case "INSERT":
+				tag = "INSERT 0 1"
+			}
+			if failure != nil {
+				backend.Send(failure)
+				if txStatus == 'T' {
+					txStatus = 'E'
+				}
+			} else {
+				backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+				switch tag {
+				case "BEGIN":
+					txStatus = 'T'
+				case "COMMIT", "ROLLBACK":
+					txStatus = 'I'
+				}
+			}
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		}
+	}
+}
+
+// receiveCopy reads the COPY input up to its end.
+func receiveCopy(backend *pgproto3.Backend) bool {
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return false
+		}
+		switch msg.(type) {
+		case *pgproto3.CopyDone, *pgproto3.CopyFail:
+			return true
+		}
+	}
+}
+
+// describeColumns describes the columns of the select COPY prepares to learn their types.
+func describeColumns(query string) *pgproto3.RowDescription {
+	columns := strings.TrimPrefix(query[:strings.Index(query, " from ")], "select ")
+	description := &pgproto3.RowDescription{}
+	for _, column := range strings.Split(columns, ", ") {
+		name := strings.Trim(column, `"`)
+		description.Fields = append(description.Fields, pgproto3.FieldDescription{Name: []byte(name), DataTypeOID: fakeColumnTypes[name], DataTypeSize: -1})
+	}
+	return description
+}
+
+func writeErrorSamples() model.Samples {
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "node"}
+	return model.Samples{{Metric: metric, Value: 1, Timestamp: 1000}, {Metric: metric, Value: 0, Timestamp: 2000}}
+}
+
+func TestWriteErrors(t *testing.T) {
+	dataError := &pgproto3.ErrorResponse{Severity: "ERROR", Code: "22P02", Message: "invalid input syntax", Where: "COPY metrics_tmp, line 2"}
+	for _, c := range []struct {
+		name     string
+		failOn   string
+		failure  *pgproto3.ErrorResponse
+		unlogged bool
+		phase    error
+		rows     int64
+		class    string
+	}{
+		{name: "create staging", failOn: "create temporary table", failure: &pgproto3.ErrorResponse{Severity: "ERROR", Code: "53100", Message: "could not extend file"}, phase: ErrStaging, rows: 0, class: "insufficient_resources"},
+		{name: "copy", failOn: "copy", failure: dataError, phase: ErrStaging, rows: 0, class: "data_exception"},
+		{name: "insert labels", failOn: "insert into metrics_labels", failure: &pgproto3.ErrorResponse{Severity: "ERROR", Code: "40P01", Message: "deadlock detected"}, phase: ErrLabelInsert, rows: 2, class: "transaction_rollback"},
+		{name: "insert values", failOn: "insert into metrics_values", failure: &pgproto3.ErrorResponse{Severity: "ERROR", Code: "23503", Message: "foreign key violation"}, phase: ErrValueInsert, rows: 3, class: "integrity_constraint_violation"},
+		{name: "begin unlogged", failOn: "begin", failure: &pgproto3.ErrorResponse{Severity: "FATAL", Code: "57P01", Message: "terminating connection due to administrator command"}, unlogged: true, phase: ErrStaging, rows: 0, class: "operator_intervention"},
+		{name: "commit unlogged", failOn: "commit", failure: &pgproto3.ErrorResponse{Severity: "ERROR", Code: "40001", Message: "could not serialize access"}, unlogged: true, phase: ErrCommit, rows: 4, class: "transaction_rollback"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := newFakePostgres(t, c.failOn, c.failure)
+			client := server.client(t, func(cfg *Config) {
+				if c.unlogged {
+					cfg.StagingMode, cfg.StagingInstanceID = stagingModeUnlogged, "test"
+				}
+			})
+			err := client.Write(writeErrorSamples())
+			var writeErr *WriteError
+			if !errors.As(err, &writeErr) {
+				t.Fatalf("Expected a *WriteError, got %v", err)
+			}
+			if !errors.Is(err, c.phase) || writeErr.Phase != c.phase || writeErr.Rows != c.rows {
+				t.Errorf("Expected phase %q after %d rows, got %q after %d rows", c.phase, c.rows, writeErr.Phase, writeErr.Rows)
+			}
+			if class, sqlState := ClassifyError(err); class != c.class || sqlState != c.failure.Code {
+				t.Errorf("Expected class %s of %s, got %s of %s", c.class, c.failure.Code, class, sqlState)
+			}
+			if c.failure == dataError {
+				var rowErr *rowError
+				if !errors.As(err, &rowErr) || rowErr.index != 1 {
+					t.Errorf("Expected the COPY error of the second sample, got %v", err)
+				}
+			}
+		})
+	}
+
+	t.Run("success", func(t *testing.T) {
+		server := newFakePostgres(t, "", nil)
+		if err := server.client(t, nil).Write(writeErrorSamples()); err != nil {
+			t.Fatal(err)
+		}
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		if n := len(server.statements); n < 6 {
+			t.Errorf("Expected the statements of a write, got %q", server.statements)
+		}
+	})
+}
+
+func TestWriteErrorConnAcquire(t *testing.T) {
+	server := newFakePostgres(t, "", nil)
+	client := server.client(t, func(cfg *Config) {
+		cfg.CircuitBreakerFailures = 1
+	})
+	_ = server.listener.Close()
+	err := client.Write(writeErrorSamples())
+	if !errors.Is(err, ErrConnAcquire) {
+		t.Fatalf("Expected the write to fail acquiring a connection, got %v", err)
+	}
+	if class, _ := ClassifyError(err); class != ErrorClassNetwork {
+		t.Errorf("Expected a network error, got %s", class)
+	}
+	// the circuit breaker sees through the phase
+	if err := client.Write(writeErrorSamples()); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected the circuit to open, got %v", err)
+	}
+}
+
+func TestWriteErrorPartialAccept(t *testing.T) {
+	server := newFakePostgres(t, "copy", &pgproto3.ErrorResponse{Severity: "ERROR", Code: "22P02", Message: "invalid input syntax", Where: "COPY metrics_tmp, line 2"})
+	client := server.client(t, func(cfg *Config) {
+		cfg.PartialAccept = true
+	})
+	_, err := client.WriteContext(context.Background(), writeErrorSamples())
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) || partial.Written != 1 || partial.Rejected != 1 {
+		t.Fatalf("Expected the sample the COPY failed on to be rejected, got %v", err)
+	}
+	if !errors.Is(err, ErrStaging) {
+		t.Errorf("Expected the first error to be kept, got %v", partial.Err)
+	}
+}
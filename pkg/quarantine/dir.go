@@ -0,0 +1,78 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const dirFileLayout = "20060102-15"
+
+// dirSink appends entries to hourly JSONL files in a directory.
+type dirSink struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+}
+
+// NewDir quarantines rejected samples in hourly JSONL files in dir. Files older than maxAge are removed,
+// as are the oldest files while all files together exceed maxBytes. recent is the number of entries kept
+// in memory for the recent endpoint.
+func NewDir(dir string, maxBytes int64, maxAge time.Duration, recent int) (*Quarantine, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating quarantine directory: %w", err)
+	}
+	return newQuarantine(&dirSink{dir: dir, maxBytes: maxBytes, maxAge: maxAge}, recent), nil
+}
+
+func (s *dirSink) write(entries []Entry) error {
+	name := filepath.Join(s.dir, fmt.Sprintf("quarantine-%s.jsonl", time.Now().UTC().Format(dirFileLayout)))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func (s *dirSink) prune(now time.Time) error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "quarantine-*.jsonl"))
+	if err != nil {
+		return err
+	}
+	// the names sort chronologically
+	sort.Strings(files)
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+	for i, file := range files {
+		hour, err := time.Parse(dirFileLayout, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "quarantine-"), ".jsonl"))
+		expired := err == nil && s.maxAge > 0 && now.Sub(hour.Add(time.Hour)) > s.maxAge
+		tooLarge := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !tooLarge {
+			break
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Package quarantine keeps the samples rejected by the write path, with the reason for the rejection,
+// so that they can be inspected later. Quarantining is best effort and never blocks the write path.
+package quarantine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/util"
+)
+
+const (
+	queueSize     = 1000
+	pruneInterval = time.Minute
+	// DefaultRecent is the number of entries returned by the recent endpoint when no limit is given.
+	DefaultRecent = 100
+)
+
+// Errors counts quarantine entries that could not be stored.
+var Errors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "quarantine_errors_total",
+		Help: "Total number of rejected samples that could not be quarantined.",
+	},
+)
+
+// Entry is a quarantined sample.
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	Reason    string            `json:"reason"`
+	Metric    model.Metric      `json:"metric"`
+	Timestamp model.Time        `json:"timestamp"`
+	Value     model.SampleValue `json:"value"`
+}
+
+// sink persists quarantine entries.
+type sink interface {
+	write(entries []Entry) error
+	// prune drops old entries to stay within the configured size and age.
+	prune(now time.Time) error
+}
+
+// Quarantine stores rejected samples in the background and remembers the most recent ones.
+type Quarantine struct {
+	sink    sink
+	entries chan Entry
+
+	mutex  sync.Mutex
+	recent []Entry
+	next   int
+	full   bool
+}
+
+func newQuarantine(s sink, recent int) *Quarantine {
+	q := &Quarantine{sink: s, entries: make(chan Entry, queueSize), recent: make([]Entry, recent)}
+	go q.run()
+	return q
+}
+
+// Add quarantines the samples. Samples are dropped, and counted as errors, if the sink can't keep up.
+func (q *Quarantine) Add(reason string, samples model.Samples) {
+	now := time.Now()
+	for _, s := range samples {
+		entry := Entry{Time: now, Reason: reason, Metric: s.Metric, Timestamp: s.Timestamp, Value: s.Value}
+		q.remember(entry)
+		select {
+		case q.entries <- entry:
+		default:
+			Errors.Inc()
+		}
+	}
+}
+
+func (q *Quarantine) remember(entry Entry) {
+	if len(q.recent) == 0 {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.recent[q.next] = entry
+	q.next = (q.next + 1) % len(q.recent)
+	if q.next == 0 {
+		q.full = true
+	}
+}
+
+// Recent returns up to n of the most recently quarantined entries, newest first.
+func (q *Quarantine) Recent(n int) []Entry {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	available := q.next
+	if q.full {
+		available = len(q.recent)
+	}
+	if n > available {
+		n = available
+	}
+	result := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, q.recent[(q.next-i+len(q.recent))%len(q.recent)])
+	}
+	return result
+}
+
+func (q *Quarantine) run() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-q.entries:
+			batch := []Entry{entry}
+		drain:
+			for len(batch) < queueSize {
+				select {
+				case entry := <-q.entries:
+					batch = append(batch, entry)
+				default:
+					break drain
+				}
+			}
+			if err := q.sink.write(batch); err != nil {
+				log.Warn("msg", "Error writing quarantined samples", "count", len(batch), "err", err)
+				Errors.Add(float64(len(batch)))
+			}
+		case now := <-ticker.C:
+			if err := q.sink.prune(now); err != nil {
+				log.Warn("msg", "Error pruning quarantine", "err", err)
+			}
+		}
+	}
+}
+
+// RecentHandler serves GET /admin/quarantine/recent?limit=N
+func (q *Quarantine) RecentHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			util.WriteError(w, http.StatusMethodNotAllowed, util.ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		limit := DefaultRecent
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 0 {
+				util.WriteError(w, http.StatusBadRequest, util.ErrCodeBadRequest, "limit must be a non-negative integer", err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(q.Recent(limit)); err != nil {
+			log.Error("msg", "Error encoding quarantine entries", "err", err)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package quarantine
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+func init() {
+	log.Init("debug")
+}
+
+type fakeSink struct {
+	mutex   sync.Mutex
+	entries []Entry
+}
+
+func (s *fakeSink) write(entries []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *fakeSink) prune(now time.Time) error {
+	return nil
+}
+
+func (s *fakeSink) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.entries)
+}
+
+func samples(n int) model.Samples {
+	result := model.Samples{}
+	for i := 0; i < n; i++ {
+		result = append(result, &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: model.Time(i), Value: model.SampleValue(i)})
+	}
+	return result
+}
+
+func TestQuarantineRecent(t *testing.T) {
+	sink := &fakeSink{}
+	q := newQuarantine(sink, 3)
+	if recent := q.Recent(10); len(recent) != 0 {
+		t.Errorf("Expected no entries, got %v", recent)
+	}
+	q.Add("out_of_order", samples(2))
+	if recent := q.Recent(10); len(recent) != 2 || recent[0].Timestamp != 1 || recent[0].Reason != "out_of_order" {
+		t.Errorf("Unexpected recent entries %v", recent)
+	}
+	q.Add("out_of_order", samples(5))
+	recent := q.Recent(10)
+	if len(recent) != 3 || recent[0].Timestamp != 4 || recent[2].Timestamp != 2 {
+		t.Errorf("Expected the newest 3 entries, got %v", recent)
+	}
+	if recent := q.Recent(1); len(recent) != 1 || recent[0].Timestamp != 4 {
+		t.Errorf("Expected the newest entry, got %v", recent)
+	}
+
+	for i := 0; i < 100 && sink.count() < 7; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := sink.count(); n != 7 {
+		t.Errorf("Expected all entries to reach the sink, got %d", n)
+	}
+}
+
+func TestRecentHandler(t *testing.T) {
+	q := newQuarantine(&fakeSink{}, 10)
+	q.Add("out_of_order", samples(3))
+
+	recorder := httptest.NewRecorder()
+	q.RecentHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/quarantine/recent?limit=2", nil))
+	var entries []Entry
+	if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Timestamp != 2 {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+
+	recorder = httptest.NewRecorder()
+	q.RecentHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/quarantine/recent?limit=x", nil))
+	if recorder.Code != 400 {
+		t.Errorf("Expected status 400 for invalid limit, got %d", recorder.Code)
+	}
+}
+
+func TestDirSink(t *testing.T) {
+	dir := t.TempDir()
+	sink := &dirSink{dir: dir, maxAge: 24 * time.Hour}
+	if err := sink.write([]Entry{{Reason: "out_of_order", Metric: model.Metric{model.MetricNameLabel: "up"}}}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "quarantine-*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one file, got %v", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	var entry Entry
+	if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Reason != "out_of_order" {
+		t.Errorf("Unexpected line %s: %v", scanner.Text(), err)
+	}
+	_ = f.Close()
+
+	old := filepath.Join(dir, "quarantine-20200101-00.jsonl")
+	if err := os.WriteFile(old, []byte("{}\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.prune(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expected expired file to be pruned")
+	}
+	if _, err := os.Stat(files[0]); err != nil {
+		t.Errorf("Expected current file to be kept: %v", err)
+	}
+
+	sink.maxBytes = 1
+	if err := sink.prune(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected file exceeding the size cap to be pruned")
+	}
+}
@@ -0,0 +1,74 @@
+package quarantine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlCreateTable  = "create table if not exists %s (time timestamp with time zone not null, reason text not null, metric jsonb not null, sample_time timestamp with time zone not null, value double precision)"
+	sqlInsertEntry  = "insert into %s (time, reason, metric, sample_time, value) values ($1, $2, $3, $4, $5)"
+	sqlPruneByAge   = "delete from %s where time < $1"
+	sqlPruneByCount = "delete from %s where ctid in (select ctid from %s order by time desc offset $1)"
+)
+
+// tableSink inserts entries into a database table.
+type tableSink struct {
+	db      *sql.DB
+	table   string
+	maxRows int
+	maxAge  time.Duration
+}
+
+// NewTable quarantines rejected samples in the given table, which is created if needed. Entries older than
+// maxAge are removed, as are the oldest entries beyond maxRows. recent is the number of entries kept in
+// memory for the recent endpoint.
+func NewTable(db *sql.DB, table string, maxRows int, maxAge time.Duration, recent int) (*Quarantine, error) {
+	if _, err := db.Exec(fmt.Sprintf(sqlCreateTable, table)); err != nil {
+		return nil, fmt.Errorf("error creating quarantine table: %w", err)
+	}
+	return newQuarantine(&tableSink{db: db, table: table, maxRows: maxRows, maxAge: maxAge}, recent), nil
+}
+
+func (s *tableSink) write(entries []Entry) error {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(sqlInsertEntry, s.table))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		metric, err := json.Marshal(entry.Metric)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, entry.Time, entry.Reason, string(metric), entry.Timestamp.Time(), float64(entry.Value)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *tableSink) prune(now time.Time) error {
+	if s.maxAge > 0 {
+		if _, err := s.db.Exec(fmt.Sprintf(sqlPruneByAge, s.table), now.Add(-s.maxAge)); err != nil {
+			return err
+		}
+	}
+	if s.maxRows > 0 {
+		if _, err := s.db.Exec(fmt.Sprintf(sqlPruneByCount, s.table, s.table), s.maxRows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+// Package quota limits the samples per second and the new series per day written for each tenant, so that
+// one tenant can't take up the whole database.
+package quota
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Policies for samples over quota
+const (
+	PolicyReject = "reject"
+	PolicyDrop   = "drop"
+)
+
+// Results of the quota check of a sample
+const (
+	resultAccepted = "accepted"
+	resultDropped  = "dropped"
+	resultRejected = "rejected"
+)
+
+// DefaultTenantHeader identifies the tenant of a write request unless the tenant is taken from a label.
+const DefaultTenantHeader = "X-Scope-OrgID"
+
+var (
+	// Samples counts the samples checked against the quotas of each tenant, by result.
+	Samples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "quota_samples_total",
+			Help: "Total number of samples checked against the quota of each tenant, by result (accepted, dropped or rejected).",
+		},
+		[]string{"tenant", "result"},
+	)
+	// NewSeries is the number of new series of each tenant on the current day.
+	NewSeries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "quota_new_series",
+			Help: "Number of new series written by each tenant on the current day (UTC).",
+		},
+		[]string{"tenant"},
+	)
+)
+
+// Limits are the quotas of a tenant. Zero values mean no limit.
+type Limits struct {
+	SamplesPerSecond float64 `yaml:"samples_per_second"`
+	// Burst is the number of samples that may be written at once, defaults to SamplesPerSecond.
+	Burst           float64 `yaml:"burst"`
+	NewSeriesPerDay int     `yaml:"new_series_per_day"`
+	// Policy is what happens to a write over quota: PolicyReject rejects it as a whole, PolicyDrop drops
+	// the samples over quota and writes the rest.
+	Policy string `yaml:"policy"`
+}
+
+// Config is the quota configuration file.
+type Config struct {
+	// TenantLabel takes the tenant of each sample from a label. Otherwise the tenant of a request is
+	// given in TenantHeader.
+	TenantLabel  string `yaml:"tenant_label"`
+	TenantHeader string `yaml:"tenant_header"`
+	// SeriesTTL is how long a series is remembered after its last sample. Series showing up again after that
+	// count as new.
+	SeriesTTL model.Duration `yaml:"series_ttl"`
+	// Default applies to tenants without limits of their own, including requests without tenant.
+	Default *Limits            `yaml:"default"`
+	Tenants map[string]*Limits `yaml:"tenants"`
+}
+
+// Parse reads a quota configuration.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if cfg.TenantLabel != "" && !model.LabelName(cfg.TenantLabel).IsValid() {
+		return nil, fmt.Errorf("invalid tenant label %q", cfg.TenantLabel)
+	}
+	if cfg.TenantHeader == "" {
+		cfg.TenantHeader = DefaultTenantHeader
+	}
+	if cfg.SeriesTTL == 0 {
+		cfg.SeriesTTL = model.Duration(7 * 24 * time.Hour)
+	}
+	if cfg.Default != nil {
+		if err := cfg.Default.validate(); err != nil {
+			return nil, fmt.Errorf("default: %w", err)
+		}
+	}
+	for tenant, limits := range cfg.Tenants {
+		if limits == nil {
+			return nil, fmt.Errorf("tenant %q has no limits", tenant)
+		}
+		if err := limits.validate(); err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (l *Limits) validate() error {
+	if l.SamplesPerSecond < 0 || l.Burst < 0 || l.NewSeriesPerDay < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if l.Burst == 0 {
+		l.Burst = l.SamplesPerSecond
+	}
+	switch l.Policy {
+	case "":
+		l.Policy = PolicyReject
+	case PolicyReject, PolicyDrop:
+	default:
+		return fmt.Errorf("unknown policy %q, expected %q or %q", l.Policy, PolicyReject, PolicyDrop)
+	}
+	return nil
+}
+
+// Load reads the quota configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ExceededError is returned for writes rejected because a tenant is over quota.
+type ExceededError struct {
+	Tenant string
+	Reason string
+	// Wait is the time until the quota allows the write: until enough samples are refilled, or until the
+	// next day for new series. Writes larger than the burst wait until the quota is refilled completely.
+	Wait time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("tenant %q is over its quota of %s", e.Tenant, e.Reason)
+}
+
+// RetryAfter returns Wait, as the time after which the write may be retried.
+func (e *ExceededError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// seriesState is what is remembered about a series of a tenant.
+type seriesState struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	// dirty marks series that changed since they were last persisted.
+	dirty bool
+}
+
+type tenantState struct {
+	tokens     float64
+	lastRefill time.Time
+	day        time.Time
+	newSeries  int
+	series     map[model.Fingerprint]*seriesState
+}
+
+// Engine checks writes against the quotas. It is safe for concurrent use.
+type Engine struct {
+	cfg   atomic.Pointer[Config]
+	store *store
+	now   func() time.Time
+
+	mutex   sync.Mutex
+	tenants map[string]*tenantState
+}
+
+// NewEngine creates an engine enforcing the quotas in cfg. The series of the tenants are kept in memory
+// only; use NewPersistentEngine to keep daily series budgets across restarts.
+func NewEngine(cfg *Config) *Engine {
+	e := &Engine{now: time.Now, tenants: map[string]*tenantState{}}
+	e.cfg.Store(cfg)
+	return e
+}
+
+// SetConfig replaces the quotas, eg. on a configuration reload. The samples counted so far are kept: the
+// new limits apply to the current budgets of the tenants.
+func (e *Engine) SetConfig(cfg *Config) {
+	e.cfg.Store(cfg)
+}
+
+// TenantHeader returns the header identifying the tenant of a request.
+func (e *Engine) TenantHeader() string {
+	return e.cfg.Load().TenantHeader
+}
+
+func (e *Engine) limits(tenant string) *Limits {
+	cfg := e.cfg.Load()
+	if limits, ok := cfg.Tenants[tenant]; ok {
+		return limits
+	}
+	return cfg.Default
+}
+
+// state returns the state of a tenant, starting a new day of series budget if needed. The caller must
+// hold the mutex.
+func (e *Engine) state(tenant string, limits *Limits, now time.Time) *tenantState {
+	s, ok := e.tenants[tenant]
+	if !ok {
+		s = &tenantState{tokens: limits.Burst, lastRefill: now, series: map[model.Fingerprint]*seriesState{}}
+		e.tenants[tenant] = s
+	}
+	if day := now.UTC().Truncate(24 * time.Hour); !s.day.Equal(day) {
+		s.day = day
+		s.newSeries = 0
+		for _, series := range s.series {
+			if !series.firstSeen.Before(day) {
+				s.newSeries++
+			}
+		}
+	}
+	tokens := s.tokens + now.Sub(s.lastRefill).Seconds()*limits.SamplesPerSecond
+	s.tokens = math.Min(tokens, limits.Burst)
+	s.lastRefill = now
+	return s
+}
+
+// Admit checks the samples of a write request against the quotas of their tenants. requestTenant is the
+// tenant given in the tenant header of the request, if any. Samples of tenants with the drop policy that are
+// over quota are left out of the result. If a tenant with the reject policy is over quota, an ExceededError
+// is returned and nothing is counted against any quota.
+func (e *Engine) Admit(requestTenant string, samples model.Samples) (model.Samples, error) {
+	byTenant := map[string]model.Samples{}
+	var tenants []string
+	tenantLabel := model.LabelName(e.cfg.Load().TenantLabel)
+	for _, s := range samples {
+		tenant := requestTenant
+		if tenantLabel != "" {
+			tenant = string(s.Metric[tenantLabel])
+		}
+		if _, ok := byTenant[tenant]; !ok {
+			tenants = append(tenants, tenant)
+		}
+		byTenant[tenant] = append(byTenant[tenant], s)
+	}
+	sort.Strings(tenants)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	now := e.now()
+	for _, tenant := range tenants {
+		limits := e.limits(tenant)
+		if limits == nil || limits.Policy != PolicyReject {
+			continue
+		}
+		if reason, wait := e.check(tenant, limits, byTenant[tenant], now); reason != "" {
+			for _, t := range tenants {
+				Samples.WithLabelValues(t, resultRejected).Add(float64(len(byTenant[t])))
+			}
+			return nil, &ExceededError{Tenant: tenant, Reason: reason, Wait: wait}
+		}
+	}
+	admitted := make(model.Samples, 0, len(samples))
+	for _, tenant := range tenants {
+		tenantSamples := byTenant[tenant]
+		limits := e.limits(tenant)
+		if limits != nil {
+			tenantSamples = e.consume(tenant, limits, tenantSamples, now)
+		}
+		Samples.WithLabelValues(tenant, resultAccepted).Add(float64(len(tenantSamples)))
+		if dropped := len(byTenant[tenant]) - len(tenantSamples); dropped > 0 {
+			Samples.WithLabelValues(tenant, resultDropped).Add(float64(dropped))
+		}
+		admitted = append(admitted, tenantSamples...)
+	}
+	return admitted, nil
+}
+
+// check tells which quota the samples of a tenant exceed, if any, and how long until they fit in, without
+// counting them.
+func (e *Engine) check(tenant string, limits *Limits, samples model.Samples, now time.Time) (string, time.Duration) {
+	s := e.state(tenant, limits, now)
+	if limits.SamplesPerSecond > 0 && float64(len(samples)) > s.tokens {
+		missing := math.Min(float64(len(samples)), limits.Burst) - s.tokens
+		wait := time.Duration(missing / limits.SamplesPerSecond * float64(time.Second))
+		return fmt.Sprintf("%g samples per second", limits.SamplesPerSecond), wait
+	}
+	if limits.NewSeriesPerDay > 0 {
+		newSeries := map[model.Fingerprint]bool{}
+		for _, sample := range samples {
+			if fp := sample.Metric.Fingerprint(); s.series[fp] == nil {
+				newSeries[fp] = true
+			}
+		}
+		if s.newSeries+len(newSeries) > limits.NewSeriesPerDay {
+			return fmt.Sprintf("%d new series per day", limits.NewSeriesPerDay), s.day.Add(24 * time.Hour).Sub(now)
+		}
+	}
+	return "", 0
+}
+
+// consume counts the samples of a tenant against its quotas, returning the ones within quota.
+func (e *Engine) consume(tenant string, limits *Limits, samples model.Samples, now time.Time) model.Samples {
+	s := e.state(tenant, limits, now)
+	admitted := samples[:0:0]
+	for _, sample := range samples {
+		if limits.SamplesPerSecond > 0 && s.tokens < 1 {
+			continue
+		}
+		fp := sample.Metric.Fingerprint()
+		series := s.series[fp]
+		if series == nil {
+			if limits.NewSeriesPerDay > 0 && s.newSeries >= limits.NewSeriesPerDay {
+				continue
+			}
+			series = &seriesState{firstSeen: now, lastSeen: now, dirty: true}
+			s.series[fp] = series
+			s.newSeries++
+		} else if now.Sub(series.lastSeen) >= time.Hour {
+			// only persisted at a coarse granularity, expiry is measured in days
+			series.lastSeen = now
+			series.dirty = true
+		}
+		if limits.SamplesPerSecond > 0 {
+			s.tokens--
+		}
+		admitted = append(admitted, sample)
+	}
+	NewSeries.WithLabelValues(tenant).Set(float64(s.newSeries))
+	return admitted
+}
+
+// expire forgets the series not seen within the series TTL. The caller must hold the mutex.
+func (e *Engine) expire(now time.Time) {
+	horizon := now.Add(-time.Duration(e.cfg.Load().SeriesTTL))
+	for _, s := range e.tenants {
+		for fp, series := range s.series {
+			if series.lastSeen.Before(horizon) {
+				delete(s.series, fp)
+			}
+		}
+	}
+}
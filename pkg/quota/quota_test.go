@@ -0,0 +1,184 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+func samplesOf(tenant string, series int, perSeries int) model.Samples {
+	var samples model.Samples
+	for i := 0; i < series; i++ {
+		metric := model.Metric{model.MetricNameLabel: "up", "tenant": model.LabelValue(tenant), "instance": model.LabelValue(fmt.Sprint(i))}
+		for j := 0; j < perSeries; j++ {
+			samples = append(samples, &model.Sample{Metric: metric, Timestamp: model.Time(j)})
+		}
+	}
+	return samples
+}
+
+func newTestEngine(t *testing.T, config string) (*Engine, *time.Time) {
+	t.Helper()
+	cfg, err := Parse([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine(cfg)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	e.now = func() time.Time {
+		return now
+	}
+	return e, &now
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]string{
+		"unknown field":  "tenants:\n  a:\n    samples_per_sec: 10\n",
+		"unknown policy": "default:\n  policy: throttle\n",
+		"negative limit": "tenants:\n  a:\n    new_series_per_day: -1\n",
+		"invalid label":  "tenant_label: team-name\n",
+		"empty tenant":   "tenants:\n  a:\n",
+	}
+	for name, config := range testCases {
+		if _, err := Parse([]byte(config)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	cfg, err := Parse([]byte("default:\n  samples_per_second: 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TenantHeader != DefaultTenantHeader || cfg.Default.Burst != 100 || cfg.Default.Policy != PolicyReject {
+		t.Errorf("Unexpected defaults %+v %+v", cfg, cfg.Default)
+	}
+}
+
+func TestAdmitRateReject(t *testing.T) {
+	e, now := newTestEngine(t, "tenants:\n  a:\n    samples_per_second: 10\n    burst: 20\n")
+	before := testutil.ToFloat64(Samples.WithLabelValues("a", resultRejected))
+	if admitted, err := e.Admit("a", samplesOf("a", 2, 10)); err != nil || len(admitted) != 20 {
+		t.Fatalf("Expected burst to be admitted, got %d samples and %v", len(admitted), err)
+	}
+	_, err := e.Admit("a", samplesOf("a", 1, 5))
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) || exceeded.Tenant != "a" {
+		t.Fatalf("Expected tenant a to be over quota, got %v", err)
+	}
+	if delta := testutil.ToFloat64(Samples.WithLabelValues("a", resultRejected)) - before; delta != 5 {
+		t.Errorf("Expected 5 rejected samples, got %v", delta)
+	}
+	if exceeded.RetryAfter() != 500*time.Millisecond {
+		t.Errorf("Expected the write to fit in after 500ms, got %v", exceeded.RetryAfter())
+	}
+	// larger than the burst, it never fits in
+	if _, err := e.Admit("a", samplesOf("a", 3, 10)); !errors.As(err, &exceeded) || exceeded.RetryAfter() != 2*time.Second {
+		t.Errorf("Expected a write larger than the burst to wait for the quota to be refilled, got %v", err)
+	}
+	*now = now.Add(time.Second)
+	if admitted, err := e.Admit("a", samplesOf("a", 1, 10)); err != nil || len(admitted) != 10 {
+		t.Errorf("Expected the refilled tokens to be used, got %d samples and %v", len(admitted), err)
+	}
+	// tenants without limits aren't limited
+	if admitted, err := e.Admit("b", samplesOf("b", 10, 10)); err != nil || len(admitted) != 100 {
+		t.Errorf("Expected unlimited tenant to be admitted, got %d samples and %v", len(admitted), err)
+	}
+}
+
+func TestAdmitDropByLabel(t *testing.T) {
+	e, _ := newTestEngine(t, `
+tenant_label: tenant
+default:
+  samples_per_second: 1000
+tenants:
+  a:
+    new_series_per_day: 3
+    policy: drop
+`)
+	samples := append(samplesOf("a", 5, 2), samplesOf("b", 5, 2)...)
+	admitted, err := e.Admit("ignored", samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tenant a keeps the samples of its first 3 series
+	if len(admitted) != 16 {
+		t.Errorf("Expected 16 samples, got %d", len(admitted))
+	}
+	if v := testutil.ToFloat64(NewSeries.WithLabelValues("a")); v != 3 {
+		t.Errorf("Expected 3 new series of tenant a, got %v", v)
+	}
+	// known series are still admitted
+	admitted, err = e.Admit("", samplesOf("a", 5, 1))
+	if err != nil || len(admitted) != 3 {
+		t.Errorf("Expected the 3 known series to be admitted, got %d samples and %v", len(admitted), err)
+	}
+}
+
+func TestAdmitRejectCountsNothing(t *testing.T) {
+	e, _ := newTestEngine(t, `
+tenant_label: tenant
+tenants:
+  a:
+    new_series_per_day: 10
+  b:
+    new_series_per_day: 1
+`)
+	samples := append(samplesOf("a", 5, 1), samplesOf("b", 2, 1)...)
+	var exceeded *ExceededError
+	if _, err := e.Admit("", samples); !errors.As(err, &exceeded) || exceeded.Tenant != "b" {
+		t.Fatalf("Expected tenant b to be over quota, got %v", err)
+	}
+	if admitted, err := e.Admit("", samplesOf("a", 10, 1)); err != nil || len(admitted) != 10 {
+		t.Errorf("Expected the rejected write not to count against tenant a, got %d samples and %v", len(admitted), err)
+	}
+}
+
+func TestSeriesBudgetResetsDaily(t *testing.T) {
+	e, now := newTestEngine(t, "tenants:\n  a:\n    new_series_per_day: 2\n")
+	if _, err := e.Admit("a", samplesOf("a", 2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := e.Admit("a", samplesOf("a", 3, 1))
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) {
+		t.Fatal("Expected the series budget to be used up")
+	}
+	if exceeded.RetryAfter() != 12*time.Hour {
+		t.Errorf("Expected the write to wait until the next day, got %v", exceeded.RetryAfter())
+	}
+	*now = now.Add(12 * time.Hour)
+	if _, err := e.Admit("a", samplesOf("a", 4, 1)); err != nil {
+		t.Errorf("Expected a new series budget on the next day, got %v", err)
+	}
+
+	// series not seen within the TTL are forgotten
+	*now = now.Add(8 * 24 * time.Hour)
+	if err := e.Persist(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.tenants["a"].series); n != 0 {
+		t.Errorf("Expected expired series to be forgotten, got %d", n)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	e, _ := newTestEngine(t, "tenants:\n  a:\n    samples_per_second: 10\n    burst: 10\n")
+	if admitted, err := e.Admit("a", samplesOf("a", 1, 10)); err != nil || len(admitted) != 10 {
+		t.Fatalf("Expected burst to be admitted, got %d samples and %v", len(admitted), err)
+	}
+	cfg, err := Parse([]byte("tenants:\n  b:\n    samples_per_second: 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetConfig(cfg)
+	if admitted, err := e.Admit("a", samplesOf("a", 1, 10)); err != nil || len(admitted) != 10 {
+		t.Errorf("Expected tenant a to be unlimited after the reload, got %d samples and %v", len(admitted), err)
+	}
+	if _, err := e.Admit("b", samplesOf("b", 1, 20)); err == nil {
+		t.Error("Expected the new limits of tenant b to apply")
+	}
+}
@@ -0,0 +1,149 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlCreateSeriesTable = "create table if not exists %s (tenant text not null, fingerprint bigint not null, first_seen timestamp with time zone not null, last_seen timestamp with time zone not null, primary key (tenant, fingerprint))"
+	sqlLoadSeries        = "select tenant, fingerprint, first_seen, last_seen from %s where last_seen >= $1"
+	sqlUpsertSeries      = "insert into %s (tenant, fingerprint, first_seen, last_seen) select * from unnest($1::text[], $2::bigint[], $3::timestamptz[], $4::timestamptz[]) on conflict (tenant, fingerprint) do update set last_seen = greatest(%s.last_seen, excluded.last_seen)"
+	sqlExpireSeries      = "delete from %s where last_seen < $1"
+)
+
+// store keeps the series of the tenants in a table, so that daily series budgets survive restarts.
+type store struct {
+	db    *sql.DB
+	table string
+}
+
+// NewPersistentEngine creates an engine that keeps the series of the tenants in the given table, which is
+// created if needed. The series seen within the series TTL are loaded right away; call Persist periodically
+// to save new ones.
+func NewPersistentEngine(cfg *Config, db *sql.DB, table string) (*Engine, error) {
+	e := NewEngine(cfg)
+	e.store = &store{db: db, table: table}
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(sqlCreateSeriesTable, table)); err != nil {
+		return nil, fmt.Errorf("error creating quota table: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(sqlLoadSeries, table), e.now().Add(-time.Duration(cfg.SeriesTTL)))
+	if err != nil {
+		return nil, fmt.Errorf("error loading quota series: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	loaded := 0
+	for rows.Next() {
+		var tenant string
+		var fingerprint int64
+		series := &seriesState{}
+		if err := rows.Scan(&tenant, &fingerprint, &series.firstSeen, &series.lastSeen); err != nil {
+			return nil, fmt.Errorf("error loading quota series: %w", err)
+		}
+		s, ok := e.tenants[tenant]
+		if !ok {
+			s = &tenantState{series: map[model.Fingerprint]*seriesState{}}
+			if limits := e.limits(tenant); limits != nil {
+				s.tokens = limits.Burst
+			}
+			s.lastRefill = e.now()
+			e.tenants[tenant] = s
+		}
+		s.series[model.Fingerprint(fingerprint)] = series
+		loaded++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading quota series: %w", err)
+	}
+	log.Info("msg", "Loaded quota series", "table", table, "series", loaded)
+	return e, nil
+}
+
+// Persist saves the series that changed since the last call and forgets the ones not seen within the series
+// TTL. It does nothing for engines without table.
+func (e *Engine) Persist(ctx context.Context) error {
+	var tenants []string
+	var fingerprints []int64
+	var firstSeen, lastSeen []time.Time
+	e.mutex.Lock()
+	now := e.now()
+	e.expire(now)
+	if e.store != nil {
+		for tenant, s := range e.tenants {
+			for fp, series := range s.series {
+				if !series.dirty {
+					continue
+				}
+				tenants = append(tenants, tenant)
+				fingerprints = append(fingerprints, int64(fp))
+				firstSeen = append(firstSeen, series.firstSeen)
+				lastSeen = append(lastSeen, series.lastSeen)
+				series.dirty = false
+			}
+		}
+	}
+	e.mutex.Unlock()
+	if e.store == nil {
+		return nil
+	}
+
+	tx, err := e.store.db.BeginTx(ctx, nil)
+	if err != nil {
+		e.markDirty(tenants, fingerprints)
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if len(tenants) > 0 {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlUpsertSeries, e.store.table, e.store.table), tenants, fingerprints, firstSeen, lastSeen); err != nil {
+			e.markDirty(tenants, fingerprints)
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(sqlExpireSeries, e.store.table), now.Add(-time.Duration(e.cfg.Load().SeriesTTL))); err != nil {
+		e.markDirty(tenants, fingerprints)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		e.markDirty(tenants, fingerprints)
+		return err
+	}
+	return nil
+}
+
+// markDirty makes the next Persist save the series again after a failure.
+func (e *Engine) markDirty(tenants []string, fingerprints []int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for i, tenant := range tenants {
+		if s, ok := e.tenants[tenant]; ok {
+			if series, ok := s.series[model.Fingerprint(fingerprints[i])]; ok {
+				series.dirty = true
+			}
+		}
+	}
+}
+
+// Run persists the series every interval. It never returns.
+func (e *Engine) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := e.Persist(ctx); err != nil {
+			log.Warn("msg", "Error persisting quota series, retrying later", "err", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestHandlerNoop(t *testing.T) {
+	var span trace.Span
+	handler := Handler("/write", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span = trace.SpanFromContext(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/write", nil))
+	if span.IsRecording() {
+		t.Error("Expected no spans to be recorded without tracer provider")
+	}
+}
+
+func TestHandlerContinuesTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	handler := Handler("/write", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Tracer().Start(r.Context(), "child")
+		span.End()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/write", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if traceID := server.SpanContext().TraceID().String(); traceID != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("Expected the trace of the traceparent header, got %s", traceID)
+	}
+	if parent := server.Parent().SpanID().String(); parent != "b7ad6b7169203331" {
+		t.Errorf("Expected the span of the traceparent header as parent, got %s", parent)
+	}
+	if child.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("Expected the child span to be a child of the request span")
+	}
+	if server.Status().Code != codes.Error {
+		t.Errorf("Expected the request span to fail on 503, got %v", server.Status())
+	}
+}
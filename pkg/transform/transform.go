@@ -0,0 +1,220 @@
+// Package transform rewrites samples according to configurable rules before they are written, eg. to
+// scale values to other units or to rename metrics.
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// RuleSamples counts the samples touched by each rule.
+var RuleSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "transform_rule_samples_total",
+		Help: "Total number of samples modified by a transformation rule.",
+	},
+	[]string{"rule"},
+)
+
+// ruleConfig is a rule as written in the rules file. Every rule matches metric names against a regex and
+// applies all of its operations to matching samples.
+type ruleConfig struct {
+	Name      string            `yaml:"name"`
+	Match     string            `yaml:"match"`
+	Multiply  *float64          `yaml:"multiply"`
+	Rename    string            `yaml:"rename"`
+	AddLabels map[string]string `yaml:"add_labels"`
+
+	line int
+}
+
+var ruleFields = map[string]bool{"name": true, "match": true, "multiply": true, "rename": true, "add_labels": true}
+
+func (c *ruleConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain ruleConfig
+	c.line = node.Line
+	// the decoder doesn't check for unknown fields in custom unmarshalers
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i < len(node.Content); i += 2 {
+			if key := node.Content[i]; !ruleFields[key.Value] {
+				return fmt.Errorf("line %d: unknown field %q", key.Line, key.Value)
+			}
+		}
+	}
+	return node.Decode((*plain)(c))
+}
+
+type rulesFile struct {
+	Rules []*ruleConfig `yaml:"rules"`
+}
+
+type rule struct {
+	name      string
+	match     *regexp.Regexp
+	multiply  *float64
+	rename    model.LabelValue
+	addLabels model.LabelSet
+	samples   prometheus.Counter
+}
+
+// Rules is a compiled, immutable set of rules. They are applied in file order, each one seeing the
+// result of the previous ones.
+type Rules struct {
+	rules []*rule
+}
+
+// Parse compiles the rules in data. Errors point at the line of the offending rule.
+func Parse(data []byte) (*Rules, error) {
+	var file rulesFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	names := map[string]int{}
+	rules := &Rules{}
+	for _, c := range file.Rules {
+		r, err := compile(c)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", c.line, err)
+		}
+		if previous, ok := names[r.name]; ok {
+			return nil, fmt.Errorf("line %d: rule %q is already defined on line %d", c.line, r.name, previous)
+		}
+		names[r.name] = c.line
+		rules.rules = append(rules.rules, r)
+	}
+	return rules, nil
+}
+
+func compile(c *ruleConfig) (*rule, error) {
+	if c.Name == "" {
+		return nil, errors.New("rule has no name")
+	}
+	if c.Match == "" {
+		return nil, fmt.Errorf("rule %q has no match regex", c.Name)
+	}
+	match, err := regexp.Compile("^(?:" + c.Match + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("rule %q has an invalid match regex: %v", c.Name, err)
+	}
+	if c.Multiply == nil && c.Rename == "" && len(c.AddLabels) == 0 {
+		return nil, fmt.Errorf("rule %q has no operation, expected multiply, rename or add_labels", c.Name)
+	}
+	if c.Rename != "" && !model.IsValidMetricName(model.LabelValue(c.Rename)) {
+		return nil, fmt.Errorf("rule %q renames to the invalid metric name %q", c.Name, c.Rename)
+	}
+	addLabels := model.LabelSet{}
+	for name, value := range c.AddLabels {
+		if !model.LabelName(name).IsValid() || name == model.MetricNameLabel {
+			return nil, fmt.Errorf("rule %q adds the invalid label %q", c.Name, name)
+		}
+		addLabels[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return &rule{
+		name:      c.Name,
+		match:     match,
+		multiply:  c.Multiply,
+		rename:    model.LabelValue(c.Rename),
+		addLabels: addLabels,
+		samples:   RuleSamples.WithLabelValues(c.Name),
+	}, nil
+}
+
+// Load reads and compiles the rules file at path.
+func Load(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Apply transforms the matching samples in place. Metrics are shared between the samples of a series,
+// so modified metrics are copied rather than changed.
+func (r *Rules) Apply(samples model.Samples) {
+	if r == nil || len(r.rules) == 0 {
+		return
+	}
+	for _, sample := range samples {
+		copied := false
+		for _, rule := range r.rules {
+			if !rule.match.MatchString(string(sample.Metric[model.MetricNameLabel])) {
+				continue
+			}
+			rule.samples.Inc()
+			if rule.multiply != nil {
+				sample.Value = model.SampleValue(float64(sample.Value) * *rule.multiply)
+			}
+			if rule.rename == "" && len(rule.addLabels) == 0 {
+				continue
+			}
+			if !copied {
+				sample.Metric = sample.Metric.Clone()
+				copied = true
+			}
+			if rule.rename != "" {
+				sample.Metric[model.MetricNameLabel] = rule.rename
+			}
+			for name, value := range rule.addLabels {
+				sample.Metric[name] = value
+			}
+		}
+	}
+}
+
+// Engine holds the current rules and allows replacing them while samples are being transformed.
+type Engine struct {
+	path  string
+	rules atomic.Pointer[Rules]
+}
+
+// NewEngine loads the rules file at path.
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload re-reads the rules file. The current rules are kept if the file is invalid.
+func (e *Engine) Reload() error {
+	rules, err := Load(e.path)
+	if err != nil {
+		return err
+	}
+	e.SetRules(rules)
+	return nil
+}
+
+// Path returns the path of the rules file.
+func (e *Engine) Path() string {
+	return e.path
+}
+
+// SetRules replaces the rules with ones loaded already, eg. validated along with other settings.
+func (e *Engine) SetRules(rules *Rules) {
+	e.rules.Store(rules)
+	log.Info("msg", "Loaded transformation rules", "path", e.path, "rules", len(rules.rules))
+}
+
+// Apply transforms the samples with the current rules.
+func (e *Engine) Apply(samples model.Samples) {
+	e.rules.Load().Apply(samples)
+}
@@ -0,0 +1,203 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+func init() {
+	log.Init("debug")
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{
+			name:  "syntax",
+			rules: "rules:\n  - name: a\n    match: [",
+			err:   "line 3",
+		},
+		{
+			name:  "unknown field",
+			rules: "rules:\n  - name: a\n    match: x\n    divide: 2\n",
+			err:   "line 4",
+		},
+		{
+			name:  "missing name",
+			rules: "rules:\n  - name: a\n    match: x\n    multiply: 2\n  - match: y\n    multiply: 2\n",
+			err:   "line 5: rule has no name",
+		},
+		{
+			name:  "invalid regex",
+			rules: "rules:\n  - name: a\n    match: \"x(\"\n    multiply: 2\n",
+			err:   "line 2: rule \"a\" has an invalid match regex",
+		},
+		{
+			name:  "no operation",
+			rules: "rules:\n  - name: a\n    match: x\n",
+			err:   "line 2: rule \"a\" has no operation",
+		},
+		{
+			name:  "invalid rename",
+			rules: "rules:\n  - name: a\n    match: x\n    rename: 1x\n",
+			err:   "line 2: rule \"a\" renames to the invalid metric name",
+		},
+		{
+			name:  "invalid label",
+			rules: "rules:\n  - name: a\n    match: x\n    add_labels:\n      __name__: y\n",
+			err:   "line 2: rule \"a\" adds the invalid label",
+		},
+		{
+			name:  "duplicate name",
+			rules: "rules:\n  - name: a\n    match: x\n    multiply: 2\n  - name: a\n    match: y\n    multiply: 2\n",
+			err:   "line 5: rule \"a\" is already defined on line 2",
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Parse([]byte(c.rules))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Expected error containing %q, got %q", c.err, err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	rules, err := Parse([]byte(`
+rules:
+  - name: bytes-to-mib
+    match: .*_bytes
+    multiply: 0.00000095367431640625
+    rename: node_memory_mib
+  - name: ms-to-seconds
+    match: latency_ms
+    multiply: 0.001
+  - name: tag-mib
+    match: node_memory_mib
+    add_labels:
+      unit: MiB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name     string
+		metric   model.Metric
+		value    model.SampleValue
+		expected model.Metric
+		expValue model.SampleValue
+	}{
+		{
+			name:     "chained rules",
+			metric:   model.Metric{model.MetricNameLabel: "node_memory_bytes", "job": "node"},
+			value:    2 * 1024 * 1024,
+			expected: model.Metric{model.MetricNameLabel: "node_memory_mib", "job": "node", "unit": "MiB"},
+			expValue: 2,
+		},
+		{
+			name:     "multiply only",
+			metric:   model.Metric{model.MetricNameLabel: "latency_ms"},
+			value:    1500,
+			expected: model.Metric{model.MetricNameLabel: "latency_ms"},
+			expValue: 1.5,
+		},
+		{
+			name:     "regex is anchored",
+			metric:   model.Metric{model.MetricNameLabel: "latency_ms_total"},
+			value:    1500,
+			expected: model.Metric{model.MetricNameLabel: "latency_ms_total"},
+			expValue: 1500,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			original := c.metric.Clone()
+			samples := model.Samples{{Metric: c.metric, Value: c.value}, {Metric: c.metric, Value: c.value}}
+			rules.Apply(samples)
+			for _, s := range samples {
+				if !s.Metric.Equal(c.expected) || s.Value != c.expValue {
+					t.Errorf("Expected %v %v, got %v %v", c.expected, c.expValue, s.Metric, s.Value)
+				}
+			}
+			if !c.metric.Equal(original) {
+				t.Errorf("Shared metric was modified: %v", c.metric)
+			}
+		})
+	}
+}
+
+func TestApplyCountsSamples(t *testing.T) {
+	rules, err := Parse([]byte("rules:\n  - name: count-me\n    match: up\n    add_labels:\n      counted: \"true\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(RuleSamples.WithLabelValues("count-me"))
+	rules.Apply(model.Samples{
+		{Metric: model.Metric{model.MetricNameLabel: "up"}},
+		{Metric: model.Metric{model.MetricNameLabel: "down"}},
+		{Metric: model.Metric{model.MetricNameLabel: "up"}},
+	})
+	if delta := testutil.ToFloat64(RuleSamples.WithLabelValues("count-me")) - before; delta != 2 {
+		t.Errorf("Expected 2 touched samples, got %v", delta)
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("rules:\n  - name: double\n    match: up\n    multiply: 2\n")
+	engine, err := NewEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func() model.SampleValue {
+		samples := model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1}}
+		engine.Apply(samples)
+		return samples[0].Value
+	}
+	if v := apply(); v != 2 {
+		t.Errorf("Expected 2, got %v", v)
+	}
+
+	write("rules:\n  - name: triple\n    match: up\n    multiply: 3\n")
+	if err := engine.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if v := apply(); v != 3 {
+		t.Errorf("Expected 3 after reload, got %v", v)
+	}
+
+	write("rules:\n  - name: broken\n    match: up\n")
+	if err := engine.Reload(); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("Expected error naming the file, got %v", err)
+	}
+	if v := apply(); v != 3 {
+		t.Errorf("Expected invalid file to keep the previous rules, got %v", v)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	rules, err := Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.Apply(model.Samples{{Metric: model.Metric{model.MetricNameLabel: "up"}, Value: 1}})
+}
@@ -1,26 +1,39 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
 )
 
-// Election defines an interface for adapter leader election.
+// LeaderElector is what the adapter needs of a leader election: whether this instance is the leader, which
+// is the only one writing, and resigning the leadership. Elector and ScheduledElector implement it for any
+// Election backend.
+type LeaderElector interface {
+	ID() string
+	IsLeader() (bool, error)
+	Resign() error
+}
+
+// Election defines an interface for adapter leader election backends.
 // If you are running Prometheus in HA mode where each Prometheus instance sends data to corresponding adapter you probably
 // want to allow writes into the database from only one adapter at the time. We need to elect a leader who can write to
 // the database. If leader goes down, another leader is elected. Look at `lock.go` for an implementation based on PostgreSQL
-// advisory locks. Should be easy to plug in different leader election implementations.
+// advisory locks, `kubernetes.go` for one based on a Kubernetes Lease. A backend only has to add BecomeLeader to
+// LeaderElector, see FakeElection for the smallest one.
 type Election interface {
-	ID() string
+	LeaderElector
 	BecomeLeader() (bool, error)
-	IsLeader() (bool, error)
-	Resign() error
 }
 
 // Elector is `Election` wrapper that provides cross-cutting concerns(eg. logging) and some common features shared among all election implementations.
@@ -62,33 +75,124 @@ func (e *Elector) Resign() error {
 	return err
 }
 
+// Causes of resignations counted by ElectionResignations
+const (
+	resignLivenessTimeout = "liveness_timeout"
+	resignLockLost        = "lock_lost"
+	resignHandoff         = "handoff"
+	resignManual          = "manual"
+)
+
+var (
+	// ElectionStepDuration is the time the scheduled election takes to verify the leadership (verify) and, on
+	// followers, to try to acquire it (acquire). Both are a query on the lock session: a healthy distribution
+	// sits within a few database round trips, far below -scheduled-election-interval. A tail approaching the
+	// interval means a slow database or lock session, which delays taking over from a leader that's gone.
+	ElectionStepDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "election_step_duration_seconds",
+			Help:    "Duration of the steps of the scheduled election, verifying or acquiring the leadership.",
+			Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"step"},
+	)
+	// ElectionSinceConfirmed is the time since the scheduled election last confirmed this instance as the
+	// leader, NaN if it never was. On a healthy leader it stays below -scheduled-election-interval, plus
+	// the step duration; a value beyond means elections are delayed, eg. by a GC pause or a stuck database.
+	// On followers it is the time since they last led.
+	ElectionSinceConfirmed = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "election_since_leadership_confirmed_seconds",
+			Help: "Time since the scheduled election last confirmed the leadership of this instance, NaN if it never did.",
+		},
+		func() float64 {
+			return sinceConfirmed(time.Now())
+		},
+	)
+	// ElectionResignations counts the times this instance stopped being the leader, by cause:
+	// liveness_timeout when Prometheus sent nothing for -prometheus-timeout, lock_lost when the lock was lost,
+	// eg. with its database session, handoff on shutdown with -handoff-grace-period, and manual when resigned
+	// by a call to Resign. Healthy leaders only resign on handoffs; any lock_lost or liveness_timeout is a
+	// leader flip worth explaining.
+	ElectionResignations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "election_resignations_total",
+			Help: "Total number of times this instance stopped being the leader, by cause.",
+		},
+		[]string{"cause"},
+	)
+	// ElectionRegainedAfter is the time this instance went without the leadership before regaining it. Only
+	// instances that lost the leadership and got it back are observed, which healthy groups rarely do:
+	// values around -scheduled-election-interval mean the leadership flaps back and forth, eg. with a GC
+	// pause exceeding -prometheus-timeout.
+	ElectionRegainedAfter = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "election_leadership_regained_after_seconds",
+			Help:    "Time between losing the leadership and regaining it.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+	)
+)
+
+// confirmedAt is the time in Unix nanoseconds at which the scheduled election last confirmed the
+// leadership, 0 if it never did.
+var confirmedAt atomic.Int64
+
+// sinceConfirmed returns the seconds between the last confirmation of the leadership and now.
+func sinceConfirmed(now time.Time) float64 {
+	at := confirmedAt.Load()
+	if at == 0 {
+		return math.NaN()
+	}
+	return now.Sub(time.Unix(0, at)).Seconds()
+}
+
+// handoffer is implemented by elections that hand their leadership off on shutdown.
+type handoffer interface {
+	HandingOff() bool
+}
+
 // ScheduledElector triggers election on scheduled interval. Currently used in combination with PgAdvisoryLock
 type ScheduledElector struct {
 	Elector
-	ticker                  *time.Ticker
-	pausedScheduledElection bool
+	ticks                   <-chan time.Time
+	now                     func() time.Time
+	pausedScheduledElection atomic.Bool
+
+	// leading is the leadership as last seen by the elector, lostAt when it was last lost
+	mutex   sync.Mutex
+	leading bool
+	lostAt  time.Time
 }
 
 func NewScheduledElector(election Election, electionInterval time.Duration) *ScheduledElector {
-	scheduledElector := &ScheduledElector{Elector: Elector{election}, ticker: time.NewTicker(electionInterval)}
-	go scheduledElector.scheduledElection()
+	return newScheduledElector(election, time.NewTicker(electionInterval).C, time.Now)
+}
+
+// newScheduledElector elects on each tick, reading the time of the liveness checks from now. Without ticks,
+// the elections are triggered by calling scheduledStep.
+func newScheduledElector(election Election, ticks <-chan time.Time, now func() time.Time) *ScheduledElector {
+	scheduledElector := &ScheduledElector{Elector: Elector{election}, ticks: ticks, now: now}
+	if ticks != nil {
+		go scheduledElector.scheduledElection()
+	}
 	return scheduledElector
 }
 
 func (se *ScheduledElector) pauseScheduledElection() {
-	se.pausedScheduledElection = true
+	se.pausedScheduledElection.Store(true)
 }
 
 func (se *ScheduledElector) resumeScheduledElection() {
-	se.pausedScheduledElection = false
+	se.pausedScheduledElection.Store(false)
 }
 
 func (se *ScheduledElector) IsPausedScheduledElection() bool {
-	return se.pausedScheduledElection
+	return se.pausedScheduledElection.Load()
 }
 
 func (se *ScheduledElector) PrometheusLivenessCheck(lastRequestUnixNano int64, timeout time.Duration) {
-	elapsed := time.Now().Sub(time.Unix(0, lastRequestUnixNano))
+	elapsed := se.now().Sub(time.Unix(0, lastRequestUnixNano))
 	leader, err := se.IsLeader()
 	if err != nil {
 		log.Error("msg", err.Error())
@@ -98,7 +202,8 @@ func (se *ScheduledElector) PrometheusLivenessCheck(lastRequestUnixNano int64, t
 			log.Warn("msg", "Prometheus timeout exceeded", "timeout", timeout)
 			se.pauseScheduledElection()
 			log.Warn("msg", "Scheduled election is paused. Instance is removed from election pool.")
-			err := se.Resign()
+			se.lost(resignLivenessTimeout)
+			err := se.Elector.Resign()
 			if err != nil {
 				log.Error("msg", err.Error())
 			}
@@ -112,44 +217,133 @@ func (se *ScheduledElector) PrometheusLivenessCheck(lastRequestUnixNano int64, t
 }
 
 func (se *ScheduledElector) scheduledElection() {
-	for {
-		select {
-		case <-se.ticker.C:
-			if !se.pausedScheduledElection {
-				se.Elect()
-			} else {
-				log.Debug("msg", "Scheduled election is paused. Instance can't become a leader until scheduled election is resumed (Prometheus comes up again)")
-			}
-		}
+	for range se.ticks {
+		se.scheduledStep()
+	}
+}
+
+// scheduledStep runs the election of a tick, unless it is paused.
+func (se *ScheduledElector) scheduledStep() {
+	if !se.pausedScheduledElection.Load() {
+		se.Elect()
+	} else {
+		log.Debug("msg", "Scheduled election is paused. Instance can't become a leader until scheduled election is resumed (Prometheus comes up again)")
 	}
 }
 
 func (se *ScheduledElector) Elect() bool {
+	begin := se.now()
 	leader, err := se.IsLeader()
+	ElectionStepDuration.WithLabelValues("verify").Observe(se.now().Sub(begin).Seconds())
 	if err != nil {
 		log.Error("msg", "Leader check failed", "err", err)
+		se.lost(resignLockLost)
 	} else if !leader {
+		if h, ok := se.election.(handoffer); ok && h.HandingOff() {
+			se.lost(resignHandoff)
+		} else {
+			se.lost(resignLockLost)
+		}
+		begin = se.now()
 		leader, err = se.BecomeLeader()
+		ElectionStepDuration.WithLabelValues("acquire").Observe(se.now().Sub(begin).Seconds())
 		if err != nil {
 			log.Error("msg", "Failed while becoming a leader", "err", err)
 		}
 	}
+	if leader {
+		se.confirmed()
+	}
 	return leader
 }
 
+// Resign resigns the leadership, counting it as a manual resignation.
+func (se *ScheduledElector) Resign() error {
+	se.lost(resignManual)
+	return se.Elector.Resign()
+}
+
+// confirmed records that the election confirmed the leadership.
+func (se *ScheduledElector) confirmed() {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	now := se.now()
+	confirmedAt.Store(now.UnixNano())
+	if !se.leading && !se.lostAt.IsZero() {
+		ElectionRegainedAfter.Observe(now.Sub(se.lostAt).Seconds())
+	}
+	se.leading = true
+}
+
+// lost records that the leadership was lost for cause, if this instance was the leader.
+func (se *ScheduledElector) lost(cause string) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	if !se.leading {
+		return
+	}
+	se.leading = false
+	se.lostAt = se.now()
+	ElectionResignations.WithLabelValues(cause).Inc()
+}
+
 // RestElection is a REST interface allowing to plug in any external leader election mechanism.
 // Remote service can use REST endpoints to manage leader election thus block or allow writes.
 // Using RestElection over PgAdvisoryLock is encouraged as it is more robust and gives more control over
 // the election process, however it does require additional engineering effort.
+//
+// Leadership is held as a lease. With a non-zero TTL the lease has to be refreshed (by claiming it again)
+// before it expires, otherwise the instance stops considering itself the leader and another claimant can take
+// over. A valid lease is never taken from its holder, except when two claimants compete for it at the same
+// time: a claim arriving within restClaimWindow of the acquisition goes to the lexicographically smallest ID,
+// regardless of the order in which the claims arrive.
 type RestElection struct {
-	leader bool
-	mutex  sync.RWMutex
+	id       string
+	ttl      time.Duration
+	now      func() time.Time
+	holder   string
+	acquired time.Time
+	expiry   time.Time
+	mutex    sync.RWMutex
 }
 
-func NewRestElection() *RestElection {
-	r := &RestElection{}
-	http.Handle("/admin/election/leader", r.handleLeader())
-	return r
+// restClaimWindow is how long after a lease is acquired competing claims count as simultaneous.
+const restClaimWindow = time.Second
+
+// RestLeaseTransitions counts lease state transitions of the REST election by type.
+var RestLeaseTransitions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rest_election_lease_transitions_total",
+		Help: "Total number of REST leader election lease transitions.",
+	},
+	[]string{"transition"},
+)
+
+const (
+	leaseAcquired  = "acquired"
+	leaseRefreshed = "refreshed"
+	leasePreempted = "preempted"
+	leaseRejected  = "rejected"
+	leaseExpired   = "expired"
+	leaseResigned  = "resigned"
+)
+
+// NewRestElection creates a REST election for the instance with the given ID (defaults to the hostname).
+// A TTL of 0 means the lease never expires.
+func NewRestElection(id string, ttl time.Duration) *RestElection {
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "localhost"
+		}
+		id = hostname
+	}
+	return &RestElection{id: id, ttl: ttl, now: time.Now}
+}
+
+// LeaderHandler returns the handler checking (GET) and changing (PUT 1 or 0) the leadership of the instance.
+func (r *RestElection) LeaderHandler() http.Handler {
+	return r.handleLeader()
 }
 
 func (r *RestElection) handleLeader() http.HandlerFunc {
@@ -160,7 +354,7 @@ func (r *RestElection) handleLeader() http.HandlerFunc {
 			leader, err := r.IsLeader()
 			if err != nil {
 				log.Error("msg", "Failed on leader check", "err", err)
-				http.Error(response, err.Error(), http.StatusInternalServerError)
+				WriteError(response, http.StatusInternalServerError, ErrCodeInternal, "leader check failed", err)
 				return
 			}
 			_, _ = fmt.Fprintf(response, "%v", leader)
@@ -168,13 +362,13 @@ func (r *RestElection) handleLeader() http.HandlerFunc {
 			body, err := io.ReadAll(request.Body)
 			if err != nil {
 				log.Error("msg", "Error reading request body", "err", err)
-				http.Error(response, "Can't read body", http.StatusBadRequest)
+				WriteError(response, http.StatusBadRequest, ErrCodeReadError, "Can't read body", nil)
 				return
 			}
 			flag, err := strconv.Atoi(string(body))
 			if err != nil {
 				log.Error("msg", "Error parsing to int", "body", string(body), "err", err)
-				http.Error(response, "1 or 0 expected in request body", http.StatusBadRequest)
+				WriteError(response, http.StatusBadRequest, ErrCodeBadRequest, "1 or 0 expected in request body", nil)
 				return
 			}
 			switch flag {
@@ -183,59 +377,158 @@ func (r *RestElection) handleLeader() http.HandlerFunc {
 				err = r.Resign()
 				if err != nil {
 					log.Error("err", err)
-					http.Error(response, err.Error(), http.StatusInternalServerError)
+					WriteError(response, http.StatusInternalServerError, ErrCodeInternal, "resign failed", err)
 					return
 				}
 				_, _ = fmt.Fprintf(response, "%v", true)
 			case 1:
-				// become a leader
-				leader, err := r.BecomeLeader()
+				// become a leader, or claim the lease on behalf of another instance
+				claimant := request.URL.Query().Get("id")
+				if claimant == "" {
+					claimant = r.id
+				}
+				r.Claim(claimant)
+				leader, err := r.IsLeader()
 				if err != nil {
 					log.Error("msg", "Failed to become a leader", "err", err)
-					http.Error(response, err.Error(), http.StatusInternalServerError)
+					WriteError(response, http.StatusInternalServerError, ErrCodeInternal, "leader check failed", err)
 					return
 				}
 				_, _ = fmt.Fprintf(response, "%v", leader)
 			default:
 				log.Error("msg", "Wrong number in request body", "body", string(body), "err", err)
-				http.Error(response, "1 or 0 expected in request body", http.StatusBadRequest)
+				WriteError(response, http.StatusBadRequest, ErrCodeBadRequest, "1 or 0 expected in request body", nil)
 				return
 			}
 		default:
 			log.Error("msg", "Request method not supported")
-			http.Error(response, "Request method not supported", http.StatusBadRequest)
+			WriteError(response, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Request method not supported", nil)
 		}
 	}
 }
 
+// RestLeaseStatus describes the current state of the REST election lease.
+type RestLeaseStatus struct {
+	ID      string     `json:"id"`
+	Leader  bool       `json:"leader"`
+	Holder  string     `json:"holder"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Status returns the current lease state as seen by this instance.
+func (r *RestElection) Status() RestLeaseStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expireLocked()
+	status := RestLeaseStatus{ID: r.id, Holder: r.holder, Leader: r.holder == r.id && r.holder != ""}
+	if r.holder != "" && r.ttl > 0 {
+		expiry := r.expiry
+		status.Expires = &expiry
+	}
+	return status
+}
+
+// StatusHandler serves the lease state as JSON on GET requests.
+func (r *RestElection) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			WriteError(response, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(response).Encode(r.Status()); err != nil {
+			log.Error("msg", "Failed to encode lease status", "err", err)
+		}
+	})
+}
+
+// ResignHandler resigns the leadership of this instance on PUT requests.
+func (r *RestElection) ResignHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPut {
+			WriteError(response, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Request method not supported", nil)
+			return
+		}
+		if err := r.Resign(); err != nil {
+			log.Error("err", err)
+			WriteError(response, http.StatusInternalServerError, ErrCodeInternal, "resign failed", err)
+			return
+		}
+		_, _ = fmt.Fprintf(response, "%v", true)
+	})
+}
+
 func (r *RestElection) ID() string {
-	return ""
+	return r.id
 }
 
-func (r *RestElection) BecomeLeader() (bool, error) {
+// Claim tries to acquire or refresh the lease for the given claimant and reports whether the
+// claimant holds the lease afterwards.
+func (r *RestElection) Claim(claimant string) bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	if r.leader {
+	r.expireLocked()
+	now := r.now()
+	switch {
+	case r.holder == "":
+		r.transition(leaseAcquired, claimant)
+		r.acquired = now
+	case r.holder == claimant:
+		r.transition(leaseRefreshed, claimant)
+	case claimant < r.holder && now.Sub(r.acquired) < restClaimWindow:
+		log.Warn("msg", "Simultaneous claims, claimant with the lower ID wins", "holder", r.holder, "claimant", claimant)
+		r.transition(leasePreempted, claimant)
+	default:
+		log.Warn("msg", "Lease contested, current holder keeps it", "holder", r.holder, "claimant", claimant)
+		RestLeaseTransitions.WithLabelValues(leaseRejected).Inc()
+		return false
+	}
+	r.holder = claimant
+	r.expiry = now.Add(r.ttl)
+	return true
+}
+
+func (r *RestElection) BecomeLeader() (bool, error) {
+	if leader, _ := r.IsLeader(); leader {
 		log.Warn("msg", "Instance is already a leader")
-		return r.leader, nil
 	}
-	r.leader = true
-	return r.leader, nil
+	return r.Claim(r.id), nil
 }
 
 func (r *RestElection) IsLeader() (bool, error) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	return r.leader, nil
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expireLocked()
+	return r.holder != "" && r.holder == r.id, nil
 }
 
 func (r *RestElection) Resign() error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	if !r.leader {
+	r.expireLocked()
+	if r.holder != r.id || r.holder == "" {
 		log.Warn("msg", "Can't resign when not a leader")
 		return nil
 	}
-	r.leader = false
+	r.transition(leaseResigned, r.holder)
+	r.holder = ""
 	return nil
 }
+
+// expireLocked drops the lease once its TTL has passed. Must be called with the mutex held.
+func (r *RestElection) expireLocked() {
+	if r.holder == "" || r.ttl <= 0 || r.now().Before(r.expiry) {
+		return
+	}
+	r.transition(leaseExpired, r.holder)
+	r.holder = ""
+}
+
+func (r *RestElection) transition(transition, holder string) {
+	RestLeaseTransitions.WithLabelValues(transition).Inc()
+	if transition == leaseRefreshed {
+		log.Debug("msg", "REST election lease refreshed", "holder", holder, "self", r.id)
+		return
+	}
+	log.Info("msg", "REST election lease "+transition, "holder", holder, "self", r.id)
+}
@@ -2,14 +2,19 @@ package util
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestRestElection(t *testing.T) {
-	http.DefaultServeMux = new(http.ServeMux)
-	re := NewRestElection()
+	re := NewRestElection("a", 0)
 	if leader, _ := re.IsLeader(); leader {
 		t.Error("Initially there is no leader")
 	}
@@ -26,8 +31,7 @@ func TestRestElection(t *testing.T) {
 }
 
 func TestRESTApi(t *testing.T) {
-	http.DefaultServeMux = new(http.ServeMux)
-	re := NewRestElection()
+	re := NewRestElection("a", 0)
 	becomeLeaderReq, err := http.NewRequest("PUT", "/admin/leader", bytes.NewReader([]byte("1")))
 	if err != nil {
 		t.Fatal(err)
@@ -60,3 +64,361 @@ func TestRESTApi(t *testing.T) {
 		t.Error("Failed to resign")
 	}
 }
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestRestElection(id string, ttl time.Duration) (*RestElection, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	re := NewRestElection(id, ttl)
+	re.now = clock.Now
+	return re, clock
+}
+
+func TestRestElectionLeaseExpiry(t *testing.T) {
+	re, clock := newTestRestElection("a", 10*time.Second)
+	if leader, _ := re.BecomeLeader(); !leader {
+		t.Fatal("Failed to elect")
+	}
+	clock.now = clock.now.Add(9 * time.Second)
+	if leader, _ := re.IsLeader(); !leader {
+		t.Error("Lease should still be valid")
+	}
+	// refresh extends the lease
+	re.Claim("a")
+	clock.now = clock.now.Add(9 * time.Second)
+	if leader, _ := re.IsLeader(); !leader {
+		t.Error("Refreshed lease should still be valid")
+	}
+	clock.now = clock.now.Add(2 * time.Second)
+	if leader, _ := re.IsLeader(); leader {
+		t.Error("Lease should have expired")
+	}
+	if status := re.Status(); status.Holder != "" {
+		t.Errorf("Expired lease should have no holder, got %q", status.Holder)
+	}
+	// after expiry another instance can claim the lease
+	if !re.Claim("b") {
+		t.Error("Expired lease should be claimable by another instance")
+	}
+	if leader, _ := re.IsLeader(); leader {
+		t.Error("Lease is held by another instance")
+	}
+}
+
+func TestRestElectionNoTTLNeverExpires(t *testing.T) {
+	re, clock := newTestRestElection("a", 0)
+	re.BecomeLeader()
+	clock.now = clock.now.Add(24 * time.Hour)
+	if leader, _ := re.IsLeader(); !leader {
+		t.Error("Lease without TTL should never expire")
+	}
+}
+
+func TestRestElectionTieBreak(t *testing.T) {
+	orders := [][]string{{"a", "b"}, {"b", "a"}}
+	for _, order := range orders {
+		re, _ := newTestRestElection("b", 10*time.Second)
+		for _, claimant := range order {
+			re.Claim(claimant)
+		}
+		status := re.Status()
+		if status.Holder != "a" {
+			t.Errorf("Claim order %v: expected lowest ID to win, got %q", order, status.Holder)
+		}
+		if status.Leader {
+			t.Errorf("Claim order %v: instance b should not be the leader", order)
+		}
+	}
+}
+
+func TestRestElectionValidLeaseNotPreempted(t *testing.T) {
+	re, clock := newTestRestElection("b", 10*time.Second)
+	if leader, _ := re.BecomeLeader(); !leader {
+		t.Fatal("Failed to elect")
+	}
+	clock.now = clock.now.Add(restClaimWindow)
+	if re.Claim("a") {
+		t.Error("A lower ID must not take over a valid lease after the claim window")
+	}
+	if leader, _ := re.IsLeader(); !leader {
+		t.Error("The holder of a valid lease should stay the leader")
+	}
+	// the holder refreshing its lease doesn't open a new claim window
+	re.Claim("b")
+	if re.Claim("a") {
+		t.Error("A lower ID must not take over a refreshed lease")
+	}
+	clock.now = clock.now.Add(10 * time.Second)
+	if !re.Claim("a") {
+		t.Error("An expired lease should be claimable by another instance")
+	}
+}
+
+func TestRestElectionStatusAndResignEndpoints(t *testing.T) {
+	re, clock := newTestRestElection("a", 10*time.Second)
+	re.BecomeLeader()
+
+	recorder := httptest.NewRecorder()
+	re.StatusHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/leader/status", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected HTTP 200 Status Code, got %d", recorder.Code)
+	}
+	var status RestLeaseStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Leader || status.Holder != "a" || status.Expires == nil || !status.Expires.Equal(clock.now.Add(10*time.Second)) {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	recorder = httptest.NewRecorder()
+	re.ResignHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/leader/resign", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected HTTP 405 Status Code, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	re.ResignHandler().ServeHTTP(recorder, httptest.NewRequest("PUT", "/leader/resign", nil))
+	if recorder.Code != 200 {
+		t.Errorf("Expected HTTP 200 Status Code, got %d", recorder.Code)
+	}
+	if leader, _ := re.IsLeader(); leader {
+		t.Error("Failed to resign")
+	}
+}
+
+func TestRESTApiErrorCodes(t *testing.T) {
+	re, _ := newTestRestElection("a", 0)
+	recorder := httptest.NewRecorder()
+	re.handleLeader().ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/leader", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected HTTP 405 Status Code, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	re.handleLeader().ServeHTTP(recorder, httptest.NewRequest("PUT", "/admin/leader", bytes.NewReader([]byte("2"))))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected HTTP 400 Status Code, got %d", recorder.Code)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != ErrCodeBadRequest {
+		t.Errorf("Expected code %q, got %q", ErrCodeBadRequest, resp.Code)
+	}
+}
+
+// newTestScheduledElector returns a scheduled elector of a fake election, elected by calling scheduledStep,
+// with the liveness checks reading the time of the fake clock.
+func newTestScheduledElector() (*ScheduledElector, *FakeElection, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	election := NewFakeElection("a")
+	return newScheduledElector(election, nil, clock.Now), election, clock
+}
+
+func checkLeader(t *testing.T, elector LeaderElector, expected bool) {
+	t.Helper()
+	leader, err := elector.IsLeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader != expected {
+		t.Fatalf("Expected leader %v, got %v", expected, leader)
+	}
+}
+
+func TestScheduledElectorAcquisition(t *testing.T) {
+	se, election, _ := newTestScheduledElector()
+	election.SetHeldElsewhere(true)
+	se.scheduledStep()
+	checkLeader(t, se, false)
+
+	election.SetHeldElsewhere(false)
+	se.scheduledStep()
+	checkLeader(t, se, true)
+	// the leader doesn't try to become the leader again
+	se.scheduledStep()
+	if attempts := election.Attempts(); attempts != 2 {
+		t.Errorf("Expected 2 attempts to become the leader, got %d", attempts)
+	}
+}
+
+func TestScheduledElectorLoss(t *testing.T) {
+	se, election, _ := newTestScheduledElector()
+	se.scheduledStep()
+	checkLeader(t, se, true)
+
+	// the lock is lost, eg. with its session, and taken by another instance
+	election.SetLeader(false)
+	election.SetHeldElsewhere(true)
+	se.scheduledStep()
+	checkLeader(t, se, false)
+
+	election.SetHeldElsewhere(false)
+	se.scheduledStep()
+	checkLeader(t, se, true)
+
+	// a failing leader check doesn't count as leadership, nor trigger an attempt
+	election.SetError(errors.New("connection lost"))
+	attempts := election.Attempts()
+	if se.Elect() {
+		t.Error("Expected no leadership while the leader check fails")
+	}
+	if election.Attempts() != attempts {
+		t.Error("Expected no attempt to become the leader while the leader check fails")
+	}
+}
+
+func TestScheduledElectorLivenessTimeout(t *testing.T) {
+	const timeout = 10 * time.Second
+	se, election, clock := newTestScheduledElector()
+	se.scheduledStep()
+	checkLeader(t, se, true)
+	lastRequest := clock.now.UnixNano()
+
+	clock.now = clock.now.Add(timeout)
+	se.PrometheusLivenessCheck(lastRequest, timeout)
+	if election.Resigns() != 0 || se.IsPausedScheduledElection() {
+		t.Fatal("Expected no resignation until the timeout is exceeded")
+	}
+
+	clock.now = clock.now.Add(time.Millisecond)
+	se.PrometheusLivenessCheck(lastRequest, timeout)
+	if election.Resigns() != 1 || !se.IsPausedScheduledElection() {
+		t.Fatalf("Expected to resign and pause once the timeout is exceeded, got %d resignations", election.Resigns())
+	}
+	checkLeader(t, se, false)
+
+	// paused, the instance doesn't try to become the leader, and doesn't resign again
+	attempts := election.Attempts()
+	se.scheduledStep()
+	se.PrometheusLivenessCheck(lastRequest, timeout)
+	if election.Attempts() != attempts || election.Resigns() != 1 {
+		t.Errorf("Expected no election while paused, got %d attempts and %d resignations", election.Attempts()-attempts, election.Resigns())
+	}
+
+	// a request from Prometheus resumes the election
+	se.PrometheusLivenessCheck(clock.now.Add(-time.Second).UnixNano(), timeout)
+	if se.IsPausedScheduledElection() {
+		t.Fatal("Expected the election to resume once Prometheus is back")
+	}
+	se.scheduledStep()
+	checkLeader(t, se, true)
+}
+
+func TestScheduledElectorFollowerLiveness(t *testing.T) {
+	const timeout = 10 * time.Second
+	se, election, clock := newTestScheduledElector()
+	election.SetHeldElsewhere(true)
+	se.scheduledStep()
+	lastRequest := clock.now.UnixNano()
+
+	// a follower without requests stays in the election, to take over from a leader that's gone
+	clock.now = clock.now.Add(time.Hour)
+	se.PrometheusLivenessCheck(lastRequest, timeout)
+	if election.Resigns() != 0 || se.IsPausedScheduledElection() {
+		t.Error("Expected a follower not to resign nor pause")
+	}
+}
+
+// handingOffElection is a fake election handing its leadership off.
+type handingOffElection struct {
+	*FakeElection
+	handingOff bool
+}
+
+func (h *handingOffElection) HandingOff() bool {
+	return h.handingOff
+}
+
+func TestScheduledElectorMetrics(t *testing.T) {
+	const timeout = 10 * time.Second
+	se, election, clock := newTestScheduledElector()
+	resignations := func(cause string) float64 {
+		return testutil.ToFloat64(ElectionResignations.WithLabelValues(cause))
+	}
+	lockLost, liveness, manual := resignations(resignLockLost), resignations(resignLivenessTimeout), resignations(resignManual)
+	verified, acquired := histogramCount(t, ElectionStepDuration.WithLabelValues("verify").(prometheus.Metric)), histogramCount(t, ElectionStepDuration.WithLabelValues("acquire").(prometheus.Metric))
+	regained := histogramCount(t, ElectionRegainedAfter)
+
+	se.scheduledStep()
+	if since := sinceConfirmed(clock.now.Add(3 * time.Second)); since != 3 {
+		t.Errorf("Expected the leadership to be confirmed 3s ago, got %v", since)
+	}
+	se.scheduledStep()
+	if n := histogramCount(t, ElectionStepDuration.WithLabelValues("verify").(prometheus.Metric)) - verified; n != 2 {
+		t.Errorf("Expected 2 verifications to be observed, got %d", n)
+	}
+	if n := histogramCount(t, ElectionStepDuration.WithLabelValues("acquire").(prometheus.Metric)) - acquired; n != 1 {
+		t.Errorf("Expected 1 acquisition to be observed, got %d", n)
+	}
+
+	// lost and regained a minute later
+	election.SetLeader(false)
+	election.SetHeldElsewhere(true)
+	se.scheduledStep()
+	se.scheduledStep()
+	if n := resignations(resignLockLost) - lockLost; n != 1 {
+		t.Errorf("Expected 1 lost lock to be counted, got %v", n)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	election.SetHeldElsewhere(false)
+	se.scheduledStep()
+	if n := histogramCount(t, ElectionRegainedAfter) - regained; n != 1 {
+		t.Errorf("Expected the time to regain the leadership to be observed, got %d", n)
+	}
+
+	lastRequest := clock.now.UnixNano()
+	clock.now = clock.now.Add(timeout + time.Second)
+	se.PrometheusLivenessCheck(lastRequest, timeout)
+	if n := resignations(resignLivenessTimeout) - liveness; n != 1 {
+		t.Errorf("Expected 1 liveness timeout to be counted, got %v", n)
+	}
+	se.PrometheusLivenessCheck(clock.now.UnixNano(), timeout)
+	se.scheduledStep()
+	if err := se.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if n := resignations(resignManual) - manual; n != 1 {
+		t.Errorf("Expected 1 manual resignation to be counted, got %v", n)
+	}
+	// resigning again isn't counted, nor the followers seeing they aren't the leader
+	_ = se.Resign()
+	se.scheduledStep()
+	if resignations(resignManual)-manual != 1 || resignations(resignLockLost)-lockLost != 1 {
+		t.Error("Expected only the loss of the leadership to be counted")
+	}
+}
+
+func TestScheduledElectorHandoff(t *testing.T) {
+	election := &handingOffElection{FakeElection: NewFakeElection("a")}
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	se := newScheduledElector(election, nil, clock.Now)
+	handoffs := testutil.ToFloat64(ElectionResignations.WithLabelValues(resignHandoff))
+	se.scheduledStep()
+	election.handingOff = true
+	election.SetLeader(false)
+	election.SetHeldElsewhere(true)
+	se.scheduledStep()
+	if n := testutil.ToFloat64(ElectionResignations.WithLabelValues(resignHandoff)) - handoffs; n != 1 {
+		t.Errorf("Expected the handoff to be counted, got %v", n)
+	}
+}
+
+func TestScheduledElectorTicks(t *testing.T) {
+	ticks := make(chan time.Time)
+	election := NewFakeElection("a")
+	se := newScheduledElector(election, ticks, time.Now)
+	ticks <- time.Now()
+	// the tick is handled once the next one is received
+	ticks <- time.Now()
+	checkLeader(t, se, true)
+	close(ticks)
+}
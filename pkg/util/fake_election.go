@@ -0,0 +1,87 @@
+package util
+
+import "sync"
+
+// FakeElection is a deterministic Election for tests. BecomeLeader succeeds unless the leadership is held by
+// another instance; SetLeader simulates acquiring or losing it by other means, eg. a lost database session.
+type FakeElection struct {
+	id string
+
+	mutex         sync.Mutex
+	leader        bool
+	heldElsewhere bool
+	err           error
+	attempts      int
+	resigns       int
+}
+
+// NewFakeElection returns a fake election of the instance with the given ID, which isn't the leader.
+func NewFakeElection(id string) *FakeElection {
+	return &FakeElection{id: id}
+}
+
+func (f *FakeElection) ID() string {
+	return f.id
+}
+
+func (f *FakeElection) BecomeLeader() (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.attempts++
+	if f.err != nil {
+		return false, f.err
+	}
+	if !f.heldElsewhere {
+		f.leader = true
+	}
+	return f.leader, nil
+}
+
+func (f *FakeElection) IsLeader() (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.leader && f.err == nil, f.err
+}
+
+func (f *FakeElection) Resign() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.resigns++
+	f.leader = false
+	return nil
+}
+
+// SetLeader makes the instance the leader or a follower.
+func (f *FakeElection) SetLeader(leader bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.leader = leader
+}
+
+// SetHeldElsewhere makes BecomeLeader fail to acquire the leadership, as if another instance held it.
+func (f *FakeElection) SetHeldElsewhere(held bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.heldElsewhere = held
+}
+
+// SetError makes the leader checks and BecomeLeader fail with err, nil restores them.
+func (f *FakeElection) SetError(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+// Attempts returns the number of calls to BecomeLeader.
+func (f *FakeElection) Attempts() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.attempts
+}
+
+// Resigns returns the number of calls to Resign.
+func (f *FakeElection) Resigns() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.resigns
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// Error codes returned in JSON error bodies. These are part of the HTTP API and must stay stable.
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeCircuitOpen        = "circuit_open"
+	ErrCodeDecode             = "decode_error"
+	ErrCodeDigestMismatch     = "digest_mismatch"
+	ErrCodeInvalidData        = "invalid_data"
+	ErrCodeInternal           = "internal_error"
+	ErrCodeLimitExceeded      = "limit_exceeded"
+	ErrCodeMethodNotAllowed   = "method_not_allowed"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeNotLeader          = "not_leader"
+	ErrCodeNotReady           = "not_ready"
+	ErrCodeNotVisible         = "not_visible"
+	ErrCodeOverloaded         = "overloaded"
+	ErrCodeQuery              = "query_error"
+	ErrCodeQuotaExceeded      = "quota_exceeded"
+	ErrCodeReadError          = "read_error"
+	ErrCodeStorageFull        = "storage_full"
+	ErrCodeStorageUnavailable = "storage_unavailable"
+	ErrCodeTooLarge           = "too_large"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeUnsupportedMedia   = "unsupported_media_type"
+	ErrCodeWriteStale         = "write_stale"
+)
+
+// LegacyErrorBodies switches error responses back to plain-text bodies carrying the underlying error text.
+// Deprecated: kept for one release for clients depending on the old bodies.
+var LegacyErrorBodies = false
+
+// DefaultRetryAfter is the Retry-After of 429 and 503 responses of which the cause doesn't tell when to retry,
+// eg. a database shutting down.
+const DefaultRetryAfter = 5 * time.Second
+
+// RetryAfterSeconds observes the Retry-After of the 429 and 503 responses, to see what clients are told.
+var RetryAfterSeconds = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "http_retry_after_seconds",
+		Help:    "Retry-After header value of the 429 and 503 responses, in seconds.",
+		Buckets: []float64{1, 2, 5, 10, 30, 60, 300, 3600, 86400},
+	},
+)
+
+// RetryAfterer is implemented by the errors of requests that may be retried after some time.
+type RetryAfterer interface {
+	RetryAfter() time.Duration
+}
+
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+func (e *retryAfterError) RetryAfter() time.Duration {
+	return e.after
+}
+
+// WithRetryAfter wraps err as the error of a request that may be retried after the given time.
+func WithRetryAfter(err error, after time.Duration) error {
+	return &retryAfterError{err: err, after: after}
+}
+
+// ErrorResponse is the JSON body sent along with non-2xx responses.
+type ErrorResponse struct {
+	Status    string `json:"status,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+}
+
+// WriteError replies with a JSON error body and the given status. The cause is only logged at debug level,
+// so internal details (eg. SQL errors) don't end up in the response. 429 and 503 responses get a Retry-After
+// header, from the cause if it is a RetryAfterer and DefaultRetryAfter otherwise.
+func WriteError(w http.ResponseWriter, status int, code string, msg string, cause error) {
+	writeErrorResponse(w, status, ErrorResponse{Error: msg, Code: code}, cause)
+}
+
+// WriteAPIError is WriteError for the Prometheus-compatible HTTP API, wrapping the error in the
+// Prometheus response envelope with the given error type (eg. "bad_data").
+func WriteAPIError(w http.ResponseWriter, status int, errorType string, code string, msg string, cause error) {
+	writeErrorResponse(w, status, ErrorResponse{Status: "error", ErrorType: errorType, Error: msg, Code: code}, cause)
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, at least 1.
+func setRetryAfter(h http.Header, cause error) {
+	after := DefaultRetryAfter
+	var retry RetryAfterer
+	if errors.As(cause, &retry) {
+		after = retry.RetryAfter()
+	}
+	seconds := int(math.Max(1, math.Ceil(after.Seconds())))
+	RetryAfterSeconds.Observe(float64(seconds))
+	h.Set("Retry-After", strconv.Itoa(seconds))
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, resp ErrorResponse, cause error) {
+	msg, code := resp.Error, resp.Code
+	if cause != nil {
+		log.Debug("msg", "HTTP error response", "code", code, "status", status, "err", cause)
+	}
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		setRetryAfter(w.Header(), cause)
+	}
+	if LegacyErrorBodies {
+		if cause != nil {
+			msg = cause.Error()
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestWriteErrorRetryAfter(t *testing.T) {
+	cause := errors.New("unavailable")
+	for _, c := range []struct {
+		status   int
+		cause    error
+		expected string
+	}{
+		{status: http.StatusServiceUnavailable, cause: cause, expected: "5"},
+		{status: http.StatusServiceUnavailable, cause: nil, expected: "5"},
+		{status: http.StatusTooManyRequests, cause: WithRetryAfter(cause, 1500*time.Millisecond), expected: "2"},
+		{status: http.StatusServiceUnavailable, cause: fmt.Errorf("writing: %w", WithRetryAfter(cause, time.Hour)), expected: "3600"},
+		{status: http.StatusServiceUnavailable, cause: WithRetryAfter(cause, 0), expected: "1"},
+		{status: http.StatusInternalServerError, cause: WithRetryAfter(cause, time.Minute)},
+		{status: http.StatusBadRequest},
+	} {
+		count := histogramCount(t, RetryAfterSeconds)
+		recorder := httptest.NewRecorder()
+		WriteError(recorder, c.status, ErrCodeStorageUnavailable, "retry later", c.cause)
+		if got := recorder.Header().Get("Retry-After"); got != c.expected {
+			t.Errorf("%d %v: expected Retry-After %q, got %q", c.status, c.cause, c.expected, got)
+		}
+		observed := histogramCount(t, RetryAfterSeconds) - count
+		if (c.expected != "") != (observed == 1) {
+			t.Errorf("%d %v: expected the Retry-After to be observed once if set, got %d", c.status, c.cause, observed)
+		}
+	}
+	if err := WithRetryAfter(cause, time.Second); !errors.Is(err, cause) || err.Error() != "unavailable" {
+		t.Errorf("Expected the wrapped error to be kept, got %v", err)
+	}
+}
+
+func histogramCount(t *testing.T, histogram prometheus.Metric) uint64 {
+	t.Helper()
+	metric := &dto.Metric{}
+	if err := histogram.Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// KubernetesElectionConfig configures the election over a coordination.k8s.io Lease.
+type KubernetesElectionConfig struct {
+	LeaseName string
+	// Namespace of the lease, defaults to the namespace of the pod, or "default" outside of a cluster.
+	Namespace string
+	// Identity of the instance in the lease, defaults to the hostname, which is the pod name.
+	Identity string
+	// Kubeconfig is the kubeconfig file to use outside of a cluster. If empty, the in-cluster configuration
+	// is used, falling back to the default kubeconfig (KUBECONFIG or ~/.kube/config).
+	Kubeconfig    string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// KubernetesElection is a leader election over a Lease object, using client-go's leader election. Unlike
+// PgAdvisoryLock, it keeps working while the database is down. The election runs in the background from
+// its creation until Resign, and again after BecomeLeader.
+type KubernetesElection struct {
+	cfg     KubernetesElectionConfig
+	elector *leaderelection.LeaderElector
+
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewKubernetesElection connects to the Kubernetes API and starts contending for the lease.
+func NewKubernetesElection(cfg KubernetesElectionConfig) (*KubernetesElection, error) {
+	restConfig, err := kubernetesConfig(cfg.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the Kubernetes configuration: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the Kubernetes client: %w", err)
+	}
+	return newKubernetesElection(client, cfg)
+}
+
+// kubernetesConfig returns the in-cluster configuration, or the one of the kubeconfig file.
+func kubernetesConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+	if !errors.Is(err, rest.ErrNotInCluster) {
+		return nil, err
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+func newKubernetesElection(client kubernetes.Interface, cfg KubernetesElectionConfig) (*KubernetesElection, error) {
+	if cfg.Namespace == "" {
+		cfg.Namespace = "default"
+		if namespace, err := os.ReadFile(serviceAccountNamespace); err == nil {
+			cfg.Namespace = strings.TrimSpace(string(namespace))
+		}
+	}
+	if cfg.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error getting the hostname as identity: %w", err)
+		}
+		cfg.Identity = hostname
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: cfg.LeaseName, Namespace: cfg.Namespace},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: cfg.Identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            cfg.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info("msg", "Acquired the Kubernetes lease", "lease", cfg.LeaseName, "identity", cfg.Identity)
+			},
+			OnStoppedLeading: func() {
+				log.Info("msg", "Released the Kubernetes lease", "lease", cfg.LeaseName, "identity", cfg.Identity)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != cfg.Identity {
+					log.Info("msg", "New leader holds the Kubernetes lease", "lease", cfg.LeaseName, "leader", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	k := &KubernetesElection{cfg: cfg, elector: elector}
+	k.start()
+	return k, nil
+}
+
+// start runs the election until Resign. A lost lease is contended for again.
+func (k *KubernetesElection) start() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	k.cancel, k.done = cancel, done
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			// Run returns when the lease is lost or the context is canceled
+			k.elector.Run(ctx)
+		}
+	}()
+}
+
+// ID returns the identity of the instance in the lease.
+func (k *KubernetesElection) ID() string {
+	return k.cfg.Identity
+}
+
+// BecomeLeader resumes contending for the lease after Resign. The lease is acquired in the background, so
+// it returns whether the instance is the leader at the moment.
+func (k *KubernetesElection) BecomeLeader() (bool, error) {
+	k.start()
+	return k.elector.IsLeader(), nil
+}
+
+// IsLeader tells whether the instance holds the lease.
+func (k *KubernetesElection) IsLeader() (bool, error) {
+	return k.elector.IsLeader(), nil
+}
+
+// Resign releases the lease and stops contending for it until BecomeLeader.
+func (k *KubernetesElection) Resign() error {
+	k.mutex.Lock()
+	cancel, done := k.cancel, k.done
+	k.cancel, k.done = nil, nil
+	k.mutex.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+	return nil
+}
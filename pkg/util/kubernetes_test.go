@@ -0,0 +1,65 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func waitForLeader(t *testing.T, election *KubernetesElection, leader bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if isLeader, _ := election.IsLeader(); isLeader == leader {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to be leader: %v", election.ID(), leader)
+}
+
+func TestKubernetesElection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// the lease stores its duration in whole seconds
+	cfg := KubernetesElectionConfig{
+		LeaseName:     "adapter",
+		Namespace:     "monitoring",
+		LeaseDuration: 2 * time.Second,
+		RenewDeadline: time.Second,
+		RetryPeriod:   50 * time.Millisecond,
+	}
+	cfg.Identity = "first"
+	first, err := newKubernetesElection(client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Resign()
+	waitForLeader(t, first, true)
+
+	cfg.Identity = "second"
+	second, err := newKubernetesElection(client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Resign()
+	time.Sleep(2 * cfg.RetryPeriod)
+	if leader, _ := second.IsLeader(); leader {
+		t.Fatal("Expected the second instance not to take the held lease")
+	}
+
+	// resigning releases the lease right away
+	if err := first.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, first, false)
+	waitForLeader(t, second, true)
+
+	if _, err := first.BecomeLeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, first, true)
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Policies for label names and metric names that don't follow the Prometheus naming rules.
+const (
+	// NamePolicyReject rejects write requests with invalid names.
+	NamePolicyReject = "reject"
+	// NamePolicyNormalize replaces the invalid characters of names, see NormalizeLabelNames.
+	NamePolicyNormalize = "normalize"
+	// NamePolicyAllow stores invalid names as they are.
+	NamePolicyAllow = "allow"
+)
+
+// ValidateNamePolicy checks that policy is one of the name policies.
+func ValidateNamePolicy(policy string) error {
+	switch policy {
+	case NamePolicyReject, NamePolicyNormalize, NamePolicyAllow:
+		return nil
+	}
+	return fmt.Errorf("unknown name policy %q, expected %q, %q or %q", policy, NamePolicyReject, NamePolicyNormalize, NamePolicyAllow)
+}
+
+// IsValidLabelName tells whether name matches [a-zA-Z_][a-zA-Z0-9_]*. Unlike model.LabelName.IsValid, it
+// doesn't depend on model.NameValidationScheme.
+func IsValidLabelName(name string) bool {
+	return isValidName(name, false)
+}
+
+// IsValidMetricName tells whether name matches [a-zA-Z_:][a-zA-Z0-9_:]*.
+func IsValidMetricName(name string) bool {
+	return isValidName(name, true)
+}
+
+func isValidName(name string, colons bool) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !validNameByte(name[i], i == 0, colons) {
+			return false
+		}
+	}
+	return true
+}
+
+func validNameByte(b byte, first bool, colons bool) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (!first && b >= '0' && b <= '9') || (colons && b == ':')
+}
+
+// NormalizeLabelName replaces each character of name not allowed in label names with '_', be it a rune or a
+// byte that isn't valid UTF-8. A name starting with a digit is prefixed with '_', the empty name is "_". Valid
+// names are returned unchanged.
+func NormalizeLabelName(name string) string {
+	return normalizeName(name, false)
+}
+
+// NormalizeMetricName is NormalizeLabelName for metric names, which may contain colons too.
+func NormalizeMetricName(name string) string {
+	return normalizeName(name, true)
+}
+
+func normalizeName(name string, colons bool) string {
+	if isValidName(name, colons) {
+		return name
+	}
+	var b strings.Builder
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		b.WriteByte('_')
+	}
+	for i, r := range name {
+		if r < 0x80 && validNameByte(byte(r), i == 0 && b.Len() == 0, colons) {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteByte('_')
+	}
+	return b.String()
+}
+
+// CollisionLabelName is the name an invalid label name normalizes to when another name of its label set
+// normalizes to the same name: NormalizeLabelName suffixed with '_' and the 8 hex digits of the 32-bit
+// FNV-1a hash of the name.
+func CollisionLabelName(name string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return fmt.Sprintf("%s_%08x", NormalizeLabelName(name), h.Sum32())
+}
+
+// NormalizeLabelNames returns the label names of a label set normalized, in the same order. Valid names are
+// kept. An invalid name becomes NormalizeLabelName of it, unless another name of the set, valid or not,
+// normalizes to the same name: then it becomes CollisionLabelName of it. The mapping of a name only depends on
+// the set through collisions, so a matcher on an invalid name matches NormalizeLabelName of it, or
+// CollisionLabelName of it in the label sets where it collided.
+func NormalizeLabelNames(names []string) []string {
+	normalized := make([]string, len(names))
+	counts := make(map[string]int, len(names))
+	for i, name := range names {
+		normalized[i] = NormalizeLabelName(name)
+		counts[normalized[i]]++
+	}
+	for i, name := range names {
+		if normalized[i] != name && counts[normalized[i]] > 1 {
+			normalized[i] = CollisionLabelName(name)
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeLabelName(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		label  string
+		metric string
+		valid  bool
+	}{
+		{name: "job", label: "job", metric: "job", valid: true},
+		{name: "__name__", label: "__name__", metric: "__name__", valid: true},
+		{name: "_", label: "_", metric: "_", valid: true},
+		{name: "Job_2", label: "Job_2", metric: "Job_2", valid: true},
+		{name: "", label: "_", metric: "_"},
+		{name: "http.method", label: "http_method", metric: "http_method"},
+		{name: "k8s-pod", label: "k8s_pod", metric: "k8s_pod"},
+		{name: "a.b-c d/e", label: "a_b_c_d_e", metric: "a_b_c_d_e"},
+		{name: "2xx", label: "_2xx", metric: "_2xx"},
+		{name: "9", label: "_9", metric: "_9"},
+		{name: ".hidden", label: "_hidden", metric: "_hidden"},
+		{name: "-", label: "_", metric: "_"},
+		{name: "node:cpu:rate5m", label: "node_cpu_rate5m", metric: "node:cpu:rate5m"},
+		{name: ":leading", label: "_leading", metric: ":leading"},
+		{name: "température", label: "temp_rature", metric: "temp_rature"},
+		{name: "日本", label: "__", metric: "__"},
+		{name: "emoji_😀", label: "emoji__", metric: "emoji__"},
+		{name: "bad\xffbyte", label: "bad_byte", metric: "bad_byte"},
+		{name: "\xff\xfe", label: "__", metric: "__"},
+		{name: "tab\there", label: "tab_here", metric: "tab_here"},
+	} {
+		if got := NormalizeLabelName(c.name); got != c.label {
+			t.Errorf("NormalizeLabelName(%q): expected %q, got %q", c.name, c.label, got)
+		}
+		if got := NormalizeMetricName(c.name); got != c.metric {
+			t.Errorf("NormalizeMetricName(%q): expected %q, got %q", c.name, c.metric, got)
+		}
+		if IsValidLabelName(c.name) != c.valid {
+			t.Errorf("IsValidLabelName(%q): expected %v", c.name, c.valid)
+		}
+		if !IsValidLabelName(c.label) || !IsValidMetricName(c.metric) {
+			t.Errorf("Expected the normalized names of %q to be valid, got %q and %q", c.name, c.label, c.metric)
+		}
+		// normalizing is idempotent
+		if NormalizeLabelName(c.label) != c.label || NormalizeMetricName(c.metric) != c.metric {
+			t.Errorf("Expected the normalized names of %q to normalize to themselves", c.name)
+		}
+	}
+	if !IsValidMetricName("a:b") || IsValidLabelName("a:b") {
+		t.Error("Expected colons to be valid in metric names only")
+	}
+}
+
+func TestCollisionLabelName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"a.b": "a_b_108bf50c",
+		"a-b": "a_b_2a89df63",
+		"":    "__811c9dc5",
+	} {
+		if got := CollisionLabelName(name); got != expected {
+			t.Errorf("CollisionLabelName(%q): expected %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestNormalizeLabelNames(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		names    []string
+		expected []string
+	}{
+		{name: "empty", names: []string{}, expected: []string{}},
+		{name: "valid", names: []string{"__name__", "job"}, expected: []string{"__name__", "job"}},
+		{name: "no collision", names: []string{"__name__", "http.method", "k8s-pod"}, expected: []string{"__name__", "http_method", "k8s_pod"}},
+		{name: "collision with a valid name", names: []string{"a_b", "a.b"}, expected: []string{"a_b", CollisionLabelName("a.b")}},
+		{name: "collision of invalid names", names: []string{"a-b", "a.b", "c"}, expected: []string{CollisionLabelName("a-b"), CollisionLabelName("a.b"), "c"}},
+		{name: "order", names: []string{"a.b", "a-b"}, expected: []string{CollisionLabelName("a.b"), CollisionLabelName("a-b")}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			got := NormalizeLabelNames(c.names)
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Expected %q, got %q", c.expected, got)
+			}
+			seen := map[string]bool{}
+			for _, name := range got {
+				if seen[name] {
+					t.Errorf("Expected the normalized names to be unique, got %q twice", name)
+				}
+				seen[name] = true
+			}
+		})
+	}
+}
+
+func TestValidateNamePolicy(t *testing.T) {
+	for _, policy := range []string{NamePolicyReject, NamePolicyNormalize, NamePolicyAllow} {
+		if err := ValidateNamePolicy(policy); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", policy, err)
+		}
+	}
+	if err := ValidateNamePolicy("drop"); err == nil {
+		t.Error("Expected an unknown policy to be invalid")
+	}
+}
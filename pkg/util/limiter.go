@@ -0,0 +1,98 @@
+package util
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errOverloaded is the cause of the requests rejected by a limiter.
+var errOverloaded = errors.New("too many concurrent requests, retry later")
+
+// ConcurrencyLimiter is an HTTP middleware bounding the number of requests handled concurrently. Requests
+// beyond the limit wait in a bounded queue for a free slot, and are rejected with 503 if the queue is
+// full or no slot frees up in time. Each endpoint that needs its own budget gets its own limiter.
+type ConcurrencyLimiter struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+	queued   atomic.Int64
+
+	inflightGauge prometheus.Gauge
+	queuedGauge   prometheus.Gauge
+	rejections    prometheus.Counter
+}
+
+// NewConcurrencyLimiter creates a limiter for up to maxConcurrency requests and maxQueue waiting ones.
+// Its metrics are prefixed with prefix, eg. `write_requests_inflight` for the prefix "write".
+func NewConcurrencyLimiter(prefix string, maxConcurrency int, maxQueue int, timeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:    make(chan struct{}, maxConcurrency),
+		maxQueue: int64(maxQueue),
+		timeout:  timeout,
+		inflightGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: prefix + "_requests_inflight",
+			Help: "Number of requests currently being handled.",
+		}),
+		queuedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: prefix + "_requests_queued",
+			Help: "Number of requests waiting for a free slot.",
+		}),
+		rejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_rejections_total",
+			Help: "Total number of requests rejected because the queue was full or no slot freed up in time.",
+		}),
+	}
+}
+
+// Collectors returns the metrics of the limiter for registration.
+func (l *ConcurrencyLimiter) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{l.inflightGauge, l.queuedGauge, l.rejections}
+}
+
+// Handler wraps the handler with the limiter.
+func (l *ConcurrencyLimiter) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			l.rejections.Inc()
+			WriteError(w, http.StatusServiceUnavailable, ErrCodeOverloaded, "too many concurrent requests, retry later", WithRetryAfter(errOverloaded, l.timeout))
+			return
+		}
+		l.inflightGauge.Inc()
+		defer func() {
+			l.inflightGauge.Dec()
+			<-l.slots
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (l *ConcurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return false
+	}
+	l.queuedGauge.Inc()
+	defer func() {
+		l.queued.Add(-1)
+		l.queuedGauge.Dec()
+	}()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
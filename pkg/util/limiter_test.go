@@ -0,0 +1,66 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter("test", 1, 1, 50*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/write", nil))
+		return recorder
+	}
+
+	var first sync.WaitGroup
+	var firstResult, queuedResult *httptest.ResponseRecorder
+	first.Add(1)
+	go func() {
+		defer first.Done()
+		firstResult = serve()
+	}()
+	<-started
+	if v := testutil.ToFloat64(limiter.inflightGauge); v != 1 {
+		t.Errorf("Expected one in-flight request, got %v", v)
+	}
+
+	// the second request queues, the third finds the queue full
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		queuedResult = serve()
+	}()
+	for i := 0; i < 100 && limiter.queued.Load() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	rejected := serve()
+	if rejected.Code != http.StatusServiceUnavailable || rejected.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After, got %d %q", rejected.Code, rejected.Header().Get("Retry-After"))
+	}
+
+	// the queued request times out while the first one is still running
+	<-queued
+	close(release)
+	first.Wait()
+	if firstResult.Code != http.StatusOK {
+		t.Errorf("Expected first request to succeed, got %d", firstResult.Code)
+	}
+	if queuedResult.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected queued request to time out, got %d", queuedResult.Code)
+	}
+	if v := testutil.ToFloat64(limiter.rejections); v != 2 {
+		t.Errorf("Expected 2 rejections, got %v", v)
+	}
+}
@@ -3,16 +3,65 @@ package util
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
 )
 
 const (
 	waitForConnectionTimeout = time.Second
+	// handoffPollInterval is how often a handoff checks whether another instance took the lock over.
+	handoffPollInterval = 100 * time.Millisecond
+)
+
+// LockReconnects counts how often the session holding the advisory lock broke, eg. on a database restart,
+// and had to be replaced.
+var LockReconnects = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "election_lock_reconnects_total",
+		Help: "Total number of times the advisory lock session was lost and replaced by a new connection.",
+	},
+)
+
+// LockIDCollisions counts the signs of another application or instance using the advisory lock ID of the
+// adapter group, as recorded in the leader registry.
+var LockIDCollisions = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "election_lock_id_collisions_total",
+		Help: "Total number of times the leader registry showed another holder of the advisory lock ID.",
+	},
+)
+
+// ElectionHandoffs counts the handoffs of the advisory lock by result: taken_over once another instance
+// holds the lock, unclaimed if none did within the grace period.
+var ElectionHandoffs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "election_handoffs_total",
+		Help: "Total number of advisory lock handoffs on shutdown, by result.",
+	},
+	[]string{"result"},
+)
+
+// ElectionTakeovers counts the times this instance acquired the advisory lock in place of another recent
+// holder, as recorded in the leader registry: by handoff from a holder shutting down, or by failover from a
+// holder that went away with the lock.
+var ElectionTakeovers = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "election_takeovers_total",
+		Help: "Total number of times the advisory lock was taken over from another instance, by cause.",
+	},
+	[]string{"cause"},
 )
 
 // PgAdvisoryLock is implementation of leader election based on PostgreSQL advisory locks. All adapters withing a HA group are trying
@@ -28,17 +77,67 @@ type PgAdvisoryLock struct {
 	conn        *sql.Conn
 	connPool    *sql.DB
 	groupLockID int
+	registry    *leaderRegistry
 
 	mutex    sync.RWMutex
 	obtained bool
+	// reconnecting is set when the lock session broke, until a new session is established.
+	reconnecting bool
+	// handoff is set once the lock was handed off: it isn't acquired again, and the instance counts as leader
+	// until handedOff is set, when another instance took over or the grace period is over.
+	handoff   bool
+	handedOff bool
 }
 
+// LeaderIdentity identifies an adapter instance in the leader registry.
+type LeaderIdentity struct {
+	Application string
+	Hostname    string
+	PID         int
+	Version     string
+}
+
+// leaderRegistry records which instance holds which advisory lock, so that other users of the same lock ID
+// (eg. a migration tool) can be detected.
+type leaderRegistry struct {
+	identity    LeaderIdentity
+	leaseWindow time.Duration
+}
+
+// noinspection SqlNoDataSourceInspection
+const (
+	sqlCreateLeaderRegistry = "create table if not exists adapter_leader_registry (lock_id bigint primary key, application_name text not null, hostname text not null, pid integer not null, version text not null, last_seen timestamp with time zone not null)"
+	sqlSelectLeaderRegistry = "select application_name, hostname, pid, version, now() - last_seen < $2 * interval '1 microsecond', last_seen = '-infinity' from adapter_leader_registry where lock_id = $1"
+	sqlUpsertLeaderRegistry = "insert into adapter_leader_registry (lock_id, application_name, hostname, pid, version, last_seen) values ($1, $2, $3, $4, $5, now()) " +
+		"on conflict (lock_id) do update set application_name = excluded.application_name, hostname = excluded.hostname, pid = excluded.pid, version = excluded.version, last_seen = excluded.last_seen"
+	sqlTouchLeaderRegistry = "update adapter_leader_registry set last_seen = now() where lock_id = $1 and hostname = $2 and pid = $3"
+	// a handoff is recorded as a last_seen of -infinity
+	sqlHandoffLeaderRegistry = "update adapter_leader_registry set last_seen = '-infinity' where lock_id = $1 and hostname = $2 and pid = $3"
+	sqlLockHeld              = "select exists (select 1 from pg_locks where locktype = 'advisory' and classid = ($1::bigint >> 32)::oid and objid = ($1::bigint & 4294967295)::oid and objsubid = 1 and granted)"
+)
+
 // NewPgAdvisoryLock creates a new instance with specified lock ID, connection pool and lock timeout.
 func NewPgAdvisoryLock(groupLockID int, connPool *sql.DB) (*PgAdvisoryLock, error) {
+	return newPgAdvisoryLock(groupLockID, connPool, nil)
+}
+
+// NewVerifiedPgAdvisoryLock is like NewPgAdvisoryLock, but records the identity of the instance in the
+// `adapter_leader_registry` table whenever it becomes the leader, warning about suspicious holders: previous
+// ones with a different application name, or other instances registering themselves while this one holds the
+// lock.
+func NewVerifiedPgAdvisoryLock(groupLockID int, connPool *sql.DB, identity LeaderIdentity, leaseWindow time.Duration) (*PgAdvisoryLock, error) {
+	if _, err := connPool.ExecContext(context.Background(), sqlCreateLeaderRegistry); err != nil {
+		return nil, fmt.Errorf("error creating leader registry: %v", err)
+	}
+	return newPgAdvisoryLock(groupLockID, connPool, &leaderRegistry{identity: identity, leaseWindow: leaseWindow})
+}
+
+func newPgAdvisoryLock(groupLockID int, connPool *sql.DB, registry *leaderRegistry) (*PgAdvisoryLock, error) {
 	lock := &PgAdvisoryLock{
 		connPool:    connPool,
 		obtained:    false,
 		groupLockID: groupLockID,
+		registry:    registry,
 	}
 	_, err := lock.TryLock()
 	if err != nil {
@@ -60,6 +159,8 @@ func getConn(pool *sql.DB, cur, maxRetries int) (*sql.Conn, error) {
 	err = checkConnection(lockConn)
 	if err != nil {
 		log.Error("msg", "Connection pool returned invalid connection", "err", err)
+		// give the connection back, so the pool discards it instead of keeping it checked out
+		_ = lockConn.Close()
 		return getConn(pool, cur+1, maxRetries)
 	}
 	return lockConn, nil
@@ -91,9 +192,15 @@ func (l *PgAdvisoryLock) Resign() error {
 func (l *PgAdvisoryLock) TryLock() (bool, error) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
+	if l.handoff {
+		return !l.handedOff, nil
+	}
 	gotLock, err := l.getAdvisoryLock()
 
 	if !gotLock || err != nil {
+		if l.obtained {
+			log.Warn("msg", "Lost the advisory lock", "lockID", l.groupLockID, "err", err)
+		}
 		l.obtained = false
 		return false, err
 	}
@@ -101,18 +208,94 @@ func (l *PgAdvisoryLock) TryLock() (bool, error) {
 	if !l.obtained {
 		l.obtained = true
 		log.Debug("msg", fmt.Sprintf("Lock obtained for group id %d", l.groupLockID))
+		if l.registry != nil {
+			l.register()
+		}
+	} else if l.registry != nil {
+		l.touchRegistration()
 	}
 
 	return true, nil
 }
 
+// register verifies the previous registered holder of the lock and records this instance as the new one.
+// It runs on the session holding the lock. Registry failures are logged, but don't affect leadership.
+func (l *PgAdvisoryLock) register() {
+	ctx := context.Background()
+	self := l.registry.identity
+	var previous LeaderIdentity
+	var recent, handedOff bool
+	err := l.conn.QueryRowContext(ctx, sqlSelectLeaderRegistry, l.groupLockID, l.registry.leaseWindow.Microseconds()).
+		Scan(&previous.Application, &previous.Hostname, &previous.PID, &previous.Version, &recent, &handedOff)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		log.Error("msg", "Failed to read leader registry", "lockID", l.groupLockID, "err", err)
+		return
+	case previous.Application != self.Application:
+		LockIDCollisions.Inc()
+		log.Warn("msg", "ADVISORY LOCK ID COLLISION: lock was previously registered by a different application. Use a lock ID that is unique to this adapter group",
+			"lockID", l.groupLockID, "application", previous.Application, "hostname", previous.Hostname, "pid", previous.PID)
+	case handedOff:
+		ElectionTakeovers.WithLabelValues("handoff").Inc()
+		log.Info("msg", "Took over the advisory lock handed off by", "lockID", l.groupLockID, "hostname", previous.Hostname, "pid", previous.PID, "version", previous.Version)
+	case recent && (previous.Hostname != self.Hostname || previous.PID != self.PID):
+		// a failover; should the previous holder still think it holds the lock, it registers itself again,
+		// which touchRegistration notices
+		ElectionTakeovers.WithLabelValues("failover").Inc()
+		log.Info("msg", "Took over the advisory lock from", "lockID", l.groupLockID, "hostname", previous.Hostname, "pid", previous.PID, "version", previous.Version)
+	}
+	l.upsertRegistration(ctx)
+}
+
+func (l *PgAdvisoryLock) upsertRegistration(ctx context.Context) {
+	self := l.registry.identity
+	_, err := l.conn.ExecContext(ctx, sqlUpsertLeaderRegistry, l.groupLockID, self.Application, self.Hostname, self.PID, self.Version)
+	if err != nil {
+		log.Error("msg", "Failed to update leader registry", "lockID", l.groupLockID, "err", err)
+	}
+}
+
+// touchRegistration refreshes the registration of this instance on every election. If another instance
+// replaced it in the meantime, while this one held the lock, both use the lock ID: that's a collision.
+func (l *PgAdvisoryLock) touchRegistration() {
+	ctx := context.Background()
+	self := l.registry.identity
+	result, err := l.conn.ExecContext(ctx, sqlTouchLeaderRegistry, l.groupLockID, self.Hostname, self.PID)
+	if err != nil {
+		log.Error("msg", "Failed to refresh leader registry", "lockID", l.groupLockID, "err", err)
+		return
+	}
+	if touched, err := result.RowsAffected(); err != nil || touched > 0 {
+		return
+	}
+	var other LeaderIdentity
+	var recent, handedOff bool
+	err = l.conn.QueryRowContext(ctx, sqlSelectLeaderRegistry, l.groupLockID, l.registry.leaseWindow.Microseconds()).
+		Scan(&other.Application, &other.Hostname, &other.PID, &other.Version, &recent, &handedOff)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("msg", "Failed to read leader registry", "lockID", l.groupLockID, "err", err)
+		return
+	}
+	if err == nil {
+		LockIDCollisions.Inc()
+		log.Warn("msg", "ADVISORY LOCK ID COLLISION: another instance registered as holder while we hold the lock. Use a lock ID that is unique to this adapter group",
+			"lockID", l.groupLockID, "application", other.Application, "hostname", other.Hostname, "pid", other.PID, "version", other.Version)
+	}
+	l.upsertRegistration(ctx)
+}
+
 func (l *PgAdvisoryLock) getAdvisoryLock() (bool, error) {
 	var err error
 	if l.conn == nil {
 		l.conn, err = getConn(l.connPool, 0, 10)
-	}
-	if err != nil {
-		return false, err
+		if err != nil {
+			return false, err
+		}
+		if l.reconnecting {
+			l.reconnecting = false
+			log.Info("msg", "Established a new advisory lock session", "lockID", l.groupLockID)
+		}
 	}
 	defer func() {
 		if err != nil {
@@ -121,6 +304,12 @@ func (l *PgAdvisoryLock) getAdvisoryLock() (bool, error) {
 	}()
 	rows, err := l.conn.QueryContext(context.Background(), "SELECT pg_try_advisory_lock($1)", l.groupLockID)
 	if err != nil {
+		if isBrokenSession(err) {
+			// the lock went away with the session; the next election acquires it again on a new session
+			LockReconnects.Inc()
+			l.reconnecting = true
+			log.Warn("msg", "Advisory lock session lost, reconnecting on the next election", "lockID", l.groupLockID, "leader", l.obtained, "err", err)
+		}
 		return false, err
 	}
 	defer func(rows *sql.Rows) {
@@ -142,13 +331,27 @@ func (l *PgAdvisoryLock) getAdvisoryLock() (bool, error) {
 
 func (l *PgAdvisoryLock) connCleanUp() {
 	if l.conn != nil {
-		if err := l.conn.Close(); err != nil {
+		// a broken session is already closed by the pool
+		if err := l.conn.Close(); err != nil && !errors.Is(err, sql.ErrConnDone) {
 			log.Error("err", err)
 		}
 	}
 	l.conn = nil
 }
 
+// isBrokenSession tells whether an error means the database session is gone, eg. after a database restart,
+// as opposed to a failing query.
+func isBrokenSession(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// connection exceptions and administrator or crash shutdowns
+		return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
 // Locked returns if the instance was able to obtain the leader lock.
 func (l *PgAdvisoryLock) Locked() bool {
 	l.mutex.RLock()
@@ -159,10 +362,15 @@ func (l *PgAdvisoryLock) Locked() bool {
 // Release releases the already obtained leader lock.
 func (l *PgAdvisoryLock) Release() error {
 	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.handoff {
+		// the lock is released already, stop counting as leader
+		l.handedOff = true
+		return nil
+	}
 	if !l.obtained {
 		return fmt.Errorf("can't release while not holding the lock")
 	}
-	defer l.mutex.Unlock()
 	rows, err := l.conn.QueryContext(
 		context.Background(),
 		"SELECT pg_advisory_unlock_all()")
@@ -175,6 +383,67 @@ func (l *PgAdvisoryLock) Release() error {
 	return nil
 }
 
+// HandingOff tells whether the lock is being or was handed off, see Handoff.
+func (l *PgAdvisoryLock) HandingOff() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.handoff
+}
+
+// Handoff releases the lock for another instance to take it over, eg. before shutting down. The lock isn't
+// acquired again afterwards. While the instance held the lock, it keeps counting as the leader until another
+// session holds the lock, so that writes go on without a gap, or until grace is over. It returns whether
+// another instance took over.
+func (l *PgAdvisoryLock) Handoff(grace time.Duration) (bool, error) {
+	l.mutex.Lock()
+	l.handoff = true
+	if !l.obtained {
+		l.handedOff = true
+		l.mutex.Unlock()
+		return false, nil
+	}
+	ctx := context.Background()
+	if l.registry != nil {
+		self := l.registry.identity
+		if _, err := l.conn.ExecContext(ctx, sqlHandoffLeaderRegistry, l.groupLockID, self.Hostname, self.PID); err != nil {
+			log.Error("msg", "Failed to record the handoff in the leader registry", "lockID", l.groupLockID, "err", err)
+		}
+	}
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock_all()")
+	l.connCleanUp()
+	l.obtained = false
+	if err != nil {
+		l.handedOff = true
+		l.mutex.Unlock()
+		return false, fmt.Errorf("error releasing the advisory lock: %w", err)
+	}
+	l.mutex.Unlock()
+	log.Info("msg", "Released the advisory lock for a handoff, waiting for another instance to take over", "lockID", l.groupLockID, "grace", grace)
+
+	deadline := time.Now().Add(grace)
+	for {
+		var held bool
+		err := l.connPool.QueryRowContext(ctx, sqlLockHeld, l.groupLockID).Scan(&held)
+		if err != nil {
+			log.Warn("msg", "Failed to check whether the advisory lock was taken over", "lockID", l.groupLockID, "err", err)
+		}
+		if held || !time.Now().Before(deadline) {
+			l.mutex.Lock()
+			l.handedOff = true
+			l.mutex.Unlock()
+			if held {
+				ElectionHandoffs.WithLabelValues("taken_over").Inc()
+				log.Info("msg", "Another instance took over the advisory lock", "lockID", l.groupLockID)
+			} else {
+				ElectionHandoffs.WithLabelValues("unclaimed").Inc()
+				log.Warn("msg", "No other instance took over the advisory lock within the grace period", "lockID", l.groupLockID, "grace", grace)
+			}
+			return held, nil
+		}
+		time.Sleep(handoffPollInterval)
+	}
+}
+
 func checkConnection(conn *sql.Conn) error {
 	_, err := conn.ExecContext(context.Background(), "SELECT 1")
 	if err != nil {
@@ -0,0 +1,329 @@
+package util
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeLockServer simulates the advisory locks of a database that can be restarted, breaking all sessions,
+// and its leader registry.
+type fakeLockServer struct {
+	mutex      sync.Mutex
+	generation int
+	holder     *fakeLockConn
+	// registered is the registry row of the lock: application name, hostname, pid and version.
+	registered []driver.Value
+	handedOff  bool
+}
+
+func (s *fakeLockServer) Connect(context.Context) (driver.Conn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &fakeLockConn{server: s, generation: s.generation}, nil
+}
+
+func (s *fakeLockServer) Driver() driver.Driver {
+	return nil
+}
+
+// restart breaks the open sessions, releasing their locks.
+func (s *fakeLockServer) restart() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.generation++
+	s.holder = nil
+}
+
+type fakeLockConn struct {
+	server     *fakeLockServer
+	generation int
+}
+
+func (c *fakeLockConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeLockStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeLockConn) Close() error {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	if c.server.holder == c {
+		c.server.holder = nil
+	}
+	return nil
+}
+
+func (c *fakeLockConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+type fakeLockStmt struct {
+	conn  *fakeLockConn
+	query string
+}
+
+func (s *fakeLockStmt) Close() error  { return nil }
+func (s *fakeLockStmt) NumInput() int { return -1 }
+
+func (s *fakeLockStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, affected, err := s.run(args)
+	return driver.RowsAffected(affected), err
+}
+
+func (s *fakeLockStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, _, err := s.run(args)
+	return rows, err
+}
+
+func (s *fakeLockStmt) run(args []driver.Value) (*fakeLockRows, int64, error) {
+	server := s.conn.server
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if s.conn.generation != server.generation {
+		return nil, 0, driver.ErrBadConn
+	}
+	result := true
+	switch {
+	case strings.Contains(s.query, "pg_try_advisory_lock"):
+		if server.holder == nil {
+			server.holder = s.conn
+		}
+		result = server.holder == s.conn
+	case strings.Contains(s.query, "pg_advisory_unlock_all"):
+		if server.holder == s.conn {
+			server.holder = nil
+		}
+	case strings.Contains(s.query, "pg_locks"):
+		result = server.holder != nil
+	case strings.HasPrefix(s.query, "select application_name"):
+		rows := &fakeLockRows{columns: []string{"application_name", "hostname", "pid", "version", "recent", "handed_off"}}
+		if server.registered != nil {
+			rows.values = append(append(rows.values, server.registered...), !server.handedOff, server.handedOff)
+		}
+		return rows, 0, nil
+	case strings.HasPrefix(s.query, "insert into adapter_leader_registry"):
+		server.registered = args[1:5]
+		server.handedOff = false
+		return &fakeLockRows{}, 1, nil
+	case strings.HasPrefix(s.query, "update adapter_leader_registry"):
+		if server.registered == nil || server.registered[1] != args[1] || server.registered[2] != args[2] {
+			return &fakeLockRows{}, 0, nil
+		}
+		if strings.Contains(s.query, "-infinity") {
+			server.handedOff = true
+		}
+		return &fakeLockRows{}, 1, nil
+	}
+	return &fakeLockRows{columns: []string{"result"}, values: []driver.Value{result}}, 0, nil
+}
+
+// fakeLockRows holds at most one row.
+type fakeLockRows struct {
+	columns []string
+	values  []driver.Value
+}
+
+func (r *fakeLockRows) Columns() []string { return r.columns }
+func (r *fakeLockRows) Close() error      { return nil }
+
+func (r *fakeLockRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
+
+func TestPgAdvisoryLockRecoversAfterRestart(t *testing.T) {
+	server := &fakeLockServer{}
+	db := sql.OpenDB(server)
+	defer db.Close()
+	lock, err := NewPgAdvisoryLock(1, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector := newScheduledElector(lock, nil, time.Now)
+	if !elector.Elect() {
+		t.Fatal("Expected to become the leader")
+	}
+
+	server.restart()
+	reconnects := testutil.ToFloat64(LockReconnects)
+	leader := false
+	// the broken session is noticed on the first election, the lock acquired again by the second one
+	for i := 0; i < 2 && !leader; i++ {
+		leader = elector.Elect()
+	}
+	if !leader {
+		t.Fatal("Expected leadership to recover within two elections")
+	}
+	if n := testutil.ToFloat64(LockReconnects) - reconnects; n != 1 {
+		t.Errorf("Expected 1 reconnect, got %v", n)
+	}
+	if stats := db.Stats(); stats.InUse != 1 {
+		t.Errorf("Expected only the lock session to be in use, got %d connections", stats.InUse)
+	}
+}
+
+func TestPgAdvisoryLockContended(t *testing.T) {
+	server := &fakeLockServer{}
+	db := sql.OpenDB(server)
+	defer db.Close()
+	first, err := NewPgAdvisoryLock(1, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewPgAdvisoryLock(1, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Locked() || second.Locked() {
+		t.Fatalf("Expected only the first instance to hold the lock, got %v and %v", first.Locked(), second.Locked())
+	}
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Release(); err == nil {
+		t.Error("Expected releasing an unheld lock to fail")
+	}
+	if leader, err := second.TryLock(); err != nil || !leader {
+		t.Errorf("Expected the second instance to take over, got %v (%v)", leader, err)
+	}
+}
+
+func TestVerifiedPgAdvisoryLockRegistry(t *testing.T) {
+	server := &fakeLockServer{}
+	db := sql.OpenDB(server)
+	defer db.Close()
+	first, err := NewVerifiedPgAdvisoryLock(1, db, LeaderIdentity{Application: "adapter", Hostname: "a", PID: 1}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewVerifiedPgAdvisoryLock(1, db, LeaderIdentity{Application: "adapter", Hostname: "b", PID: 2}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collisions := testutil.ToFloat64(LockIDCollisions)
+
+	// a failover within the lease window is no collision
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if leader, err := second.TryLock(); err != nil || !leader {
+			t.Fatalf("Expected the second instance to take over, got %v (%v)", leader, err)
+		}
+	}
+	if n := testutil.ToFloat64(LockIDCollisions) - collisions; n != 0 {
+		t.Errorf("Expected no collision on failover, got %v", n)
+	}
+
+	// another instance registering itself while the second one holds the lock is
+	if _, err := db.Exec(sqlUpsertLeaderRegistry, 1, "adapter", "c", 3, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(LockIDCollisions) - collisions; n != 1 {
+		t.Errorf("Expected 1 collision, got %v", n)
+	}
+	if server.registered[1] != "b" {
+		t.Errorf("Expected the lock holder to register itself again, got %v", server.registered)
+	}
+}
+
+func TestPgAdvisoryLockHandoff(t *testing.T) {
+	server := &fakeLockServer{}
+	db := sql.OpenDB(server)
+	defer db.Close()
+	first, err := NewVerifiedPgAdvisoryLock(1, db, LeaderIdentity{Application: "adapter", Hostname: "a", PID: 1}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewVerifiedPgAdvisoryLock(1, db, LeaderIdentity{Application: "adapter", Hostname: "b", PID: 2}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaving := newScheduledElector(first, nil, time.Now)
+	standby := newScheduledElector(second, nil, time.Now)
+	handoffs := testutil.ToFloat64(ElectionHandoffs.WithLabelValues("taken_over"))
+	takeovers := testutil.ToFloat64(ElectionTakeovers.WithLabelValues("handoff"))
+	failovers := testutil.ToFloat64(ElectionTakeovers.WithLabelValues("failover"))
+
+	type result struct {
+		takenOver bool
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		takenOver, err := first.Handoff(10 * time.Second)
+		done <- result{takenOver, err}
+	}()
+	// at any time until the handoff is done, exactly one of both instances is the leader
+	for {
+		select {
+		case r := <-done:
+			if r.err != nil || !r.takenOver {
+				t.Fatalf("Expected the standby to take over, got %v (%v)", r.takenOver, r.err)
+			}
+			if leader, _ := leaving.IsLeader(); leader {
+				t.Error("Expected the instance handing off not to be the leader anymore")
+			}
+			if leader := leaving.Elect(); leader {
+				t.Error("Expected the instance handing off not to acquire the lock again")
+			}
+			if n := testutil.ToFloat64(ElectionHandoffs.WithLabelValues("taken_over")) - handoffs; n != 1 {
+				t.Errorf("Expected 1 handoff, got %v", n)
+			}
+			if n := testutil.ToFloat64(ElectionTakeovers.WithLabelValues("handoff")) - takeovers; n != 1 {
+				t.Errorf("Expected 1 takeover by handoff, got %v", n)
+			}
+			if n := testutil.ToFloat64(ElectionTakeovers.WithLabelValues("failover")) - failovers; n != 0 {
+				t.Errorf("Expected the handoff not to count as failover, got %v", n)
+			}
+			return
+		default:
+		}
+		old, _ := leaving.IsLeader()
+		if old {
+			// the standby's election may acquire the lock now, while the old leader still counts as leader
+			standby.Elect()
+			continue
+		}
+		if leader, _ := standby.IsLeader(); !leader {
+			t.Fatal("Expected the standby to be the leader once the old one isn't")
+		}
+	}
+}
+
+func TestPgAdvisoryLockHandoffUnclaimed(t *testing.T) {
+	server := &fakeLockServer{}
+	db := sql.OpenDB(server)
+	defer db.Close()
+	lock, err := NewPgAdvisoryLock(1, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unclaimed := testutil.ToFloat64(ElectionHandoffs.WithLabelValues("unclaimed"))
+	if takenOver, err := lock.Handoff(200 * time.Millisecond); err != nil || takenOver {
+		t.Fatalf("Expected nobody to take over, got %v (%v)", takenOver, err)
+	}
+	if leader, _ := lock.IsLeader(); leader {
+		t.Error("Expected the instance not to be the leader after the grace period")
+	}
+	if n := testutil.ToFloat64(ElectionHandoffs.WithLabelValues("unclaimed")) - unclaimed; n != 1 {
+		t.Errorf("Expected 1 unclaimed handoff, got %v", n)
+	}
+	if server.holder != nil {
+		t.Error("Expected the lock to be released")
+	}
+}
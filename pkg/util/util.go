@@ -2,33 +2,52 @@ package util
 
 import (
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
 )
 
-// ThroughputCalc runs on scheduled interval to calculate the throughput per second and sends results to a channel
+// Averaging windows of the throughput rates, as used for load averages.
+const (
+	rateWindow1m = time.Minute
+	rateWindow5m = 5 * time.Minute
+)
+
+// ThroughputCalc calculates the throughput per second of the counts added to it. Counts are summed in an
+// atomic counter that is flushed every tick into exponentially weighted moving averages over one and five
+// minutes, so the rates are smooth under bursty traffic and decay to zero when nothing is added.
 type ThroughputCalc struct {
 	tickInterval time.Duration
-	previous     float64
-	current      chan float64
-	Values       chan float64
+	count        atomic.Int64
+	rate1m       atomic.Uint64
+	rate5m       atomic.Uint64
 	running      bool
 	lock         sync.Mutex
 }
 
 func NewThroughputCalc(interval time.Duration) *ThroughputCalc {
-	return &ThroughputCalc{tickInterval: interval, current: make(chan float64, 1), Values: make(chan float64, 1)}
+	return &ThroughputCalc{tickInterval: interval}
 }
 
-func (dt *ThroughputCalc) SetCurrent(value float64) {
-	select {
-	case dt.current <- value:
-	default:
-	}
+// Add counts n more processed items.
+func (dt *ThroughputCalc) Add(n int) {
+	dt.count.Add(int64(n))
 }
 
+// Rate returns the throughput per second averaged over the last minute.
+func (dt *ThroughputCalc) Rate() float64 {
+	return math.Float64frombits(dt.rate1m.Load())
+}
+
+// Rate5m returns the throughput per second averaged over the last five minutes.
+func (dt *ThroughputCalc) Rate5m() float64 {
+	return math.Float64frombits(dt.rate5m.Load())
+}
+
+// Start flushes the counter every tick interval in the background.
 func (dt *ThroughputCalc) Start() {
 	dt.lock.Lock()
 	defer dt.lock.Unlock()
@@ -37,21 +56,25 @@ func (dt *ThroughputCalc) Start() {
 		ticker := time.NewTicker(dt.tickInterval)
 		go func() {
 			for range ticker.C {
-				if !dt.running {
-					return
-				}
-				current := <-dt.current
-				diff := current - dt.previous
-				dt.previous = current
-				select {
-				case dt.Values <- diff / dt.tickInterval.Seconds():
-				default:
-				}
+				dt.tick()
 			}
 		}()
 	}
 }
 
+// tick folds the counts added since the last tick into the moving averages.
+func (dt *ThroughputCalc) tick() {
+	instant := float64(dt.count.Swap(0)) / dt.tickInterval.Seconds()
+	dt.rate1m.Store(math.Float64bits(ewma(dt.Rate(), instant, dt.tickInterval, rateWindow1m)))
+	dt.rate5m.Store(math.Float64bits(ewma(dt.Rate5m(), instant, dt.tickInterval, rateWindow5m)))
+}
+
+// ewma moves average towards value, weighting it by the share of the window that elapsed.
+func ewma(average, value float64, elapsed, window time.Duration) float64 {
+	decay := math.Exp(-elapsed.Seconds() / window.Seconds())
+	return average*decay + value*(1-decay)
+}
+
 // RetryWithFixedDelay Blocking retry with a fixed delay
 func RetryWithFixedDelay(retries uint, wait time.Duration, f func() (interface{}, error)) (interface{}, error) {
 	current := uint(0)
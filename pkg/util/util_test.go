@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"math"
 	"testing"
 	"time"
 
@@ -70,3 +71,47 @@ func TestSuccessAfterRetry(t *testing.T) {
 	}
 
 }
+
+func TestThroughputCalcConverges(t *testing.T) {
+	calc := NewThroughputCalc(time.Second)
+	// bursts of 500 samples every 10 seconds average to 50 samples/sec
+	for i := 0; i < 1800; i++ {
+		if i%10 == 0 {
+			calc.Add(500)
+		}
+		calc.tick()
+	}
+	if v := calc.Rate(); math.Abs(v-50) > 15 {
+		t.Errorf("Expected one minute rate close to 50 samples/sec, got %v", v)
+	}
+	if v := calc.Rate5m(); math.Abs(v-50) > 5 {
+		t.Errorf("Expected five minute rate close to 50 samples/sec, got %v", v)
+	}
+
+	// a single burst moves the five minute rate less than the one minute rate
+	calc.Add(5000)
+	calc.tick()
+	if calc.Rate() <= calc.Rate5m() {
+		t.Errorf("Expected one minute rate %v to react more to a burst than five minute rate %v", calc.Rate(), calc.Rate5m())
+	}
+
+	for i := 0; i < 3600; i++ {
+		calc.tick()
+	}
+	if v := calc.Rate(); v > 0.01 {
+		t.Errorf("Expected one minute rate to decay to 0 without new samples, got %v", v)
+	}
+	if v := calc.Rate5m(); v > 0.01 {
+		t.Errorf("Expected five minute rate to decay to 0 without new samples, got %v", v)
+	}
+}
+
+func TestThroughputCalcStart(t *testing.T) {
+	calc := NewThroughputCalc(10 * time.Millisecond)
+	calc.Start()
+	calc.Add(1000)
+	time.Sleep(50 * time.Millisecond)
+	if v := calc.Rate(); v <= 0 {
+		t.Errorf("Expected a positive rate after adding samples, got %v", v)
+	}
+}
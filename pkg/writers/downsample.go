@@ -0,0 +1,307 @@
+package writers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// The aggregations of the samples of an interval.
+const (
+	DownsampleLast = "last"
+	DownsampleAvg  = "avg"
+	DownsampleMin  = "min"
+	DownsampleMax  = "max"
+)
+
+const (
+	// downsampleFlushTick is the interval at which buckets past their grace window are emitted.
+	downsampleFlushTick = time.Second
+	// the estimated memory taken by a series besides its labels, by each of its labels and by a bucket
+	downsampleSeriesBytes = 128
+	downsampleLabelBytes  = 32
+	downsampleBucketBytes = 64
+)
+
+// DownsampleInputSamples counts the samples buffered by the downsampler.
+var DownsampleInputSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "downsample_input_samples_total",
+		Help: "Total number of samples buffered by the downsampler.",
+	},
+)
+
+// DownsampleOutputSamples counts the aggregated samples the downsampler wrote.
+var DownsampleOutputSamples = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "downsample_output_samples_total",
+		Help: "Total number of aggregated samples written by the downsampler.",
+	},
+)
+
+// DownsampleDroppedSamples counts the samples the downsampler dropped, by reason: late, max_series and
+// max_bytes for input samples, write_error for aggregated samples.
+var DownsampleDroppedSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "downsample_dropped_samples_total",
+		Help: "Total number of samples dropped by the downsampler, by reason.",
+	},
+	[]string{"reason"},
+)
+
+// DownsampleBufferedSeries is the number of series with samples buffered by the downsampler.
+var DownsampleBufferedSeries = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "downsample_buffered_series",
+		Help: "Number of series with samples buffered by the downsampler.",
+	},
+)
+
+// DownsampleConfig configures a Downsampler.
+type DownsampleConfig struct {
+	// Interval is the resolution of the written samples. Intervals are aligned on the wall clock.
+	Interval time.Duration
+	// Method aggregates the samples of an interval: DownsampleLast, DownsampleAvg, DownsampleMin or
+	// DownsampleMax.
+	Method string
+	// Grace is how long after the end of an interval its samples are still accepted before it is written.
+	Grace time.Duration
+	// MaxSeries and MaxBytes bound the buffer, samples of new series or intervals being dropped beyond them.
+	// 0 means no limit.
+	MaxSeries int
+	MaxBytes  int64
+	// Now is the clock the ends of the intervals and grace windows are judged by, the local clock if nil.
+	Now func() time.Time
+}
+
+// Downsampler is a Writer that aggregates the samples of each series per interval, and writes one sample
+// per series and interval to the next writer once the interval and its grace window are over. The
+// aggregated samples are written by a background loop, so that write errors don't reach the sender,
+// they are logged and counted.
+type Downsampler struct {
+	next  Writer
+	cfg   DownsampleConfig
+	now   func() time.Time
+	mutex sync.Mutex
+	// series are the buffered series by fingerprint
+	series map[model.Fingerprint]*downsampleSeries
+	bytes  int64
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type downsampleSeries struct {
+	metric model.Metric
+	bytes  int64
+	// buckets are the open intervals of the series, in time order
+	buckets []*downsampleBucket
+}
+
+type downsampleBucket struct {
+	start               model.Time
+	count               int
+	sum, min, max, last float64
+	lastTime            model.Time
+}
+
+// NewDownsampler returns a Downsampler writing to next. Start starts writing the aggregated samples.
+func NewDownsampler(next Writer, cfg DownsampleConfig) (*Downsampler, error) {
+	switch cfg.Method {
+	case DownsampleLast, DownsampleAvg, DownsampleMin, DownsampleMax:
+	default:
+		return nil, fmt.Errorf("unknown downsample method %q, expected %q, %q, %q or %q", cfg.Method, DownsampleLast, DownsampleAvg, DownsampleMin, DownsampleMax)
+	}
+	if cfg.Interval < time.Millisecond {
+		return nil, fmt.Errorf("the downsample interval must be at least 1ms, got %v", cfg.Interval)
+	}
+	if cfg.Grace < 0 || cfg.MaxSeries < 0 || cfg.MaxBytes < 0 {
+		return nil, fmt.Errorf("the downsample grace window and buffer limits must not be negative")
+	}
+	now := cfg.Now
+	if now == nil {
+		now = time.Now
+	}
+	return &Downsampler{
+		next:   next,
+		cfg:    cfg,
+		now:    now,
+		series: map[model.Fingerprint]*downsampleSeries{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start starts the loop writing the intervals past their grace window.
+func (d *Downsampler) Start() {
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(downsampleFlushTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				_ = d.flush(context.Background(), d.now())
+			}
+		}
+	}()
+}
+
+// Close stops the loop started by Start, which must have been called, and writes all the buffered intervals,
+// including those that aren't over yet.
+func (d *Downsampler) Close(ctx context.Context) error {
+	close(d.stop)
+	<-d.done
+	return d.flush(ctx, time.Time{})
+}
+
+// WriteContext buffers the samples. The stats count the buffered samples as written, and the dropped ones
+// by reason: late for samples of intervals already past their grace window, max_series and max_bytes for
+// samples of new series or intervals while the buffer is full. It never fails.
+func (d *Downsampler) WriteContext(ctx context.Context, samples model.Samples) (WriteStats, error) {
+	var stats WriteStats
+	interval := model.Time(d.cfg.Interval.Milliseconds())
+	deadline := model.TimeFromUnixNano(d.now().Add(-d.cfg.Grace).UnixNano())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, sample := range samples {
+		start := sample.Timestamp - sample.Timestamp%interval
+		if sample.Timestamp < 0 && sample.Timestamp%interval != 0 {
+			start -= interval
+		}
+		if start+interval <= deadline {
+			stats.Drop("late", 1)
+			continue
+		}
+		fingerprint := sample.Metric.Fingerprint()
+		series, ok := d.series[fingerprint]
+		if !ok {
+			series = &downsampleSeries{metric: sample.Metric, bytes: downsampleSeriesBytes}
+			for name, value := range sample.Metric {
+				series.bytes += int64(len(name)+len(value)) + downsampleLabelBytes
+			}
+			if d.cfg.MaxSeries > 0 && len(d.series) >= d.cfg.MaxSeries {
+				stats.Drop("max_series", 1)
+				continue
+			}
+			if d.cfg.MaxBytes > 0 && d.bytes+series.bytes+downsampleBucketBytes > d.cfg.MaxBytes {
+				stats.Drop("max_bytes", 1)
+				continue
+			}
+			d.series[fingerprint] = series
+			d.bytes += series.bytes
+		} else if d.cfg.MaxBytes > 0 && !series.has(start) && d.bytes+downsampleBucketBytes > d.cfg.MaxBytes {
+			stats.Drop("max_bytes", 1)
+			continue
+		}
+		if series.add(sample, start) {
+			d.bytes += downsampleBucketBytes
+		}
+		stats.Written++
+	}
+	DownsampleBufferedSeries.Set(float64(len(d.series)))
+	DownsampleInputSamples.Add(float64(stats.Written))
+	for reason, n := range stats.Dropped {
+		DownsampleDroppedSamples.WithLabelValues(reason).Add(float64(n))
+	}
+	return stats, nil
+}
+
+// Name is the name of the next writer, which the samples end up in.
+func (d *Downsampler) Name() string {
+	return d.next.Name()
+}
+
+// has tells whether the series has a bucket starting at start.
+func (s *downsampleSeries) has(start model.Time) bool {
+	for _, b := range s.buckets {
+		if b.start == start {
+			return true
+		}
+	}
+	return false
+}
+
+// add aggregates the sample into the bucket starting at start, telling whether the bucket is new.
+func (s *downsampleSeries) add(sample *model.Sample, start model.Time) bool {
+	value := float64(sample.Value)
+	i := 0
+	for i < len(s.buckets) && s.buckets[i].start < start {
+		i++
+	}
+	if i < len(s.buckets) && s.buckets[i].start == start {
+		b := s.buckets[i]
+		b.count++
+		b.sum += value
+		b.min = math.Min(b.min, value)
+		b.max = math.Max(b.max, value)
+		if sample.Timestamp >= b.lastTime {
+			b.last, b.lastTime = value, sample.Timestamp
+		}
+		return false
+	}
+	b := &downsampleBucket{start: start, count: 1, sum: value, min: value, max: value, last: value, lastTime: sample.Timestamp}
+	s.buckets = append(s.buckets, nil)
+	copy(s.buckets[i+1:], s.buckets[i:])
+	s.buckets[i] = b
+	return true
+}
+
+// value returns the aggregated value of the bucket.
+func (b *downsampleBucket) value(method string) model.SampleValue {
+	switch method {
+	case DownsampleAvg:
+		return model.SampleValue(b.sum / float64(b.count))
+	case DownsampleMin:
+		return model.SampleValue(b.min)
+	case DownsampleMax:
+		return model.SampleValue(b.max)
+	default:
+		return model.SampleValue(b.last)
+	}
+}
+
+// flush writes the buckets of which the interval and grace window are over at now, all buckets if now is
+// zero. The aggregated samples are stamped with the start of their interval.
+func (d *Downsampler) flush(ctx context.Context, now time.Time) error {
+	interval := model.Time(d.cfg.Interval.Milliseconds())
+	deadline := model.TimeFromUnixNano(now.Add(-d.cfg.Grace).UnixNano())
+	var samples model.Samples
+	d.mutex.Lock()
+	for fingerprint, series := range d.series {
+		ready := 0
+		for ready < len(series.buckets) && (now.IsZero() || series.buckets[ready].start+interval <= deadline) {
+			b := series.buckets[ready]
+			samples = append(samples, &model.Sample{Metric: series.metric, Value: b.value(d.cfg.Method), Timestamp: b.start})
+			ready++
+		}
+		series.buckets = series.buckets[ready:]
+		d.bytes -= int64(ready) * downsampleBucketBytes
+		if len(series.buckets) == 0 {
+			delete(d.series, fingerprint)
+			d.bytes -= series.bytes
+		}
+	}
+	DownsampleBufferedSeries.Set(float64(len(d.series)))
+	d.mutex.Unlock()
+
+	if len(samples) == 0 {
+		return nil
+	}
+	stats, err := d.next.WriteContext(ctx, samples)
+	DownsampleOutputSamples.Add(float64(stats.Written))
+	if err != nil {
+		DownsampleDroppedSamples.WithLabelValues("write_error").Add(float64(len(samples) - stats.Written))
+		log.Error("msg", "Error writing downsampled samples, they are lost", "samples", len(samples)-stats.Written, "err", err)
+		return err
+	}
+	return nil
+}
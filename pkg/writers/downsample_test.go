@@ -0,0 +1,171 @@
+package writers
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+func init() {
+	log.Init("debug")
+}
+
+// recordingWriter keeps the samples written to it.
+type recordingWriter struct {
+	samples model.Samples
+	err     error
+}
+
+func (r *recordingWriter) WriteContext(ctx context.Context, samples model.Samples) (WriteStats, error) {
+	if r.err != nil {
+		return WriteStats{}, r.err
+	}
+	r.samples = append(r.samples, samples...)
+	return WriteStats{Written: len(samples)}, nil
+}
+
+func (r *recordingWriter) Name() string {
+	return "recording"
+}
+
+func newTestDownsampler(t *testing.T, next Writer, cfg DownsampleConfig, now time.Time) *Downsampler {
+	d, err := NewDownsampler(next, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.now = func() time.Time {
+		return now
+	}
+	return d
+}
+
+func TestDownsampleMethods(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	metric := model.Metric{model.MetricNameLabel: "temperature"}
+	samples := model.Samples{
+		{Metric: metric, Value: 3, Timestamp: model.TimeFromUnixNano(base.Add(10 * time.Second).UnixNano())},
+		{Metric: metric, Value: 1, Timestamp: model.TimeFromUnixNano(base.Add(50 * time.Second).UnixNano())},
+		{Metric: metric, Value: 2, Timestamp: model.TimeFromUnixNano(base.Add(30 * time.Second).UnixNano())},
+		{Metric: metric, Value: 7, Timestamp: model.TimeFromUnixNano(base.Add(70 * time.Second).UnixNano())},
+	}
+	for method, expected := range map[string]model.SampleValue{DownsampleLast: 1, DownsampleAvg: 2, DownsampleMin: 1, DownsampleMax: 3} {
+		t.Run(method, func(t *testing.T) {
+			next := &recordingWriter{}
+			d := newTestDownsampler(t, next, DownsampleConfig{Interval: time.Minute, Method: method, Grace: 10 * time.Second}, base.Add(55*time.Second))
+			stats, err := d.WriteContext(context.Background(), samples)
+			if err != nil || stats.Written != 4 {
+				t.Fatalf("Expected 4 samples buffered, got %+v, %v", stats, err)
+			}
+			// the first minute is still in its grace window
+			if err := d.flush(context.Background(), base.Add(65*time.Second)); err != nil || len(next.samples) != 0 {
+				t.Fatalf("Expected nothing written, got %v, %v", next.samples, err)
+			}
+			if err := d.flush(context.Background(), base.Add(70*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if len(next.samples) != 1 || next.samples[0].Value != expected || !next.samples[0].Timestamp.Time().Equal(base) {
+				t.Errorf("Expected %v at %v, got %v", expected, base, next.samples)
+			}
+			// the second minute is written on close
+			if err := d.flush(context.Background(), time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			if len(next.samples) != 2 || next.samples[1].Value != 7 || len(d.series) != 0 || d.bytes != 0 {
+				t.Errorf("Expected the second minute written and the buffer empty, got %v, %d bytes", next.samples, d.bytes)
+			}
+		})
+	}
+}
+
+func TestDownsampleLate(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	metric := model.Metric{model.MetricNameLabel: "up"}
+	d := newTestDownsampler(t, &recordingWriter{}, DownsampleConfig{Interval: time.Minute, Method: DownsampleLast, Grace: 10 * time.Second}, base.Add(65*time.Second))
+	stats, _ := d.WriteContext(context.Background(), model.Samples{
+		// within the grace window of the first minute
+		{Metric: metric, Value: 1, Timestamp: model.TimeFromUnixNano(base.Add(59 * time.Second).UnixNano())},
+		// past the grace window
+		{Metric: metric, Value: 1, Timestamp: model.TimeFromUnixNano(base.Add(-time.Second).UnixNano())},
+	})
+	if stats.Written != 1 || stats.Dropped["late"] != 1 {
+		t.Errorf("Expected one sample buffered and one late, got %+v", stats)
+	}
+}
+
+func TestDownsampleLimits(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	ts := model.TimeFromUnixNano(base.UnixNano())
+	series := func(job string) model.Metric {
+		return model.Metric{model.MetricNameLabel: "up", "job": model.LabelValue(job)}
+	}
+	d := newTestDownsampler(t, &recordingWriter{}, DownsampleConfig{Interval: time.Minute, Method: DownsampleLast, MaxSeries: 2}, base)
+	stats, _ := d.WriteContext(context.Background(), model.Samples{
+		{Metric: series("a"), Timestamp: ts}, {Metric: series("b"), Timestamp: ts}, {Metric: series("c"), Timestamp: ts}, {Metric: series("a"), Timestamp: ts + 1},
+	})
+	if stats.Written != 3 || stats.Dropped["max_series"] != 1 {
+		t.Errorf("Expected the third series to be dropped, got %+v", stats)
+	}
+
+	d = newTestDownsampler(t, &recordingWriter{}, DownsampleConfig{Interval: time.Minute, Method: DownsampleLast, MaxBytes: 300}, base)
+	stats, _ = d.WriteContext(context.Background(), model.Samples{
+		{Metric: series("a"), Timestamp: ts}, {Metric: series("a"), Timestamp: ts + 60000}, {Metric: series("b"), Timestamp: ts},
+	})
+	if stats.Written != 1 || stats.Dropped["max_bytes"] != 2 || d.bytes > 300 {
+		t.Errorf("Expected the buffer to be bounded to 300 bytes, got %+v with %d bytes", stats, d.bytes)
+	}
+}
+
+func TestDownsampleClose(t *testing.T) {
+	base := time.Now()
+	next := &recordingWriter{}
+	d := newTestDownsampler(t, next, DownsampleConfig{Interval: time.Hour, Method: DownsampleMax}, base)
+	d.Start()
+	ts := model.TimeFromUnixNano(base.UnixNano())
+	var samples model.Samples
+	for _, job := range []string{"b", "a"} {
+		samples = append(samples, &model.Sample{Metric: model.Metric{"job": model.LabelValue(job)}, Value: 1, Timestamp: ts})
+	}
+	if _, err := d.WriteContext(context.Background(), samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(next.samples, func(i, j int) bool { return next.samples[i].Metric["job"] < next.samples[j].Metric["job"] })
+	if len(next.samples) != 2 || next.samples[0].Metric["job"] != "a" {
+		t.Errorf("Expected both series written on close, got %v", next.samples)
+	}
+}
+
+func TestDownsampleWriteError(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	next := &recordingWriter{err: errors.New("connection refused")}
+	d := newTestDownsampler(t, next, DownsampleConfig{Interval: time.Minute, Method: DownsampleLast}, base)
+	if _, err := d.WriteContext(context.Background(), model.Samples{{Metric: model.Metric{"job": "a"}, Timestamp: model.TimeFromUnixNano(base.UnixNano())}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.flush(context.Background(), base.Add(time.Minute)); !errors.Is(err, next.err) {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+	if len(d.series) != 0 {
+		t.Error("Expected the failed samples not to be kept")
+	}
+}
+
+func TestNewDownsamplerErrors(t *testing.T) {
+	for _, cfg := range []DownsampleConfig{
+		{Interval: time.Minute, Method: "median"},
+		{Interval: 0, Method: DownsampleLast},
+		{Interval: time.Minute, Method: DownsampleLast, Grace: -time.Second},
+	} {
+		if _, err := NewDownsampler(&recordingWriter{}, cfg); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package writers
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStorage is the sink written to unless configured otherwise.
+const DefaultStorage = "postgresql"
+
+// Sink configures and builds a Writer. The flags of a sink are registered with a prefix of its own, so that
+// the flags of different sinks don't collide, and New builds the writer once they are parsed.
+type Sink interface {
+	RegisterFlags(fs *flag.FlagSet, prefix string)
+	New() (Writer, error)
+}
+
+type registration struct {
+	prefix  string
+	newSink func(sinks *Sinks) Sink
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = map[string]registration{}
+)
+
+// Register makes a sink available under name, its flags being prefixed with prefix. newSink gets the sinks
+// configured alongside it, for sinks writing to others. Sinks register in the init function of their
+// package, Register panics if name is registered twice.
+func Register(name, prefix string, newSink func(sinks *Sinks) Sink) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("writers: sink " + name + " registered twice")
+	}
+	registry[name] = registration{prefix: prefix, newSink: newSink}
+}
+
+// Names returns the names of the registered sinks, sorted.
+func Names() []string {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Sinks are the registered sinks configured from one flag set.
+type Sinks struct {
+	sinks map[string]Sink
+}
+
+// RegisterFlags creates every registered sink and registers its flags on fs.
+func RegisterFlags(fs *flag.FlagSet) *Sinks {
+	s := &Sinks{sinks: map[string]Sink{}}
+	for _, name := range Names() {
+		registryMutex.Lock()
+		r := registry[name]
+		registryMutex.Unlock()
+		sink := r.newSink(s)
+		sink.RegisterFlags(fs, r.prefix)
+		s.sinks[name] = sink
+	}
+	return s
+}
+
+// Get returns the sink registered as name.
+func (s *Sinks) Get(name string) (Sink, bool) {
+	sink, ok := s.sinks[name]
+	return sink, ok
+}
+
+// New builds the writer of the sink registered as name.
+func (s *Sinks) New(name string) (Writer, error) {
+	sink, ok := s.sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage %q, expected one of %s", name, strings.Join(Names(), ", "))
+	}
+	w, err := sink.New()
+	if err != nil {
+		return nil, fmt.Errorf("storage %s: %w", name, err)
+	}
+	return w, nil
+}
+
+func init() {
+	Register("dry-run", "dry-run", func(*Sinks) Sink {
+		return &dryRunSink{}
+	})
+	Register("tee", "tee", func(sinks *Sinks) Sink {
+		return &teeSink{sinks: sinks}
+	})
+}
+
+type dryRunSink struct {
+	latency   time.Duration
+	errorRate float64
+}
+
+func (s *dryRunSink) RegisterFlags(fs *flag.FlagSet, prefix string) {
+	fs.DurationVar(&s.latency, prefix+"-latency", 0, "Simulated latency of each write of the dry-run storage.")
+	fs.Float64Var(&s.errorRate, prefix+"-error-rate", 0, "Share of writes of the dry-run storage failing, between 0 and 1.")
+}
+
+func (s *dryRunSink) New() (Writer, error) {
+	if s.errorRate < 0 || s.errorRate > 1 {
+		return nil, fmt.Errorf("the error rate must be between 0 and 1, got %v", s.errorRate)
+	}
+	if s.latency < 0 {
+		return nil, fmt.Errorf("the latency must not be negative, got %v", s.latency)
+	}
+	return NewDryRun(s.latency, s.errorRate), nil
+}
+
+type teeSink struct {
+	sinks *Sinks
+	flag  string
+	names string
+}
+
+func (s *teeSink) RegisterFlags(fs *flag.FlagSet, prefix string) {
+	s.flag = prefix + "-storages"
+	fs.StringVar(&s.names, s.flag, "", "Comma-separated storages the tee storage writes each request to, each configured by its own flags. The first one is the primary, its result is the result of the write, and failures of the others are logged and counted.")
+}
+
+func (s *teeSink) New() (Writer, error) {
+	var next []Writer
+	for _, name := range strings.Split(s.names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "tee" {
+			return nil, errors.New("a tee can't write to itself")
+		}
+		w, err := s.sinks.New(name)
+		if err != nil {
+			return nil, err
+		}
+		next = append(next, w)
+	}
+	if len(next) == 0 {
+		return nil, fmt.Errorf("no storages to write to, set -%s", s.flag)
+	}
+	return NewTee(next[0], next[1:]...), nil
+}
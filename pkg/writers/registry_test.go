@@ -0,0 +1,60 @@
+package writers
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSinks(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	sinks := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-dry-run-latency=1ms", "-tee-storages=dry-run, dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := sinks.New("tee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tee, ok := w.(*Tee)
+	if !ok || len(tee.mirrors) != 1 || tee.Primary().(*DryRun).latency != time.Millisecond {
+		t.Errorf("Expected a tee of two dry-run writers, got %#v", w)
+	}
+	if _, err := sinks.New("clickhouse"); err == nil || !strings.Contains(err.Error(), "dry-run, tee") {
+		t.Errorf("Expected an unknown storage to fail listing the storages, got %v", err)
+	}
+}
+
+func TestSinkErrors(t *testing.T) {
+	for _, c := range []struct {
+		args    []string
+		storage string
+	}{
+		{args: []string{"-dry-run-error-rate=2"}, storage: "dry-run"},
+		{args: []string{"-dry-run-latency=-1s"}, storage: "dry-run"},
+		{args: []string{}, storage: "tee"},
+		{args: []string{"-tee-storages=tee"}, storage: "tee"},
+		{args: []string{"-tee-storages=dry-run,unknown"}, storage: "tee"},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		sinks := RegisterFlags(fs)
+		if err := fs.Parse(c.args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sinks.New(c.storage); err == nil {
+			t.Errorf("%s %v: expected an error", c.storage, c.args)
+		}
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a name twice to panic")
+		}
+	}()
+	Register("dry-run", "other", func(*Sinks) Sink {
+		return &dryRunSink{}
+	})
+}
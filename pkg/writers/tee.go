@@ -0,0 +1,74 @@
+package writers
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/timescale/prometheus-postgresql-adapter/pkg/log"
+)
+
+// TeeMirrorErrors counts the failed writes of the storages a Tee mirrors the samples to, by storage.
+var TeeMirrorErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "tee_mirror_errors_total",
+		Help: "Total number of failed writes to the storages the samples are mirrored to, by storage.",
+	},
+	[]string{"storage"},
+)
+
+// Tee is a Writer writing the samples to a primary writer and mirroring them to others, concurrently. The
+// result of a write is that of the primary, failures of the mirrors are logged and counted. The samples
+// must not be modified by the writers.
+type Tee struct {
+	primary Writer
+	mirrors []Writer
+}
+
+// NewTee returns a Tee writing to primary and mirroring to mirrors.
+func NewTee(primary Writer, mirrors ...Writer) *Tee {
+	return &Tee{primary: primary, mirrors: mirrors}
+}
+
+// WriteContext writes the samples to the primary and the mirrors, and returns once all of them are done.
+func (t *Tee) WriteContext(ctx context.Context, samples model.Samples) (WriteStats, error) {
+	var wg sync.WaitGroup
+	for _, mirror := range t.mirrors {
+		wg.Add(1)
+		go func(mirror Writer) {
+			defer wg.Done()
+			if _, err := mirror.WriteContext(ctx, samples); err != nil {
+				TeeMirrorErrors.WithLabelValues(mirror.Name()).Inc()
+				log.Warn("msg", "Error mirroring samples", "storage", mirror.Name(), "samples", len(samples), "err", err)
+			}
+		}(mirror)
+	}
+	stats, err := t.primary.WriteContext(ctx, samples)
+	wg.Wait()
+	return stats, err
+}
+
+// Name lists the writers of the tee, the primary first.
+func (t *Tee) Name() string {
+	names := []string{t.primary.Name()}
+	for _, mirror := range t.mirrors {
+		names = append(names, mirror.Name())
+	}
+	return "tee(" + strings.Join(names, ",") + ")"
+}
+
+// Primary returns the writer whose result is the result of the writes.
+func (t *Tee) Primary() Writer {
+	return t.primary
+}
+
+// HealthCheck checks the primary, if it can be checked.
+func (t *Tee) HealthCheck() error {
+	if checker, ok := t.primary.(interface{ HealthCheck() error }); ok {
+		return checker.HealthCheck()
+	}
+	return nil
+}
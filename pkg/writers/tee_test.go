@@ -0,0 +1,51 @@
+package writers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+type failingWriter struct {
+	err error
+}
+
+func (f failingWriter) WriteContext(context.Context, model.Samples) (WriteStats, error) {
+	return WriteStats{}, f.err
+}
+
+func (f failingWriter) Name() string {
+	return "failing"
+}
+
+func TestTee(t *testing.T) {
+	samples := model.Samples{{Timestamp: 1}, {Timestamp: 2}}
+	primary, mirror := NewDryRun(0, 0), NewDryRun(0, 0)
+	failing := failingWriter{err: errors.New("unavailable")}
+	errs := testutil.ToFloat64(TeeMirrorErrors.WithLabelValues("failing"))
+	tee := NewTee(primary, mirror, failing)
+	stats, err := tee.WriteContext(context.Background(), samples)
+	if err != nil || stats.Written != 2 {
+		t.Fatalf("Expected the result of the primary, got %v, %v", stats, err)
+	}
+	if primary.Samples() != 2 || mirror.Samples() != 2 {
+		t.Errorf("Expected the samples to be written to every writer, got %d and %d", primary.Samples(), mirror.Samples())
+	}
+	if n := testutil.ToFloat64(TeeMirrorErrors.WithLabelValues("failing")) - errs; n != 1 {
+		t.Errorf("Expected 1 mirror error to be counted, got %v", n)
+	}
+	if name := tee.Name(); name != "tee(dry-run,dry-run,failing)" {
+		t.Errorf("Unexpected name %q", name)
+	}
+
+	tee = NewTee(failing, primary)
+	if _, err := tee.WriteContext(context.Background(), samples); !errors.Is(err, failing.err) {
+		t.Errorf("Expected the error of the primary, got %v", err)
+	}
+	if primary.Samples() != 4 {
+		t.Errorf("Expected the samples to be mirrored when the primary fails, got %d", primary.Samples())
+	}
+}
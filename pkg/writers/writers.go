@@ -0,0 +1,104 @@
+// Package writers defines the interface of the storages samples are written to and the registry of the
+// sinks they are built from, with a dry-run writer that discards the samples and a tee writing them to
+// several storages.
+package writers
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Writer writes samples to a remote storage. The context carries the trace of the write request. The stats
+// tell what became of the samples, also when the write fails part way.
+type Writer interface {
+	WriteContext(ctx context.Context, samples model.Samples) (WriteStats, error)
+	Name() string
+}
+
+// WriteStats counts the samples of a write that were written, and those that were dropped by reason, such
+// as "out_of_order".
+type WriteStats struct {
+	Written int
+	Dropped map[string]int
+}
+
+// Drop counts n samples dropped for reason.
+func (s *WriteStats) Drop(reason string, n int) {
+	if n <= 0 {
+		return
+	}
+	if s.Dropped == nil {
+		s.Dropped = map[string]int{}
+	}
+	s.Dropped[reason] += n
+}
+
+// Add adds the written and dropped samples of other to s.
+func (s *WriteStats) Add(other WriteStats) {
+	s.Written += other.Written
+	for reason, n := range other.Dropped {
+		s.Drop(reason, n)
+	}
+}
+
+// DroppedTotal returns the number of samples dropped for any reason.
+func (s WriteStats) DroppedTotal() int {
+	total := 0
+	for _, n := range s.Dropped {
+		total += n
+	}
+	return total
+}
+
+// ErrDryRun is the error a DryRun writer fails with.
+var ErrDryRun = errors.New("simulated write error")
+
+// DryRun is a Writer that discards the samples, counting them. It can simulate the latency and failures of
+// a real storage. It is always healthy.
+type DryRun struct {
+	latency   time.Duration
+	errorRate float64
+	samples   atomic.Int64
+}
+
+// NewDryRun returns a DryRun writer taking latency for each write, with writes failing at the given rate
+// between 0 and 1.
+func NewDryRun(latency time.Duration, errorRate float64) *DryRun {
+	return &DryRun{latency: latency, errorRate: errorRate}
+}
+
+// WriteContext waits for the simulated latency and counts the samples, unless it simulates an error.
+func (d *DryRun) WriteContext(ctx context.Context, samples model.Samples) (WriteStats, error) {
+	if d.latency > 0 {
+		select {
+		case <-time.After(d.latency):
+		case <-ctx.Done():
+			return WriteStats{}, ctx.Err()
+		}
+	}
+	if d.errorRate > 0 && rand.Float64() < d.errorRate {
+		return WriteStats{}, ErrDryRun
+	}
+	d.samples.Add(int64(len(samples)))
+	return WriteStats{Written: len(samples)}, nil
+}
+
+// Name identifies the writer as dry run.
+func (d *DryRun) Name() string {
+	return "dry-run"
+}
+
+// HealthCheck always succeeds.
+func (d *DryRun) HealthCheck() error {
+	return nil
+}
+
+// Samples returns the number of samples written so far.
+func (d *DryRun) Samples() int64 {
+	return d.samples.Load()
+}
@@ -0,0 +1,65 @@
+package writers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestDryRun(t *testing.T) {
+	samples := model.Samples{{Timestamp: 1}, {Timestamp: 2}}
+	dryRun := NewDryRun(10*time.Millisecond, 0)
+	begin := time.Now()
+	stats, err := dryRun.WriteContext(context.Background(), samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 2 || stats.DroppedTotal() != 0 {
+		t.Errorf("Expected 2 samples written, got %+v", stats)
+	}
+	if elapsed := time.Since(begin); elapsed < 10*time.Millisecond {
+		t.Errorf("Expected the write to take the simulated latency, took %v", elapsed)
+	}
+	if _, err := dryRun.WriteContext(context.Background(), samples[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if n := dryRun.Samples(); n != 3 {
+		t.Errorf("Expected 3 samples, got %d", n)
+	}
+	if err := dryRun.HealthCheck(); err != nil {
+		t.Errorf("Expected dry run to be healthy, got %v", err)
+	}
+}
+
+func TestDryRunErrors(t *testing.T) {
+	dryRun := NewDryRun(0, 1)
+	if _, err := dryRun.WriteContext(context.Background(), model.Samples{{Timestamp: 1}}); !errors.Is(err, ErrDryRun) {
+		t.Errorf("Expected simulated error, got %v", err)
+	}
+	if n := dryRun.Samples(); n != 0 {
+		t.Errorf("Expected failed writes not to be counted, got %d samples", n)
+	}
+}
+
+func TestDryRunCanceled(t *testing.T) {
+	dryRun := NewDryRun(time.Hour, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dryRun.WriteContext(ctx, model.Samples{{Timestamp: 1}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the write to be canceled, got %v", err)
+	}
+}
+
+func TestWriteStats(t *testing.T) {
+	var stats WriteStats
+	stats.Drop("out_of_order", 2)
+	stats.Drop("invalid_utf8", 0)
+	stats.Drop("out_of_order", 1)
+	stats.Drop("quota", 4)
+	if len(stats.Dropped) != 2 || stats.Dropped["out_of_order"] != 3 || stats.DroppedTotal() != 7 {
+		t.Errorf("Unexpected dropped samples %v", stats.Dropped)
+	}
+}